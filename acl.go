@@ -0,0 +1,107 @@
+package desync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sort"
+)
+
+// Tags and version used in the Linux representation of POSIX ACLs, as stored
+// in the system.posix_acl_access and system.posix_acl_default xattrs.
+const (
+	posixACLVersion  = 2
+	posixACLUserObj  = 0x01
+	posixACLUser     = 0x02
+	posixACLGroupObj = 0x04
+	posixACLGroup    = 0x08
+	posixACLMask     = 0x10
+	posixACLOther    = 0x20
+	posixACLUndefID  = 0xffffffff
+)
+
+type posixACLEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// encodeAccessACL returns the xattr value of the access ACL of a node. The
+// user, mask and other permissions come from the mode. Returns nil if the ACL
+// has no entries beyond what the mode already represents.
+func encodeAccessACL(acl *ACL, mode os.FileMode) []byte {
+	if acl == nil || (len(acl.Users) == 0 && len(acl.Groups) == 0 && acl.GroupObj == nil) {
+		return nil
+	}
+	perm := uint16(mode.Perm())
+	groupObj := (perm >> 3) & 7
+	if acl.GroupObj != nil {
+		groupObj = uint16(acl.GroupObj.Permissions & 7)
+	}
+	entries := []posixACLEntry{
+		{tag: posixACLUserObj, perm: (perm >> 6) & 7, id: posixACLUndefID},
+		{tag: posixACLGroupObj, perm: groupObj, id: posixACLUndefID},
+		{tag: posixACLMask, perm: (perm >> 3) & 7, id: posixACLUndefID},
+		{tag: posixACLOther, perm: perm & 7, id: posixACLUndefID},
+	}
+	return encodePosixACL(append(entries, namedACLEntries(acl.Users, acl.Groups)...))
+}
+
+// encodeDefaultACL returns the xattr value of the default ACL of a directory,
+// or nil if it doesn't have one.
+func encodeDefaultACL(acl *ACL) []byte {
+	if acl == nil || acl.Default == nil {
+		return nil
+	}
+	d := acl.Default
+	named := namedACLEntries(acl.DefaultUsers, acl.DefaultGroups)
+	entries := []posixACLEntry{
+		{tag: posixACLUserObj, perm: uint16(d.UserObjPermissions & 7), id: posixACLUndefID},
+		{tag: posixACLGroupObj, perm: uint16(d.GroupObjPermissions & 7), id: posixACLUndefID},
+		{tag: posixACLOther, perm: uint16(d.OtherPermissions & 7), id: posixACLUndefID},
+	}
+	// The mask is optional in the archive (all bits set if absent), but
+	// required if there are named entries. Use the union of the group
+	// permissions in that case, same as setfacl does.
+	switch {
+	case d.MaskPermissions <= 7:
+		entries = append(entries, posixACLEntry{tag: posixACLMask, perm: uint16(d.MaskPermissions), id: posixACLUndefID})
+	case len(named) > 0:
+		mask := uint16(d.GroupObjPermissions & 7)
+		for _, e := range named {
+			mask |= e.perm
+		}
+		entries = append(entries, posixACLEntry{tag: posixACLMask, perm: mask, id: posixACLUndefID})
+	}
+	return encodePosixACL(append(entries, named...))
+}
+
+func namedACLEntries(users []FormatACLUser, groups []FormatACLGroup) []posixACLEntry {
+	var entries []posixACLEntry
+	for _, u := range users {
+		entries = append(entries, posixACLEntry{tag: posixACLUser, perm: uint16(u.Permissions & 7), id: uint32(u.UID)})
+	}
+	for _, g := range groups {
+		entries = append(entries, posixACLEntry{tag: posixACLGroup, perm: uint16(g.Permissions & 7), id: uint32(g.GID)})
+	}
+	return entries
+}
+
+// encodePosixACL sorts the entries by tag and ID, as required by the kernel,
+// and serializes them.
+func encodePosixACL(entries []posixACLEntry) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, uint32(posixACLVersion))
+	for _, e := range entries {
+		binary.Write(b, binary.LittleEndian, e.tag)
+		binary.Write(b, binary.LittleEndian, e.perm)
+		binary.Write(b, binary.LittleEndian, e.id)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,40 @@
+package desync
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+)
+
+// Extended attributes used by Linux to store file capabilities and ACLs
+const (
+	xattrCapability = "security.capability"
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+)
+
+// setFCaps applies file capabilities to a file. This needs to happen after any
+// change of ownership since chown() clears them.
+func setFCaps(path string, fcaps []byte) error {
+	if len(fcaps) == 0 {
+		return nil
+	}
+	return errors.Wrapf(xattr.Set(path, xattrCapability, fcaps), "set capabilities on %s", path)
+}
+
+// setACL applies the access ACL, and the default ACL for directories. Should be
+// called after chmod() since that updates the mask.
+func setACL(path string, mode os.FileMode, acl *ACL) error {
+	if b := encodeAccessACL(acl, mode); b != nil {
+		if err := xattr.Set(path, xattrACLAccess, b); err != nil {
+			return errors.Wrapf(err, "set ACL on %s", path)
+		}
+	}
+	if b := encodeDefaultACL(acl); b != nil {
+		if err := xattr.Set(path, xattrACLDefault, b); err != nil {
+			return errors.Wrapf(err, "set default ACL on %s", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package desync
+
+import "os"
+
+// File capabilities are only supported on Linux
+func setFCaps(path string, fcaps []byte) error {
+	return nil
+}
+
+// ACLs are only supported on Linux
+func setACL(path string, mode os.FileMode, acl *ACL) error {
+	return nil
+}
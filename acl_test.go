@@ -0,0 +1,54 @@
+package desync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeAccessACL(t *testing.T) {
+	// No extended ACL, nothing to set
+	require.Nil(t, encodeAccessACL(nil, 0644))
+	require.Nil(t, encodeAccessACL(&ACL{}, 0644))
+
+	acl := &ACL{
+		Users:    []FormatACLUser{{UID: 1001, Permissions: 6}, {UID: 1000, Permissions: 4}},
+		Groups:   []FormatACLGroup{{GID: 100, Permissions: 5}},
+		GroupObj: &FormatACLGroupObj{Permissions: 4},
+	}
+	expected := []byte{
+		0x02, 0x00, 0x00, 0x00, // version
+		0x01, 0x00, 0x07, 0x00, 0xff, 0xff, 0xff, 0xff, // user_obj rwx
+		0x02, 0x00, 0x04, 0x00, 0xe8, 0x03, 0x00, 0x00, // user:1000 r--
+		0x02, 0x00, 0x06, 0x00, 0xe9, 0x03, 0x00, 0x00, // user:1001 rw-
+		0x04, 0x00, 0x04, 0x00, 0xff, 0xff, 0xff, 0xff, // group_obj r--
+		0x08, 0x00, 0x05, 0x00, 0x64, 0x00, 0x00, 0x00, // group:100 r-x
+		0x10, 0x00, 0x07, 0x00, 0xff, 0xff, 0xff, 0xff, // mask rwx (from mode)
+		0x20, 0x00, 0x01, 0x00, 0xff, 0xff, 0xff, 0xff, // other --x
+	}
+	require.Equal(t, expected, encodeAccessACL(acl, 0771))
+}
+
+func TestEncodeDefaultACL(t *testing.T) {
+	require.Nil(t, encodeDefaultACL(&ACL{}))
+
+	// Without mask in the archive, it's calculated from the group entries
+	acl := &ACL{
+		Default: &FormatACLDefault{
+			UserObjPermissions:  7,
+			GroupObjPermissions: 4,
+			OtherPermissions:    0,
+			MaskPermissions:     ^uint64(0),
+		},
+		DefaultGroups: []FormatACLGroup{{GID: 100, Permissions: 2}},
+	}
+	expected := []byte{
+		0x02, 0x00, 0x00, 0x00, // version
+		0x01, 0x00, 0x07, 0x00, 0xff, 0xff, 0xff, 0xff, // user_obj rwx
+		0x04, 0x00, 0x04, 0x00, 0xff, 0xff, 0xff, 0xff, // group_obj r--
+		0x08, 0x00, 0x02, 0x00, 0x64, 0x00, 0x00, 0x00, // group:100 -w-
+		0x10, 0x00, 0x06, 0x00, 0xff, 0xff, 0xff, 0xff, // mask rw-
+		0x20, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, // other ---
+	}
+	require.Equal(t, expected, encodeDefaultACL(acl))
+}
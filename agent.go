@@ -0,0 +1,19 @@
+package desync
+
+import (
+	"net/url"
+)
+
+// NewAgentStore returns a store that reads and writes chunks through a desync
+// agent listening on the Unix socket at the given path. The agent holds the
+// cache, credentials and limits for the upstream stores and shares them between
+// all processes on the host, so options like encryption or the chunk layout
+// don't apply to the client. Chunks are transferred uncompressed since they
+// don't leave the host.
+func NewAgentStore(socket string, opt StoreOptions) (*RemoteHTTP, error) {
+	opt.Uncompressed = true
+	opt.EncryptionPassword = ""
+	opt.ChunkLayout = ""
+	location := &url.URL{Scheme: "http", Host: "desync-agent", Path: "/"}
+	return newRemoteHTTPStore(location, opt, "unix:"+socket)
+}
@@ -1,6 +1,7 @@
 package desync
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -13,6 +14,19 @@ import (
 
 type Xattrs map[string]string
 
+// ACL holds the POSIX access control lists of a node in a catar archive. The
+// user, group and other permissions of the access ACL are part of the mode.
+type ACL struct {
+	Users    []FormatACLUser
+	Groups   []FormatACLGroup
+	GroupObj *FormatACLGroupObj
+
+	// Default ACL, only present on directories
+	Default       *FormatACLDefault
+	DefaultUsers  []FormatACLUser
+	DefaultGroups []FormatACLGroup
+}
+
 // NodeDirectory represents a directory in a catar archive
 type NodeDirectory struct {
 	Name   string
@@ -21,6 +35,7 @@ type NodeDirectory struct {
 	Mode   os.FileMode
 	MTime  time.Time
 	Xattrs Xattrs
+	ACL    *ACL
 }
 
 // NodeFile holds file permissions and data in a catar archive
@@ -31,6 +46,8 @@ type NodeFile struct {
 	Name   string
 	MTime  time.Time
 	Xattrs Xattrs
+	ACL    *ACL
+	FCaps  []byte
 	Size   uint64
 	Data   io.Reader
 }
@@ -55,14 +72,35 @@ type NodeDevice struct {
 	Major  uint64
 	Minor  uint64
 	Xattrs Xattrs
+	ACL    *ACL
 	MTime  time.Time
 }
 
+// ArchiveDecoderOptions influence how strictly a catar archive is decoded.
+type ArchiveDecoderOptions struct {
+	// Confirm the goodbye element of every directory is a valid BST that
+	// references all entries in the directory with their correct offsets and
+	// sizes, like casync does. By default, goodbye elements are only used to
+	// find the end of a directory.
+	VerifyGoodbye bool
+}
+
 // ArchiveDecoder is used to decode a catar archive.
 type ArchiveDecoder struct {
 	d    FormatDecoder
 	dir  string
 	last interface{}
+	opt  ArchiveDecoderOptions
+
+	// Directories that are open while verifying goodbye elements
+	dirs []archiveDir
+}
+
+// Position of a directory in the stream and the goodbye items expected for
+// its entries.
+type archiveDir struct {
+	entry uint64
+	items []FormatGoodbyeItem
 }
 
 // NewArchiveDecoder initializes a decoder for a catar archive.
@@ -70,6 +108,18 @@ func NewArchiveDecoder(r io.Reader) ArchiveDecoder {
 	return ArchiveDecoder{d: NewFormatDecoder(r), dir: "."}
 }
 
+// NewArchiveDecoderContext initializes a decoder for a catar archive that can be
+// interrupted by cancelling the context, even while a file body is being read.
+func NewArchiveDecoderContext(ctx context.Context, r io.Reader) ArchiveDecoder {
+	return ArchiveDecoder{d: NewFormatDecoderContext(ctx, r), dir: "."}
+}
+
+// NewArchiveDecoderWithOptions initializes a decoder for a catar archive that
+// can be interrupted by cancelling the context.
+func NewArchiveDecoderWithOptions(ctx context.Context, r io.Reader, opt ArchiveDecoderOptions) ArchiveDecoder {
+	return ArchiveDecoder{d: NewFormatDecoderContext(ctx, r), dir: ".", opt: opt}
+}
+
 // Next returns a node from an archive, or nil if the end is reached. If NodeFile
 // is returned, the caller should read the file body before calling Next() again
 // as that invalidates the reader.
@@ -80,6 +130,8 @@ func (a *ArchiveDecoder) Next() (interface{}, error) {
 		symlink *FormatSymlink
 		device  *FormatDevice
 		xattrs  map[string]string
+		acl     *ACL
+		fcaps   []byte
 		name    string
 		c       interface{}
 		err     error
@@ -97,6 +149,11 @@ loop:
 			if err != nil {
 				return nil, err
 			}
+			if a.opt.VerifyGoodbye {
+				if err = a.verify(c); err != nil {
+					return nil, err
+				}
+			}
 		}
 
 		switch d := c.(type) {
@@ -109,10 +166,50 @@ loop:
 		case FormatGroup:
 		case FormatSELinux:
 		case FormatACLUser:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			if acl == nil {
+				acl = &ACL{}
+			}
+			if d.Type == CaFormatACLDefaultUser {
+				acl.DefaultUsers = append(acl.DefaultUsers, d)
+			} else {
+				acl.Users = append(acl.Users, d)
+			}
 		case FormatACLGroup:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			if acl == nil {
+				acl = &ACL{}
+			}
+			if d.Type == CaFormatACLDefaultGroup {
+				acl.DefaultGroups = append(acl.DefaultGroups, d)
+			} else {
+				acl.Groups = append(acl.Groups, d)
+			}
 		case FormatACLGroupObj:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			if acl == nil {
+				acl = &ACL{}
+			}
+			acl.GroupObj = &d
 		case FormatACLDefault:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			if acl == nil {
+				acl = &ACL{}
+			}
+			acl.Default = &d
 		case FormatFCaps:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			fcaps = d.Data
 		case FormatPayload:
 			if entry == nil {
 				return nil, InvalidFormat{}
@@ -168,6 +265,7 @@ loop:
 			Mode:   entry.Mode,
 			MTime:  entry.MTime,
 			Xattrs: xattrs,
+			ACL:    acl,
 		}, nil
 	}
 
@@ -180,6 +278,8 @@ loop:
 			Mode:   entry.Mode,
 			MTime:  entry.MTime,
 			Xattrs: xattrs,
+			ACL:    acl,
+			FCaps:  fcaps,
 			Size:   payload.Size - 16,
 			Data:   payload.Data,
 		}, nil
@@ -194,6 +294,7 @@ loop:
 			Mode:   entry.Mode,
 			MTime:  entry.MTime,
 			Xattrs: xattrs,
+			ACL:    acl,
 			Major:  device.Major,
 			Minor:  device.Minor,
 		}, nil
@@ -214,3 +315,45 @@ loop:
 
 	return nil, nil
 }
+
+// Records the positions of directories and their entries as elements are read
+// from the stream and validates each goodbye element against them.
+func (a *ArchiveDecoder) verify(c interface{}) error {
+	pos := a.d.pos
+
+	// Each entry in a directory ends where the next one, or the goodbye
+	// element, starts
+	closeEntry := func(d *archiveDir) {
+		if n := len(d.items); n > 0 && d.items[n-1].Size == 0 {
+			d.items[n-1].Size = pos - d.items[n-1].Offset
+		}
+	}
+
+	switch d := c.(type) {
+	case FormatEntry:
+		if d.Mode.IsDir() {
+			a.dirs = append(a.dirs, archiveDir{entry: pos})
+		}
+	case FormatFilename:
+		if len(a.dirs) == 0 {
+			return InvalidFormat{"filename outside of a directory"}
+		}
+		dir := &a.dirs[len(a.dirs)-1]
+		closeEntry(dir)
+		dir.items = append(dir.items, FormatGoodbyeItem{Offset: pos, Hash: SipHash([]byte(d.Name))})
+	case FormatGoodbye:
+		if len(a.dirs) == 0 {
+			return InvalidFormat{"goodbye outside of a directory"}
+		}
+		dir := &a.dirs[len(a.dirs)-1]
+		closeEntry(dir)
+		for i := range dir.items {
+			dir.items[i].Offset = pos - dir.items[i].Offset
+		}
+		if err := verifyGoodbye(d, dir.items, pos-dir.entry); err != nil {
+			return err
+		}
+		a.dirs = a.dirs[:len(a.dirs)-1]
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package desync
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
@@ -94,3 +97,51 @@ func TestArchiveDecoderNesting(t *testing.T) {
 		}
 	}
 }
+
+func TestArchiveDecoderVerifyGoodbye(t *testing.T) {
+	decode := func(b []byte, opt ArchiveDecoderOptions) error {
+		d := NewArchiveDecoderWithOptions(context.Background(), bytes.NewReader(b), opt)
+		for {
+			v, err := d.Next()
+			if v == nil || err != nil {
+				return err
+			}
+		}
+	}
+	strict := ArchiveDecoderOptions{VerifyGoodbye: true}
+
+	// Archives produced by casync are valid
+	for _, name := range []string{"flat.catar", "flatdir.catar", "nested.catar", "complex.catar"} {
+		b, err := ioutil.ReadFile(path.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := decode(b, strict); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	// Swap the first two items of the goodbye element at the end of the root
+	// directory, which breaks the ordering of the BST
+	b, err := ioutil.ReadFile("testdata/flat.catar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := len(b) - 120
+	item := append([]byte(nil), b[first:first+24]...)
+	copy(b[first:], b[first+24:first+48])
+	copy(b[first+24:], item)
+	if err := decode(b, ArchiveDecoderOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decode(b, strict).(InvalidFormat); !ok {
+		t.Fatal("expected invalid format error for malformed goodbye")
+	}
+
+	// Offset pointing to the wrong place
+	b, _ = ioutil.ReadFile("testdata/flat.catar")
+	b[first]++
+	if _, ok := decode(b, strict).(InvalidFormat); !ok {
+		t.Fatal("expected invalid format error for wrong goodbye offset")
+	}
+}
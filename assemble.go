@@ -2,9 +2,13 @@ package desync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/sync/errgroup"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 // InvalidSeedAction represent the action that we will take if a seed
@@ -23,21 +27,219 @@ const (
 type AssembleOptions struct {
 	N                 int
 	InvalidSeedAction InvalidSeedAction
+
+	// Optional, file to record which chunks have been written. If the target
+	// exists, chunks marked as done in a matching state file are skipped without
+	// verifying them, allowing an interrupted operation to be resumed. The file
+	// is removed once the operation completes.
+	StateFile string
+
+	// Number of times to retry getting a chunk from the store if it fails with
+	// any error other than ChunkMissing.
+	ChunkRetries int
+
+	// Delay before the first retry of a chunk, doubled with every further
+	// attempt up to maxChunkRetryInterval. No delay if 0.
+	ChunkRetryInterval time.Duration
+
+	// Don't abort when a chunk can't be retrieved from the store or is invalid.
+	// Failed chunks are recorded in ExtractStats and a ChunksFailed error is
+	// returned at the end, after everything else has been written.
+	ContinueOnChunkError bool
+
+	// Flush the data to disk before returning, so the output is complete even
+	// after a power failure.
+	Fsync bool
+
+	// Flush the directory of the output to disk if the file was created, to
+	// make sure it's persisted as well.
+	FsyncDir bool
+
+	// Number of goroutines fetching chunks from the store. Defaults to N.
+	FetchConcurrency int
+
+	// Number of goroutines writing into the output. Defaults to N.
+	WriteConcurrency int
+
+	// Maximum number of fetched chunks that can be waiting to be written,
+	// which limits the memory used when writing is slower than fetching.
+	// Defaults to twice the number of fetch goroutines.
+	FetchAhead int
+
+	// Optional, called for every chunk once it's been written to the output,
+	// or found to be in it already. Called concurrently from the writers.
+	OnChunk func(ChunkRecord)
+
+	// Block size of the output, used to align ranges cloned from seeds. Has
+	// to be a power of 2 of at least 512 if set. Detected from the output if
+	// 0, which can be wrong for stacked devices or some network filesystems.
+	BlockSize uint64
+
+	// How to check that there's enough free space for the output before
+	// writing to it. Block devices aren't checked. Not checked by default.
+	SpaceCheck SpaceCheck
+}
+
+// ChunkSource tells where a chunk in the output of AssembleFile came from.
+type ChunkSource string
+
+const (
+	ChunkSourceStore   ChunkSource = "store"    // fetched from the store
+	ChunkSourceCache   ChunkSource = "cache"    // found in the cache of the store
+	ChunkSourceSeed    ChunkSource = "seed"     // copied or cloned from a seed
+	ChunkSourceSelf    ChunkSource = "self"     // copied from elsewhere in the output
+	ChunkSourceInPlace ChunkSource = "in-place" // already in the output
+	ChunkSourceResumed ChunkSource = "resumed"  // written by an earlier operation
+)
+
+// ChunkRecord describes how a chunk was written to the output of AssembleFile.
+// For chunks from seeds, the duration is that of writing the whole segment,
+// divided by the number of chunks in it.
+type ChunkRecord struct {
+	ID       ChunkID
+	Start    uint64
+	Size     uint64
+	Source   ChunkSource
+	Duration time.Duration
+}
+
+// chunkFetchError is used internally to tell failures to get a chunk from
+// the store apart from failures to read or write the output.
+type chunkFetchError struct {
+	err error
+}
+
+func (e chunkFetchError) Error() string { return e.err.Error() }
+
+// Upper limit for the delay between two attempts to get a chunk.
+const maxChunkRetryInterval = time.Minute
+
+// Returns how long to wait before the given retry (starting at 1) of a chunk.
+func (o AssembleOptions) chunkRetryDelay(retry int) time.Duration {
+	d := o.ChunkRetryInterval
+	for i := 1; i < retry && d > 0 && d < maxChunkRetryInterval; i++ {
+		d *= 2
+	}
+	if d > maxChunkRetryInterval {
+		d = maxChunkRetryInterval
+	}
+	return d
+}
+
+// fetchChunk gets a chunk from the store and returns its data, retrying up to
+// the number of times set in the options with an exponential backoff. Also
+// returns if the chunk came from a cache.
+func fetchChunk(ctx context.Context, c IndexChunk, s Store, options AssembleOptions) ([]byte, ChunkSource, error) {
+	var err error
+	for attempt := 0; attempt <= options.ChunkRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, options.chunkRetryDelay(attempt)); err != nil {
+				return nil, ChunkSourceStore, err
+			}
+		}
+		var (
+			b      []byte
+			source ChunkSource
+		)
+		b, source, err = fetchChunkOnce(c, s)
+		if err == nil {
+			return b, source, nil
+		}
+		// No point retrying if the chunk doesn't exist or we're not allowed to read it
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnauthorized) {
+			break
+		}
+	}
+	return nil, ChunkSourceStore, chunkFetchError{err}
+}
+
+// Waits for d, or until ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func fetchChunkOnce(c IndexChunk, s Store) ([]byte, ChunkSource, error) {
+	// Pull the (compressed) chunk from the store, or its cache
+	var (
+		chunk *Chunk
+		err   error
+	)
+	source := ChunkSourceStore
+	if cache, ok := s.(Cache); ok {
+		var cached bool
+		chunk, cached, err = cache.getChunk(c.ID)
+		if cached {
+			source = ChunkSourceCache
+		}
+	} else {
+		chunk, err = s.GetChunk(c.ID)
+	}
+	if err != nil {
+		return nil, source, err
+	}
+	b, err := chunk.Data()
+	if err != nil {
+		return nil, source, err
+	}
+	// Might as well verify the chunk size while we're at it
+	if c.Size != uint64(len(b)) {
+		return nil, source, fmt.Errorf("unexpected size for chunk %s", c.ID.String())
+	}
+	return b, source, nil
+}
+
+// prefetchChunk is run ahead of writing a chunk into the file, to get it
+// from the store without being held up by the writes of others. Chunks that
+// are either in the self seed or already in the file are left for the writer
+// to deal with. So are repeated chunks, they're likely to be in the self seed
+// by the time they're written.
+func prefetchChunk(ctx context.Context, job *assembleJob, ss *selfSeed, seen *sync.Map, dc *digestCache, f *os.File, s Store, stats *ExtractStats, isBlank bool, options AssembleOptions) error {
+	c := job.segment.chunks()[0]
+	if ss.getChunk(c.ID) != nil {
+		return nil
+	}
+	if _, ok := seen.LoadOrStore(c.ID, struct{}{}); ok {
+		return nil
+	}
+	if !isBlank {
+		b := make([]byte, c.Size)
+		if _, err := f.ReadAt(b, int64(c.Start)); err != nil {
+			return err
+		}
+		if dc.verify(c.ID, b) {
+			job.inPlace = true
+			return nil
+		}
+	}
+	stats.incChunksFromStore()
+	job.fetched = true
+	start := time.Now()
+	job.data, job.from, job.err = fetchChunk(ctx, c, s, options)
+	job.duration = time.Since(start)
+	return nil
 }
 
 // writeChunk tries to write a chunk by looking at the self seed, if it is already existing in the
-// destination file or by taking it from the store
-func writeChunk(c IndexChunk, ss *selfSeed, f *os.File, blocksize uint64, s Store, stats *ExtractStats, isBlank bool) error {
+// destination file or by taking it from the store. Returns where the chunk came from.
+func writeChunk(ctx context.Context, c IndexChunk, ss *selfSeed, dc *digestCache, f *os.File, blocksize uint64, s Store, stats *ExtractStats, isBlank bool, options AssembleOptions) (ChunkSource, error) {
 	// If we already took this chunk from the store we can reuse it by looking
 	// into the selfSeed.
 	if segment := ss.getChunk(c.ID); segment != nil {
-		copied, cloned, err := segment.WriteInto(f, c.Start, c.Size, blocksize, isBlank)
+		copied, cloned, fallback, err := writeSeedSegment(segment, f, c.Start, c.Size, blocksize, isBlank)
 		if err != nil {
-			return err
+			return ChunkSourceSelf, err
 		}
 		stats.addBytesCopied(copied)
 		stats.addBytesCloned(cloned)
-		return nil
+		stats.addBytesFallback(fallback)
+		return ChunkSourceSelf, nil
 	}
 
 	// If we operate on an existing file there's a good chance we already
@@ -46,56 +248,95 @@ func writeChunk(c IndexChunk, ss *selfSeed, f *os.File, blocksize uint64, s Stor
 	if !isBlank {
 		b := make([]byte, c.Size)
 		if _, err := f.ReadAt(b, int64(c.Start)); err != nil {
-			return err
+			return ChunkSourceInPlace, err
 		}
-		sum := Digest.Sum(b)
-		if sum == c.ID {
+		if dc.verify(c.ID, b) {
 			// Record we kept this chunk in the file (when using in-place extract)
 			stats.incChunksInPlace()
-			return nil
+			return ChunkSourceInPlace, nil
 		}
 	}
 	// Record this chunk having been pulled from the store
 	stats.incChunksFromStore()
-	// Pull the (compressed) chunk from the store
-	chunk, err := s.GetChunk(c.ID)
+	b, source, err := fetchChunk(ctx, c, s, options)
 	if err != nil {
-		return err
+		return source, err
 	}
-	b, err := chunk.Data()
-	if err != nil {
-		return err
+	// Write the decompressed chunk into the file at the right position
+	_, err = f.WriteAt(b, int64(c.Start))
+	return source, err
+}
+
+// assembleJob is a part of the file passed from the fetchers to the writers,
+// either with a seed to copy it from, or with the chunk from the store.
+type assembleJob struct {
+	segment IndexSegment
+	source  SeedSegment
+
+	// Set by the fetchers for single chunks without seed
+	inPlace  bool
+	fetched  bool
+	from     ChunkSource
+	duration time.Duration
+	data     []byte
+	err      error
+}
+
+// Returns the number of bytes that need to be allocated to grow an output of
+// the given size to the index. In sparse mode, null chunks aren't counted.
+func spaceRequired(idx Index, size int64, sparse bool) uint64 {
+	length := idx.Length()
+	if size >= length {
+		return 0
 	}
-	// Might as well verify the chunk size while we're at it
-	if c.Size != uint64(len(b)) {
-		return fmt.Errorf("unexpected size for chunk %s", c.ID)
+	if !sparse {
+		return uint64(length - size)
 	}
-	// Write the decompressed chunk into the file at the right position
-	if _, err = f.WriteAt(b, int64(c.Start)); err != nil {
-		return err
+	var required uint64
+	nullID := newNullChunk(idx.Index.ChunkSizeMax, idx.digest()).ID
+	for _, c := range idx.Chunks {
+		if c.ID != nullID {
+			required += c.Size
+		}
 	}
-	return nil
+	return required
 }
 
-// AssembleFile re-assembles a file based on a list of index chunks. It runs n
-// goroutines, creating one filehandle for the file "name" per goroutine
-// and writes to the file simultaneously. If progress is provided, it'll be
-// called when a chunk has been processed.
+// AssembleFile re-assembles a file based on a list of index chunks. Chunks are
+// fetched from the store by one set of goroutines and written by another, so
+// that slow writes don't hold up downloads and the other way around. Each of
+// the writers has its own filehandle for the file "name" and writes to it
+// simultaneously. The number of chunks fetched ahead of being written is
+// limited by options.FetchAhead.
 // If the input file exists and is not empty, the algorithm will first
 // confirm if the data matches what is expected and only populate areas that
 // differ from the expected content. This can be used to complete partly
-// written files.
+// written files. Use options.StateFile to avoid having to confirm data that was
+// already written by an interrupted operation.
 func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []Seed, options AssembleOptions) (*ExtractStats, error) {
-	type Job struct {
-		segment IndexSegment
-		source  SeedSegment
+	if options.BlockSize != 0 && !IsValidBlockSize(options.BlockSize) {
+		return nil, fmt.Errorf("invalid block size %d, needs to be a power of 2 of at least 512", options.BlockSize)
+	}
+	fetchN := options.FetchConcurrency
+	if fetchN <= 0 {
+		fetchN = options.N
+	}
+	writeN := options.WriteConcurrency
+	if writeN <= 0 {
+		writeN = options.N
+	}
+	fetchAhead := options.FetchAhead
+	if fetchAhead <= 0 {
+		fetchAhead = 2 * fetchN
 	}
 	var (
-		attempt     = 1
-		in          = make(chan Job)
+		in          = make(chan *assembleJob)
+		fetched     = make(chan *assembleJob, fetchAhead)
+		isCreated   bool
 		isBlank     bool
 		isBlkDevice bool
 		pb          ProgressBar
+		state       *assembleState
 	)
 	g, ctx := errgroup.WithContext(ctx)
 
@@ -114,6 +355,7 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 			return stats, err
 		}
 		f.Close()
+		isCreated = true
 		isBlank = true
 	case err != nil: // Some other error => bail
 		return stats, err
@@ -123,6 +365,22 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 		isBlank = true
 	}
 
+	// Fail early with a clear error if the filesystem can't hold the output,
+	// rather than running out of space halfway through
+	if !isBlkDevice && options.SpaceCheck != SpaceCheckNone {
+		var size int64
+		if info != nil && !isCreated {
+			size = info.Size()
+		}
+		required := spaceRequired(idx, size, isBlank && options.SpaceCheck == SpaceCheckSparse)
+		if err := CheckFreeSpace(filepath.Dir(name), required); err != nil {
+			if isCreated {
+				os.Remove(name)
+			}
+			return stats, err
+		}
+	}
+
 	// Truncate the output file to the full expected size. Not only does this
 	// confirm there's enough disk space, but it allows for an optimization
 	// when dealing with the Null Chunk
@@ -132,12 +390,33 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 		}
 	}
 
+	// Load the state of a previous operation. It's only valid if the target
+	// already had data in it.
+	if options.StateFile != "" {
+		state, err = newAssembleState(options.StateFile, name, idx)
+		if err != nil {
+			return stats, err
+		}
+		if !isBlank {
+			n, err := state.load()
+			if err != nil {
+				return stats, err
+			}
+			if n > 0 {
+				Log.WithField("chunks", n).Info("resuming from state file")
+			}
+		}
+	}
+
 	// Determine the blocksize of the target file which is required for reflinking
-	blocksize := blocksizeOfFile(name)
+	blocksize := options.BlockSize
+	if blocksize == 0 {
+		blocksize = blocksizeOfFile(name)
+	}
 
 	// Prepend a nullchunk seed to the list of seeds to make sure we read that
 	// before any large null sections in other seed files
-	ns, err := newNullChunkSeed(name, blocksize, idx.Index.ChunkSizeMax)
+	ns, err := newNullChunkSeed(name, blocksize, idx.Index.ChunkSizeMax, idx.digest())
 	if err != nil {
 		return stats, err
 	}
@@ -156,55 +435,151 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 	stats.Seeds = len(seeds)
 	stats.Blocksize = blocksize
 
-	// Start the workers, each having its own filehandle to write concurrently
-	for i := 0; i < options.N; i++ {
+	// Chunks that are repeated in the blob, like null chunks, are verified again
+	// every time they're read back from the output. Remember recently verified
+	// ones to avoid calculating their digest each time.
+	dc := newDigestCache(assembleDigestCacheSize, idx.digest())
+
+	// Report chunks that were written if requested
+	record := func(c IndexChunk, source ChunkSource, d time.Duration) {
+		if options.OnChunk != nil {
+			options.OnChunk(ChunkRecord{ID: c.ID, Start: c.Start, Size: c.Size, Source: source, Duration: d})
+		}
+	}
+
+	// Decide if an error writing a chunk should abort the operation, or if the
+	// chunk is recorded as failed to continue with the rest.
+	chunkFailed := func(c IndexChunk, err error) error {
+		if fErr, ok := err.(chunkFetchError); ok {
+			if !options.ContinueOnChunkError {
+				return fErr.err
+			}
+			Log.WithError(fErr.err).WithField("ID", c.ID).Warning("failed to write chunk, continuing")
+			stats.addFailedChunk(c, fErr.err)
+			return nil
+		}
+		return err
+	}
+
+	// Start the fetchers which get chunks from the store ahead of them being
+	// written. They share a filehandle to look for chunks already in the file.
+	rf, err := os.Open(name)
+	if err != nil {
+		return stats, fmt.Errorf("unable to open file %s, %s", name, err)
+	}
+	defer rf.Close()
+	var seen sync.Map
+	fg, fctx := errgroup.WithContext(ctx)
+	for i := 0; i < fetchN; i++ {
+		fg.Go(func() error {
+			for job := range in {
+				if job.source == nil && !state.isDone(job.segment) {
+					if len(job.segment.chunks()) != 1 {
+						panic("Received an unexpected segment that doesn't contain just a single chunk")
+					}
+					if err := prefetchChunk(fctx, job, ss, &seen, dc, rf, s, stats, isBlank, options); err != nil {
+						return err
+					}
+				}
+				select {
+				case <-fctx.Done():
+					return fctx.Err()
+				case fetched <- job:
+				}
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		defer close(fetched)
+		return fg.Wait()
+	})
+
+	// Start the writers, each having its own filehandle to write concurrently
+	for i := 0; i < writeN; i++ {
 		f, err := os.OpenFile(name, os.O_RDWR, 0666)
 		if err != nil {
 			return stats, fmt.Errorf("unable to open file %s, %s", name, err)
 		}
 		defer f.Close()
 		g.Go(func() error {
-			for job := range in {
-				pb.Add(job.segment.lengthChunks())
+			for job := range fetched {
+				pb.Add(int64(job.segment.lengthChunks()))
+
+				// Skip anything that was written by a previous operation
+				if state.isDone(job.segment) {
+					stats.addChunksResumed(uint64(job.segment.lengthChunks()))
+					ss.add(job.segment)
+					for _, c := range job.segment.chunks() {
+						record(c, ChunkSourceResumed, 0)
+					}
+					continue
+				}
+
 				if job.source != nil {
 					// If we have a seedSegment we expect 1 or more chunks between
 					// the start and the end of this segment.
 					stats.addChunksFromSeed(uint64(job.segment.lengthChunks()))
 					offset := job.segment.start()
 					length := job.segment.lengthBytes()
-					copied, cloned, err := job.source.WriteInto(f, offset, length, blocksize, isBlank)
+					start := time.Now()
+					copied, cloned, fallback, err := writeSeedSegment(job.source, f, offset, length, blocksize, isBlank)
+					// Seeds that aren't local files, like a blob on a mirror, can
+					// be unavailable or outdated. Fall back to the store for their
+					// chunks rather than failing.
+					remote := job.source.FileName() == ""
 					if err != nil {
-						return err
+						if !remote {
+							return err
+						}
+						Log.WithError(err).Info("Unable to read from seed, taking the chunks from the self seed or the store")
 					}
+					perChunk := time.Since(start) / time.Duration(job.segment.lengthChunks())
 
 					// Validate that the written chunks are exactly what we were expecting.
 					// Because the seed might point to a RW location, if the data changed
 					// while we were extracting an index, we might end up writing to the
 					// destination some unexpected values.
+					var failed bool
+					crcs := seedSegmentCRCs(job.source)
 					for _, c := range job.segment.chunks() {
 						b := make([]byte, c.Size)
 						if _, err := f.ReadAt(b, int64(c.Start)); err != nil {
 							return err
 						}
-						sum := Digest.Sum(b)
-						if sum != c.ID {
-							if options.InvalidSeedAction == InvalidSeedActionRegenerate {
-								// Try harder before giving up and aborting
-								Log.WithField("ID", c.ID).Info("The seed may have changed during processing, trying to take the chunk from the self seed or the store")
-								if err := writeChunk(c, ss, f, blocksize, s, stats, isBlank); err != nil {
-									return err
-								}
-							} else {
-								return fmt.Errorf("written data in %s doesn't match its expected hash value, seed may have changed during processing", name)
+						if crcs.match(c.ID, b) || dc.verify(c.ID, b) {
+							record(c, ChunkSourceSeed, perChunk)
+							continue
+						}
+						if options.InvalidSeedAction != InvalidSeedActionRegenerate && !remote {
+							return fmt.Errorf("written data in %s doesn't match its expected hash value, seed may have changed during processing", name)
+						}
+						// Try harder before giving up and aborting
+						Log.WithField("ID", c.ID).Info("The seed may have changed during processing, trying to take the chunk from the self seed or the store")
+						start := time.Now()
+						source, err := writeChunk(ctx, c, ss, dc, f, blocksize, s, stats, isBlank, options)
+						if err != nil {
+							if err := chunkFailed(c, err); err != nil {
+								return err
 							}
+							failed = true
+							continue
 						}
+						record(c, source, time.Since(start))
 					}
 
 					stats.addBytesCopied(copied)
 					stats.addBytesCloned(cloned)
+					stats.addBytesFallback(fallback)
 					// Record this segment's been written in the self-seed to make it
-					// available going forward
+					// available going forward. If some of it is missing, it's only
+					// skipped so the self-seed can move past it.
+					if failed {
+						ss.skip(job.segment)
+						continue
+					}
 					ss.add(job.segment)
+					state.markDone(job.segment)
 					continue
 				}
 
@@ -216,8 +591,31 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 				}
 				c := job.segment.chunks()[0]
 
-				if err := writeChunk(c, ss, f, blocksize, s, stats, isBlank); err != nil {
-					return err
+				var (
+					err    error
+					source ChunkSource
+				)
+				start := time.Now()
+				switch {
+				case job.inPlace:
+					source = ChunkSourceInPlace
+					stats.incChunksInPlace()
+				case job.fetched:
+					source, err = job.from, job.err
+					if err == nil {
+						_, err = f.WriteAt(job.data, int64(c.Start))
+					}
+				default: // In the self-seed, or repeated and left to be copied from it
+					source, err = writeChunk(ctx, c, ss, dc, f, blocksize, s, stats, isBlank, options)
+				}
+				if err != nil {
+					if err := chunkFailed(c, err); err != nil {
+						return err
+					}
+					// Don't record the chunk as written, but let the self-seed
+					// move past it
+					ss.skip(job.segment)
+					continue
 				}
 
 				// Record this chunk's been written in the self-seed.
@@ -225,6 +623,8 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 				// self-seed, we still need to record it as being written, otherwise
 				// the self-seed position pointer doesn't advance as we expect.
 				ss.add(job.segment)
+				state.markDone(job.segment)
+				record(c, source, job.duration+time.Since(start))
 			}
 			return nil
 		})
@@ -233,6 +633,76 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 	// Let the sequencer break up the index into segments, create and validate a plan,
 	// feed the workers, and stop if there are any errors
 	seq := NewSeedSequencer(idx, seeds...)
+	plan, attempt, err := validPlan(ctx, seq, options)
+	if err != nil {
+		return stats, err
+	}
+
+	pb = NewProgressBar(fmt.Sprintf("Attempt %d: Assembling ", attempt))
+	pb.SetTotal(int64(len(idx.Chunks)))
+	pb.Start()
+	defer pb.Finish()
+
+	// Save the state periodically to be able to resume after a crash
+	stopSaving := make(chan struct{})
+	savingDone := make(chan struct{})
+	go func() {
+		defer close(savingDone)
+		if state == nil {
+			return
+		}
+		ticker := time.NewTicker(assembleStateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopSaving:
+				return
+			case <-ticker.C:
+				if err := state.save(); err != nil {
+					Log.WithError(err).Warning("failed to save state")
+				}
+			}
+		}
+	}()
+
+loop:
+	for _, segment := range plan {
+		select {
+		case <-ctx.Done():
+			break loop
+		case in <- &assembleJob{segment: segment.indexSegment, source: segment.source}:
+		}
+	}
+	close(in)
+
+	err = g.Wait()
+	if err == nil {
+		err = stats.failed()
+	}
+	if err == nil && options.Fsync {
+		err = SyncFile(name)
+	}
+	if err == nil && options.FsyncDir && isCreated {
+		err = SyncDir(filepath.Dir(name))
+	}
+	close(stopSaving)
+	<-savingDone
+
+	// Clean up the state when done, or save it so the operation can be resumed
+	if err == nil {
+		return stats, state.remove()
+	}
+	if sErr := state.save(); sErr != nil {
+		Log.WithError(sErr).Warning("failed to save state")
+	}
+	return stats, err
+}
+
+// Creates plans with the sequencer until one is found where all segments from
+// seeds are valid. Invalid seeds are handled according to the options. Returns
+// the plan and the number of attempts it took.
+func validPlan(ctx context.Context, seq *SeedSequencer, options AssembleOptions) (Plan, int, error) {
+	attempt := 1
 	plan := seq.Plan()
 	for {
 		validatingPrefix := fmt.Sprintf("Attempt %d: Validating ", attempt)
@@ -240,11 +710,11 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 			// This plan has at least one invalid seed
 			switch options.InvalidSeedAction {
 			case InvalidSeedActionBailOut:
-				return stats, err
+				return nil, attempt, err
 			case InvalidSeedActionRegenerate:
 				Log.WithError(err).Info("Unable to use one of the chosen seeds, regenerating it")
 				if err := seq.RegenerateInvalidSeeds(ctx, options.N, attempt); err != nil {
-					return stats, err
+					return nil, attempt, err
 				}
 			case InvalidSeedActionSkip:
 				// Recreate the plan. This time the seed marked as invalid will be skipped
@@ -259,23 +729,6 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 			continue
 		}
 		// Found a valid plan
-		break
-	}
-
-	pb = NewProgressBar(fmt.Sprintf("Attempt %d: Assembling ", attempt))
-	pb.SetTotal(len(idx.Chunks))
-	pb.Start()
-	defer pb.Finish()
-
-loop:
-	for _, segment := range plan {
-		select {
-		case <-ctx.Done():
-			break loop
-		case in <- Job{segment.indexSegment, segment.source}:
-		}
+		return plan, attempt, nil
 	}
-	close(in)
-
-	return stats, g.Wait()
 }
@@ -5,12 +5,15 @@ import (
 	"context"
 	"crypto/md5"
 	"crypto/rand"
+	"errors"
 	"github.com/stretchr/testify/require"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestExtract(t *testing.T) {
@@ -130,7 +133,7 @@ func TestExtract(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			defer os.Remove(test.outfile)
 			if _, err := AssembleFile(context.Background(), test.outfile, index, test.store, nil,
-				AssembleOptions{10, InvalidSeedActionBailOut},
+				AssembleOptions{N: 10, InvalidSeedAction: InvalidSeedActionBailOut},
 			); err != nil {
 				t.Fatal(err)
 			}
@@ -273,7 +276,7 @@ func TestSeed(t *testing.T) {
 			}
 
 			if _, err := AssembleFile(context.Background(), dst.Name(), dstIndex, s, seeds,
-				AssembleOptions{10, InvalidSeedActionBailOut},
+				AssembleOptions{N: 10, InvalidSeedAction: InvalidSeedActionBailOut},
 			); err != nil {
 				t.Fatal(err)
 			}
@@ -334,7 +337,7 @@ func TestExtractWithNonStaticSeeds(t *testing.T) {
 	err = plan.Validate(context.Background(), n, NullProgressBar{})
 	require.NoError(t, err)
 
-	options := AssembleOptions{n, InvalidSeedActionRegenerate}
+	options := AssembleOptions{N: n, InvalidSeedAction: InvalidSeedActionRegenerate}
 	_, err = AssembleFile(context.Background(), out, index, store, seeds, options)
 	require.NoError(t, err)
 
@@ -342,3 +345,203 @@ func TestExtractWithNonStaticSeeds(t *testing.T) {
 	err = VerifyIndex(context.Background(), out, index, n, NullProgressBar{})
 	require.NoError(t, err)
 }
+
+func TestExtractResumeWithState(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	stateFile := filepath.Join(dir, "state")
+
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	src, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+
+	// Fail after a few chunks were pulled from the store
+	var requests int64
+	failing := &TestStore{
+		GetChunkFunc: func(id ChunkID) (*Chunk, error) {
+			if atomic.AddInt64(&requests, 1) > 10 {
+				return nil, errors.New("connection lost")
+			}
+			return src.GetChunk(id)
+		},
+	}
+	opt := AssembleOptions{N: 1, StateFile: stateFile}
+	_, err = AssembleFile(context.Background(), out, index, failing, nil, opt)
+	require.Error(t, err)
+	_, err = os.Stat(stateFile)
+	require.NoError(t, err)
+
+	// Resume, the chunks written before shouldn't need to be checked again
+	stats, err := AssembleFile(context.Background(), out, index, src, nil, opt)
+	require.NoError(t, err)
+	require.NotZero(t, stats.ChunksResumed)
+
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+
+	// The state should be gone after success
+	_, err = os.Stat(stateFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestExtractContinueOnChunkError(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	src, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+
+	// Make one of the chunks unavailable
+	missing := index.Chunks[len(index.Chunks)/2].ID
+	s := &TestStore{
+		GetChunkFunc: func(id ChunkID) (*Chunk, error) {
+			if id == missing {
+				return nil, ChunkMissing{id}
+			}
+			return src.GetChunk(id)
+		},
+	}
+	stats, err := AssembleFile(context.Background(), out, index, s, nil, AssembleOptions{N: 10, ContinueOnChunkError: true})
+	require.IsType(t, ChunksFailed{}, err)
+	failed := err.(ChunksFailed).Chunks
+	require.NotEmpty(t, failed)
+	require.Equal(t, stats.FailedChunks, failed)
+
+	// Everything but the failed ranges should have been written
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Len(t, b, len(expected))
+	for _, c := range failed {
+		require.Equal(t, missing, c.ID)
+		copy(b[c.Start:c.Start+c.Size], expected[c.Start:c.Start+c.Size])
+	}
+	require.Equal(t, expected, b)
+}
+
+func TestExtractChunkRetries(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+	src, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+
+	// Fail every other request
+	var requests int64
+	s := &TestStore{
+		GetChunkFunc: func(id ChunkID) (*Chunk, error) {
+			if atomic.AddInt64(&requests, 1)%2 == 0 {
+				return nil, errors.New("temporary failure")
+			}
+			return src.GetChunk(id)
+		},
+	}
+	_, err = AssembleFile(context.Background(), out, index, s, nil, AssembleOptions{N: 1})
+	require.Error(t, err)
+
+	require.NoError(t, os.Remove(out))
+	_, err = AssembleFile(context.Background(), out, index, s, nil, AssembleOptions{N: 1, ChunkRetries: 1, ChunkRetryInterval: time.Millisecond})
+	require.NoError(t, err)
+}
+
+func TestFetchChunkCancel(t *testing.T) {
+	s := &TestStore{
+		GetChunkFunc: func(id ChunkID) (*Chunk, error) {
+			return nil, errors.New("temporary failure")
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Retries don't wait out the delay once the context is cancelled
+	start := time.Now()
+	_, _, err := fetchChunk(ctx, IndexChunk{}, s, AssembleOptions{ChunkRetries: 3, ChunkRetryInterval: time.Minute})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, time.Since(start), time.Minute)
+}
+
+func TestChunkRetryDelay(t *testing.T) {
+	o := AssembleOptions{ChunkRetryInterval: time.Second}
+	require.Equal(t, time.Second, o.chunkRetryDelay(1))
+	require.Equal(t, 2*time.Second, o.chunkRetryDelay(2))
+	require.Equal(t, 8*time.Second, o.chunkRetryDelay(4))
+	require.Equal(t, maxChunkRetryInterval, o.chunkRetryDelay(1000))
+	require.Zero(t, AssembleOptions{}.chunkRetryDelay(3))
+}
+
+func TestExtractFsync(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	s, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+
+	_, err = AssembleFile(context.Background(), out, index, s, nil, AssembleOptions{N: 10, Fsync: true, FsyncDir: true})
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+}
+
+func TestExtractFetchAhead(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	src, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+
+	// Record how many chunks are being fetched at the same time
+	var active, maxActive int64
+	s := &TestStore{
+		GetChunkFunc: func(id ChunkID) (*Chunk, error) {
+			n := atomic.AddInt64(&active, 1)
+			defer atomic.AddInt64(&active, -1)
+			for {
+				m := atomic.LoadInt64(&maxActive)
+				if n <= m || atomic.CompareAndSwapInt64(&maxActive, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			return src.GetChunk(id)
+		},
+	}
+
+	// A single writer shouldn't limit the number of concurrent fetches
+	_, err = AssembleFile(context.Background(), out, index, s, nil, AssembleOptions{
+		N:                1,
+		FetchConcurrency: 4,
+		WriteConcurrency: 1,
+		FetchAhead:       4,
+	})
+	require.NoError(t, err)
+	require.Greater(t, atomic.LoadInt64(&maxActive), int64(1))
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+}
+
+func TestExtractBlockSize(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	s, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+	seed, err := NewIndexSeed(out, "testdata/blob2", readCaibxFile(t, "testdata/blob2.caibx"))
+	require.NoError(t, err)
+
+	// Block sizes that aren't a power of 2 are rejected
+	_, err = AssembleFile(context.Background(), out, index, s, []Seed{seed}, AssembleOptions{N: 10, BlockSize: 3000})
+	require.Error(t, err)
+
+	_, err = AssembleFile(context.Background(), out, index, s, []Seed{seed}, AssembleOptions{N: 10, BlockSize: 65536})
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+}
@@ -0,0 +1,145 @@
+package desync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/folbricht/tempfile"
+)
+
+// How often the state of an extract operation is saved while running
+const assembleStateInterval = 10 * time.Second
+
+// assembleState tracks which chunks of an index have been written to the target
+// of AssembleFile, and saves it to a file to allow resuming an interrupted
+// operation without verifying the target again. The state file contains the
+// digest of the index followed by a ChunkBitmap of the chunks that have been
+// written. All methods are no-ops when called on a nil state.
+type assembleState struct {
+	name   string // state file
+	target string // file being assembled
+	sum    ChunkID
+	mu     sync.Mutex
+	done   ChunkBitmap
+}
+
+func newAssembleState(name, target string, idx Index) (*assembleState, error) {
+	b := new(bytes.Buffer)
+	if _, err := idx.WriteTo(b); err != nil {
+		return nil, err
+	}
+	return &assembleState{
+		name:   name,
+		target: target,
+		sum:    idx.digest().Sum(b.Bytes()),
+		done:   NewChunkBitmap(len(idx.Chunks)),
+	}, nil
+}
+
+// load reads a previously saved state. Returns the number of chunks that are
+// already written. A missing state file, or one for a different index is
+// ignored.
+func (s *assembleState) load() (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	b, err := os.ReadFile(s.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(b) != len(s.sum)+len(s.done) || !bytes.Equal(b[:len(s.sum)], s.sum[:]) {
+		Log.WithField("file", s.name).Warning("state file doesn't match the index, ignoring it")
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.done, b[len(s.sum):])
+	var n int
+	for i := 0; i < len(s.done)*8; i++ {
+		if s.done.Has(i) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// isDone returns true if all chunks in the segment have already been written.
+func (s *assembleState) isDone(segment IndexSegment) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := segment.first; i <= segment.last; i++ {
+		if !s.done.Has(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// markDone records all chunks in the segment as written.
+func (s *assembleState) markDone(segment IndexSegment) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := segment.first; i <= segment.last; i++ {
+		s.done.Set(i)
+	}
+}
+
+// save flushes the target to disk and then writes the state file. Only chunks
+// that were recorded before the flush are marked as done in the file.
+func (s *assembleState) save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	b := append(append([]byte{}, s.sum[:]...), s.done...)
+	s.mu.Unlock()
+
+	f, err := os.OpenFile(s.target, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	// Write the state to a temp file and rename it to not end up with a
+	// partial state if interrupted
+	tmp, err := tempfile.NewMode(filepath.Dir(s.name), "."+filepath.Base(s.name), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.name)
+}
+
+// remove deletes the state file once it's no longer needed.
+func (s *assembleState) remove() error {
+	if s == nil {
+		return nil
+	}
+	if err := os.Remove(s.name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
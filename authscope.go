@@ -0,0 +1,76 @@
+package desync
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// AuthScope grants clients sending a matching Authorization header access to
+// the requests under a path prefix of a HTTP chunk or index server. A scope
+// without authorization applies to all clients.
+type AuthScope struct {
+	Prefix        string `json:"prefix"`
+	Authorization string `json:"authorization,omitempty"`
+	Writable      bool   `json:"writable,omitempty"`
+}
+
+// Compares the Authorization header of a request to an expected value in
+// constant time.
+func authorizationEqual(expected, auth string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(auth)) == 1
+}
+
+// Returns true if the scope covers the given request path.
+func (s AuthScope) covers(p string) bool {
+	prefix := strings.TrimSuffix(s.Prefix, "/") + "/"
+	return strings.HasPrefix(p, prefix)
+}
+
+// ScopeAuthorizer authorizes requests to HTTP chunk or index servers based on
+// a list of scopes. Its Authorize method can be used in HTTPHandlerOptions and
+// HTTPIndexHandlerOptions. GET and HEAD requests are allowed if any scope of the
+// client covers the path, all other requests need a writable scope. Without any
+// scopes, all requests are allowed. The scopes can be replaced while the server
+// is running.
+type ScopeAuthorizer struct {
+	mu     sync.RWMutex
+	scopes []AuthScope
+}
+
+// NewScopeAuthorizer returns an authorizer for the given scopes.
+func NewScopeAuthorizer(scopes []AuthScope) *ScopeAuthorizer {
+	return &ScopeAuthorizer{scopes: scopes}
+}
+
+// SetScopes replaces the scopes, for example after the configuration was
+// reloaded.
+func (a *ScopeAuthorizer) SetScopes(scopes []AuthScope) {
+	a.mu.Lock()
+	a.scopes = scopes
+	a.mu.Unlock()
+}
+
+// Authorize returns true if one of the scopes allows the request.
+func (a *ScopeAuthorizer) Authorize(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.scopes) == 0 {
+		return true
+	}
+	for _, s := range a.scopes {
+		if s.Authorization != "" && !authorizationEqual(s.Authorization, auth) {
+			continue
+		}
+		if write && !s.Writable {
+			continue
+		}
+		if s.covers(r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package desync
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScopeAuthorizer(t *testing.T) {
+	a := NewScopeAuthorizer([]AuthScope{
+		{Prefix: "/a/", Authorization: "team-a", Writable: true},
+		{Prefix: "/", Authorization: "team-a"},
+		{Prefix: "/b", Authorization: "team-b", Writable: true},
+		{Prefix: "/public/"},
+	})
+
+	tests := map[string]struct {
+		method string
+		path   string
+		auth   string
+		ok     bool
+	}{
+		"write own prefix":          {"PUT", "/a/0000/0000.cacnk", "team-a", true},
+		"read other prefix":         {"GET", "/b/0000/0000.cacnk", "team-a", true},
+		"write other prefix":        {"PUT", "/b/0000/0000.cacnk", "team-a", false},
+		"no access outside scope":   {"GET", "/a/0000/0000.cacnk", "team-b", false},
+		"prefix without slash":      {"PUT", "/b/0000/0000.cacnk", "team-b", true},
+		"prefix is not a substring": {"GET", "/bb/0000/0000.cacnk", "team-b", false},
+		"anonymous read":            {"HEAD", "/public/0000/0000.cacnk", "", true},
+		"anonymous write":           {"PUT", "/public/0000/0000.cacnk", "", false},
+		"unknown client":            {"GET", "/a/0000/0000.cacnk", "team-c", false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.path, nil)
+			if test.auth != "" {
+				r.Header.Set("Authorization", test.auth)
+			}
+			require.Equal(t, test.ok, a.Authorize(r))
+		})
+	}
+
+	// Replacing the scopes takes effect immediately
+	a.SetScopes([]AuthScope{{Prefix: "/a/", Authorization: "team-a"}})
+	r := httptest.NewRequest("GET", "/public/0000/0000.cacnk", nil)
+	require.False(t, a.Authorize(r))
+
+	// Without scopes, all requests are allowed
+	a.SetScopes(nil)
+	require.True(t, a.Authorize(r))
+}
@@ -0,0 +1,215 @@
+package desync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var _ ChunkLister = &BandwidthLimitedStore{}
+var _ BatchWriteStore = &BandwidthLimitedWriteStore{}
+
+// Largest number of bytes read from a limited stream at once, so a transfer
+// can't get ahead of the limit by more than that.
+const bandwidthLimitedReadSize = 32 << 10
+
+// BandwidthLimiter is a token bucket that limits the number of bytes per
+// second. It can be shared between stores to apply a limit to all of them.
+type BandwidthLimiter struct {
+	rate   float64 // bytes per second
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidthLimiter returns a limiter allowing bps bytes per second. Up to
+// one second worth of bytes can be sent in a burst.
+func NewBandwidthLimiter(bps float64) *BandwidthLimiter {
+	return &BandwidthLimiter{rate: bps, tokens: bps, last: time.Now()}
+}
+
+// WaitN blocks until n bytes are allowed to be transferred. n can be larger
+// than the burst, the bytes over the limit then delay later calls.
+func (l *BandwidthLimiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// Returns a reader that waits for the limiters as data is read from r.
+func limitReader(r io.Reader, limiters []*BandwidthLimiter) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+	return bandwidthLimitedReader{r, limiters}
+}
+
+type bandwidthLimitedReader struct {
+	r        io.Reader
+	limiters []*BandwidthLimiter
+}
+
+func (r bandwidthLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthLimitedReadSize {
+		p = p[:bandwidthLimitedReadSize]
+	}
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		l.WaitN(n)
+	}
+	return n, err
+}
+
+// Limiters applied to the data a store transfers. They're added when the store
+// is wrapped in a BandwidthLimitedStore, before it's used.
+type bandwidthLimits struct {
+	download, upload []*BandwidthLimiter
+}
+
+func (l *bandwidthLimits) add(download, upload *BandwidthLimiter) {
+	if download != nil {
+		l.download = append(l.download, download)
+	}
+	if upload != nil {
+		l.upload = append(l.upload, upload)
+	}
+}
+
+// Returns a reader for data downloaded from the store.
+func (l *bandwidthLimits) downloadReader(r io.Reader) io.Reader {
+	return limitReader(r, l.download)
+}
+
+// Returns a reader for data uploaded to the store.
+func (l *bandwidthLimits) uploadReader(r io.Reader) io.Reader {
+	return limitReader(r, l.upload)
+}
+
+// Implemented by stores that can apply bandwidth limiters to the data as it's
+// transferred.
+type bandwidthLimitable interface {
+	limitBandwidth(download, upload *BandwidthLimiter)
+}
+
+// Hands the limiters to the store at the bottom of a chain of wrappers if it can
+// apply them to its data streams. Returns false if it can't, in which case the
+// limits are applied to whole chunks.
+func limitStoreStreams(s Store, download, upload *BandwidthLimiter) bool {
+	for {
+		switch st := s.(type) {
+		case bandwidthLimitable:
+			st.limitBandwidth(download, upload)
+			return true
+		case interface{ Unwrap() Store }:
+			s = st.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// BandwidthLimitedStore wraps a store and limits the number of bytes per second
+// read from it. Stores that support it apply the limit to the data as it's
+// read. For all others, the size of a chunk is only known once it's been read,
+// so the bytes of a chunk delay the requests following it.
+type BandwidthLimitedStore struct {
+	s        Store
+	download *BandwidthLimiter
+	streamed bool
+}
+
+// BandwidthLimitedWriteStore does the same as BandwidthLimitedStore but
+// implements WriteStore as well and limits the bytes written to the store.
+type BandwidthLimitedWriteStore struct {
+	BandwidthLimitedStore
+	upload *BandwidthLimiter
+}
+
+// NewBandwidthLimitedStore returns a store that reads from s with at most the
+// rate of the download limiter, which can be nil.
+func NewBandwidthLimitedStore(s Store, download *BandwidthLimiter) *BandwidthLimitedStore {
+	streamed := limitStoreStreams(s, download, nil)
+	return &BandwidthLimitedStore{s: s, download: download, streamed: streamed}
+}
+
+// NewBandwidthLimitedWriteStore returns a writable store that reads from and
+// writes to s with at most the rates of the download and upload limiters.
+// Either of them can be nil.
+func NewBandwidthLimitedWriteStore(s WriteStore, download, upload *BandwidthLimiter) *BandwidthLimitedWriteStore {
+	streamed := limitStoreStreams(s, download, upload)
+	return &BandwidthLimitedWriteStore{BandwidthLimitedStore{s: s, download: download, streamed: streamed}, upload}
+}
+
+// GetChunk reads and returns one chunk from the store
+func (s *BandwidthLimitedStore) GetChunk(id ChunkID) (*Chunk, error) {
+	chunk, err := s.s.GetChunk(id)
+	if err != nil || s.streamed {
+		return chunk, err
+	}
+	s.download.WaitN(chunk.size())
+	return chunk, nil
+}
+
+// HasChunk returns true if the chunk is in the store
+func (s *BandwidthLimitedStore) HasChunk(id ChunkID) (bool, error) {
+	return s.s.HasChunk(id)
+}
+
+func (s *BandwidthLimitedStore) String() string {
+	return s.s.String()
+}
+
+// ListChunks calls fn for every chunk in the underlying store. Fails if the
+// store doesn't support listing chunks.
+func (s *BandwidthLimitedStore) ListChunks(ctx context.Context, fn func(ChunkID) error) error {
+	l, ok := s.s.(ChunkLister)
+	if !ok {
+		return fmt.Errorf("store %s does not support listing chunks", s.s)
+	}
+	return l.ListChunks(ctx, fn)
+}
+
+// Close the underlying store
+func (s *BandwidthLimitedStore) Close() error {
+	return s.s.Close()
+}
+
+// Unwrap returns the store requests are sent to.
+func (s *BandwidthLimitedStore) Unwrap() Store {
+	return s.s
+}
+
+// StoreChunk adds a new chunk to the store
+func (s *BandwidthLimitedWriteStore) StoreChunk(chunk *Chunk) error {
+	if !s.streamed {
+		s.upload.WaitN(chunk.size())
+	}
+	return s.s.(WriteStore).StoreChunk(chunk)
+}
+
+// StoreChunks adds multiple chunks to the store, in a single batch if the
+// underlying store supports it.
+func (s *BandwidthLimitedWriteStore) StoreChunks(chunks []*Chunk) error {
+	if !s.streamed {
+		for _, chunk := range chunks {
+			s.upload.WaitN(chunk.size())
+		}
+	}
+	return StoreChunks(s.s.(WriteStore), chunks)
+}
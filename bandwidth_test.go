@@ -0,0 +1,97 @@
+package desync
+
+import (
+	"context"
+	"math/rand"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthLimitedStore(t *testing.T) {
+	chunk := NewChunk(make([]byte, 1000))
+	ts := &TestStore{Chunks: map[ChunkID][]byte{chunk.ID(): make([]byte, 1000)}}
+
+	// 10kB/s allows a burst of 10 chunks, the following 5 take another 500ms
+	up := NewBandwidthLimiter(10000)
+	s := NewBandwidthLimitedWriteStore(ts, nil, up)
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		require.NoError(t, s.StoreChunk(chunk))
+	}
+	require.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+
+	// Reading is not limited by the upload limiter
+	start = time.Now()
+	for i := 0; i < 15; i++ {
+		_, err := s.GetChunk(chunk.ID())
+		require.NoError(t, err)
+	}
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// A limiter shared between stores limits them together
+	down := NewBandwidthLimiter(10000)
+	s1 := NewBandwidthLimitedStore(ts, down)
+	s2 := NewBandwidthLimitedStore(ts, down)
+	start = time.Now()
+	for i := 0; i < 8; i++ {
+		_, err := s1.GetChunk(chunk.ID())
+		require.NoError(t, err)
+		_, err = s2.GetChunk(chunk.ID())
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+}
+
+func TestBandwidthLimitedHTTPStore(t *testing.T) {
+	local, err := NewLocalStore(t.TempDir(), StoreOptions{Uncompressed: true})
+	require.NoError(t, err)
+	ts := httptest.NewServer(NewHTTPHandler(local, true, false, nil, ""))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	remote, err := NewRemoteHTTPStore(u, StoreOptions{Uncompressed: true})
+	require.NoError(t, err)
+	defer remote.Close()
+
+	// The limit applies while the chunk is transferred, so a single chunk
+	// larger than the burst is already slowed down
+	data := make([]byte, 150000)
+	rand.Read(data)
+	chunk := NewChunk(data)
+	s := NewBandwidthLimitedWriteStore(remote, NewBandwidthLimiter(100000), NewBandwidthLimiter(100000))
+	require.True(t, s.streamed)
+	start := time.Now()
+	require.NoError(t, s.StoreChunk(chunk))
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	start = time.Now()
+	out, err := s.GetChunk(chunk.ID())
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	b, err := out.Data()
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+}
+
+func TestBandwidthLimitedStoreInterfaces(t *testing.T) {
+	local, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	s := NewBandwidthLimitedWriteStore(local, nil, NewBandwidthLimiter(10000))
+
+	// Batches and listing are passed through to the wrapped store
+	chunks := []*Chunk{NewChunk([]byte("a")), NewChunk([]byte("b"))}
+	require.NoError(t, StoreChunks(s, chunks))
+	var listed []ChunkID
+	err = s.ListChunks(context.Background(), func(id ChunkID) error {
+		listed = append(listed, id)
+		return nil
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []ChunkID{chunks[0].ID(), chunks[1].ID()}, listed)
+
+	// Stores that can't list chunks fail
+	err = NewBandwidthLimitedStore(&TestStore{}, nil).ListChunks(context.Background(), func(ChunkID) error { return nil })
+	require.Error(t, err)
+}
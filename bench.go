@@ -0,0 +1,148 @@
+package desync
+
+import (
+	"context"
+	"crypto/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// BenchResult holds the throughput and latency of one benchmark run against a
+// store.
+type BenchResult struct {
+	Operation   string             `json:"operation"`
+	ChunkSize   int                `json:"chunk-size"`
+	Concurrency int                `json:"concurrency"`
+	Chunks      int                `json:"chunks"`
+	Duration    time.Duration      `json:"duration"`
+	Throughput  float64            `json:"bytes-per-second"`
+	Latency     LatencyPercentiles `json:"latency"`
+}
+
+// LatencyPercentiles summarizes the latencies of individual operations.
+type LatencyPercentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// NewBenchChunks returns count chunks of the given size filled with random
+// data. Since the data doesn't compress, stores that compress chunks write
+// slightly more than size bytes per chunk.
+func NewBenchChunks(size, count int) ([]*Chunk, error) {
+	chunks := make([]*Chunk, 0, count)
+	for i := 0; i < count; i++ {
+		b := make([]byte, size)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, NewChunk(b))
+	}
+	return chunks, nil
+}
+
+// BenchStoreChunks writes the chunks to the store using n goroutines and
+// measures how long it takes. Stops on the first error.
+func BenchStoreChunks(ctx context.Context, s WriteStore, chunks []*Chunk, n int) (BenchResult, error) {
+	return bench(ctx, "store", chunks, n, func(c *Chunk) error {
+		return s.StoreChunk(c)
+	})
+}
+
+// BenchGetChunks reads the chunks from the store using n goroutines and measures
+// how long it takes. The chunks have to be in the store already, for example
+// after running BenchStoreChunks. The data of every chunk is decoded to include
+// the cost of decompression or decryption. Stops on the first error.
+func BenchGetChunks(ctx context.Context, s Store, chunks []*Chunk, n int) (BenchResult, error) {
+	return bench(ctx, "get", chunks, n, func(c *Chunk) error {
+		chunk, err := s.GetChunk(c.ID())
+		if err != nil {
+			return err
+		}
+		_, err = chunk.Data()
+		return err
+	})
+}
+
+// Runs fn on all chunks using n goroutines, recording the latency of each call.
+func bench(ctx context.Context, op string, chunks []*Chunk, n int, fn func(*Chunk) error) (BenchResult, error) {
+	if n < 1 {
+		n = 1
+	}
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, len(chunks))
+		bytes     int
+	)
+	g, ctx := errgroup.WithContext(ctx)
+	in := make(chan *Chunk)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for c := range in {
+				t := time.Now()
+				if err := fn(c); err != nil {
+					return err
+				}
+				d := time.Since(t)
+				b, _ := c.Data()
+				mu.Lock()
+				latencies = append(latencies, d)
+				bytes += len(b)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		defer close(in)
+		for _, c := range chunks {
+			select {
+			case in <- c:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return BenchResult{}, err
+	}
+	duration := time.Since(start)
+
+	result := BenchResult{
+		Operation:   op,
+		Concurrency: n,
+		Chunks:      len(latencies),
+		Duration:    duration,
+		Latency:     latencyPercentiles(latencies),
+	}
+	if len(chunks) > 0 {
+		b, _ := chunks[0].Data()
+		result.ChunkSize = len(b)
+	}
+	if duration > 0 {
+		result.Throughput = float64(bytes) / duration.Seconds()
+	}
+	return result, nil
+}
+
+func latencyPercentiles(l []time.Duration) LatencyPercentiles {
+	if len(l) == 0 {
+		return LatencyPercentiles{}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	p := func(q float64) time.Duration {
+		return l[int(q*float64(len(l)-1))]
+	}
+	return LatencyPercentiles{
+		P50: p(0.5),
+		P90: p(0.9),
+		P99: p(0.99),
+		Max: l[len(l)-1],
+	}
+}
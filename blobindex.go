@@ -0,0 +1,193 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/folbricht/tempfile"
+)
+
+var _ IndexStore = &BlobIndexStore{}
+
+// BlobIndexStoreOptions define how indexes are generated by a BlobIndexStore.
+type BlobIndexStoreOptions struct {
+	// Number of goroutines used to chunk a blob
+	N int
+
+	// Chunk size parameters
+	ChunkSizeMin, ChunkSizeAvg, ChunkSizeMax uint64
+
+	// Hash algorithm for the chunks of generated indexes, the global Digest
+	// if nil
+	Digest HashAlgorithm
+}
+
+// BlobIndexStore is a read-only index store that generates indexes for blobs
+// in a directory when they're requested. The index for blob "name" is
+// available as "name.caibx". Generated indexes are kept in a cache directory
+// and generated again when the blob is modified.
+type BlobIndexStore struct {
+	dir      string
+	cacheDir string
+	opt      BlobIndexStoreOptions
+
+	// Used to generate only one index per blob at a time. Locks are removed
+	// once no request is using them anymore.
+	mu    sync.Mutex
+	locks map[string]*blobIndexLock
+}
+
+// blobIndexLock serializes requests for the index of one blob.
+type blobIndexLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewBlobIndexStore returns an index store serving indexes for the blobs in
+// dir. Generated indexes are cached in cacheDir, which is created if needed.
+func NewBlobIndexStore(dir, cacheDir string, opt BlobIndexStoreOptions) (*BlobIndexStore, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	if opt.N < 1 {
+		opt.N = 1
+	}
+	return &BlobIndexStore{
+		dir:      dir,
+		cacheDir: cacheDir,
+		opt:      opt,
+		locks:    make(map[string]*blobIndexLock),
+	}, nil
+}
+
+// GetIndexReader returns a reader for the index of a blob, generating it first
+// if it's not in the cache or the blob changed since.
+func (s *BlobIndexStore) GetIndexReader(name string) (io.ReadCloser, error) {
+	if !strings.HasSuffix(name, ".caibx") || strings.ContainsAny(name, `/\`) || name == ".caibx" {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	blob := filepath.Join(s.dir, strings.TrimSuffix(name, ".caibx"))
+	cached := filepath.Join(s.cacheDir, name)
+
+	s.lock(name)
+	defer s.unlock(name)
+
+	blobInfo, err := os.Stat(blob)
+	if err != nil {
+		return nil, err
+	}
+	if !blobInfo.Mode().IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	// Use the cached index if it was generated from the current blob
+	if info, err := os.Stat(cached); err == nil && info.ModTime().Equal(blobInfo.ModTime()) {
+		return os.Open(cached)
+	}
+
+	Log.WithField("blob", blob).Info("generating index")
+	ctx := WithDigest(context.Background(), s.indexDigest())
+	idx, _, err := IndexFromFile(ctx, blob, s.opt.N,
+		s.opt.ChunkSizeMin, s.opt.ChunkSizeAvg, s.opt.ChunkSizeMax, NullProgressBar{})
+	if err != nil {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	if _, err := idx.WriteTo(b); err != nil {
+		return nil, err
+	}
+
+	// Don't cache the index if the blob was modified while it was chunked
+	info, err := os.Stat(blob)
+	if err != nil {
+		return nil, err
+	}
+	if !info.ModTime().Equal(blobInfo.ModTime()) || info.Size() != blobInfo.Size() {
+		return nil, fmt.Errorf("%s was modified while generating its index", blob)
+	}
+	if err := s.store(cached, b.Bytes(), blobInfo); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(b), nil
+}
+
+// GetIndex returns an Index structure for a blob.
+func (s *BlobIndexStore) GetIndex(name string) (i Index, e error) {
+	r, err := s.GetIndexReader(name)
+	if err != nil {
+		return i, err
+	}
+	defer r.Close()
+	return IndexFromReaderWithDigest(r, s.indexDigest())
+}
+
+func (s *BlobIndexStore) indexDigest() HashAlgorithm {
+	return digestOrDefault(s.opt.Digest)
+}
+
+// Close the index store. NOP operation, needed to implement IndexStore interface
+func (s *BlobIndexStore) Close() error { return nil }
+
+func (s *BlobIndexStore) String() string {
+	return s.dir
+}
+
+// Writes a generated index into the cache, with the mtime of the blob it was
+// generated from.
+func (s *BlobIndexStore) store(name string, b []byte, blobInfo os.FileInfo) error {
+	f, err := tempfile.NewMode(s.cacheDir, "."+filepath.Base(name), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(f.Name(), blobInfo.ModTime(), blobInfo.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Acquires the lock for the index with the given name, creating it if no other
+// request holds or waits for it.
+func (s *BlobIndexStore) lock(name string) {
+	s.mu.Lock()
+	l, ok := s.locks[name]
+	if !ok {
+		l = new(blobIndexLock)
+		s.locks[name] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+	l.Lock()
+}
+
+// Releases the lock for the index with the given name, and removes it once it's
+// no longer used.
+func (s *BlobIndexStore) unlock(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.locks[name]
+	l.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(s.locks, name)
+	}
+}
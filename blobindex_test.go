@@ -0,0 +1,63 @@
+package desync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobIndexStore(t *testing.T) {
+	expected := readCaibxFile(t, "testdata/blob1.caibx")
+	b, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "blob1"), b, 0644))
+
+	s, err := NewBlobIndexStore(dir, cacheDir, BlobIndexStoreOptions{
+		N:            2,
+		ChunkSizeMin: expected.Index.ChunkSizeMin,
+		ChunkSizeAvg: expected.Index.ChunkSizeAvg,
+		ChunkSizeMax: expected.Index.ChunkSizeMax,
+	})
+	require.NoError(t, err)
+
+	// The index is generated and stored in the cache
+	idx, err := s.GetIndex("blob1.caibx")
+	require.NoError(t, err)
+	require.Equal(t, expected.Chunks, idx.Chunks)
+	_, err = os.Stat(filepath.Join(cacheDir, "blob1.caibx"))
+	require.NoError(t, err)
+
+	// Modify the blob, the index should be generated again
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "blob1"), b[:len(b)/2], 0644))
+	mtime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "blob1"), mtime, mtime))
+	idx, err = s.GetIndex("blob1.caibx")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(b)/2), idx.Length())
+
+	// Names that don't refer to blobs aren't found
+	for _, name := range []string{"blob1", "missing.caibx", "../blob1.caibx", ".caibx"} {
+		_, err = s.GetIndex(name)
+		require.True(t, os.IsNotExist(err), name)
+	}
+
+	// Concurrent requests share a lock, which is removed when they're done
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.GetIndex("blob1.caibx")
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Empty(t, s.locks)
+}
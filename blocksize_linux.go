@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package desync
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the block size that ranges cloned into the file need to be aligned
+// to. For block devices, that's the physical block size of the device, or the
+// logical one if not known. For files it's the block size of the filesystem.
+// st_blksize isn't used since it's only the preferred I/O size, which doesn't
+// have to match the block size, for example on stacked devices.
+func blocksizeOfFile(name string) uint64 {
+	info, err := os.Stat(name)
+	if err != nil {
+		return DefaultBlockSize
+	}
+	if isDevice(info.Mode()) {
+		return blocksizeOfDevice(name)
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(name, &st); err != nil {
+		return DefaultBlockSize
+	}
+	if bs := uint64(st.Bsize); IsValidBlockSize(bs) {
+		return bs
+	}
+	return DefaultBlockSize
+}
+
+func blocksizeOfDevice(name string) uint64 {
+	f, err := os.Open(name)
+	if err != nil {
+		return DefaultBlockSize
+	}
+	defer f.Close()
+	for _, req := range []uint{unix.BLKPBSZGET, unix.BLKSSZGET} {
+		bs, err := unix.IoctlGetInt(int(f.Fd()), req)
+		if err == nil && IsValidBlockSize(uint64(bs)) {
+			return uint64(bs)
+		}
+	}
+	return DefaultBlockSize
+}
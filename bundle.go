@@ -0,0 +1,269 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// A bundle is a single file holding an index and a subset of its chunks,
+// typically the ones a client doesn't already have in a seed or cache. It's
+// used to transfer everything needed for an update as one download. The file
+// starts with a magic string, followed by the compressed chunks, a JSON
+// manifest and a fixed-size trailer:
+//
+//	magic | chunk data ... | manifest | manifest offset | manifest size | magic
+//
+// Offset and size of the manifest are little-endian uint64 values.
+const bundleMagic = "DSBUNDL1"
+
+const bundleTrailerSize = 16 + len(bundleMagic)
+
+// BundleManifest describes the content of a bundle.
+type BundleManifest struct {
+	Version int           `json:"version"`
+	Index   []byte        `json:"index"` // caibx/caidx encoded index
+	Chunks  []BundleChunk `json:"chunks"`
+}
+
+// BundleChunk describes the location of a compressed chunk in a bundle.
+type BundleChunk struct {
+	ID     ChunkID `json:"id"`
+	Offset uint64  `json:"offset"`
+	Size   uint64  `json:"size"`
+}
+
+// BundleStats contains the results of writing a bundle.
+type BundleStats struct {
+	Chunks          uint64 `json:"chunks"`
+	BytesCompressed uint64 `json:"bytes-compressed"`
+	BytesPlain      uint64 `json:"bytes-plain"`
+}
+
+// WriteBundle writes a bundle with the index and the chunks listed in ids,
+// fetching them from s using n goroutines. The chunks are stored compressed,
+// in no particular order.
+func WriteBundle(ctx context.Context, w io.Writer, idx Index, ids []ChunkID, s Store, n int, pb ProgressBar) (BundleStats, error) {
+	var (
+		stats    BundleStats
+		manifest = BundleManifest{Version: 1}
+		mu       sync.Mutex
+		offset   = uint64(len(bundleMagic))
+	)
+	if n < 1 {
+		n = 1
+	}
+
+	index := new(bytes.Buffer)
+	if _, err := idx.WriteTo(index); err != nil {
+		return stats, err
+	}
+	manifest.Index = index.Bytes()
+
+	if _, err := io.WriteString(w, bundleMagic); err != nil {
+		return stats, err
+	}
+
+	pb.SetTotal(int64(len(ids)))
+	pb.Start()
+	defer pb.Finish()
+
+	in := make(chan ChunkID)
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Fetch and compress the chunks in parallel, and append them to the bundle
+	// in whatever order they're ready
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for id := range in {
+				chunk, err := s.GetChunk(id)
+				if err != nil {
+					return err
+				}
+				plain, err := chunk.Data()
+				if err != nil {
+					return err
+				}
+				b, err := compressedChunkData(chunk)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				if _, err := w.Write(b); err != nil {
+					mu.Unlock()
+					return err
+				}
+				manifest.Chunks = append(manifest.Chunks, BundleChunk{ID: id, Offset: offset, Size: uint64(len(b))})
+				offset += uint64(len(b))
+				stats.Chunks++
+				stats.BytesCompressed += uint64(len(b))
+				stats.BytesPlain += uint64(len(plain))
+				mu.Unlock()
+				pb.Increment()
+			}
+			return nil
+		})
+	}
+
+	// Feed the workers, the context is cancelled if any goroutine encounters an error
+	g.Go(func() error {
+		defer close(in)
+		for _, id := range ids {
+			select {
+			case <-ctx.Done():
+				return Interrupted{}
+			case in <- id:
+			}
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return stats, err
+	}
+
+	// Write the manifest and trailer
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return stats, err
+	}
+	if _, err := w.Write(m); err != nil {
+		return stats, err
+	}
+	trailer := make([]byte, bundleTrailerSize)
+	binary.LittleEndian.PutUint64(trailer[0:8], offset)
+	binary.LittleEndian.PutUint64(trailer[8:16], uint64(len(m)))
+	copy(trailer[16:], bundleMagic)
+	_, err = w.Write(trailer)
+	return stats, err
+}
+
+// Returns the chunk data compressed, re-using the storage format of the
+// chunk if it's already compressed the same way.
+func compressedChunkData(c *Chunk) ([]byte, error) {
+	if len(c.storage) > 0 && c.converters.equal(Converters{Compressor{}}) {
+		return c.storage, nil
+	}
+	b, err := c.Data()
+	if err != nil {
+		return nil, err
+	}
+	return Compress(b)
+}
+
+// BundleStore is a read-only store serving chunks from a bundle file.
+type BundleStore struct {
+	Name     string
+	Manifest BundleManifest
+
+	f      *os.File
+	opt    StoreOptions
+	chunks map[ChunkID]BundleChunk
+}
+
+var _ Store = &BundleStore{}
+
+// NewBundleStore opens a bundle file and reads its manifest.
+func NewBundleStore(name string, opt StoreOptions) (*BundleStore, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &BundleStore{Name: name, f: f, opt: opt}
+	if err := s.readManifest(); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, name)
+	}
+	return s, nil
+}
+
+func (s *BundleStore) readManifest() error {
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+	if size < uint64(len(bundleMagic)+bundleTrailerSize) {
+		return InvalidFormat{"file too small for a bundle"}
+	}
+	magic := make([]byte, len(bundleMagic))
+	if _, err := s.f.ReadAt(magic, 0); err != nil {
+		return err
+	}
+	trailer := make([]byte, bundleTrailerSize)
+	if _, err := s.f.ReadAt(trailer, int64(size)-int64(bundleTrailerSize)); err != nil {
+		return err
+	}
+	if string(magic) != bundleMagic || string(trailer[16:]) != bundleMagic {
+		return InvalidFormat{"not a bundle"}
+	}
+	offset := binary.LittleEndian.Uint64(trailer[0:8])
+	length := binary.LittleEndian.Uint64(trailer[8:16])
+	end := size - uint64(bundleTrailerSize)
+	if offset < uint64(len(bundleMagic)) || offset > end || length > end-offset {
+		return InvalidFormat{"invalid manifest location in bundle"}
+	}
+	m := make([]byte, length)
+	if _, err := s.f.ReadAt(m, int64(offset)); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(m, &s.Manifest); err != nil {
+		return err
+	}
+	if s.Manifest.Version != 1 {
+		return fmt.Errorf("unsupported bundle version %d", s.Manifest.Version)
+	}
+	s.chunks = make(map[ChunkID]BundleChunk, len(s.Manifest.Chunks))
+	for _, c := range s.Manifest.Chunks {
+		// Written so it can't overflow with untrusted values
+		if c.Offset < uint64(len(bundleMagic)) || c.Offset > offset || c.Size > offset-c.Offset {
+			return InvalidFormat{fmt.Sprintf("chunk %s out of bounds in bundle", c.ID.String())}
+		}
+		s.chunks[c.ID] = c
+	}
+	return nil
+}
+
+// Index returns the index contained in the bundle.
+func (s *BundleStore) Index() (Index, error) {
+	idx, err := IndexFromReaderWithDigest(bytes.NewReader(s.Manifest.Index), s.opt.indexDigest())
+	if err != nil {
+		return idx, err
+	}
+	return idx, idx.Validate()
+}
+
+// GetChunk reads and returns one chunk from the bundle.
+func (s *BundleStore) GetChunk(id ChunkID) (*Chunk, error) {
+	c, ok := s.chunks[id]
+	if !ok {
+		return nil, ChunkMissing{id}
+	}
+	b := make([]byte, c.Size)
+	if _, err := s.f.ReadAt(b, int64(c.Offset)); err != nil {
+		return nil, errors.Wrap(err, s.String())
+	}
+	return newChunkFromStorage(id, b, Converters{Compressor{}}, s.opt.SkipVerify, s.opt.digest())
+}
+
+// HasChunk returns true if the chunk is in the bundle.
+func (s *BundleStore) HasChunk(id ChunkID) (bool, error) {
+	_, ok := s.chunks[id]
+	return ok, nil
+}
+
+func (s *BundleStore) String() string {
+	return s.Name
+}
+
+// Close the bundle file.
+func (s *BundleStore) Close() error {
+	return s.f.Close()
+}
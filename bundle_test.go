@@ -0,0 +1,109 @@
+package desync
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundle(t *testing.T) {
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+	s, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+
+	// Bundle every other chunk of the index
+	var ids []ChunkID
+	selected := make(map[ChunkID]struct{})
+	for i, c := range index.Chunks {
+		if _, ok := selected[c.ID]; ok || i%2 != 0 {
+			continue
+		}
+		selected[c.ID] = struct{}{}
+		ids = append(ids, c.ID)
+	}
+	name := filepath.Join(t.TempDir(), "test.debd")
+	f, err := os.Create(name)
+	require.NoError(t, err)
+	stats, err := WriteBundle(context.Background(), f, index, ids, s, 4, NullProgressBar{})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, uint64(len(ids)), stats.Chunks)
+
+	bundle, err := NewBundleStore(name, StoreOptions{})
+	require.NoError(t, err)
+	defer bundle.Close()
+
+	// The index should be the same as the original
+	idx, err := bundle.Index()
+	require.NoError(t, err)
+	require.Equal(t, index.Chunks, idx.Chunks)
+
+	// Only the selected chunks should be in the bundle, with valid data
+	for _, c := range index.Chunks {
+		_, isSelected := selected[c.ID]
+		hasChunk, err := bundle.HasChunk(c.ID)
+		require.NoError(t, err)
+		require.Equal(t, isSelected, hasChunk)
+		if !hasChunk {
+			continue
+		}
+		chunk, err := bundle.GetChunk(c.ID)
+		require.NoError(t, err)
+		b, err := chunk.Data()
+		require.NoError(t, err)
+		require.Equal(t, c.Size, uint64(len(b)))
+	}
+
+	// Anything that isn't a bundle should fail to open
+	_, err = NewBundleStore("testdata/blob1", StoreOptions{})
+	require.Error(t, err)
+}
+
+func TestBundleInvalidManifest(t *testing.T) {
+	// Writes a bundle with the given manifest location and chunks, without any
+	// chunk data
+	write := func(offset, length uint64, chunks []BundleChunk) string {
+		m, err := json.Marshal(BundleManifest{Version: 1, Chunks: chunks})
+		require.NoError(t, err)
+		if length == 0 {
+			length = uint64(len(m))
+		}
+		b := append([]byte(bundleMagic), m...)
+		trailer := make([]byte, bundleTrailerSize)
+		binary.LittleEndian.PutUint64(trailer[0:8], offset)
+		binary.LittleEndian.PutUint64(trailer[8:16], length)
+		copy(trailer[16:], bundleMagic)
+		name := filepath.Join(t.TempDir(), "test.debd")
+		require.NoError(t, ioutil.WriteFile(name, append(b, trailer...), 0644))
+		return name
+	}
+	start := uint64(len(bundleMagic))
+
+	// Valid, but empty
+	bundle, err := NewBundleStore(write(start, 0, nil), StoreOptions{})
+	require.NoError(t, err)
+	bundle.Close()
+
+	// Manifest location out of bounds or overflowing
+	for _, loc := range [][2]uint64{{math.MaxUint64, 1}, {start, math.MaxUint64}, {0, 0}} {
+		_, err = NewBundleStore(write(loc[0], loc[1], nil), StoreOptions{})
+		require.Error(t, err)
+	}
+
+	// Chunks out of bounds or overflowing
+	for _, c := range []BundleChunk{
+		{Offset: math.MaxUint64 - 1, Size: 10},
+		{Offset: start, Size: math.MaxUint64},
+		{Offset: start, Size: 1},
+	} {
+		_, err = NewBundleStore(write(start, 0, []BundleChunk{c}), StoreOptions{})
+		require.Error(t, err)
+	}
+}
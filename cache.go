@@ -2,6 +2,7 @@ package desync
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
@@ -10,38 +11,77 @@ import (
 // functions as disk cache. Any request to the cache for a chunk will first be
 // routed to the local store, and if that fails to the slower remote store.
 // Any chunks retrieved from the remote store will be stored in the local one.
+// If repair is enabled, invalid chunks found in the cache are replaced with
+// valid ones from the remote store and logged.
 type Cache struct {
-	s Store
-	l WriteStore
+	s        Store
+	l        WriteStore
+	repair   bool
+	repaired *uint64
 }
 
 // NewCache returns a cache router that uses a local store as cache before
-// accessing a (supposedly slower) remote one.
+// accessing a (supposedly slower) remote one. Invalid chunks in the cache are
+// returned as errors.
 func NewCache(s Store, l WriteStore) Cache {
-	return Cache{s: s, l: l}
+	return NewCacheWithRepair(s, l, false)
+}
+
+// NewCacheWithRepair returns a cache router like NewCache. If repair is true,
+// invalid chunks in the cache are replaced with the ones from the remote store
+// rather than returned as errors. Every replaced chunk is logged as warning.
+func NewCacheWithRepair(s Store, l WriteStore, repair bool) Cache {
+	return Cache{s: s, l: l, repair: repair, repaired: new(uint64)}
 }
 
 // GetChunk first asks the local store for the chunk and then the remote one.
-// If we get a chunk from the remote, it's stored locally too.
+// If we get a chunk from the remote, it's stored locally too. If the chunk in
+// the local store is invalid and repair is enabled, it's replaced with the one
+// from the remote.
 func (c Cache) GetChunk(id ChunkID) (*Chunk, error) {
+	chunk, _, err := c.getChunk(id)
+	return chunk, err
+}
+
+// Works like GetChunk but also returns true if the chunk was found in the cache,
+// or in any of the caches if the store is a cache itself.
+func (c Cache) getChunk(id ChunkID) (*Chunk, bool, error) {
 	chunk, err := c.l.GetChunk(id)
-	switch err.(type) {
-	case nil:
-		return chunk, nil
-	case ChunkMissing:
+	var invalid bool
+	switch {
+	case err == nil:
+		return chunk, true, nil
+	case errors.Is(err, ErrNotFound):
+	case c.repair && errors.Is(err, ErrCorrupt):
+		invalid = true
+		removeInvalidChunk(c.l, id)
 	default:
-		return chunk, err
+		return chunk, false, err
 	}
 	// At this point we failed to find chunk in the local cache. Ask the remote
-	chunk, err = c.s.GetChunk(id)
+	var cached bool
+	if s, ok := c.s.(Cache); ok {
+		chunk, cached, err = s.getChunk(id)
+	} else {
+		chunk, err = c.s.GetChunk(id)
+	}
 	if err != nil {
-		return chunk, err
+		return chunk, cached, err
 	}
 	// Got the chunk. Store it in the local cache for next time
 	if err = c.l.StoreChunk(chunk); err != nil {
-		return chunk, errors.Wrap(err, "failed to store in local cache")
+		return chunk, cached, errors.Wrap(err, "failed to store in local cache")
 	}
-	return chunk, nil
+	if invalid {
+		atomic.AddUint64(c.repaired, 1)
+		Log.WithField("id", id.String()).WithField("cache", c.l.String()).Warning("replaced invalid chunk in cache")
+	}
+	return chunk, cached, nil
+}
+
+// Repaired returns the number of invalid chunks in the cache that were replaced.
+func (c Cache) Repaired() uint64 {
+	return atomic.LoadUint64(c.repaired)
 }
 
 // HasChunk first checks the cache for the chunk, then the store.
@@ -62,6 +102,24 @@ func (c Cache) Close() error {
 	return c.s.Close()
 }
 
+// Moves an invalid chunk into quarantine if the store has one configured, or
+// removes it if the store supports that. Otherwise it's left to be overwritten.
+func removeInvalidChunk(l WriteStore, id ChunkID) {
+	if ls, ok := l.(LocalStore); ok && ls.Opt.Quarantine != "" {
+		if target, err := ls.QuarantineChunk(id); err != nil {
+			Log.WithError(err).WithField("id", id.String()).Warning("failed to quarantine invalid chunk")
+		} else {
+			Log.WithField("id", id.String()).WithField("target", target).Info("quarantined invalid chunk")
+		}
+		return
+	}
+	if r, ok := l.(interface{ RemoveChunk(ChunkID) error }); ok {
+		if err := r.RemoveChunk(id); err != nil {
+			Log.WithError(err).WithField("id", id.String()).Warning("failed to remove invalid chunk")
+		}
+	}
+}
+
 // New cache which GetChunk() function will return ChunkMissing error instead of ChunkInvalid
 // so caller can redownload invalid chunk from store
 type RepairableCache struct {
@@ -74,10 +132,16 @@ func NewRepairableCache(l WriteStore) RepairableCache {
 	return RepairableCache{l: l}
 }
 
+// GetChunk reads a chunk from the cache, reporting invalid chunks as missing. If
+// the underlying store has a quarantine configured, the invalid chunk is moved there
+// first to preserve it before it gets replaced.
 func (r RepairableCache) GetChunk(id ChunkID) (*Chunk, error) {
 	chunk, err := r.l.GetChunk(id)
 	var chunkInvalidErr ChunkInvalid
 	if err != nil && errors.As(err, &chunkInvalidErr) {
+		if ls, ok := r.l.(LocalStore); ok && ls.Opt.Quarantine != "" {
+			removeInvalidChunk(ls, id)
+		}
 		return chunk, ChunkMissing{ID: chunkInvalidErr.ID}
 	}
 	return chunk, err
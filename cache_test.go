@@ -0,0 +1,42 @@
+package desync
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheRepair(t *testing.T) {
+	remote := &TestStore{}
+	chunk := NewChunk([]byte("some chunk data"))
+	require.NoError(t, remote.StoreChunk(chunk))
+	id := chunk.ID()
+
+	// Put a damaged copy of the chunk in the cache
+	local, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	require.NoError(t, local.StoreChunk(chunk))
+	_, p := local.nameFromID(id)
+	require.NoError(t, ioutil.WriteFile(p, []byte("bitrot"), 0644))
+
+	// Without repair, the default, the error is passed up
+	_, err = NewCache(remote, local).GetChunk(id)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	// With repair, the chunk comes from the remote and replaces the bad one
+	c := NewCacheWithRepair(remote, local, true)
+	out, err := c.GetChunk(id)
+	require.NoError(t, err)
+	b, err := out.Data()
+	require.NoError(t, err)
+	require.Equal(t, []byte("some chunk data"), b)
+	require.Equal(t, uint64(1), c.Repaired())
+
+	// The cache is valid again
+	_, err = local.GetChunk(id)
+	require.NoError(t, err)
+	_, err = c.GetChunk(id)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), c.Repaired())
+}
@@ -0,0 +1,113 @@
+package desync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Partially written chunk files older than this are left over from writers
+// that failed or were killed, and are removed when collecting garbage.
+const staleTmpChunkAge = time.Hour
+
+// CacheGCOptions determine which chunks LocalStore.CollectGarbage removes.
+// Chunks are aged by their modification time, which is set when they're
+// written, and updated when they're read if UpdateTimes is set on the store.
+type CacheGCOptions struct {
+	// Remove chunks that haven't been used for longer than this. No limit if 0.
+	MaxAge time.Duration
+
+	// Remove the least recently used chunks until the total size of the chunk
+	// files is no larger than this. No limit if 0.
+	MaxSize int64
+
+	// Only count the chunks that would be removed, without removing them.
+	DryRun bool
+}
+
+// CacheGCStats hold the results of LocalStore.CollectGarbage.
+type CacheGCStats struct {
+	Chunks        int   `json:"chunks"`
+	Bytes         int64 `json:"bytes"`
+	ChunksRemoved int   `json:"chunks-removed"`
+	BytesRemoved  int64 `json:"bytes-removed"`
+}
+
+// CollectGarbage removes chunks from the store that have expired, and the least
+// recently used ones if the store is larger than allowed. This is meant for
+// stores that are used as cache, and should have UpdateTimes set.
+func (s LocalStore) CollectGarbage(ctx context.Context, opt CacheGCOptions) (CacheGCStats, error) {
+	type chunkFile struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var (
+		stats CacheGCStats
+		files []chunkFile
+		now   = time.Now()
+	)
+	err := filepath.Walk(s.Base, func(path string, info os.FileInfo, err error) error {
+		// See if we're meant to stop
+		select {
+		case <-ctx.Done():
+			return Interrupted{}
+		default:
+		}
+		if err != nil { // failed to walk? => fail
+			return err
+		}
+		if info.IsDir() { // Skip dirs
+			return nil
+		}
+		if strings.HasPrefix(filepath.Base(path), tmpChunkPrefix) {
+			if !opt.DryRun && now.Sub(info.ModTime()) > staleTmpChunkAge {
+				_ = os.Remove(path)
+			}
+			return nil
+		}
+		// Skip anything that isn't a chunk
+		if _, err := s.idFromName(path); err != nil {
+			return nil
+		}
+		files = append(files, chunkFile{path: path, size: info.Size(), mtime: info.ModTime()})
+		stats.Chunks++
+		stats.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	remove := func(f chunkFile) error {
+		if !opt.DryRun {
+			if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		stats.ChunksRemoved++
+		stats.BytesRemoved += f.size
+		return nil
+	}
+
+	// Oldest first, so expired chunks are at the start and the rest are removed
+	// in order of their last use if the store is too large
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return stats, Interrupted{}
+		}
+		expired := opt.MaxAge > 0 && now.Sub(f.mtime) > opt.MaxAge
+		tooLarge := opt.MaxSize > 0 && stats.Bytes-stats.BytesRemoved > opt.MaxSize
+		if !expired && !tooLarge {
+			break
+		}
+		if err := remove(f); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,56 @@
+package desync
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalStoreCollectGarbage(t *testing.T) {
+	s, err := NewLocalStore(t.TempDir(), StoreOptions{Uncompressed: true})
+	require.NoError(t, err)
+
+	// Store 4 chunks of 100 bytes, with the first being the oldest
+	var ids []ChunkID
+	for i := 0; i < 4; i++ {
+		b := make([]byte, 100)
+		b[0] = byte(i)
+		chunk := NewChunk(b)
+		require.NoError(t, s.StoreChunk(chunk))
+		_, p := s.nameFromID(chunk.ID())
+		mtime := time.Now().Add(-time.Duration(4-i) * 24 * time.Hour)
+		require.NoError(t, os.Chtimes(p, mtime, mtime))
+		ids = append(ids, chunk.ID())
+	}
+
+	// Reading a chunk with UpdateTimes marks it as used
+	s.UpdateTimes = true
+	_, err = s.GetChunk(ids[0])
+	require.NoError(t, err)
+
+	// Nothing is removed in a dry-run
+	stats, err := s.CollectGarbage(context.Background(), CacheGCOptions{MaxAge: 36 * time.Hour, DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, CacheGCStats{Chunks: 4, Bytes: 400, ChunksRemoved: 2, BytesRemoved: 200}, stats)
+
+	// Chunks older than 36h are removed, the one that was just read is kept
+	stats, err = s.CollectGarbage(context.Background(), CacheGCOptions{MaxAge: 36 * time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.ChunksRemoved)
+	for i, want := range []bool{true, false, false, true} {
+		has, err := s.HasChunk(ids[i])
+		require.NoError(t, err)
+		require.Equal(t, want, has)
+	}
+
+	// Limit the size, the least recently used chunk goes first
+	stats, err = s.CollectGarbage(context.Background(), CacheGCOptions{MaxSize: 150})
+	require.NoError(t, err)
+	require.Equal(t, CacheGCStats{Chunks: 2, Bytes: 200, ChunksRemoved: 1, BytesRemoved: 100}, stats)
+	has, err := s.HasChunk(ids[0])
+	require.NoError(t, err)
+	require.True(t, has)
+}
@@ -9,19 +9,31 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// Number of chunks a worker in ChopFile collects before writing them to a
+// store that supports batches.
+const chopBatchSize = 32
+
 // ChopFile split a file according to a list of chunks obtained from an Index
-// and stores them in the provided store
+// and stores them in the provided store. The chunk IDs are verified with the
+// algorithm set in the context with WithDigest.
 func ChopFile(ctx context.Context, name string, chunks []IndexChunk, ws WriteStore, n int, pb ProgressBar) error {
+	digest := DigestFromContext(ctx)
 	in := make(chan IndexChunk)
 	g, ctx := errgroup.WithContext(ctx)
 
 	// Setup and start the progressbar if any
-	pb.SetTotal(len(chunks))
+	pb.SetTotal(int64(len(chunks)))
 	pb.Start()
 	defer pb.Finish()
 
 	s := NewChunkStorage(ws)
 
+	// Collect chunks into batches if the store can write them more efficiently
+	batchSize := 1
+	if _, ok := ws.(BatchWriteStore); ok {
+		batchSize = chopBatchSize
+	}
+
 	// Start the workers, each having its own filehandle to read concurrently
 	for i := 0; i < n; i++ {
 		f, err := os.Open(name)
@@ -31,18 +43,26 @@ func ChopFile(ctx context.Context, name string, chunks []IndexChunk, ws WriteSto
 		defer f.Close()
 
 		g.Go(func() error {
+			batch := make([]*Chunk, 0, batchSize)
 			for c := range in {
 				// Update progress bar if any
 				pb.Increment()
 
-				chunk, err := readChunkFromFile(f, c)
+				chunk, err := readChunkFromFile(f, c, digest)
 				if err != nil {
 					return err
 				}
-
-				if err := s.StoreChunk(chunk); err != nil {
+				batch = append(batch, chunk)
+				if len(batch) < batchSize {
+					continue
+				}
+				if err := s.StoreChunks(batch); err != nil {
 					return err
 				}
+				batch = batch[:0]
+			}
+			if len(batch) > 0 {
+				return s.StoreChunks(batch)
 			}
 			return nil
 		})
@@ -64,7 +84,7 @@ loop:
 }
 
 // Helper function to read chunk contents from file
-func readChunkFromFile(f *os.File, c IndexChunk) (*Chunk, error) {
+func readChunkFromFile(f *os.File, c IndexChunk, digest HashAlgorithm) (*Chunk, error) {
 	var err error
 	b := make([]byte, c.Size)
 
@@ -77,5 +97,5 @@ func readChunkFromFile(f *os.File, c IndexChunk) (*Chunk, error) {
 	if _, err = io.ReadFull(f, b); err != nil {
 		return nil, err
 	}
-	return NewChunkWithID(c.ID, b, false)
+	return newChunkWithID(c.ID, b, false, digest)
 }
@@ -2,6 +2,7 @@ package desync
 
 import (
 	"errors"
+	"fmt"
 )
 
 // Chunk holds chunk data plain, storage format, or both. If a chunk is created
@@ -15,6 +16,7 @@ type Chunk struct {
 	converters   Converters // Modifiers to convert from storage format to plain
 	id           ChunkID
 	idCalculated bool
+	digest       HashAlgorithm // Algorithm for the ID, global Digest if nil
 }
 
 // NewChunk creates a new chunk from plain data. The data is trusted and the ID is
@@ -23,12 +25,22 @@ func NewChunk(b []byte) *Chunk {
 	return &Chunk{data: b}
 }
 
+// NewChunkWithDigest creates a new chunk from plain data like NewChunk, with
+// the ID calculated using the hash algorithm h instead of the global Digest.
+func NewChunkWithDigest(b []byte, h HashAlgorithm) *Chunk {
+	return &Chunk{data: b, digest: h}
+}
+
 // NewChunkWithID creates a new chunk from either compressed or uncompressed data
 // (or both if available). It also expects an ID and validates that it matches
 // the uncompressed data unless skipVerify is true. If called with just compressed
 // data, it'll decompress it for the ID validation.
 func NewChunkWithID(id ChunkID, b []byte, skipVerify bool) (*Chunk, error) {
-	c := &Chunk{id: id, data: b}
+	return newChunkWithID(id, b, skipVerify, nil)
+}
+
+func newChunkWithID(id ChunkID, b []byte, skipVerify bool, h HashAlgorithm) (*Chunk, error) {
+	c := &Chunk{id: id, data: b, digest: h}
 	if skipVerify {
 		c.idCalculated = true // Pretend this was calculated. No need to re-calc later
 		return c, nil
@@ -44,7 +56,11 @@ func NewChunkWithID(id ChunkID, b []byte, skipVerify bool) (*Chunk, error) {
 // It uses raw storage format from it source and the modifiers are used to convert
 // into plain data as needed.
 func NewChunkFromStorage(id ChunkID, b []byte, modifiers Converters, skipVerify bool) (*Chunk, error) {
-	c := &Chunk{id: id, storage: b, converters: modifiers}
+	return newChunkFromStorage(id, b, modifiers, skipVerify, nil)
+}
+
+func newChunkFromStorage(id ChunkID, b []byte, modifiers Converters, skipVerify bool, h HashAlgorithm) (*Chunk, error) {
+	c := &Chunk{id: id, storage: b, converters: modifiers, digest: h}
 	if skipVerify {
 		c.idCalculated = true // Pretend this was calculated. No need to re-calc later
 		return c, nil
@@ -66,11 +82,28 @@ func (c *Chunk) Data() ([]byte, error) {
 	if len(c.storage) > 0 {
 		var err error
 		c.data, err = c.converters.fromStorage(c.storage)
-		return c.data, err
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+		}
+		return c.data, nil
 	}
 	return nil, errors.New("no data in chunk")
 }
 
+// Returns the number of bytes of the chunk in storage format if available, or
+// of the plain data otherwise. Used to estimate the bytes transferred.
+func (c *Chunk) size() int {
+	if len(c.storage) > 0 {
+		return len(c.storage)
+	}
+	return len(c.data)
+}
+
+// Returns the hash algorithm used to calculate the ID of the chunk.
+func (c *Chunk) hash() HashAlgorithm {
+	return digestOrDefault(c.digest)
+}
+
 // ID returns the checksum/ID of the uncompressed chunk data. The ID is stored
 // after the first call and doesn't need to be re-calculated. Note that calculating
 // the ID may mean decompressing the data first.
@@ -82,7 +115,7 @@ func (c *Chunk) ID() ChunkID {
 	if err != nil {
 		return ChunkID{}
 	}
-	c.id = Digest.Sum(b)
+	c.id = c.hash().Sum(b)
 	c.idCalculated = true
 	return c.id
 }
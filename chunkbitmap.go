@@ -0,0 +1,114 @@
+package desync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/boljen/go-bitmap"
+	"golang.org/x/sync/errgroup"
+)
+
+// ChunkBitmap records which chunks of an index are present, for example in a
+// local store or cache. It holds one bit per chunk in the order of the index,
+// duplicate chunks included. Bit i is stored in byte i/8, least significant
+// bit first. A bitmap can be sent to a server that holds the same index to
+// find out which chunks are missing on the client.
+type ChunkBitmap []byte
+
+// NewChunkBitmap returns an empty bitmap for an index with n chunks.
+func NewChunkBitmap(n int) ChunkBitmap {
+	return ChunkBitmap(bitmap.New(n))
+}
+
+// ChunkBitmapFromBytes validates that b is a bitmap for the given index and
+// returns it.
+func ChunkBitmapFromBytes(b []byte, idx Index) (ChunkBitmap, error) {
+	if expected := (len(idx.Chunks) + 7) / 8; len(b) != expected {
+		return nil, fmt.Errorf("chunk bitmap has %d bytes, expected %d for index with %d chunks", len(b), expected, len(idx.Chunks))
+	}
+	return ChunkBitmap(b), nil
+}
+
+// Has returns true if chunk i of the index is present.
+func (b ChunkBitmap) Has(i int) bool {
+	return bitmap.Get(b, i)
+}
+
+// Set marks chunk i of the index as present.
+func (b ChunkBitmap) Set(i int) {
+	bitmap.Set(b, i, true)
+}
+
+// Present returns the IDs of all chunks of the index that are marked as
+// present, without duplicates.
+func (b ChunkBitmap) Present(idx Index) []ChunkID {
+	var ids []ChunkID
+	seen := make(map[ChunkID]struct{})
+	for i, c := range idx.Chunks {
+		if !b.Has(i) {
+			continue
+		}
+		if _, ok := seen[c.ID]; ok {
+			continue
+		}
+		seen[c.ID] = struct{}{}
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// ChunkPresence checks which chunks of the index are available in the store and
+// returns the result as bitmap. Every unique chunk is only looked up once, using
+// n goroutines.
+func ChunkPresence(ctx context.Context, idx Index, s Store, n int) (ChunkBitmap, error) {
+	if n < 1 {
+		n = 1
+	}
+	var (
+		mu      sync.Mutex
+		present = make(map[ChunkID]bool)
+		in      = make(chan ChunkID)
+	)
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Start the workers
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for id := range in {
+				hasChunk, err := s.HasChunk(id)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				present[id] = hasChunk
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+
+	// Feed the workers with unique chunk IDs
+	g.Go(func() error {
+		defer close(in)
+		return IndexChunks(idx)(ctx, func(id ChunkID) error {
+			select {
+			case <-ctx.Done():
+				return Interrupted{}
+			case in <- id:
+			}
+			return nil
+		})
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	b := NewChunkBitmap(len(idx.Chunks))
+	for i, c := range idx.Chunks {
+		if present[c.ID] {
+			b.Set(i)
+		}
+	}
+	return b, nil
+}
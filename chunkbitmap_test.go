@@ -0,0 +1,32 @@
+package desync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkPresence(t *testing.T) {
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+	src, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+
+	// Only put the first chunk in the store
+	s := &TestStore{}
+	chunk, err := src.GetChunk(index.Chunks[0].ID)
+	require.NoError(t, err)
+	require.NoError(t, s.StoreChunk(chunk))
+
+	b, err := ChunkPresence(context.Background(), index, s, 1)
+	require.NoError(t, err)
+	require.Len(t, b, (len(index.Chunks)+7)/8)
+	for i, c := range index.Chunks {
+		require.Equal(t, c.ID == index.Chunks[0].ID, b.Has(i))
+	}
+	require.Equal(t, []ChunkID{index.Chunks[0].ID}, b.Present(index))
+
+	// The size of the bitmap has to match the index
+	_, err = ChunkBitmapFromBytes(b[1:], index)
+	require.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package desync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ChunkCRCSuffix is appended to the name of a blob to get the name of the
+// sidecar file holding the CRCs of its chunks.
+const ChunkCRCSuffix = ".crc"
+
+// Type marker at the start of a chunk CRC file.
+const chunkCRCFileType = 0x7a3c91e4b05d26f8
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChunkCRCs holds the CRC-32C of chunks by their ID. The CRC only depends on
+// the data of a chunk, so it's valid for any blob containing the chunk. It's
+// much faster to calculate than the chunk digest, which makes it useful to
+// verify large amounts of seed data, at the cost of a weaker check that won't
+// detect deliberately crafted changes.
+type ChunkCRCs map[ChunkID]uint32
+
+// ChunkCRC returns the CRC-32C of the data of a chunk.
+func ChunkCRC(b []byte) uint32 {
+	return crc32.Checksum(b, castagnoli)
+}
+
+// ChunkCRCsFromFile reads a blob and calculates the CRCs of all chunks in its
+// index. The blob needs to match the index, the chunk digests aren't verified.
+func ChunkCRCsFromFile(name string, idx Index) (ChunkCRCs, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	crcs := make(ChunkCRCs)
+	r := bufio.NewReaderSize(f, 1<<20)
+	b := make([]byte, idx.Index.ChunkSizeMax)
+	for _, c := range idx.Chunks {
+		if c.Size > uint64(len(b)) {
+			return nil, errors.Errorf("chunk %s is larger than the maximum chunk size", c.ID.String())
+		}
+		if _, err := io.ReadFull(r, b[:c.Size]); err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+		crcs[c.ID] = ChunkCRC(b[:c.Size])
+	}
+	return crcs, nil
+}
+
+// ReadChunkCRCs reads CRCs written by ChunkCRCs.WriteTo.
+func ReadChunkCRCs(r io.Reader) (ChunkCRCs, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, errors.Wrap(err, "reading chunk CRC file")
+	}
+	if binary.LittleEndian.Uint64(hdr[0:8]) != chunkCRCFileType {
+		return nil, errors.New("not a chunk CRC file")
+	}
+	n := binary.LittleEndian.Uint64(hdr[8:16])
+	crcs := make(ChunkCRCs)
+	item := make([]byte, 36)
+	for i := uint64(0); i < n; i++ {
+		if _, err := io.ReadFull(br, item); err != nil {
+			return nil, errors.New("chunk CRC file is truncated")
+		}
+		id, err := ChunkIDFromSlice(item[:32])
+		if err != nil {
+			return nil, err
+		}
+		crcs[id] = binary.LittleEndian.Uint32(item[32:])
+	}
+	if n, _ := br.Read(make([]byte, 1)); n > 0 {
+		return nil, errors.New("unexpected data after chunk CRCs")
+	}
+	return crcs, nil
+}
+
+// WriteTo writes the CRCs into a stream, sorted by chunk ID.
+func (c ChunkCRCs) WriteTo(w io.Writer) (int64, error) {
+	ids := make([]ChunkID, 0, len(c))
+	for id := range c {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+
+	bw := bufio.NewWriter(w)
+	b := make([]byte, 16, 36)
+	binary.LittleEndian.PutUint64(b[0:8], chunkCRCFileType)
+	binary.LittleEndian.PutUint64(b[8:16], uint64(len(ids)))
+	n, err := bw.Write(b)
+	if err != nil {
+		return int64(n), err
+	}
+	total := int64(n)
+	for _, id := range ids {
+		b = append(b[:0], id[:]...)
+		b = binary.LittleEndian.AppendUint32(b, c[id])
+		n, err := bw.Write(b)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, bw.Flush()
+}
+
+// Returns true if the CRC of the chunk is known and matches the data. Callers
+// verify the digest of the data if it doesn't, the CRC could be wrong.
+func (c ChunkCRCs) match(id ChunkID, b []byte) bool {
+	crc, ok := c[id]
+	return ok && crc == ChunkCRC(b)
+}
+
+// Returns the CRCs of the chunks in a seed segment, if the seed has them.
+func seedSegmentCRCs(s SeedSegment) ChunkCRCs {
+	if fs, ok := s.(*fileSeedSegment); ok {
+		return fs.crcs
+	}
+	return nil
+}
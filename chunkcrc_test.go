@@ -0,0 +1,70 @@
+package desync
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkCRCs(t *testing.T) {
+	f, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := IndexFromReader(f)
+	require.NoError(t, err)
+	data, err := os.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+
+	crcs, err := ChunkCRCsFromFile("testdata/blob1", idx)
+	require.NoError(t, err)
+	for _, c := range idx.Chunks {
+		require.Equal(t, ChunkCRC(data[c.Start:c.Start+c.Size]), crcs[c.ID])
+	}
+
+	// Write and read them back
+	b := new(bytes.Buffer)
+	n, err := crcs.WriteTo(b)
+	require.NoError(t, err)
+	require.Equal(t, int64(b.Len()), n)
+	crcs2, err := ReadChunkCRCs(bytes.NewReader(b.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, crcs, crcs2)
+
+	_, err = ReadChunkCRCs(bytes.NewReader(b.Bytes()[:b.Len()-1]))
+	require.Error(t, err)
+	_, err = ReadChunkCRCs(bytes.NewReader(append(b.Bytes(), 0)))
+	require.Error(t, err)
+}
+
+func TestFileSeedSegmentValidateCRC(t *testing.T) {
+	f, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := IndexFromReader(f)
+	require.NoError(t, err)
+	data, err := os.Open("testdata/blob1")
+	require.NoError(t, err)
+	defer data.Close()
+
+	crcs, err := ChunkCRCsFromFile("testdata/blob1", idx)
+	require.NoError(t, err)
+	segment := newFileSeedSegment("testdata/blob1", idx.Chunks, false, Digest)
+	segment.crcs = crcs
+	require.NoError(t, segment.Validate(data))
+
+	// A wrong CRC falls back to the digest, which still matches
+	for id := range crcs {
+		crcs[id]++
+	}
+	require.NoError(t, segment.Validate(data))
+
+	// Data that doesn't match the index fails regardless
+	segment = newFileSeedSegment("testdata/blob2", idx.Chunks, false, Digest)
+	segment.crcs = crcs
+	other, err := os.Open("testdata/blob2")
+	require.NoError(t, err)
+	defer other.Close()
+	require.Error(t, segment.Validate(other))
+}
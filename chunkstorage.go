@@ -2,6 +2,7 @@ package desync
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 // ChunkStorage stores chunks in a writable store. It can be safely used by multiple goroutines and
@@ -10,6 +11,18 @@ type ChunkStorage struct {
 	sync.Mutex
 	ws        WriteStore
 	processed map[ChunkID]struct{}
+	stats     ChunkStorageStats
+}
+
+// ChunkStorageStats counts the chunks handled by a ChunkStorage.
+type ChunkStorageStats struct {
+	// Chunks that were seen more than once and skipped after the first time
+	ChunksDuplicate uint64 `json:"chunks-duplicate"`
+	// Chunks that were already present in the store
+	ChunksInStore uint64 `json:"chunks-in-store"`
+	// Chunks and (uncompressed) bytes written to the store
+	ChunksStored uint64 `json:"chunks-stored"`
+	BytesStored  uint64 `json:"bytes-stored"`
 }
 
 // NewChunkStorage initializes a ChunkStorage object.
@@ -47,11 +60,15 @@ func (s *ChunkStorage) StoreChunk(chunk *Chunk) (err error) {
 	// at the same time. If this is the first time this chunk is marked, it'll
 	// return false and we need to continue processing/storing the chunk below.
 	if s.markProcessed(chunk.ID()) {
+		atomic.AddUint64(&s.stats.ChunksDuplicate, 1)
 		return nil
 	}
 
 	// Skip this chunk if the store already has it
 	if hasChunk, err := s.ws.HasChunk(chunk.ID()); err != nil || hasChunk {
+		if hasChunk {
+			atomic.AddUint64(&s.stats.ChunksInStore, 1)
+		}
 		return err
 	}
 
@@ -64,5 +81,67 @@ func (s *ChunkStorage) StoreChunk(chunk *Chunk) (err error) {
 	}()
 
 	// Store the compressed chunk
-	return s.ws.StoreChunk(chunk)
+	if err := s.ws.StoreChunk(chunk); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.stats.ChunksStored, 1)
+	if b, err := chunk.Data(); err == nil {
+		atomic.AddUint64(&s.stats.BytesStored, uint64(len(b)))
+	}
+	return nil
+}
+
+// StoreChunks stores multiple chunks in a synchronous manner, in a single batch
+// if the store supports it. Chunks that were already processed or are in the
+// store are skipped.
+func (s *ChunkStorage) StoreChunks(chunks []*Chunk) error {
+	var todo []*Chunk
+	for _, chunk := range chunks {
+		if s.markProcessed(chunk.ID()) {
+			atomic.AddUint64(&s.stats.ChunksDuplicate, 1)
+			continue
+		}
+		hasChunk, err := s.ws.HasChunk(chunk.ID())
+		if err != nil {
+			s.unmarkProcessed(chunk.ID())
+			for _, c := range todo {
+				s.unmarkProcessed(c.ID())
+			}
+			return err
+		}
+		if hasChunk {
+			atomic.AddUint64(&s.stats.ChunksInStore, 1)
+			continue
+		}
+		todo = append(todo, chunk)
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+
+	// Unmark all chunks of the batch if it failed so they can be tried again,
+	// it's not known which of them were stored
+	if err := StoreChunks(s.ws, todo); err != nil {
+		for _, c := range todo {
+			s.unmarkProcessed(c.ID())
+		}
+		return err
+	}
+	for _, chunk := range todo {
+		atomic.AddUint64(&s.stats.ChunksStored, 1)
+		if b, err := chunk.Data(); err == nil {
+			atomic.AddUint64(&s.stats.BytesStored, uint64(len(b)))
+		}
+	}
+	return nil
+}
+
+// Stats returns the number of chunks processed so far.
+func (s *ChunkStorage) Stats() ChunkStorageStats {
+	return ChunkStorageStats{
+		ChunksDuplicate: atomic.LoadUint64(&s.stats.ChunksDuplicate),
+		ChunksInStore:   atomic.LoadUint64(&s.stats.ChunksInStore),
+		ChunksStored:    atomic.LoadUint64(&s.stats.ChunksStored),
+		BytesStored:     atomic.LoadUint64(&s.stats.BytesStored),
+	}
 }
@@ -0,0 +1,110 @@
+package desync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test store that records the size of every batch written to it.
+type batchTestStore struct {
+	TestStore
+	batches []int
+	fail    bool
+}
+
+func (s *batchTestStore) StoreChunks(chunks []*Chunk) error {
+	if s.fail {
+		return errors.New("failed")
+	}
+	s.batches = append(s.batches, len(chunks))
+	for _, c := range chunks {
+		if err := s.StoreChunk(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestChopFileBatches(t *testing.T) {
+	f, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := IndexFromReader(f)
+	require.NoError(t, err)
+
+	s := &batchTestStore{}
+	require.NoError(t, ChopFile(context.Background(), "testdata/blob1", idx.Chunks, s, 1, NullProgressBar{}))
+
+	// Chunks are read in batches, duplicates are removed before writing them
+	var total int
+	for _, n := range s.batches {
+		require.True(t, n <= chopBatchSize)
+		total += n
+	}
+	require.Len(t, s.batches, (len(idx.Chunks)+chopBatchSize-1)/chopBatchSize)
+	require.Equal(t, len(s.TestStore.Chunks), total)
+	for _, c := range idx.Chunks {
+		require.Contains(t, s.TestStore.Chunks, c.ID)
+	}
+}
+
+func TestChunkStorageBatchError(t *testing.T) {
+	s := &batchTestStore{fail: true}
+	cs := NewChunkStorage(s)
+	chunks := []*Chunk{NewChunk([]byte("a")), NewChunk([]byte("b"))}
+
+	// A failed batch should leave the chunks eligible to be stored again
+	require.Error(t, cs.StoreChunks(chunks))
+	s.fail = false
+	require.NoError(t, cs.StoreChunks(chunks))
+	require.Equal(t, []int{2}, s.batches)
+	require.Equal(t, uint64(2), cs.Stats().ChunksStored)
+
+	// Storing them again only counts them as duplicates
+	require.NoError(t, cs.StoreChunks(chunks))
+	require.Equal(t, uint64(2), cs.Stats().ChunksDuplicate)
+}
+
+func TestStoreChunksConcurrentlyLimit(t *testing.T) {
+	const limit = 3
+	var (
+		mu           sync.Mutex
+		active, peak int
+		sem          = newBatchLimit(limit)
+		chunks       []*Chunk
+	)
+	for i := 0; i < 20; i++ {
+		chunks = append(chunks, NewChunk([]byte{byte(i)}))
+	}
+	store := func(*Chunk) error {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return nil
+	}
+
+	// Several batches written at once share the limit
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, storeChunksConcurrently(chunks, sem, store))
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, peak, limit)
+}
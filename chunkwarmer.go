@@ -0,0 +1,85 @@
+package desync
+
+import (
+	"sync"
+)
+
+// Number of chunks that can be waiting to be warmed, any more are dropped.
+const chunkWarmQueueSize = 64 * 1024
+
+// ChunkWarmer reads chunks from a store in the background, typically to
+// populate a cache in front of slower upstream stores before clients request
+// them. Chunks are only queued once at a time, and dropped if the queue is
+// full.
+type ChunkWarmer struct {
+	s     Store
+	queue chan ChunkID
+
+	mu      sync.Mutex
+	pending map[ChunkID]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewChunkWarmer returns a warmer that reads chunks from s with n goroutines.
+func NewChunkWarmer(s Store, n int) *ChunkWarmer {
+	if n < 1 {
+		n = 1
+	}
+	w := &ChunkWarmer{
+		s:       s,
+		queue:   make(chan ChunkID, chunkWarmQueueSize),
+		pending: make(map[ChunkID]struct{}),
+	}
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for id := range w.queue {
+				if _, err := w.s.GetChunk(id); err != nil {
+					Log.WithError(err).WithField("ID", id).Debug("failed to warm chunk")
+				}
+				w.mu.Lock()
+				delete(w.pending, id)
+				w.mu.Unlock()
+			}
+		}()
+	}
+	return w
+}
+
+// Warm queues chunks to be read from the store and returns how many were
+// added to the queue. Chunks that are already queued are skipped.
+func (w *ChunkWarmer) Warm(ids []ChunkID) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0
+	}
+	var queued int
+	for _, id := range ids {
+		if _, ok := w.pending[id]; ok {
+			continue
+		}
+		select {
+		case w.queue <- id:
+			w.pending[id] = struct{}{}
+			queued++
+		default: // Queue is full
+			return queued
+		}
+	}
+	return queued
+}
+
+// Close stops accepting new chunks and waits for the queued ones to be read.
+func (w *ChunkWarmer) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+	return nil
+}
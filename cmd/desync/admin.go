@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/folbricht/desync"
+)
+
+// adminAPI holds the operations available through the admin endpoints of a
+// server. Endpoints for operations that are nil aren't supported by the server
+// and answered with 404.
+type adminAPI struct {
+	// Returns the store configuration currently in use, without secrets
+	config func() interface{}
+	// Returns the health of the upstream stores and statistics of the caches
+	status func(context.Context) interface{}
+	// Opens the stores and caches again, reading the store-file if there is one
+	reload func() error
+	// Removes all chunks from the caches
+	clearCaches func(context.Context) error
+	// Cleans up the caches and returns the statistics for each
+	cacheGC func(context.Context, desync.CacheGCOptions) interface{}
+	// Used for cache GC when the request doesn't specify max-age or max-size
+	gcOptions desync.CacheGCOptions
+}
+
+// Serves the admin endpoints, which require the admin authorization.
+//
+//	GET  /admin/config       store configuration
+//	GET  /admin/status       health of the stores and cache statistics
+//	POST /admin/reload       re-open the stores and caches
+//	POST /admin/cache/reopen same as /admin/reload
+//	POST /admin/cache/clear  remove all chunks from the caches, then reload
+//	POST /admin/cache/gc     clean up the caches, optionally with max-age and
+//	                         max-size query parameters
+func (a adminAPI) handler(auth string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(auth)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		method, supported := "POST", true
+		switch r.URL.Path {
+		case "/admin/config":
+			method, supported = "GET", a.config != nil
+		case "/admin/status":
+			method, supported = "GET", a.status != nil
+		case "/admin/reload", "/admin/cache/reopen":
+			supported = a.reload != nil
+		case "/admin/cache/clear":
+			supported = a.clearCaches != nil && a.reload != nil
+		case "/admin/cache/gc":
+			supported = a.cacheGC != nil
+		default:
+			supported = false
+		}
+		if !supported {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, "only "+method+" is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			result interface{}
+			err    error
+		)
+		switch r.URL.Path {
+		case "/admin/config":
+			result = a.config()
+		case "/admin/status":
+			result = a.status(r.Context())
+		case "/admin/reload", "/admin/cache/reopen":
+			err = a.reload()
+		case "/admin/cache/clear":
+			if err = a.clearCaches(r.Context()); err == nil {
+				err = a.reload()
+			}
+		case "/admin/cache/gc":
+			gcOpt := a.gcOptions
+			maxAge, maxSize := r.URL.Query().Get("max-age"), r.URL.Query().Get("max-size")
+			if maxAge != "" || maxSize != "" {
+				if gcOpt, err = parseCacheGCOptions(maxAge, maxSize); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if gcOpt.MaxAge == 0 && gcOpt.MaxSize == 0 {
+				http.Error(w, "max-age or max-size is required", http.StatusBadRequest)
+				return
+			}
+			result = a.cacheGC(r.Context(), gcOpt)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if result == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	})
+}
+
+// Status of a store as reported by /admin/status.
+type adminStoreStatus struct {
+	Location string `json:"location"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Status of a cache as reported by /admin/status and /admin/cache/gc.
+type adminCacheStatus struct {
+	Location string `json:"location"`
+	desync.CacheGCStats
+	Error string `json:"error,omitempty"`
+}
+
+type adminStatus struct {
+	Stores []adminStoreStatus `json:"stores"`
+	Caches []adminCacheStatus `json:"caches,omitempty"`
+}
+
+// An upstream store being served, with the location it was opened from.
+type servedStore struct {
+	location string
+	store    desync.Store
+}
+
+// Upstream stores currently in use by a server. The main stores are replaced
+// when the configuration is reloaded, the stores under prefixes are not.
+type liveStores struct {
+	mu       sync.Mutex
+	main     []servedStore
+	prefixes []servedStore
+}
+
+func (l *liveStores) setMain(stores []servedStore) {
+	l.mu.Lock()
+	l.main = stores
+	l.mu.Unlock()
+}
+
+func (l *liveStores) all() []servedStore {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append(append([]servedStore{}, l.main...), l.prefixes...)
+}
+
+// Returns an error if any of the stores in use can't be reached.
+func (l *liveStores) check() error {
+	for _, s := range l.all() {
+		if err := desync.CheckStore(s.store); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Confirms each of the stores in use can be reached.
+func (l *liveStores) status() []adminStoreStatus {
+	stores := l.all()
+	statuses := make([]adminStoreStatus, 0, len(stores))
+	for _, s := range stores {
+		status := adminStoreStatus{Location: redactLocation(s.location)}
+		if err := desync.CheckStore(s.store); err != nil {
+			status.Error = err.Error()
+		} else {
+			status.Healthy = true
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Runs garbage collection with the given options on each of the local caches.
+// Use DryRun to only count the chunks in them.
+func cachesGC(ctx context.Context, locations []string, cmdOpt cmdStoreOptions, gcOpt desync.CacheGCOptions) []adminCacheStatus {
+	l := make([]adminCacheStatus, 0, len(locations))
+	for _, location := range locations {
+		status := adminCacheStatus{Location: redactLocation(location)}
+		c, err := localCache(location, cmdOpt)
+		if err == nil {
+			status.CacheGCStats, err = c.CollectGarbage(ctx, gcOpt)
+			c.Close()
+		}
+		if err != nil {
+			status.Error = err.Error()
+		}
+		l = append(l, status)
+	}
+	return l
+}
+
+// Returns a copy of the store-file configuration with passwords and
+// authorization values removed.
+func redactStoreFile(c storeFile) storeFile {
+	redactEntries := func(entries []storeFileEntry) []storeFileEntry {
+		var l []storeFileEntry
+		for _, e := range entries {
+			l = append(l, redactStoreFileEntry(e))
+		}
+		return l
+	}
+	r := storeFile{
+		Version: c.Version,
+		Stores:  redactEntries(c.Stores),
+		Cache:   redactLocation(c.Cache),
+		Caches:  redactEntries(c.Caches),
+	}
+	if len(c.Prefixes) > 0 {
+		r.Prefixes = make(map[string]storeFileEntry)
+		for p, e := range c.Prefixes {
+			r.Prefixes[p] = redactStoreFileEntry(e)
+		}
+	}
+	for _, s := range c.Scopes {
+		if s.Authorization != "" {
+			s.Authorization = "xxxxx"
+		}
+		r.Scopes = append(r.Scopes, s)
+	}
+	return r
+}
+
+func redactStoreFileEntry(e storeFileEntry) storeFileEntry {
+	r := storeFileEntry{Location: redactLocation(e.Location)}
+	if e.Options != nil {
+		opt := *e.Options
+		if opt.EncryptionPassword != "" {
+			opt.EncryptionPassword = "xxxxx"
+		}
+		if opt.HTTPAuth != "" {
+			opt.HTTPAuth = "xxxxx"
+		}
+		r.Options = &opt
+	}
+	return r
+}
+
+// Removes the password from a store location URL.
+func redactLocation(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.User == nil {
+		return location
+	}
+	return u.Redacted()
+}
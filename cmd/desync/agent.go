@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/folbricht/desync"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+type agentOptions struct {
+	cmdStoreOptions
+	stores     []string
+	cache      string
+	socket     string
+	socketMode string
+	writable   bool
+	logFile    string
+}
+
+func newAgentCommand(ctx context.Context) *cobra.Command {
+	var opt agentOptions
+
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Share stores and caches between processes on a host",
+		Long: `Starts a local agent that serves chunks from the given stores over a Unix
+socket. Other desync processes on the host use it as store with a location of
+the form unix:///path/to/socket. They then share the agent's connections to the
+upstream stores, its cache, rate and bandwidth limits, and credentials. Requests
+for the same chunk from different processes are combined into one. This is
+useful when many short-lived commands, like cron jobs, read from the same stores.
+
+Chunks are transferred uncompressed between the agent and its clients. Store
+options that define the format of the chunks, like encryption, only need to be
+configured for the agent.
+
+The -w option enables writing through the agent, but this is only allowed with
+just one upstream store and no cache. Access to the agent is controlled with the
+permissions of the socket, set with --socket-mode. A stale socket left behind
+by an agent that's no longer running is replaced.`,
+		Example: `  desync agent -s s3+https://s3.example.com/store -c /var/cache/desync --socket /run/desync/agent.sock
+  desync extract -s unix:///run/desync/agent.sock file.caibx file.bin`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAgent(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "upstream source store(s)")
+	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
+	flags.StringVar(&opt.socket, "socket", "/run/desync/agent.sock", "path of the Unix socket to listen on")
+	flags.StringVar(&opt.socketMode, "socket-mode", "0660", "permissions of the socket")
+	flags.BoolVarP(&opt.writable, "writeable", "w", false, "support writing")
+	flags.StringVar(&opt.logFile, "log", "", "request log file or - for STDOUT")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runAgent(ctx context.Context, opt agentOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if len(opt.stores) == 0 {
+		return errors.New("no store provided")
+	}
+	if opt.writable && (len(opt.stores) > 1 || opt.cache != "") {
+		return errors.New("Only one upstream store supported for writing and no cache")
+	}
+	mode, err := strconv.ParseUint(opt.socketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid socket mode '%s'", opt.socketMode)
+	}
+
+	// Combine concurrent requests for the same chunk from all clients
+	var s desync.Store
+	if opt.writable {
+		ws, err := WritableStore(opt.stores[0], opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+		s = desync.NewWriteDedupQueue(ws)
+	} else {
+		s, err = MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
+		if err != nil {
+			return err
+		}
+		s = desync.NewDedupQueue(s)
+	}
+	defer s.Close()
+
+	// Chunks don't leave the host, serve them uncompressed
+	var handler http.Handler = desync.NewHTTPHandlerWithOptions(s, desync.HTTPHandlerOptions{
+		Writable: opt.writable,
+	})
+	switch opt.logFile {
+	case "": // No logging of requests
+	case "-":
+		handler = withLog(handler, log.New(stderr, "", log.LstdFlags))
+	default:
+		l, err := os.OpenFile(opt.logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		handler = withLog(handler, log.New(l, "", log.LstdFlags))
+	}
+
+	l, err := listenUnix(opt.socket, os.FileMode(mode))
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:  handler,
+		ErrorLog: log.New(stderr, "", log.LstdFlags),
+	}
+
+	// Stop the server on INT/TERM, which also removes the socket
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Listens on a Unix socket with the given permissions. A socket left behind by
+// a process that's no longer running is removed first, but not one that's
+// still in use.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket %s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
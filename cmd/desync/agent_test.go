@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Starts an agent with the given arguments and waits for its socket to show up.
+func startAgent(t *testing.T, socket string, args ...string) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := newAgentCommand(ctx)
+	cmd.SetArgs(append([]string{"--socket", socket}, args...))
+	cmd.SetOutput(ioutil.Discard)
+	go cmd.Execute()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return cancel
+}
+
+func TestAgentCommand(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "agent.sock")
+	cache := filepath.Join(dir, "cache")
+	require.NoError(t, os.Mkdir(cache, 0755))
+	cancel := startAgent(t, socket, "-s", "testdata/blob1.store", "-c", cache)
+	defer cancel()
+
+	// Extract through the agent, the chunks end up in its cache
+	out := filepath.Join(dir, "blob")
+	extractCmd := newExtractCommand(context.Background())
+	extractCmd.SetArgs([]string{"-s", "unix://" + socket, "testdata/blob1.caibx", out})
+	stdout = ioutil.Discard
+	extractCmd.SetOutput(ioutil.Discard)
+	_, err := extractCmd.ExecuteC()
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+	files, err := ioutil.ReadDir(cache)
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	// A second agent can't take over the socket while the first is running
+	cmd := newAgentCommand(context.Background())
+	cmd.SetArgs([]string{"--socket", socket, "-s", "testdata/blob1.store"})
+	cmd.SetOutput(ioutil.Discard)
+	require.Error(t, cmd.Execute())
+
+	// This agent doesn't allow writing
+	chopCmd := newChopCommand(context.Background())
+	chopCmd.SetArgs([]string{"-s", "unix://" + socket, "testdata/blob2.caibx", "testdata/blob2"})
+	chopCmd.SetOutput(ioutil.Discard)
+	_, err = chopCmd.ExecuteC()
+	require.Error(t, err)
+}
+
+func TestAgentCommandWrite(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "agent.sock")
+	store := filepath.Join(dir, "store")
+	require.NoError(t, os.Mkdir(store, 0755))
+	cancel := startAgent(t, socket, "-s", store, "-w")
+	defer cancel()
+
+	chopCmd := newChopCommand(context.Background())
+	chopCmd.SetArgs([]string{"-s", "unix://" + socket, "testdata/blob1.caibx", "testdata/blob1"})
+	chopCmd.SetOutput(ioutil.Discard)
+	_, err := chopCmd.ExecuteC()
+	require.NoError(t, err)
+
+	// The chunks were written to the upstream store
+	verifyCmd := newVerifyCommand(context.Background())
+	verifyCmd.SetArgs([]string{"-s", store})
+	verifyCmd.SetOutput(ioutil.Discard)
+	_, err = verifyCmd.ExecuteC()
+	require.NoError(t, err)
+	files, err := ioutil.ReadDir(store)
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type applyBundleOptions struct {
+	cmdStoreOptions
+	stores     []string
+	seeds      []string
+	seedDirs   []string
+	inPlace    bool
+	printStats bool
+}
+
+func newApplyBundleCommand(ctx context.Context) *cobra.Command {
+	var opt applyBundleOptions
+
+	cmd := &cobra.Command{
+		Use:   "apply-bundle <bundle> <output>",
+		Short: "Build a blob from a bundle file",
+		Long: `Reads the index from a bundle file produced by the 'bundle' command and builds
+the blob from the chunks in the bundle and the given seeds, same as 'extract'.
+Chunks that are neither in the bundle nor in a seed can be read from additional
+stores provided with -s.`,
+		Example: `  desync apply-bundle --seed v1.caibx v2.debd v2.vmdk`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runApplyBundle(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "additional source store(s)")
+	flags.StringSliceVar(&opt.seeds, "seed", nil, "seed indexes")
+	flags.StringSliceVar(&opt.seedDirs, "seed-dir", nil, "directory with seed index files")
+	flags.BoolVarP(&opt.inPlace, "in-place", "k", false, "extract the file in place and keep it in case of error")
+	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "print statistics")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runApplyBundle(ctx context.Context, opt applyBundleOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+
+	inFile := args[0]
+	outFile := args[1]
+
+	bundle, err := desync.NewBundleStore(inFile, desync.StoreOptions{SkipVerify: opt.skipVerify})
+	if err != nil {
+		return err
+	}
+	idx, err := bundle.Index()
+	if err != nil {
+		bundle.Close()
+		return err
+	}
+
+	// Use the bundle as primary store, falling back to any other stores if given
+	var s desync.Store = bundle
+	if len(opt.stores) > 0 {
+		others, err := multiStoreWithRouter(opt.cmdStoreOptions, opt.stores...)
+		if err != nil {
+			bundle.Close()
+			return err
+		}
+		s = desync.NewStoreRouter(bundle, others)
+	}
+	defer s.Close()
+
+	seeds, err := readSeeds(outFile, opt.seeds, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	dSeeds, err := readSeedDirs(outFile, inFile, opt.seedDirs, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	seeds = append(seeds, dSeeds...)
+
+	assembleOpt := desync.AssembleOptions{N: opt.n, InvalidSeedAction: desync.InvalidSeedActionBailOut}
+
+	var stats *desync.ExtractStats
+	if opt.inPlace {
+		stats, err = writeInplace(ctx, outFile, idx, s, seeds, assembleOpt)
+	} else {
+		stats, err = writeWithTmpFile(ctx, outFile, "", idx, s, seeds, assembleOpt)
+	}
+	if err != nil {
+		return err
+	}
+	if opt.printStats {
+		return printJSON(stdout, stats)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type benchOptions struct {
+	cmdStoreOptions
+	chunkSizes  []int
+	count       int
+	keep        bool
+	printFormat string
+}
+
+func newBenchCommand(ctx context.Context) *cobra.Command {
+	var opt benchOptions
+
+	cmd := &cobra.Command{
+		Use:   "bench <store>",
+		Short: "Measure the performance of a store",
+		Long: `Writes chunks with random content to a store and reads them back, measuring
+the throughput as well as the latency of individual requests. Every operation
+is first run sequentially and then with the number of goroutines given in -n.
+This is repeated for each of the chunk sizes given in --chunk-size, in kb.
+
+The chunks are removed from the store when the benchmark is done, unless --keep
+is used. Stores that don't support removing chunks keep them.`,
+		Example: `  desync bench --chunk-size 16,64,256 -n 32 s3+https://s3.example.com/store`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBench(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.IntSliceVar(&opt.chunkSizes, "chunk-size", []int{64}, "size of the chunks in kb")
+	flags.IntVar(&opt.count, "count", 100, "number of chunks per run")
+	flags.BoolVar(&opt.keep, "keep", false, "don't remove the chunks from the store")
+	flags.StringVarP(&opt.printFormat, "format", "f", "plain", "output format, plain or json")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runBench(ctx context.Context, opt benchOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if opt.count < 1 {
+		return errors.New("--count must be at least 1")
+	}
+	for _, size := range opt.chunkSizes {
+		if size < 1 {
+			return fmt.Errorf("invalid chunk size %d", size)
+		}
+	}
+	if opt.printFormat != "plain" && opt.printFormat != "json" {
+		return fmt.Errorf("unsupported output format '%s'", opt.printFormat)
+	}
+	location := args[0]
+
+	s, err := WritableStore(location, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var (
+		results []desync.BenchResult
+		written []*desync.Chunk
+	)
+	if !opt.keep {
+		defer func() { removeBenchChunks(s, written) }()
+	}
+	for _, size := range opt.chunkSizes {
+		// Use different chunks for each run so none of them are already in
+		// the store, or in a cache on the way
+		var runs [][]*desync.Chunk
+		for _, n := range []int{1, opt.n} {
+			chunks, err := desync.NewBenchChunks(size*1024, opt.count)
+			if err != nil {
+				return err
+			}
+			written = append(written, chunks...)
+			runs = append(runs, chunks)
+			r, err := desync.BenchStoreChunks(ctx, s, chunks, n)
+			if err != nil {
+				return err
+			}
+			results = append(results, r)
+		}
+		for i, n := range []int{1, opt.n} {
+			r, err := desync.BenchGetChunks(ctx, s, runs[i], n)
+			if err != nil {
+				return err
+			}
+			results = append(results, r)
+		}
+	}
+
+	if opt.printFormat == "json" {
+		return printJSON(stdout, results)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Operation\tChunk size\tConcurrency\tChunks\tMB/s\tp50\tp90\tp99\tmax\t")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.2f\t%s\t%s\t%s\t%s\t\n",
+			r.Operation, r.ChunkSize, r.Concurrency, r.Chunks, r.Throughput/1e6,
+			r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+	}
+	return w.Flush()
+}
+
+// Removes the chunks written by the benchmark if the store supports it. Failures
+// are only reported since the benchmark results are valid regardless.
+func removeBenchChunks(s desync.Store, chunks []*desync.Chunk) {
+	s = withoutLimits(s)
+	if q, ok := s.(*desync.WriteDedupQueue); ok {
+		s = q.S
+	}
+	r, ok := s.(interface{ RemoveChunk(desync.ChunkID) error })
+	if !ok {
+		fmt.Fprintf(stderr, "store '%s' does not support removing chunks, %d chunks were left behind\n", s, len(chunks))
+		return
+	}
+	for _, c := range chunks {
+		err := r.RemoveChunk(c.ID())
+		if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, desync.ErrNotFound) {
+			fmt.Fprintln(stderr, "failed to remove chunk:", err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchCommand(t *testing.T) {
+	store := t.TempDir()
+
+	cmd := newBenchCommand(context.Background())
+	cmd.SetArgs([]string{"--chunk-size", "1,4", "--count", "5", "-n", "2", "--format", "json", store})
+	b := new(bytes.Buffer)
+	stdout = b
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Store and get, sequential and parallel, for each chunk size
+	var results []desync.BenchResult
+	require.NoError(t, json.Unmarshal(b.Bytes(), &results))
+	require.Len(t, results, 8)
+	for _, r := range results {
+		require.Equal(t, 5, r.Chunks)
+		require.Contains(t, []int{1024, 4096}, r.ChunkSize)
+		require.Contains(t, []int{1, 2}, r.Concurrency)
+	}
+
+	// The chunks should be removed again
+	files, err := filepath.Glob(filepath.Join(store, "*", "*.cacnk"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
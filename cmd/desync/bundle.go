@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type bundleOptions struct {
+	cmdStoreOptions
+	stores       []string
+	cache        string
+	excludeSeeds []string
+	have         string
+	printStats   bool
+}
+
+func newBundleCommand(ctx context.Context) *cobra.Command {
+	var opt bundleOptions
+
+	cmd := &cobra.Command{
+		Use:   "bundle <index> <bundle>",
+		Short: "Write an index and its chunks into a single bundle file",
+		Long: `Reads an index and writes it, together with the chunks it references, into a
+single bundle file. The bundle can be extracted with 'apply-bundle' without
+access to a store, which is useful for clients that can only download single
+files.
+
+Chunks that the client already has can be left out of the bundle. Use
+--exclude-seed to skip all chunks referenced in an index the client has a
+matching blob for (the seed used in 'apply-bundle'). Use --have with a bitmap
+produced by 'chunk-bitmap' on the client to skip chunks present in its local
+store or cache. Use '-' to read the index from STDIN.`,
+		Example: `  desync bundle -s /path/to/store --exclude-seed v1.caibx v2.caibx v2.debd
+  desync bundle -s /path/to/store --have device-chunks.bin v2.caibx v2.debd`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBundle(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s)")
+	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
+	flags.StringSliceVar(&opt.excludeSeeds, "exclude-seed", nil, "index of a seed available to the client, its chunks are not bundled")
+	flags.StringVar(&opt.have, "have", "", "bitmap file (from chunk-bitmap) with chunks available to the client")
+	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "print statistics")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runBundle(ctx context.Context, opt bundleOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if err := readsStdinOnce(append(args[:1:1], opt.excludeSeeds...)...); err != nil {
+		return err
+	}
+	if len(opt.stores) == 0 {
+		return errors.New("no store provided")
+	}
+
+	inFile := args[0]
+	outFile := args[1]
+
+	idx, err := readCaibxFile(inFile, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+
+	// Build the list of chunks the client already has
+	exclude := make(map[desync.ChunkID]struct{})
+	for _, name := range opt.excludeSeeds {
+		seed, err := readCaibxFile(name, opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+		for _, c := range seed.Chunks {
+			exclude[c.ID] = struct{}{}
+		}
+	}
+	if opt.have != "" {
+		b, err := os.ReadFile(opt.have)
+		if err != nil {
+			return err
+		}
+		have, err := desync.ChunkBitmapFromBytes(b, idx)
+		if err != nil {
+			return err
+		}
+		for _, id := range have.Present(idx) {
+			exclude[id] = struct{}{}
+		}
+	}
+
+	// Everything else is needed, in the order of the index
+	var ids []desync.ChunkID
+	err = desync.IndexChunks(idx)(ctx, func(id desync.ChunkID) error {
+		if _, ok := exclude[id]; !ok {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s, err := MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+
+	// Don't leave a partial bundle behind. The file needs to be closed before
+	// it can be removed on Windows.
+	stats, err := desync.WriteBundle(ctx, f, idx, ids, s, opt.n, desync.NewProgressBar("Bundling "))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(outFile)
+		return err
+	}
+	if opt.printStats {
+		return printJSON(stdout, stats)
+	}
+	return nil
+}
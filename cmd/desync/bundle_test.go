@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundleCommand(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	outDir := t.TempDir()
+
+	for _, test := range []struct {
+		name       string
+		bundleArgs []string
+		applyArgs  []string
+	}{
+		{"full bundle",
+			[]string{"-s", "testdata/blob1.store"},
+			nil},
+		{"bundle without seed chunks",
+			[]string{"-s", "testdata/blob1.store", "--exclude-seed", "testdata/blob2.caibx"},
+			[]string{"--seed", "testdata/blob2.caibx"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bundle := filepath.Join(outDir, "blob1.debd")
+			out := filepath.Join(outDir, "blob1")
+
+			cmd := newBundleCommand(context.Background())
+			cmd.SetArgs(append(test.bundleArgs, "testdata/blob1.caibx", bundle))
+			_, err := cmd.ExecuteC()
+			require.NoError(t, err)
+
+			cmd = newApplyBundleCommand(context.Background())
+			cmd.SetArgs(append(test.applyArgs, bundle, out))
+			_, err = cmd.ExecuteC()
+			require.NoError(t, err)
+
+			b, err := ioutil.ReadFile(out)
+			require.NoError(t, err)
+			require.Equal(t, expected, b)
+		})
+	}
+
+	// Without the seed, a bundle that excludes its chunks is incomplete
+	bundle := filepath.Join(outDir, "partial.debd")
+	cmd := newBundleCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob1.store", "--exclude-seed", "testdata/blob2.caibx", "testdata/blob1.caibx", bundle})
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	cmd = newApplyBundleCommand(context.Background())
+	cmd.SetArgs([]string{bundle, filepath.Join(outDir, "partial")})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(outDir, "partial"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -14,6 +14,7 @@ type cacheOptions struct {
 	cache         string
 	ignoreIndexes []string
 	ignoreChunks  []string
+	skipNull      bool
 }
 
 func newCacheCommand(ctx context.Context) *cobra.Command {
@@ -30,7 +31,15 @@ index file. Use '-' to read (a single) index from STDIN.
 To exclude chunks that are known to exist in the target store already, use
 --ignore <index> which will skip any chunks from the given index. The same can
 be achieved by providing the chunks in their ASCII representation in a text
-file with --ignore-chunks <file>.`,
+file with --ignore-chunks <file>.
+
+Chunks of only 0-bytes with the max chunk size of the indexes are produced
+locally instead of reading them from the source store. With --skip-null-chunk,
+they aren't written to the target either. desync doesn't need them, but other
+tools such as casync do.
+
+If the target is a local uncompressed store, the command checks that its
+filesystem has enough free space for the missing chunks before copying them.`,
 		Example: `  desync cache -s http://192.168.1.1/ -c /path/to/local file.caibx`,
 		Args:    cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -43,6 +52,7 @@ file with --ignore-chunks <file>.`,
 	flags.StringVarP(&opt.cache, "cache", "c", "", "target store")
 	flags.StringSliceVarP(&opt.ignoreIndexes, "ignore", "", nil, "index(s) to ignore chunks from")
 	flags.StringSliceVarP(&opt.ignoreChunks, "ignore-chunks", "", nil, "ignore chunks from text file")
+	flags.BoolVar(&opt.skipNull, "skip-null-chunk", false, "don't write the null chunk to the target store")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
@@ -51,6 +61,9 @@ func runCache(ctx context.Context, opt cacheOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if err := readsStdinOnce(append(args, opt.ignoreIndexes...)...); err != nil {
+		return err
+	}
 	if len(opt.stores) == 0 {
 		return errors.New("no source store provided")
 	}
@@ -58,15 +71,18 @@ func runCache(ctx context.Context, opt cacheOptions, args []string) error {
 		return errors.New("no target cache store provided")
 	}
 
-	// Read the input files and merge all chunk IDs in a map to de-dup them
-	idm := make(map[desync.ChunkID]struct{})
+	// Read the input files and merge all chunk IDs in a map to de-dup them,
+	// along with their size
+	idm := make(map[desync.ChunkID]uint64)
+	nullSizes := make(map[desync.HashAlgorithm][]uint64)
 	for _, name := range args {
 		c, err := readCaibxFile(name, opt.cmdStoreOptions)
 		if err != nil {
 			return err
 		}
+		nullSizes[c.Digest] = append(nullSizes[c.Digest], c.Index.ChunkSizeMax)
 		for _, c := range c.Chunks {
-			idm[c.ID] = struct{}{}
+			idm[c.ID] = c.Size
 		}
 	}
 	// If requested, skip/ignore all chunks that are referenced in other indexes or text files
@@ -112,9 +128,34 @@ func runCache(ctx context.Context, opt cacheOptions, args []string) error {
 	}
 	defer dst.Close()
 
+	// Make sure a local cache has room for the chunks that are missing from
+	// it. The size of compressed chunks isn't known before they're read, so
+	// only uncompressed caches are checked.
+	if ls, ok := withoutLimits(dst).(desync.LocalStore); ok && ls.Opt.Uncompressed {
+		var required uint64
+		for id, size := range idm {
+			if hasChunk, err := ls.HasChunk(id); err == nil && !hasChunk {
+				required += size
+			}
+		}
+		if err := desync.CheckFreeSpace(ls.Base, required); err != nil {
+			return err
+		}
+	}
+
+	// Don't download null chunks, and don't store them if requested. The null
+	// chunk IDs depend on the digest of the indexes they're from.
+	var src desync.Store = s
+	for digest, sizes := range nullSizes {
+		src = desync.NewNullChunkStoreWithDigest(src, digest, sizes...)
+		if opt.skipNull {
+			dst = desync.NewNullChunkStoreWithDigest(dst, digest, sizes...)
+		}
+	}
+
 	// If this is a terminal, we want a progress bar
 	pb := desync.NewProgressBar("")
 
 	// Pull all the chunks, and load them into the cache in the process
-	return desync.Copy(ctx, ids, s, dst, opt.n, pb)
+	return desync.Copy(ctx, ids, src, dst, opt.n, pb)
 }
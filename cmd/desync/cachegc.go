@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type cacheGCOptions struct {
+	cmdStoreOptions
+	maxAge     string
+	maxSize    string
+	interval   time.Duration
+	dryRun     bool
+	printStats bool
+}
+
+func newCacheGCCommand(ctx context.Context) *cobra.Command {
+	var opt cacheGCOptions
+
+	cmd := &cobra.Command{
+		Use:   "cache-gc <cache>",
+		Short: "Remove old chunks from a local cache",
+		Long: `Removes chunks from a local store used as cache that haven't been used for
+longer than --max-age, and the least recently used chunks until the cache is no
+larger than --max-size. Chunks are aged by their modification time, which is
+only updated when a chunk is read from a cache if the reading command is run with
+--cache-update-times. Otherwise chunks are aged by the time they were added.
+
+The age can be given in days with a 'd' suffix, like 30d, or as a duration like
+12h. The size can have a K, M, G or T suffix. With --interval, the cache is
+cleaned up repeatedly until the command is stopped. Use --dry-run to see how much
+would be removed, without removing anything.`,
+		Example: `  desync cache-gc --max-age 30d --max-size 50G /var/cache/desync
+  desync cache-gc --max-size 10G --interval 1h /var/cache/desync`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCacheGC(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&opt.maxAge, "max-age", "", "remove chunks that haven't been used for longer than this, like 30d or 12h")
+	flags.StringVar(&opt.maxSize, "max-size", "", "remove the least recently used chunks until the cache is no larger than this, like 50G")
+	flags.DurationVar(&opt.interval, "interval", 0, "clean up the cache repeatedly at this interval")
+	flags.BoolVar(&opt.dryRun, "dry-run", false, "show how much would be removed without removing anything")
+	flags.BoolVar(&opt.printStats, "print-stats", false, "print the results in JSON")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runCacheGC(ctx context.Context, opt cacheGCOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	gcOpt, err := parseCacheGCOptions(opt.maxAge, opt.maxSize)
+	if err != nil {
+		return err
+	}
+	gcOpt.DryRun = opt.dryRun
+	if opt.interval < 0 {
+		return errors.New("invalid --interval")
+	}
+
+	s, err := localCache(args[0], opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return cacheGCLoop(ctx, s, gcOpt, opt.interval, func(stats desync.CacheGCStats) error {
+		verb := "removed"
+		if opt.dryRun {
+			verb = "would be removed"
+		}
+		fmt.Fprintf(stderr, "%d of %d chunks (%d of %d bytes) %s from '%s'\n",
+			stats.ChunksRemoved, stats.Chunks, stats.BytesRemoved, stats.Bytes, verb, s)
+		if opt.printStats {
+			return printJSON(stdout, stats)
+		}
+		return nil
+	})
+}
+
+// Runs garbage collection on a cache and reports the results. If interval is
+// set, it's repeated until the context is cancelled. Errors of repeated runs are
+// logged rather than returned.
+func cacheGCLoop(ctx context.Context, s desync.LocalStore, opt desync.CacheGCOptions, interval time.Duration, report func(desync.CacheGCStats) error) error {
+	for {
+		stats, err := s.CollectGarbage(ctx, opt)
+		if err == nil {
+			err = report(stats)
+		}
+		if interval == 0 {
+			return err
+		}
+		if err != nil {
+			desync.Log.WithError(err).WithField("cache", s.String()).Error("failed to clean up cache")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Opens a cache location which needs to be a local store. Reading chunks
+// updates their modification time.
+func localCache(location string, cmdOpt cmdStoreOptions) (desync.LocalStore, error) {
+	s, err := storeFromLocation(location, cmdOpt)
+	if err != nil {
+		return desync.LocalStore{}, err
+	}
+	ls, ok := withoutLimits(s).(desync.LocalStore)
+	if !ok {
+		s.Close()
+		return desync.LocalStore{}, fmt.Errorf("cache '%s' is not a local store", location)
+	}
+	ls.UpdateTimes = true
+	return ls, nil
+}
+
+// Parses the limits for cleaning up caches. At least one has to be given.
+func parseCacheGCOptions(maxAge, maxSize string) (desync.CacheGCOptions, error) {
+	var (
+		opt desync.CacheGCOptions
+		err error
+	)
+	if maxAge == "" && maxSize == "" {
+		return opt, errors.New("--max-age or --max-size is required")
+	}
+	if maxAge != "" {
+		if opt.MaxAge, err = parseAge(maxAge); err != nil {
+			return opt, err
+		}
+	}
+	if maxSize != "" {
+		if opt.MaxSize, err = parseSize(maxSize); err != nil {
+			return opt, err
+		}
+	}
+	return opt, nil
+}
+
+// Parses a duration that can also be given in days, like 30d.
+func parseAge(s string) (time.Duration, error) {
+	var (
+		d   time.Duration
+		err error
+	)
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		var n float64
+		n, err = strconv.ParseFloat(days, 64)
+		d = time.Duration(n * float64(24*time.Hour))
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid age '%s'", s)
+	}
+	return d, nil
+}
+
+// Parses a size in bytes with an optional K, M, G or T suffix (powers of 1024).
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	if len(num) > 0 {
+		if i := strings.IndexByte("KMGT", num[len(num)-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
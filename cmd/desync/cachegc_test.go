@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGCCommand(t *testing.T) {
+	// Copy the chunks of a store into a cache and make them all old
+	cache := t.TempDir()
+	var chunkFile string
+	err := filepath.Walk("testdata/blob1.store", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel("testdata/blob1.store", path)
+		target := filepath.Join(cache, rel)
+		chunkFile = target
+		require.NoError(t, os.MkdirAll(filepath.Dir(target), 0755))
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(target, b, 0644))
+		old := time.Now().Add(-48 * time.Hour)
+		return os.Chtimes(target, old, old)
+	})
+	require.NoError(t, err)
+
+	// Reading from the cache doesn't change the chunks by default
+	extract := newExtractCommand(context.Background())
+	extract.SetArgs([]string{"-s", t.TempDir(), "-c", cache, "testdata/blob1.caibx", filepath.Join(t.TempDir(), "out")})
+	stderr = ioutil.Discard
+	extract.SetOutput(ioutil.Discard)
+	_, err = extract.ExecuteC()
+	require.NoError(t, err)
+	info, err := os.Stat(chunkFile)
+	require.NoError(t, err)
+	require.True(t, time.Since(info.ModTime()) > 24*time.Hour)
+
+	// Extract with --cache-update-times, that marks the chunks in the index as used
+	extract = newExtractCommand(context.Background())
+	extract.SetArgs([]string{"-s", t.TempDir(), "-c", cache, "--cache-update-times", "testdata/blob1.caibx", filepath.Join(t.TempDir(), "out")})
+	extract.SetOutput(ioutil.Discard)
+	_, err = extract.ExecuteC()
+	require.NoError(t, err)
+
+	// Remove everything not used in the last day, the cache should still work
+	// for the same extraction, without a store
+	cmd := newCacheGCCommand(context.Background())
+	cmd.SetArgs([]string{"--max-age", "1d", cache})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	extract = newExtractCommand(context.Background())
+	extract.SetArgs([]string{"-s", t.TempDir(), "-c", cache, "testdata/blob1.caibx", filepath.Join(t.TempDir(), "out")})
+	extract.SetOutput(ioutil.Discard)
+	_, err = extract.ExecuteC()
+	require.NoError(t, err)
+
+	// A limit is required
+	cmd = newCacheGCCommand(context.Background())
+	cmd.SetArgs([]string{cache})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+}
+
+func TestParseAgeAndSize(t *testing.T) {
+	d, err := parseAge("30d")
+	require.NoError(t, err)
+	require.Equal(t, 30*24*time.Hour, d)
+	d, err = parseAge("12h")
+	require.NoError(t, err)
+	require.Equal(t, 12*time.Hour, d)
+	_, err = parseAge("-1d")
+	require.Error(t, err)
+
+	n, err := parseSize("50G")
+	require.NoError(t, err)
+	require.Equal(t, int64(50<<30), n)
+	n, err = parseSize("1.5kb")
+	require.NoError(t, err)
+	require.Equal(t, int64(1536), n)
+	n, err = parseSize("100")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), n)
+	_, err = parseSize("G")
+	require.Error(t, err)
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"io"
+	"math"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/folbricht/desync"
 	"github.com/spf13/cobra"
@@ -15,26 +18,39 @@ type catOptions struct {
 	stores         []string
 	cache          string
 	offset, length int
+	output         string
+	seeds          []string
+	seedDirs       []string
 }
 
 func newCatCommand(ctx context.Context) *cobra.Command {
 	var opt catOptions
 
 	cmd := &cobra.Command{
-		Use:   "cat <index> [<output>]",
+		Use:   "cat <index> [<index>...] [<output>]",
 		Short: "Stream a blob to stdout or a file-like object",
 		Long: `Stream a blob to stdout or a file-like object, optionally seeking and limiting
 the read length.
 
+When multiple indexes are given, their blobs are streamed back-to-back as if
+they were one, with the offset and length applying to the combined stream.
+Chunks used more than once are only read from the store once. The output file
+can be given with --output, or for compatibility as the second argument when
+only one index is read and the name doesn't end in .caibx.
+
 Unlike extract, this supports output to FIFOs, named pipes, and other
 non-seekable destinations.
 
 This is inherently slower than extract as while multiple chunks can be
 retrieved concurrently, writing to stdout cannot be parallelized.
 
+Seeds given with --seed or --seed-dir are used to read chunks from local files
+before they're requested from the store.
+
 Use '-' to read the index from STDIN.`,
-		Example: `  desync cat -s http://192.168.1.1/ file.caibx | grep something`,
-		Args:    cobra.RangeArgs(1, 2),
+		Example: `  desync cat -s http://192.168.1.1/ file.caibx | grep something
+  desync cat -s /path/to/store --output image.bin part1.caibx part2.caibx part3.caibx`,
+		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runCat(ctx, opt, args)
 		},
@@ -45,6 +61,9 @@ Use '-' to read the index from STDIN.`,
 	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
 	flags.IntVarP(&opt.offset, "offset", "o", 0, "offset in bytes to seek to before reading")
 	flags.IntVarP(&opt.length, "length", "l", 0, "number of bytes to read")
+	flags.StringVar(&opt.output, "output", "", "write to this file instead of STDOUT")
+	flags.StringSliceVar(&opt.seeds, "seed", nil, "seed indexes")
+	flags.StringSliceVar(&opt.seedDirs, "seed-dir", nil, "directory with seed index files")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
@@ -53,40 +72,63 @@ func runCat(ctx context.Context, opt catOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
-
-	var (
-		outFile io.Writer
-		err     error
-	)
-	if len(args) == 2 {
-		outFileName := args[1]
-		outFile, err = os.Create(outFileName)
-		if err != nil {
-			return err
-		}
-	} else {
-		outFile = stdout
+	if err := readsStdinOnce(append(args, opt.seeds...)...); err != nil {
+		return err
 	}
 
-	inFile := args[0]
+	// Without --output, a 2nd argument that isn't an index is the output file
+	indexFiles := args
+	outFileName := opt.output
+	if outFileName == "" && len(args) == 2 && !strings.HasSuffix(args[1], ".caibx") {
+		indexFiles, outFileName = args[:1], args[1]
+	}
 
 	// Checkout the store
 	if len(opt.stores) == 0 {
 		return errors.New("no store provided")
 	}
 
+	// Read the input, combining all indexes into one
+	var c desync.Index
+	for _, name := range indexFiles {
+		idx, err := readCaibxFile(name, opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+		c = appendIndex(c, idx)
+	}
+	if len(c.Chunks) == 0 {
+		return nil
+	}
+
+	var outFile io.Writer = stdout
+	if outFileName != "" {
+		f, err := os.Create(outFileName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		outFile = f
+	}
+
 	// Parse the store locations, open the stores and add a cache is requested
 	s, err := MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
 	if err != nil {
 		return err
 	}
-	defer s.Close()
 
-	// Read the input
-	c, err := readCaibxFile(inFile, opt.cmdStoreOptions)
-	if err != nil {
+	// Read chunks from seeds if possible
+	if s, err = withSeedStore(s, opt.seeds, opt.seedDirs, "", opt.cmdStoreOptions); err != nil {
 		return err
 	}
+	defer s.Close()
+
+	// Keep chunks that are used again in the requested range in memory
+	length := uint64(math.MaxUint64)
+	if opt.length > 0 {
+		length = uint64(opt.length)
+	}
+	s = newRepeatChunkStore(s, c.RangeChunks(uint64(opt.offset), length), repeatChunkCacheSize)
 
 	// Write the output
 	readSeeker := desync.NewIndexReadSeeker(c, s)
@@ -101,3 +143,89 @@ func runCat(ctx context.Context, opt catOptions, args []string) error {
 	}
 	return err
 }
+
+// Appends the chunks of idx to c as if the blobs were concatenated. The chunk
+// size parameters of the result are the widest of both.
+func appendIndex(c, idx desync.Index) desync.Index {
+	if len(c.Chunks) == 0 {
+		c.Index = idx.Index
+	}
+	if idx.Index.ChunkSizeMin < c.Index.ChunkSizeMin {
+		c.Index.ChunkSizeMin = idx.Index.ChunkSizeMin
+	}
+	if idx.Index.ChunkSizeMax > c.Index.ChunkSizeMax {
+		c.Index.ChunkSizeMax = idx.Index.ChunkSizeMax
+	}
+	offset := uint64(c.Length())
+	for _, chunk := range idx.Chunks {
+		chunk.Start += offset
+		c.Chunks = append(c.Chunks, chunk)
+	}
+	return c
+}
+
+// Upper limit of the data held by a repeatChunkStore.
+const repeatChunkCacheSize = 64 << 20
+
+// repeatChunkStore holds on to chunks that are going to be requested again,
+// based on the list of chunks expected to be read in order. Chunks are dropped
+// after their last use. Up to max bytes of chunk data are kept, chunks beyond
+// that are read from the store again.
+type repeatChunkStore struct {
+	desync.Store
+	mu     sync.Mutex
+	refs   map[desync.ChunkID]int
+	sizes  map[desync.ChunkID]uint64
+	chunks map[desync.ChunkID]*desync.Chunk
+	size   uint64
+	max    uint64
+}
+
+func newRepeatChunkStore(s desync.Store, chunks []desync.IndexChunk, max uint64) *repeatChunkStore {
+	refs := make(map[desync.ChunkID]int)
+	sizes := make(map[desync.ChunkID]uint64)
+	for _, c := range chunks {
+		refs[c.ID]++
+		sizes[c.ID] = c.Size
+	}
+	return &repeatChunkStore{
+		Store:  s,
+		refs:   refs,
+		sizes:  sizes,
+		chunks: make(map[desync.ChunkID]*desync.Chunk),
+		max:    max,
+	}
+}
+
+func (s *repeatChunkStore) GetChunk(id desync.ChunkID) (*desync.Chunk, error) {
+	s.mu.Lock()
+	chunk, cached := s.chunks[id]
+	s.mu.Unlock()
+
+	// Don't hold the lock while reading from the store
+	if !cached {
+		var err error
+		chunk, err = s.Store.GetChunk(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs[id]--
+	if s.refs[id] > 0 {
+		if _, ok := s.chunks[id]; !ok && s.size+s.sizes[id] <= s.max {
+			s.chunks[id] = chunk
+			s.size += s.sizes[id]
+		}
+		return chunk, nil
+	}
+	if _, ok := s.chunks[id]; ok {
+		delete(s.chunks, id)
+		s.size -= s.sizes[id]
+	}
+	delete(s.refs, id)
+	delete(s.sizes, id)
+	return chunk, nil
+}
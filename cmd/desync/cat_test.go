@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"io/ioutil"
+	"path/filepath"
+	"strconv"
 	"testing"
 
+	"github.com/folbricht/desync"
 	"github.com/stretchr/testify/require"
 )
 
@@ -47,3 +50,98 @@ func TestCatCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestCatCommandMultipleIndexes(t *testing.T) {
+	f, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	expected := append(append([]byte{}, f...), f...)
+
+	// Stream the same blob twice, once to STDOUT and once into a file, starting
+	// close to the end of the first and reading into the second
+	cmd := newCatCommand(context.Background())
+	cmd.SetArgs([]string{"--store", "testdata/blob1.store", "-o", strconv.Itoa(len(f) - 1024), "-l", "4096", "testdata/blob1.caibx", "testdata/blob1.caibx"})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	require.Equal(t, expected[len(f)-1024:len(f)+3072], b.Bytes())
+
+	out := filepath.Join(t.TempDir(), "out")
+	cmd = newCatCommand(context.Background())
+	cmd.SetArgs([]string{"--store", "testdata/blob1.store", "--output", out, "testdata/blob1.caibx", "testdata/blob1.caibx"})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+
+	// The old form with the output file as 2nd argument still works
+	out = filepath.Join(t.TempDir(), "out")
+	cmd = newCatCommand(context.Background())
+	cmd.SetArgs([]string{"--store", "testdata/blob1.store", "testdata/blob1.caibx", out})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	got, err = ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, f, got)
+}
+
+func TestRepeatChunkStore(t *testing.T) {
+	s, err := desync.NewLocalStore(t.TempDir(), desync.StoreOptions{})
+	require.NoError(t, err)
+	chunk := desync.NewChunk([]byte("repeated"))
+	require.NoError(t, s.StoreChunk(chunk))
+	id := chunk.ID()
+
+	// The chunk is used twice, so it has to be kept after the first read
+	r := newRepeatChunkStore(s, []desync.IndexChunk{{ID: id, Size: 8}, {ID: id, Size: 8}}, 8)
+	_, err = r.GetChunk(id)
+	require.NoError(t, err)
+	require.Contains(t, r.chunks, id)
+
+	// Remove it from the store, the 2nd read needs to come from memory
+	require.NoError(t, s.RemoveChunk(id))
+	_, err = r.GetChunk(id)
+	require.NoError(t, err)
+	require.Empty(t, r.chunks)
+	require.Zero(t, r.size)
+}
+
+func TestRepeatChunkStoreLimit(t *testing.T) {
+	s, err := desync.NewLocalStore(t.TempDir(), desync.StoreOptions{})
+	require.NoError(t, err)
+	a := desync.NewChunk([]byte("chunk a"))
+	b := desync.NewChunk([]byte("chunk b"))
+	require.NoError(t, s.StoreChunk(a))
+	require.NoError(t, s.StoreChunk(b))
+
+	// Only one of the repeated chunks fits
+	r := newRepeatChunkStore(s, []desync.IndexChunk{
+		{ID: a.ID(), Size: 7}, {ID: b.ID(), Size: 7}, {ID: a.ID(), Size: 7}, {ID: b.ID(), Size: 7},
+	}, 10)
+	for _, id := range []desync.ChunkID{a.ID(), b.ID(), a.ID(), b.ID()} {
+		_, err = r.GetChunk(id)
+		require.NoError(t, err)
+		require.LessOrEqual(t, r.size, uint64(10))
+	}
+	require.Empty(t, r.chunks)
+	require.Zero(t, r.size)
+}
+
+func TestCatCommandSeed(t *testing.T) {
+	f, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+
+	// The store is empty, all chunks have to come from the seed
+	cmd := newCatCommand(context.Background())
+	cmd.SetArgs([]string{"--store", "testdata/empty.store", "--seed", "testdata/blob1.caibx", "-o", "1024", "testdata/blob1.caibx"})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	require.Equal(t, f[1024:], b.Bytes())
+}
@@ -16,6 +16,7 @@ type chopOptions struct {
 	store         string
 	ignoreIndexes []string
 	ignoreChunks  []string
+	skipNull      bool
 }
 
 func newChopCommand(ctx context.Context) *cobra.Command {
@@ -33,6 +34,10 @@ are known to exist in the target store already, use --ignore <index> which will
 skip any chunks from the given index. The same can be achieved by providing the
 chunks in their ASCII representation in a text file with --ignore-chunks <file>.
 
+With --skip-null-chunk, chunks of only 0-bytes with the max chunk size of the
+index aren't written to the store. desync doesn't need them, but other tools
+such as casync do.
+
 Use '-' to read the index from STDIN.`,
 		Example: `  desync chop -s sftp://192.168.1.1/store file.caibx largefile.bin`,
 		Args:    cobra.ExactArgs(2),
@@ -45,6 +50,7 @@ Use '-' to read the index from STDIN.`,
 	flags.StringVarP(&opt.store, "store", "s", "", "target store")
 	flags.StringSliceVarP(&opt.ignoreIndexes, "ignore", "", nil, "index(s) to ignore chunks from")
 	flags.StringSliceVarP(&opt.ignoreChunks, "ignore-chunks", "", nil, "ignore chunks from text file")
+	flags.BoolVar(&opt.skipNull, "skip-null-chunk", false, "don't write the null chunk to the store")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
@@ -53,6 +59,9 @@ func runChop(ctx context.Context, opt chopOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if err := readsStdinOnce(append(args[:1:1], opt.ignoreIndexes...)...); err != nil {
+		return err
+	}
 	if opt.store == "" {
 		return errors.New("no target store provided")
 	}
@@ -74,6 +83,12 @@ func runChop(ctx context.Context, opt chopOptions, args []string) error {
 	}
 	chunks := c.Chunks
 
+	// The null chunk isn't needed by desync and large empty areas are common
+	var ws desync.WriteStore = s
+	if opt.skipNull {
+		ws = desync.NewNullChunkStoreWithDigest(s, c.Digest, c.Index.ChunkSizeMax)
+	}
+
 	// If requested, skip/ignore all chunks that are referenced in other indexes or text files
 	if len(opt.ignoreIndexes) > 0 || len(opt.ignoreChunks) > 0 {
 		m := make(map[desync.ChunkID]desync.IndexChunk)
@@ -113,7 +128,7 @@ func runChop(ctx context.Context, opt chopOptions, args []string) error {
 	pb := desync.NewProgressBar("")
 
 	// Chop up the file into chunks and store them in the target store
-	return desync.ChopFile(ctx, dataFile, chunks, s, opt.n, pb)
+	return desync.ChopFile(ctx, dataFile, chunks, ws, opt.n, pb)
 }
 
 // Read a list of chunk IDs from a file. Blank lines are skipped.
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/folbricht/desync"
 	"github.com/stretchr/testify/require"
 )
 
@@ -62,3 +63,85 @@ func TestChopErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestChopShardedStore(t *testing.T) {
+	tmp := t.TempDir()
+	shard1, shard2 := filepath.Join(tmp, "shard1"), filepath.Join(tmp, "shard2")
+	require.NoError(t, os.Mkdir(shard1, 0755))
+	require.NoError(t, os.Mkdir(shard2, 0755))
+	store := "00-7f=" + shard1 + ";80-ff=" + shard2
+
+	// Write the chunks of a blob into the shards
+	cmd := newChopCommand(context.Background())
+	cmd.SetArgs([]string{"-s", store, "testdata/blob1.caibx", "testdata/blob1"})
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Each shard only holds the chunks of its range
+	for dir, valid := range map[string]string{shard1: "01234567", shard2: "89abcdef"} {
+		dirs, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.NotEmpty(t, dirs)
+		for _, d := range dirs {
+			require.Contains(t, valid, d.Name()[:1])
+		}
+	}
+
+	// Extract the blob again from the sharded store
+	out := filepath.Join(tmp, "blob1")
+	cmd = newExtractCommand(context.Background())
+	cmd.SetArgs([]string{"-s", store, "testdata/blob1.caibx", out})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+}
+
+func TestChopSkipNullChunk(t *testing.T) {
+	// A blob with a large empty area, split into chunks of the max size
+	dir := t.TempDir()
+	blob := filepath.Join(dir, "blob")
+	data, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(blob, append(make([]byte, 1024*1024), data...), 0644))
+	idx, _, err := desync.IndexFromFile(context.Background(), blob, 1, 16*1024, 64*1024, 256*1024, desync.NewProgressBar(""))
+	require.NoError(t, err)
+	index := filepath.Join(dir, "blob.caibx")
+	f, err := os.Create(index)
+	require.NoError(t, err)
+	_, err = idx.WriteTo(f)
+	require.NoError(t, err)
+	f.Close()
+
+	null := desync.NewNullChunk(idx.Index.ChunkSizeMax)
+	nullFile := func(store string) string {
+		return filepath.Join(store, null.ID.String()[:4], null.ID.String()+".cacnk")
+	}
+
+	for _, skip := range []bool{false, true} {
+		store := t.TempDir()
+		args := []string{"-s", store, index, blob}
+		if skip {
+			args = append([]string{"--skip-null-chunk"}, args...)
+		}
+		cmd := newChopCommand(context.Background())
+		cmd.SetArgs(args)
+		stderr = ioutil.Discard
+		cmd.SetOutput(ioutil.Discard)
+		_, err = cmd.ExecuteC()
+		require.NoError(t, err)
+
+		_, err = os.Stat(nullFile(store))
+		if skip {
+			require.True(t, os.IsNotExist(err))
+		} else {
+			require.NoError(t, err)
+		}
+	}
+}
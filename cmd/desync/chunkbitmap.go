@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type chunkBitmapOptions struct {
+	cmdStoreOptions
+	stores      []string
+	printFormat string
+}
+
+func newChunkBitmapCommand(ctx context.Context) *cobra.Command {
+	var opt chunkBitmapOptions
+
+	cmd := &cobra.Command{
+		Use:   "chunk-bitmap <index>",
+		Short: "Show which chunks of an index are available in a store",
+		Long: `Checks which chunks of an index are present in one or more stores, typically a
+local store or cache, and writes the result to STDOUT. By default, the output is
+a bitmap with one bit per chunk in the order of the index (duplicates included),
+with bit i in byte i/8, least significant bit first. The bitmap can be uploaded to
+a server holding the same index to prepare a download of only the missing chunks.
+Use --format=base64 for a text representation of the bitmap, or --format=list to
+print the IDs of the present chunks instead. Use '-' to read the index from STDIN.`,
+		Example: `  desync chunk-bitmap -s /var/cache/desync image.caibx > have.bin
+  desync chunk-bitmap -s /var/cache/desync --format=list image.caibx`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runChunkBitmap(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "store(s) to check for chunks")
+	flags.StringVarP(&opt.printFormat, "format", "f", "raw", "output format, raw, base64 or list")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runChunkBitmap(ctx context.Context, opt chunkBitmapOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if len(opt.stores) == 0 {
+		return errors.New("no store provided")
+	}
+	switch opt.printFormat {
+	case "raw", "base64", "list":
+	default:
+		return fmt.Errorf("unsupported output format '%s'", opt.printFormat)
+	}
+
+	// Read the index
+	idx, err := readCaibxFile(args[0], opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+
+	s, err := multiStoreWithRouter(opt.cmdStoreOptions, opt.stores...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	b, err := desync.ChunkPresence(ctx, idx, s, opt.n)
+	if err != nil {
+		return err
+	}
+
+	switch opt.printFormat {
+	case "raw":
+		_, err = stdout.Write(b)
+	case "base64":
+		_, err = fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(b))
+	case "list":
+		for _, id := range b.Present(idx) {
+			if _, err = fmt.Fprintln(stdout, id.String()); err != nil {
+				break
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkBitmapCommand(t *testing.T) {
+	f, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := desync.IndexFromReader(f)
+	require.NoError(t, err)
+
+	// All chunks are in the store, all bits should be set
+	cmd := newChunkBitmapCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob1.store", "testdata/blob1.caibx"})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	bm, err := desync.ChunkBitmapFromBytes(b.Bytes(), idx)
+	require.NoError(t, err)
+	for i := range idx.Chunks {
+		require.True(t, bm.Has(i))
+	}
+
+	// Nothing is present in an empty store
+	cmd = newChunkBitmapCommand(context.Background())
+	cmd.SetArgs([]string{"-s", t.TempDir(), "--format", "list", "testdata/blob1.caibx"})
+	b = new(bytes.Buffer)
+	stdout = b
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	require.Zero(t, b.Len())
+
+	// List the chunks that are present
+	cmd = newChunkBitmapCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob1.store", "--format", "list", "testdata/blob1.caibx"})
+	b = new(bytes.Buffer)
+	stdout = b
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	scanner := bufio.NewScanner(b)
+	for scanner.Scan() {
+		_, err := desync.ChunkIDFromString(scanner.Text())
+		require.NoError(t, err)
+	}
+	require.NoError(t, scanner.Err())
+}
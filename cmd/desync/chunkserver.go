@@ -2,20 +2,22 @@ package main
 
 import (
 	"context"
-
-	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/folbricht/desync"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 type chunkServerOptions struct {
 	cmdStoreOptions
 	cmdServerOptions
+	cmdEventOptions
+	cmdAdminOptions
 	stores          []string
 	cache           string
 	storeFile       string
@@ -24,6 +26,19 @@ type chunkServerOptions struct {
 	skipVerifyWrite bool
 	uncompressed    bool
 	logFile         string
+	dryRun          bool
+	maxChunkSize    uint64
+	checkFormat     bool
+	verifyDigest    bool
+	skipExisting    bool
+	altDigest       string
+	digestMap       string
+	warm            bool
+	altFormats      []string
+	encryptionPwd   string
+	cacheMaxAge     string
+	cacheMaxSize    string
+	cacheGCInterval time.Duration
 }
 
 func newChunkServerCommand(ctx context.Context) *cobra.Command {
@@ -43,13 +58,76 @@ is used, only uncompressed chunks are being served (and accepted). If the
 upstream store serves compressed chunks, everything will have to be decompressed 
 server-side so it's better to also read from uncompressed upstream stores.
 
+Chunks written to the server can be restricted in size with --max-chunk-size.
+With --check-format, chunks that can't be decoded, like invalid zstd data on a
+compressed server, are rejected. --verify-digest makes the server check that the
+chunk ID matches the data using the configured digest algorithm, regardless of
+--skip-verify-write. With --skip-existing, writes of chunks that are already in
+the store are answered with 204 without reading or verifying the data, and
+chunks that fail verification are rejected with 409. This reduces the load when
+many clients upload overlapping sets of chunks.
+
+To serve clients using a different digest algorithm from the same store, for
+example during a migration from SHA512-256 to SHA256, use --alt-digest together
+with --digest-map. Chunks can then be requested and written by their ID in either
+algorithm. The map file holds the translation from alternate to store IDs, it's
+updated when chunks are written to the server and can be built for an existing
+store with the digest-map command. Chunks written with either ID are always
+verified when --alt-digest is used.
+
+With --warm, clients can POST an index, or a list of chunk IDs with content type
+text/plain, to /warm before extracting it. The server then reads these chunks
+from the upstream stores in the background to have them in its cache by the time
+they are requested. This requires a cache and uses --concurrency goroutines.
+
+Local caches can be cleaned up in the background with --cache-max-age and
+--cache-max-size, every --cache-gc-interval. This works like the cache-gc
+command. With --cache-max-age, chunks served from the cache are marked as used,
+like with --cache-update-times.
+
+Clients that expect a different chunk format, for example during a migration from
+compressed to uncompressed and encrypted chunks, can be served from the same
+endpoint with --alt-format. Clients choose the format with the Accept or
+Content-Type header, others are served the default format. Supported formats are
+zstd, plain, aes-256-gcm and zstd+aes-256-gcm. Encrypted formats require a
+password given with --encryption-password or DESYNC_ENCRYPTION_PASSWORD.
+
+With --webhook, every chunk written to the server is reported as an event in a
+JSON POST request to the given URLs, or appended to a file with --event-log.
+
 While --concurrency does not limit the number of clients that can be served
 concurrently, it does influence connection pools to remote upstream stores and
 needs to be chosen carefully if the server is under high load.
 
+With --http3, the server also accepts HTTP/3 (QUIC) connections on the UDP ports
+of the listen addresses. This requires --key and --cert. Clients use it with the
+http3 store option. QUIC often performs better than TCP on lossy links, like
+cellular connections, when many small chunks are requested. HTTP/3 connections
+are only subject to --idle-timeout and --max-body-size, --read-timeout,
+--read-header-timeout and --write-timeout don't apply to them.
+
+With --admin-authorization, the server can be managed through the /admin
+endpoints, for clients that send the given value in their Authorization header.
+GET /admin/config returns the store configuration in use, without passwords, and
+/admin/status the health of each upstream store and the size of the caches. A
+POST request to /admin/reload opens the stores and caches again, reading the
+store-file if there is one. /admin/cache/clear removes all chunks from the local
+caches before opening them again, and /admin/cache/gc cleans them up like the
+cache-gc command, using --cache-max-age and --cache-max-size or the max-age and
+max-size query parameters. Chunks are only marked as used for max-age if
+--cache-max-age or --cache-update-times is set. The admin endpoints can be served on a separate
+address, for example one that's only reachable internally, with --admin-listen.
+
 This command supports the --store-file option which can be used to define the stores
 and caches in a JSON file. The config can then be reloaded by sending a SIGHUP without
-needing to restart the server. This can be done under load as well.
+needing to restart the server. This can be done under load as well. The new stores
+are probed before they're used, if that fails, the server keeps using the current
+ones. Use --dry-run to check a configuration without starting the server.
+
+A version 2 store-file can also define additional stores that are served under
+path prefixes, and scopes that limit which clients can read from or write to
+which prefixes based on their Authorization header. This allows one server to
+be shared by several teams.
 `,
 		Example: `  desync chunk-server -s sftp://192.168.1.1/store -c /path/to/cache -l :8080`,
 		Args:    cobra.NoArgs,
@@ -68,8 +146,24 @@ needing to restart the server. This can be done under load as well.
 	flags.BoolVar(&opt.skipVerifyWrite, "skip-verify-write", true, "don't verify chunk data written to this server (faster)")
 	flags.BoolVarP(&opt.uncompressed, "uncompressed", "u", false, "serve uncompressed chunks")
 	flags.StringVar(&opt.logFile, "log", "", "request log file or - for STDOUT")
+	flags.BoolVar(&opt.dryRun, "dry-run", false, "validate the store configuration and exit")
+	flags.Uint64Var(&opt.maxChunkSize, "max-chunk-size", 0, "maximum size of chunks written to this server in kb, 0 for unlimited")
+	flags.BoolVar(&opt.checkFormat, "check-format", false, "reject written chunks that are not in the storage format of the server")
+	flags.BoolVar(&opt.verifyDigest, "verify-digest", false, "always verify the digest of written chunks")
+	flags.BoolVar(&opt.skipExisting, "skip-existing", false, "don't write chunks that are already in the store, answer with 204")
+	flags.StringVar(&opt.altDigest, "alt-digest", "", "also serve chunks by their ID in this digest algorithm, sha512-256 or sha256, requires --digest-map")
+	flags.StringVar(&opt.digestMap, "digest-map", "", "file mapping chunk IDs of the alternate digest to IDs in the store")
+	flags.StringSliceVar(&opt.altFormats, "alt-format", nil, "additional chunk format clients can request, like plain or aes-256-gcm")
+	flags.StringVar(&opt.encryptionPwd, "encryption-password", "", "password for encrypted chunk formats given in --alt-format")
+	flags.StringVar(&opt.cacheMaxAge, "cache-max-age", "", "periodically remove chunks from the cache that haven't been used for longer than this, like 30d")
+	flags.StringVar(&opt.cacheMaxSize, "cache-max-size", "", "periodically remove the least recently used chunks from the cache if it's larger than this, like 50G")
+	flags.DurationVar(&opt.cacheGCInterval, "cache-gc-interval", time.Hour, "interval for cleaning up the cache with --cache-max-age or --cache-max-size")
+	flags.BoolVar(&opt.http3, "http3", false, "also serve HTTP/3 (QUIC) on the UDP ports of the listen addresses, requires --key and --cert. Read and write timeouts don't apply to HTTP/3")
+	flags.BoolVar(&opt.warm, "warm", false, "accept lists of chunks to read into the cache ahead of clients requesting them")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	addServerOptions(&opt.cmdServerOptions, flags)
+	addEventOptions(&opt.cmdEventOptions, flags)
+	addAdminOptions(&opt.cmdAdminOptions, flags)
 	return cmd
 }
 
@@ -80,9 +174,40 @@ func runChunkServer(ctx context.Context, opt chunkServerOptions, args []string)
 	if err := opt.cmdServerOptions.validate(); err != nil {
 		return err
 	}
+	if err := opt.cmdEventOptions.validate(); err != nil {
+		return err
+	}
+	if err := opt.cmdAdminOptions.validate(opt.listenAddresses); err != nil {
+		return err
+	}
+	if (opt.altDigest == "") != (opt.digestMap == "") {
+		return errors.New("--alt-digest and --digest-map options need to be provided together")
+	}
 	if opt.auth == "" {
 		opt.auth = os.Getenv("DESYNC_HTTP_AUTH")
 	}
+	if opt.adminAuth == "" {
+		opt.adminAuth = os.Getenv("DESYNC_ADMIN_AUTH")
+	}
+	if opt.readyProbe == "write" && !opt.writable {
+		return errors.New("--ready-probe write requires --writable")
+	}
+	var gcOpt desync.CacheGCOptions
+	cacheGC := opt.cacheMaxAge != "" || opt.cacheMaxSize != ""
+	if cacheGC {
+		var err error
+		if gcOpt, err = parseCacheGCOptions(opt.cacheMaxAge, opt.cacheMaxSize); err != nil {
+			return err
+		}
+		if opt.cacheGCInterval <= 0 {
+			return errors.New("invalid --cache-gc-interval")
+		}
+		// Chunks served from the cache need to be marked as used to be aged
+		// correctly
+		if opt.cacheMaxAge != "" {
+			opt.cacheUpdateTimes = true
+		}
+	}
 
 	addresses := opt.listenAddresses
 	if len(addresses) == 0 {
@@ -90,49 +215,166 @@ func runChunkServer(ctx context.Context, opt chunkServerOptions, args []string)
 	}
 
 	// Extract the store setup from command line options and validate it
-	s, err := chunkServerStore(opt)
+	s, upstream, cfg, err := chunkServerStore(opt)
 	if err != nil {
 		return err
 	}
+	live := &liveStores{main: upstream}
+	if opt.dryRun {
+		defer s.Close()
+		return desync.ProbeStore(s, opt.writable)
+	}
+
+	// Restrict access to the stores based on the scopes in the store-file, and
+	// reload them together with the stores. Scopes can be added by reloading
+	// even if there are none at the start.
+	var authz *desync.ScopeAuthorizer
+	if opt.auth == "" {
+		authz = desync.NewScopeAuthorizer(cfg.Scopes)
+	}
 
 	// When a store file is used, it's possible to reload the store setup from it
 	// on the fly. Wrap the store into a SwapStore and start a handler for SIGHUP,
-	// reloading the store config from file.
-	if opt.storeFile != "" {
+	// reloading the store config from file. The admin endpoints use the same
+	// mechanism to re-open the stores and caches.
+	var reloader *storeReloader
+	if opt.storeFile != "" || opt.adminAuth != "" {
 		if _, ok := s.(desync.WriteStore); ok {
 			s = desync.NewSwapWriteStore(s)
 		} else {
 			s = desync.NewSwapStore(s)
 		}
 
-		go func() {
-			for range sighup {
-				newStore, err := chunkServerStore(opt)
-				if err != nil {
-					fmt.Fprintln(stderr, "failed to reload configuration:", err)
-					continue
-				}
-				switch store := s.(type) {
-				case *desync.SwapStore:
-					if err := store.Swap(newStore); err != nil {
-						fmt.Fprintln(stderr, "failed to reload configuration:", err)
-					}
-				case *desync.SwapWriteStore:
-					if err := store.Swap(newStore); err != nil {
-						fmt.Fprintln(stderr, "failed to reload configuration:", err)
-					}
-				}
+		// The upstream stores of a loaded config are only reported once they're
+		// swapped in. Both functions are called with the reloader locked.
+		var loaded []servedStore
+		reloader = newStoreReloader(s, cfg, func() (desync.Store, storeFile, error) {
+			s, upstream, c, err := chunkServerStore(opt)
+			loaded = upstream
+			return s, c, err
+		}, func(c storeFile) {
+			live.setMain(loaded)
+			if authz != nil {
+				authz.SetScopes(c.Scopes)
 			}
-		}()
+		})
+		if opt.storeFile != "" {
+			go reloader.onSIGHUP()
+		}
 	}
 	defer s.Close()
 
 	var converters desync.Converters
 	if !opt.uncompressed {
-		converters = desync.Converters{desync.Compressor{}}
+		converters = desync.Converters{desync.Compressor{Level: opt.compressionLevel}}
 	}
 
-	handler := desync.NewHTTPHandler(s, opt.writable, opt.skipVerifyWrite, converters, opt.auth)
+	limits := desync.ChunkWriteLimits{
+		MaxSize:      opt.maxChunkSize * 1024,
+		CheckFormat:  opt.checkFormat,
+		VerifyDigest: opt.verifyDigest,
+	}
+	skipVerifyWrite := opt.skipVerifyWrite
+	if opt.altDigest != "" {
+		// The handler can only verify IDs of the global digest, leave it to the dual-digest store
+		skipVerifyWrite = true
+		limits.VerifyDigest = false
+	}
+	if opt.encryptionPwd == "" {
+		opt.encryptionPwd = os.Getenv("DESYNC_ENCRYPTION_PASSWORD")
+	}
+	var altConverters []desync.Converters
+	for _, format := range opt.altFormats {
+		c, err := desync.ParseChunkFormat(format, opt.encryptionPwd)
+		if err != nil {
+			return err
+		}
+		altConverters = append(altConverters, c)
+	}
+
+	// Clean up local caches in the background. Caches added by reloading the
+	// store-file are not included.
+	if cacheGC {
+		locations := cfg.cacheLocations()
+		if len(locations) == 0 {
+			return errors.New("--cache-max-age and --cache-max-size require a cache")
+		}
+		cacheOpt := opt.cmdStoreOptions
+		cacheOpt.storeFileOptions = cfg.options()
+		for _, location := range locations {
+			c, err := localCache(location, cacheOpt)
+			if err != nil {
+				return err
+			}
+			go cacheGCLoop(ctx, c, gcOpt, opt.cacheGCInterval, func(stats desync.CacheGCStats) error {
+				desync.Log.WithFields(logrus.Fields{
+					"cache":          c.String(),
+					"chunks-removed": stats.ChunksRemoved,
+					"bytes-removed":  stats.BytesRemoved,
+				}).Info("cleaned up cache")
+				return nil
+			})
+		}
+	}
+
+	var warmer *desync.ChunkWarmer
+	if opt.warm {
+		if len(cfg.cacheLocations()) == 0 {
+			return errors.New("--warm requires a cache")
+		}
+		warmer = desync.NewChunkWarmer(s, opt.n)
+	}
+	notify, closeEvents, err := opt.cmdEventOptions.notifier()
+	if err != nil {
+		return err
+	}
+	if closeEvents != nil {
+		defer closeEvents()
+	}
+	hopt := desync.HTTPHandlerOptions{
+		Writable:        opt.writable,
+		SkipVerifyWrite: skipVerifyWrite,
+		Converters:      converters,
+		Authorization:   opt.auth,
+		Limits:          limits,
+		SkipExisting:    opt.skipExisting,
+		AltConverters:   altConverters,
+		Warmer:          warmer,
+		Notify:          notify,
+	}
+	if authz != nil {
+		hopt.Authorize = authz.Authorize
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", desync.NewHTTPHandlerWithOptions(s, hopt))
+
+	// Serve the additional stores under their prefixes
+	for _, prefix := range cfg.prefixes() {
+		writable := cfg.prefixWritable(prefix)
+		ps, err := chunkServerPrefixStore(opt, cfg, prefix, writable)
+		if err != nil {
+			return err
+		}
+		defer ps.Close()
+		live.prefixes = append(live.prefixes, servedStore{cfg.prefixLocation(prefix), ps})
+		popt := hopt
+		popt.Prefix = prefix
+		popt.Writable = writable
+		popt.SkipVerifyWrite = opt.skipVerifyWrite
+		popt.Limits.VerifyDigest = opt.verifyDigest
+		popt.Warmer = nil
+		mux.Handle(prefix+"/", desync.NewHTTPHandlerWithOptions(ps, popt))
+	}
+
+	// Serve the admin endpoints on their own address if requested
+	var admin http.Handler
+	if opt.adminAuth != "" {
+		admin = chunkServerAdmin(opt, reloader, live, gcOpt).handler(opt.adminAuth)
+		if opt.adminListen == "" {
+			mux.Handle("/admin/", admin)
+		}
+	}
+	var handler http.Handler = mux
 
 	// Wrap the handler in a logger if requested
 	switch opt.logFile {
@@ -148,9 +390,22 @@ func runChunkServer(ctx context.Context, opt chunkServerOptions, args []string)
 		handler = withLog(handler, log.New(l, "", log.LstdFlags))
 	}
 
-	http.Handle("/", handler)
+	// Ready once every upstream store in use can be reached, and written to
+	// if requested
+	http.Handle("/", withHealth(handler, opt.cmdServerOptions, func() error {
+		if err := live.check(); err != nil {
+			return err
+		}
+		if opt.readyProbe == "write" {
+			return desync.ProbeStore(s, true)
+		}
+		return nil
+	}))
 
 	// Start the server
+	if opt.adminListen != "" {
+		return serveWithAdmin(ctx, opt.cmdServerOptions, opt.adminListen, admin, addresses...)
+	}
 	return serve(ctx, opt.cmdServerOptions, addresses...)
 }
 
@@ -163,51 +418,155 @@ func withLog(h http.Handler, log *log.Logger) http.HandlerFunc {
 	}
 }
 
-// Reads the store-related command line options and returns the appropriate store.
-func chunkServerStore(opt chunkServerOptions) (desync.Store, error) {
-	stores := opt.stores
-	cache := opt.cache
+// Returns the admin API of the chunk server. It works on the configuration that
+// was last loaded by the reloader.
+func chunkServerAdmin(opt chunkServerOptions, reloader *storeReloader, live *liveStores, gcOpt desync.CacheGCOptions) adminAPI {
+	// Options for opening the stores in the current configuration
+	current := func() (storeFile, cmdStoreOptions) {
+		c := reloader.config()
+		cmdOpt := opt.cmdStoreOptions
+		cmdOpt.storeFileOptions = c.options()
+		return c, cmdOpt
+	}
+	return adminAPI{
+		config: func() interface{} {
+			return redactStoreFile(reloader.config())
+		},
+		status: func(ctx context.Context) interface{} {
+			c, cmdOpt := current()
+			return adminStatus{
+				Stores: live.status(),
+				Caches: cachesGC(ctx, c.cacheLocations(), cmdOpt, desync.CacheGCOptions{DryRun: true}),
+			}
+		},
+		reload: reloader.reload,
+		clearCaches: func(ctx context.Context) error {
+			c, cmdOpt := current()
+			return clearCaches(ctx, c.cacheLocations(), cmdOpt)
+		},
+		cacheGC: func(ctx context.Context, gcOpt desync.CacheGCOptions) interface{} {
+			c, cmdOpt := current()
+			l := cachesGC(ctx, c.cacheLocations(), cmdOpt, gcOpt)
+			for _, status := range l {
+				if status.Error != "" {
+					continue
+				}
+				desync.Log.WithFields(logrus.Fields{
+					"cache":          status.Location,
+					"chunks-removed": status.ChunksRemoved,
+					"bytes-removed":  status.BytesRemoved,
+				}).Info("cleaned up cache")
+			}
+			return l
+		},
+		gcOptions: gcOpt,
+	}
+}
 
-	var err error
-	if opt.storeFile != "" {
-		if len(stores) != 0 {
-			return nil, errors.New("--store and --store-file can't be used together")
-		}
-		if cache != "" {
-			return nil, errors.New("--cache and --store-file can't be used together")
+// Removes all chunks from the caches, which need to be local stores.
+func clearCaches(ctx context.Context, locations []string, cmdOpt cmdStoreOptions) error {
+	for _, location := range locations {
+		c, err := localCache(location, cmdOpt)
+		if err != nil {
+			return err
 		}
-		stores, cache, err = readStoreFile(opt.storeFile)
+		err = c.Prune(ctx, nil)
+		c.Close()
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to read store-file '%s'", err)
+			return err
 		}
+		desync.Log.WithField("cache", location).Info("cleared cache")
+	}
+	return nil
+}
+
+// Reads the store-related command line options and returns the appropriate store
+// as well as the configuration it was built from.
+func chunkServerStore(opt chunkServerOptions) (desync.Store, []servedStore, storeFile, error) {
+	c, err := storeConfig(opt.stores, opt.cache, opt.storeFile)
+	if err != nil {
+		return nil, nil, c, err
+	}
+	if len(c.Scopes) > 0 && opt.auth != "" {
+		return nil, nil, c, errors.New("--authorization can't be used together with scopes in the store-file")
 	}
+	opt.storeFileOptions = c.options()
+	stores, caches := c.locations(), c.cacheLocations()
 
 	// Got to have at least one upstream store
 	if len(stores) == 0 {
-		return nil, errors.New("no store provided")
+		return nil, nil, c, errors.New("no store provided")
 	}
 
 	// When supporting writing, only one upstream store is possible and no cache
-	if opt.writable && (len(stores) > 1 || cache != "") {
-		return nil, errors.New("Only one upstream store supported for writing and no cache")
+	if opt.writable && (len(stores) > 1 || len(caches) > 0) {
+		return nil, nil, c, errors.New("Only one upstream store supported for writing and no cache")
 	}
 
-	var s desync.Store
+	// Keep the upstream stores to report their health
+	var (
+		s        desync.Store
+		upstream []servedStore
+	)
 	if opt.writable {
-		s, err = WritableStore(stores[0], opt.cmdStoreOptions)
+		ws, err := WritableStore(stores[0], opt.cmdStoreOptions)
 		if err != nil {
-			return nil, err
+			return nil, nil, c, err
 		}
+		upstream = []servedStore{{stores[0], ws}}
+		// Coalesce concurrent requests for the same chunk, including HasChunk
+		// probes from many clients checking the same chunks at once
+		s = desync.NewWriteDedupQueue(ws)
 	} else {
-		s, err = MultiStoreWithCache(opt.cmdStoreOptions, cache, stores...)
+		var group []desync.Store
+		for _, location := range stores {
+			g, err := storeGroup(location, opt.cmdStoreOptions)
+			if err != nil {
+				return nil, nil, c, err
+			}
+			group = append(group, g)
+			upstream = append(upstream, servedStore{location, g})
+		}
+		s, err = withCaches(opt.cmdStoreOptions, desync.NewStoreRouter(group...), caches)
 		if err != nil {
-			return nil, err
+			return nil, nil, c, err
 		}
 		// We want to take the edge of a large number of requests coming in for the same chunk. No need
 		// to hit the (potentially slow) upstream stores for duplicated requests.
 		s = desync.NewDedupQueue(s)
 	}
-	return s, nil
+
+	// Serve chunks by their ID in a second digest algorithm as well if requested
+	if opt.altDigest != "" {
+		alt, err := parseDigestAlgorithm(opt.altDigest)
+		if err != nil {
+			s.Close()
+			return nil, nil, c, err
+		}
+		s, err = desync.NewDualDigestStore(s, alt, opt.digestMap)
+		if err != nil {
+			return nil, nil, c, err
+		}
+	}
+	return s, upstream, c, nil
+}
+
+// Opens the store served under a prefix given in the store-file.
+func chunkServerPrefixStore(opt chunkServerOptions, c storeFile, prefix string, writable bool) (desync.Store, error) {
+	opt.storeFileOptions = c.options()
+	location := c.prefixLocation(prefix)
+	if writable {
+		ws, err := WritableStore(location, opt.cmdStoreOptions)
+		if err != nil {
+			return nil, err
+		}
+		return desync.NewWriteDedupQueue(ws), nil
+	}
+	s, err := multiStoreWithCaches(opt.cmdStoreOptions, nil, location)
+	if err != nil {
+		return nil, err
+	}
+	return desync.NewDedupQueue(s), nil
 }
 
 type loggingResponseWriter struct {
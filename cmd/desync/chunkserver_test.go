@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/folbricht/desync"
 	"github.com/stretchr/testify/require"
 )
 
@@ -181,3 +185,415 @@ func startChunkServer(t *testing.T, args ...string) (string, context.CancelFunc)
 	time.Sleep(time.Second)
 	return addr, cancel
 }
+
+func TestChunkServerDryRun(t *testing.T) {
+	storeFile := filepath.Join(t.TempDir(), "stores.json")
+
+	// A working store passes
+	require.NoError(t, ioutil.WriteFile(storeFile, []byte(`{"stores": ["testdata/blob1.store"]}`), 0644))
+	cmd := newChunkServerCommand(context.Background())
+	cmd.SetArgs([]string{"--store-file", storeFile, "--dry-run"})
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// One that can't be reached fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	require.NoError(t, ioutil.WriteFile(storeFile, []byte(fmt.Sprintf(`{"stores": ["http://%s/"]}`, addr)), 0644))
+	cmd = newChunkServerCommand(context.Background())
+	cmd.SetArgs([]string{"--store-file", storeFile, "--dry-run", "-e", "1"})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+}
+
+func TestPrintStoreFileDiff(t *testing.T) {
+	config := func(cache string, stores ...string) storeFile {
+		c, err := storeConfig(stores, cache, "")
+		require.NoError(t, err)
+		return c
+	}
+
+	b := new(strings.Builder)
+	printStoreFileDiff(b, config("/c1", "/a", "/b"), config("/c2", "/b", "/d"))
+	require.Equal(t, "removed store: /a\nadded store: /d\nchanged cache: '/c1' -> '/c2'\n", b.String())
+
+	b.Reset()
+	printStoreFileDiff(b, config("", "/a", "/b"), config("", "/b", "/a"))
+	require.Equal(t, "changed store order: /b, /a\n", b.String())
+
+	b.Reset()
+	printStoreFileDiff(b, config("", "/a"), config("", "/a"))
+	require.Equal(t, "store configuration unchanged\n", b.String())
+
+	b.Reset()
+	withOptions := config("", "/a")
+	withOptions.Stores[0].Options = &desync.StoreOptions{Uncompressed: true}
+	printStoreFileDiff(b, config("", "/a"), withOptions)
+	require.Equal(t, "changed options: /a\n", b.String())
+}
+
+func TestChunkServerStoreFileV2(t *testing.T) {
+	tmp := t.TempDir()
+	cache1 := filepath.Join(tmp, "cache1")
+	cache2 := filepath.Join(tmp, "cache2")
+	require.NoError(t, os.Mkdir(cache1, 0755))
+	require.NoError(t, os.Mkdir(cache2, 0755))
+
+	// Serve chunks through two tiers of caches, the second one is uncompressed
+	storeFile := filepath.Join(tmp, "stores.json")
+	require.NoError(t, ioutil.WriteFile(storeFile, []byte(fmt.Sprintf(`{
+  "version": 2,
+  "stores": [{"location": "testdata/blob1.store", "options": {"rate-limit": 1000}}],
+  "caches": ["%s", {"location": "%s", "options": {"uncompressed": true}}]
+}`, cache1, cache2)), 0644))
+	addr, cancel := startChunkServer(t, "--store-file", storeFile)
+	defer cancel()
+
+	extractCmd := newExtractCommand(context.Background())
+	extractCmd.SetArgs([]string{"-s", fmt.Sprintf("http://%s/", addr), "testdata/blob1.caibx", filepath.Join(tmp, "blob")})
+	extractCmd.SetOutput(ioutil.Discard)
+	_, err := extractCmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Both caches should have been populated, in their respective formats
+	compressed, err := filepath.Glob(filepath.Join(cache1, "*", "*.cacnk"))
+	require.NoError(t, err)
+	require.NotEmpty(t, compressed)
+	uncompressed, err := filepath.Glob(filepath.Join(cache2, "*", "*"))
+	require.NoError(t, err)
+	require.Len(t, uncompressed, len(compressed))
+	require.Equal(t, "", filepath.Ext(uncompressed[0]))
+}
+
+func TestReadStoreFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "stores.json")
+
+	// Version 1 files with plain strings still work
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{"stores": ["/a", "/b|/c"], "cache": "/cache"}`), 0644))
+	c, err := readStoreFile(name)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/a", "/b|/c"}, c.locations())
+	require.Equal(t, []string{"/cache"}, c.cacheLocations())
+	require.Empty(t, c.options())
+
+	// Options in version 2 apply to all members of a failover group
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{"version": 2, "stores": ["/a", {"location": "/b|/c", "options": {"error-retry": 7}}], "caches": ["/c1", "/c2"]}`), 0644))
+	c, err = readStoreFile(name)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/a", "/b|/c"}, c.locations())
+	require.Equal(t, []string{"/c1", "/c2"}, c.cacheLocations())
+	opt := c.options()
+	require.Len(t, opt, 2)
+	require.Equal(t, 7, opt["/b"].ErrorRetry)
+	require.Equal(t, 7, opt["/c"].ErrorRetry)
+
+	// Invalid files
+	for _, content := range []string{
+		`{"stores": [{"location": "/a", "options": {}}]}`,
+		`{"stores": ["/a"], "caches": ["/c"]}`,
+		`{"version": 2, "stores": ["/a"], "cache": "/c", "caches": ["/c"]}`,
+		`{"version": 3, "stores": ["/a"]}`,
+		`{"version": 2, "stores": [{"options": {}}]}`,
+		`{"stores": ["/a"], "scopes": [{"prefix": "/"}]}`,
+		`{"version": 2, "stores": ["/a"], "prefixes": {"/": "/b"}}`,
+		`{"version": 2, "stores": ["/a"], "scopes": [{"prefix": "a"}]}`,
+	} {
+		require.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+		_, err = readStoreFile(name)
+		require.Error(t, err, content)
+	}
+}
+
+func TestChunkServerScopes(t *testing.T) {
+	tmp := t.TempDir()
+	teamA := filepath.Join(tmp, "team-a")
+	require.NoError(t, os.Mkdir(teamA, 0755))
+
+	// Team A can write to its own store under /a and read everything, anyone
+	// else can't access the server
+	storeFile := filepath.Join(tmp, "stores.json")
+	require.NoError(t, ioutil.WriteFile(storeFile, []byte(fmt.Sprintf(`{
+  "version": 2,
+  "stores": ["testdata/blob1.store"],
+  "prefixes": {"/a": "%s"},
+  "scopes": [
+    {"prefix": "/a", "authorization": "team-a", "writable": true},
+    {"prefix": "/", "authorization": "team-a"}
+  ]
+}`, teamA)), 0644))
+	addr, cancel := startChunkServer(t, "--store-file", storeFile)
+	defer cancel()
+
+	chunkPath := "/06b7/06b727fda4024fbf864090e62fb66597ed6ddf265b428601e4bbf1a3b51851bd.cacnk"
+	chunk, err := ioutil.ReadFile("testdata/blob1.store" + chunkPath)
+	require.NoError(t, err)
+
+	do := func(method, path, auth string) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", addr, path), strings.NewReader(string(chunk)))
+		require.NoError(t, err)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, do("GET", chunkPath, "team-a"))
+	require.Equal(t, http.StatusUnauthorized, do("GET", chunkPath, ""))
+	require.Equal(t, http.StatusUnauthorized, do("PUT", chunkPath, "team-a"))
+	require.Equal(t, http.StatusUnauthorized, do("PUT", "/a"+chunkPath, "team-b"))
+	require.Equal(t, http.StatusOK, do("PUT", "/a"+chunkPath, "team-a"))
+	require.Equal(t, http.StatusOK, do("GET", "/a"+chunkPath, "team-a"))
+
+	// The chunk was written to the store of team A
+	_, err = os.Stat(filepath.Join(teamA, chunkPath))
+	require.NoError(t, err)
+}
+
+func TestChunkServerScopesReload(t *testing.T) {
+	// The server starts without scopes, they're added by reloading the config
+	storeFile := filepath.Join(t.TempDir(), "stores.json")
+	require.NoError(t, ioutil.WriteFile(storeFile, []byte(`{"stores": ["testdata/blob1.store"]}`), 0644))
+	addr, cancel := startChunkServer(t, "--store-file", storeFile, "--admin-authorization", "Bearer admin")
+	defer cancel()
+
+	do := func(method, path, auth string) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", addr, path), nil)
+		require.NoError(t, err)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	chunkPath := "/06b7/06b727fda4024fbf864090e62fb66597ed6ddf265b428601e4bbf1a3b51851bd.cacnk"
+	require.Equal(t, http.StatusOK, do("GET", chunkPath, ""))
+
+	require.NoError(t, ioutil.WriteFile(storeFile, []byte(`{
+  "version": 2,
+  "stores": ["testdata/blob1.store"],
+  "scopes": [{"prefix": "/", "authorization": "team-a"}]
+}`), 0644))
+	require.Equal(t, http.StatusOK, do("POST", "/admin/reload", "Bearer admin"))
+	require.Equal(t, http.StatusUnauthorized, do("GET", chunkPath, ""))
+	require.Equal(t, http.StatusOK, do("GET", chunkPath, "team-a"))
+}
+
+func TestChunkServerCacheAdmin(t *testing.T) {
+	outdir := t.TempDir()
+	cache := filepath.Join(outdir, "cache")
+	require.NoError(t, os.Mkdir(cache, 0755))
+	addr, cancel := startChunkServer(t, "-s", "testdata/blob1.store", "-c", cache, "--admin-authorization", "Bearer admin")
+	defer cancel()
+	store := fmt.Sprintf("http://%s/", addr)
+
+	extract := func() {
+		extractCmd := newExtractCommand(context.Background())
+		extractCmd.SetArgs([]string{"-s", store, "testdata/blob1.caibx", filepath.Join(outdir, "blob")})
+		stdout = ioutil.Discard
+		extractCmd.SetOutput(ioutil.Discard)
+		_, err := extractCmd.ExecuteC()
+		require.NoError(t, err)
+	}
+	post := func(path, auth string) int {
+		req, err := http.NewRequest("POST", store+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	cached := func() int {
+		var n int
+		filepath.Walk(cache, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+
+	// Fill the cache
+	extract()
+	require.NotZero(t, cached())
+
+	// The admin endpoints need their own authorization
+	require.Equal(t, http.StatusUnauthorized, post("admin/cache/clear", ""))
+	require.NotZero(t, cached())
+
+	// Clear the cache and fill it again through the re-opened stores
+	require.Equal(t, http.StatusOK, post("admin/cache/clear", "Bearer admin"))
+	require.Zero(t, cached())
+	extract()
+	require.NotZero(t, cached())
+
+	// Replace the cache directory and re-open it
+	require.NoError(t, os.RemoveAll(cache))
+	require.NoError(t, os.Mkdir(cache, 0755))
+	require.Equal(t, http.StatusOK, post("admin/cache/reopen", "Bearer admin"))
+	extract()
+	require.NotZero(t, cached())
+
+	require.Equal(t, http.StatusNotFound, post("admin/other", "Bearer admin"))
+}
+
+func TestChunkServerAdmin(t *testing.T) {
+	outdir := t.TempDir()
+	cache := filepath.Join(outdir, "cache")
+	require.NoError(t, os.Mkdir(cache, 0755))
+	storeFile := filepath.Join(outdir, "stores.json")
+	require.NoError(t, ioutil.WriteFile(storeFile, []byte(fmt.Sprintf(
+		`{"version": 2, "stores": [{"location": "testdata/blob1.store", "options": {"http-auth": "Bearer secret"}}], "cache": %q}`, cache,
+	)), 0644))
+
+	// Serve the admin endpoints on their own address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	adminAddr := l.Addr().String()
+	l.Close()
+	addr, cancel := startChunkServer(t, "--store-file", storeFile, "--admin-listen", adminAddr, "--admin-authorization", "Bearer admin")
+	defer cancel()
+
+	// Fill the cache
+	extractCmd := newExtractCommand(context.Background())
+	extractCmd.SetArgs([]string{"-s", fmt.Sprintf("http://%s/", addr), "testdata/blob1.caibx", filepath.Join(outdir, "blob")})
+	stdout = ioutil.Discard
+	extractCmd.SetOutput(ioutil.Discard)
+	_, err = extractCmd.ExecuteC()
+	require.NoError(t, err)
+
+	request := func(method, host, path string) (int, []byte) {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s/%s", host, path), nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, b
+	}
+
+	// The admin endpoints are not available on the listen address
+	code, _ := request("GET", addr, "admin/status")
+	require.NotEqual(t, http.StatusOK, code)
+
+	// The config doesn't contain secrets
+	code, b := request("GET", adminAddr, "admin/config")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, string(b), "testdata/blob1.store")
+	require.NotContains(t, string(b), "secret")
+
+	// Status of the store and the cache
+	var status adminStatus
+	code, b = request("GET", adminAddr, "admin/status")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(b, &status))
+	require.Len(t, status.Stores, 1)
+	require.True(t, status.Stores[0].Healthy)
+	require.Len(t, status.Caches, 1)
+	require.NotZero(t, status.Caches[0].Chunks)
+	chunks := status.Caches[0].Chunks
+
+	// GC needs limits, either from the command line or the request
+	code, _ = request("POST", adminAddr, "admin/cache/gc")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = request("GET", adminAddr, "admin/cache/gc?max-size=1")
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// Remove everything from the cache
+	var gc []adminCacheStatus
+	code, b = request("POST", adminAddr, "admin/cache/gc?max-size=1")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(b, &gc))
+	require.Len(t, gc, 1)
+	require.Equal(t, chunks, gc[0].ChunksRemoved)
+	code, b = request("GET", adminAddr, "admin/status")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(b, &status))
+	require.Zero(t, status.Caches[0].Chunks)
+
+	code, _ = request("POST", adminAddr, "admin/reload")
+	require.Equal(t, http.StatusOK, code)
+}
+
+func TestChunkServerReloadWritable(t *testing.T) {
+	tmp := t.TempDir()
+	store := filepath.Join(tmp, "store")
+	require.NoError(t, os.Mkdir(store, 0755))
+	storeFile := filepath.Join(tmp, "stores.json")
+	require.NoError(t, ioutil.WriteFile(storeFile, []byte(fmt.Sprintf(`{"stores": [%q]}`, store)), 0644))
+	addr, cancel := startChunkServer(t, "-w", "--store-file", storeFile, "--admin-authorization", "Bearer admin")
+	defer cancel()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/admin/reload", addr), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Reloading doesn't write anything into the store
+	entries, err := ioutil.ReadDir(store)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestAdminLiveStoresStatus(t *testing.T) {
+	local, err := desync.NewLocalStore("testdata/blob1.store", desync.StoreOptions{})
+	require.NoError(t, err)
+
+	// Nothing listens on the address of the HTTP store
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	u, _ := url.Parse(fmt.Sprintf("http://user:secret@%s/", l.Addr()))
+	l.Close()
+	remote, err := desync.NewRemoteHTTPStore(u, desync.StoreOptions{})
+	require.NoError(t, err)
+	defer remote.Close()
+
+	live := &liveStores{main: []servedStore{{"testdata/blob1.store", local}}}
+	live.prefixes = []servedStore{{u.String(), remote}}
+	status := live.status()
+	require.Len(t, status, 2)
+	require.True(t, status[0].Healthy)
+	require.False(t, status[1].Healthy)
+	require.NotEmpty(t, status[1].Error)
+	require.NotContains(t, status[1].Location, "secret")
+
+	// Reloading replaces the main stores
+	live.setMain(nil)
+	require.Len(t, live.status(), 1)
+}
+
+func TestChunkServerReady(t *testing.T) {
+	store := t.TempDir()
+	addr, cancel := startChunkServer(t, "-s", store)
+	defer cancel()
+
+	get := func(path string) int {
+		resp, err := http.Get("http://" + addr + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The store can be reached
+	require.Equal(t, http.StatusOK, get("/healthz"))
+	require.Equal(t, http.StatusOK, get("/readyz"))
+
+	// Without the store directory, the server is still live but not ready
+	require.NoError(t, os.RemoveAll(store))
+	require.Equal(t, http.StatusOK, get("/healthz"))
+	require.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+}
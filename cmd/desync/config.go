@@ -34,6 +34,9 @@ type S3Creds struct {
 type Config struct {
 	S3Credentials map[string]S3Creds             `json:"s3-credentials"`
 	StoreOptions  map[string]desync.StoreOptions `json:"store-options"`
+	Aliases       map[string]storeFileEntry      `json:"aliases,omitempty"`
+	DownloadLimit int64                          `json:"download-limit,omitempty"`
+	UploadLimit   int64                          `json:"upload-limit,omitempty"`
 }
 
 // GetS3CredentialsFor attempts to find creds and region for an S3 location in the
@@ -91,6 +94,16 @@ func (c Config) GetStoreOptionsFor(location string) (options desync.StoreOptions
 	return options, nil
 }
 
+// resolveAlias returns the store location for a name defined in the aliases
+// section of the config, along with any options given for it. Locations that
+// aren't aliases are returned unchanged.
+func (c Config) resolveAlias(location string) (string, *desync.StoreOptions) {
+	if a, ok := c.Aliases[location]; ok {
+		return a.Location, a.Options
+	}
+	return location, nil
+}
+
 func newConfigCommand(ctx context.Context) *cobra.Command {
 	var write bool
 
@@ -176,15 +189,42 @@ func initConfig() {
 // Digest algorithm to be used by desync globally.
 var digestAlgorithm string
 
+// Append a checksum trailer to indexes written by any command.
+var indexChecksum bool
+
 func setDigestAlgorithm() {
-	switch digestAlgorithm {
-	case "", "sha512-256":
-		desync.Digest = desync.SHA512256{}
-	case "sha256":
-		desync.Digest = desync.SHA256{}
-	default:
-		die(fmt.Errorf("invalid digest algorithm '%s'", digestAlgorithm))
+	d, err := parseDigestAlgorithm(digestAlgorithm)
+	if err != nil {
+		die(err)
+	}
+	desync.Digest = d
+}
+
+// Returns the hash algorithm for its name as used in the --digest option.
+func parseDigestAlgorithm(name string) (desync.HashAlgorithm, error) {
+	if name == "" {
+		return desync.SHA512256{}, nil
+	}
+	return desync.DigestByName(name)
+}
+
+// Bandwidth limits in bytes per second shared by all remote stores. Values given
+// on the command line take precedence over the config file.
+var downloadLimit, uploadLimit int64
+var downloadLimiter, uploadLimiter *desync.BandwidthLimiter
+
+func setBandwidthLimits() {
+	if downloadLimit == 0 {
+		downloadLimit = cfg.DownloadLimit
+	}
+	if uploadLimit == 0 {
+		uploadLimit = cfg.UploadLimit
+	}
+	if downloadLimit < 0 || uploadLimit < 0 {
+		die(errors.New("invalid bandwidth limit"))
 	}
+	downloadLimiter = newBandwidthLimiter(downloadLimit)
+	uploadLimiter = newBandwidthLimiter(uploadLimit)
 }
 
 // Verbose mode
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/folbricht/desync"
 	"github.com/stretchr/testify/require"
 )
 
@@ -54,3 +57,58 @@ func TestConfigFileMultipleMatches(t *testing.T) {
 	_, err = cfg.GetStoreOptionsFor("/path/to/store")
 	require.Error(t, err)
 }
+
+func TestConfigAliases(t *testing.T) {
+	dir := t.TempDir()
+	cfgFileContent := []byte(`{"aliases": {"plain": "/path/to/store", "prod": {"location": "/path/to/other", "options": {"uncompressed": true}}}}`)
+	cfgFile = filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(cfgFile, cfgFileContent, 0644))
+	initConfig()
+	defer func() { cfg = Config{} }()
+
+	location, opt := cfg.resolveAlias("plain")
+	require.Equal(t, "/path/to/store", location)
+	require.Nil(t, opt)
+
+	location, opt = cfg.resolveAlias("prod")
+	require.Equal(t, "/path/to/other", location)
+	require.NotNil(t, opt)
+	require.True(t, opt.Uncompressed)
+
+	// Anything else is returned as is
+	location, opt = cfg.resolveAlias("/path/to/store")
+	require.Equal(t, "/path/to/store", location)
+	require.Nil(t, opt)
+}
+
+func TestConfigAliasMembers(t *testing.T) {
+	// Chunks are stored uncompressed, only readable with the options of the alias
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	require.NoError(t, os.Mkdir(a, 0755))
+	require.NoError(t, os.Mkdir(b, 0755))
+	s, err := desync.NewLocalStore(a, desync.StoreOptions{Uncompressed: true})
+	require.NoError(t, err)
+	chunk := desync.NewChunk([]byte("uncompressed"))
+	require.NoError(t, s.StoreChunk(chunk))
+
+	cfgFileContent := []byte(fmt.Sprintf(`{"aliases": {
+		"failover": {"location": "%s|%s", "options": {"uncompressed": true}},
+		"sharded": {"location": "00-ff=%s", "options": {"uncompressed": true}}
+	}}`, a, b, a))
+	cfgFile = filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(cfgFile, cfgFileContent, 0644))
+	initConfig()
+	defer func() { cfg = Config{} }()
+
+	var opt cmdStoreOptions
+	newTestOptionsCommand(&opt)
+	for _, alias := range []string{"failover", "sharded"} {
+		s, err := storeGroup(alias, opt)
+		require.NoError(t, err)
+		hasChunk, err := s.HasChunk(chunk.ID())
+		require.NoError(t, err)
+		require.True(t, hasChunk, alias)
+		s.Close()
+	}
+}
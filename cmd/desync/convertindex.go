@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type convertIndexOptions struct {
+	cmdStoreOptions
+	stores []string
+	to     string
+}
+
+func newConvertIndexCommand(ctx context.Context) *cobra.Command {
+	var opt convertIndexOptions
+
+	cmd := &cobra.Command{
+		Use:   "convert-index <input> <output>",
+		Short: "Convert between blob and archive indexes",
+		Long: `Converts a blob index (caibx) of a catar archive into an archive index (caidx),
+or the other way around. Both types of index list the same chunks, but casync
+decides how to use an index by its feature flags, and refuses to mount or
+extract an archive from a blob index.
+
+When converting to caidx, the first chunk of the archive is read from the store
+to take the feature flags from the header of the archive. The flags are checked
+for consistency, and the conversion fails if the index doesn't describe a catar
+archive. Converting to caibx replaces the flags with those used by make.
+
+The type of the output is given with --to, or taken from the extension of the
+output file. Use '-' to read the index from STDIN or write it to STDOUT.`,
+		Example: `  desync convert-index -s /path/to/store image.catar.caibx image.caidx
+  desync convert-index --to caibx image.caidx -`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runConvertIndex(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s), needed to convert to caidx")
+	flags.StringVar(&opt.to, "to", "", "type of index to convert to, caidx or caibx")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addRequireChunksOption(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runConvertIndex(ctx context.Context, opt convertIndexOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	input, output := args[0], args[1]
+
+	to := opt.to
+	if to == "" {
+		to = filepath.Ext(output)
+		if len(to) > 0 {
+			to = to[1:]
+		}
+	}
+	if to != "caidx" && to != "caibx" {
+		return errors.New("unable to determine the type of the output, use --to caidx or --to caibx")
+	}
+
+	idx, err := readCaibxFile(input, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+
+	switch to {
+	case "caidx":
+		if len(opt.stores) == 0 {
+			return errors.New("converting to caidx requires a store")
+		}
+		s, err := MultiStoreWithCache(opt.cmdStoreOptions, "", opt.stores...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if idx, err = desync.IndexToArchive(idx, s); err != nil {
+			return err
+		}
+	case "caibx":
+		if !desync.IsArchiveIndex(idx) {
+			fmt.Fprintln(stderr, "input is already a blob index")
+		}
+		idx = desync.IndexToBlob(idx)
+	}
+	return storeCaibxFile(ctx, idx, output, opt.cmdStoreOptions)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertIndexCommand(t *testing.T) {
+	dir := t.TempDir()
+	blob := filepath.Join(dir, "tree.catar.caibx")
+	archive := filepath.Join(dir, "tree.caidx")
+	stderr = ioutil.Discard
+
+	convert := func(args ...string) error {
+		cmd := newConvertIndexCommand(context.Background())
+		cmd.SetArgs(args)
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		return err
+	}
+
+	readIndex := func(name string) (desync.Index, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return desync.Index{}, err
+		}
+		defer f.Close()
+		return desync.IndexFromReader(f)
+	}
+
+	orig, err := readIndex("testdata/tree.caidx")
+	require.NoError(t, err)
+
+	// Convert the archive index into a blob index
+	require.NoError(t, convert("testdata/tree.caidx", blob))
+	idx, err := readIndex(blob)
+	require.NoError(t, err)
+	require.False(t, desync.IsArchiveIndex(idx))
+	require.Equal(t, orig.Chunks, idx.Chunks)
+
+	// Converting back to caidx needs the store to read the archive header
+	require.Error(t, convert(blob, archive))
+	require.NoError(t, convert("-s", "testdata/tree.store", blob, archive))
+	idx, err = readIndex(archive)
+	require.NoError(t, err)
+	require.Equal(t, orig.Index.FeatureFlags, idx.Index.FeatureFlags)
+	require.Equal(t, orig.Chunks, idx.Chunks)
+
+	// The type of the output can't be guessed without extension
+	require.Error(t, convert(blob, filepath.Join(dir, "out")))
+	require.NoError(t, convert("--to", "caibx", archive, filepath.Join(dir, "out")))
+
+	// A blob index of something that isn't a catar archive can't be converted
+	require.Error(t, convert("-s", "testdata/blob1.store", "testdata/blob1.caibx", archive))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type convertStoreOptions struct {
+	cmdStoreOptions
+	from          string
+	to            string
+	encryptionPwd string
+	printStats    bool
+}
+
+func newConvertStoreCommand(ctx context.Context) *cobra.Command {
+	var opt convertStoreOptions
+
+	cmd := &cobra.Command{
+		Use:   "convert-store <source-store> <target-store>",
+		Short: "Copy all chunks into a store with a different format",
+		Long: `Copies all chunks from the source store into the target store, converting them
+into the format given with --to. Supported formats are 'compressed',
+'uncompressed' and 'encrypted', which compresses and then encrypts chunks with a
+key derived from --encryption-password or DESYNC_ENCRYPTION_PASSWORD. The format
+of the source store is taken from the config or store-file unless it's given
+with --from.
+
+The data of every chunk is validated against its ID while being copied. Chunks
+that are already present in the target store are skipped, so an interrupted
+conversion can be continued by running the same command again. The source store
+is not modified and needs to support listing chunks, which local, S3, GCS and
+SFTP stores do.`,
+		Example: `  desync convert-store --to uncompressed /path/to/store /path/to/uncompressed-store
+  desync convert-store --from uncompressed --to compressed /path/to/store s3+https://s3.eu-west-1.amazonaws.com/store`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runConvertStore(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&opt.from, "from", "", "format of the source store, compressed, uncompressed or encrypted")
+	flags.StringVar(&opt.to, "to", "", "format of the target store, compressed, uncompressed or encrypted")
+	flags.StringVar(&opt.encryptionPwd, "encryption-password", "", "password for encrypted stores")
+	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "print statistics")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runConvertStore(ctx context.Context, opt convertStoreOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if opt.to == "" {
+		return errors.New("--to is required")
+	}
+	if strings.TrimSuffix(args[0], "/") == strings.TrimSuffix(args[1], "/") {
+		return errors.New("source and target store need to be different")
+	}
+	if opt.encryptionPwd == "" {
+		opt.encryptionPwd = os.Getenv("DESYNC_ENCRYPTION_PASSWORD")
+	}
+
+	// Override the format of the stores by giving them options as if they
+	// came from a store-file
+	storeOptions := make(map[string]desync.StoreOptions)
+	for k, v := range opt.storeFileOptions {
+		storeOptions[k] = v
+	}
+	if opt.from != "" {
+		if err := setStoreFormat(storeOptions, args[0], opt.from, opt.encryptionPwd); err != nil {
+			return err
+		}
+	}
+	if err := setStoreFormat(storeOptions, args[1], opt.to, opt.encryptionPwd); err != nil {
+		return err
+	}
+	opt.storeFileOptions = storeOptions
+
+	// Open the source store, it needs to support listing chunks
+	sr, err := storeFromLocation(args[0], opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+	src, err := chunkLister(sr, args[0])
+	if err != nil {
+		return err
+	}
+
+	dst, err := WritableStore(args[1], opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// If this is a terminal, we want a progress bar
+	pb := desync.NewProgressBar("")
+
+	stats, err := desync.Mirror(ctx, src, dst, desync.MirrorOptions{N: opt.n, Incremental: true}, pb)
+	if err != nil {
+		return err
+	}
+	if opt.printStats {
+		return printJSON(stdout, stats)
+	}
+	return nil
+}
+
+// Sets the chunk format options for a store location, on top of any that are
+// configured for it already.
+func setStoreFormat(m map[string]desync.StoreOptions, location, format, password string) error {
+	location = strings.TrimSuffix(location, "/")
+	o, ok := m[location]
+	if !ok {
+		var err error
+		if o, err = cfg.GetStoreOptionsFor(location); err != nil {
+			return err
+		}
+	}
+	switch format {
+	case "compressed":
+		o.Uncompressed = false
+		o.EncryptionPassword = ""
+	case "uncompressed":
+		o.Uncompressed = true
+		o.EncryptionPassword = ""
+	case "encrypted":
+		if password == "" {
+			return errors.New("encrypted stores require --encryption-password")
+		}
+		o.Uncompressed = false
+		o.EncryptionPassword = password
+	default:
+		return fmt.Errorf("invalid store format '%s'", format)
+	}
+	m[location] = o
+	return nil
+}
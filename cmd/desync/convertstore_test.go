@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertStoreCommand(t *testing.T) {
+	uncompressed := t.TempDir()
+	encrypted := t.TempDir()
+	stderr = ioutil.Discard
+
+	convert := func(args ...string) desync.MirrorStats {
+		cmd := newConvertStoreCommand(context.Background())
+		cmd.SetArgs(append([]string{"--print-stats"}, args...))
+		b := new(bytes.Buffer)
+		stdout = b
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		require.NoError(t, err)
+		var stats desync.MirrorStats
+		require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+		return stats
+	}
+
+	// Convert the compressed store into an uncompressed one
+	stats := convert("--to", "uncompressed", "testdata/blob1.store", uncompressed)
+	require.NotZero(t, stats.ChunksCopied)
+	files, err := filepath.Glob(filepath.Join(uncompressed, "*", "*"))
+	require.NoError(t, err)
+	require.Len(t, files, int(stats.ChunksCopied))
+	for _, name := range files {
+		require.Equal(t, "", filepath.Ext(name))
+	}
+
+	// Running it again should skip all chunks
+	stats2 := convert("--to", "uncompressed", "testdata/blob1.store", uncompressed)
+	require.Equal(t, stats.ChunksCopied, stats2.ChunksSkipped)
+	require.Zero(t, stats2.ChunksCopied)
+
+	// Convert the uncompressed store into an encrypted one
+	stats = convert("--from", "uncompressed", "--to", "encrypted", "--encryption-password", "secret", uncompressed, encrypted)
+	require.Equal(t, stats2.ChunksSkipped, stats.ChunksCopied)
+
+	// The chunks can only be read with the password
+	opt := desync.NewStoreOptionsWithDefaults()
+	opt.EncryptionPassword = "secret"
+	s, err := desync.NewLocalStore(encrypted, opt)
+	require.NoError(t, err)
+	require.NoError(t, s.Verify(context.Background(), 1, false, ioutil.Discard))
+
+	// Invalid target format
+	cmd := newConvertStoreCommand(context.Background())
+	cmd.SetArgs([]string{"--to", "zip", "testdata/blob1.store", t.TempDir()})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+}
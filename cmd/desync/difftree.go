@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type diffTreeOptions struct {
+	printFormat string
+}
+
+func newDiffTreeCommand(ctx context.Context) *cobra.Command {
+	var opt diffTreeOptions
+
+	cmd := &cobra.Command{
+		Use:   "diff-tree <old> <new>",
+		Short: "Show the differences between two tree indexes",
+		Long: `Compares two tree indexes made with make-tree and lists the paths that were
+added (+), removed (-) or modified (M) in the new one. Entries are modified if
+their content or any of their metadata differs. The number and size of the
+chunks referenced by the new index that aren't in the old one are printed as
+well, which is what needs to be downloaded to update from the old tree to the
+new one when the old chunks are in a cache.`,
+		Example: `  desync diff-tree docs-v1.tree docs-v2.tree`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDiffTree(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&opt.printFormat, "format", "f", "plain", "output format, plain or json")
+	return cmd
+}
+
+func runDiffTree(ctx context.Context, opt diffTreeOptions, args []string) error {
+	if opt.printFormat != "plain" && opt.printFormat != "json" {
+		return fmt.Errorf("unsupported output format '%s'", opt.printFormat)
+	}
+	oldIdx, err := readTreeIndex(args[0])
+	if err != nil {
+		return err
+	}
+	newIdx, err := readTreeIndex(args[1])
+	if err != nil {
+		return err
+	}
+	diff := desync.DiffTreeIndex(oldIdx, newIdx)
+
+	if opt.printFormat == "json" {
+		return printJSON(stdout, diff)
+	}
+	for _, p := range diff.Added {
+		fmt.Fprintln(stdout, "+", p)
+	}
+	for _, p := range diff.Removed {
+		fmt.Fprintln(stdout, "-", p)
+	}
+	for _, p := range diff.Modified {
+		fmt.Fprintln(stdout, "M", p)
+	}
+	fmt.Fprintf(stdout, "Chunks added: %d (%d bytes)\n", diff.ChunksAdded, diff.BytesAdded)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type digestMapOptions struct {
+	cmdStoreOptions
+	store     string
+	altDigest string
+}
+
+func newDigestMapCommand(ctx context.Context) *cobra.Command {
+	var opt digestMapOptions
+
+	cmd := &cobra.Command{
+		Use:   "digest-map <map-file>",
+		Short: "Build a map of chunk IDs in an alternate digest algorithm",
+		Long: `Reads all chunks in a store and records their IDs in the digest algorithm given
+with --alt-digest in the map file. The file can then be used with the --digest-map
+option of chunk-server to serve chunks to clients using either digest algorithm.
+Chunks that are already in the map are skipped, so the command can be run
+repeatedly to pick up new chunks. The store needs to support listing chunks,
+which local, S3, GCS and SFTP stores do.`,
+		Example: `  desync digest-map -s /path/to/store --alt-digest sha256 /path/to/store.map`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDigestMap(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&opt.store, "store", "s", "", "source store")
+	flags.StringVar(&opt.altDigest, "alt-digest", "sha256", "alternate digest algorithm, sha512-256 or sha256")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runDigestMap(ctx context.Context, opt digestMapOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if opt.store == "" {
+		return errors.New("no store provided")
+	}
+	alt, err := parseDigestAlgorithm(opt.altDigest)
+	if err != nil {
+		return err
+	}
+
+	s, err := storeFromLocation(opt.store, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	lister, ok := s.(desync.ChunkLister)
+	if !ok {
+		return fmt.Errorf("store '%s' does not support listing chunks", opt.store)
+	}
+
+	pb := desync.NewProgressBar("")
+	return desync.BuildDigestMap(ctx, lister, alt, args[0], opt.n, pb)
+}
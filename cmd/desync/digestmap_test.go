@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestMapCommand(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "blob1.map")
+
+	cmd := newDigestMapCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob1.store", "--alt-digest", "sha256", mapFile})
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Expect one record for every chunk in the store
+	chunks, err := filepath.Glob("testdata/blob1.store/*/*.cacnk")
+	require.NoError(t, err)
+	fi, err := os.Stat(mapFile)
+	require.NoError(t, err)
+	require.Equal(t, int64(64*len(chunks)), fi.Size())
+
+	// Running it again doesn't add duplicates
+	cmd = newDigestMapCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob1.store", "--alt-digest", "sha256", mapFile})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	fi, err = os.Stat(mapFile)
+	require.NoError(t, err)
+	require.Equal(t, int64(64*len(chunks)), fi.Size())
+}
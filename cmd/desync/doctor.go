@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type doctorOptions struct {
+	cmdStoreOptions
+	stores  []string
+	cache   string
+	index   string
+	targets []string
+}
+
+// Result of a single diagnostic check. A hint tells the user what to do about a
+// warning or error.
+type doctorFinding struct {
+	status string
+	check  string
+	msg    string
+	hint   string
+}
+
+const (
+	doctorOK      = "OK"
+	doctorWarning = "WARNING"
+	doctorError   = "ERROR"
+)
+
+func newDoctorCommand(ctx context.Context) *cobra.Command {
+	var opt doctorOptions
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose problems with the configuration and environment",
+		Long: `Runs a series of checks on the environment desync is used in and prints
+the findings, with hints on how to address any problems.
+
+The config file is checked for syntax errors and unknown keys. Stores given with
+-s and -c are opened and a chunk is requested from them to confirm they can be
+reached, after their options and credentials are checked. With --index, the
+digest algorithm of the index is compared to the one in use, and the stores are
+asked for its first chunk. Directories given with --target are tested for
+reflink support, which is used to clone blocks from seeds during extract. The
+availability of FUSE, needed by mount-index, is checked as well.
+
+The command fails if any of the checks found an error.`,
+		Example: `  desync doctor -s s3+https://s3.example.com/store -c /var/cache/desync --index image.caibx --target /var/lib/images`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDoctor(ctx, opt)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "store(s) to check")
+	flags.StringVarP(&opt.cache, "cache", "c", "", "cache to check")
+	flags.StringVar(&opt.index, "index", "", "index to check the digest and chunks of")
+	flags.StringSliceVar(&opt.targets, "target", nil, "directory to check for reflink support")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runDoctor(ctx context.Context, opt doctorOptions) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+
+	var findings []doctorFinding
+	add := func(status, check, msg, hint string) {
+		findings = append(findings, doctorFinding{status: status, check: check, msg: msg, hint: hint})
+	}
+
+	checkDoctorConfig(add)
+
+	// Check the digest used by the index before anything is read with it
+	var (
+		idx     desync.Index
+		haveIdx bool
+	)
+	add(doctorOK, "digest", "using "+digestName(desync.Digest.Algorithm()), "")
+	if opt.index != "" {
+		var (
+			err      error
+			mismatch desync.DigestMismatch
+		)
+		idx, err = readCaibxFile(opt.index, opt.cmdStoreOptions)
+		switch {
+		case err == nil:
+			haveIdx = true
+			add(doctorOK, "digest", fmt.Sprintf("index %s uses the same digest", opt.index), "")
+		case errors.As(err, &mismatch):
+			add(doctorError, "digest", fmt.Sprintf("index %s: %s", opt.index, err), "set the matching algorithm with --digest "+digestName(mismatch.Index))
+		default:
+			add(doctorError, "index", fmt.Sprintf("failed to read %s: %s", opt.index, err), "")
+		}
+	}
+
+	locations := opt.stores
+	if opt.cache != "" {
+		locations = append(locations, opt.cache)
+	}
+	for _, location := range locations {
+		checkDoctorStore(location, opt, idx, haveIdx, add)
+	}
+
+	for _, dir := range opt.targets {
+		if desync.CanClone(filepath.Join(dir, "x"), filepath.Join(dir, "x")) {
+			add(doctorOK, "reflink", fmt.Sprintf("%s supports cloning blocks from seeds", dir), "")
+		} else {
+			add(doctorWarning, "reflink", fmt.Sprintf("%s does not support reflinks", dir),
+				"blocks are copied from seeds instead of cloned, use a filesystem like XFS or btrfs for faster extracts")
+		}
+	}
+
+	checkDoctorFUSE(add)
+
+	var errs int
+	for _, f := range findings {
+		fmt.Fprintf(stdout, "%-8s %-8s %s\n", f.status, f.check, f.msg)
+		if f.hint != "" {
+			fmt.Fprintf(stdout, "%-17s -> %s\n", "", f.hint)
+		}
+		if f.status == doctorError {
+			errs++
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("%d check(s) failed", errs)
+	}
+	return nil
+}
+
+// Checks the config file for unknown keys and missing credentials files. Syntax
+// errors are already reported when the config is loaded on startup.
+func checkDoctorConfig(add func(status, check, msg, hint string)) {
+	b, err := ioutil.ReadFile(cfgFile)
+	if os.IsNotExist(err) {
+		add(doctorOK, "config", fmt.Sprintf("no config file at %s, using defaults", cfgFile), "")
+		return
+	}
+	if err != nil {
+		add(doctorError, "config", err.Error(), "")
+		return
+	}
+	var c Config
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		add(doctorWarning, "config", fmt.Sprintf("%s: %s", cfgFile, err), "check the key for typos, unknown keys are ignored")
+	} else {
+		add(doctorOK, "config", fmt.Sprintf("%s is valid", cfgFile), "")
+	}
+	for location, creds := range cfg.S3Credentials {
+		if creds.AwsCredentialsFile == "" {
+			continue
+		}
+		if _, err := os.Stat(creds.AwsCredentialsFile); err != nil {
+			add(doctorError, "config", fmt.Sprintf("credentials file for %s: %s", location, err), "")
+		}
+	}
+}
+
+// Checks the options and credentials of a store, and if it can be reached. If an
+// index is given, its first chunk is requested from the store.
+func checkDoctorStore(location string, opt doctorOptions, idx desync.Index, haveIdx bool, add func(status, check, msg, hint string)) {
+	// Check each member of an alias, failover group or sharded store
+	resolved, _ := cfg.resolveAlias(location)
+	for _, member := range storeMembers(resolved) {
+		member, _ = cfg.resolveAlias(member)
+		if _, err := cfg.GetStoreOptionsFor(member); err != nil {
+			add(doctorError, "store", err.Error(), "make the store-options keys in the config more specific")
+			return
+		}
+
+		loc, err := url.Parse(member)
+		if err == nil && strings.HasPrefix(loc.Scheme, "s3+") {
+			creds, _ := cfg.GetS3CredentialsFor(loc)
+			v, err := creds.Get()
+			switch {
+			case err != nil:
+				add(doctorError, "creds", fmt.Sprintf("%s: %s", member, err), "")
+			case v.AccessKeyID == "":
+				add(doctorWarning, "creds", fmt.Sprintf("no credentials for %s, requests are anonymous", member),
+					"set S3_ACCESS_KEY and S3_SECRET_KEY, or add s3-credentials to the config")
+			default:
+				add(doctorOK, "creds", fmt.Sprintf("found credentials for %s", member), "")
+			}
+		}
+	}
+
+	s, err := storeGroup(location, opt.cmdStoreOptions)
+	if err != nil {
+		add(doctorError, "store", fmt.Sprintf("failed to open %s: %s", location, err), "")
+		return
+	}
+	defer s.Close()
+	if err := desync.CheckStore(s); err != nil {
+		add(doctorError, "store", err.Error(), "check the location, network access and credentials of the store")
+		return
+	}
+	add(doctorOK, "store", fmt.Sprintf("%s can be reached", location), "")
+
+	if !haveIdx || len(idx.Chunks) == 0 {
+		return
+	}
+	id := idx.Chunks[0].ID
+	_, err = s.GetChunk(id)
+	var invalid desync.ChunkInvalid
+	switch {
+	case err == nil:
+		add(doctorOK, "store", fmt.Sprintf("%s has chunk %s of the index", location, id.String()), "")
+	case errors.As(err, &invalid):
+		add(doctorError, "digest", fmt.Sprintf("%s: %s", location, err), "the store may use a different digest, check --digest")
+	case errors.Is(err, desync.ErrNotFound):
+		add(doctorWarning, "store", fmt.Sprintf("%s does not have chunk %s of the index", location, id.String()), "")
+	default:
+		add(doctorError, "store", fmt.Sprintf("%s: %s", location, err), "")
+	}
+}
+
+// Checks if FUSE mounts are possible, as needed by mount-index.
+func checkDoctorFUSE(add func(status, check, msg, hint string)) {
+	switch runtime.GOOS {
+	case "linux":
+		if _, err := os.Stat("/dev/fuse"); err != nil {
+			add(doctorWarning, "fuse", "/dev/fuse is not available, mount-index won't work", "load the fuse kernel module, or pass the device into the container")
+			return
+		}
+		if _, err := exec.LookPath("fusermount"); err != nil {
+			if _, err := exec.LookPath("fusermount3"); err != nil {
+				add(doctorWarning, "fuse", "fusermount not found, mount-index won't work", "install the fuse package of the distribution")
+				return
+			}
+		}
+		add(doctorOK, "fuse", "FUSE is available", "")
+	case "darwin":
+		if _, err := os.Stat("/Library/Filesystems/macfuse.fs"); err != nil {
+			add(doctorWarning, "fuse", "macFUSE is not installed, mount-index won't work", "install macFUSE")
+			return
+		}
+		add(doctorOK, "fuse", "FUSE is available", "")
+	case "windows":
+		add(doctorWarning, "fuse", "mount-index is not supported on Windows", "")
+	}
+}
+
+func digestName(h crypto.Hash) string {
+	switch h {
+	case crypto.SHA512_256:
+		return "sha512-256"
+	case crypto.SHA256:
+		return "sha256"
+	}
+	return h.String()
+}
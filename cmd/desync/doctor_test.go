@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoctorCommand(t *testing.T) {
+	cmd := newDoctorCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob1.store", "--index", "testdata/blob1.caibx"})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "testdata/blob1.store can be reached")
+	require.Contains(t, b.String(), "testdata/blob1.store has chunk")
+
+	// A store that doesn't exist is an error
+	cmd = newDoctorCommand(context.Background())
+	cmd.SetArgs([]string{"-s", t.TempDir() + "/missing"})
+	b.Reset()
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+	require.Contains(t, b.String(), "ERROR")
+}
+
+func TestDoctorCommandAlias(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile = filepath.Join(dir, "config.json")
+	cfgFileContent := []byte(`{"aliases": {"group": {"location": "testdata/blob1.store|` + dir + `", "options": {"uncompressed": false}}}}`)
+	require.NoError(t, ioutil.WriteFile(cfgFile, cfgFileContent, 0644))
+	initConfig()
+	defer func() { cfg = Config{} }()
+
+	// The alias resolves to a failover group that's checked as a whole
+	cmd := newDoctorCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "group", "--index", "testdata/blob1.caibx"})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "group can be reached")
+	require.Contains(t, b.String(), "group has chunk")
+}
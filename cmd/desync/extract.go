@@ -1,15 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/folbricht/desync"
-	"github.com/folbricht/tempfile"
 	"github.com/spf13/cobra"
 )
 
@@ -23,6 +26,21 @@ type extractOptions struct {
 	printStats             bool
 	skipInvalidSeeds       bool
 	regenerateInvalidSeeds bool
+	stateFile              string
+	chunkRetries           int
+	chunkRetryInterval     time.Duration
+	continueOnChunkError   bool
+	tmpDir                 string
+	fsync                  bool
+	fetchConcurrency       int
+	writeConcurrency       int
+	stamp                  bool
+	verifyOnly             bool
+	seedVerify             string
+	writeCRC               bool
+	chunkLog               string
+	blockSize              uint64
+	spaceCheck             string
 }
 
 func newExtractCommand(ctx context.Context) *cobra.Command {
@@ -35,10 +53,39 @@ func newExtractCommand(ctx context.Context) *cobra.Command {
 When using -k, the blob will be extracted in-place utilizing existing data and
 the target file will not be deleted on error. This can be used to restart a
 failed prior extraction without having to retrieve completed chunks again.
+With --state-file, the progress of an in-place extraction is recorded and
+saved periodically. If interrupted, running the same command again resumes
+where it left off, without having to verify the data that was already written.
+The state file is removed once the extraction completes.
+Chunks that fail to be retrieved can be retried with --chunk-retries, waiting
+--chunk-retry-interval before the first retry and twice as long before each
+further one. Use
+--continue-on-chunk-error to write everything else if chunks are missing or
+invalid. The command then fails at the end, listing the incomplete ranges in
+the output of --print-stats.
+Without -k, the blob is written to a temporary file which is synced to disk
+and then renamed to the output. The temporary file is created next to the
+output, or in the directory given with --tmp-dir. Temporary files left behind
+by extractions that were killed or crashed are removed. With --fsync, the
+data is also flushed to disk when writing in-place with -k.
+With --stamp, the output is marked with an extended attribute holding a digest
+of the index once the extraction is complete. If the output still carries a
+matching stamp and hasn't been modified since, running the same extraction again
+returns without reading or writing it.
+Chunks are downloaded ahead of being written to the output. The number of
+concurrent downloads and writes can be set separately with --fetch-concurrency
+and --write-concurrency, which is useful with slow stores or slow disks.
+With --verify-only, nothing is written. The existing output is compared to the
+index and the seeds are validated, then the percentage of the output that is
+already correct is printed in JSON, along with how much of the rest would be
+taken from seeds or fetched from the store. No store is needed in this mode.
 Multiple optional seed indexes can be given with -seed. The matching blob should
 have the same name as the index file without the .caibx extension. Instead, if the
 matching blob data is in another location, or with a different name, you can explicitly
 set the path by writing the index file path, followed by a colon and the data path.
+The blob of a seed can also be a http(s) URL, like a mirror of a previous release.
+Its chunks are then read with HTTP range requests and verified once written.
+Chunks that don't match or can't be read are taken from the store instead.
 If several seed files and indexes are available, the -seed-dir option can be used
 to automatically select all .caibx files in a directory as seeds. Use '-' to read
 the index from STDIN. If a seed is invalid, by default the extract operation will be
@@ -47,11 +94,32 @@ extraction will continue without them. Otherwise with the -regenerate-invalid-se
 the eventual invalid seed indexes will be regenerated, in memory, by using the
 available data, and neither data nor indexes will be changed on disk. Also, if the seed changes
 while processing, its invalid chunks will be taken from the self seed, or the store, instead
-of aborting.`,
+of aborting.
+Seeds are validated by calculating the digest of every chunk used from them. With
+--seed-verify=fast, seeds that have a file with chunk CRCs next to their blob, named
+like the blob with a .crc extension, are validated by comparing the much cheaper
+CRC instead. The digest is only calculated for chunks that don't match their CRC.
+This is a weaker check, only use it for seeds that can't be tampered with. Use
+--write-crc to write such a file for the output once it's complete, so it can
+be used as seed later.
+With --chunk-log, a line is written to the given file for every chunk in the
+output, with its ID, size, where it came from (store, cache, seed, self, in-place
+or resumed) and how long it took to write, separated by tabs.
+The block size of the output, which ranges cloned from seeds are aligned to, is
+detected automatically. Use --blocksize to set it if the detection is wrong, for
+example on stacked devices.
+Before writing, the command checks that the filesystem of the output has enough
+free space for it and fails otherwise. With --space-check sparse, chunks of only
+0-bytes aren't counted for new files since they're left as holes. Use
+--space-check none to disable the check, for example on filesystems that don't
+report their free space correctly.`,
 		Example: `  desync extract -s http://192.168.1.1/ -c /path/to/local file.caibx largefile.bin
   desync extract -s /mnt/store -s /tmp/other/store file.tar.caibx file.tar
   desync extract -s /mnt/store --seed /mnt/v1.caibx v2.caibx v2.vmdk
-  desync extract -s /mnt/store --seed /tmp/v1.caibx:/mnt/v1 v2.caibx v2.vmdk`,
+  desync extract -s /mnt/store --seed /tmp/v1.caibx:/mnt/v1 v2.caibx v2.vmdk
+  desync extract -s /mnt/store --seed http://mirror.lan/v1.caibx v2.caibx v2.vmdk
+  desync extract -s /mnt/store -k --state-file /var/lib/update.state v2.caibx /dev/sdb2
+  desync extract -s http://192.168.1.1/ --chunk-log chunks.log file.caibx largefile.bin`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runExtract(ctx, opt, args)
@@ -67,6 +135,21 @@ of aborting.`,
 	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
 	flags.BoolVarP(&opt.inPlace, "in-place", "k", false, "extract the file in place and keep it in case of error")
 	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "print statistics")
+	flags.StringVar(&opt.stateFile, "state-file", "", "record progress in this file to resume an interrupted extract (requires -k)")
+	flags.IntVar(&opt.chunkRetries, "chunk-retries", 0, "number of times to retry a chunk that failed to be retrieved")
+	flags.DurationVar(&opt.chunkRetryInterval, "chunk-retry-interval", desync.DefaultErrorRetryBaseInterval, "delay before the first chunk retry, doubled with each subsequent attempt")
+	flags.BoolVar(&opt.fsync, "fsync", false, "flush the output to disk before returning, also with -k")
+	flags.StringVar(&opt.tmpDir, "tmp-dir", "", "directory for the temporary file, default is the directory of the output")
+	flags.IntVar(&opt.fetchConcurrency, "fetch-concurrency", 0, "number of chunks fetched from the store concurrently, default is the value of -n")
+	flags.IntVar(&opt.writeConcurrency, "write-concurrency", 0, "number of chunks written into the output concurrently, default is the value of -n")
+	flags.BoolVar(&opt.stamp, "stamp", false, "mark the output with the index digest, and skip the extraction if it's marked already")
+	flags.BoolVar(&opt.verifyOnly, "verify-only", false, "compare the output to the index and print how much of it is correct, without writing it")
+	flags.StringVar(&opt.seedVerify, "seed-verify", "full", "how to validate seeds, full or fast to use CRC files next to the seeds if present")
+	flags.BoolVar(&opt.writeCRC, "write-crc", false, "write the CRCs of the chunks in the output into a file next to it, for use with --seed-verify=fast")
+	flags.StringVar(&opt.chunkLog, "chunk-log", "", "write the ID, size, source and duration of every chunk to this file")
+	flags.Uint64Var(&opt.blockSize, "blocksize", 0, "block size of the output in bytes, detected if not set")
+	flags.StringVar(&opt.spaceCheck, "space-check", "full", "check the free space for the output before writing it, full, sparse or none")
+	flags.BoolVar(&opt.continueOnChunkError, "continue-on-chunk-error", false, "don't abort on missing or invalid chunks, list them at the end (requires -k)")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
@@ -75,6 +158,9 @@ func runExtract(ctx context.Context, opt extractOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if err := readsStdinOnce(append(args[:1:1], opt.seeds...)...); err != nil {
+		return err
+	}
 
 	inFile := args[0]
 	outFile := args[1]
@@ -83,21 +169,46 @@ func runExtract(ctx context.Context, opt extractOptions, args []string) error {
 	}
 
 	// Checkout the store
-	if len(opt.stores) == 0 {
+	if len(opt.stores) == 0 && !opt.verifyOnly {
 		return errors.New("no store provided")
 	}
 
+	if opt.stateFile != "" && !opt.inPlace {
+		return errors.New("--state-file requires --in-place")
+	}
+	if opt.continueOnChunkError && !opt.inPlace {
+		return errors.New("--continue-on-chunk-error requires --in-place")
+	}
+	if opt.seedVerify != "full" && opt.seedVerify != "fast" {
+		return fmt.Errorf("invalid --seed-verify policy %q, expected full or fast", opt.seedVerify)
+	}
+	if opt.writeCRC && opt.verifyOnly {
+		return errors.New("--write-crc can't be used with --verify-only")
+	}
+	if opt.chunkLog != "" && opt.verifyOnly {
+		return errors.New("--chunk-log can't be used with --verify-only")
+	}
+	if opt.blockSize != 0 && !desync.IsValidBlockSize(opt.blockSize) {
+		return fmt.Errorf("invalid --blocksize %d, needs to be a power of 2 of at least 512", opt.blockSize)
+	}
+	spaceCheck, err := parseSpaceCheck(opt.spaceCheck)
+	if err != nil {
+		return err
+	}
 	if opt.skipInvalidSeeds && opt.regenerateInvalidSeeds {
 		return errors.New("is not possible to use at the same time --skip-invalid-seeds and --regenerate-invalid-seeds")
 	}
 
 	// Parse the store locations, open the stores and add a cache is requested
 	var s desync.Store
-	s, err := MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
-	if err != nil {
-		return err
+	if !opt.verifyOnly {
+		var err error
+		s, err = MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
 	}
-	defer s.Close()
 
 	// Read the input
 	idx, err := readCaibxFile(inFile, opt.cmdStoreOptions)
@@ -105,6 +216,26 @@ func runExtract(ctx context.Context, opt extractOptions, args []string) error {
 		return err
 	}
 
+	// Nothing to do if the output was stamped with the same index and wasn't
+	// modified since
+	var digest string
+	if opt.stamp && !opt.verifyOnly {
+		if digest, err = desync.IndexDigest(idx); err != nil {
+			return err
+		}
+		if desync.FileStampMatches(outFile, digest) {
+			desync.Log.WithField("file", outFile).Info("output matches the index, skipping extraction")
+			if opt.printStats {
+				return printJSON(stdout, &desync.ExtractStats{
+					BytesTotal:  idx.Length(),
+					ChunksTotal: len(idx.Chunks),
+					Unchanged:   true,
+				})
+			}
+			return nil
+		}
+	}
+
 	// Build a list of seeds if any were given in the command line
 	seeds, err := readSeeds(outFile, opt.seeds, opt.cmdStoreOptions)
 	if err != nil {
@@ -118,6 +249,17 @@ func runExtract(ctx context.Context, opt extractOptions, args []string) error {
 	}
 	seeds = append(seeds, dSeeds...)
 
+	// Validate seeds with their chunk CRCs if requested and available
+	if opt.seedVerify == "fast" {
+		for _, seed := range seeds {
+			if fs, ok := seed.(*desync.FileSeed); ok {
+				if err := fs.LoadChunkCRCs(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
 	// By default, bail out if we encounter an invalid seed
 	invalidSeedAction := desync.InvalidSeedActionBailOut
 	if opt.skipInvalidSeeds {
@@ -125,29 +267,123 @@ func runExtract(ctx context.Context, opt extractOptions, args []string) error {
 	} else if opt.regenerateInvalidSeeds {
 		invalidSeedAction = desync.InvalidSeedActionRegenerate
 	}
-	assembleOpt := desync.AssembleOptions{N: opt.n, InvalidSeedAction: invalidSeedAction}
+	assembleOpt := desync.AssembleOptions{
+		N:                    opt.n,
+		InvalidSeedAction:    invalidSeedAction,
+		StateFile:            opt.stateFile,
+		ChunkRetries:         opt.chunkRetries,
+		ChunkRetryInterval:   opt.chunkRetryInterval,
+		ContinueOnChunkError: opt.continueOnChunkError,
+		Fsync:                opt.fsync,
+		FsyncDir:             opt.fsync,
+		FetchConcurrency:     opt.fetchConcurrency,
+		WriteConcurrency:     opt.writeConcurrency,
+		BlockSize:            opt.blockSize,
+		SpaceCheck:           spaceCheck,
+	}
+
+	// Only report how much of the output is correct
+	if opt.verifyOnly {
+		stats, err := desync.VerifyExtract(ctx, outFile, idx, seeds, assembleOpt)
+		if err != nil {
+			return err
+		}
+		return printJSON(stdout, stats)
+	}
+
+	// Record every chunk in the output if requested
+	var cl *chunkLog
+	if opt.chunkLog != "" {
+		if cl, err = newChunkLog(opt.chunkLog); err != nil {
+			return err
+		}
+		defer cl.Close()
+		assembleOpt.OnChunk = cl.record
+	}
 
 	var stats *desync.ExtractStats
 	if opt.inPlace {
 		stats, err = writeInplace(ctx, outFile, idx, s, seeds, assembleOpt)
 	} else {
-		stats, err = writeWithTmpFile(ctx, outFile, idx, s, seeds, assembleOpt)
+		stats, err = writeWithTmpFile(ctx, outFile, opt.tmpDir, idx, s, seeds, assembleOpt)
 	}
-	if err != nil {
+	// The stats list the incomplete ranges if some chunks failed
+	var failed desync.ChunksFailed
+	if err != nil && !errors.As(err, &failed) {
 		return err
 	}
+	if cl != nil {
+		if err := cl.Close(); err != nil {
+			return err
+		}
+	}
+	if err == nil && opt.writeCRC {
+		if err := writeChunkCRCFile(outFile, idx); err != nil {
+			return err
+		}
+	}
+	if err == nil && opt.stamp {
+		if sErr := desync.StampFile(outFile, digest); sErr != nil {
+			desync.Log.WithError(sErr).WithField("file", outFile).Warning("failed to stamp output")
+		}
+	}
 	if opt.printStats {
-		return printJSON(stdout, stats)
+		if pErr := printJSON(stdout, stats); pErr != nil {
+			return pErr
+		}
 	}
-	return nil
+	return err
+}
+
+// chunkLog writes a line for every chunk written by an extract operation.
+type chunkLog struct {
+	f  *os.File
+	w  *bufio.Writer
+	mu sync.Mutex
+}
+
+func newChunkLog(name string) (*chunkLog, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkLog{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (l *chunkLog) record(r desync.ChunkRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "%s\t%d\t%s\t%s\n", r.ID.String(), r.Size, r.Source, r.Duration)
+}
+
+// Close flushes the log and closes the file. It's safe to call more than once.
+func (l *chunkLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if cErr := l.f.Close(); err == nil {
+		err = cErr
+	}
+	l.f = nil
+	return err
 }
 
-func writeWithTmpFile(ctx context.Context, name string, idx desync.Index, s desync.Store, seeds []desync.Seed, assembleOpt desync.AssembleOptions) (*desync.ExtractStats, error) {
+func writeWithTmpFile(ctx context.Context, name, tmpDir string, idx desync.Index, s desync.Store, seeds []desync.Seed, assembleOpt desync.AssembleOptions) (*desync.ExtractStats, error) {
+	if tmpDir == "" {
+		tmpDir = filepath.Dir(name)
+	}
+
+	// Clean up after previous runs that didn't get to remove their tempfile
+	removeOrphanedTmpFiles(tmpDir, name)
+
 	// Prepare a tempfile that'll hold the output during processing. Close it, we
 	// just need the name here since it'll be opened multiple times during write.
 	// Also make sure it gets removed regardless of any errors below.
 	var stats *desync.ExtractStats
-	tmp, err := tempfile.NewMode(filepath.Dir(name), "."+filepath.Base(name), 0644)
+	tmp, err := newTmpFile(tmpDir, name)
 	if err != nil {
 		return stats, err
 	}
@@ -159,8 +395,8 @@ func writeWithTmpFile(ctx context.Context, name string, idx desync.Index, s desy
 		return stats, err
 	}
 
-	// Rename the tempfile to the output file
-	return stats, os.Rename(tmp.Name(), name)
+	// Move the tempfile to the output file
+	return stats, publishTmpFile(tmp.Name(), name)
 }
 
 func writeInplace(ctx context.Context, name string, idx desync.Index, s desync.Store, seeds []desync.Seed, assembleOpt desync.AssembleOptions) (*desync.ExtractStats, error) {
@@ -171,32 +407,21 @@ func writeInplace(ctx context.Context, name string, idx desync.Index, s desync.S
 func readSeeds(dstFile string, seedsInfo []string, opts cmdStoreOptions) ([]desync.Seed, error) {
 	var seeds []desync.Seed
 	for _, seedInfo := range seedsInfo {
-		var (
-			srcIndexFile string
-			srcFile      string
-		)
-
-		if strings.HasSuffix(seedInfo, ".caibx") {
-			srcIndexFile = seedInfo
-			srcFile = strings.TrimSuffix(srcIndexFile, ".caibx")
-		} else {
-			seedArray := strings.Split(seedInfo, ":")
-			if len(seedArray) < 2 {
-				return nil, fmt.Errorf("the provided seed argument %q seems to be malformed", seedInfo)
-			} else if len(seedArray) > 2 {
-				// In the future we might add the ability to specify some additional options for the seeds.
-				desync.Log.WithField("seed", seedsInfo).Warning("Seed options are reserved for future use")
-			}
-			srcIndexFile = seedArray[0]
-			srcFile = seedArray[1]
+		srcIndexFile, srcFile, err := parseSeedArg(seedInfo)
+		if err != nil {
+			return nil, err
 		}
-
 		srcIndex, err := readCaibxFile(srcIndexFile, opts)
 		if err != nil {
 			return nil, err
 		}
 
-		seed, err := desync.NewIndexSeed(dstFile, srcFile, srcIndex)
+		var seed desync.Seed
+		if isHTTPLocation(srcFile) {
+			seed, err = httpRangeSeed(srcFile, srcIndex, opts)
+		} else {
+			seed, err = desync.NewIndexSeed(dstFile, srcFile, srcIndex)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -205,11 +430,67 @@ func readSeeds(dstFile string, seedsInfo []string, opts cmdStoreOptions) ([]desy
 	return seeds, nil
 }
 
+// Returns a seed that reads the blob from a web server with range requests.
+func httpRangeSeed(location string, idx desync.Index, opts cmdStoreOptions) (desync.Seed, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	configOptions, err := opts.optionsFor(location[:strings.LastIndex(location, "/")])
+	if err != nil {
+		return nil, err
+	}
+	return desync.NewHTTPRangeSeed(u, idx, opts.MergedWith(configOptions))
+}
+
+func isHTTPLocation(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
 func readSeedDirs(dstFile, dstIdxFile string, dirs []string, opts cmdStoreOptions) ([]desync.Seed, error) {
 	var seeds []desync.Seed
-	absIn, err := filepath.Abs(dstIdxFile)
+	err := walkSeedDirs(dirs, dstIdxFile, func(indexFile, srcFile string) error {
+		// Read the index and add it to the list of seeds
+		srcIndex, err := readCaibxFile(indexFile, opts)
+		if err != nil {
+			return err
+		}
+		seed, err := desync.NewIndexSeed(dstFile, srcFile, srcIndex)
+		if err != nil {
+			return err
+		}
+		seeds = append(seeds, seed)
+		return nil
+	})
+	return seeds, err
+}
+
+// Returns the index and blob of a seed given on the command line, either as
+// <index>.caibx with the blob next to it, or as <index>:<blob>.
+func parseSeedArg(seedInfo string) (string, string, error) {
+	if strings.HasSuffix(seedInfo, ".caibx") {
+		return seedInfo, strings.TrimSuffix(seedInfo, ".caibx"), nil
+	}
+	// The blob can be a URL, which has a colon in it too
+	if i := strings.Index(seedInfo, ":"); i > 0 && isHTTPLocation(seedInfo[i+1:]) {
+		return seedInfo[:i], seedInfo[i+1:], nil
+	}
+	seedArray := strings.Split(seedInfo, ":")
+	if len(seedArray) < 2 {
+		return "", "", fmt.Errorf("the provided seed argument %q seems to be malformed", seedInfo)
+	} else if len(seedArray) > 2 {
+		// In the future we might add the ability to specify some additional options for the seeds.
+		desync.Log.WithField("seed", seedInfo).Warning("Seed options are reserved for future use")
+	}
+	return seedArray[0], seedArray[1], nil
+}
+
+// Calls fn for every index in the directories that has its blob next to it.
+// The index given in skip, typically the one being extracted, is left out.
+func walkSeedDirs(dirs []string, skip string, fn func(indexFile, srcFile string) error) error {
+	absIn, err := filepath.Abs(skip)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	for _, dir := range dirs {
 		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
@@ -235,21 +516,74 @@ func readSeedDirs(dstFile, dstIdxFile string, dirs []string, opts cmdStoreOption
 			if _, err := os.Stat(srcFile); err != nil {
 				return nil
 			}
-			// Read the index and add it to the list of seeds
-			srcIndex, err := readCaibxFile(path, opts)
-			if err != nil {
-				return err
-			}
-			seed, err := desync.NewIndexSeed(dstFile, srcFile, srcIndex)
-			if err != nil {
-				return err
-			}
-			seeds = append(seeds, seed)
-			return nil
+			return fn(path, srcFile)
 		})
 		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wraps a store so that chunks are read from the given seeds, and seeds found
+// in seed directories, before using the store. Used for random access to blobs,
+// where the seeds used by extract don't work. Returns the store unchanged if
+// there are no seeds.
+func withSeedStore(s desync.Store, seedArgs, seedDirs []string, skip string, opts cmdStoreOptions) (desync.Store, error) {
+	if len(seedArgs) == 0 && len(seedDirs) == 0 {
+		return s, nil
+	}
+	ss := desync.NewSeedStore(s)
+	add := func(indexFile, srcFile string) error {
+		idx, err := readCaibxFile(indexFile, opts)
+		if err != nil {
+			return err
+		}
+		return ss.AddSeed(srcFile, idx)
+	}
+	for _, seedInfo := range seedArgs {
+		indexFile, srcFile, err := parseSeedArg(seedInfo)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(indexFile, srcFile); err != nil {
 			return nil, err
 		}
 	}
-	return seeds, nil
+	if err := walkSeedDirs(seedDirs, skip, add); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// Writes the CRCs of the chunks in a complete output into the file next to it,
+// which is used to validate it when it becomes a seed for another extraction.
+func writeChunkCRCFile(name string, idx desync.Index) error {
+	crcs, err := desync.ChunkCRCsFromFile(name, idx)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(name + desync.ChunkCRCSuffix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := crcs.WriteTo(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Parses the value of the --space-check option.
+func parseSpaceCheck(s string) (desync.SpaceCheck, error) {
+	switch s {
+	case "full":
+		return desync.SpaceCheckFull, nil
+	case "sparse":
+		return desync.SpaceCheckSparse, nil
+	case "none":
+		return desync.SpaceCheckNone, nil
+	default:
+		return 0, fmt.Errorf("invalid --space-check %q, expected full, sparse or none", s)
+	}
 }
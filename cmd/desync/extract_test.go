@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/folbricht/desync"
 	"github.com/stretchr/testify/require"
 )
 
@@ -57,6 +62,10 @@ func TestExtractCommand(t *testing.T) {
 			[]string{"-s", "testdata/blob1.store", "--seed", "testdata/blob2_without_data.caibx:testdata/blob2", "--seed", "testdata/blob1_without_data.caibx:testdata/blob1", "testdata/blob1.caibx"}, out1},
 		{"extract with multi seed and one explicit data directory",
 			[]string{"-s", "testdata/blob1.store", "--seed", "testdata/blob2_without_data.caibx:testdata/blob2", "--seed", "testdata/blob1.caibx", "testdata/blob1.caibx"}, out1},
+		{"extract with seed and block size",
+			[]string{"--store", "testdata/blob1.store", "--seed", "testdata/blob2.caibx", "--blocksize", "65536", "testdata/blob1.caibx"}, out1},
+		{"extract with sparse space check",
+			[]string{"--store", "testdata/blob1.store", "--space-check", "sparse", "testdata/blob1.caibx"}, out1},
 		{"extract with cache",
 			[]string{"-s", "testdata/blob1.store", "-c", cacheDir, "testdata/blob1.caibx"}, out1},
 		{"extract with multiple stores",
@@ -166,3 +175,207 @@ func TestExtractWithInvalidSeeds(t *testing.T) {
 		})
 	}
 }
+
+func TestExtractCommandTmpDir(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+
+	outDir := t.TempDir()
+	tmpDir := t.TempDir()
+	out := filepath.Join(outDir, "out")
+
+	// Leftovers from a process that's gone, and from one that's still running
+	orphan := filepath.Join(tmpDir, tmpFilePrefix(out, 0x3fffffff)+"123"+tmpFileSuffix)
+	require.NoError(t, ioutil.WriteFile(orphan, []byte{1}, 0644))
+	active := filepath.Join(tmpDir, tmpFilePrefix(out, os.Getpid())+"123"+tmpFileSuffix)
+	require.NoError(t, ioutil.WriteFile(active, []byte{1}, 0644))
+
+	cmd := newExtractCommand(context.Background())
+	cmd.SetArgs([]string{"--store", "testdata/blob1.store", "--tmp-dir", tmpDir, "testdata/blob1.caibx", out})
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+
+	// Only the tempfile of the running process is left
+	_, err = os.Stat(orphan)
+	require.True(t, os.IsNotExist(err))
+	entries, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, filepath.Base(active), entries[0].Name())
+}
+
+func TestExtractCommandStamp(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	extract := func(store string) error {
+		cmd := newExtractCommand(context.Background())
+		cmd.SetArgs([]string{"--stamp", "--store", store, "testdata/blob1.caibx", out})
+		stderr = ioutil.Discard
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		return err
+	}
+	require.NoError(t, extract("testdata/blob1.store"))
+	f, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := desync.IndexFromReader(f)
+	require.NoError(t, err)
+	digest, err := desync.IndexDigest(idx)
+	require.NoError(t, err)
+	if !desync.FileStampMatches(out, digest) {
+		t.Skip("extended attributes not supported")
+	}
+
+	// Running it again doesn't need any chunks
+	require.NoError(t, extract("testdata/empty.store"))
+
+	// Once the output is modified, it's extracted again
+	mtime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(out, mtime, mtime))
+	require.Error(t, extract("testdata/empty.store"))
+}
+
+func TestExtractCommandVerifyOnly(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	outDir := t.TempDir()
+
+	verify := func(args ...string) desync.VerifyExtractStats {
+		cmd := newExtractCommand(context.Background())
+		cmd.SetArgs(append([]string{"--verify-only"}, args...))
+		b := new(bytes.Buffer)
+		stdout = b
+		stderr = ioutil.Discard
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		require.NoError(t, err)
+		var stats desync.VerifyExtractStats
+		require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+		return stats
+	}
+
+	// A complete output, no store needed
+	complete := filepath.Join(outDir, "complete")
+	require.NoError(t, ioutil.WriteFile(complete, expected, 0644))
+	stats := verify("testdata/blob1.caibx", complete)
+	require.Equal(t, float64(100), stats.PercentCorrect)
+	require.Equal(t, stats.ChunksTotal, stats.ChunksCorrect)
+	require.Zero(t, stats.ChunksFromStore)
+
+	// A missing output needs everything from the store
+	missing := filepath.Join(outDir, "missing")
+	stats = verify("testdata/blob1.caibx", missing)
+	require.Zero(t, stats.PercentCorrect)
+	require.NotZero(t, stats.ChunksFromStore)
+	_, err = os.Stat(missing)
+	require.True(t, os.IsNotExist(err))
+
+	// Only the first half is correct, some of the rest can be taken from a seed
+	half := filepath.Join(outDir, "half")
+	require.NoError(t, ioutil.WriteFile(half, expected[:len(expected)/2], 0644))
+	stats = verify("--seed", "testdata/blob2.caibx", "testdata/blob1.caibx", half)
+	require.Greater(t, stats.PercentCorrect, float64(0))
+	require.Less(t, stats.PercentCorrect, float64(100))
+	require.NotZero(t, stats.ChunksFromSeeds)
+	require.Equal(t, stats.ChunksTotal, stats.ChunksCorrect+stats.ChunksFromSeeds+stats.ChunksFromStore)
+
+	// The output wasn't modified
+	b, err := ioutil.ReadFile(half)
+	require.NoError(t, err)
+	require.Len(t, b, len(expected)/2)
+}
+
+func TestExtractCommandFastSeedVerify(t *testing.T) {
+	expected, err := os.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "seed")
+	out := filepath.Join(dir, "out")
+
+	extract := func(args ...string) error {
+		cmd := newExtractCommand(context.Background())
+		cmd.SetArgs(args)
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		return err
+	}
+
+	// Extract the seed and write the CRCs of its chunks next to it
+	require.NoError(t, extract("-s", "testdata/blob1.store", "--write-crc", "testdata/blob1.caibx", seed))
+	_, err = os.Stat(seed + desync.ChunkCRCSuffix)
+	require.NoError(t, err)
+	index, err := os.ReadFile("testdata/blob1.caibx")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(seed+".caibx", index, 0644))
+
+	// Use it as seed without a store, validating it with the CRCs
+	require.NoError(t, extract("-s", "testdata/empty.store", "--seed", seed+".caibx", "--seed-verify", "fast", "testdata/blob1.caibx", out))
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+
+	// A modified seed is still detected
+	b[10] ^= 0xff
+	require.NoError(t, os.WriteFile(seed, b, 0644))
+	require.Error(t, extract("-s", "testdata/empty.store", "--seed", seed+".caibx", "--seed-verify", "fast", "testdata/blob1.caibx", out))
+
+	require.Error(t, extract("-s", "testdata/blob1.store", "--seed-verify", "quick", "testdata/blob1.caibx", out))
+}
+
+func TestExtractCommandChunkLog(t *testing.T) {
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "cache")
+	require.NoError(t, os.Mkdir(cache, 0755))
+	log := filepath.Join(dir, "chunks.log")
+
+	f, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := desync.IndexFromReader(f)
+	require.NoError(t, err)
+
+	// Returns the number of chunks in the log by source
+	sources := func() map[string]int {
+		b, err := ioutil.ReadFile(log)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		require.Len(t, lines, len(idx.Chunks))
+		m := make(map[string]int)
+		for _, line := range lines {
+			fields := strings.Split(line, "\t")
+			require.Len(t, fields, 4)
+			_, err := desync.ChunkIDFromString(fields[0])
+			require.NoError(t, err)
+			m[fields[2]]++
+		}
+		return m
+	}
+
+	extract := func() {
+		cmd := newExtractCommand(context.Background())
+		cmd.SetArgs([]string{"-s", "testdata/blob1.store", "-c", cache, "--chunk-log", log, "testdata/blob1.caibx", filepath.Join(dir, "out")})
+		stderr = ioutil.Discard
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		require.NoError(t, err)
+	}
+
+	// Nothing in the cache the first time, chunks come from the store, or
+	// from the output if they're repeated
+	extract()
+	m := sources()
+	require.NotZero(t, m["store"])
+	require.Zero(t, m["cache"])
+
+	// Now they're found in the cache
+	extract()
+	m = sources()
+	require.NotZero(t, m["cache"])
+	require.Zero(t, m["store"])
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type extractTreeOptions struct {
+	cmdStoreOptions
+	desync.LocalFSOptions
+	stores []string
+	cache  string
+}
+
+func newExtractTreeCommand(ctx context.Context) *cobra.Command {
+	var opt extractTreeOptions
+
+	cmd := &cobra.Command{
+		Use:   "extract-tree <tree-index> <target>",
+		Short: "Extract a directory tree from a tree index",
+		Long: `Extracts the directory tree described by a tree index made with make-tree,
+reading the content of the files from the store(s). Use '-' to read the index
+from STDIN. Directories are created in order, while files are written by -n
+goroutines in parallel.
+
+With --overlay, files in the target that are identical to the index are left
+untouched, like with untar.`,
+		Example: `  desync extract-tree -s /path/to/store -c /path/to/cache docs.tree /tmp/documents`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runExtractTree(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s)")
+	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
+	flags.BoolVar(&opt.NoSameOwner, "no-same-owner", false, "extract files as current user")
+	flags.BoolVar(&opt.NoSamePermissions, "no-same-permissions", false, "use current user's umask instead of what is in the index")
+	flags.BoolVar(&opt.Overlay, "overlay", false, "only rewrite files that differ from the index, keep identical ones")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runExtractTree(ctx context.Context, opt extractTreeOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if len(opt.stores) == 0 {
+		return errors.New("no store provided")
+	}
+	idx, err := readTreeIndex(args[0])
+	if err != nil {
+		return err
+	}
+
+	s, err := MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return desync.ExtractTreeIndex(ctx, idx, s, desync.NewLocalFS(args[1], opt.LocalFSOptions), opt.n)
+}
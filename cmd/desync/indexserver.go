@@ -10,19 +10,30 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/folbricht/desync"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/spf13/cobra"
 )
 
 type indexServerOptions struct {
 	cmdStoreOptions
 	cmdServerOptions
+	cmdEventOptions
+	cmdAdminOptions
 	store           string
+	storeFile       string
 	listenAddresses []string
 	writable        bool
 	logFile         string
+	maxIndexSize    int64
+	dailyQuota      int64
+	validate        bool
+	chunkSize       string
+	blobDir         string
+	blobCache       string
 }
 
 func newIndexServerCommand(ctx context.Context) *cobra.Command {
@@ -34,9 +45,42 @@ func newIndexServerCommand(ctx context.Context) *cobra.Command {
 		Long: `Starts an HTTP index server that can be used as remote store. It supports
 reading from a single local or a proxying to a remote store.
 If --cert and --key are provided, the server will serve over HTTPS. The -w option
-enables writing to this store.`,
-		Example: `  desync index-server -s sftp://192.168.1.1/indexes -l :8080`,
-		Args:    cobra.NoArgs,
+enables writing to this store.
+
+Uploads can be restricted with --max-index-size and a --daily-quota of bytes that
+each client can write. Clients are identified by the common name of their TLS
+certificate, their Authorization header, or their IP address. With --validate,
+uploaded indexes are parsed and checked for consistency before they're stored,
+and --chunk-size only accepts indexes made with these chunk size parameters.
+With --require-chunks, indexes are only accepted if all the
+chunks they reference are present in the given chunk store(s), checked with
+--concurrency goroutines.
+
+Instead of a store, --blob-dir can be used to serve indexes for the files in a
+directory, which don't need to be chunked ahead of time. The index for file
+<name> is available as <name>.caibx. It's generated when it's first requested,
+using the chunk sizes given with -m (default 16:64:256), and cached in the
+--blob-cache directory. When a file is modified, its index is generated again.
+This mode is read-only.
+
+With --webhook, every uploaded index is reported as an event in a JSON POST
+request to the given URLs, or appended to a file with --event-log.
+
+This command supports the --store-file option which can be used to define the store
+in a JSON file. The config can then be reloaded by sending a SIGHUP without needing
+to restart the server. A version 2 store-file can also define additional stores
+that are served under path prefixes, and scopes that limit which clients can read
+from or write to which prefixes based on their Authorization header.
+
+With --admin-authorization, the server can be managed through the /admin
+endpoints, for clients that send the given value in their Authorization header.
+GET /admin/config returns the store configuration in use, without passwords, and
+/admin/status the health of the index stores. A POST request to /admin/reload
+opens the stores again, reading the store-file if there is one. The admin
+endpoints can be served on a separate address with --admin-listen.`,
+		Example: `  desync index-server -s sftp://192.168.1.1/indexes -l :8080
+  desync index-server --blob-dir /srv/artifacts --blob-cache /var/cache/desync -l :8080`,
+		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runIndexServer(ctx, opt, args)
 		},
@@ -44,11 +88,21 @@ enables writing to this store.`,
 	}
 	flags := cmd.Flags()
 	flags.StringVarP(&opt.store, "store", "s", "", "upstream source index store")
+	flags.StringVar(&opt.storeFile, "store-file", "", "read store arguments from a file, supports reload on SIGHUP")
 	flags.StringSliceVarP(&opt.listenAddresses, "listen", "l", []string{":http"}, "listen address")
 	flags.BoolVarP(&opt.writable, "writeable", "w", false, "support writing")
 	flags.StringVar(&opt.logFile, "log", "", "request log file or - for STDOUT")
+	flags.Int64Var(&opt.maxIndexSize, "max-index-size", 0, "maximum size of uploaded indexes in bytes, 0 for unlimited")
+	flags.Int64Var(&opt.dailyQuota, "daily-quota", 0, "bytes each client can upload per day, 0 for unlimited")
+	flags.BoolVar(&opt.validate, "validate", false, "validate uploaded indexes")
+	flags.StringVarP(&opt.chunkSize, "chunk-size", "m", "", "only accept indexes with these min:avg:max chunk sizes in kb, or chunk sizes used with --blob-dir")
+	flags.StringVar(&opt.blobDir, "blob-dir", "", "serve indexes generated from the files in this directory")
+	flags.StringVar(&opt.blobCache, "blob-cache", "", "directory to cache indexes generated with --blob-dir")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addRequireChunksOption(&opt.cmdStoreOptions, flags)
 	addServerOptions(&opt.cmdServerOptions, flags)
+	addEventOptions(&opt.cmdEventOptions, flags)
+	addAdminOptions(&opt.cmdAdminOptions, flags)
 	return cmd
 }
 
@@ -59,41 +113,125 @@ func runIndexServer(ctx context.Context, opt indexServerOptions, args []string)
 	if err := opt.cmdServerOptions.validate(); err != nil {
 		return err
 	}
+	if err := opt.cmdEventOptions.validate(); err != nil {
+		return err
+	}
+	if err := opt.cmdAdminOptions.validate(opt.listenAddresses); err != nil {
+		return err
+	}
+	if opt.readyProbe == "write" {
+		return errors.New("--ready-probe write is not supported by index-server")
+	}
 	if opt.auth == "" {
 		opt.auth = os.Getenv("DESYNC_HTTP_AUTH")
 	}
+	if opt.adminAuth == "" {
+		opt.adminAuth = os.Getenv("DESYNC_ADMIN_AUTH")
+	}
 
 	addresses := opt.listenAddresses
 	if len(addresses) == 0 {
 		addresses = []string{":http"}
 	}
 
-	// Checkout the store
-	if opt.store == "" {
-		return errors.New("no store provided")
+	s, c, err := indexServerStore(opt)
+	if err != nil {
+		return err
 	}
 
-	// Making sure we have a "/" at the end
-	loc := opt.store
-	if !strings.HasSuffix(loc, "/") {
-		loc = loc + "/"
+	// Restrict access to the stores based on the scopes in the store-file, and
+	// reload them together with the stores. Scopes can be added by reloading
+	// even if there are none at the start.
+	var authz *desync.ScopeAuthorizer
+	if opt.auth == "" {
+		authz = desync.NewScopeAuthorizer(c.Scopes)
 	}
 
-	var (
-		s   desync.IndexStore
-		err error
-	)
-	if opt.writable {
-		s, _, err = writableIndexStore(loc, opt.cmdStoreOptions)
-	} else {
-		s, _, err = indexStoreFromLocation(loc, opt.cmdStoreOptions)
+	// When a store file is used, wrap the store so it can be replaced when the
+	// config is reloaded on SIGHUP. The admin endpoints reload it the same way.
+	var reloader *storeReloader
+	if opt.storeFile != "" || opt.adminAuth != "" {
+		swap := desync.NewSwapIndexStore(s)
+		s = swap
+		reloader = newIndexStoreReloader(swap, c, func() (desync.IndexStore, storeFile, error) {
+			return indexServerStore(opt)
+		}, func(c storeFile) {
+			if authz != nil {
+				authz.SetScopes(c.Scopes)
+			}
+		})
+		if opt.storeFile != "" {
+			go reloader.onSIGHUP()
+		}
+	}
+	defer s.Close()
+
+	limits := desync.IndexUploadLimits{
+		MaxSize:    opt.maxIndexSize,
+		DailyQuota: opt.dailyQuota,
+		Validate:   opt.validate,
+	}
+	if opt.chunkSize != "" && opt.blobDir == "" {
+		limits.ChunkSizeMin, limits.ChunkSizeAvg, limits.ChunkSizeMax, err = parseChunkSizeParam(opt.chunkSize)
+		if err != nil {
+			return err
+		}
 	}
+	notify, closeEvents, err := opt.cmdEventOptions.notifier()
 	if err != nil {
 		return err
 	}
-	defer s.Close()
+	if closeEvents != nil {
+		defer closeEvents()
+	}
+	hopt := desync.HTTPIndexHandlerOptions{
+		Writable:      opt.writable,
+		Authorization: opt.auth,
+		Limits:        limits,
+		Notify:        notify,
+	}
+	if authz != nil {
+		hopt.Authorize = authz.Authorize
+	}
+
+	// Reject uploaded indexes that reference chunks which aren't in the stores
+	if len(opt.requireChunks) > 0 {
+		cs, err := multiStoreWithRouter(opt.cmdStoreOptions, opt.requireChunks...)
+		if err != nil {
+			return err
+		}
+		defer cs.Close()
+		hopt.ChunkStore = cs
+		hopt.ChunkCheckConcurrency = opt.n
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", desync.NewHTTPIndexHandlerWithOptions(s, hopt))
+
+	// Serve the additional stores under their prefixes
+	stores := map[string]desync.IndexStore{"": s}
+	for _, prefix := range c.prefixes() {
+		writable := c.prefixWritable(prefix)
+		ps, err := indexServerPrefixStore(opt, c, prefix, writable)
+		if err != nil {
+			return err
+		}
+		defer ps.Close()
+		popt := hopt
+		popt.Prefix = prefix
+		popt.Writable = writable
+		mux.Handle(prefix+"/", desync.NewHTTPIndexHandlerWithOptions(ps, popt))
+		stores[prefix] = ps
+	}
 
-	handler := desync.NewHTTPIndexHandler(s, opt.writable, opt.auth)
+	// Serve the admin endpoints on their own address if requested
+	var admin http.Handler
+	if opt.adminAuth != "" {
+		admin = indexServerAdmin(opt, reloader, stores).handler(opt.adminAuth)
+		if opt.adminListen == "" {
+			mux.Handle("/admin/", admin)
+		}
+	}
+	var handler http.Handler = mux
 
 	// Wrap the handler in a logger if requested
 	switch opt.logFile {
@@ -109,13 +247,158 @@ func runIndexServer(ctx context.Context, opt indexServerOptions, args []string)
 		handler = withLog(handler, log.New(l, "", log.LstdFlags))
 	}
 
-	http.Handle("/", handler)
+	http.Handle("/", withHealth(handler, opt.cmdServerOptions, func() error {
+		return desync.CheckIndexStore(s)
+	}))
 
 	// Start the server
+	if opt.adminListen != "" {
+		return serveWithAdmin(ctx, opt.cmdServerOptions, opt.adminListen, admin, addresses...)
+	}
 	return serve(ctx, opt.cmdServerOptions, addresses...)
 }
 
+// Returns the admin API of the index server. The stores are the ones being
+// served, by prefix, with the main store under "".
+func indexServerAdmin(opt indexServerOptions, reloader *storeReloader, stores map[string]desync.IndexStore) adminAPI {
+	return adminAPI{
+		config: func() interface{} {
+			return redactStoreFile(reloader.config())
+		},
+		status: func(ctx context.Context) interface{} {
+			c := reloader.config()
+			var prefixes []string
+			for prefix := range stores {
+				prefixes = append(prefixes, prefix)
+			}
+			sort.Strings(prefixes)
+			status := adminStatus{Stores: make([]adminStoreStatus, 0, len(prefixes))}
+			for _, prefix := range prefixes {
+				location := opt.blobDir
+				if prefix != "" {
+					location = c.prefixLocation(prefix)
+				} else if len(c.Stores) > 0 {
+					location = c.Stores[0].Location
+				}
+				s := adminStoreStatus{Location: redactLocation(location), Healthy: true}
+				if err := desync.CheckIndexStore(stores[prefix]); err != nil {
+					s.Healthy = false
+					s.Error = err.Error()
+				}
+				status.Stores = append(status.Stores, s)
+			}
+			return status
+		},
+		reload: reloader.reload,
+	}
+}
+
+// Reads the store-related command line options and returns the index store as
+// well as the configuration it was built from.
+func indexServerStore(opt indexServerOptions) (desync.IndexStore, storeFile, error) {
+	if opt.blobDir != "" {
+		return blobIndexStore(opt)
+	}
+	var stores []string
+	if opt.store != "" {
+		stores = []string{opt.store}
+	}
+	c, err := storeConfig(stores, "", opt.storeFile)
+	if err != nil {
+		return nil, c, err
+	}
+	if len(c.Scopes) > 0 && opt.auth != "" {
+		return nil, c, errors.New("--authorization can't be used together with scopes in the store-file")
+	}
+	opt.storeFileOptions = c.options()
+
+	// Checkout the store
+	if len(c.Stores) == 0 {
+		return nil, c, errors.New("no store provided")
+	}
+	if len(c.Stores) > 1 || len(c.cacheLocations()) > 0 {
+		return nil, c, errors.New("only one store and no cache supported for indexes")
+	}
+
+	// Making sure we have a "/" at the end
+	loc := c.Stores[0].Location
+	if !strings.HasSuffix(loc, "/") {
+		loc = loc + "/"
+	}
+
+	var s desync.IndexStore
+	if opt.writable {
+		s, _, err = writableIndexStore(loc, opt.cmdStoreOptions)
+	} else {
+		s, _, err = indexStoreFromLocation(loc, opt.cmdStoreOptions)
+	}
+	return s, c, err
+}
+
+// Opens the index store served under a prefix given in the store-file.
+func indexServerPrefixStore(opt indexServerOptions, c storeFile, prefix string, writable bool) (desync.IndexStore, error) {
+	opt.storeFileOptions = c.options()
+	loc := c.prefixLocation(prefix)
+	if !strings.HasSuffix(loc, "/") {
+		loc = loc + "/"
+	}
+	var (
+		s   desync.IndexStore
+		err error
+	)
+	if writable {
+		s, _, err = writableIndexStore(loc, opt.cmdStoreOptions)
+	} else {
+		s, _, err = indexStoreFromLocation(loc, opt.cmdStoreOptions)
+	}
+	return s, err
+}
+
+// Returns an index store generating indexes for the files in --blob-dir.
+func blobIndexStore(opt indexServerOptions) (desync.IndexStore, storeFile, error) {
+	if opt.store != "" || opt.storeFile != "" {
+		return nil, storeFile{}, errors.New("--blob-dir can't be used together with a store")
+	}
+	if opt.writable {
+		return nil, storeFile{}, errors.New("--blob-dir does not support writing")
+	}
+	if opt.blobCache == "" {
+		return nil, storeFile{}, errors.New("--blob-dir requires --blob-cache")
+	}
+	chunkSize := opt.chunkSize
+	if chunkSize == "" {
+		chunkSize = "16:64:256"
+	}
+	min, avg, max, err := parseChunkSizeParam(chunkSize)
+	if err != nil {
+		return nil, storeFile{}, err
+	}
+	// Indexes are generated with the digest configured for the blob directory
+	configOptions, err := opt.optionsFor(opt.blobDir)
+	if err != nil {
+		return nil, storeFile{}, err
+	}
+	digest, err := desync.DigestByName(configOptions.Digest)
+	if err != nil {
+		return nil, storeFile{}, err
+	}
+	s, err := desync.NewBlobIndexStore(opt.blobDir, opt.blobCache, desync.BlobIndexStoreOptions{
+		N:            opt.n,
+		ChunkSizeMin: min,
+		ChunkSizeAvg: avg,
+		ChunkSizeMax: max,
+		Digest:       digest,
+	})
+	return s, storeFile{}, err
+}
+
 func serve(ctx context.Context, opt cmdServerOptions, addresses ...string) error {
+	return serveWithAdmin(ctx, opt, "", nil, addresses...)
+}
+
+// Like serve, but also serves the admin handler on its own address if adminAddr
+// is set. The admin listener uses the same TLS configuration.
+func serveWithAdmin(ctx context.Context, opt cmdServerOptions, adminAddr string, admin http.Handler, addresses ...string) error {
 	tlsConfig := &tls.Config{}
 	if opt.mutualTLS {
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
@@ -132,16 +415,40 @@ func serve(ctx context.Context, opt cmdServerOptions, addresses ...string) error
 		tlsConfig.ClientCAs = certPool
 	}
 
+	// HTTP/3 servers need the certificate in the TLS config
+	var tlsConfig3 *tls.Config
+	if opt.http3 {
+		certificate, err := tls.LoadX509KeyPair(opt.cert, opt.key)
+		if err != nil {
+			return err
+		}
+		tlsConfig3 = tlsConfig.Clone()
+		tlsConfig3.Certificates = []tls.Certificate{certificate}
+	}
+
 	// Run the server(s) in a goroutine, and use the main goroutine to wait for
 	// a signal or a failing server (ctx gets cancelled in that case)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	handlers := make(map[string]http.Handler) // nil for the default mux
 	for _, addr := range addresses {
-		go func(a string) {
+		handlers[addr] = nil
+	}
+	if adminAddr != "" {
+		handlers[adminAddr] = admin
+	}
+	for addr, handler := range handlers {
+		go func(a string, h http.Handler) {
 			server := &http.Server{
-				Addr:      a,
-				TLSConfig: tlsConfig,
-				ErrorLog:  log.New(stderr, "", log.LstdFlags),
+				Addr:              a,
+				Handler:           serverHandler(h, opt),
+				TLSConfig:         tlsConfig,
+				ErrorLog:          log.New(stderr, "", log.LstdFlags),
+				ReadHeaderTimeout: opt.readHeaderTimeout,
+				ReadTimeout:       opt.readTimeout,
+				WriteTimeout:      opt.writeTimeout,
+				IdleTimeout:       opt.idleTimeout,
+				MaxHeaderBytes:    opt.maxHeaderBytes,
 			}
 			var err error
 			if opt.key == "" {
@@ -151,8 +458,28 @@ func serve(ctx context.Context, opt cmdServerOptions, addresses ...string) error
 			}
 			fmt.Fprintln(stderr, err)
 			cancel()
-		}(addr)
+		}(addr, handler)
 	}
+
+	// HTTP/3 listeners on the same addresses, using UDP
+	if opt.http3 {
+		for _, addr := range addresses {
+			go func(a string) {
+				// There are no read or write timeouts for HTTP/3, only the idle
+				// timeout and the body size limit apply
+				server := &http3.Server{
+					Addr:           a,
+					Handler:        serverHandler(nil, opt),
+					TLSConfig:      http3.ConfigureTLSConfig(tlsConfig3),
+					IdleTimeout:    opt.idleTimeout,
+					MaxHeaderBytes: opt.maxHeaderBytes,
+				}
+				fmt.Fprintln(stderr, server.ListenAndServe())
+				cancel()
+			}(addr)
+		}
+	}
+
 	// wait for either INT/TERM or an issue with the server
 	<-ctx.Done()
 	return nil
@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -71,6 +73,34 @@ func TestIndexServerWriteCommand(t *testing.T) {
 	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
 }
 
+func TestIndexServerBlobDir(t *testing.T) {
+	cache := t.TempDir()
+	addr, cancel := startIndexServer(t, "--blob-dir", "testdata", "--blob-cache", cache, "-m", "2:8:32")
+	defer cancel()
+
+	// Extract a file using the index generated by the server
+	out := filepath.Join(t.TempDir(), "out")
+	cmd := newExtractCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob1.store", fmt.Sprintf("http://%s/blob1.caibx", addr), out})
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+
+	// The index was cached, and files that don't exist aren't found
+	_, err = os.Stat(filepath.Join(cache, "blob1.caibx"))
+	require.NoError(t, err)
+	resp, err := http.Get(fmt.Sprintf("http://%s/missing.caibx", addr))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
 func startIndexServer(t *testing.T, args ...string) (string, context.CancelFunc) {
 	// Find a free local port to be used to run the index server on
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -94,3 +124,44 @@ func startIndexServer(t *testing.T, args ...string) (string, context.CancelFunc)
 	time.Sleep(time.Second)
 	return addr, cancel
 }
+
+func TestIndexServerAdmin(t *testing.T) {
+	addr, cancel := startIndexServer(t, "-s", "testdata", "--admin-authorization", "Bearer admin")
+	defer cancel()
+
+	request := func(method, path, auth string) (int, []byte) {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s/%s", addr, path), nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, b
+	}
+
+	code, _ := request("GET", "admin/status", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	var status adminStatus
+	code, b := request("GET", "admin/status", "Bearer admin")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(b, &status))
+	require.Equal(t, []adminStoreStatus{{Location: "testdata", Healthy: true}}, status.Stores)
+
+	code, b = request("GET", "admin/config", "Bearer admin")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, string(b), "testdata")
+
+	code, _ = request("POST", "admin/reload", "Bearer admin")
+	require.Equal(t, http.StatusOK, code)
+
+	// Index servers have no caches
+	code, _ = request("POST", "admin/cache/gc?max-age=1d", "Bearer admin")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// Indexes are still served after the reload
+	code, _ = request("GET", "blob1.caibx", "")
+	require.Equal(t, http.StatusOK, code)
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"sync"
+	"sort"
+	"strings"
 	"sync/atomic"
 
 	"github.com/folbricht/desync"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
 )
 
 type infoOptions struct {
@@ -27,15 +31,26 @@ func newInfoCommand(ctx context.Context) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "info <index>",
 		Short: "Show information about an index",
-		Long: `Displays information about the provided index, such as the number of chunks
-and the total size of unique chunks that are not available in the seed. If a
-store is provided, it'll also show how many of the chunks are present in the
-store. By providing a chunks info file, generated by 'inspect-chunks', additional
-information will be shown, like the size of compressed chunks not in the seed nor cache.
-If one or more seed indexes are provided, the number of chunks available
-in the seeds are also shown. Use '-' to read the index from STDIN.`,
+		Long: `Displays information about the provided index, such as the number of
+chunks and the total size of unique chunks that are not available in the seed.
+If a store is provided, it'll also show how many of the chunks are present in
+the store. With more than one store, the number of chunks is also shown for each
+store individually, together with the number of chunks that are in none of them.
+The command fails if a store or the cache can't be queried, rather than counting
+chunks as missing. Credentials in store URLs are not shown. By providing a
+chunks info file, generated by 'inspect-chunks', additional information will be
+shown, like the size of compressed chunks not in the seed nor cache. If one or
+more seed indexes are provided, the number of chunks available in the seeds are
+also shown. Metadata added to the index when it was created, such as labels
+given to 'make', is shown as well. Use '-' to read the index from STDIN.
+
+With --format=prometheus, the numbers are printed as gauges in the Prometheus
+text exposition format, labeled with the name of the index, to be served by an
+exporter or the textfile collector of the node exporter. Numbers about seeds,
+caches and stores are only included if they were given.`,
 		Example: `  desync info -s /path/to/local --format=json file.caibx
-desync info --seed http://192.168.1.1/rootfs2.caibx --chunks-info chunks.json --format=json rootfs.caibx`,
+desync info --seed http://192.168.1.1/rootfs2.caibx --chunks-info chunks.json --format=json rootfs.caibx
+  desync info -s /path/to/local --format=prometheus file.caibx > /var/lib/node_exporter/file.prom`,
 		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runInfo(ctx, opt, args)
@@ -46,7 +61,7 @@ desync info --seed http://192.168.1.1/rootfs2.caibx --chunks-info chunks.json --
 	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s)")
 	flags.StringSliceVar(&opt.seeds, "seed", nil, "seed indexes")
 	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
-	flags.StringVarP(&opt.printFormat, "format", "f", "json", "output format, plain or json")
+	flags.StringVarP(&opt.printFormat, "format", "f", "json", "output format, plain, json or prometheus")
 	flags.StringVar(&opt.chunksInfo, "chunks-info", "", "json file with additional chunks info")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
@@ -56,28 +71,19 @@ func runInfo(ctx context.Context, opt infoOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if err := readsStdinOnce(append(args[:1:1], opt.seeds...)...); err != nil {
+		return err
+	}
 
-	// Read the index
-	c, err := readCaibxFile(args[0], opt.cmdStoreOptions)
+	// Open the index, the chunks are read one at a time below so very large
+	// indexes don't have to be held in memory
+	ir, closeIndex, err := openCaibxFile(args[0], opt.cmdStoreOptions)
 	if err != nil {
 		return err
 	}
+	defer closeIndex()
 
-	var results struct {
-		Total                           int    `json:"total"`
-		Unique                          int    `json:"unique"`
-		InStore                         uint64 `json:"in-store"`
-		InSeed                          uint64 `json:"in-seed"`
-		InCache                         uint64 `json:"in-cache"`
-		NotInSeedNorCache               uint64 `json:"not-in-seed-nor-cache"`
-		Size                            uint64 `json:"size"`
-		SizeNotInSeed                   uint64 `json:"dedup-size-not-in-seed"`
-		SizeNotInSeedNorCache           uint64 `json:"dedup-size-not-in-seed-nor-cache"`
-		SizeNotInSeedNorCacheCompressed uint64 `json:"dedup-size-not-in-seed-nor-cache-compressed"`
-		ChunkSizeMin                    uint64 `json:"chunk-size-min"`
-		ChunkSizeAvg                    uint64 `json:"chunk-size-avg"`
-		ChunkSizeMax                    uint64 `json:"chunk-size-max"`
-	}
+	var results infoResults
 
 	var estimateCompressedSize = opt.chunksInfo != ""
 	var chunksInfo []desync.ChunkAdditionalInfo
@@ -99,30 +105,20 @@ func runInfo(ctx context.Context, opt infoOptions, args []string) error {
 
 	dedupedSeeds := make(map[desync.ChunkID]struct{})
 	for _, seed := range opt.seeds {
-		caibxSeed, err := readCaibxFile(seed, opt.cmdStoreOptions)
-		if err != nil {
+		if err := readSeedChunkIDs(ctx, seed, opt.cmdStoreOptions, dedupedSeeds); err != nil {
 			return err
 		}
-		for _, chunk := range caibxSeed.Chunks {
-			dedupedSeeds[chunk.ID] = struct{}{}
-			select {
-			case <-ctx.Done():
-				return nil
-			default:
-			}
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
 		}
 	}
 
-	// Calculate the size of the blob, from the last chunk
-	if len(c.Chunks) > 0 {
-		last := c.Chunks[len(c.Chunks)-1]
-		results.Size = last.Start + last.Size
-	}
-
 	// Capture min:avg:max from the index
-	results.ChunkSizeMin = c.Index.ChunkSizeMin
-	results.ChunkSizeAvg = c.Index.ChunkSizeAvg
-	results.ChunkSizeMax = c.Index.ChunkSizeMax
+	results.ChunkSizeMin = ir.Index.ChunkSizeMin
+	results.ChunkSizeAvg = ir.Index.ChunkSizeAvg
+	results.ChunkSizeMax = ir.Index.ChunkSizeMax
 
 	var cache desync.WriteStore
 	if opt.cache != "" {
@@ -136,13 +132,22 @@ func runInfo(ctx context.Context, opt infoOptions, args []string) error {
 	// with a map and calculate the size of the chunks that are not available
 	// in seed
 	deduped := make(map[desync.ChunkID]struct{})
-	for _, chunk := range c.Chunks {
+	for {
+		chunk, err := ir.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, args[0])
+		}
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
 		}
 
+		// The size of the blob is the end of the last chunk
+		results.Size = chunk.Start + chunk.Size
 		results.Total++
 		if _, duplicatedChunk := deduped[chunk.ID]; duplicatedChunk {
 			// This is a duplicated chunk, do not count it again in the seed
@@ -158,7 +163,11 @@ func runInfo(ctx context.Context, opt infoOptions, args []string) error {
 			inSeed = true
 		}
 		if cache != nil {
-			if hasChunk, _ := cache.HasChunk(chunk.ID); hasChunk {
+			hasChunk, err := cache.HasChunk(chunk.ID)
+			if err != nil {
+				return err
+			}
+			if hasChunk {
 				results.InCache++
 				inCache = true
 			}
@@ -195,31 +204,69 @@ func runInfo(ctx context.Context, opt infoOptions, args []string) error {
 	}
 	results.Unique = len(deduped)
 
+	// The metadata follows the chunk table, so it's only available now
+	results.Metadata = ir.Metadata
+
 	if len(opt.stores) > 0 {
-		store, err := multiStoreWithRouter(opt.cmdStoreOptions, opt.stores...)
-		if err != nil {
-			return err
+		// Open the stores individually to count the chunks in each of them
+		var stores []desync.Store
+		for _, location := range opt.stores {
+			s, err := storeGroup(location, opt.cmdStoreOptions)
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			stores = append(stores, s)
 		}
+		inStore := make([]uint64, len(stores))
 
-		// Query the store in parallel for better performance
-		var wg sync.WaitGroup
+		// Query the stores in parallel for better performance. Errors are
+		// returned rather than counting the chunk as missing.
 		ids := make(chan desync.ChunkID)
+		g, gctx := errgroup.WithContext(ctx)
 		for i := 0; i < opt.n; i++ {
-			wg.Add(1)
-			go func() {
+			g.Go(func() error {
 				for id := range ids {
-					if hasChunk, err := store.HasChunk(id); err == nil && hasChunk {
+					var found bool
+					for i, s := range stores {
+						hasChunk, err := s.HasChunk(id)
+						if err != nil {
+							return err
+						}
+						if hasChunk {
+							atomic.AddUint64(&inStore[i], 1)
+							found = true
+						}
+					}
+					if found {
 						atomic.AddUint64(&results.InStore, 1)
 					}
 				}
-				wg.Done()
-			}()
+				return nil
+			})
 		}
+	feed:
 		for id := range deduped {
-			ids <- id
+			select {
+			case ids <- id:
+			case <-gctx.Done():
+				break feed
+			}
 		}
 		close(ids)
-		wg.Wait()
+		if err := g.Wait(); err != nil {
+			return err
+		}
+
+		// Break the numbers down by store if there's more than one, to find
+		// chunks that are missing in some of them
+		if len(stores) > 1 {
+			for i, location := range opt.stores {
+				results.Stores = append(results.Stores, storeInfo{Location: redactLocation(location), InStore: inStore[i]})
+			}
+			notInAnyStore := uint64(results.Unique) - results.InStore
+			results.NotInAnyStore = &notInAnyStore
+		}
 	}
 
 	switch opt.printFormat {
@@ -234,6 +281,12 @@ func runInfo(ctx context.Context, opt infoOptions, args []string) error {
 		fmt.Println("Total chunks:", results.Total)
 		fmt.Println("Unique chunks:", results.Unique)
 		fmt.Println("Chunks in store:", results.InStore)
+		for _, s := range results.Stores {
+			fmt.Printf("Chunks in store %s: %d\n", s.Location, s.InStore)
+		}
+		if results.NotInAnyStore != nil {
+			fmt.Println("Chunks not in any store:", *results.NotInAnyStore)
+		}
 		fmt.Println("Chunks in seed:", results.InSeed)
 		fmt.Println("Chunks in cache:", results.InCache)
 		fmt.Println("Chunks not in seed nor cache:", results.NotInSeedNorCache)
@@ -241,8 +294,139 @@ func runInfo(ctx context.Context, opt infoOptions, args []string) error {
 		fmt.Println("Chunk size min:", results.ChunkSizeMin)
 		fmt.Println("Chunk size avg:", results.ChunkSizeAvg)
 		fmt.Println("Chunk size max:", results.ChunkSizeMax)
+		keys := make([]string, 0, len(results.Metadata))
+		for k := range results.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("Metadata %s: %s\n", k, results.Metadata[k])
+		}
+	case "prometheus":
+		m := infoMetrics{
+			results:         results,
+			index:           args[0],
+			withSeed:        len(opt.seeds) > 0,
+			withCache:       cache != nil,
+			withStores:      len(opt.stores) > 0,
+			withCompression: estimateCompressedSize,
+		}
+		if err := m.write(stdout); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("unsupported output format '%s", opt.printFormat)
 	}
 	return nil
 }
+
+// Numbers about an index shown by info.
+type infoResults struct {
+	Total                           int               `json:"total"`
+	Unique                          int               `json:"unique"`
+	InStore                         uint64            `json:"in-store"`
+	InSeed                          uint64            `json:"in-seed"`
+	InCache                         uint64            `json:"in-cache"`
+	NotInSeedNorCache               uint64            `json:"not-in-seed-nor-cache"`
+	Size                            uint64            `json:"size"`
+	SizeNotInSeed                   uint64            `json:"dedup-size-not-in-seed"`
+	SizeNotInSeedNorCache           uint64            `json:"dedup-size-not-in-seed-nor-cache"`
+	SizeNotInSeedNorCacheCompressed uint64            `json:"dedup-size-not-in-seed-nor-cache-compressed"`
+	ChunkSizeMin                    uint64            `json:"chunk-size-min"`
+	ChunkSizeAvg                    uint64            `json:"chunk-size-avg"`
+	ChunkSizeMax                    uint64            `json:"chunk-size-max"`
+	Metadata                        map[string]string `json:"metadata,omitempty"`
+	Stores                          []storeInfo       `json:"stores,omitempty"`
+	NotInAnyStore                   *uint64           `json:"not-in-any-store,omitempty"`
+}
+
+// Number of chunks of the index in one of the stores given to info.
+type storeInfo struct {
+	Location string `json:"location"`
+	InStore  uint64 `json:"in-store"`
+}
+
+// Adds the IDs of all chunks in a seed index to ids, reading the index one chunk
+// at a time.
+func readSeedChunkIDs(ctx context.Context, location string, cmdOpt cmdStoreOptions, ids map[desync.ChunkID]struct{}) error {
+	ir, closeIndex, err := openCaibxFile(location, cmdOpt)
+	if err != nil {
+		return err
+	}
+	defer closeIndex()
+	for {
+		chunk, err := ir.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, location)
+		}
+		ids[chunk.ID] = struct{}{}
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+	}
+}
+
+// Writes the numbers of info in the Prometheus text exposition format.
+type infoMetrics struct {
+	results infoResults
+	index   string
+
+	// Which of the optional numbers are known
+	withSeed, withCache, withStores, withCompression bool
+}
+
+func (m infoMetrics) write(w io.Writer) error {
+	r := m.results
+	index := `index="` + promLabelValue(m.index) + `"`
+	type metric struct {
+		name, help string
+		value      uint64
+		show       bool
+	}
+	metrics := []metric{
+		{"desync_index_chunks", "Number of chunks in the index.", uint64(r.Total), true},
+		{"desync_index_unique_chunks", "Number of unique chunks in the index.", uint64(r.Unique), true},
+		{"desync_index_size_bytes", "Size of the blob described by the index.", r.Size, true},
+		{"desync_index_chunk_size_min_bytes", "Minimum chunk size of the index.", r.ChunkSizeMin, true},
+		{"desync_index_chunk_size_avg_bytes", "Average chunk size of the index.", r.ChunkSizeAvg, true},
+		{"desync_index_chunk_size_max_bytes", "Maximum chunk size of the index.", r.ChunkSizeMax, true},
+		{"desync_index_chunks_in_store", "Number of unique chunks present in at least one of the stores.", r.InStore, m.withStores},
+		{"desync_index_chunks_in_seed", "Number of unique chunks present in the seeds.", r.InSeed, m.withSeed},
+		{"desync_index_chunks_in_cache", "Number of unique chunks present in the cache.", r.InCache, m.withCache},
+		{"desync_index_chunks_not_in_seed_nor_cache", "Number of unique chunks neither in the seeds nor the cache.", r.NotInSeedNorCache, true},
+		{"desync_index_dedup_size_not_in_seed_bytes", "Size of the unique chunks not in the seeds.", r.SizeNotInSeed, true},
+		{"desync_index_dedup_size_not_in_seed_nor_cache_bytes", "Size of the unique chunks neither in the seeds nor the cache.", r.SizeNotInSeedNorCache, true},
+		{"desync_index_dedup_size_not_in_seed_nor_cache_compressed_bytes", "Compressed size of the unique chunks neither in the seeds nor the cache.", r.SizeNotInSeedNorCacheCompressed, m.withCompression},
+	}
+	if r.NotInAnyStore != nil {
+		metrics = append(metrics, metric{"desync_index_chunks_not_in_any_store", "Number of unique chunks missing from all stores.", *r.NotInAnyStore, true})
+	}
+	var b strings.Builder
+	for _, metric := range metrics {
+		if !metric.show {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s{%s} %d\n", metric.name, metric.help, metric.name, metric.name, index, metric.value)
+	}
+
+	// Chunks in each of the stores if there's more than one
+	if len(r.Stores) > 0 {
+		b.WriteString("# HELP desync_index_chunks_in_each_store Number of unique chunks present in a store.\n")
+		b.WriteString("# TYPE desync_index_chunks_in_each_store gauge\n")
+		for _, s := range r.Stores {
+			fmt.Fprintf(&b, "desync_index_chunks_in_each_store{%s,store=\"%s\"} %d\n", index, promLabelValue(s.Location), s.InStore)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Escapes a label value for the Prometheus text format.
+func promLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -5,6 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -101,6 +104,28 @@ func TestInfoCommand(t *testing.T) {
 				"chunk-size-avg": 8192,
 				"chunk-size-max": 32768
 			}`)},
+		{"info command with multiple stores",
+			[]string{"-s", "testdata/blob2.cache", "-s", "testdata/blob2.store", "testdata/blob1.caibx"},
+			[]byte(`{
+				"total": 161,
+				"unique": 131,
+				"in-store": 124,
+				"in-seed": 0,
+				"in-cache": 0,
+				"not-in-seed-nor-cache": 131,
+				"size": 2097152,
+				"dedup-size-not-in-seed": 1114112,
+				"dedup-size-not-in-seed-nor-cache": 1114112,
+				"dedup-size-not-in-seed-nor-cache-compressed": 0,
+				"chunk-size-min": 2048,
+				"chunk-size-avg": 8192,
+				"chunk-size-max": 32768,
+				"stores": [
+					{"location": "testdata/blob2.cache", "in-store": 25},
+					{"location": "testdata/blob2.store", "in-store": 124}
+				],
+				"not-in-any-store": 7
+			}`)},
 	} {
 		t.Run(test.name, func(t *testing.T) {
 			exp := make(map[string]interface{})
@@ -125,3 +150,69 @@ func TestInfoCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestInfoCommandPrometheus(t *testing.T) {
+	cmd := newInfoCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob2.cache", "-s", "testdata/blob2.store", "--seed", "testdata/blob2.caibx", "--format", "prometheus", "testdata/blob1.caibx"})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE desync_index_chunks gauge\n",
+		`desync_index_chunks{index="testdata/blob1.caibx"} 161` + "\n",
+		`desync_index_unique_chunks{index="testdata/blob1.caibx"} 131` + "\n",
+		`desync_index_size_bytes{index="testdata/blob1.caibx"} 2097152` + "\n",
+		`desync_index_chunks_in_store{index="testdata/blob1.caibx"} 124` + "\n",
+		`desync_index_chunks_in_seed{index="testdata/blob1.caibx"} 124` + "\n",
+		`desync_index_chunks_not_in_any_store{index="testdata/blob1.caibx"} 7` + "\n",
+		`desync_index_chunks_in_each_store{index="testdata/blob1.caibx",store="testdata/blob2.cache"} 25` + "\n",
+		`desync_index_chunks_in_each_store{index="testdata/blob1.caibx",store="testdata/blob2.store"} 124` + "\n",
+	} {
+		require.Contains(t, out, line)
+	}
+
+	// Numbers that weren't requested are left out
+	require.NotContains(t, out, "desync_index_chunks_in_cache")
+	require.NotContains(t, out, "compressed")
+}
+
+func TestInfoCommandStoreErrors(t *testing.T) {
+	status := http.StatusNotFound
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	u.User = url.UserPassword("user", "secret")
+
+	run := func() (infoResults, error) {
+		cmd := newInfoCommand(context.Background())
+		cmd.SetArgs([]string{"-e", "0", "-s", "testdata/blob2.store", "-s", u.String(), "testdata/blob1.caibx"})
+		b := new(bytes.Buffer)
+		stdout = b
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		var results infoResults
+		if err == nil {
+			require.NoError(t, json.Unmarshal(b.Bytes(), &results))
+		}
+		return results, err
+	}
+
+	// Credentials are not shown in the output
+	results, err := run()
+	require.NoError(t, err)
+	require.Len(t, results.Stores, 2)
+	require.NotContains(t, results.Stores[1].Location, "secret")
+	require.Zero(t, results.Stores[1].InStore)
+
+	// Failures to query a store aren't counted as missing chunks
+	status = http.StatusInternalServerError
+	_, err = run()
+	require.Error(t, err)
+}
@@ -22,7 +22,8 @@ func newinspectChunksCommand(ctx context.Context) *cobra.Command {
 		Short: "Inspect chunks from an index and an optional local store",
 		Long: `Prints a detailed JSON with information about chunks stored in an index file.
 By using the '--store' option to provide a local store, the generated JSON will include, if
-available, the chunks compressed size info from that particular store.`,
+available, the chunks compressed size info from that particular store. Use '-'
+to read the index from STDIN.`,
 		Example: `  desync inspect-chunks file.caibx
 desync inspect-chunks --store /mnt/store file.caibx inspect_result.json`,
 		Args: cobra.RangeArgs(1, 2),
@@ -3,12 +3,20 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"math"
 
+	"github.com/folbricht/desync"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 type listOptions struct {
 	cmdStoreOptions
+	offsets bool
+	offset  uint64
+	length  uint64
+	unique  bool
 }
 
 func newListCommand(ctx context.Context) *cobra.Command {
@@ -18,15 +26,26 @@ func newListCommand(ctx context.Context) *cobra.Command {
 		Use:   "list-chunks <index>",
 		Short: "List chunk IDs from an index",
 		Long: `Reads the index file and prints the list of chunk IDs in it. Use '-' to read
-the index from STDIN.`,
-		Example: `  desync list-chunks file.caibx`,
-		Args:    cobra.ExactArgs(1),
+the index from STDIN.
+
+With --offsets, the start and size of each chunk in the blob are printed after
+the ID. --offset and --length restrict the list to the chunks covering the given
+byte range of the blob, which can be used to find the chunks holding a damaged
+area of a device or file. A length of 0 means up to the end. Use --unique to
+print every chunk ID only once.`,
+		Example: `  desync list-chunks file.caibx
+  desync list-chunks --offsets --offset 1048576 --length 4096 file.caibx`,
+		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runList(ctx, opt, args)
 		},
 		SilenceUsage: true,
 	}
 	flags := cmd.Flags()
+	flags.BoolVar(&opt.offsets, "offsets", false, "print start and size of each chunk")
+	flags.Uint64Var(&opt.offset, "offset", 0, "only list chunks covering the range starting at this byte offset")
+	flags.Uint64Var(&opt.length, "length", 0, "length of the range in bytes, 0 for up to the end")
+	flags.BoolVar(&opt.unique, "unique", false, "print every chunk ID only once")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
@@ -36,14 +55,48 @@ func runList(ctx context.Context, opt listOptions, args []string) error {
 		return err
 	}
 
-	// Read the input
-	c, err := readCaibxFile(args[0], opt.cmdStoreOptions)
+	// Read the chunks one at a time, the index could be too large to hold it in
+	// memory
+	ir, closeIndex, err := openCaibxFile(args[0], opt.cmdStoreOptions)
 	if err != nil {
 		return err
 	}
+	defer closeIndex()
+	seen := make(map[desync.ChunkID]struct{})
+
+	// Only list chunks covering the requested range
+	start := opt.offset
+	end := start + opt.length
+	if opt.length == 0 || end < start {
+		end = math.MaxUint64
+	}
+
 	// Write the list of chunk IDs to STDOUT
-	for _, chunk := range c.Chunks {
-		fmt.Fprintln(stdout, chunk.ID)
+	for {
+		chunk, err := ir.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, args[0])
+		}
+		if chunk.Start >= end {
+			return nil
+		}
+		if chunk.Start+chunk.Size <= start {
+			continue
+		}
+		if opt.unique {
+			if _, ok := seen[chunk.ID]; ok {
+				continue
+			}
+			seen[chunk.ID] = struct{}{}
+		}
+		if opt.offsets {
+			fmt.Fprintf(stdout, "%s %d %d\n", chunk.ID.String(), chunk.Start, chunk.Size)
+		} else {
+			fmt.Fprintln(stdout, chunk.ID.String())
+		}
 		// See if we're meant to stop
 		select {
 		case <-ctx.Done():
@@ -51,5 +104,4 @@ func runList(ctx context.Context, opt listOptions, args []string) error {
 		default:
 		}
 	}
-	return nil
 }
@@ -4,7 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/folbricht/desync"
@@ -31,3 +35,51 @@ func TestListCommand(t *testing.T) {
 	}
 	require.NoError(t, scanner.Err())
 }
+
+func TestListCommandRange(t *testing.T) {
+	f, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := desync.IndexFromReader(f)
+	require.NoError(t, err)
+	require.True(t, len(idx.Chunks) > 2)
+
+	// Ask for a range that spans the end of the 2nd chunk and the start of the 3rd
+	c1, c2 := idx.Chunks[1], idx.Chunks[2]
+	cmd := newListCommand(context.Background())
+	cmd.SetArgs([]string{
+		"--offsets",
+		"--offset", strconv.FormatUint(c1.Start+c1.Size-1, 10),
+		"--length", "2",
+		"testdata/blob1.caibx",
+	})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	expected := fmt.Sprintf("%s %d %d\n%s %d %d\n", c1.ID.String(), c1.Start, c1.Size, c2.ID.String(), c2.Start, c2.Size)
+	require.Equal(t, expected, b.String())
+}
+
+func TestListCommandUnique(t *testing.T) {
+	f, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := desync.IndexFromReader(f)
+	require.NoError(t, err)
+	unique := make(map[desync.ChunkID]struct{})
+	for _, c := range idx.Chunks {
+		unique[c.ID] = struct{}{}
+	}
+
+	cmd := newListCommand(context.Background())
+	cmd.SetArgs([]string{"--unique", "testdata/blob1.caibx"})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	require.Len(t, strings.Fields(b.String()), len(unique))
+}
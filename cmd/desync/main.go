@@ -38,7 +38,7 @@ func main() {
 	signal.Notify(sighup, syscall.SIGHUP)
 
 	// Read config early
-	cobra.OnInitialize(initConfig, setDigestAlgorithm, setVerbose)
+	cobra.OnInitialize(initConfig, setDigestAlgorithm, setBandwidthLimits, setVerbose)
 
 	// Register the sub-commands under root
 	rootCmd := newRootCommand()
@@ -46,10 +46,13 @@ func main() {
 		newConfigCommand(ctx),
 		newCatCommand(ctx),
 		newCacheCommand(ctx),
+		newCacheGCCommand(ctx),
 		newMakeCommand(ctx),
 		newExtractCommand(ctx),
+		newPatchCommand(ctx),
 		newChopCommand(ctx),
 		newChunkCommand(ctx),
+		newChunkBitmapCommand(ctx),
 		newInfoCommand(ctx),
 		newinspectChunksCommand(ctx),
 		newListCommand(ctx),
@@ -58,11 +61,23 @@ func main() {
 		newPullCommand(ctx),
 		newIndexServerCommand(ctx),
 		newChunkServerCommand(ctx),
+		newAgentCommand(ctx),
 		newTarCommand(ctx),
 		newUntarCommand(ctx),
+		newMakeTreeCommand(ctx),
+		newDiffTreeCommand(ctx),
+		newExtractTreeCommand(ctx),
 		newVerifyCommand(ctx),
 		newVerifyIndexCommand(ctx),
 		newMtreeCommand(ctx),
+		newMirrorCommand(ctx),
+		newConvertStoreCommand(ctx),
+		newConvertIndexCommand(ctx),
+		newBenchCommand(ctx),
+		newDoctorCommand(ctx),
+		newDigestMapCommand(ctx),
+		newBundleCommand(ctx),
+		newApplyBundleCommand(ctx),
 		newManpageCommand(ctx, rootCmd),
 	)
 
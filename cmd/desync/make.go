@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 
@@ -16,6 +17,8 @@ type makeOptions struct {
 	store      string
 	chunkSize  string
 	printStats bool
+	stamp      bool
+	labels     []string
 }
 
 func newMakeCommand(ctx context.Context) *cobra.Command {
@@ -27,9 +30,24 @@ func newMakeCommand(ctx context.Context) *cobra.Command {
 		Long: `Creates chunks from the input file and builds an index. If a chunk store is
 provided with -s, such as a local directory or S3 store, it splits the input
 file according to the index and stores the chunks. Use '-' to write the index
-to STDOUT.`,
-		Example: `  desync make -s /path/to/local file.caibx largefile.bin`,
-		Args:    cobra.ExactArgs(2),
+to STDOUT.
+
+Use '-' as input file to read the data from STDIN. Since the input can't be read
+more than once in this case, it is split into large windows that are chunked in
+parallel and the chunks are stored while chunking.
+
+With --stamp, the input file is marked with an extended attribute holding a
+digest of the index once it's been written. If the input still carries a stamp
+matching the existing index and hasn't been modified since, the index is kept
+as is without reading the input again. If a store is given, the chunks of the
+index need to be present in it as well.
+
+Metadata can be added to the index with --label key=value, for example the name
+or version of the input. It's shown by 'info'.`,
+		Example: `  desync make -s /path/to/local file.caibx largefile.bin
+  cat largefile.bin | desync make -s /path/to/local file.caibx -
+  desync make --label name=rootfs --label version=1.2 rootfs.caibx rootfs.img`,
+		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runMake(ctx, opt, args)
 		},
@@ -38,8 +56,11 @@ to STDOUT.`,
 	flags := cmd.Flags()
 	flags.StringVarP(&opt.store, "store", "s", "", "target store")
 	flags.StringVarP(&opt.chunkSize, "chunk-size", "m", "16:64:256", "min:avg:max chunk size in kb")
-	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "show chunking statistics")
+	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "show chunking statistics, including per-worker throughput")
+	flags.BoolVar(&opt.stamp, "stamp", false, "mark the input with the index digest, and skip chunking if it's marked already")
+	flags.StringArrayVar(&opt.labels, "label", nil, "add key=value metadata to the index, can be repeated")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addRequireChunksOption(&opt.cmdStoreOptions, flags)
 	return cmd
 }
 
@@ -52,6 +73,10 @@ func runMake(ctx context.Context, opt makeOptions, args []string) error {
 	if err != nil {
 		return err
 	}
+	labels, err := parseLabels(opt.labels)
+	if err != nil {
+		return err
+	}
 
 	indexFile := args[0]
 	dataFile := args[1]
@@ -66,24 +91,86 @@ func runMake(ctx context.Context, opt makeOptions, args []string) error {
 		defer s.Close()
 	}
 
-	// Split up the file and create and index from it
-	pb := desync.NewProgressBar("Chunking ")
-	index, stats, err := desync.IndexFromFile(ctx, dataFile, opt.n, min, avg, max, pb)
+	// Nothing to do if the input was stamped with the existing index
+	if opt.stamp && dataFile != "-" && indexFile != "-" && inputMatchesIndex(dataFile, indexFile, min, avg, max, labels, s, opt.cmdStoreOptions) {
+		desync.Log.WithField("file", dataFile).Info("input matches the index, skipping")
+		return nil
+	}
+
+	// Split up the file and create and index from it. If the data is coming from
+	// STDIN, chunks are stored while the data is being split.
+	var (
+		index desync.Index
+		stats desync.ChunkingStats
+	)
+	pb := desync.NewBytesProgressBar("Chunking ")
+	if dataFile == "-" {
+		index, stats, err = desync.IndexFromStream(ctx, os.Stdin, s, opt.n, min, avg, max, pb)
+	} else {
+		index, stats, err = desync.IndexFromFile(ctx, dataFile, opt.n, min, avg, max, pb)
+	}
 	if err != nil {
 		return err
 	}
 
 	// Chop up the file into chunks and store them in the target store if a store was given
-	if s != nil {
+	if s != nil && dataFile != "-" {
 		pb := desync.NewProgressBar("Storing ")
 		if err := desync.ChopFile(ctx, dataFile, index.Chunks, s, opt.n, pb); err != nil {
 			return err
 		}
 	}
+	index.Metadata = labels
+	if err := storeCaibxFile(ctx, index, indexFile, opt.cmdStoreOptions); err != nil {
+		return err
+	}
+	if opt.stamp && dataFile != "-" {
+		digest, err := desync.IndexDigest(index)
+		if err != nil {
+			return err
+		}
+		if err := desync.StampFile(dataFile, digest); err != nil {
+			desync.Log.WithError(err).WithField("file", dataFile).Warning("failed to stamp input")
+		}
+	}
 	if opt.printStats {
 		return printJSON(stderr, stats) // write to stderr since stdout could be used for index data
 	}
-	return storeCaibxFile(index, indexFile, opt.cmdStoreOptions)
+	return nil
+}
+
+// Returns true if the input file was stamped with the digest of an existing
+// index that was made with the same chunk sizes and labels, and the chunks of
+// the index are in the store if there is one.
+func inputMatchesIndex(dataFile, indexFile string, min, avg, max uint64, labels map[string]string, s desync.Store, cmdOpt cmdStoreOptions) bool {
+	idx, err := readCaibxFile(indexFile, cmdOpt)
+	if err != nil {
+		return false
+	}
+	if idx.Index.ChunkSizeMin != min || idx.Index.ChunkSizeAvg != avg || idx.Index.ChunkSizeMax != max {
+		return false
+	}
+	if len(idx.Metadata) != len(labels) {
+		return false
+	}
+	for k, v := range labels {
+		if value, ok := idx.Metadata[k]; !ok || value != v {
+			return false
+		}
+	}
+	digest, err := desync.IndexDigest(idx)
+	if err != nil || !desync.FileStampMatches(dataFile, digest) {
+		return false
+	}
+	if s == nil {
+		return true
+	}
+	for _, c := range idx.Chunks {
+		if hasChunk, err := s.HasChunk(c.ID); err != nil || !hasChunk {
+			return false
+		}
+	}
+	return true
 }
 
 func parseChunkSizeParam(s string) (min, avg, max uint64, err error) {
@@ -108,3 +195,20 @@ func parseChunkSizeParam(s string) (min, avg, max uint64, err error) {
 	max = uint64(num) * 1024
 	return
 }
+
+// Parses a list of key=value labels into index metadata. Returns nil if there
+// are no labels.
+func parseLabels(labels []string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, l := range labels {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label '%s', expected key=value", l)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
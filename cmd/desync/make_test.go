@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeCommandStamp(t *testing.T) {
+	dir := t.TempDir()
+	b, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	input := filepath.Join(dir, "blob1")
+	require.NoError(t, ioutil.WriteFile(input, b, 0644))
+	index := filepath.Join(dir, "blob1.caibx")
+	store := filepath.Join(dir, "store")
+	require.NoError(t, os.Mkdir(store, 0755))
+
+	run := func() {
+		cmd := newMakeCommand(context.Background())
+		cmd.SetArgs([]string{"--stamp", "-s", store, index, input})
+		stderr = ioutil.Discard
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		require.NoError(t, err)
+	}
+	run()
+
+	// Running it again with the same input doesn't write the index
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(index, old, old))
+	run()
+	info, err := os.Stat(index)
+	require.NoError(t, err)
+	if !info.ModTime().Equal(old) {
+		t.Skip("extended attributes not supported")
+	}
+
+	// Unless chunks are missing from the store
+	require.NoError(t, os.RemoveAll(store))
+	require.NoError(t, os.Mkdir(store, 0755))
+	run()
+	info, err = os.Stat(index)
+	require.NoError(t, err)
+	require.NotEqual(t, old, info.ModTime())
+}
+
+func TestMakeCommandLabels(t *testing.T) {
+	index := filepath.Join(t.TempDir(), "blob1.caibx")
+
+	cmd := newMakeCommand(context.Background())
+	cmd.SetArgs([]string{"--label", "name=blob1", "--label", "version=1.0=rc1", index, "testdata/blob1"})
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// The labels are shown by info
+	cmd = newInfoCommand(context.Background())
+	cmd.SetArgs([]string{index})
+	b := new(bytes.Buffer)
+	stdout = b
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	var results struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &results))
+	require.Equal(t, map[string]string{"name": "blob1", "version": "1.0=rc1"}, results.Metadata)
+
+	// Labels need a key
+	cmd = newMakeCommand(context.Background())
+	cmd.SetArgs([]string{"--label", "=value", index, "testdata/blob1"})
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+}
+
+func TestMakeCommandRequireChunks(t *testing.T) {
+	dir := t.TempDir()
+	index := filepath.Join(dir, "blob1.caibx")
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, os.Mkdir(empty, 0755))
+
+	run := func(args ...string) error {
+		cmd := newMakeCommand(context.Background())
+		cmd.SetArgs(append(args, index, "testdata/blob1"))
+		stderr = ioutil.Discard
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		return err
+	}
+
+	// The chunks aren't in the store, the index is not written
+	require.Error(t, run("--require-chunks", empty))
+	require.NoFileExists(t, index)
+
+	// Writing the chunks to the store first makes them available
+	store := filepath.Join(dir, "store")
+	require.NoError(t, os.Mkdir(store, 0755))
+	require.NoError(t, run("-s", store, "--require-chunks", store))
+	require.FileExists(t, index)
+}
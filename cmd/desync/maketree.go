@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type makeTreeOptions struct {
+	cmdStoreOptions
+	desync.LocalFSOptions
+	store     string
+	chunkSize string
+}
+
+func newMakeTreeCommand(ctx context.Context) *cobra.Command {
+	var opt makeTreeOptions
+
+	cmd := &cobra.Command{
+		Use:   "make-tree <tree-index> <source>",
+		Short: "Chunk a directory tree file by file into a tree index",
+		Long: `Chunks every file in a directory tree on its own and stores the chunks, writing
+a tree index that lists the entries of the tree with their metadata and chunks.
+Use '-' to write the index to STDOUT.
+
+Unlike 'tar -i', which chunks the tree as a single catar stream, a change to one
+file only affects the chunks of that file and doesn't shift the chunk boundaries
+of the rest of the archive. This makes updates of trees with many small files
+much smaller. Files are chunked by -n goroutines. Tree indexes can be compared
+with diff-tree and extracted with extract-tree.`,
+		Example: `  desync make-tree -s /path/to/store docs.tree $HOME/Documents`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMakeTree(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&opt.store, "store", "s", "", "target store")
+	flags.StringVarP(&opt.chunkSize, "chunk-size", "m", "16:64:256", "min:avg:max chunk size in kb")
+	flags.BoolVar(&opt.NoTime, "no-time", false, "set file timestamps to zero in the index")
+	if runtime.GOOS != "windows" {
+		flags.BoolVarP(&opt.OneFileSystem, "one-file-system", "x", false, "don't cross filesystem boundaries")
+	}
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runMakeTree(ctx context.Context, opt makeTreeOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if opt.store == "" {
+		return errors.New("no store provided")
+	}
+	min, avg, max, err := parseChunkSizeParam(opt.chunkSize)
+	if err != nil {
+		return err
+	}
+	output := args[0]
+	source := args[1]
+
+	s, err := WritableStore(opt.store, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	idx, err := desync.MakeTreeIndex(ctx, desync.NewLocalFS(source, opt.LocalFSOptions), s, desync.TreeIndexOptions{
+		ChunkSizeMin: min,
+		ChunkSizeAvg: avg,
+		ChunkSizeMax: max,
+		N:            opt.n,
+	})
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = idx.WriteTo(w)
+	return err
+}
+
+// Reads a tree index from a file, or STDIN with '-'.
+func readTreeIndex(name string) (desync.TreeIndex, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return desync.TreeIndex{}, err
+		}
+		defer f.Close()
+	}
+	return desync.ReadTreeIndex(f)
+}
@@ -0,0 +1,69 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeCommands(t *testing.T) {
+	dir := t.TempDir()
+	store := filepath.Join(dir, "store")
+	require.NoError(t, os.Mkdir(store, 0755))
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a"), []byte("file a"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("file b"), 0644))
+
+	makeTree := func(out string) {
+		cmd := newMakeTreeCommand(context.Background())
+		cmd.SetArgs([]string{"-s", store, out, src})
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		require.NoError(t, err)
+	}
+	old := filepath.Join(dir, "old.tree")
+	makeTree(old)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("file b, changed"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "c"), []byte("file c"), 0644))
+	updated := filepath.Join(dir, "new.tree")
+	makeTree(updated)
+
+	// Compare the two
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd := newDiffTreeCommand(context.Background())
+	cmd.SetArgs([]string{old, updated})
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "+ c\n")
+	require.Contains(t, b.String(), "M sub/b\n")
+	require.NotContains(t, b.String(), " a\n")
+	require.Contains(t, b.String(), "Chunks added: 2 (21 bytes)\n")
+
+	// Extract the new tree
+	out := filepath.Join(dir, "out")
+	cmd = newExtractTreeCommand(context.Background())
+	cmd.SetArgs([]string{"-s", store, "--no-same-owner", updated, out})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	for name, content := range map[string]string{
+		"a":     "file a",
+		"sub/b": "file b, changed",
+		"c":     "file c",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(out, name))
+		require.NoError(t, err)
+		require.Equal(t, content, string(b))
+	}
+}
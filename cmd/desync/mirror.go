@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type mirrorOptions struct {
+	cmdStoreOptions
+	include     []string
+	exclude     []string
+	incremental bool
+	printStats  bool
+}
+
+func newMirrorCommand(ctx context.Context) *cobra.Command {
+	var opt mirrorOptions
+
+	cmd := &cobra.Command{
+		Use:   "mirror <source-store> <target-store>",
+		Short: "Copy all chunks from one store to another",
+		Long: `Copies all chunks from the source store into the target store. Unlike the cache
+command, this is not driven by index files, but by the list of chunks present in
+the source. The source needs to support listing chunks, which local, S3, GCS and
+SFTP stores do.
+
+The data of every chunk is validated against its ID while being copied. Use
+--include and --exclude to limit the chunks that are copied to those with IDs
+matching (or not matching) the given prefixes. With -i, chunks that are already
+present in the target store are skipped which allows running the command
+repeatedly to keep the target up-to-date.`,
+		Example: `  desync mirror s3+https://s3.eu-west-1.amazonaws.com/store s3+https://s3.us-east-1.amazonaws.com/store
+  desync mirror -i --include 00,01 /path/to/store sftp://host/path/to/store`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMirror(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVar(&opt.include, "include", nil, "only copy chunks with IDs starting with these prefixes")
+	flags.StringSliceVar(&opt.exclude, "exclude", nil, "skip chunks with IDs starting with these prefixes")
+	flags.BoolVarP(&opt.incremental, "incremental", "i", false, "skip chunks already present in the target store")
+	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "print statistics")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runMirror(ctx context.Context, opt mirrorOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+
+	// Open the source store, it needs to support listing chunks
+	sr, err := storeFromLocation(args[0], opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+	src, err := chunkLister(sr, args[0])
+	if err != nil {
+		return err
+	}
+
+	dst, err := WritableStore(args[1], opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// If this is a terminal, we want a progress bar
+	pb := desync.NewProgressBar("")
+
+	mirrorOpt := desync.MirrorOptions{
+		N:           opt.n,
+		Include:     opt.include,
+		Exclude:     opt.exclude,
+		Incremental: opt.incremental,
+	}
+	stats, err := desync.Mirror(ctx, src, dst, mirrorOpt, pb)
+	if err != nil {
+		return err
+	}
+	if opt.printStats {
+		return printJSON(stdout, stats)
+	}
+	return nil
+}
+
+// Returns the store as ChunkLister, looking past the dedup queue local stores
+// are wrapped in.
+func chunkLister(s desync.Store, location string) (desync.ChunkLister, error) {
+	if l, ok := s.(desync.ChunkLister); ok {
+		return l, nil
+	}
+	if q, ok := s.(*desync.WriteDedupQueue); ok {
+		if l, ok := q.S.(desync.ChunkLister); ok {
+			return l, nil
+		}
+		return nil, fmt.Errorf("store '%s' does not support listing chunks", q.S)
+	}
+	return nil, fmt.Errorf("store '%s' does not support listing chunks", location)
+}
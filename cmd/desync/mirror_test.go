@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorCommand(t *testing.T) {
+	target := t.TempDir()
+
+	// Copy everything except chunks starting with "0"
+	cmd := newMirrorCommand(context.Background())
+	cmd.SetArgs([]string{"--exclude", "0", "--print-stats", "testdata/blob1.store", target})
+	b := new(bytes.Buffer)
+	stdout = b
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	var stats desync.MirrorStats
+	require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+	require.NotZero(t, stats.ChunksCopied)
+	require.NotZero(t, stats.ChunksExcluded)
+	require.Equal(t, stats.ChunksListed, stats.ChunksCopied+stats.ChunksExcluded)
+
+	// Run it again incrementally, with all chunks included. Only the previously
+	// excluded ones should be copied.
+	cmd = newMirrorCommand(context.Background())
+	cmd.SetArgs([]string{"-i", "--print-stats", "testdata/blob1.store", target})
+	b = new(bytes.Buffer)
+	stdout = b
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	var stats2 desync.MirrorStats
+	require.NoError(t, json.Unmarshal(b.Bytes(), &stats2))
+	require.Equal(t, stats.ChunksCopied, stats2.ChunksSkipped)
+	require.Equal(t, stats.ChunksExcluded, stats2.ChunksCopied)
+}
@@ -10,18 +10,24 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/folbricht/desync"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 type mountIndexOptions struct {
 	cmdStoreOptions
-	stores    []string
-	cache     string
-	storeFile string
-	corFile   string
+	stores        []string
+	cache         string
+	storeFile     string
+	corFile       string
+	dryRun        bool
+	seeds         []string
+	seedDirs      []string
+	statsInterval time.Duration
 	desync.SparseFileOptions
 }
 
@@ -39,14 +45,26 @@ the index from STDIN.
 When a Copy-on-Read file is given (with --cor-file), the file is used as a fast cache.
 All chunks that are accessed by the mount are retrieved from the store and written into
 the file as read operations are performed. Once all chunks have been accessed, the COR
-file is fully populated. On termination, a <name>.state file is written containing
+file is fully populated, unless its size is limited with --cor-max-size. In that case
+the least recently read chunks are removed from the file when it grows larger, which
+requires a filesystem supporting hole punching (Linux only). On termination, a
+<name>.state file is written containing
 information about which chunks of the index have or have not been read. A state file is
 only valid for a one cache-file and one index. When re-using it with a different index,
 data corruption can occur.
 
+With --cor-stats-interval, statistics about the reads from the COR file, such as
+the number of chunks served from it or fetched from the store and the distribution
+of read latencies, are logged periodically. They're also logged on termination.
+
 This command supports the --store-file option which can be used to define the stores
 and caches in a JSON file. The config can then be reloaded by sending a SIGHUP without
-needing to restart the server. This can be done under load as well.
+needing to restart the server. This can be done under load as well. The new stores
+are probed before they're used, if that fails, the current ones remain in use. Use
+--dry-run to check a configuration without mounting the index.
+
+Seeds given with --seed or --seed-dir are used to read chunks from local files
+before they're requested from the store.
 `,
 		Example: `  desync mount-index -s http://192.168.1.1/ file.caibx /mnt/blob
   desync mount-index -s /path/to/store -x /var/tmp/blob.cor blob.caibx /mnt/blob
@@ -61,10 +79,15 @@ needing to restart the server. This can be done under load as well.
 	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s)")
 	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
 	flags.StringVar(&opt.storeFile, "store-file", "", "read store arguments from a file, supports reload on SIGHUP")
+	flags.BoolVar(&opt.dryRun, "dry-run", false, "validate the store configuration and exit")
 	flags.StringVarP(&opt.corFile, "cor-file", "", "", "use a copy-on-read sparse file as cache")
+	flags.StringSliceVar(&opt.seeds, "seed", nil, "seed indexes")
+	flags.StringSliceVar(&opt.seedDirs, "seed-dir", nil, "directory with seed index files")
 	flags.StringVarP(&opt.StateSaveFile, "cor-state-save", "", "", "file to store the state for copy-on-read")
 	flags.StringVarP(&opt.StateInitFile, "cor-state-init", "", "", "copy-on-read state init file")
 	flags.IntVarP(&opt.StateInitConcurrency, "cor-init-n", "", 10, "number of gorooutines to use for initialization (with --cor-state-init)")
+	flags.Int64Var(&opt.MaxSize, "cor-max-size", 0, "maximum bytes of chunk data kept in the copy-on-read file, 0 for unlimited")
+	flags.DurationVar(&opt.statsInterval, "cor-stats-interval", 0, "log copy-on-read statistics at this interval, 0 to disable")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
@@ -73,16 +96,23 @@ func runMountIndex(ctx context.Context, opt mountIndexOptions, args []string) er
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if opt.statsInterval != 0 && opt.corFile == "" {
+		return errors.New("--cor-stats-interval requires --cor-file")
+	}
 
 	indexFile := args[0]
 	mountPoint := args[1]
 	mountFName := strings.TrimSuffix(filepath.Base(indexFile), filepath.Ext(indexFile))
 
 	// Parse the store locations, open the stores and add a cache if requested
-	s, err := mountIndexStore(opt)
+	s, cfg, err := mountIndexStore(opt)
 	if err != nil {
 		return err
 	}
+	if opt.dryRun {
+		defer s.Close()
+		return desync.ProbeStore(s, false)
+	}
 
 	// When a store file is used, it's possible to reload the store setup from it
 	// on the fly. Wrap the store into a SwapStore and start a handler for SIGHUP,
@@ -90,22 +120,15 @@ func runMountIndex(ctx context.Context, opt mountIndexOptions, args []string) er
 	if opt.storeFile != "" {
 		s = desync.NewSwapStore(s)
 
-		go func() {
-			for range sighup {
-				newStore, err := mountIndexStore(opt)
-				if err != nil {
-					fmt.Fprintln(stderr, "failed to reload configuration:", err)
-					continue
-				}
-				if store, ok := s.(*desync.SwapStore); ok {
-					if err := store.Swap(newStore); err != nil {
-						fmt.Fprintln(stderr, "failed to reload configuration:", err)
-					}
-				}
-			}
-		}()
+		go reloadStoresOnSIGHUP(s, cfg, func() (desync.Store, storeFile, error) {
+			return mountIndexStore(opt)
+		}, nil)
 	}
 
+	// Read chunks from seeds if possible
+	if s, err = withSeedStore(s, opt.seeds, opt.seedDirs, indexFile, opt.cmdStoreOptions); err != nil {
+		return err
+	}
 	defer s.Close()
 
 	// Read the index
@@ -133,6 +156,23 @@ func runMountIndex(ctx context.Context, opt mountIndexOptions, args []string) er
 			}
 		}()
 
+		// Log the statistics periodically and when the mount ends
+		if opt.statsInterval > 0 {
+			go func() {
+				ticker := time.NewTicker(opt.statsInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						logSparseFileStats(fs.Stats())
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			defer func() { logSparseFileStats(fs.Stats()) }()
+		}
+
 		ifs = fs
 	} else {
 		ifs = desync.NewIndexMountFS(idx, mountFName, s)
@@ -142,28 +182,37 @@ func runMountIndex(ctx context.Context, opt mountIndexOptions, args []string) er
 	return desync.MountIndex(ctx, idx, ifs, mountPoint, s, opt.n)
 }
 
-// Reads the store-related command line options and returns the appropriate store.
-func mountIndexStore(opt mountIndexOptions) (desync.Store, error) {
-	stores := opt.stores
-	cache := opt.cache
-
-	var err error
-	if opt.storeFile != "" {
-		if len(stores) != 0 {
-			return nil, errors.New("--store and --store-file can't be used together")
-		}
-		if cache != "" {
-			return nil, errors.New("--cache and --store-file can't be used together")
-		}
-		stores, cache, err = readStoreFile(opt.storeFile)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to read store-file '%s'", err)
-		}
+// Reads the store-related command line options and returns the appropriate store
+// as well as the configuration it was built from.
+func mountIndexStore(opt mountIndexOptions) (desync.Store, storeFile, error) {
+	c, err := storeConfig(opt.stores, opt.cache, opt.storeFile)
+	if err != nil {
+		return nil, c, err
 	}
+	opt.storeFileOptions = c.options()
 
 	// Got to have at least one upstream store
-	if len(stores) == 0 {
-		return nil, errors.New("no store provided")
+	if len(c.Stores) == 0 {
+		return nil, c, errors.New("no store provided")
+	}
+	s, err := multiStoreWithCaches(opt.cmdStoreOptions, c.cacheLocations(), c.locations()...)
+	return s, c, err
+}
+
+// Logs the statistics of a copy-on-read file in one line.
+func logSparseFileStats(stats desync.SparseFileStats) {
+	fields := logrus.Fields{
+		"reads":             stats.Reads,
+		"bytes-read":        stats.BytesRead,
+		"chunks-from-cache": stats.ChunksFromCache,
+		"chunks-from-store": stats.ChunksFromStore,
+		"bytes-from-cache":  stats.BytesFromCache,
+		"bytes-from-store":  stats.BytesFromStore,
+		"fetch-errors":      stats.FetchErrors,
+		"chunks-evicted":    stats.ChunksEvicted,
+	}
+	for _, b := range stats.ReadLatency {
+		fields["read-latency-le-"+b.Le] = b.Count
 	}
-	return MultiStoreWithCache(opt.cmdStoreOptions, cache, stores...)
+	desync.Log.WithFields(fields).Info("copy-on-read statistics")
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 
@@ -15,6 +16,7 @@ type mtreeOptions struct {
 	stores    []string
 	cache     string
 	readIndex bool
+	verify    string
 }
 
 func newMtreeCommand(ctx context.Context) *cobra.Command {
@@ -27,11 +29,18 @@ func newMtreeCommand(ctx context.Context) *cobra.Command {
 the content in mtree format.
 
 The input is either a catar archive, a caidx index file (with -i and -s), or
-a local directory.
+a local directory. Use '-' to read the archive or index from STDIN.
+
+With --verify <dir>, the content of the archive or index is compared to the
+given directory instead of being printed. Every difference, like missing or
+additional files, different permissions, ownership, xattrs or file content is
+printed in a line. The command fails if any differences were found. Timestamps
+are not compared.
 `,
 		Example: `  desync mtree docs.catar
   desync mtree -s http://192.168.1.1/ -c /path/to/local -i docs.caidx
-  desync mtree /path/to/dir`,
+  desync mtree /path/to/dir
+  desync mtree -s /path/to/store -i --verify /srv/app app.caidx`,
 		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runMtree(ctx, opt, args)
@@ -42,6 +51,7 @@ a local directory.
 	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s), used with -i")
 	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
 	flags.BoolVarP(&opt.readIndex, "index", "i", false, "read index file (caidx), not catar")
+	flags.StringVar(&opt.verify, "verify", "", "compare the input to this directory and print differences")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
@@ -55,47 +65,79 @@ func runMtree(ctx context.Context, opt mtreeOptions, args []string) error {
 	}
 
 	input := args[0]
+
+	// Compare the input to a directory rather than printing it
+	if opt.verify != "" {
+		verifyFS, err := desync.NewMtreeVerifyFS(opt.verify, stdout)
+		if err != nil {
+			return err
+		}
+		if err := writeMtree(ctx, opt, input, verifyFS); err != nil {
+			return err
+		}
+		if n := verifyFS.Finish(); n > 0 {
+			return fmt.Errorf("found %d differences", n)
+		}
+		return nil
+	}
+
 	mtreeFS, err := desync.NewMtreeFS(os.Stdout)
 	if err != nil {
 		return err
 	}
+	return writeMtree(ctx, opt, input, mtreeFS)
+}
 
-	stat, err := os.Stat(input)
-	if err != nil {
-		return err
+// Reads the input, which can be a directory, catar or index, and writes its
+// content into a filesystem writer.
+func writeMtree(ctx context.Context, opt mtreeOptions, input string, mtreeFS desync.FilesystemWriter) error {
+	// STDIN can't be a directory
+	isDir := false
+	if input != "-" {
+		stat, err := os.Stat(input)
+		if err != nil {
+			return err
+		}
+		isDir = stat.IsDir()
 	}
 
-	if opt.readIndex && stat.IsDir() {
+	if opt.readIndex && isDir {
 		return errors.New("-i can't be used with input directory")
 	}
 
 	// Input is a directory, not an archive. So Tar it into an Untar stream
 	// which then writes into an mtree writer.
-	if stat.IsDir() {
+	if isDir {
 		r, w := io.Pipe()
 		inFS := desync.NewLocalFS(input, desync.LocalFSOptions{})
 
 		// Run the tar bit in a goroutine, writing to the pipe
-		var tarErr error
+		tarErr := make(chan error, 1)
 		go func() {
-			tarErr = desync.Tar(ctx, w, inFS)
-			w.Close()
+			err := desync.Tar(ctx, w, inFS)
+			w.CloseWithError(err)
+			tarErr <- err
 		}()
 		untarErr := desync.UnTar(ctx, r, mtreeFS)
 
-		if tarErr != nil {
-			return tarErr
+		// Unblock the tar goroutine if untar stopped early
+		r.CloseWithError(untarErr)
+		if err := <-tarErr; err != nil {
+			return err
 		}
 		return untarErr
 	}
 
 	// If we got a catar file unpack that and exit
 	if !opt.readIndex {
-		f, err := os.Open(input)
-		if err != nil {
-			return err
+		f := os.Stdin
+		if input != "-" {
+			var err error
+			if f, err = os.Open(input); err != nil {
+				return err
+			}
+			defer f.Close()
 		}
-		defer f.Close()
 		var r io.Reader = f
 		return desync.UnTar(ctx, r, mtreeFS)
 	}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/folbricht/desync"
@@ -18,9 +24,17 @@ type cmdStoreOptions struct {
 	skipVerify             bool
 	trustInsecure          bool
 	cacheRepair            bool
+	cacheUpdateTimes       bool
+	cacheQuarantine        string
 	errorRetry             int
 	errorRetryBaseInterval time.Duration
+	indexCache             string
+	compressionLevel       int
+	requireChunks          []string
 	pflag.FlagSet
+
+	// Options for individual stores, read from a store-file
+	storeFileOptions map[string]desync.StoreOptions
 }
 
 // MergedWith takes store options as read from the config, and applies command-line
@@ -49,17 +63,40 @@ func (o cmdStoreOptions) MergedWith(opt desync.StoreOptions) desync.StoreOptions
 	if o.FlagSet.Lookup("error-retry-base-interval").Changed {
 		opt.ErrorRetryBaseInterval = o.errorRetryBaseInterval
 	}
+	if o.FlagSet.Lookup("cache-quarantine").Changed {
+		opt.Quarantine = o.cacheQuarantine
+	}
+	if o.FlagSet.Lookup("compression-level").Changed {
+		opt.CompressionLevel = o.compressionLevel
+	}
 	return opt
 }
 
+// Returns the directory used to cache remote indexes, or an empty string if
+// index caching is disabled.
+func (o cmdStoreOptions) indexCacheDir() string {
+	if o.indexCache != "" {
+		return o.indexCache
+	}
+	return os.Getenv("DESYNC_INDEX_CACHE")
+}
+
 // Validate the command line options are sensical and return an error if they aren't.
 func (o cmdStoreOptions) validate() error {
 	if (o.clientKey == "") != (o.clientCert == "") {
 		return errors.New("--client-key and --client-cert options need to be provided together")
 	}
+	if !validCompressionLevel(o.compressionLevel) {
+		return errors.New("--compression-level needs to be between 1 and 22, or 0 for the default")
+	}
 	return nil
 }
 
+// Returns true if level is a zstd compression level, 0 selects the default.
+func validCompressionLevel(level int) bool {
+	return level >= 0 && level <= 22
+}
+
 // Add common store option flags to a command flagset.
 func addStoreOptions(o *cmdStoreOptions, f *pflag.FlagSet) {
 	f.IntVarP(&o.n, "concurrency", "n", 10, "number of concurrent goroutines")
@@ -68,28 +105,110 @@ func addStoreOptions(o *cmdStoreOptions, f *pflag.FlagSet) {
 	f.StringVar(&o.caCert, "ca-cert", "", "trust authorities in this file, instead of OS trust store")
 	f.BoolVarP(&o.trustInsecure, "trust-insecure", "t", false, "trust invalid certificates")
 	f.BoolVarP(&o.cacheRepair, "cache-repair", "r", true, "replace invalid chunks in the cache from source")
+	f.BoolVar(&o.cacheUpdateTimes, "cache-update-times", false, "mark chunks read from local caches as used, for cache-gc --max-age")
+	f.StringVar(&o.cacheQuarantine, "cache-quarantine", "", "move invalid chunks found in the cache into this directory before replacing them")
 	f.IntVarP(&o.errorRetry, "error-retry", "e", desync.DefaultErrorRetry, "number of times to retry in case of network error")
 	f.DurationVarP(&o.errorRetryBaseInterval, "error-retry-base-interval", "b", desync.DefaultErrorRetryBaseInterval, "initial retry delay, increases linearly with each subsequent attempt")
+	f.IntVar(&o.compressionLevel, "compression-level", 0, "zstd compression level of chunks written to stores, 1 (fastest) to 22 (best), 0 for the default")
+	f.StringVar(&o.indexCache, "index-cache", "", "cache indexes read from remote stores in this directory, can also be set with DESYNC_INDEX_CACHE")
 
 	o.FlagSet = *f
 }
 
+// addRequireChunksOption adds --require-chunks to commands that write indexes.
+func addRequireChunksOption(o *cmdStoreOptions, f *pflag.FlagSet) {
+	f.StringSliceVar(&o.requireChunks, "require-chunks", nil, "only write indexes if all their chunks are in these store(s)")
+}
+
 // cmdServerOptions hold command line options used in HTTP servers.
 type cmdServerOptions struct {
-	cert      string
-	key       string
-	mutualTLS bool
-	clientCA  string
-	auth      string
+	cert         string
+	key          string
+	mutualTLS    bool
+	clientCA     string
+	auth         string
+	readyProbe   string
+	readyTimeout time.Duration
+
+	// Limits protecting the server from slow or misbehaving clients
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	maxBodySize       int64
+
+	// Also serve HTTP/3 (QUIC) on the UDP ports of the listen addresses. Only
+	// available in chunk-server.
+	http3 bool
 }
 
 func (o cmdServerOptions) validate() error {
 	if (o.key == "") != (o.cert == "") {
 		return errors.New("--key and --cert options need to be provided together")
 	}
+	if o.http3 && o.key == "" {
+		return errors.New("--http3 requires --key and --cert")
+	}
+	switch o.readyProbe {
+	case "read", "write", "none":
+	default:
+		return fmt.Errorf("invalid --ready-probe '%s', expected read, write or none", o.readyProbe)
+	}
+	if o.maxHeaderBytes < 0 || o.maxBodySize < 0 {
+		return errors.New("--max-header-bytes and --max-body-size can't be negative")
+	}
 	return nil
 }
 
+// Returns the handler of a server, with the body size limit applied. Requests
+// go to the default mux if h is nil.
+func serverHandler(h http.Handler, opt cmdServerOptions) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	return withBodyLimit(h, opt)
+}
+
+// Default for --max-body-size, 256 times the default maximum chunk size of
+// 256kB. Leaves room for chunks made with larger chunk sizes and indexes of
+// blobs of around 100GB.
+const defaultMaxBodySize = 256 * 256 * 1024
+
+// Returns a handler that rejects request bodies larger than --max-body-size
+// with 413, and passes all other requests to h.
+func withBodyLimit(h http.Handler, opt cmdServerOptions) http.Handler {
+	if opt.maxBodySize == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > opt.maxBodySize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, opt.maxBodySize)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Returns a handler that answers liveness and readiness checks on /healthz and
+// /readyz, and passes all other requests to h. Readiness is determined by the
+// check function, unless disabled with --ready-probe none.
+func withHealth(h http.Handler, opt cmdServerOptions, check func() error) http.Handler {
+	health := desync.HealthHandler{Timeout: opt.readyTimeout}
+	if opt.readyProbe != "none" {
+		health.Ready = check
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz":
+			health.ServeHTTP(w, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
 // Add common HTTP server options to a command flagset.
 func addServerOptions(o *cmdServerOptions, f *pflag.FlagSet) {
 	f.StringVar(&o.cert, "cert", "", "cert file in PEM format, requires --key")
@@ -97,4 +216,134 @@ func addServerOptions(o *cmdServerOptions, f *pflag.FlagSet) {
 	f.BoolVar(&o.mutualTLS, "mutual-tls", false, "require valid client certficate")
 	f.StringVar(&o.clientCA, "client-ca", "", "acceptable client certificate or CA")
 	f.StringVar(&o.auth, "authorization", "", "expected value of the authorization header in requests")
+	f.StringVar(&o.readyProbe, "ready-probe", "read", "how /readyz checks the upstream store, read, write or none")
+	f.DurationVar(&o.readyTimeout, "ready-timeout", 5*time.Second, "maximum time a readiness check can take")
+	f.DurationVar(&o.readHeaderTimeout, "read-header-timeout", 30*time.Second, "maximum time to read the headers of a request, 0 for unlimited")
+	f.DurationVar(&o.readTimeout, "read-timeout", 0, "maximum time to read a request including its body, 0 for unlimited")
+	f.DurationVar(&o.writeTimeout, "write-timeout", 0, "maximum time to write a response, 0 for unlimited")
+	f.DurationVar(&o.idleTimeout, "idle-timeout", 2*time.Minute, "time idle keep-alive connections are kept open, 0 for unlimited")
+	f.IntVar(&o.maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of request headers in bytes")
+	f.Int64Var(&o.maxBodySize, "max-body-size", defaultMaxBodySize, "maximum size of request bodies in bytes, 0 for unlimited")
+}
+
+// cmdAdminOptions hold command line options for the admin endpoints of servers.
+type cmdAdminOptions struct {
+	adminAuth   string
+	adminListen string
+}
+
+func (o cmdAdminOptions) validate(listenAddresses []string) error {
+	if o.adminListen == "" {
+		return nil
+	}
+	if o.adminAuth == "" {
+		return errors.New("--admin-listen requires --admin-authorization")
+	}
+	for _, a := range listenAddresses {
+		if a == o.adminListen {
+			return errors.New("--admin-listen needs to be different from the listen addresses")
+		}
+	}
+	return nil
+}
+
+// Add admin endpoint options to a command flagset.
+func addAdminOptions(o *cmdAdminOptions, f *pflag.FlagSet) {
+	f.StringVar(&o.adminAuth, "admin-authorization", "", "expected value of the authorization header for the /admin endpoints, which are disabled if not set")
+	f.StringVar(&o.adminListen, "admin-listen", "", "serve the /admin endpoints on this address instead of the listen addresses")
+}
+
+// cmdEventOptions hold command line options for reporting events, like chunks or
+// indexes written to a server, to webhooks or a log.
+type cmdEventOptions struct {
+	webhooks       []string
+	webhookSecret  string
+	webhookRetries int
+	eventLog       string
+	eventTypes     []string
+}
+
+func (o cmdEventOptions) validate() error {
+	for _, t := range o.eventTypes {
+		switch t {
+		case desync.EventChunkStored, desync.EventIndexStored, desync.EventPruneFinished:
+		default:
+			return fmt.Errorf("invalid event type '%s'", t)
+		}
+	}
+	return nil
+}
+
+// Returns a function that passes events to the configured webhooks and log, as
+// well as a function to call once no more events are sent. Both are nil if
+// events aren't reported.
+func (o cmdEventOptions) notifier() (func(desync.Event), func(), error) {
+	if len(o.webhooks) == 0 && o.eventLog == "" {
+		return nil, nil, nil
+	}
+	var (
+		notifiers []func(desync.Event)
+		closers   []func()
+	)
+	if len(o.webhooks) > 0 {
+		secret := o.webhookSecret
+		if secret == "" {
+			secret = os.Getenv("DESYNC_WEBHOOK_SECRET")
+		}
+		n := desync.NewWebhookNotifier(o.webhooks, desync.WebhookOptions{
+			Secret:  secret,
+			Types:   o.eventTypes,
+			Retries: o.webhookRetries,
+		})
+		notifiers = append(notifiers, n.Notify)
+		closers = append(closers, func() { n.Close() })
+	}
+	if o.eventLog != "" {
+		var w io.Writer = stderr
+		if o.eventLog != "-" {
+			f, err := os.OpenFile(o.eventLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, nil, err
+			}
+			w = f
+			closers = append(closers, func() { f.Close() })
+		}
+		types := make(map[string]bool)
+		for _, t := range o.eventTypes {
+			types[t] = true
+		}
+		var mu sync.Mutex
+		enc := json.NewEncoder(w)
+		notifiers = append(notifiers, func(e desync.Event) {
+			if len(types) > 0 && !types[e.Type] {
+				return
+			}
+			if e.Time.IsZero() {
+				e.Time = time.Now()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			enc.Encode(e)
+		})
+	}
+	notify := func(e desync.Event) {
+		for _, n := range notifiers {
+			n(e)
+		}
+	}
+	closeAll := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+	return notify, closeAll, nil
+}
+
+// Add options for reporting events to a command flagset.
+func addEventOptions(o *cmdEventOptions, f *pflag.FlagSet) {
+	f.StringSliceVar(&o.webhooks, "webhook", nil, "URL to POST events to as JSON, can be repeated")
+	f.StringVar(&o.webhookSecret, "webhook-secret", "", "sign webhook requests with this secret (HMAC-SHA256)")
+	f.IntVar(&o.webhookRetries, "webhook-retries", 2, "number of times to retry failed webhook requests")
+	f.StringVar(&o.eventLog, "event-log", "", "append events as JSON lines to this file, or - for STDERR")
+	f.StringSliceVar(&o.eventTypes, "event", nil, "only report these types of events, chunk-stored, index-stored or prune-finished")
 }
@@ -1,11 +1,16 @@
 package main
 
 import (
-	"github.com/spf13/cobra"
-	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
 )
 
 const defaultErrorRetry = 3
@@ -168,3 +173,64 @@ func TestStringOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestCompressionLevelOption(t *testing.T) {
+	f, err := os.CreateTemp("", "desync-options")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte(`{"store-options": {"/store/*/":{"compression-level": 19}}}`))
+	require.NoError(t, err)
+	cfgFile = f.Name()
+	initConfig()
+
+	for _, test := range []struct {
+		args  []string
+		level int
+	}{
+		{nil, 19},
+		{[]string{"--compression-level", "1"}, 1},
+	} {
+		var cmdOpt cmdStoreOptions
+		cmd := newTestOptionsCommand(&cmdOpt)
+		cmd.SetArgs(test.args)
+		_, err = cmd.ExecuteC()
+		require.NoError(t, err)
+		require.NoError(t, cmdOpt.validate())
+
+		configOptions, err := cfg.GetStoreOptionsFor("/store/20230901")
+		require.NoError(t, err)
+		require.Equal(t, test.level, cmdOpt.MergedWith(configOptions).CompressionLevel)
+	}
+
+	var cmdOpt cmdStoreOptions
+	cmd := newTestOptionsCommand(&cmdOpt)
+	cmd.SetArgs([]string{"--compression-level", "23"})
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	require.Error(t, cmdOpt.validate())
+}
+
+func TestServerBodyLimit(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	})
+	ts := httptest.NewServer(serverHandler(h, cmdServerOptions{maxBodySize: 10}))
+	defer ts.Close()
+
+	put := func(body io.Reader) int {
+		req, err := http.NewRequest("PUT", ts.URL, body)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, put(strings.NewReader("0123456789")))
+	require.Equal(t, http.StatusRequestEntityTooLarge, put(strings.NewReader("0123456789a")))
+
+	// Bodies without a length are cut off while reading them
+	body := io.MultiReader(strings.NewReader("0123456789"), strings.NewReader("a"))
+	require.Equal(t, http.StatusRequestEntityTooLarge, put(body))
+}
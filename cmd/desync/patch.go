@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type patchOptions struct {
+	cmdStoreOptions
+	stores     []string
+	cache      string
+	old        string
+	fsync      bool
+	printStats bool
+}
+
+func newPatchCommand(ctx context.Context) *cobra.Command {
+	var opt patchOptions
+
+	cmd := &cobra.Command{
+		Use:   "patch <index> <file>",
+		Short: "Rewrite a blob in place to match a new index",
+		Long: `Rewrites an existing blob, like a partition, in place to match an index. Unlike
+extract -k, chunks that are already in the blob but at a different offset are
+moved there from their old position, so the old content serves as seed without
+a second copy of it. Only chunks that aren't in the blob are read from the
+store(s). This allows updating devices that don't have A/B partitions.
+
+The old index of the blob is given with --old. Without it, the blob is chunked
+first, using the chunk sizes of the new index.
+
+Chunks are written in an order that makes sure data in the blob is only
+overwritten once every chunk that needs it was read. If chunks depend on each
+other in a cycle, for example when two of them swap places, one is held in
+memory to break it. Every chunk read from the blob is verified, chunks that
+don't match are read from the store instead. The store can be omitted if all
+chunks are expected to be in the blob already.
+
+The blob is not consistent while the command is running. If it's interrupted,
+run extract -k with the new index and a store to complete it.`,
+		Example: `  desync patch -s http://192.168.1.1/store --old v1.caibx v2.caibx /dev/sda2`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runPatch(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s)")
+	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
+	flags.StringVar(&opt.old, "old", "", "index of the current content of the blob, the blob is chunked if not given")
+	flags.BoolVar(&opt.fsync, "fsync", false, "flush the blob to disk before returning")
+	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "print statistics")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runPatch(ctx context.Context, opt patchOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if err := readsStdinOnce(args[0], opt.old); err != nil {
+		return err
+	}
+	indexFile := args[0]
+	dataFile := args[1]
+	if dataFile == "-" {
+		return errors.New("can't patch STDOUT")
+	}
+
+	idx, err := readCaibxFile(indexFile, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+
+	// Read the index of the current content, or chunk it to make one
+	var old desync.Index
+	if opt.old != "" {
+		if old, err = readCaibxFile(opt.old, opt.cmdStoreOptions); err != nil {
+			return err
+		}
+	} else {
+		min, avg, max := idx.Index.ChunkSizeMin, idx.Index.ChunkSizeAvg, idx.Index.ChunkSizeMax
+		pb := desync.NewProgressBar("Chunking ")
+		if old, _, err = desync.IndexFromFile(ctx, dataFile, opt.n, min, avg, max, pb); err != nil {
+			return err
+		}
+	}
+
+	var s desync.Store
+	if len(opt.stores) > 0 {
+		s, err = MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+	}
+
+	stats, err := desync.PatchFile(ctx, dataFile, old, idx, s, desync.PatchOptions{
+		N:     opt.n,
+		Fsync: opt.fsync,
+	}, desync.NewProgressBar("Patching "))
+	if err != nil {
+		return err
+	}
+	if opt.printStats {
+		return printJSON(stdout, stats)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchCommand(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	old, err := ioutil.ReadFile("testdata/blob2")
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name string
+		args []string
+	}{
+		{"patch with old index", []string{"-s", "testdata/blob1.store", "--old", "testdata/blob2.caibx"}},
+		{"patch without old index", []string{"-s", "testdata/blob1.store"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+			require.NoError(t, ioutil.WriteFile(out, old, 0644))
+
+			cmd := newPatchCommand(context.Background())
+			cmd.SetArgs(append(test.args, "--print-stats", "testdata/blob1.caibx", out))
+			b := new(bytes.Buffer)
+			stdout = b
+			cmd.SetOutput(ioutil.Discard)
+			_, err := cmd.ExecuteC()
+			require.NoError(t, err)
+
+			var stats desync.PatchStats
+			require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+			require.NotZero(t, stats.ChunksInPlace+stats.ChunksMoved)
+
+			data, err := ioutil.ReadFile(out)
+			require.NoError(t, err)
+			require.Equal(t, expected, data)
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync/atomic"
 
 	"github.com/folbricht/desync"
 	"github.com/spf13/cobra"
@@ -12,8 +13,10 @@ import (
 
 type pruneOptions struct {
 	cmdStoreOptions
-	store string
-	yes   bool
+	cmdEventOptions
+	store  string
+	yes    bool
+	dryRun bool
 }
 
 func newPruneCommand(ctx context.Context) *cobra.Command {
@@ -24,9 +27,17 @@ func newPruneCommand(ctx context.Context) *cobra.Command {
 		Short: "Remove unreferenced chunks from a store",
 		Long: `Read chunk IDs in from index files and delete any chunks from a store
 that are not referenced in the provided index files. Use '-' to read a single index
-from STDIN.`,
-		Example: `  desync prune -s /path/to/local --yes file.caibx`,
-		Args:    cobra.MinimumNArgs(1),
+from STDIN. Use --dry-run to list the chunks that would be deleted, along with
+their size in the store, without deleting anything. With the trash-prefix store
+option in the config, chunks in S3 and GCS stores are moved to the trash prefix
+instead of being deleted.
+
+With --webhook, an event with the number of removed chunks is sent to the given
+URLs in a JSON POST request once pruning is finished, or appended to a file with
+--event-log.`,
+		Example: `  desync prune -s /path/to/local --yes file.caibx
+  desync prune -s s3+https://s3.eu-west-1.amazonaws.com/store --dry-run file.caibx`,
+		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runPrune(ctx, opt, args)
 		},
@@ -35,7 +46,9 @@ from STDIN.`,
 	flags := cmd.Flags()
 	flags.StringVarP(&opt.store, "store", "s", "", "target store")
 	flags.BoolVarP(&opt.yes, "yes", "y", false, "do not ask for confirmation")
+	flags.BoolVar(&opt.dryRun, "dry-run", false, "list the chunks that would be deleted without deleting them")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addEventOptions(&opt.cmdEventOptions, flags)
 	return cmd
 }
 
@@ -43,9 +56,15 @@ func runPrune(ctx context.Context, opt pruneOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if err := readsStdinOnce(args...); err != nil {
+		return err
+	}
 	if opt.store == "" {
 		return errors.New("no store provided")
 	}
+	if err := opt.cmdEventOptions.validate(); err != nil {
+		return err
+	}
 
 	// Open the target store
 	sr, err := storeFromLocation(opt.store, opt.cmdStoreOptions)
@@ -54,7 +73,9 @@ func runPrune(ctx context.Context, opt pruneOptions, args []string) error {
 	}
 	defer sr.Close()
 
-	// Make sure this store can be used for pruning
+	// Make sure this store can be used for pruning. Stores apply the rate limit
+	// themselves when pruning, so the limiters are removed as well.
+	sr = withoutLimits(sr)
 	s, ok := sr.(desync.PruneStore)
 	if !ok {
 		if q, ok := sr.(*desync.WriteDedupQueue); ok {
@@ -78,6 +99,25 @@ func runPrune(ctx context.Context, opt pruneOptions, args []string) error {
 		}
 	}
 
+	// Only list what would be deleted
+	if opt.dryRun {
+		ds, ok := s.(desync.PruneDryRunStore)
+		if !ok {
+			return fmt.Errorf("store '%s' does not support --dry-run", s)
+		}
+		candidates, err := ds.PruneDryRun(ctx, ids)
+		if err != nil {
+			return err
+		}
+		var size int64
+		for _, c := range candidates {
+			fmt.Fprintf(stdout, "%s %d\n", c.ID.String(), c.Size)
+			size += c.Size
+		}
+		fmt.Fprintf(stderr, "%d chunks (%d bytes) would be deleted from '%s'\n", len(candidates), size, s)
+		return nil
+	}
+
 	// If the -y option wasn't provided, ask the user to confirm before doing anything
 	if !opt.yes {
 		fmt.Printf("Warning: The provided index files reference %d unique chunks. Are you sure\nyou want to delete all other chunks from '%s'?\n", len(ids), s)
@@ -95,5 +135,44 @@ func runPrune(ctx context.Context, opt pruneOptions, args []string) error {
 		}
 	}
 
-	return s.Prune(ctx, ids)
+	notify, closeEvents, err := opt.cmdEventOptions.notifier()
+	if err != nil {
+		return err
+	}
+	if closeEvents != nil {
+		defer closeEvents()
+	}
+
+	// If this is a terminal, we want a progress bar. It's also used to count the
+	// removed chunks.
+	pb := &countingProgressBar{ProgressBar: desync.NewProgressBar("")}
+
+	if ps, ok := s.(desync.PruneProgressStore); ok {
+		err = ps.PruneWithProgress(ctx, ids, pb)
+	} else {
+		err = s.Prune(ctx, ids)
+	}
+	if notify != nil {
+		e := desync.Event{
+			Type:    desync.EventPruneFinished,
+			Store:   s.String(),
+			Removed: atomic.LoadInt64(&pb.n),
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		notify(e)
+	}
+	return err
+}
+
+// Progress bar that counts the number of increments.
+type countingProgressBar struct {
+	desync.ProgressBar
+	n int64
+}
+
+func (p *countingProgressBar) Increment() int64 {
+	atomic.AddInt64(&p.n, 1)
+	return p.ProgressBar.Increment()
 }
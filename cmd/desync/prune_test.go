@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/folbricht/desync"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,3 +32,64 @@ func TestPruneCommand(t *testing.T) {
 	_, err = pruneCmd.ExecuteC()
 	require.NoError(t, err)
 }
+
+func TestPruneCommandDryRun(t *testing.T) {
+	store := t.TempDir()
+
+	chopCmd := newChopCommand(context.Background())
+	chopCmd.SetArgs([]string{"-s", store, "testdata/blob1.caibx", "testdata/blob1"})
+	_, err := chopCmd.ExecuteC()
+	require.NoError(t, err)
+	before, err := filepath.Glob(filepath.Join(store, "*", "*.cacnk"))
+	require.NoError(t, err)
+
+	// List the chunks that would be removed, nothing should be deleted
+	pruneCmd := newPruneCommand(context.Background())
+	pruneCmd.SetArgs([]string{"-s", store, "testdata/blob2.caibx", "--dry-run"})
+	b := new(bytes.Buffer)
+	stdout = b
+	stderr = ioutil.Discard
+	_, err = pruneCmd.ExecuteC()
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.NotEmpty(t, lines)
+	files, err := filepath.Glob(filepath.Join(store, "*", "*.cacnk"))
+	require.NoError(t, err)
+	require.Len(t, files, len(before))
+
+	// Prune for real, the same chunks should be gone
+	pruneCmd = newPruneCommand(context.Background())
+	pruneCmd.SetArgs([]string{"-s", store, "testdata/blob2.caibx", "--yes"})
+	_, err = pruneCmd.ExecuteC()
+	require.NoError(t, err)
+	files, err = filepath.Glob(filepath.Join(store, "*", "*.cacnk"))
+	require.NoError(t, err)
+	require.Len(t, files, len(before)-len(lines))
+	for _, line := range lines {
+		id := strings.Fields(line)[0]
+		require.NoFileExists(t, filepath.Join(store, id[:4], id+".cacnk"))
+	}
+}
+
+func TestPruneCommandEventLog(t *testing.T) {
+	store := t.TempDir()
+	eventLog := filepath.Join(t.TempDir(), "events.log")
+
+	chopCmd := newChopCommand(context.Background())
+	chopCmd.SetArgs([]string{"-s", store, "testdata/blob1.caibx", "testdata/blob1"})
+	_, err := chopCmd.ExecuteC()
+	require.NoError(t, err)
+
+	pruneCmd := newPruneCommand(context.Background())
+	pruneCmd.SetArgs([]string{"-s", store, "--yes", "--event-log", eventLog, "testdata/blob2.caibx"})
+	_, err = pruneCmd.ExecuteC()
+	require.NoError(t, err)
+
+	b, err := ioutil.ReadFile(eventLog)
+	require.NoError(t, err)
+	var e desync.Event
+	require.NoError(t, json.Unmarshal(b, &e))
+	require.Equal(t, desync.EventPruneFinished, e.Type)
+	require.Greater(t, e.Removed, int64(0))
+	require.Empty(t, e.Error)
+}
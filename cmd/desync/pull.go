@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
 
 	"github.com/folbricht/desync"
@@ -14,13 +15,18 @@ func newPullCommand(ctx context.Context) *cobra.Command {
 	var opt pullOptions
 
 	cmd := &cobra.Command{
-		Use:   "pull - - - <store>",
+		Use:   "pull - - - <store> [<index>...]",
 		Short: "Serve chunks via casync protocol over SSH",
 		Long: `Serves up chunks (read-only) from a local store using the casync protocol
 via Stdin/Stdout. Functions as a drop-in replacement for casync on remote
-stores accessed with SSH. See CASYNC_REMOTE_PATH environment variable.`,
-		Example: `  desync pull - - - /path/to/store`,
-		Args:    cobra.ExactArgs(4),
+stores accessed with SSH. See CASYNC_REMOTE_PATH environment variable.
+
+Any index files given after the store are sent to clients requesting them
+at the start of the session, in the given order. Chunks can be pulled in the
+same session afterwards, which avoids a new SSH connection for every index.`,
+		Example: `  desync pull - - - /path/to/store
+  desync pull - - - /path/to/store /path/to/a.caibx /path/to/b.caibx`,
+		Args: cobra.MinimumNArgs(4),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runPull(ctx, opt, args)
 		},
@@ -48,6 +54,16 @@ func runPull(ctx context.Context, opt pullOptions, args []string) error {
 		return err
 	}
 
+	// Read the indexes to be sent to the client
+	var indexes [][]byte
+	for _, name := range args[4:] {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, b)
+	}
+
 	// Start the server
-	return desync.NewProtocolServer(os.Stdin, os.Stdout, s).Serve(ctx)
+	return desync.NewProtocolServerWithIndexes(os.Stdin, os.Stdout, s, indexes).Serve(ctx)
 }
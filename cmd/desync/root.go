@@ -11,6 +11,9 @@ func newRootCommand() *cobra.Command {
 	}
 	cmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default $HOME/.config/desync/config.json)")
 	cmd.PersistentFlags().StringVar(&digestAlgorithm, "digest", "sha512-256", "digest algorithm, sha512-256 or sha256")
+	cmd.PersistentFlags().BoolVar(&indexChecksum, "index-checksum", false, "append a checksum to written indexes to detect damage")
+	cmd.PersistentFlags().Int64Var(&downloadLimit, "download-limit", 0, "maximum bytes per second read from all remote stores together, 0 for unlimited")
+	cmd.PersistentFlags().Int64Var(&uploadLimit, "upload-limit", 0, "maximum bytes per second written to all remote stores together, 0 for unlimited")
 	cmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "verbose mode")
 	return cmd
 }
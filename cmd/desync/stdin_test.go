@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexFromStdin(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "blob1")
+	stderr = ioutil.Discard
+
+	for _, test := range []struct {
+		name string
+		cmd  func(context.Context) *cobra.Command
+		args []string
+	}{
+		{"list-chunks", newListCommand, []string{"-"}},
+		{"info", newInfoCommand, []string{"-s", "testdata/blob1.store", "-"}},
+		{"inspect-chunks", newinspectChunksCommand, []string{"-"}},
+		{"chunk-bitmap", newChunkBitmapCommand, []string{"-s", "testdata/blob1.store", "-"}},
+		{"extract", newExtractCommand, []string{"-s", "testdata/blob1.store", "-", out}},
+		{"verify-index", newVerifyIndexCommand, []string{"-", "testdata/blob1"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			withStdin(t, "testdata/blob1.caibx")
+			cmd := test.cmd(context.Background())
+			cmd.SetArgs(test.args)
+			stdout = new(bytes.Buffer)
+			cmd.SetOutput(ioutil.Discard)
+			_, err := cmd.ExecuteC()
+			require.NoError(t, err)
+		})
+	}
+
+	// Archives can be read from STDIN as well
+	withStdin(t, "testdata/tree.catar")
+	cmd := newUntarCommand(context.Background())
+	cmd.SetArgs([]string{"--no-same-owner", "-", t.TempDir()})
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// STDIN can't be used for more than one index
+	withStdin(t, "testdata/blob1.caibx")
+	cmd = newExtractCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob1.store", "--seed", "-", "-", out})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+}
+
+// Replaces STDIN with a file for the duration of a test.
+func withStdin(t *testing.T, name string) {
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	stdin := os.Stdin
+	os.Stdin = f
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		f.Close()
+	})
+}
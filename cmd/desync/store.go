@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/folbricht/desync"
 	minio "github.com/minio/minio-go/v6"
@@ -20,27 +26,40 @@ import (
 // cacheLocation - Place of the local store used for caching, can be blank
 // storeLocation - URLs or paths to remote or local stores that should be queried in order
 func MultiStoreWithCache(cmdOpt cmdStoreOptions, cacheLocation string, storeLocations ...string) (desync.Store, error) {
+	var caches []string
+	if cacheLocation != "" {
+		caches = []string{cacheLocation}
+	}
+	return multiStoreWithCaches(cmdOpt, caches, storeLocations...)
+}
+
+// multiStoreWithCaches works like MultiStoreWithCache but supports multiple tiers
+// of caches. The first cache is queried first, chunks that are found further down
+// are stored in all caches before it.
+func multiStoreWithCaches(cmdOpt cmdStoreOptions, cacheLocations []string, storeLocations ...string) (desync.Store, error) {
 	// Combine all stores into one router
 	store, err := multiStoreWithRouter(cmdOpt, storeLocations...)
 	if err != nil {
 		return nil, err
 	}
+	return withCaches(cmdOpt, store, cacheLocations)
+}
 
-	// See if we want to use a writable store as cache, if so, attach a cache to
-	// the router
-	if cacheLocation != "" {
-		cache, err := WritableStore(cacheLocation, cmdOpt)
+// Attaches the caches to a store, starting with the last (slowest) one. The
+// modification time of chunks read from local caches is only updated if they're
+// cleaned up by age, since it costs a write for every read.
+func withCaches(cmdOpt cmdStoreOptions, store desync.Store, cacheLocations []string) (desync.Store, error) {
+	for i := len(cacheLocations) - 1; i >= 0; i-- {
+		cache, err := WritableStore(cacheLocations[i], cmdOpt)
 		if err != nil {
 			return store, err
 		}
 
-		if ls, ok := cache.(desync.LocalStore); ok {
+		if ls, ok := cache.(desync.LocalStore); ok && cmdOpt.cacheUpdateTimes {
 			ls.UpdateTimes = true
+			cache = ls
 		}
-		if cmdOpt.cacheRepair {
-			cache = desync.NewRepairableCache(cache)
-		}
-		store = desync.NewCache(store, cache)
+		store = desync.NewCacheWithRepair(store, cache, cmdOpt.cacheRepair)
 	}
 	return store, nil
 }
@@ -64,14 +83,18 @@ func multiStoreWithRouter(cmdOpt cmdStoreOptions, storeLocations ...string) (des
 // each store in the group individually before wrapping them into a FailoverGroup. If there's
 // no "|" in the string, this is a nop.
 func storeGroup(location string, cmdOpt cmdStoreOptions) (desync.Store, error) {
-	if !strings.ContainsAny(location, "|") {
+	resolved, aliasOptions := cfg.resolveAlias(location)
+	if !strings.ContainsAny(resolved, "|") || isShardedLocation(resolved) {
 		return storeFromLocation(location, cmdOpt)
 	}
 	var stores []desync.Store
-	members := strings.Split(location, "|")
+	members := strings.Split(resolved, "|")
 	for _, m := range members {
-		s, err := storeFromLocation(m, cmdOpt)
+		s, err := storeWithAliasOptions(m, aliasOptions, cmdOpt)
 		if err != nil {
+			for _, s := range stores {
+				s.Close()
+			}
 			return nil, err
 		}
 		stores = append(stores, s)
@@ -95,22 +118,89 @@ func WritableStore(location string, cmdOpt cmdStoreOptions) (desync.WriteStore,
 	return store, nil
 }
 
-// Parse a single store URL or path and return an initialized instance of it
+// Matches a shard in a sharded store location, like 00-7f=/path/to/store
+var shardPattern = regexp.MustCompile(`^([0-9a-fA-F]+)-([0-9a-fA-F]+)=(.+)$`)
+
+// Returns true if the location defines shards of a store, separated by ";".
+func isShardedLocation(location string) bool {
+	return shardPattern.MatchString(strings.SplitN(location, ";", 2)[0])
+}
+
+// shardedStore parses a location of the form "00-7f=<location>;80-ff=<location>"
+// and returns a store that distributes chunks across the members by the prefix
+// of their IDs.
+func shardedStore(location string, aliasOptions *desync.StoreOptions, cmdOpt cmdStoreOptions) (desync.Store, error) {
+	var shards []desync.StoreShard
+	for _, m := range strings.Split(location, ";") {
+		match := shardPattern.FindStringSubmatch(m)
+		if match == nil {
+			closeShards(shards)
+			return nil, fmt.Errorf("invalid shard '%s', expected <from>-<to>=<location>", m)
+		}
+		s, err := storeWithAliasOptions(match[3], aliasOptions, cmdOpt)
+		if err != nil {
+			closeShards(shards)
+			return nil, err
+		}
+		shards = append(shards, desync.StoreShard{From: strings.ToLower(match[1]), To: strings.ToLower(match[2]), Store: s})
+	}
+	s, err := desync.NewShardedStore(shards...)
+	if err != nil {
+		closeShards(shards)
+		return nil, errors.Wrapf(err, "store '%s'", location)
+	}
+	return s, nil
+}
+
+func closeShards(shards []desync.StoreShard) {
+	for _, s := range shards {
+		s.Store.Close()
+	}
+}
+
+// Parse a single store URL or path, or the name of an alias in the config, and
+// return an initialized instance of it
 func storeFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Store, error) {
+	return storeWithAliasOptions(location, nil, cmdOpt)
+}
+
+// Like storeFromLocation, but applies the options of the alias a failover or
+// shard member came from, unless the member is an alias with options itself.
+func storeWithAliasOptions(location string, inherited *desync.StoreOptions, cmdOpt cmdStoreOptions) (desync.Store, error) {
+	location, aliasOptions := cfg.resolveAlias(location)
+	if aliasOptions == nil {
+		aliasOptions = inherited
+	}
+	if isShardedLocation(location) {
+		return shardedStore(location, aliasOptions, cmdOpt)
+	}
 	loc, err := url.Parse(location)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to parse store location %s : %s", location, err)
 	}
 
-	// Get any store options from the config if present and overwrite with settings from
-	// the command line
-	configOptions, err := cfg.GetStoreOptionsFor(location)
-	if err != nil {
-		return nil, err
+	// Get any store options from the alias, store-file or config if present and
+	// overwrite with settings from the command line
+	var configOptions desync.StoreOptions
+	if aliasOptions != nil {
+		configOptions = *aliasOptions
+	} else {
+		configOptions, err = cmdOpt.optionsFor(location)
+		if err != nil {
+			return nil, err
+		}
 	}
 	opt := cmdOpt.MergedWith(configOptions)
 
+	if opt.DownloadLimit < 0 || opt.UploadLimit < 0 {
+		return nil, fmt.Errorf("invalid bandwidth limit for store '%s'", location)
+	}
+	if !validCompressionLevel(opt.CompressionLevel) {
+		return nil, fmt.Errorf("invalid compression level for store '%s'", location)
+	}
+
 	var s desync.Store
+	remote := true
 	switch loc.Scheme {
 	case "ssh":
 		s, err = desync.NewRemoteSSHStore(loc, opt)
@@ -123,7 +213,19 @@ func storeFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Store, e
 			return nil, err
 		}
 	case "http", "https":
-		s, err = desync.NewRemoteHTTPStore(loc, opt)
+		if opt.ConsistentHash {
+			s, err = desync.NewConsistentHashHTTPStore(loc, opt)
+		} else {
+			s, err = desync.NewRemoteHTTPStore(loc, opt)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case "unix":
+		// The agent applies the limits to its upstream stores, don't count
+		// the traffic twice
+		remote = false
+		s, err = desync.NewAgentStore(loc.Path, opt)
 		if err != nil {
 			return nil, err
 		}
@@ -150,6 +252,7 @@ func storeFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Store, e
 			return nil, err
 		}
 	default:
+		remote = false
 		local, err := desync.NewLocalStore(location, opt)
 		if err != nil {
 			return nil, err
@@ -164,25 +267,163 @@ func storeFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Store, e
 			s = desync.NewWriteDedupQueue(local)
 		}
 	}
+
+	// Limit the number of requests sent to the store if configured
+	if opt.RateLimit > 0 {
+		if ws, ok := s.(desync.WriteStore); ok {
+			s = desync.NewRateLimitedWriteStore(ws, opt.RateLimit)
+		} else {
+			s = desync.NewRateLimitedStore(s, opt.RateLimit)
+		}
+	}
+
+	// Limit the bandwidth of this store, and of all remote stores together
+	s = withBandwidthLimits(s, newBandwidthLimiter(opt.DownloadLimit), newBandwidthLimiter(opt.UploadLimit))
+	if remote {
+		s = withBandwidthLimits(s, downloadLimiter, uploadLimiter)
+	}
 	return s, nil
 }
 
+// Returns a limiter for the given number of bytes per second, or nil if there's
+// no limit.
+func newBandwidthLimiter(bps int64) *desync.BandwidthLimiter {
+	if bps <= 0 {
+		return nil
+	}
+	return desync.NewBandwidthLimiter(float64(bps))
+}
+
+// Wraps a store to limit the bytes read from and written to it. Either limiter
+// can be nil.
+func withBandwidthLimits(s desync.Store, download, upload *desync.BandwidthLimiter) desync.Store {
+	if download == nil && upload == nil {
+		return s
+	}
+	if ws, ok := s.(desync.WriteStore); ok {
+		return desync.NewBandwidthLimitedWriteStore(ws, download, upload)
+	}
+	return desync.NewBandwidthLimitedStore(s, download)
+}
+
+// Removes the request and bandwidth limiters from a store, for operations that
+// need the underlying store.
+func withoutLimits(s desync.Store) desync.Store {
+	for {
+		switch l := s.(type) {
+		case *desync.RateLimitedWriteStore:
+			s = l.Unwrap()
+		case *desync.RateLimitedStore:
+			s = l.Unwrap()
+		case *desync.BandwidthLimitedWriteStore:
+			s = l.Unwrap()
+		case *desync.BandwidthLimitedStore:
+			s = l.Unwrap()
+		default:
+			return s
+		}
+	}
+}
+
+// Returns the options for a store location. Options given in a store-file take
+// precedence over those in the config file.
+func (o cmdStoreOptions) optionsFor(location string) (desync.StoreOptions, error) {
+	if opt, ok := o.storeFileOptions[strings.TrimSuffix(location, "/")]; ok {
+		return opt, nil
+	}
+	return cfg.GetStoreOptionsFor(location)
+}
+
+// STDIN can only be read once, so only one of the indexes given to a command
+// can be read from it.
+func readsStdinOnce(locations ...string) error {
+	var n int
+	for _, location := range locations {
+		if location == "-" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one index can be read from STDIN")
+	}
+	return nil
+}
+
 func readCaibxFile(location string, cmdOpt cmdStoreOptions) (c desync.Index, err error) {
 	is, indexName, err := indexStoreFromLocation(location, cmdOpt)
 	if err != nil {
 		return c, err
 	}
 	defer is.Close()
+	if dir := cmdOpt.indexCacheDir(); dir != "" {
+		if is, err = desync.NewIndexCache(is, dir); err != nil {
+			return c, err
+		}
+	}
 	idx, err := is.GetIndex(indexName)
-	return idx, errors.Wrap(err, location)
+	if err != nil {
+		return idx, errors.Wrap(err, location)
+	}
+	return idx, errors.Wrap(idx.Validate(), location)
+}
+
+// Opens an index to read its chunks one at a time with the returned reader,
+// for commands that don't need the whole chunk table in memory. The chunk size
+// parameters and digest are validated up front. The index needs to be closed
+// with the returned function when done.
+func openCaibxFile(location string, cmdOpt cmdStoreOptions) (*desync.IndexReader, func() error, error) {
+	is, indexName, err := indexStoreFromLocation(location, cmdOpt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dir := cmdOpt.indexCacheDir(); dir != "" {
+		c, err := desync.NewIndexCache(is, dir)
+		if err != nil {
+			is.Close()
+			return nil, nil, err
+		}
+		is = c
+	}
+	rc, err := is.GetIndexReader(indexName)
+	if err != nil {
+		is.Close()
+		return nil, nil, errors.Wrap(err, location)
+	}
+	closeIndex := func() error {
+		rc.Close()
+		return is.Close()
+	}
+	ir, err := desync.NewIndexReader(rc)
+	if err == nil {
+		idx := desync.Index{Index: ir.Index}
+		err = idx.Validate()
+	}
+	if err != nil {
+		closeIndex()
+		return nil, nil, errors.Wrap(err, location)
+	}
+	return ir, closeIndex, nil
 }
 
-func storeCaibxFile(idx desync.Index, location string, cmdOpt cmdStoreOptions) error {
+func storeCaibxFile(ctx context.Context, idx desync.Index, location string, cmdOpt cmdStoreOptions) error {
 	is, indexName, err := writableIndexStore(location, cmdOpt)
 	if err != nil {
 		return err
 	}
 	defer is.Close()
+	if indexChecksum {
+		idx.Checksum = true
+	}
+
+	// Only write the index if all its chunks can be found in the given stores
+	if len(cmdOpt.requireChunks) > 0 {
+		s, err := multiStoreWithRouter(cmdOpt, cmdOpt.requireChunks...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		return desync.NewChunkCheckIndexStore(is, s, cmdOpt.n).StoreIndexContext(ctx, indexName, idx)
+	}
 	return is.StoreIndex(indexName, idx)
 }
 
@@ -226,7 +467,7 @@ func indexStoreFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Ind
 		base = location[:strings.LastIndex(location, "\\")]
 	}
 
-	configOptions, err := cfg.GetStoreOptionsFor(base)
+	configOptions, err := cmdOpt.optionsFor(base)
 	if err != nil {
 		return nil, "", err
 	}
@@ -270,9 +511,11 @@ func indexStoreFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Ind
 		}
 	default:
 		if location == "-" {
-			s, _ = desync.NewConsoleIndexStore()
+			cs, _ := desync.NewConsoleIndexStore()
+			cs.Digest, _ = desync.DigestByName(opt.Digest)
+			s = cs
 		} else {
-			s, err = desync.NewLocalIndexStore(filepath.Dir(location))
+			s, err = desync.NewLocalIndexStoreWithOptions(filepath.Dir(location), opt)
 			if err != nil {
 				return nil, "", err
 			}
@@ -285,18 +528,379 @@ func indexStoreFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Ind
 // storeFile defines the structure of a file that can be used to pass in the stores
 // not by command line arguments, but a file instead. This allows the configuration
 // to be reloaded for long-running processes on-the-fly without restarting the process.
+// Version 2 of the format allows objects with a location and store options in place
+// of location strings, as well as multiple tiers of caches. Options given this way
+// replace those from the config file for that location:
+//
+//	{
+//	  "version": 2,
+//	  "stores": [{"location": "s3+https://s3.host/bucket", "options": {"rate-limit": 100}}],
+//	  "caches": ["/fast/cache", {"location": "/slow/cache", "options": {"uncompressed": true}}]
+//	}
+//
+// Servers can also serve additional stores under path prefixes, and limit the
+// access of clients to prefixes based on their Authorization header:
+//
+//	{
+//	  "version": 2,
+//	  "stores": ["/srv/shared"],
+//	  "prefixes": {"/a": "/srv/team-a"},
+//	  "scopes": [
+//	    {"prefix": "/a", "authorization": "Bearer team-a", "writable": true},
+//	    {"prefix": "/", "authorization": "Bearer team-a"}
+//	  ]
+//	}
 type storeFile struct {
-	Stores []string `json:"stores"`
-	Cache  string   `json:"cache"`
+	Version  int                       `json:"version,omitempty"`
+	Stores   []storeFileEntry          `json:"stores"`
+	Cache    string                    `json:"cache,omitempty"`
+	Caches   []storeFileEntry          `json:"caches,omitempty"`
+	Prefixes map[string]storeFileEntry `json:"prefixes,omitempty"`
+	Scopes   []desync.AuthScope        `json:"scopes,omitempty"`
+}
+
+// storeFileEntry is a store location in a store-file, with optional options.
+type storeFileEntry struct {
+	Location string               `json:"location"`
+	Options  *desync.StoreOptions `json:"options,omitempty"`
 }
 
-func readStoreFile(name string) ([]string, string, error) {
+// UnmarshalJSON accepts either a plain location string or an object.
+func (e *storeFileEntry) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &e.Location); err == nil {
+		return nil
+	}
+	type alias storeFileEntry
+	return json.Unmarshal(b, (*alias)(e))
+}
+
+// Returns the store configuration given either on the command line, or in a
+// store-file. The two can't be combined.
+func storeConfig(stores []string, cache string, storeFileName string) (storeFile, error) {
+	if storeFileName == "" {
+		c := storeFile{Cache: cache}
+		for _, l := range stores {
+			c.Stores = append(c.Stores, storeFileEntry{Location: l})
+		}
+		return c, nil
+	}
+	if len(stores) != 0 {
+		return storeFile{}, errors.New("--store and --store-file can't be used together")
+	}
+	if cache != "" {
+		return storeFile{}, errors.New("--cache and --store-file can't be used together")
+	}
+	c, err := readStoreFile(storeFileName)
+	if err != nil {
+		return c, errors.Wrapf(err, "failed to read store-file '%s'", storeFileName)
+	}
+	return c, nil
+}
+
+func readStoreFile(name string) (storeFile, error) {
+	var c storeFile
 	f, err := os.Open(name)
 	if err != nil {
-		return nil, "", err
+		return c, err
 	}
 	defer f.Close()
-	c := new(storeFile)
-	err = json.NewDecoder(f).Decode(&c)
-	return c.Stores, c.Cache, err
+	if err = json.NewDecoder(f).Decode(&c); err != nil {
+		return c, err
+	}
+	return c, c.validate()
+}
+
+func (c storeFile) validate() error {
+	if c.Version > 2 {
+		return fmt.Errorf("unsupported store-file version %d", c.Version)
+	}
+	if c.Cache != "" && len(c.Caches) > 0 {
+		return errors.New("cache and caches can't be used together")
+	}
+	if c.Version < 2 {
+		if len(c.Caches) > 0 {
+			return errors.New("caches requires version 2")
+		}
+		if len(c.Prefixes) > 0 || len(c.Scopes) > 0 {
+			return errors.New("prefixes and scopes require version 2")
+		}
+		for _, e := range c.Stores {
+			if e.Options != nil {
+				return errors.New("store options require version 2")
+			}
+		}
+	}
+	for _, e := range append(c.Stores, c.Caches...) {
+		if e.Location == "" {
+			return errors.New("store without location")
+		}
+	}
+	for p, e := range c.Prefixes {
+		if !strings.HasPrefix(p, "/") || strings.Trim(p, "/") == "" {
+			return fmt.Errorf("invalid prefix '%s'", p)
+		}
+		if e.Location == "" {
+			return fmt.Errorf("prefix '%s' without location", p)
+		}
+	}
+	for _, s := range c.Scopes {
+		if !strings.HasPrefix(s.Prefix, "/") {
+			return fmt.Errorf("invalid scope prefix '%s'", s.Prefix)
+		}
+	}
+	return nil
+}
+
+// Returns the prefixes with their own stores, sorted and without trailing "/".
+func (c storeFile) prefixes() []string {
+	var l []string
+	for p := range c.Prefixes {
+		l = append(l, strings.TrimSuffix(p, "/"))
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Returns the store location for a prefix.
+func (c storeFile) prefixLocation(prefix string) string {
+	if e, ok := c.Prefixes[prefix]; ok {
+		return e.Location
+	}
+	return c.Prefixes[prefix+"/"].Location
+}
+
+// Returns true if any of the scopes allows writing to the store under prefix.
+func (c storeFile) prefixWritable(prefix string) bool {
+	for _, s := range c.Scopes {
+		if !s.Writable {
+			continue
+		}
+		p := strings.TrimSuffix(s.Prefix, "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") || strings.HasPrefix(prefix, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the store locations in order.
+func (c storeFile) locations() []string {
+	var l []string
+	for _, e := range c.Stores {
+		l = append(l, e.Location)
+	}
+	return l
+}
+
+// Returns the cache locations, fastest first.
+func (c storeFile) cacheLocations() []string {
+	if c.Cache != "" {
+		return []string{c.Cache}
+	}
+	var l []string
+	for _, e := range c.Caches {
+		l = append(l, e.Location)
+	}
+	return l
+}
+
+// Returns the locations of the members of a failover group or sharded store, or
+// the location itself if it's a single store.
+func storeMembers(location string) []string {
+	if !isShardedLocation(location) {
+		return strings.Split(location, "|")
+	}
+	var l []string
+	for _, m := range strings.Split(location, ";") {
+		if match := shardPattern.FindStringSubmatch(m); match != nil {
+			l = append(l, match[3])
+		}
+	}
+	return l
+}
+
+// Returns the options of all entries that have them, by location. The options of
+// a failover group or sharded store apply to each of its members.
+func (c storeFile) options() map[string]desync.StoreOptions {
+	m := make(map[string]desync.StoreOptions)
+	entries := append(c.Stores, c.Caches...)
+	for _, e := range c.Prefixes {
+		entries = append(entries, e)
+	}
+	for _, e := range entries {
+		if e.Options == nil {
+			continue
+		}
+		for _, l := range storeMembers(e.Location) {
+			m[strings.TrimSuffix(l, "/")] = *e.Options
+		}
+	}
+	return m
+}
+
+// Prints the differences between two store configurations.
+func printStoreFileDiff(w io.Writer, old, new storeFile) {
+	var changed bool
+	oldStores, newStores := old.locations(), new.locations()
+	for _, s := range oldStores {
+		if !containsString(newStores, s) {
+			fmt.Fprintln(w, "removed store:", s)
+			changed = true
+		}
+	}
+	for _, s := range newStores {
+		if !containsString(oldStores, s) {
+			fmt.Fprintln(w, "added store:", s)
+			changed = true
+		}
+	}
+	if !changed && strings.Join(oldStores, ",") != strings.Join(newStores, ",") {
+		fmt.Fprintln(w, "changed store order:", strings.Join(newStores, ", "))
+		changed = true
+	}
+	oldCaches, newCaches := strings.Join(old.cacheLocations(), ", "), strings.Join(new.cacheLocations(), ", ")
+	if oldCaches != newCaches {
+		fmt.Fprintf(w, "changed cache: '%s' -> '%s'\n", oldCaches, newCaches)
+		changed = true
+	}
+	oldOptions, newOptions := old.options(), new.options()
+	for _, l := range append(newStores, new.cacheLocations()...) {
+		for _, m := range storeMembers(l) {
+			m = strings.TrimSuffix(m, "/")
+			o1, ok1 := oldOptions[m]
+			o2, ok2 := newOptions[m]
+			if ok1 != ok2 || !reflect.DeepEqual(o1, o2) {
+				fmt.Fprintln(w, "changed options:", m)
+				changed = true
+			}
+		}
+	}
+	if !reflect.DeepEqual(old.Scopes, new.Scopes) {
+		fmt.Fprintln(w, "changed scopes")
+		changed = true
+	}
+	if !reflect.DeepEqual(old.Prefixes, new.Prefixes) {
+		fmt.Fprintln(w, "changed prefixes, restart the server to apply them")
+		changed = true
+	}
+	if !changed {
+		fmt.Fprintln(w, "store configuration unchanged")
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Reloads the store configuration with load() whenever SIGHUP is received and
+// swaps the new stores into s. The new stores are probed first, and if they
+// don't work the old ones remain in use. If not nil, reloaded is called with
+// the new configuration once it's in use.
+func reloadStoresOnSIGHUP(s desync.Store, cfg storeFile, load func() (desync.Store, storeFile, error), reloaded func(storeFile)) {
+	if r := newStoreReloader(s, cfg, load, reloaded); r != nil {
+		r.onSIGHUP()
+	}
+}
+
+// storeReloader replaces the chunk or index stores of a long-running process
+// with new ones, when the configuration is reloaded or the caches are re-opened.
+type storeReloader struct {
+	cfg storeFile
+	// Opens and probes the stores of the new configuration, and returns a
+	// function that swaps them in
+	open     func() (func() error, storeFile, error)
+	reloaded func(storeFile)
+
+	mu sync.Mutex
+}
+
+// Returns a reloader for s with new stores from load(), or nil if s can't be
+// swapped.
+func newStoreReloader(s desync.Store, cfg storeFile, load func() (desync.Store, storeFile, error), reloaded func(storeFile)) *storeReloader {
+	swapper, ok := s.(interface{ Swap(desync.Store) error })
+	if !ok {
+		return nil
+	}
+	open := func() (func() error, storeFile, error) {
+		newStore, newCfg, err := load()
+		if err != nil {
+			return nil, newCfg, err
+		}
+		if err := desync.ProbeStore(newStore, false); err != nil {
+			newStore.Close()
+			return nil, newCfg, errors.Wrap(err, "keeping the current stores")
+		}
+		return swapStore(newStore, func() error { return swapper.Swap(newStore) }), newCfg, nil
+	}
+	return &storeReloader{cfg: cfg, open: open, reloaded: reloaded}
+}
+
+// Returns a reloader for the index store s with new stores from load().
+func newIndexStoreReloader(s *desync.SwapIndexStore, cfg storeFile, load func() (desync.IndexStore, storeFile, error), reloaded func(storeFile)) *storeReloader {
+	open := func() (func() error, storeFile, error) {
+		newStore, newCfg, err := load()
+		if err != nil {
+			return nil, newCfg, err
+		}
+		if err := desync.CheckIndexStore(newStore); err != nil {
+			newStore.Close()
+			return nil, newCfg, errors.Wrap(err, "keeping the current stores")
+		}
+		return swapStore(newStore, func() error { return s.Swap(newStore) }), newCfg, nil
+	}
+	return &storeReloader{cfg: cfg, open: open, reloaded: reloaded}
+}
+
+// Returns a function that swaps in a new store, and closes it if that fails.
+func swapStore(newStore io.Closer, swap func() error) func() error {
+	return func() error {
+		if err := swap(); err != nil {
+			newStore.Close()
+			return err
+		}
+		return nil
+	}
+}
+
+// Loads and probes new stores and swaps them in. The current stores remain in
+// use if that fails. The probe only reads from the stores, so reloading doesn't
+// leave anything behind in them. Writable servers can only swap in writable
+// stores.
+func (r *storeReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	swap, newCfg, err := r.open()
+	if err != nil {
+		return errors.Wrap(err, "failed to reload configuration")
+	}
+	if err := swap(); err != nil {
+		return errors.Wrap(err, "failed to reload configuration")
+	}
+	if r.reloaded != nil {
+		r.reloaded(newCfg)
+	}
+	printStoreFileDiff(stderr, r.cfg, newCfg)
+	r.cfg = newCfg
+	return nil
+}
+
+// Reloads the stores whenever SIGHUP is received.
+func (r *storeReloader) onSIGHUP() {
+	for range sighup {
+		if err := r.reload(); err != nil {
+			fmt.Fprintln(stderr, err)
+		}
+	}
+}
+
+// Returns the configuration of the stores currently in use.
+func (r *storeReloader) config() storeFile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
 }
@@ -7,6 +7,9 @@ import (
 	"io"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/folbricht/desync"
 	"github.com/spf13/cobra"
@@ -18,7 +21,10 @@ type tarOptions struct {
 	chunkSize   string
 	createIndex bool
 	desync.LocalFSOptions
-	inFormat string
+	inFormat     string
+	reproducible bool
+	printStats   bool
+	labels       []string
 	desync.TarReaderOptions
 }
 
@@ -37,13 +43,23 @@ the -i option can be provided as well as a store. Using -i is equivalent
 to first using the tar command to create a catar, then the make
 command to chunk it into a store and produce an index file. With -i,
 less disk space is required as no intermediary catar is created. There
-can however be a difference in performance depending on file size.
+can however be a difference in performance depending on file size. If a
+store is given and the output file ends in .caidx, -i is implied. With
+--print-stats, the number of chunks produced and written to the store are
+printed when done.
 
 By default, input is read from local disk. Using --input-format=tar,
 the input can be a tar file or stream to STDIN with '-'.
+
+With --reproducible, the same input always produces identical catar
+archives and chunks. All timestamps are set to zero, unless the
+SOURCE_DATE_EPOCH environment variable is set, in which case timestamps
+later than that are clamped to it. Input from tar archives needs to be
+sorted by name within each directory.
 `,
 		Example: `  desync tar documents.catar $HOME/Documents
-  desync tar -i -s /path/to/local pics.caidx $HOME/Pictures`,
+  desync tar -i -s /path/to/local pics.caidx $HOME/Pictures
+  SOURCE_DATE_EPOCH=1700000000 desync tar --reproducible rootfs.catar /build/rootfs`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runTar(ctx, opt, args)
@@ -56,6 +72,9 @@ the input can be a tar file or stream to STDIN with '-'.
 	flags.BoolVarP(&opt.createIndex, "index", "i", false, "create index file (caidx), not catar")
 	flags.StringVar(&opt.inFormat, "input-format", "disk", "input format, 'disk' or 'tar'")
 	flags.BoolVarP(&opt.NoTime, "no-time", "", false, "set file timestamps to zero in the archive")
+	flags.BoolVar(&opt.reproducible, "reproducible", false, "produce deterministic output, normalizing timestamps")
+	flags.BoolVar(&opt.printStats, "print-stats", false, "print chunking and upload statistics (used with -i)")
+	flags.StringArrayVar(&opt.labels, "label", nil, "add key=value metadata to the index (used with -i), can be repeated")
 	flags.BoolVarP(&opt.AddRoot, "tar-add-root", "", false, "pretend that all tar elements have a common root directory")
 
 	if runtime.GOOS != "windows" {
@@ -63,6 +82,7 @@ the input can be a tar file or stream to STDIN with '-'.
 	}
 
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addRequireChunksOption(&opt.cmdStoreOptions, flags)
 	return cmd
 }
 
@@ -70,21 +90,28 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if opt.store != "" && strings.HasSuffix(args[0], ".caidx") {
+		opt.createIndex = true
+	}
 	if opt.createIndex && opt.store == "" {
 		return errors.New("-i requires a store (-s <location>)")
 	}
 	if opt.AddRoot && opt.inFormat != "tar" {
 		return errors.New("--tar-add-root works only with --input-format tar")
 	}
+	if len(opt.labels) > 0 && !opt.createIndex {
+		return errors.New("--label requires -i")
+	}
+	labels, err := parseLabels(opt.labels)
+	if err != nil {
+		return err
+	}
 
 	output := args[0]
 	source := args[1]
 
 	// Prepare input
-	var (
-		fs  desync.FilesystemReader
-		err error
-	)
+	var fs desync.FilesystemReader
 	switch opt.inFormat {
 	case "disk": // Local filesystem
 		local := desync.NewLocalFS(source, opt.LocalFSOptions)
@@ -104,6 +131,17 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 	default:
 		return fmt.Errorf("invalid input format '%s'", opt.inFormat)
 	}
+	if opt.reproducible {
+		var clamp time.Time
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			sec, err := strconv.ParseInt(epoch, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid SOURCE_DATE_EPOCH '%s'", epoch)
+			}
+			clamp = time.Unix(sec, 0)
+		}
+		fs = desync.NewReproducibleReader(fs, clamp)
+	}
 
 	// Just make the catar and stop if that's all that was required
 	if !opt.createIndex {
@@ -151,12 +189,13 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 
 	// Read from the pipe, split the stream and store the chunks. This should
 	// complete when Tar is done and closes the pipe writer
-	index, err := desync.ChunkStream(ctx, c, s, opt.n)
+	index, stats, err := desync.ChunkStreamWithStats(ctx, c, s, opt.n)
 	if err != nil {
 		return err
 	}
 
 	index.Index.FeatureFlags |= desync.TarFeatureFlags
+	index.Metadata = labels
 
 	// See if Tar encountered an error along the way
 	if tarErr != nil {
@@ -164,5 +203,17 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 	}
 
 	// Write the index
-	return storeCaibxFile(index, output, opt.cmdStoreOptions)
+	if err := storeCaibxFile(ctx, index, output, opt.cmdStoreOptions); err != nil {
+		return err
+	}
+
+	if opt.printStats {
+		// Don't mix the stats with the index if that's written to STDOUT
+		w := stdout
+		if output == "-" {
+			w = stderr
+		}
+		return printJSON(w, stats)
+	}
+	return nil
 }
@@ -3,12 +3,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/folbricht/desync"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,3 +42,39 @@ func TestTarCommandIndex(t *testing.T) {
 	_, err = cmd.ExecuteC()
 	require.NoError(t, err)
 }
+
+func TestTarCommandIndexStats(t *testing.T) {
+	out := t.TempDir()
+	index := filepath.Join(out, "tree.caidx")
+
+	run := func() desync.ChunkStreamStats {
+		b := new(bytes.Buffer)
+		stdout = b
+		defer func() { stdout = os.Stdout }()
+
+		// -i is implied by the store and the .caidx extension
+		cmd := newTarCommand(context.Background())
+		cmd.SetArgs([]string{"-s", out, "--print-stats", index, "testdata/tree"})
+		cmd.SetOutput(ioutil.Discard)
+		_, err := cmd.ExecuteC()
+		require.NoError(t, err)
+
+		var stats desync.ChunkStreamStats
+		require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+		return stats
+	}
+
+	// All chunks are written the first time
+	stats := run()
+	require.NotZero(t, stats.ChunksTotal)
+	require.NotZero(t, stats.BytesTotal)
+	require.Equal(t, uint64(stats.ChunksUnique), stats.ChunksStored)
+	require.Zero(t, stats.ChunksInStore)
+	_, err := os.Stat(index)
+	require.NoError(t, err)
+
+	// Nothing needs to be uploaded again the second time
+	stats = run()
+	require.Zero(t, stats.ChunksStored)
+	require.Equal(t, uint64(stats.ChunksUnique), stats.ChunksInStore)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/folbricht/desync"
+	"github.com/folbricht/tempfile"
+)
+
+// Suffix of temporary files used while writing the output of a command.
+const tmpFileSuffix = ".desync-tmp"
+
+// Returns the prefix of tempfiles for the given output file. It contains
+// the PID of the process so files left behind by a crash can be identified.
+func tmpFilePrefix(name string, pid int) string {
+	return fmt.Sprintf(".%s.%d.", filepath.Base(name), pid)
+}
+
+// Creates a new temporary file in dir that will become the output file name.
+func newTmpFile(dir, name string) (*os.File, error) {
+	return tempfile.NewSuffixAndMode(dir, tmpFilePrefix(name, os.Getpid()), tmpFileSuffix, 0644)
+}
+
+// Removes tempfiles for the output file name in dir that were left behind by
+// processes which are no longer running. Failures are logged and ignored.
+func removeOrphanedTmpFiles(dir, name string) {
+	prefix := "." + filepath.Base(name) + "."
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		n := e.Name()
+		if !e.Mode().IsRegular() || !strings.HasPrefix(n, prefix) || !strings.HasSuffix(n, tmpFileSuffix) {
+			continue
+		}
+		// Extract the PID of the process that created it
+		fields := strings.SplitN(strings.TrimPrefix(n, prefix), ".", 2)
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil || processRunning(pid) {
+			continue
+		}
+		p := filepath.Join(dir, n)
+		if err := os.Remove(p); err != nil {
+			desync.Log.WithError(err).WithField("file", p).Warning("failed to remove orphaned temporary file")
+			continue
+		}
+		desync.Log.WithField("file", p).Info("removed orphaned temporary file")
+	}
+}
+
+// Moves a completed tempfile into place. The data is synced to disk before the
+// rename, and the directory after it, so that the output is either the old or
+// the complete new file after a power loss. If the tempfile is on another
+// filesystem, it's first copied next to the output.
+func publishTmpFile(tmp, name string) error {
+	if err := desync.SyncFile(tmp); err != nil {
+		return err
+	}
+	err := os.Rename(tmp, name)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyTmpFile(tmp, name)
+	}
+	if err != nil {
+		return err
+	}
+	return desync.SyncDir(filepath.Dir(name))
+}
+
+// Copies tmp into a new tempfile in the directory of name and renames that.
+func copyTmpFile(tmp, name string) error {
+	src, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := newTmpFile(filepath.Dir(name), name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst.Name(), name)
+}
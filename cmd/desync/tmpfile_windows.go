@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+// Returns true if a process with the given PID exists.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/folbricht/desync"
 	"github.com/spf13/cobra"
@@ -14,10 +15,13 @@ import (
 type untarOptions struct {
 	cmdStoreOptions
 	desync.LocalFSOptions
-	stores    []string
-	cache     string
-	readIndex bool
-	outFormat string
+	stores     []string
+	cache      string
+	readIndex  bool
+	outFormat  string
+	whiteouts  string
+	fetchAhead int
+	strict     bool
 }
 
 func newUntarCommand(ctx context.Context) *cobra.Command {
@@ -27,15 +31,46 @@ func newUntarCommand(ctx context.Context) *cobra.Command {
 		Use:   "untar <catar|index> <target>",
 		Short: "Extract directory tree from a catar archive or index",
 		Long: `Extracts a directory tree from a catar file or an index. Use '-' to read the
-index from STDIN.
+archive or index from STDIN.
 
-The input is either a catar archive, or a caidx index file (with -i and -s).
+The input is either a catar archive, or a caidx index file (with -i and -s). If
+a store is given and the input ends in .caidx, -i is implied.
 
-By default, the catar archive is extracted to local disk. Using --output-format=gnu-tar,
-the output can be set to GNU tar, either an archive or STDOUT with '-'.
+By default, the catar archive is extracted to local disk. Directories are
+created in archive order, while small files are written together with their
+metadata by -n goroutines in parallel. Up to -n+1 small files of at most 1MB
+each are held in memory at a time. Large files, directories, symlinks and
+devices are written one after the other. When extracting an index, chunks are
+fetched by -n goroutines up to --fetch-ahead chunks ahead of the extraction.
+Chunks that repeat within that window are only fetched once. Using
+--output-format=gnu-tar, or its alias 'tar', the output can be set to GNU tar,
+either an archive or STDOUT with '-'. Together with an index, this streams the
+tree straight from the store into a tar without writing anything to disk, for
+example to import it into a container runtime.
+
+With --overlay, files in the target that are identical to the archive are left
+untouched. Files with the same size and modification time are considered
+identical, otherwise the content is compared. Files that differ are replaced
+with a new file, leaving other hardlinks to them unchanged. This makes repeated
+extractions into the same directory much faster and preserves reflinks of
+unchanged files.
+
+When the archive contains a container diff layer, --whiteout-format converts
+deletions and opaque directories while extracting. With 'oci', they are written
+as .wh.<name> and .wh..wh..opq files, as used in OCI image layers. With
+'overlayfs', they're written as 0:0 character devices and "trusted.overlay.opaque"
+xattrs, so the target can be used as an OverlayFS layer directly. Whiteouts in
+either format are recognized in the archive.
+
+With --strict, the goodbye element at the end of every directory is validated
+and the extraction fails if it's not a well-formed BST referencing all entries
+of the directory, which casync rejects as well. Without it, malformed goodbye
+elements in archives produced by other tools are ignored.
 `,
 		Example: `  desync untar docs.catar /tmp/documents
-  desync untar -s http://192.168.1.1/ -c /path/to/local -i docs.caidx /tmp/documents`,
+  desync untar -s http://192.168.1.1/ -c /path/to/local -i docs.caidx /tmp/documents
+  desync untar --overlay -s /path/to/store -i docs.caidx /tmp/documents
+  desync untar -s /path/to/store --output-format=tar rootfs.caidx - | docker import - rootfs`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runUntar(ctx, opt, args)
@@ -48,15 +83,24 @@ the output can be set to GNU tar, either an archive or STDOUT with '-'.
 	flags.BoolVarP(&opt.readIndex, "index", "i", false, "read index file (caidx), not catar")
 	flags.BoolVar(&opt.NoSameOwner, "no-same-owner", false, "extract files as current user")
 	flags.BoolVar(&opt.NoSamePermissions, "no-same-permissions", false, "use current user's umask instead of what is in the archive")
-	flags.StringVar(&opt.outFormat, "output-format", "disk", "output format, 'disk' or 'gnu-tar'")
+	flags.BoolVar(&opt.NoFCaps, "no-fcaps", false, "don't apply file capabilities from the archive")
+	flags.BoolVar(&opt.NoACLs, "no-acls", false, "don't apply POSIX ACLs from the archive")
+	flags.BoolVar(&opt.Overlay, "overlay", false, "only rewrite files that differ from the archive, keep identical ones")
+	flags.StringVar(&opt.whiteouts, "whiteout-format", "", "convert container layer whiteouts, 'oci' or 'overlayfs'")
+	flags.StringVar(&opt.outFormat, "output-format", "disk", "output format, 'disk' or 'gnu-tar' ('tar')")
+	flags.BoolVar(&opt.strict, "strict", false, "fail on malformed directory goodbye elements in the archive")
+	flags.IntVar(&opt.fetchAhead, "fetch-ahead", 0, "number of chunks fetched ahead of extracting them with -i, defaults to -n")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
 
-func runUntar(ctx context.Context, opt untarOptions, args []string) error {
+func runUntar(ctx context.Context, opt untarOptions, args []string) (err error) {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if len(opt.stores) > 0 && strings.HasSuffix(args[0], ".caidx") {
+		opt.readIndex = true
+	}
 	if opt.readIndex && len(opt.stores) == 0 {
 		return errors.New("-i requires at least one store (-s <location>)")
 	}
@@ -66,13 +110,14 @@ func runUntar(ctx context.Context, opt untarOptions, args []string) error {
 
 	// Prepare output
 	var (
-		fs  desync.FilesystemWriter
-		err error
+		fs   desync.FilesystemWriter
+		uopt = desync.UnTarOptions{VerifyGoodbye: opt.strict}
 	)
 	switch opt.outFormat {
-	case "disk": // Local filesystem
+	case "disk": // Local filesystem, small files are written in parallel
 		fs = desync.NewLocalFS(target, opt.LocalFSOptions)
-	case "gnu-tar": // GNU tar, either file or STDOUT
+		uopt.Writers = opt.n
+	case "gnu-tar", "tar": // GNU tar, either file or STDOUT
 		var w *os.File
 		if target == "-" {
 			w = os.Stdout
@@ -81,34 +126,59 @@ func runUntar(ctx context.Context, opt untarOptions, args []string) error {
 			if err != nil {
 				return err
 			}
-			defer w.Close()
+			defer func() {
+				if cerr := w.Close(); err == nil {
+					err = cerr
+				}
+			}()
 		}
 		gtar := desync.NewTarWriter(w)
-		defer gtar.Close()
+		// Closing writes the end of the archive, a stream without it is truncated
+		defer func() {
+			if cerr := gtar.Close(); err == nil {
+				err = cerr
+			}
+		}()
 		fs = gtar
 	default:
 		return fmt.Errorf("invalid output format '%s'", opt.outFormat)
 	}
 
+	// Convert container layer whiteouts if requested
+	switch opt.whiteouts {
+	case "":
+	case "oci":
+		fs = desync.NewWhiteoutFS(fs, desync.WhiteoutOCI)
+	case "overlayfs":
+		fs = desync.NewWhiteoutFS(fs, desync.WhiteoutOverlayFS)
+	default:
+		return fmt.Errorf("invalid whiteout format '%s'", opt.whiteouts)
+	}
+
 	// If we got a catar file unpack that and exit
 	if !opt.readIndex {
-		f, err := os.Open(input)
-		if err != nil {
-			return err
+		f := os.Stdin
+		if input != "-" {
+			var err error
+			if f, err = os.Open(input); err != nil {
+				return err
+			}
+			defer f.Close()
 		}
-		defer f.Close()
 		var r io.Reader = f
-		pb := desync.NewProgressBar("Unpacking ")
-		// Get the file size to initialize the progress bar
+		pb := desync.NewBytesProgressBar("Unpacking ")
+		// Get the file size to initialize the progress bar, unknown for pipes
 		info, err := f.Stat()
 		if err != nil {
 			return err
 		}
-		pb.SetTotal(int(info.Size()))
+		if info.Mode().IsRegular() {
+			pb.SetTotal(info.Size())
+		}
 		pb.Start()
 		defer pb.Finish()
 		r = io.TeeReader(f, pb)
-		return desync.UnTar(ctx, r, fs)
+		return desync.UnTarWithOptions(ctx, r, fs, uopt)
 	}
 
 	s, err := MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
@@ -122,6 +192,7 @@ func runUntar(ctx context.Context, opt untarOptions, args []string) error {
 	if err != nil {
 		return err
 	}
+	uopt.FetchAhead = opt.fetchAhead
 
-	return desync.UnTarIndex(ctx, fs, index, s, opt.n, desync.NewProgressBar("Unpacking "))
+	return desync.UnTarIndexWithOptions(ctx, fs, index, s, opt.n, desync.NewProgressBar("Unpacking "), uopt)
 }
@@ -4,11 +4,14 @@
 package main
 
 import (
+	"archive/tar"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -40,6 +43,32 @@ func TestUntarCommandIndex(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestUntarCommandIndexToTar(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "tree.tar")
+
+	// Convert a caidx index straight into a tar, -i is implied by the extension
+	cmd := newUntarCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/tree.store", "--output-format=tar", "testdata/tree.caidx", out})
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// The output should be a complete tar with entries in it
+	f, err := os.Open(out)
+	require.NoError(t, err)
+	defer f.Close()
+	r := tar.NewReader(f)
+	var n int
+	for {
+		_, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		n++
+	}
+	require.NotZero(t, n)
+}
+
 // Check that we repair broken chunks in cache
 func TestUntarCommandRepair(t *testing.T) {
 	// Create an output dir to extract into
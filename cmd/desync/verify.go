@@ -11,8 +11,9 @@ import (
 
 type verifyOptions struct {
 	cmdStoreOptions
-	store  string
-	repair bool
+	store      string
+	repair     bool
+	quarantine string
 }
 
 func newVerifyCommand(ctx context.Context) *cobra.Command {
@@ -22,9 +23,12 @@ func newVerifyCommand(ctx context.Context) *cobra.Command {
 		Use:   "verify",
 		Short: "Read chunks in a store and verify their integrity",
 		Long: `Reads all chunks in a local store and verifies their integrity. If -r is used,
-invalid chunks are deleted from the store.`,
-		Example: `  desync verify -s /path/to/store`,
-		Args:    cobra.NoArgs,
+invalid chunks are deleted from the store. With --quarantine, invalid chunks are
+moved into the given directory under a timestamped name instead of being deleted,
+preserving them for later analysis.`,
+		Example: `  desync verify -s /path/to/store
+  desync verify -s /path/to/store -r --quarantine /path/to/quarantine`,
+		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runVerify(ctx, opt, args)
 		},
@@ -34,6 +38,7 @@ invalid chunks are deleted from the store.`,
 	flags.StringVarP(&opt.store, "store", "s", "", "target store")
 	flags.IntVarP(&opt.n, "concurrency", "n", 10, "number of concurrent goroutines")
 	flags.BoolVarP(&opt.repair, "repair", "r", false, "remove invalid chunks from the store")
+	flags.StringVar(&opt.quarantine, "quarantine", "", "move invalid chunks into this directory instead of deleting them")
 	return cmd
 }
 
@@ -45,6 +50,9 @@ func runVerify(ctx context.Context, opt verifyOptions, args []string) error {
 	if err != nil {
 		return err
 	}
+	if opt.quarantine != "" {
+		options.Quarantine = opt.quarantine
+	}
 	s, err := desync.NewLocalStore(opt.store, options)
 	if err != nil {
 		return err
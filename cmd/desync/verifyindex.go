@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/folbricht/desync"
 	"github.com/spf13/cobra"
@@ -9,6 +11,10 @@ import (
 
 type verifyIndexOptions struct {
 	cmdStoreOptions
+	report bool
+	repair bool
+	stores []string
+	cache  string
 }
 
 func newVerifyIndexCommand(ctx context.Context) *cobra.Command {
@@ -18,15 +24,26 @@ func newVerifyIndexCommand(ctx context.Context) *cobra.Command {
 		Use:   "verify-index <index> <file>",
 		Short: "Verifies an index matches a file",
 		Long: `Verifies an index file matches the content of a blob. Use '-' to read the index
-from STDIN.`,
-		Example: `  desync verify-index sftp://192.168.1.1/myIndex.caibx largefile.bin`,
-		Args:    cobra.ExactArgs(2),
+from STDIN.
+
+By default, the command fails on the first mismatch. With --report, every chunk
+is checked and the ones that don't match the blob are printed with their start
+and size. --repair does the same, and then writes the data of the damaged chunks
+into the blob in place, reading them from the store(s) given with -s. Only the
+damaged ranges are written.`,
+		Example: `  desync verify-index sftp://192.168.1.1/myIndex.caibx largefile.bin
+  desync verify-index --repair -s http://192.168.1.1/store disk.caibx /dev/sdb`,
+		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runVerifyIndex(ctx, opt, args)
 		},
 		SilenceUsage: true,
 	}
 	flags := cmd.Flags()
+	flags.BoolVar(&opt.report, "report", false, "check all chunks and list the ones that don't match")
+	flags.BoolVar(&opt.repair, "repair", false, "replace damaged chunks in the file with data from the store")
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s) used to repair the file")
+	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
@@ -34,6 +51,9 @@ func runVerifyIndex(ctx context.Context, opt verifyIndexOptions, args []string)
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if opt.repair && len(opt.stores) == 0 {
+		return errors.New("no store provided for --repair")
+	}
 	indexFile := args[0]
 	dataFile := args[1]
 
@@ -46,6 +66,31 @@ func runVerifyIndex(ctx context.Context, opt verifyIndexOptions, args []string)
 	// If this is a terminal, we want a progress bar
 	pb := desync.NewProgressBar("")
 
-	// Chop up the file into chunks and store them in the target store
-	return desync.VerifyIndex(ctx, dataFile, idx, opt.n, pb)
+	if !opt.report && !opt.repair {
+		// Chop up the file into chunks and store them in the target store
+		return desync.VerifyIndex(ctx, dataFile, idx, opt.n, pb)
+	}
+
+	// Check every chunk and list the damaged ones
+	damaged, err := desync.FindDamagedChunks(ctx, dataFile, idx, opt.n, pb)
+	if err != nil {
+		return err
+	}
+	for _, c := range damaged {
+		fmt.Fprintf(stdout, "%s %d %d\n", c.ID.String(), c.Start, c.Size)
+	}
+	if len(damaged) == 0 {
+		return nil
+	}
+	if !opt.repair {
+		return fmt.Errorf("%d chunks don't match the index", len(damaged))
+	}
+
+	// Pull the damaged chunks from the store and write them into the file
+	s, err := MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return desync.RepairChunks(ctx, dataFile, idx, damaged, s, opt.n, desync.NewProgressBar("Repairing "))
 }
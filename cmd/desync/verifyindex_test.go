@@ -3,8 +3,12 @@ package main
 import (
 	"bytes"
 	"context"
-	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestVerifyIndexCommand(t *testing.T) {
@@ -32,3 +36,37 @@ func TestVerifyIndexCommand(t *testing.T) {
 	_, err = verifyIndex.ExecuteC()
 	require.Error(t, err)
 }
+
+func TestVerifyIndexCommandRepair(t *testing.T) {
+	blob, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+
+	// Damage a copy of the blob in two places, and cut off the end
+	damaged := append([]byte{}, blob[:len(blob)-100]...)
+	damaged[10] ^= 0xff
+	damaged[len(damaged)/2] ^= 0xff
+	file := filepath.Join(t.TempDir(), "blob1")
+	require.NoError(t, ioutil.WriteFile(file, damaged, 0644))
+
+	// Report the damaged chunks
+	cmd := newVerifyIndexCommand(context.Background())
+	cmd.SetArgs([]string{"--report", "testdata/blob1.caibx", file})
+	cmd.SetOutput(ioutil.Discard)
+	b := new(bytes.Buffer)
+	stdout = b
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(b.String()), "\n"), 3)
+
+	// Repair them from the store
+	cmd = newVerifyIndexCommand(context.Background())
+	cmd.SetArgs([]string{"--repair", "-s", "testdata/blob1.store", "testdata/blob1.caibx", file})
+	cmd.SetOutput(ioutil.Discard)
+	stdout = ioutil.Discard
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	repaired, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, blob, repaired)
+}
@@ -2,22 +2,47 @@
 
 package desync
 
-import "github.com/klauspost/compress/zstd"
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
 
 // Create a reader/writer that caches compressors.
 var (
 	encoder, _ = zstd.NewWriter(nil)
-	decoder, _ = zstd.NewReader(nil)
+	decoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+)
+
+// Encoders for compression levels other than the default, created when they're
+// first used.
+var (
+	levelEncoders   = make(map[zstd.EncoderLevel]*zstd.Encoder)
+	levelEncodersMu sync.Mutex
 )
 
-// Compress a block using the only (currently) supported algorithm
-func Compress(src []byte) ([]byte, error) {
-	return encoder.EncodeAll(src, make([]byte, 0, len(src))), nil
+// Compresses a block into a single zstd frame. Levels are mapped to the closest
+// one supported by the encoder.
+func compressFrame(src []byte, level int) ([]byte, error) {
+	if level == 0 {
+		return encoder.EncodeAll(src, make([]byte, 0, len(src))), nil
+	}
+	l := zstd.EncoderLevelFromZstd(level)
+	levelEncodersMu.Lock()
+	e, ok := levelEncoders[l]
+	if !ok {
+		var err error
+		if e, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(l)); err != nil {
+			levelEncodersMu.Unlock()
+			return nil, err
+		}
+		levelEncoders[l] = e
+	}
+	levelEncodersMu.Unlock()
+	return e.EncodeAll(src, make([]byte, 0, len(src))), nil
 }
 
-// Decompress a block using the only supported algorithm. If you already have
-// a buffer it can be passed into out and will be used. If out=nil, a buffer
-// will be allocated.
-func Decompress(dst, src []byte) ([]byte, error) {
+// Decompresses one or more zstd frames, appending the data to dst.
+func decompressFrames(dst, src []byte) ([]byte, error) {
 	return decoder.DecodeAll(src, dst)
 }
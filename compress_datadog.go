@@ -6,14 +6,16 @@ import (
 	"github.com/DataDog/zstd"
 )
 
-// Compress a block using the only (currently) supported algorithm
-func Compress(b []byte) ([]byte, error) {
-	return zstd.CompressLevel(nil, b, 3)
+// Compresses a block into a single zstd frame.
+func compressFrame(b []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = 3
+	}
+	return zstd.CompressLevel(nil, b, level)
 }
 
-// Decompress a block using the only supported algorithm. If you already have
-// a buffer it can be passed into out and will be used. If out=nil, a buffer
-// will be allocated.
-func Decompress(out, in []byte) ([]byte, error) {
+// Decompresses one or more zstd frames. If dst is large enough, it's used for
+// the output.
+func decompressFrames(out, in []byte) ([]byte, error) {
 	return zstd.Decompress(out, in)
 }
@@ -0,0 +1,100 @@
+package desync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressLevel(t *testing.T) {
+	// Somewhat compressible data, random words from a small list
+	words := []string{"alpha ", "bravo ", "charlie ", "delta ", "echo ", "foxtrot ", "golf ", "hotel "}
+	var in []byte
+	r := rand.New(rand.NewSource(1))
+	for len(in) < 256*1024 {
+		in = append(in, words[r.Intn(len(words))]...)
+	}
+
+	var sizes []int
+	for _, level := range []int{0, 1, 22} {
+		b, err := CompressLevel(in, level)
+		require.NoError(t, err)
+		out, err := Decompress(nil, b)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(in, out))
+		sizes = append(sizes, len(b))
+	}
+	require.LessOrEqual(t, sizes[2], sizes[1])
+
+	// The level doesn't change the format, but compressors with different
+	// levels aren't equal since they don't produce the same data
+	c := Converters{Compressor{Level: 22}}
+	require.True(t, c.equal(Converters{Compressor{Level: 22}}))
+	require.False(t, c.equal(Converters{Compressor{}}))
+	require.Equal(t, "zstd", c.format())
+}
+
+func TestCompressLargeBlock(t *testing.T) {
+	in := make([]byte, 2*compressFrameSize+12345)
+	r := rand.New(rand.NewSource(1))
+	for i := range in {
+		in[i] = byte(r.Intn(16))
+	}
+
+	// Large blocks are split into several frames
+	b, err := Compress(in)
+	require.NoError(t, err)
+	frames, size, ok := zstdFrames(b)
+	require.True(t, ok)
+	require.Len(t, frames, 3)
+	require.Equal(t, len(in), size)
+
+	// They're decompressed concurrently, and can still be read as one stream
+	out, err := Decompress(nil, b)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(in, out))
+	out, err = decompressFrames(nil, b)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(in, out))
+
+	// Truncated data doesn't decompress to the original
+	out, err = Decompress(nil, b[:len(b)-100])
+	require.True(t, err != nil || !bytes.Equal(in, out))
+}
+
+func TestDecompressFramesEdgeCases(t *testing.T) {
+	in := make([]byte, compressFrameSize+12345)
+	r := rand.New(rand.NewSource(1))
+	for i := range in {
+		in[i] = byte(r.Intn(16))
+	}
+	b, err := Compress(in)
+	require.NoError(t, err)
+
+	// A valid stream with an empty frame at the end
+	empty := []byte{
+		0x28, 0xb5, 0x2f, 0xfd, // magic
+		0x20,             // single segment, 1 byte content size
+		0x00,             // content size 0
+		0x01, 0x00, 0x00, // last raw block of 0 bytes
+	}
+	out, err := decompressFrames(nil, empty)
+	require.NoError(t, err)
+	require.Empty(t, out)
+	out, err = Decompress(nil, append(b, empty...))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(in, out))
+
+	// Two tiny frames whose headers claim a huge content size
+	frame := []byte{
+		0x28, 0xb5, 0x2f, 0xfd, // magic
+		0xe0,                                           // single segment, 8 byte content size
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, // content size 1<<42
+		0x09, 0x00, 0x00, // last raw block of 1 byte
+		0x00,
+	}
+	_, err = Decompress(nil, append(append([]byte{}, frame...), frame...))
+	require.Error(t, err)
+}
@@ -0,0 +1,176 @@
+package desync
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sync/errgroup"
+)
+
+// Blocks larger than this are compressed as several independent zstd frames of
+// this size, which are compressed and decompressed concurrently. Concatenated
+// frames are valid zstd data, any decoder can read them. Only very large chunks
+// are affected, the default maximum chunk size is much smaller.
+const compressFrameSize = 4 << 20
+
+// Largest amount of data a compressed chunk is allowed to decompress into. The
+// content sizes recorded in zstd frame headers can't be trusted, they're
+// checked against this before any memory is allocated for them.
+const maxDecompressedSize = 1 << 30
+
+// Maximum size of the content of a single zstd block.
+const zstdMaxBlockSize = 128 << 10
+
+// Compress a block using the only (currently) supported algorithm
+func Compress(src []byte) ([]byte, error) {
+	return CompressLevel(src, 0)
+}
+
+// CompressLevel compresses a block like Compress, with a zstd compression level
+// from 1 (fastest) to 22 (best). 0 selects the default level.
+func CompressLevel(src []byte, level int) ([]byte, error) {
+	if len(src) <= compressFrameSize {
+		return compressFrame(src, level)
+	}
+	frames := make([][]byte, (len(src)+compressFrameSize-1)/compressFrameSize)
+	var g errgroup.Group
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for i := range frames {
+		i := i
+		start := i * compressFrameSize
+		end := start + compressFrameSize
+		if end > len(src) {
+			end = len(src)
+		}
+		g.Go(func() (err error) {
+			frames[i], err = compressFrame(src[start:end], level)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	var size int
+	for _, f := range frames {
+		size += len(f)
+	}
+	out := make([]byte, 0, size)
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	return out, nil
+}
+
+// Decompress a block using the only supported algorithm. If you already have
+// a buffer it can be passed into out and will be used. If out=nil, a buffer
+// will be allocated. Blocks made up of several frames that all record their
+// size are decompressed concurrently.
+func Decompress(dst, src []byte) ([]byte, error) {
+	// Only data that was split when compressing starts with a frame of
+	// compressFrameSize, don't bother looking for more frames otherwise
+	var h zstd.Header
+	if err := h.Decode(src); err != nil || !h.HasFCS || h.FrameContentSize < compressFrameSize {
+		return decompressFrames(dst, src)
+	}
+	frames, size, ok := zstdFrames(src)
+	if !ok || len(frames) < 2 {
+		return decompressFrames(dst, src)
+	}
+	if size > maxDecompressedSize {
+		return nil, fmt.Errorf("zstd frame content size %d exceeds the maximum of %d", size, maxDecompressedSize)
+	}
+	if cap(dst) >= size {
+		dst = dst[:size]
+	} else {
+		dst = make([]byte, size)
+	}
+	var g errgroup.Group
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	var offset int
+	for _, f := range frames {
+		f := f
+		out := dst[offset : offset+f.size : offset+f.size]
+		offset += f.size
+		g.Go(func() error {
+			b, err := decompressFrames(out[:0], src[f.start:f.end])
+			if err != nil {
+				return err
+			}
+			if len(b) != len(out) {
+				return errors.New("zstd frame content size mismatch")
+			}
+			if len(b) > 0 && &b[0] != &out[0] {
+				copy(out, b)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// Position of a zstd frame in compressed data, and the size of its content.
+type zstdFrame struct {
+	start, end int
+	size       int
+}
+
+// Finds the frames in zstd data by reading their headers and the headers of
+// their blocks. Returns false if the data can't be parsed, if the content size
+// of any of the frames is unknown, or larger than its blocks can hold. Frames
+// without content are left out.
+func zstdFrames(src []byte) ([]zstdFrame, int, bool) {
+	var (
+		frames []zstdFrame
+		total  int
+		pos    int
+	)
+	for pos < len(src) {
+		var h zstd.Header
+		if err := h.Decode(src[pos:]); err != nil || h.Skippable || !h.HasFCS || h.DictionaryID != 0 {
+			return nil, 0, false
+		}
+		frame := zstdFrame{start: pos, size: int(h.FrameContentSize)}
+		if frame.size < 0 || uint64(frame.size) != h.FrameContentSize {
+			return nil, 0, false
+		}
+		pos += h.HeaderSize
+		var blocks int
+		for last := false; !last; blocks++ {
+			if pos+3 > len(src) {
+				return nil, 0, false
+			}
+			bh := uint32(src[pos]) | uint32(src[pos+1])<<8 | uint32(src[pos+2])<<16
+			last = bh&1 == 1
+			size := int(bh >> 3)
+			switch (bh >> 1) & 3 {
+			case 0, 2: // raw or compressed
+			case 1: // RLE, a single byte is repeated
+				size = 1
+			default:
+				return nil, 0, false
+			}
+			pos += 3 + size
+		}
+		if h.HasCheckSum {
+			pos += 4
+		}
+		if pos > len(src) {
+			return nil, 0, false
+		}
+		if frame.size > blocks*zstdMaxBlockSize {
+			return nil, 0, false
+		}
+		frame.end = pos
+		if frame.size == 0 {
+			continue
+		}
+		frames = append(frames, frame)
+		total += frame.size
+	}
+	return frames, total, true
+}
@@ -0,0 +1,166 @@
+package desync
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var _ WriteStore = &ConsistentHashStore{}
+
+// Number of points each store has on the hash ring. More points spread the
+// chunks more evenly.
+const consistentHashReplicas = 100
+
+type ringPoint struct {
+	hash  uint64
+	store int
+}
+
+// ConsistentHashStore spreads requests across stores holding the same chunks,
+// like a pool of chunk servers, and sends all requests for a chunk to the same
+// store. The store is chosen by consistent hashing of the chunk ID, so every
+// server only has to cache its share of the chunks, and only a small part of
+// the chunks move to a different server when one is added or removed. If the
+// chosen store fails with an error other than the chunk missing, the request is
+// retried on the next store on the ring.
+type ConsistentHashStore struct {
+	stores []Store
+	ring   []ringPoint
+}
+
+// NewConsistentHashStore returns a store that routes requests to the given
+// stores by chunk ID. The position of the stores on the ring is based on their
+// names, so clients using the same stores route chunks the same way.
+func NewConsistentHashStore(stores ...Store) *ConsistentHashStore {
+	s := &ConsistentHashStore{stores: stores}
+	for i, store := range stores {
+		for r := 0; r < consistentHashReplicas; r++ {
+			sum := sha256.Sum256([]byte(fmt.Sprintf("%s#%d", store, r)))
+			s.ring = append(s.ring, ringPoint{hash: binary.BigEndian.Uint64(sum[:8]), store: i})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+	return s
+}
+
+// NewConsistentHashHTTPStore resolves the host of an HTTP chunk store location
+// to all of its addresses, and returns a store that routes the requests for
+// each chunk to one of them. The host name is still used in requests and for
+// TLS. Addresses are only resolved once.
+func NewConsistentHashHTTPStore(location *url.URL, opt StoreOptions) (*ConsistentHashStore, error) {
+	addrs, err := net.LookupHost(location.Hostname())
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", location.Hostname())
+	}
+	sort.Strings(addrs)
+	port := location.Port()
+	if port == "" {
+		port = "80"
+		if location.Scheme == "https" {
+			port = "443"
+		}
+	}
+	var stores []Store
+	for _, addr := range addrs {
+		u := *location
+		s, err := newRemoteHTTPStore(&u, opt, net.JoinHostPort(addr, port))
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, s)
+	}
+	return NewConsistentHashStore(stores...), nil
+}
+
+// Returns the stores in the order they should be tried for a chunk, starting
+// with the one the chunk is assigned to.
+func (s *ConsistentHashStore) storesFor(id ChunkID) []Store {
+	pos := binary.BigEndian.Uint64(id[:8])
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= pos })
+	var (
+		l    []Store
+		seen = make(map[int]bool)
+	)
+	for n := 0; n < len(s.ring) && len(l) < len(s.stores); n++ {
+		p := s.ring[(i+n)%len(s.ring)]
+		if seen[p.store] {
+			continue
+		}
+		seen[p.store] = true
+		l = append(l, s.stores[p.store])
+	}
+	return l
+}
+
+// GetChunk reads the chunk from the store it's assigned to, moving on to the
+// next store if that fails with an error other than the chunk missing.
+func (s *ConsistentHashStore) GetChunk(id ChunkID) (*Chunk, error) {
+	var sErr error
+	for _, store := range s.storesFor(id) {
+		chunk, err := store.GetChunk(id)
+		if err == nil || errors.Is(err, ErrNotFound) {
+			return chunk, err
+		}
+		sErr = err
+	}
+	if sErr == nil {
+		return nil, ChunkMissing{id}
+	}
+	return nil, sErr
+}
+
+// HasChunk asks the store the chunk is assigned to if it has the chunk.
+func (s *ConsistentHashStore) HasChunk(id ChunkID) (bool, error) {
+	var sErr error
+	for _, store := range s.storesFor(id) {
+		hasChunk, err := store.HasChunk(id)
+		if err == nil {
+			return hasChunk, nil
+		}
+		sErr = err
+	}
+	return false, sErr
+}
+
+// StoreChunk writes the chunk to the store it's assigned to.
+func (s *ConsistentHashStore) StoreChunk(chunk *Chunk) error {
+	var sErr error
+	for _, store := range s.storesFor(chunk.ID()) {
+		ws, ok := store.(WriteStore)
+		if !ok {
+			return fmt.Errorf("store %s does not support writing", store)
+		}
+		err := ws.StoreChunk(chunk)
+		if err == nil {
+			return nil
+		}
+		sErr = err
+	}
+	return sErr
+}
+
+func (s *ConsistentHashStore) String() string {
+	var a []string
+	for _, store := range s.stores {
+		a = append(a, store.String())
+	}
+	return "consistent-hash:" + strings.Join(a, ",")
+}
+
+// Close closes all stores. Returns only the first error encountered.
+func (s *ConsistentHashStore) Close() error {
+	var sErr error
+	for _, store := range s.stores {
+		if err := store.Close(); err != nil && sErr == nil {
+			sErr = err
+		}
+	}
+	return sErr
+}
@@ -0,0 +1,120 @@
+package desync
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Store that counts requests and can be made to fail.
+type countingStore struct {
+	TestStore
+	name     string
+	requests int
+	fail     bool
+}
+
+func (s *countingStore) GetChunk(id ChunkID) (*Chunk, error) {
+	s.requests++
+	if s.fail {
+		return nil, errors.New("unavailable")
+	}
+	return s.TestStore.GetChunk(id)
+}
+
+func (s *countingStore) String() string { return s.name }
+
+func TestConsistentHashStore(t *testing.T) {
+	var (
+		stores []*countingStore
+		ids    []ChunkID
+	)
+	chunks := make(map[ChunkID][]byte)
+	for i := 0; i < 1000; i++ {
+		c := NewChunk([]byte(fmt.Sprintf("chunk %d", i)))
+		chunks[c.ID()], _ = c.Data()
+		ids = append(ids, c.ID())
+	}
+	for i := 0; i < 3; i++ {
+		stores = append(stores, &countingStore{TestStore: TestStore{Chunks: chunks}, name: fmt.Sprintf("store%d", i)})
+	}
+	s := NewConsistentHashStore(stores[0], stores[1], stores[2])
+
+	// Every chunk is read from one store, and the chunks are spread over all of them
+	for _, id := range ids {
+		_, err := s.GetChunk(id)
+		require.NoError(t, err)
+	}
+	for _, store := range stores {
+		require.Greater(t, store.requests, 200, store.name)
+	}
+
+	// Reading the same chunks again hits the same stores
+	before := []int{stores[0].requests, stores[1].requests, stores[2].requests}
+	for _, id := range ids {
+		_, err := s.GetChunk(id)
+		require.NoError(t, err)
+	}
+	for i, store := range stores {
+		require.Equal(t, 2*before[i], store.requests)
+	}
+
+	// The order of the stores doesn't matter
+	reordered := NewConsistentHashStore(stores[2], stores[0], stores[1])
+	for _, id := range ids[:50] {
+		require.Equal(t, s.storesFor(id)[0], reordered.storesFor(id)[0])
+	}
+
+	// When a store fails, its chunks are read from the others
+	stores[1].fail = true
+	for _, id := range ids {
+		_, err := s.GetChunk(id)
+		require.NoError(t, err)
+	}
+
+	// Missing chunks aren't requested from other stores
+	stores[1].fail = false
+	stores[0].requests, stores[1].requests, stores[2].requests = 0, 0, 0
+	_, err := s.GetChunk(ChunkID{1})
+	require.Error(t, err)
+	var missing ChunkMissing
+	require.True(t, errors.As(err, &missing))
+	require.Equal(t, 1, stores[0].requests+stores[1].requests+stores[2].requests)
+}
+
+func TestConsistentHashHTTPStore(t *testing.T) {
+	c := NewChunk([]byte("some data"))
+	b, err := Compressor{}.toStorage(mustData(t, c))
+	require.NoError(t, err)
+
+	var hosts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		w.Write(b)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	// Use a name that resolves, requests still carry the name as host
+	loc, err := url.Parse(fmt.Sprintf("http://localhost:%s/", u.Port()))
+	require.NoError(t, err)
+	s, err := NewConsistentHashHTTPStore(loc, StoreOptions{})
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.GetChunk(c.ID())
+	require.NoError(t, err)
+	require.NotEmpty(t, hosts)
+	require.Equal(t, loc.Host, hosts[len(hosts)-1])
+}
+
+func mustData(t *testing.T, c *Chunk) []byte {
+	b, err := c.Data()
+	require.NoError(t, err)
+	return b
+}
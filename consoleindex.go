@@ -8,7 +8,10 @@ import (
 )
 
 // ConsoleIndexStore is used for writing/reading indexes from STDOUT/STDIN
-type ConsoleIndexStore struct{}
+type ConsoleIndexStore struct {
+	// Hash algorithm of the indexes read from STDIN, the global Digest if nil
+	Digest HashAlgorithm
+}
 
 // NewConsoleIndexStore creates an instance of an indexStore that reads/writes to and
 // from console
@@ -23,7 +26,11 @@ func (s ConsoleIndexStore) GetIndexReader(string) (io.ReadCloser, error) {
 
 // GetIndex reads an index from STDIN and returns it.
 func (s ConsoleIndexStore) GetIndex(string) (i Index, e error) {
-	return IndexFromReader(os.Stdin)
+	return IndexFromReaderWithDigest(os.Stdin, s.indexDigest())
+}
+
+func (s ConsoleIndexStore) indexDigest() HashAlgorithm {
+	return digestOrDefault(s.Digest)
 }
 
 // StoreIndex writes the provided indes to STDOUT. The name is ignored.
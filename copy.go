@@ -2,57 +2,146 @@ package desync
 
 import (
 	"context"
+	"sync/atomic"
 
 	"golang.org/x/sync/errgroup"
 )
 
-// Copy reads a list of chunks from the provided src store, and copies the ones
-// not already present in the dst store. The goal is to load chunks from remote
-// store to populate a cache. If progress is provided, it'll be called when a
-// chunk has been processed. Used to draw a progress bar, can be nil.
-func Copy(ctx context.Context, ids []ChunkID, src Store, dst WriteStore, n int, pb ProgressBar) error {
+// ChunkIterator calls fn for every chunk ID it produces and stops on the first
+// error. The ListChunks method of a ChunkLister can be used as iterator.
+type ChunkIterator func(ctx context.Context, fn func(ChunkID) error) error
+
+// ChunkList returns an iterator over a list of chunk IDs.
+func ChunkList(ids []ChunkID) ChunkIterator {
+	return func(ctx context.Context, fn func(ChunkID) error) error {
+		for _, id := range ids {
+			if err := fn(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// IndexChunks returns an iterator over all chunks referenced in one or more
+// indexes. Every chunk ID is only produced once, even if it's used several
+// times.
+func IndexChunks(indexes ...Index) ChunkIterator {
+	return func(ctx context.Context, fn func(ChunkID) error) error {
+		seen := make(map[ChunkID]struct{})
+		for _, idx := range indexes {
+			for _, c := range idx.Chunks {
+				if _, ok := seen[c.ID]; ok {
+					continue
+				}
+				seen[c.ID] = struct{}{}
+				if err := fn(c.ID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// CopyOptions influence the behavior of CopyChunks.
+type CopyOptions struct {
+	// Number of concurrent goroutines copying chunks
+	N int
+
+	// Called after each chunk has been processed, with the chunk ID and whether
+	// it was copied or already present in the destination. Must be safe for
+	// concurrent use. Can be nil.
+	Progress func(id ChunkID, copied bool)
+}
+
+// CopyStats contains the results of a copy operation.
+type CopyStats struct {
+	ChunksRequested uint64 `json:"chunks-requested"`
+	ChunksSkipped   uint64 `json:"chunks-skipped"`
+	ChunksCopied    uint64 `json:"chunks-copied"`
+	BytesCopied     uint64 `json:"bytes-copied"`
+}
+
+// CopyChunks reads the chunks produced by the iterator from the src store, and
+// copies the ones not already present in the dst store. Used to populate a
+// cache from remote stores. Chunks are copied while the iterator is running,
+// so it doesn't need to produce the full list upfront.
+func CopyChunks(ctx context.Context, it ChunkIterator, src Store, dst WriteStore, opt CopyOptions) (CopyStats, error) {
+	var stats CopyStats
+	if opt.N < 1 {
+		opt.N = 1
+	}
+	progress := opt.Progress
+	if progress == nil {
+		progress = func(ChunkID, bool) {}
+	}
+
 	in := make(chan ChunkID)
 	g, ctx := errgroup.WithContext(ctx)
 
-	// Setup and start the progressbar if any
-	pb.SetTotal(len(ids))
-	pb.Start()
-	defer pb.Finish()
-
 	// Start the workers
-	for i := 0; i < n; i++ {
+	for i := 0; i < opt.N; i++ {
 		g.Go(func() error {
 			for id := range in {
-				pb.Increment()
 				hasChunk, err := dst.HasChunk(id)
 				if err != nil {
 					return err
 				}
 				if hasChunk {
+					atomic.AddUint64(&stats.ChunksSkipped, 1)
+					progress(id, false)
 					continue
 				}
 				chunk, err := src.GetChunk(id)
 				if err != nil {
 					return err
 				}
+				b, err := chunk.Data()
+				if err != nil {
+					return err
+				}
 				if err := dst.StoreChunk(chunk); err != nil {
 					return err
 				}
+				atomic.AddUint64(&stats.ChunksCopied, 1)
+				atomic.AddUint64(&stats.BytesCopied, uint64(len(b)))
+				progress(id, true)
 			}
 			return nil
 		})
 	}
 
 	// Feed the workers, the context is cancelled if any goroutine encounters an error
-loop:
-	for _, c := range ids {
-		select {
-		case <-ctx.Done():
-			break loop
-		case in <- c:
-		}
-	}
-	close(in)
+	g.Go(func() error {
+		defer close(in)
+		return it(ctx, func(id ChunkID) error {
+			select {
+			case <-ctx.Done():
+				return Interrupted{}
+			case in <- id:
+			}
+			atomic.AddUint64(&stats.ChunksRequested, 1)
+			return nil
+		})
+	})
+
+	return stats, g.Wait()
+}
+
+// Copy reads a list of chunks from the provided src store, and copies the ones
+// not already present in the dst store. The goal is to load chunks from remote
+// store to populate a cache. If progress is provided, it'll be called when a
+// chunk has been processed. Used to draw a progress bar, can be nil.
+func Copy(ctx context.Context, ids []ChunkID, src Store, dst WriteStore, n int, pb ProgressBar) error {
+	// Setup and start the progressbar if any
+	pb.SetTotal(int64(len(ids)))
+	pb.Start()
+	defer pb.Finish()
 
-	return g.Wait()
+	_, err := CopyChunks(ctx, ChunkList(ids), src, dst, CopyOptions{
+		N:        n,
+		Progress: func(ChunkID, bool) { pb.Increment() },
+	})
+	return err
 }
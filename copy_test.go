@@ -0,0 +1,45 @@
+package desync
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyChunks(t *testing.T) {
+	src, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+	dst, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+
+	// Use the same index twice, the chunks should only be requested once
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+	unique := make(map[ChunkID]struct{})
+	for _, c := range index.Chunks {
+		unique[c.ID] = struct{}{}
+	}
+
+	var progress uint64
+	opt := CopyOptions{
+		N:        4,
+		Progress: func(ChunkID, bool) { atomic.AddUint64(&progress, 1) },
+	}
+	stats, err := CopyChunks(context.Background(), IndexChunks(index, index), src, dst, opt)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(unique)), stats.ChunksRequested)
+	require.Equal(t, uint64(len(unique)), stats.ChunksCopied)
+	require.Equal(t, uint64(0), stats.ChunksSkipped)
+	require.Equal(t, uint64(len(unique)), progress)
+
+	// Copy again, everything should be skipped now
+	stats, err = CopyChunks(context.Background(), IndexChunks(index), src, dst, opt)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), stats.ChunksCopied)
+	require.Equal(t, uint64(len(unique)), stats.ChunksSkipped)
+
+	// Missing chunks in the source should fail the copy
+	_, err = CopyChunks(context.Background(), ChunkList([]ChunkID{{1}}), src, dst, CopyOptions{})
+	require.IsType(t, ChunkMissing{}, err)
+}
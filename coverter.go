@@ -1,5 +1,11 @@
 package desync
 
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
 // Converters are modifiers for chunk data, such as compression or encryption.
 // They are used to prepare chunk data for storage, or to read it from storage.
 // The order of the conversion layers matters. When plain data is prepared for
@@ -63,6 +69,54 @@ func (s Converters) equal(c Converters) bool {
 	return true
 }
 
+// Media type used to negotiate the format of chunks sent over HTTP. The
+// "format" parameter lists the converter layers, like "zstd+aes-256-gcm".
+const ChunkMediaType = "application/x-desync-chunk"
+
+// Name of the format for chunks without conversion layers.
+const plainChunkFormat = "plain"
+
+// Returns the name of the format produced by the converters, with the names
+// of the layers joined by "+".
+func (s Converters) format() string {
+	if len(s) == 0 {
+		return plainChunkFormat
+	}
+	names := make([]string, 0, len(s))
+	for _, layer := range s {
+		names = append(names, layer.name())
+	}
+	return strings.Join(names, "+")
+}
+
+// Returns the media type with the format of the converters.
+func (s Converters) mediaType() string {
+	return mime.FormatMediaType(ChunkMediaType, map[string]string{"format": s.format()})
+}
+
+// ParseChunkFormat returns converters for a format like "zstd", "plain" or
+// "zstd+aes-256-gcm". The password is used for encryption layers.
+func ParseChunkFormat(format, password string) (Converters, error) {
+	var s Converters
+	if format == plainChunkFormat {
+		return s, nil
+	}
+	for _, name := range strings.Split(format, "+") {
+		switch name {
+		case compressorName:
+			s = append(s, Compressor{})
+		case aesGCMName:
+			if password == "" {
+				return nil, fmt.Errorf("chunk format %q requires an encryption password", format)
+			}
+			s = append(s, NewAESGCMEncryptor(password))
+		default:
+			return nil, fmt.Errorf("unsupported chunk format %q", format)
+		}
+	}
+	return s, nil
+}
+
 // converter is a storage data modifier layer.
 type converter interface {
 	// Convert data from it's original form to storage format.
@@ -76,15 +130,25 @@ type converter interface {
 	fromStorage([]byte) ([]byte, error)
 
 	equal(converter) bool
+
+	// Name of the layer used in the media type of chunks.
+	name() string
 }
 
+const compressorName = "zstd"
+
 // Compression layer
-type Compressor struct{}
+type Compressor struct {
+	// zstd compression level from 1 (fastest) to 22 (best), or 0 for the
+	// default. It only affects writing, chunks compressed with any level can
+	// be read.
+	Level int
+}
 
 var _ converter = Compressor{}
 
 func (d Compressor) toStorage(in []byte) ([]byte, error) {
-	return Compress(in)
+	return CompressLevel(in, d.Level)
 }
 
 func (d Compressor) fromStorage(in []byte) ([]byte, error) {
@@ -92,6 +156,10 @@ func (d Compressor) fromStorage(in []byte) ([]byte, error) {
 }
 
 func (d Compressor) equal(c converter) bool {
-	_, ok := c.(Compressor)
-	return ok
+	other, ok := c.(Compressor)
+	return ok && d.Level == other.Level
+}
+
+func (d Compressor) name() string {
+	return compressorName
 }
@@ -80,6 +80,9 @@ func (q *DedupQueue) String() string { return q.store.String() }
 
 func (q *DedupQueue) Close() error { return q.store.Close() }
 
+// Unwrap returns the store requests are sent to.
+func (q *DedupQueue) Unwrap() Store { return q.store }
+
 // queue manages the in-flight requests
 type queue struct {
 	requests map[ChunkID]*request
@@ -89,3 +89,44 @@ func TestDedupQueueParallel(t *testing.T) {
 		t.Fatalf("%d requests to the store; want 1", requests)
 	}
 }
+
+func TestDedupQueueHasChunkParallel(t *testing.T) {
+	// Make a store that counts the requests to it and blocks until released
+	var requests int64
+	release := make(chan struct{})
+	store := &TestStore{
+		HasChunkFunc: func(ChunkID) (bool, error) {
+			atomic.AddInt64(&requests, 1)
+			<-release
+			return true, nil
+		},
+	}
+	q := NewDedupQueue(store)
+
+	// Start several goroutines all probing for the same chunk
+	var wg sync.WaitGroup
+	results := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hasChunk, _ := q.HasChunk(ChunkID{0})
+			results <- hasChunk
+		}()
+	}
+
+	// Give all goroutines time to queue up behind the first request
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for hasChunk := range results {
+		if !hasChunk {
+			t.Fatal("HasChunk() = false; want true")
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("%d requests to the store; want 1", requests)
+	}
+}
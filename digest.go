@@ -1,13 +1,19 @@
 package desync
 
 import (
+	"context"
 	"crypto"
 	"crypto/sha256"
 	"crypto/sha512"
+	"fmt"
 )
 
-// Digest algorithm used globally for all chunk hashing. Can be set to SHA512256
-// (default) or to SHA256.
+// Digest algorithm used for chunk hashing where no other algorithm is set. Can
+// be set to SHA512256 (default) or to SHA256. Indexes read from files use the
+// algorithm they were created with, stores use the one in their options, and
+// chunking uses the one in the context (see WithDigest). Setting the algorithm
+// in those places instead of here allows using different algorithms
+// concurrently.
 var Digest HashAlgorithm = SHA512256{}
 
 // HashAlgorithm is a digest algorithm used to hash chunks.
@@ -27,3 +33,76 @@ type SHA256 struct{}
 
 func (h SHA256) Sum(data []byte) [32]byte { return sha256.Sum256(data) }
 func (h SHA256) Algorithm() crypto.Hash   { return crypto.SHA256 }
+
+// DigestByName returns the hash algorithm for its name, "sha512-256" or
+// "sha256". An empty name returns nil, which stands for the global Digest.
+func DigestByName(name string) (HashAlgorithm, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "sha512-256":
+		return SHA512256{}, nil
+	case "sha256":
+		return SHA256{}, nil
+	default:
+		return nil, fmt.Errorf("invalid digest algorithm '%s'", name)
+	}
+}
+
+// Returns h, or the global Digest if h is nil.
+func digestOrDefault(h HashAlgorithm) HashAlgorithm {
+	if h == nil {
+		return Digest
+	}
+	return h
+}
+
+// Returns the hash algorithm indicated by the feature flags of an index.
+func digestFromFlags(flags uint64) HashAlgorithm {
+	if flags&CaFormatSHA512256 != 0 {
+		return SHA512256{}
+	}
+	return SHA256{}
+}
+
+// Returns the feature flag for the hash algorithm to be set in an index.
+func digestFlag(h HashAlgorithm) uint64 {
+	if h.Algorithm() == crypto.SHA512_256 {
+		return CaFormatSHA512256
+	}
+	return 0
+}
+
+// Returns DigestMismatch if the feature flags of an index indicate a different
+// hash algorithm than h.
+func checkDigestFlags(h HashAlgorithm, flags uint64) error {
+	switch h.Algorithm() {
+	case crypto.SHA512_256:
+		if flags&CaFormatSHA512256 == 0 {
+			return DigestMismatch{Index: crypto.SHA256, Expected: crypto.SHA512_256}
+		}
+	case crypto.SHA256:
+		if flags&CaFormatSHA512256 != 0 {
+			return DigestMismatch{Index: crypto.SHA512_256, Expected: crypto.SHA256}
+		}
+	}
+	return nil
+}
+
+type digestContextKey struct{}
+
+// WithDigest returns a context that carries the hash algorithm to be used by
+// operations like IndexFromFile, IndexFromStream or ChunkStream that hash chunks
+// without an index or store to take the algorithm from.
+func WithDigest(ctx context.Context, h HashAlgorithm) context.Context {
+	return context.WithValue(ctx, digestContextKey{}, h)
+}
+
+// DigestFromContext returns the hash algorithm set in the context with
+// WithDigest, or the global Digest if there is none.
+func DigestFromContext(ctx context.Context) HashAlgorithm {
+	if h, ok := ctx.Value(digestContextKey{}).(HashAlgorithm); ok && h != nil {
+		return h
+	}
+	return Digest
+}
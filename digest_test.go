@@ -0,0 +1,78 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestPerOperation(t *testing.T) {
+	data := make([]byte, 4*ChunkSizeMaxDefault)
+	rand.Read(data)
+
+	// Chunk the same data into SHA256 and SHA512-256 stores concurrently
+	type result struct {
+		idx Index
+		dir string
+		err error
+	}
+	chunk := func(h HashAlgorithm, digest string) chan result {
+		res := make(chan result, 1)
+		go func() {
+			dir := t.TempDir()
+			s, err := NewLocalStore(dir, StoreOptions{Digest: digest})
+			if err != nil {
+				res <- result{err: err}
+				return
+			}
+			c, err := NewChunker(bytes.NewReader(data), ChunkSizeMinDefault, ChunkSizeAvgDefault, ChunkSizeMaxDefault)
+			if err != nil {
+				res <- result{err: err}
+				return
+			}
+			idx, err := ChunkStream(WithDigest(context.Background(), h), c, s, 4)
+			res <- result{idx, dir, err}
+		}()
+		return res
+	}
+	c256, c512 := chunk(SHA256{}, "sha256"), chunk(SHA512256{}, "sha512-256")
+	r256, r512 := <-c256, <-c512
+	require.NoError(t, r256.err)
+	require.NoError(t, r512.err)
+
+	require.Equal(t, uint64(0), r256.idx.Index.FeatureFlags&CaFormatSHA512256)
+	require.NotEqual(t, uint64(0), r512.idx.Index.FeatureFlags&CaFormatSHA512256)
+	require.NoError(t, r256.idx.Validate())
+	require.NoError(t, r512.idx.Validate())
+	require.Equal(t, ChunkID(SHA256{}.Sum(data[:r256.idx.Chunks[0].Size])), r256.idx.Chunks[0].ID)
+
+	// Read the SHA256 index back without a global setting, the algorithm is
+	// taken from the index
+	b := new(bytes.Buffer)
+	_, err := r256.idx.WriteTo(b)
+	require.NoError(t, err)
+	_, err = IndexFromReader(bytes.NewReader(b.Bytes()))
+	require.Error(t, err)
+	idx, err := IndexFromReaderWithDigest(bytes.NewReader(b.Bytes()), nil)
+	require.NoError(t, err)
+	require.Equal(t, SHA256{}, idx.Digest)
+
+	// Chunks are verified with the algorithm of the store
+	s, err := NewLocalStore(r256.dir, StoreOptions{Digest: "sha256"})
+	require.NoError(t, err)
+	for _, c := range idx.Chunks {
+		_, err := s.GetChunk(c.ID)
+		require.NoError(t, err)
+	}
+	s, err = NewLocalStore(r256.dir, StoreOptions{})
+	require.NoError(t, err)
+	_, err = s.GetChunk(idx.Chunks[0].ID)
+	require.Error(t, err)
+
+	// Invalid algorithms are rejected when the store is created
+	_, err = NewLocalStore(r256.dir, StoreOptions{Digest: "md5"})
+	require.Error(t, err)
+}
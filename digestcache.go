@@ -0,0 +1,68 @@
+package desync
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+)
+
+// Number of verified chunks remembered by the digest cache used in AssembleFile.
+const assembleDigestCacheSize = 4096
+
+type digestCacheKey struct {
+	id  ChunkID
+	sum uint64
+}
+
+// digestCache remembers recently verified chunks by their ID and a fast,
+// non-cryptographic hash of their data. Verifying the same data for a chunk
+// again, like for chunks that appear many times in a blob, then only needs the
+// fast hash instead of the chunk digest. The least recently used entries are
+// dropped once the cache is full.
+type digestCache struct {
+	h     HashAlgorithm
+	seed  maphash.Seed
+	max   int
+	mu    sync.Mutex
+	lru   *list.List
+	elems map[digestCacheKey]*list.Element
+}
+
+func newDigestCache(max int, h HashAlgorithm) *digestCache {
+	return &digestCache{
+		h:     h,
+		seed:  maphash.MakeSeed(),
+		max:   max,
+		lru:   list.New(),
+		elems: make(map[digestCacheKey]*list.Element),
+	}
+}
+
+// verify returns true if b is the data of the chunk with the given ID.
+func (c *digestCache) verify(id ChunkID, b []byte) bool {
+	key := digestCacheKey{id: id, sum: maphash.Bytes(c.seed, b)}
+	c.mu.Lock()
+	if e, ok := c.elems[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return true
+	}
+	c.mu.Unlock()
+
+	if c.h.Sum(b) != id {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.elems[key]; ok {
+		return true
+	}
+	c.elems[key] = c.lru.PushFront(key)
+	if c.lru.Len() > c.max {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.elems, e.Value.(digestCacheKey))
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package desync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestCache(t *testing.T) {
+	dc := newDigestCache(2, Digest)
+
+	a := []byte("chunk a")
+	b := []byte("chunk b")
+	c := []byte("chunk c")
+	idA, idB, idC := Digest.Sum(a), Digest.Sum(b), Digest.Sum(c)
+
+	require.True(t, dc.verify(idA, a))
+	require.True(t, dc.verify(idA, a))
+	require.Equal(t, 1, dc.lru.Len())
+
+	// Different data for a known chunk doesn't match
+	require.False(t, dc.verify(idA, b))
+	require.Equal(t, 1, dc.lru.Len())
+
+	// The least recently used entry is dropped once it's full
+	require.True(t, dc.verify(idB, b))
+	require.True(t, dc.verify(idA, a))
+	require.True(t, dc.verify(idC, c))
+	require.Equal(t, 2, dc.lru.Len())
+	for key := range dc.elems {
+		require.NotEqual(t, idB, key.id)
+	}
+}
+
+func BenchmarkDigestCacheRepeatedChunk(b *testing.B) {
+	data := make([]byte, 64*1024)
+	id := Digest.Sum(data)
+	dc := newDigestCache(assembleDigestCacheSize, Digest)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		dc.verify(id, data)
+	}
+}
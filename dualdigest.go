@@ -0,0 +1,230 @@
+package desync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+var _ WriteStore = &DualDigestStore{}
+
+// DualDigestStore wraps a store with chunks keyed by the global Digest and makes
+// them available by their ID in another digest algorithm as well. This allows
+// one store to serve clients using SHA512-256 and SHA256 at the same time, for
+// example during a migration. The translation from the alternate to the primary
+// ID is kept in a map file next to the store. It's updated when chunks are
+// written through this store, or can be built for an existing store with
+// BuildDigestMap. Chunks can be written with either ID, they're always stored
+// with the primary one.
+type DualDigestStore struct {
+	s   Store
+	alt HashAlgorithm
+
+	mu sync.RWMutex
+	m  map[ChunkID]ChunkID // alternate ID -> primary ID
+	f  *os.File
+}
+
+// Size of a record in the digest map file, alternate followed by primary ID.
+const digestMapRecordSize = 64
+
+// NewDualDigestStore returns a store serving chunks from s by their primary ID
+// as well as their ID in the alt digest algorithm. The mapping between the two
+// is read from, and added to, mapFile.
+func NewDualDigestStore(s Store, alt HashAlgorithm, mapFile string) (*DualDigestStore, error) {
+	f, err := os.OpenFile(mapFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m, err := readDigestMap(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, mapFile)
+	}
+	return &DualDigestStore{s: s, alt: alt, m: m, f: f}, nil
+}
+
+func readDigestMap(r io.Reader) (map[ChunkID]ChunkID, error) {
+	m := make(map[ChunkID]ChunkID)
+	rec := make([]byte, digestMapRecordSize)
+	for {
+		_, err := io.ReadFull(r, rec)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF: // A partial record is left over from an interrupted write
+			return m, nil
+		default:
+			return nil, err
+		}
+		var alt, primary ChunkID
+		copy(alt[:], rec[:32])
+		copy(primary[:], rec[32:])
+		m[alt] = primary
+	}
+}
+
+// GetChunk returns a chunk by its primary or alternate ID.
+func (s *DualDigestStore) GetChunk(id ChunkID) (*Chunk, error) {
+	primary, ok := s.lookup(id)
+	if !ok {
+		return s.s.GetChunk(id)
+	}
+	chunk, err := s.s.GetChunk(primary)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ChunkMissing{id}
+		}
+		return nil, err
+	}
+	b, err := chunk.Data()
+	if err != nil {
+		return nil, err
+	}
+	// The data can't be verified against the alternate ID with the global Digest
+	return NewChunkWithID(id, b, true)
+}
+
+// HasChunk returns true if the chunk is in the store, by primary or alternate ID.
+func (s *DualDigestStore) HasChunk(id ChunkID) (bool, error) {
+	if primary, ok := s.lookup(id); ok {
+		id = primary
+	}
+	return s.s.HasChunk(id)
+}
+
+// StoreChunk verifies a chunk against either of its IDs, writes it to the
+// underlying store under its primary ID and records the alternate one.
+func (s *DualDigestStore) StoreChunk(chunk *Chunk) error {
+	ws, ok := s.s.(WriteStore)
+	if !ok {
+		return fmt.Errorf("store %s does not support writing", s.s)
+	}
+	b, err := chunk.Data()
+	if err != nil {
+		return err
+	}
+	id := chunk.ID()
+	primary := ChunkID(Digest.Sum(b))
+	alt := ChunkID(s.alt.Sum(b))
+	switch id {
+	case primary:
+	case alt:
+		// Written by a client using the alternate digest, store it under the primary ID
+		chunk, err = NewChunkWithID(primary, b, true)
+		if err != nil {
+			return err
+		}
+	default:
+		return ChunkInvalid{ID: id, Sum: primary}
+	}
+	if err := ws.StoreChunk(chunk); err != nil {
+		return err
+	}
+	return s.add(alt, primary)
+}
+
+func (s *DualDigestStore) lookup(id ChunkID) (ChunkID, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	primary, ok := s.m[id]
+	return primary, ok
+}
+
+// Records a mapping in memory and the map file, unless it's already known.
+func (s *DualDigestStore) add(alt, primary ChunkID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[alt]; ok {
+		return nil
+	}
+	if _, err := s.f.Write(append(alt[:], primary[:]...)); err != nil {
+		return err
+	}
+	s.m[alt] = primary
+	return nil
+}
+
+func (s *DualDigestStore) String() string {
+	return s.s.String()
+}
+
+// Close the map file and the underlying store.
+func (s *DualDigestStore) Close() error {
+	s.f.Close()
+	return s.s.Close()
+}
+
+// BuildDigestMap reads all chunks in a store and writes the mapping from their
+// IDs in the alt digest algorithm to their IDs in the store into mapFile, for
+// use with DualDigestStore. Chunks already in the map are skipped.
+func BuildDigestMap(ctx context.Context, s ChunkLister, alt HashAlgorithm, mapFile string, n int, pb ProgressBar) error {
+	d, err := NewDualDigestStore(s, alt, mapFile)
+	if err != nil {
+		return err
+	}
+	defer d.f.Close()
+
+	// Primary IDs that are already mapped
+	known := make(map[ChunkID]struct{}, len(d.m))
+	for _, primary := range d.m {
+		known[primary] = struct{}{}
+	}
+
+	// Build the list of chunks that still need to be mapped
+	var ids []ChunkID
+	err = s.ListChunks(ctx, func(id ChunkID) error {
+		if _, ok := known[id]; !ok {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if n < 1 {
+		n = 1
+	}
+	pb.SetTotal(int64(len(ids)))
+	pb.Start()
+	defer pb.Finish()
+
+	in := make(chan ChunkID)
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for id := range in {
+				chunk, err := s.GetChunk(id)
+				if err != nil {
+					return err
+				}
+				b, err := chunk.Data()
+				if err != nil {
+					return err
+				}
+				if err := d.add(alt.Sum(b), id); err != nil {
+					return err
+				}
+				pb.Increment()
+			}
+			return nil
+		})
+	}
+
+	// Feed the chunk IDs to the workers
+loop:
+	for _, id := range ids {
+		select {
+		case <-ctx.Done():
+			break loop
+		case in <- id:
+		}
+	}
+	close(in)
+	return g.Wait()
+}
@@ -0,0 +1,92 @@
+package desync
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDualDigestStore(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "map")
+	s := &TestStore{}
+	d, err := NewDualDigestStore(s, SHA256{}, mapFile)
+	require.NoError(t, err)
+
+	// Store a chunk with the primary ID, then read it back with either ID
+	data1 := []byte("chunk written by primary ID")
+	primary1 := ChunkID(Digest.Sum(data1))
+	alt1 := ChunkID(SHA256{}.Sum(data1))
+	require.NoError(t, d.StoreChunk(NewChunk(data1)))
+
+	chunk, err := d.GetChunk(alt1)
+	require.NoError(t, err)
+	require.Equal(t, alt1, chunk.ID())
+	b, err := chunk.Data()
+	require.NoError(t, err)
+	require.Equal(t, data1, b)
+
+	hasChunk, err := d.HasChunk(alt1)
+	require.NoError(t, err)
+	require.True(t, hasChunk)
+	hasChunk, err = d.HasChunk(primary1)
+	require.NoError(t, err)
+	require.True(t, hasChunk)
+
+	// Store a chunk with the alternate ID, it needs to end up under the primary one
+	data2 := []byte("chunk written by alternate ID")
+	primary2 := ChunkID(Digest.Sum(data2))
+	alt2 := ChunkID(SHA256{}.Sum(data2))
+	chunk, err = NewChunkWithID(alt2, data2, true)
+	require.NoError(t, err)
+	require.NoError(t, d.StoreChunk(chunk))
+	require.Contains(t, s.Chunks, primary2)
+	require.NotContains(t, s.Chunks, alt2)
+
+	// Chunks that match neither ID are rejected
+	chunk, err = NewChunkWithID(ChunkID{1}, data2, true)
+	require.NoError(t, err)
+	require.ErrorIs(t, d.StoreChunk(chunk), ErrCorrupt)
+
+	// Unknown chunks are reported as missing
+	_, err = d.GetChunk(ChunkID{2})
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, d.Close())
+
+	// The mapping is persisted in the file
+	d, err = NewDualDigestStore(s, SHA256{}, mapFile)
+	require.NoError(t, err)
+	defer d.Close()
+	for alt, primary := range map[ChunkID]ChunkID{alt1: primary1, alt2: primary2} {
+		id, ok := d.lookup(alt)
+		require.True(t, ok)
+		require.Equal(t, primary, id)
+	}
+}
+
+func TestBuildDigestMap(t *testing.T) {
+	s, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	var data [][]byte
+	for _, str := range []string{"one", "two", "three"} {
+		b := []byte(str)
+		data = append(data, b)
+		require.NoError(t, s.StoreChunk(NewChunk(b)))
+	}
+
+	mapFile := filepath.Join(t.TempDir(), "map")
+	require.NoError(t, BuildDigestMap(context.Background(), s, SHA256{}, mapFile, 2, NewProgressBar("")))
+
+	// All chunks can now be read by their alternate ID
+	d, err := NewDualDigestStore(s, SHA256{}, mapFile)
+	require.NoError(t, err)
+	defer d.Close()
+	for _, b := range data {
+		chunk, err := d.GetChunk(SHA256{}.Sum(b))
+		require.NoError(t, err)
+		got, err := chunk.Data()
+		require.NoError(t, err)
+		require.Equal(t, b, got)
+	}
+}
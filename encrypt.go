@@ -0,0 +1,110 @@
+package desync
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// AESGCMEncryptor is a converter layer that encrypts chunk and index data with
+// AES-256-GCM. A master key is derived from the password with scrypt. Every
+// object is encrypted with its own key, derived from the master key and a
+// random salt with HKDF, and a random nonce. Salt and nonce are stored in
+// front of the ciphertext.
+type AESGCMEncryptor struct {
+	key [32]byte
+}
+
+var _ converter = AESGCMEncryptor{}
+
+const aesGCMName = "aes-256-gcm"
+
+const (
+	// Length of the random salt stored with each encrypted object
+	aesGCMSaltSize = 16
+	// Length of the GCM nonce
+	aesGCMNonceSize = 12
+)
+
+// scrypt parameters for deriving the master key. The salt is fixed since the
+// same password needs to produce the same master key on all clients of a
+// store, the per-object salt is applied with HKDF.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var scryptSalt = []byte("desync aes-256-gcm master key")
+
+// Master keys by password. Deriving a key with scrypt is expensive on purpose,
+// so it's only done once per password.
+var aesGCMKeys sync.Map
+
+// NewAESGCMEncryptor returns an encryption layer using a key derived from the
+// given password.
+func NewAESGCMEncryptor(password string) AESGCMEncryptor {
+	if key, ok := aesGCMKeys.Load(password); ok {
+		return AESGCMEncryptor{key: key.([32]byte)}
+	}
+	var key [32]byte
+	// Can't fail with valid parameters
+	b, _ := scrypt.Key([]byte(password), scryptSalt, scryptN, scryptR, scryptP, len(key))
+	copy(key[:], b)
+	aesGCMKeys.Store(password, key)
+	return AESGCMEncryptor{key: key}
+}
+
+// Returns the AEAD for an object encrypted with the given salt.
+func (e AESGCMEncryptor) aead(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, e.key[:], salt, []byte(aesGCMName)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e AESGCMEncryptor) toStorage(in []byte) ([]byte, error) {
+	header := make([]byte, aesGCMSaltSize+aesGCMNonceSize, aesGCMSaltSize+aesGCMNonceSize+len(in)+16)
+	if _, err := rand.Read(header); err != nil {
+		return nil, err
+	}
+	aead, err := e.aead(header[:aesGCMSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, header[aesGCMSaltSize:], in, nil), nil
+}
+
+func (e AESGCMEncryptor) fromStorage(in []byte) ([]byte, error) {
+	if len(in) < aesGCMSaltSize+aesGCMNonceSize {
+		return nil, errors.New("encrypted data too short")
+	}
+	aead, err := e.aead(in[:aesGCMSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	nonce := in[aesGCMSaltSize : aesGCMSaltSize+aesGCMNonceSize]
+	return aead.Open(nil, nonce, in[aesGCMSaltSize+aesGCMNonceSize:], nil)
+}
+
+func (e AESGCMEncryptor) equal(c converter) bool {
+	other, ok := c.(AESGCMEncryptor)
+	return ok && bytes.Equal(e.key[:], other.key[:])
+}
+
+func (e AESGCMEncryptor) name() string {
+	return aesGCMName
+}
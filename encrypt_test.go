@@ -0,0 +1,63 @@
+package desync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocalStore(dir, StoreOptions{EncryptionPassword: "secret"})
+	require.NoError(t, err)
+
+	data := []byte("some chunk data")
+	chunk := NewChunk(data)
+	require.NoError(t, s.StoreChunk(chunk))
+
+	// Read it back with the same password
+	c, err := s.GetChunk(chunk.ID())
+	require.NoError(t, err)
+	b, err := c.Data()
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+
+	// The wrong password should fail to decrypt the chunk
+	wrong, err := NewLocalStore(dir, StoreOptions{EncryptionPassword: "wrong"})
+	require.NoError(t, err)
+	_, err = wrong.GetChunk(chunk.ID())
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	// Same for a store without encryption
+	plain, err := NewLocalStore(dir, StoreOptions{})
+	require.NoError(t, err)
+	_, err = plain.GetChunk(chunk.ID())
+	require.Error(t, err)
+}
+
+func TestEncryptorNonce(t *testing.T) {
+	e := NewAESGCMEncryptor("secret")
+	in := []byte("data")
+
+	// Encrypting the same data twice should not produce the same output, and
+	// use a different salt for the key each time
+	b1, err := e.toStorage(in)
+	require.NoError(t, err)
+	b2, err := e.toStorage(in)
+	require.NoError(t, err)
+	require.NotEqual(t, b1, b2)
+	require.NotEqual(t, b1[:aesGCMSaltSize], b2[:aesGCMSaltSize])
+
+	// The data can't be decrypted with a modified salt
+	b := append([]byte{}, b2...)
+	b[0] ^= 1
+	_, err = e.fromStorage(b)
+	require.Error(t, err)
+
+	out, err := e.fromStorage(b1)
+	require.NoError(t, err)
+	require.Equal(t, in, out)
+
+	require.True(t, e.equal(NewAESGCMEncryptor("secret")))
+	require.False(t, e.equal(NewAESGCMEncryptor("other")))
+}
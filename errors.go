@@ -1,6 +1,86 @@
 package desync
 
-import "fmt"
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Classes of errors returned by stores. Errors returned from stores, or any of
+// the types wrapping them like Cache, StoreRouter and FailoverGroup, can be
+// tested against these with errors.Is to decide whether to retry, fail over to
+// another store, or abort.
+var (
+	// ErrNotFound means the chunk or object doesn't exist in the store
+	ErrNotFound = errors.New("not found")
+
+	// ErrUnauthorized means the credentials are missing or not sufficient
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrThrottled means the store is rate-limiting requests
+	ErrThrottled = errors.New("throttled")
+
+	// ErrTemporaryNetwork means the store could not be reached, or failed with
+	// an error that is likely to go away when retried
+	ErrTemporaryNetwork = errors.New("temporary network error")
+
+	// ErrCorrupt means the data read from the store is invalid
+	ErrCorrupt = errors.New("corrupt data")
+)
+
+// StoreError is returned by stores to attach one of the error classes above
+// to an underlying error.
+type StoreError struct {
+	Kind  error  // One of ErrNotFound, ErrUnauthorized, ErrThrottled, ErrTemporaryNetwork or ErrCorrupt
+	Store string // Name of the store
+	Err   error
+}
+
+func (e StoreError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Store, e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e StoreError) Unwrap() error { return e.Err }
+
+// Is returns true if target is the class of the error
+func (e StoreError) Is(target error) bool { return target == e.Kind }
+
+// Returns a StoreError for HTTP status codes that fall into one of the error
+// classes, or nil if the status doesn't map to any of them.
+func errorFromHTTPStatus(store string, code int, err error) error {
+	var kind error
+	switch {
+	case code == http.StatusNotFound:
+		kind = ErrNotFound
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		kind = ErrUnauthorized
+	case code == http.StatusTooManyRequests:
+		kind = ErrThrottled
+	case code >= 500 && code < 600:
+		kind = ErrTemporaryNetwork
+	default:
+		return nil
+	}
+	return StoreError{Kind: kind, Store: store, Err: err}
+}
+
+// DigestMismatch is returned when an index uses a different hash algorithm
+// than expected.
+type DigestMismatch struct {
+	Index    crypto.Hash // Algorithm used by the index
+	Expected crypto.Hash // Algorithm in use
+}
+
+func (e DigestMismatch) Error() string {
+	name := "SHA256"
+	if e.Index == crypto.SHA512_256 {
+		name = "SHA512-256"
+	}
+	return "index file uses " + name
+}
 
 // ChunkMissing is returned by a store that can't find a requested chunk
 type ChunkMissing struct {
@@ -13,13 +93,19 @@ type NoSuchObject struct {
 }
 
 func (e ChunkMissing) Error() string {
-	return fmt.Sprintf("chunk %s missing from store", e.ID)
+	return fmt.Sprintf("chunk %s missing from store", e.ID.String())
 }
 
+// Is makes ChunkMissing match ErrNotFound
+func (e ChunkMissing) Is(target error) bool { return target == ErrNotFound }
+
 func (e NoSuchObject) Error() string {
 	return fmt.Sprintf("object %s missing from store", e.location)
 }
 
+// Is makes NoSuchObject match ErrNotFound
+func (e NoSuchObject) Is(target error) bool { return target == ErrNotFound }
+
 // ChunkInvalid means the hash of the chunk content doesn't match its ID
 type ChunkInvalid struct {
 	ID  ChunkID
@@ -27,9 +113,12 @@ type ChunkInvalid struct {
 }
 
 func (e ChunkInvalid) Error() string {
-	return fmt.Sprintf("chunk id %s does not match its hash %s", e.ID, e.Sum)
+	return fmt.Sprintf("chunk id %s does not match its hash %s", e.ID.String(), e.Sum.String())
 }
 
+// Is makes ChunkInvalid match ErrCorrupt
+func (e ChunkInvalid) Is(target error) bool { return target == ErrCorrupt }
+
 // InvalidFormat is returned when an error occurred when parsing an archive file
 type InvalidFormat struct {
 	Msg string
@@ -44,3 +133,20 @@ func (e InvalidFormat) Error() string {
 type Interrupted struct{}
 
 func (e Interrupted) Error() string { return "interrupted" }
+
+// ChunksFailed is returned by AssembleFile when it's configured to continue on
+// chunk errors and one or more chunks could not be written. The listed ranges
+// of the output are incomplete.
+type ChunksFailed struct {
+	Chunks []FailedChunk
+}
+
+func (e ChunksFailed) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d chunk(s) could not be written", len(e.Chunks))
+	if len(e.Chunks) > 0 {
+		c := e.Chunks[0]
+		fmt.Fprintf(&b, ", first at offset %d: %s", c.Start, c.Err)
+	}
+	return b.String()
+}
@@ -1,6 +1,8 @@
 package desync
 
 import (
+	"sort"
+	"sync"
 	"sync/atomic"
 )
 
@@ -10,12 +12,31 @@ type ExtractStats struct {
 	ChunksFromSeeds uint64 `json:"chunks-from-seeds"`
 	ChunksFromStore uint64 `json:"chunks-from-store"`
 	ChunksInPlace   uint64 `json:"chunks-in-place"`
+	ChunksResumed   uint64 `json:"chunks-resumed"`
 	BytesCopied     uint64 `json:"bytes-copied-from-seeds"`
 	BytesCloned     uint64 `json:"bytes-cloned-from-seeds"`
+	BytesFallback   uint64 `json:"bytes-copied-after-clone-failure"`
 	Blocksize       uint64 `json:"blocksize"`
 	BytesTotal      int64  `json:"bytes-total"`
 	ChunksTotal     int    `json:"chunks-total"`
 	Seeds           int    `json:"seeds"`
+
+	// The output already matched the index according to its stamp, and
+	// nothing was written
+	Unchanged bool `json:"unchanged,omitempty"`
+
+	// Chunks that could not be written when continuing on errors
+	FailedChunks []FailedChunk `json:"failed-chunks,omitempty"`
+	mu           sync.Mutex
+}
+
+// FailedChunk describes a chunk that couldn't be written to the output, and the
+// range of the output that is incomplete because of it.
+type FailedChunk struct {
+	ID    ChunkID `json:"id"`
+	Start uint64  `json:"start"`
+	Size  uint64  `json:"size"`
+	Err   string  `json:"error"`
 }
 
 func (s *ExtractStats) incChunksFromStore() {
@@ -26,6 +47,10 @@ func (s *ExtractStats) incChunksInPlace() {
 	atomic.AddUint64(&s.ChunksInPlace, 1)
 }
 
+func (s *ExtractStats) addChunksResumed(n uint64) {
+	atomic.AddUint64(&s.ChunksResumed, n)
+}
+
 func (s *ExtractStats) addChunksFromSeed(n uint64) {
 	atomic.AddUint64(&s.ChunksFromSeeds, n)
 }
@@ -37,3 +62,25 @@ func (s *ExtractStats) addBytesCopied(n uint64) {
 func (s *ExtractStats) addBytesCloned(n uint64) {
 	atomic.AddUint64(&s.BytesCloned, n)
 }
+
+func (s *ExtractStats) addBytesFallback(n uint64) {
+	atomic.AddUint64(&s.BytesFallback, n)
+}
+
+func (s *ExtractStats) addFailedChunk(c IndexChunk, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.FailedChunks = append(s.FailedChunks, FailedChunk{ID: c.ID, Start: c.Start, Size: c.Size, Err: err.Error()})
+}
+
+// failed returns an error listing all failed chunks in order, or nil if there
+// weren't any.
+func (s *ExtractStats) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.FailedChunks) == 0 {
+		return nil
+	}
+	sort.Slice(s.FailedChunks, func(i, j int) bool { return s.FailedChunks[i].Start < s.FailedChunks[j].Start })
+	return ChunksFailed{Chunks: append([]FailedChunk{}, s.FailedChunks...)}
+}
@@ -1,6 +1,7 @@
 package desync
 
 import (
+	"errors"
 	"strings"
 	"sync"
 )
@@ -12,7 +13,7 @@ var _ Store = &FailoverGroup{}
 // from the active store, the next store in the group becomes the active one and the request retried.
 // When all stores returned a failure, the group will pass up the failure to the caller. The active store
 // rotates through all available stores. All stores in the group are expected to contain the same chunks,
-// there is no failover for missing chunks. Implements the Store interface.
+// there is no failover for missing chunks (ErrNotFound). Implements the Store interface.
 type FailoverGroup struct {
 	stores []Store
 	active int
@@ -35,7 +36,7 @@ func (g *FailoverGroup) GetChunk(id ChunkID) (*Chunk, error) {
 		}
 
 		// All stores are meant to hold the same chunks, fail on the first missing chunk
-		if _, ok := err.(ChunkMissing); ok {
+		if errors.Is(err, ErrNotFound) {
 			return b, err
 		}
 
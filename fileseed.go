@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
 // FileSeed is used to copy or clone blocks from an existing index+blob during
@@ -16,7 +20,13 @@ type FileSeed struct {
 	pos        map[ChunkID][]int
 	canReflink bool
 	isInvalid  bool
+	crcs       ChunkCRCs
 	mu         sync.RWMutex
+
+	// Offset of the first chunk found to not match the data, if known. Used to
+	// only chunk the data from there when regenerating the index.
+	invalidFrom  uint64
+	invalidKnown bool
 }
 
 // NewIndexSeed initializes a new seed that uses an existing index and its blob
@@ -41,21 +51,18 @@ func NewIndexSeed(dstFile string, srcFile string, index Index) (*FileSeed, error
 func (s *FileSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
 	s.mu.RLock()
 	// isInvalid can be concurrently read or wrote. Use a mutex to avoid a race
-	if len(chunks) == 0 || len(s.index.Chunks) == 0 || s.isInvalid {
+	invalid := s.isInvalid
+	s.mu.RUnlock()
+	if len(chunks) == 0 || len(s.index.Chunks) == 0 || invalid {
 		return 0, nil
 	}
-	s.mu.RUnlock()
 	pos, ok := s.pos[chunks[0].ID]
 	if !ok {
 		return 0, nil
 	}
 	// From every position of chunks[0] in the source, find a slice of
 	// matching chunks. Then return the longest of those slices.
-	var (
-		match []IndexChunk
-		max   int
-		limit int
-	)
+	var limit int
 	if !s.canReflink {
 		// Limit the maximum number of chunks, in a single sequence, to avoid
 		// having jobs that are too unbalanced.
@@ -63,37 +70,179 @@ func (s *FileSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
 		// take less space.
 		limit = 100
 	}
-	for _, p := range pos {
-		m := s.maxMatchFrom(chunks, p, limit)
-		if len(m) > max {
-			match = m
-			max = len(m)
-		}
-		if limit != 0 && limit == max {
-			break
-		}
+	match := longestMatchFrom(s.index.Chunks, pos, chunks, limit)
+	segment := newFileSeedSegment(s.srcFile, match, s.canReflink, s.index.digest())
+	segment.crcs = s.crcs
+	segment.seed = s
+	return len(match), segment
+}
+
+// SetChunkCRCs provides the CRCs of the chunks in the seed, to validate the
+// seed by comparing CRCs instead of chunk digests. The digest is still checked
+// for chunks with a CRC mismatch or without a known CRC.
+func (s *FileSeed) SetChunkCRCs(crcs ChunkCRCs) {
+	s.crcs = crcs
+}
+
+// LoadChunkCRCs reads the CRCs of the chunks in the seed from the sidecar file
+// next to the seed blob, named like the blob with ChunkCRCSuffix appended. Does
+// nothing if there is no such file.
+func (s *FileSeed) LoadChunkCRCs() error {
+	f, err := os.Open(s.srcFile + ChunkCRCSuffix)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	return max, newFileSeedSegment(s.srcFile, match, s.canReflink)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	crcs, err := ReadChunkCRCs(f)
+	if err != nil {
+		return errors.Wrap(err, f.Name())
+	}
+	s.SetChunkCRCs(crcs)
+	return nil
 }
 
+// RegenerateIndex chunks the seed data again to make the index match it. If
+// the offset of the first invalid chunk is known, the chunks before it are
+// kept and only the data from there on is chunked. The kept chunks are
+// validated again with the next plan, and the index regenerated from an
+// earlier offset if they don't match either.
 func (s *FileSeed) RegenerateIndex(ctx context.Context, n int, attempt int, seedNumber int) error {
+	s.mu.RLock()
+	from, known := s.invalidFrom, s.invalidKnown
+	s.mu.RUnlock()
+	if !known {
+		from = 0
+	}
+
+	// Keep the chunks that end before the first invalid one. Their end is a
+	// chunk boundary, chunking from there produces the same chunks as chunking
+	// the whole file.
+	keep := sort.Search(len(s.index.Chunks), func(i int) bool {
+		c := s.index.Chunks[i]
+		return c.Start+c.Size > from
+	})
+
+	f, err := os.Open(s.srcFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// The chunks before the invalid one weren't necessarily validated, and the
+	// index could be wrong altogether. Only keep those that match the data,
+	// which is a lot faster than chunking it again.
+	keep, err = s.validPrefix(ctx, f, keep, uint64(info.Size()), n)
+	if err != nil {
+		return err
+	}
+	var start uint64
+	if keep > 0 {
+		last := s.index.Chunks[keep-1]
+		start = last.Start + last.Size
+	}
+
 	chunkingPrefix := fmt.Sprintf("Attempt %d: Chunking Seed %d ", attempt, seedNumber)
-	index, _, err := IndexFromFile(ctx, s.srcFile, n, s.index.Index.ChunkSizeMin, s.index.Index.ChunkSizeAvg,
-		s.index.Index.ChunkSizeMax, NewProgressBar(chunkingPrefix))
+	r := io.NewSectionReader(f, int64(start), info.Size()-int64(start))
+	tail, _, err := IndexFromStream(WithDigest(ctx, s.index.digest()), r, nil, n, s.index.Index.ChunkSizeMin, s.index.Index.ChunkSizeAvg,
+		s.index.Index.ChunkSizeMax, NewBytesProgressBar(chunkingPrefix))
 	if err != nil {
 		return err
 	}
 
-	s.index = index
-	s.SetInvalid(false)
-	s.pos = make(map[ChunkID][]int, len(s.index.Chunks))
-	for i, c := range s.index.Chunks {
-		s.pos[c.ID] = append(s.pos[c.ID], i)
+	// Merge the kept chunks with the new ones, and update the positions of
+	// the chunks that changed
+	for _, c := range s.index.Chunks[keep:] {
+		s.pos[c.ID] = dropPositionsFrom(s.pos[c.ID], keep)
+		if len(s.pos[c.ID]) == 0 {
+			delete(s.pos, c.ID)
+		}
 	}
+	chunks := append(s.index.Chunks[:keep:keep], tail.Chunks...)
+	for i := keep; i < len(chunks); i++ {
+		chunks[i].Start += start
+		s.pos[chunks[i].ID] = append(s.pos[chunks[i].ID], i)
+	}
+	s.index.Chunks = chunks
 
+	s.mu.Lock()
+	s.invalidKnown = false
+	s.mu.Unlock()
+	s.SetInvalid(false)
 	return nil
 }
 
+// Validates the first chunks of the index in n goroutines and returns the
+// number of chunks at the start that match the data in f.
+func (s *FileSeed) validPrefix(ctx context.Context, f *os.File, chunks int, size uint64, n int) (int, error) {
+	if n < 1 {
+		n = 1
+	}
+	var (
+		mu    sync.Mutex
+		valid = chunks
+		span  = chunks/n + 1
+	)
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < chunks; i += span {
+		first, last := i, i+span
+		if last > chunks {
+			last = chunks
+		}
+		g.Go(func() error {
+			for i, c := range s.index.Chunks[first:last] {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				mu.Lock()
+				done := first+i >= valid
+				mu.Unlock()
+				if done { // an earlier chunk is already invalid
+					return nil
+				}
+				if c.Start+c.Size <= size {
+					b := make([]byte, c.Size)
+					if _, err := f.ReadAt(b, int64(c.Start)); err != nil {
+						return err
+					}
+					if s.crcs.match(c.ID, b) || s.index.digest().Sum(b) == c.ID {
+						continue
+					}
+				}
+				mu.Lock()
+				if first+i < valid {
+					valid = first + i
+				}
+				mu.Unlock()
+				return nil
+			}
+			return nil
+		})
+	}
+	return valid, g.Wait()
+}
+
+// Records that the chunk at the given offset doesn't match the seed data.
+func (s *FileSeed) invalidAt(offset uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.invalidKnown || offset < s.invalidFrom {
+		s.invalidFrom = offset
+		s.invalidKnown = true
+	}
+}
+
+// Removes positions at or after p from a sorted list of positions.
+func dropPositionsFrom(pos []int, p int) []int {
+	i := sort.SearchInts(pos, p)
+	return pos[:i]
+}
+
 func (s *FileSeed) SetInvalid(value bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -106,9 +255,26 @@ func (s *FileSeed) IsInvalid() bool {
 	return s.isInvalid
 }
 
+// Returns the longest slice of chunks from the seed that matches chunks from
+// position 0, trying each of the given positions in the seed. A "limit" value
+// of zero means that there is no limit.
+func longestMatchFrom(seed []IndexChunk, pos []int, chunks []IndexChunk, limit int) []IndexChunk {
+	var match []IndexChunk
+	for _, p := range pos {
+		m := maxMatchFrom(seed, chunks, p, limit)
+		if len(m) > len(match) {
+			match = m
+		}
+		if limit != 0 && limit == len(match) {
+			break
+		}
+	}
+	return match
+}
+
 // Returns a slice of chunks from the seed. Compares chunks from position 0
 // with seed chunks starting at p. A "limit" value of zero means that there is no limit.
-func (s *FileSeed) maxMatchFrom(chunks []IndexChunk, p int, limit int) []IndexChunk {
+func maxMatchFrom(seed []IndexChunk, chunks []IndexChunk, p int, limit int) []IndexChunk {
 	if len(chunks) == 0 {
 		return nil
 	}
@@ -120,16 +286,16 @@ func (s *FileSeed) maxMatchFrom(chunks []IndexChunk, p int, limit int) []IndexCh
 		if limit != 0 && sp == limit {
 			break
 		}
-		if dp >= len(s.index.Chunks) || sp >= len(chunks) {
+		if dp >= len(seed) || sp >= len(chunks) {
 			break
 		}
-		if chunks[sp].ID != s.index.Chunks[dp].ID {
+		if chunks[sp].ID != seed[dp].ID {
 			break
 		}
 		dp++
 		sp++
 	}
-	return s.index.Chunks[p:dp]
+	return seed[p:dp]
 }
 
 type fileSeedSegment struct {
@@ -137,13 +303,19 @@ type fileSeedSegment struct {
 	chunks         []IndexChunk
 	canReflink     bool
 	needValidation bool
+	crcs           ChunkCRCs
+	digest         HashAlgorithm
+
+	// Seed the segment is from, notified of chunks that don't match the data
+	seed *FileSeed
 }
 
-func newFileSeedSegment(file string, chunks []IndexChunk, canReflink bool) *fileSeedSegment {
+func newFileSeedSegment(file string, chunks []IndexChunk, canReflink bool, digest HashAlgorithm) *fileSeedSegment {
 	return &fileSeedSegment{
 		canReflink: canReflink,
 		file:       file,
 		chunks:     chunks,
+		digest:     digest,
 	}
 }
 
@@ -160,59 +332,78 @@ func (s *fileSeedSegment) Size() uint64 {
 }
 
 func (s *fileSeedSegment) WriteInto(dst *os.File, offset, length, blocksize uint64, isBlank bool) (uint64, uint64, error) {
+	copied, cloned, _, err := s.WriteIntoWithFallback(dst, offset, length, blocksize, isBlank)
+	return copied, cloned, err
+}
+
+// WriteIntoWithFallback works like WriteInto and also reports the bytes that
+// were copied because cloning them failed.
+func (s *fileSeedSegment) WriteIntoWithFallback(dst *os.File, offset, length, blocksize uint64, isBlank bool) (uint64, uint64, uint64, error) {
 	if length != s.Size() {
-		return 0, 0, fmt.Errorf("unable to copy %d bytes from %s to %s : wrong size", length, s.file, dst.Name())
+		return 0, 0, 0, fmt.Errorf("unable to copy %d bytes from %s to %s : wrong size", length, s.file, dst.Name())
 	}
 	src, err := os.Open(s.file)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 	defer src.Close()
 
 	// Do a straight copy if reflinks are not supported or blocks aren't aligned
 	if !s.canReflink || s.chunks[0].Start%blocksize != offset%blocksize {
-		return s.copy(dst, src, s.chunks[0].Start, length, offset)
+		copied, err := s.copy(dst, src, s.chunks[0].Start, length, offset)
+		return copied, 0, 0, err
 	}
 	return s.clone(dst, src, s.chunks[0].Start, length, offset, blocksize)
 }
 
 // Validate compares all chunks in this slice of the seed index to the underlying data
-// and fails if they don't match.
+// and fails if they don't match. Chunks with a known CRC are compared by CRC first.
 func (s *fileSeedSegment) Validate(file *os.File) error {
 	for _, c := range s.chunks {
 		b := make([]byte, c.Size)
 		if _, err := file.ReadAt(b, int64(c.Start)); err != nil {
+			s.invalidAt(c.Start)
 			return err
 		}
-		sum := Digest.Sum(b)
+		if s.crcs.match(c.ID, b) {
+			continue
+		}
+		sum := s.digest.Sum(b)
 		if sum != c.ID {
+			s.invalidAt(c.Start)
 			return fmt.Errorf("seed index for %s doesn't match its data", s.file)
 		}
 	}
 	return nil
 }
 
+func (s *fileSeedSegment) invalidAt(offset uint64) {
+	if s.seed != nil {
+		s.seed.invalidAt(offset)
+	}
+}
+
 // Performs a plain copy of everything in the seed to the target, not cloning
 // of blocks.
-func (s *fileSeedSegment) copy(dst, src *os.File, srcOffset, length, dstOffset uint64) (uint64, uint64, error) {
+func (s *fileSeedSegment) copy(dst, src *os.File, srcOffset, length, dstOffset uint64) (uint64, error) {
 	if _, err := dst.Seek(int64(dstOffset), os.SEEK_SET); err != nil {
-		return 0, 0, err
+		return 0, err
 	}
 	if _, err := src.Seek(int64(srcOffset), os.SEEK_SET); err != nil {
-		return 0, 0, err
+		return 0, err
 	}
 
 	// Copy using a fixed buffer. Using io.Copy() with a LimitReader will make it
 	// create a buffer matching N of the LimitReader which can be too large
 	copied, err := io.CopyBuffer(dst, io.LimitReader(src, int64(length)), make([]byte, 64*1024))
-	return uint64(copied), 0, err
+	return uint64(copied), err
 }
 
 // Reflink the overlapping blocks in the two ranges and copy the bit before and
-// after the blocks.
-func (s *fileSeedSegment) clone(dst, src *os.File, srcOffset, srcLength, dstOffset, blocksize uint64) (uint64, uint64, error) {
+// after the blocks. If the blocks can't be cloned, they're copied instead.
+func (s *fileSeedSegment) clone(dst, src *os.File, srcOffset, srcLength, dstOffset, blocksize uint64) (uint64, uint64, uint64, error) {
 	if srcOffset%blocksize != dstOffset%blocksize {
-		return 0, 0, fmt.Errorf("reflink ranges not aligned between %s and %s", src.Name(), dst.Name())
+		return 0, 0, 0, fmt.Errorf("reflink ranges not aligned between %s and %s", src.Name(), dst.Name())
 	}
 
 	srcAlignStart := (srcOffset/blocksize + 1) * blocksize
@@ -223,17 +414,26 @@ func (s *fileSeedSegment) clone(dst, src *os.File, srcOffset, srcLength, dstOffs
 
 	// fill the area before the first aligned block
 	var copied uint64
-	c1, _, err := s.copy(dst, src, srcOffset, srcAlignStart-srcOffset, dstOffset)
+	c1, err := s.copy(dst, src, srcOffset, srcAlignStart-srcOffset, dstOffset)
 	if err != nil {
-		return c1, 0, err
+		return c1, 0, 0, err
 	}
 	copied += c1
 	// fill the area after the last aligned block
-	c2, _, err := s.copy(dst, src, srcAlignEnd, srcOffset+srcLength-srcAlignEnd, dstAlignEnd)
+	c2, err := s.copy(dst, src, srcAlignEnd, srcOffset+srcLength-srcAlignEnd, dstAlignEnd)
 	if err != nil {
-		return copied + c2, 0, err
+		return copied + c2, 0, 0, err
 	}
 	copied += c2
-	// close the aligned blocks
-	return copied, alignLength, CloneRange(dst, src, srcAlignStart, alignLength, dstAlignStart)
+	// close the aligned blocks, or copy them if that fails
+	cloneErr := CloneRange(dst, src, srcAlignStart, alignLength, dstAlignStart)
+	if cloneErr == nil {
+		return copied, alignLength, 0, nil
+	}
+	Log.WithError(cloneErr).WithField("seed", s.file).Debug("cloning failed, copying blocks instead")
+	c3, err := s.copy(dst, src, srcAlignStart, alignLength, dstAlignStart)
+	if err != nil {
+		return copied + c3, 0, c3, errors.Wrapf(err, "copying blocks after %s", cloneErr)
+	}
+	return copied + c3, 0, c3, nil
 }
@@ -0,0 +1,102 @@
+package desync
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSeedSegmentCloneFallback(t *testing.T) {
+	dir := t.TempDir()
+	const blocksize = 4096
+
+	// Seed with a single chunk covering several blocks, not starting on a block
+	// boundary
+	data := make([]byte, 5*blocksize)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	seedFile := filepath.Join(dir, "seed")
+	require.NoError(t, ioutil.WriteFile(seedFile, data, 0644))
+	chunk := IndexChunk{ID: Digest.Sum(data[100 : 4*blocksize]), Start: 100, Size: 4*blocksize - 100}
+
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	require.NoError(t, err)
+	defer dst.Close()
+	require.NoError(t, dst.Truncate(int64(len(data))))
+
+	// Force the segment to clone. On filesystems without reflink support the
+	// blocks are copied instead, on others they're cloned.
+	segment := newFileSeedSegment(seedFile, []IndexChunk{chunk}, true, Digest)
+	copied, cloned, fallback, err := segment.WriteIntoWithFallback(dst, chunk.Start, chunk.Size, blocksize, true)
+	require.NoError(t, err)
+	require.Equal(t, chunk.Size, copied+cloned)
+	require.Equal(t, uint64(3*blocksize), cloned+fallback)
+
+	b := make([]byte, chunk.Size)
+	_, err = dst.ReadAt(b, int64(chunk.Start))
+	require.NoError(t, err)
+	require.Equal(t, data[chunk.Start:chunk.Start+chunk.Size], b)
+}
+
+func TestFileSeedRegenerateIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	data := make([]byte, 16*ChunkSizeMaxDefault)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	seedFile := filepath.Join(dir, "seed")
+	require.NoError(t, ioutil.WriteFile(seedFile, data, 0644))
+	index := func() Index {
+		idx, _, err := IndexFromFile(context.Background(), seedFile, 4,
+			ChunkSizeMinDefault, ChunkSizeAvgDefault, ChunkSizeMaxDefault, NewProgressBar(""))
+		require.NoError(t, err)
+		return idx
+	}
+	oldIndex := index()
+
+	// Change the data in the second half of the seed after it was chunked
+	_, err = rand.Read(data[len(data)/2 : len(data)/2+100])
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(seedFile, data, 0644))
+	newIndex := index()
+
+	for name, validate := range map[string]bool{
+		"from the invalid chunk": true,
+		"whole seed":             false,
+	} {
+		t.Run(name, func(t *testing.T) {
+			seed, err := NewIndexSeed(filepath.Join(dir, "dst"), seedFile, oldIndex)
+			require.NoError(t, err)
+
+			// Validating the whole seed records the first invalid chunk
+			if validate {
+				_, segment := seed.LongestMatchWith(oldIndex.Chunks)
+				f, err := os.Open(seedFile)
+				require.NoError(t, err)
+				defer f.Close()
+				require.Error(t, segment.Validate(f))
+				require.True(t, seed.invalidKnown)
+				require.NotZero(t, seed.invalidFrom)
+			}
+			seed.SetInvalid(true)
+
+			require.NoError(t, seed.RegenerateIndex(context.Background(), 4, 1, 1))
+			require.False(t, seed.IsInvalid())
+			require.Equal(t, newIndex.Chunks, seed.index.Chunks)
+
+			// The positions point to the new chunks
+			for id, pos := range seed.pos {
+				for _, p := range pos {
+					require.Equal(t, id, seed.index.Chunks[p].ID)
+				}
+			}
+			n, _ := seed.LongestMatchWith(newIndex.Chunks)
+			require.Equal(t, len(newIndex.Chunks), n)
+		})
+	}
+}
@@ -2,10 +2,12 @@ package desync
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/bits"
 	"os"
 	"reflect"
 	"sort"
@@ -85,6 +87,8 @@ type FormatFCaps struct {
 	Data []byte
 }
 
+// FormatACLUser is used for both, access and default ACL entries. The two
+// are distinguished by the type in the header.
 type FormatACLUser struct {
 	FormatHeader
 	UID         uint64
@@ -92,6 +96,8 @@ type FormatACLUser struct {
 	Name        string
 }
 
+// FormatACLGroup is used for both, access and default ACL entries. The two
+// are distinguished by the type in the header.
 type FormatACLGroup struct {
 	FormatHeader
 	GID         uint64
@@ -135,12 +141,22 @@ type FormatTableItem struct {
 type FormatDecoder struct {
 	r       reader
 	advance io.Reader
+
+	// Stream offsets of the last element returned and the one after it
+	pos, next uint64
 }
 
 func NewFormatDecoder(r io.Reader) FormatDecoder {
 	return FormatDecoder{r: reader{r}}
 }
 
+// NewFormatDecoderContext returns a decoder that stops reading from r once the
+// context is cancelled. Any read from the stream, including reads from payload
+// readers returned by Next, then fails with Interrupted.
+func NewFormatDecoderContext(ctx context.Context, r io.Reader) FormatDecoder {
+	return NewFormatDecoder(contextReader{ctx: ctx, r: r})
+}
+
 // Next returns the next format element from the stream. If an element
 // contains a reader, that reader should be used before any subsequent calls as
 // it'll be invalidated then. Returns nil when the end is reached.
@@ -158,6 +174,8 @@ func (d *FormatDecoder) Next() (interface{}, error) {
 		}
 		return nil, err
 	}
+	d.pos = d.next
+	d.next += hdr.Size
 	switch hdr.Type {
 	case CaFormatEntry:
 		if hdr.Size != 64 {
@@ -278,7 +296,7 @@ func (d *FormatDecoder) Next() (interface{}, error) {
 		}
 		return FormatFCaps{FormatHeader: hdr, Data: b}, nil
 
-	case CaFormatACLUser:
+	case CaFormatACLUser, CaFormatACLDefaultUser:
 		e := FormatACLUser{FormatHeader: hdr}
 		e.UID, err = d.r.ReadUint64()
 		if err != nil {
@@ -297,7 +315,7 @@ func (d *FormatDecoder) Next() (interface{}, error) {
 		e.Name = string(b)
 		return e, nil
 
-	case CaFormatACLGroup:
+	case CaFormatACLGroup, CaFormatACLDefaultGroup:
 		e := FormatACLGroup{FormatHeader: hdr}
 		e.GID, err = d.r.ReadUint64()
 		if err != nil {
@@ -626,23 +644,17 @@ func (e *FormatEncoder) Encode(v interface{}) (int64, error) {
 }
 
 // Create a balanced BST of goodbye items in catar. Modifies the input slice.
+// The output is identical to what casync produces for the same items: they're
+// sorted by hash only, and items with equal hashes stay in the order they
+// appear in the directory.
 func makeGoodbyeBST(in []FormatGoodbyeItem) []FormatGoodbyeItem {
-	// Sort the list by hash (primary) and offset (secondary)
-	sort.Slice(in, func(i, j int) bool {
-		switch {
-		case in[i].Hash < in[j].Hash:
-			return true
-		case in[i].Hash > in[j].Hash:
-			return false
-		default:
-			return in[i].Offset < in[j].Offset
-		}
+	sort.SliceStable(in, func(i, j int) bool {
+		return in[i].Hash < in[j].Hash
 	})
 
 	// Convert the sorted array into a complete BST in array representation
 	out := make([]FormatGoodbyeItem, len(in))
-	e := uint(math.Log2(float64(len(in))) + 1)
-	bst(in, out, 0, e)
+	bst(in, out, 0, uint(bits.Len(uint(len(in)))))
 	return out
 }
 
@@ -665,3 +677,53 @@ func bst(in, out []FormatGoodbyeItem, i int, e uint) {
 	bst(in[:k], out, 2*i+1, e-1)
 	bst(in[k+1:], out, 2*i+2, e-1)
 }
+
+// Confirms the items of a goodbye element form a valid BST for the entries of
+// a directory. The items are expected to be in the same format as in the
+// goodbye element, with offsets counting backwards from its start. entryOffset
+// is the distance from the start of the directory's entry to the goodbye
+// element, as recorded in the tail marker.
+func verifyGoodbye(g FormatGoodbye, items []FormatGoodbyeItem, entryOffset uint64) error {
+	if len(g.Items) != len(items)+1 {
+		return InvalidFormat{fmt.Sprintf("goodbye has %d items, directory has %d entries", len(g.Items)-1, len(items))}
+	}
+	tail := g.Items[len(g.Items)-1]
+	if tail.Offset != entryOffset || tail.Size != g.Size {
+		return InvalidFormat{fmt.Sprintf("goodbye tail marker with offset %d and size %d, expected %d and %d", tail.Offset, tail.Size, entryOffset, g.Size)}
+	}
+	tree := g.Items[:len(g.Items)-1]
+
+	// Every item needs to be within the hash range allowed by its parents
+	var walk func(i int, min, max uint64) error
+	walk = func(i int, min, max uint64) error {
+		if i >= len(tree) {
+			return nil
+		}
+		if h := tree[i].Hash; h < min || h > max {
+			return InvalidFormat{fmt.Sprintf("goodbye item %d with hash %016x out of order", i, h)}
+		}
+		if err := walk(2*i+1, min, tree[i].Hash); err != nil {
+			return err
+		}
+		return walk(2*i+2, tree[i].Hash, max)
+	}
+	if err := walk(0, 0, math.MaxUint64); err != nil {
+		return err
+	}
+
+	// The items need to point to the entries in the directory
+	less := func(l []FormatGoodbyeItem) func(i, j int) bool {
+		return func(i, j int) bool { return l[i].Offset < l[j].Offset }
+	}
+	have := append([]FormatGoodbyeItem(nil), tree...)
+	sort.Slice(have, less(have))
+	want := append([]FormatGoodbyeItem(nil), items...)
+	sort.Slice(want, less(want))
+	for i := range want {
+		if have[i] != want[i] {
+			return InvalidFormat{fmt.Sprintf("goodbye item with offset %d, size %d and hash %016x doesn't match directory entry with offset %d, size %d and hash %016x",
+				have[i].Offset, have[i].Size, have[i].Hash, want[i].Offset, want[i].Size, want[i].Hash)}
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package desync
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
 	"reflect"
@@ -204,3 +205,56 @@ func TestGoodbyeBST(t *testing.T) {
 		t.Fatal("BST doesn't match expected")
 	}
 }
+
+// Items with the same hash keep their order, like in casync.
+func TestGoodbyeBSTEqualHashes(t *testing.T) {
+	in := []FormatGoodbyeItem{
+		{Offset: 0x30, Hash: 0x2},
+		{Offset: 0x20, Hash: 0x1},
+		{Offset: 0x10, Hash: 0x1},
+	}
+	expected := []FormatGoodbyeItem{
+		{Offset: 0x10, Hash: 0x1},
+		{Offset: 0x20, Hash: 0x1},
+		{Offset: 0x30, Hash: 0x2},
+	}
+
+	out := makeGoodbyeBST(in)
+
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("BST doesn't match expected: %v", out)
+	}
+}
+
+func TestFormatDecoderInterrupted(t *testing.T) {
+	f, err := os.Open("testdata/flat.catar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := NewFormatDecoderContext(ctx, f)
+
+	// Advance to the first payload, then cancel before reading it
+	for {
+		v, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil {
+			t.Fatal("no payload found in archive")
+		}
+		if p, ok := v.(FormatPayload); ok {
+			cancel()
+			if _, err := ioutil.ReadAll(p.Data); err != (Interrupted{}) {
+				t.Fatalf("expected Interrupted reading payload, got %v", err)
+			}
+			break
+		}
+	}
+	if _, err := d.Next(); err != (Interrupted{}) {
+		t.Fatalf("expected Interrupted, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package desync
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SpaceCheck defines how AssembleFile checks that there's enough free space
+// for the output before writing to it.
+type SpaceCheck int
+
+const (
+	// Don't check the free space. This is the default.
+	SpaceCheckNone SpaceCheck = iota
+
+	// Require free space for all the data that's added to the output.
+	SpaceCheckFull
+
+	// Like SpaceCheckFull, but don't count null chunks in new or empty
+	// outputs. They're not written but left as holes in sparse files.
+	SpaceCheckSparse
+)
+
+// InsufficientSpace is returned when the filesystem doesn't have enough free
+// space for an operation.
+type InsufficientSpace struct {
+	Path      string
+	Required  uint64
+	Available uint64
+}
+
+func (e InsufficientSpace) Error() string {
+	return fmt.Sprintf("not enough space in %s, need %d bytes but only %d are available", e.Path, e.Required, e.Available)
+}
+
+// Returned by freeSpace on platforms where it's not implemented.
+var errFreeSpaceUnsupported = errors.New("free space can't be determined on this platform")
+
+// CheckFreeSpace returns InsufficientSpace if the filesystem of the directory
+// dir has less than required bytes available. If the free space can't be
+// determined, the check passes.
+func CheckFreeSpace(dir string, required uint64) error {
+	if required == 0 {
+		return nil
+	}
+	available, err := freeSpace(dir)
+	if err != nil {
+		if err != errFreeSpaceUnsupported {
+			Log.WithError(err).WithField("path", dir).Debug("unable to determine free space")
+		}
+		return nil
+	}
+	if available < required {
+		return InsufficientSpace{Path: dir, Required: required, Available: available}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package desync
+
+import "golang.org/x/sys/unix"
+
+// Returns the number of bytes available to unprivileged users in the
+// filesystem of the given path.
+func freeSpace(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.F_bavail) * uint64(st.F_bsize), nil
+}
@@ -0,0 +1,59 @@
+package desync
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, CheckFreeSpace(dir, 0))
+	require.NoError(t, CheckFreeSpace(dir, 1))
+
+	err := CheckFreeSpace(dir, 1<<62)
+	if err == nil {
+		t.Skip("free space can't be determined")
+	}
+	var e InsufficientSpace
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, uint64(1<<62), e.Required)
+}
+
+func TestAssembleFileSpaceCheck(t *testing.T) {
+	if CheckFreeSpace(t.TempDir(), 1<<62) == nil {
+		t.Skip("free space can't be determined")
+	}
+	idx := Index{
+		Index: FormatIndex{FeatureFlags: CaFormatSHA512256, ChunkSizeMin: 1, ChunkSizeAvg: 1 << 20, ChunkSizeMax: 1 << 62},
+		Chunks: []IndexChunk{
+			{ID: Digest.Sum([]byte("data")), Start: 0, Size: 1 << 62},
+		},
+	}
+	out := filepath.Join(t.TempDir(), "out")
+
+	// The output doesn't fit and isn't left behind
+	_, err := AssembleFile(context.Background(), out, idx, nil, nil, AssembleOptions{N: 1, SpaceCheck: SpaceCheckFull})
+	var e InsufficientSpace
+	require.True(t, errors.As(err, &e))
+	require.NoFileExists(t, out)
+}
+
+func TestSpaceRequired(t *testing.T) {
+	null := newNullChunk(1024, Digest)
+	idx := Index{
+		Index: FormatIndex{FeatureFlags: CaFormatSHA512256, ChunkSizeMax: 1024},
+		Chunks: []IndexChunk{
+			{ID: Digest.Sum([]byte("data")), Start: 0, Size: 100},
+			{ID: null.ID, Start: 100, Size: 1024},
+			{ID: Digest.Sum([]byte("more")), Start: 1124, Size: 200},
+		},
+	}
+	require.Equal(t, uint64(1324), spaceRequired(idx, 0, false))
+	require.Equal(t, uint64(300), spaceRequired(idx, 0, true))
+	require.Equal(t, uint64(324), spaceRequired(idx, 1000, false))
+	require.Equal(t, uint64(0), spaceRequired(idx, 2000, false))
+}
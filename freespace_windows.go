@@ -0,0 +1,17 @@
+package desync
+
+import "golang.org/x/sys/windows"
+
+// Returns the number of bytes available to the user in the filesystem of the
+// given directory.
+func freeSpace(dir string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
@@ -0,0 +1,16 @@
+package desync
+
+import "os"
+
+// SyncFile flushes the content of a file to disk.
+func SyncFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
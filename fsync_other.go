@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package desync
+
+import "os"
+
+// SyncDir flushes a directory to disk, persisting files that were created or
+// renamed in it.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,7 @@
+package desync
+
+// SyncDir is a no-op on Windows. Directories can't be synced, changes to them
+// are persisted by the filesystem.
+func SyncDir(dir string) error {
+	return nil
+}
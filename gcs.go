@@ -6,16 +6,21 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"strings"
 
 	"cloud.google.com/go/storage"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
 var _ WriteStore = GCStore{}
+var _ PruneProgressStore = GCStore{}
+var _ PruneDryRunStore = GCStore{}
+var _ ChunkLister = GCStore{}
 
 // GCStoreBase is the base object for all chunk and index stores with Google
 // Storage backing
@@ -26,6 +31,8 @@ type GCStoreBase struct {
 	prefix     string
 	opt        StoreOptions
 	converters Converters
+	layout     ChunkLayout
+	limits     *bandwidthLimits
 }
 
 // GCStore is a read-write store with Google Storage backing
@@ -55,7 +62,13 @@ func normalizeGCPrefix(path string) string {
 func NewGCStoreBase(u *url.URL, opt StoreOptions) (GCStoreBase, error) {
 	var err error
 	ctx := context.TODO()
-	s := GCStoreBase{Location: u.String(), opt: opt, converters: opt.converters()}
+	s := GCStoreBase{Location: u.String(), opt: opt, converters: opt.converters(), limits: &bandwidthLimits{}}
+	if s.layout, err = opt.chunkLayout(); err != nil {
+		return s, err
+	}
+	if _, err = DigestByName(opt.Digest); err != nil {
+		return s, err
+	}
 	if u.Scheme != "gs" {
 		return s, fmt.Errorf("invalid scheme '%s', expected 'gs'", u.Scheme)
 	}
@@ -110,23 +123,23 @@ func (s GCStore) GetChunk(id ChunkID) (*Chunk, error) {
 		return nil, ChunkMissing{ID: id}
 	} else if err != nil {
 		log.WithError(err).Error("Unable to retrieve object from GCS bucket")
-		return nil, errors.Wrap(err, s.String())
+		return nil, s.classifyError(errors.Wrap(err, s.String()))
 	}
 	defer rc.Close()
 
-	b, err := ioutil.ReadAll(rc)
+	b, err := ioutil.ReadAll(s.limits.downloadReader(rc))
 
 	if err == storage.ErrObjectNotExist {
 		log.Warning("Unable to read from object in GCS bucket; the object may not exist, or the bucket may not exist, or you may not have permission to access it")
 		return nil, ChunkMissing{ID: id}
 	} else if err != nil {
 		log.WithError(err).Error("Unable to retrieve object from GCS bucket")
-		return nil, errors.Wrap(err, fmt.Sprintf("chunk %s could not be retrieved from GCS bucket", id))
+		return nil, s.classifyError(errors.Wrap(err, fmt.Sprintf("chunk %s could not be retrieved from GCS bucket", id.String())))
 	}
 
 	log.Debug("Retrieved chunk from GCS bucket")
 
-	return NewChunkFromStorage(id, b, s.converters, s.opt.SkipVerify)
+	return newChunkFromStorage(id, b, s.converters, s.opt.SkipVerify, s.opt.digest())
 }
 
 // StoreChunk adds a new chunk to the store
@@ -154,26 +167,30 @@ func (s GCStore) StoreChunk(chunk *Chunk) error {
 		return err
 	}
 
-	r := bytes.NewReader(b)
+	r := s.limits.uploadReader(bytes.NewReader(b))
 	w := s.client.Object(name).NewWriter(ctx)
 	w.ContentType = contentType
 	_, err = io.Copy(w, r)
 
 	if err != nil {
 		log.WithError(err).Error("Error when copying data from local filesystem to object in GCS bucket")
-		return errors.Wrap(err, s.String())
+		return s.classifyError(errors.Wrap(err, s.String()))
 	}
 
 	err = w.Close()
 	if err != nil {
 		log.WithError(err).Error("Error when finalizing copying of data from local filesystem to object in GCS bucket")
-		return errors.Wrap(err, s.String())
+		return s.classifyError(errors.Wrap(err, s.String()))
 	}
 
 	log.Debug("Uploaded chunk to GCS bucket")
 	return nil
 }
 
+func (s GCStore) limitBandwidth(download, upload *BandwidthLimiter) {
+	s.limits.add(download, upload)
+}
+
 // HasChunk returns true if the chunk is in the store
 func (s GCStore) HasChunk(id ChunkID) (bool, error) {
 
@@ -194,7 +211,7 @@ func (s GCStore) HasChunk(id ChunkID) (bool, error) {
 		return false, nil
 	} else if err != nil {
 		log.WithError(err).Error("Unable to query attributes for object in GCS bucket")
-		return false, err
+		return false, s.classifyError(err)
 	} else {
 		log.WithField("exists", true).Debug("Chunk exists in GCS bucket")
 		return true, nil
@@ -202,7 +219,8 @@ func (s GCStore) HasChunk(id ChunkID) (bool, error) {
 }
 
 // RemoveChunk deletes a chunk, typically an invalid one, from the filesystem.
-// Used when verifying and repairing caches.
+// Used when verifying and repairing caches. If a trash prefix is set in the
+// options, the chunk is copied there before it's deleted.
 func (s GCStore) RemoveChunk(id ChunkID) error {
 	ctx := context.TODO()
 	name := s.nameFromID(id)
@@ -214,6 +232,14 @@ func (s GCStore) RemoveChunk(id ChunkID) error {
 		})
 	)
 
+	if s.opt.TrashPrefix != "" {
+		trash := s.opt.trashName(name)
+		if _, err := s.client.Object(trash).CopierFrom(s.client.Object(name)).Run(ctx); err != nil {
+			log.WithError(err).Error("Unable to move object to trash in GCS bucket")
+			return errors.Wrapf(err, "moving %s to trash", name)
+		}
+	}
+
 	err := s.client.Object(name).Delete(ctx)
 
 	if err != nil {
@@ -227,6 +253,30 @@ func (s GCStore) RemoveChunk(id ChunkID) error {
 
 // Prune removes any chunks from the store that are not contained in a list (map)
 func (s GCStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
+	return s.PruneWithProgress(ctx, ids, NullProgressBar{})
+}
+
+// PruneWithProgress works like Prune and reports the removed chunks to pb.
+func (s GCStore) PruneWithProgress(ctx context.Context, ids map[ChunkID]struct{}, pb ProgressBar) error {
+	list := func(ctx context.Context, fn func(ChunkID, int64) error) error {
+		return s.prune(ctx, ids, fn)
+	}
+	return pruneConcurrently(ctx, s.opt, pb, list, s.RemoveChunk)
+}
+
+// PruneDryRun returns the chunks that Prune would remove from the store, without
+// removing anything.
+func (s GCStore) PruneDryRun(ctx context.Context, ids map[ChunkID]struct{}) ([]PruneCandidate, error) {
+	var candidates []PruneCandidate
+	err := s.prune(ctx, ids, func(id ChunkID, size int64) error {
+		candidates = append(candidates, PruneCandidate{ID: id, Size: size})
+		return nil
+	})
+	return candidates, err
+}
+
+// Calls fn for every chunk in the store that is not in ids.
+func (s GCStore) prune(ctx context.Context, ids map[ChunkID]struct{}, fn func(ChunkID, int64) error) error {
 	query := &storage.Query{Prefix: s.prefix}
 	it := s.client.Objects(ctx, query)
 	for {
@@ -245,7 +295,7 @@ func (s GCStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
 
 		// Drop the chunk if it's not on the list
 		if _, ok := ids[id]; !ok {
-			if err = s.RemoveChunk(id); err != nil {
+			if err = fn(id, attrs.Size); err != nil {
 				return err
 			}
 		}
@@ -253,38 +303,54 @@ func (s GCStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
 	return nil
 }
 
-func (s GCStore) nameFromID(id ChunkID) string {
-	sID := id.String()
-	name := s.prefix + sID[0:4] + "/" + sID
-	if s.opt.Uncompressed {
-		name += UncompressedChunkExt
-	} else {
-		name += CompressedChunkExt
+// ListChunks calls fn for every chunk in the store. Objects that are not chunks
+// are skipped.
+func (s GCStore) ListChunks(ctx context.Context, fn func(ChunkID) error) error {
+	query := &storage.Query{Prefix: s.prefix}
+	it := s.client.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		id, err := s.idFromName(attrs.Name)
+		if err != nil {
+			continue
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
 	}
-	return name
+	return nil
+}
+
+func (s GCStore) nameFromID(id ChunkID) string {
+	return s.prefix + s.layout.Name(id)
 }
 
 func (s GCStore) idFromName(name string) (ChunkID, error) {
-	var n string
-	if s.opt.Uncompressed {
-		if !strings.HasSuffix(name, UncompressedChunkExt) {
-			return ChunkID{}, fmt.Errorf("object %s is not a chunk", name)
-		}
-		n = strings.TrimSuffix(strings.TrimPrefix(name, s.prefix), UncompressedChunkExt)
-	} else {
-		if !strings.HasSuffix(name, CompressedChunkExt) {
-			return ChunkID{}, fmt.Errorf("object %s is not a chunk", name)
-		}
-		n = strings.TrimSuffix(strings.TrimPrefix(name, s.prefix), CompressedChunkExt)
+	if !strings.HasPrefix(name, s.prefix) {
+		return ChunkID{}, fmt.Errorf("object %s is not a chunk", name)
 	}
-	fragments := strings.Split(n, "/")
-	if len(fragments) != 2 {
-		return ChunkID{}, fmt.Errorf("incorrect chunk name for object %s", name)
+	return s.layout.ID(strings.TrimPrefix(name, s.prefix))
+}
+
+// Attaches an error class to errors returned by the GCS client, based on the
+// HTTP status of the response.
+func (s GCStoreBase) classifyError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if sErr := errorFromHTTPStatus(s.String(), apiErr.Code, err); sErr != nil {
+			return sErr
+		}
+		return err
 	}
-	idx := fragments[0]
-	sid := fragments[1]
-	if !strings.HasPrefix(sid, idx) {
-		return ChunkID{}, fmt.Errorf("incorrect chunk name for object %s", name)
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return StoreError{Kind: ErrTemporaryNetwork, Store: s.String(), Err: err}
 	}
-	return ChunkIDFromString(sid)
+	return err
 }
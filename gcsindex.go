@@ -14,16 +14,22 @@ import (
 // GCIndexStore is a read-write index store with Google Storage backing
 type GCIndexStore struct {
 	GCStoreBase
+
+	indexConverters Converters
 }
 
 // NewGCIndexStore creates an index store with Google Storage backing. The URL
 // should be provided like this: gc://bucket/prefix
 func NewGCIndexStore(location *url.URL, opt StoreOptions) (s GCIndexStore, e error) {
+	converters, err := opt.indexConverters()
+	if err != nil {
+		return s, err
+	}
 	b, err := NewGCStoreBase(location, opt)
 	if err != nil {
 		return s, err
 	}
-	return GCIndexStore{b}, nil
+	return GCIndexStore{b, converters}, nil
 }
 
 // GetIndexReader returns a reader for an index from an Google Storage store. Fails if the specified index
@@ -49,7 +55,7 @@ func (s GCIndexStore) GetIndexReader(name string) (r io.ReadCloser, err error) {
 	}
 
 	log.Debug("Created index reader from GCS bucket")
-	return obj, nil
+	return indexReaderFromStorage(obj, s.indexConverters)
 }
 
 // GetIndex returns an Index structure from the store
@@ -59,7 +65,20 @@ func (s GCIndexStore) GetIndex(name string) (i Index, e error) {
 		return i, err
 	}
 	defer obj.Close()
-	return IndexFromReader(obj)
+	return IndexFromReaderWithDigest(obj, s.indexDigest())
+}
+
+func (s GCIndexStore) indexDigest() HashAlgorithm {
+	return s.opt.indexDigest()
+}
+
+// IndexETag returns the ETag of an index in the Google Storage store.
+func (s GCIndexStore) IndexETag(name string) (string, error) {
+	attrs, err := s.client.Object(s.prefix + name).Attrs(context.TODO())
+	if err != nil {
+		return "", errors.Wrap(err, s.String())
+	}
+	return attrs.Etag, nil
 }
 
 // StoreIndex writes the index file to the Google Storage store
@@ -76,7 +95,7 @@ func (s GCIndexStore) StoreIndex(name string, idx Index) error {
 	w := s.client.Object(s.prefix + name).NewWriter(ctx)
 	w.ContentType = "application/octet-stream"
 
-	_, err := idx.WriteTo(w)
+	err := writeIndexToStorage(w, idx, s.indexConverters)
 
 	if err != nil {
 		log.WithError(err).Error("Error when copying data from local filesystem to object in GCS bucket")
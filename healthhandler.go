@@ -0,0 +1,151 @@
+package desync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	minio "github.com/minio/minio-go/v6"
+	"github.com/pkg/errors"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	// Default time a readiness check is allowed to take
+	defaultReadyTimeout = 5 * time.Second
+)
+
+// Name of the index that's requested to check if an index store can be reached.
+const probeIndexName = "desync-probe.caibx"
+
+// HealthHandler serves liveness checks on /healthz and readiness checks on
+// /readyz. The server is live as long as it responds, but only ready if the
+// check function succeeds, typically by probing the upstream store.
+type HealthHandler struct {
+	// Checks if the server is able to handle requests. Always ready if nil.
+	Ready func() error
+
+	// Maximum time the readiness check can take before it's considered failed.
+	// Default: 5s
+	Timeout time.Duration
+}
+
+func (h HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case healthzPath:
+		fmt.Fprintln(w, "ok")
+	case readyzPath:
+		if err := h.check(r.Context()); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Runs the readiness check, giving up when it takes too long.
+func (h HealthHandler) check(ctx context.Context) error {
+	if h.Ready == nil {
+		return nil
+	}
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- h.Ready() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.New("readiness check timed out")
+	}
+}
+
+// CheckStore confirms a store can be reached by requesting a chunk from it that
+// is unlikely to be present. Unlike ProbeStore, a store reporting the chunk as
+// missing is fine while any other error is returned. Local stores are also
+// required to still have their directory.
+func CheckStore(s Store) error {
+	for st := s; st != nil; {
+		if c, ok := st.(interface{ checkReachable() error }); ok {
+			if err := c.checkReachable(); err != nil {
+				return errors.Wrapf(err, "failed to reach store %s", s)
+			}
+		}
+		u, ok := st.(interface{ Unwrap() Store })
+		if !ok {
+			break
+		}
+		st = u.Unwrap()
+	}
+	_, err := s.GetChunk(NewChunk(probeChunkData).ID())
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return errors.Wrapf(err, "failed to reach store %s", s)
+}
+
+// CheckIndexStore confirms an index store can be reached by requesting an index
+// that is unlikely to be present. The index is read completely since some
+// stores only make the request when the data is read.
+func CheckIndexStore(s IndexStore) error {
+	for st := s; st != nil; {
+		if c, ok := st.(interface{ checkReachable() error }); ok {
+			if err := c.checkReachable(); err != nil {
+				return errors.Wrapf(err, "failed to reach index store %s", s)
+			}
+		}
+		u, ok := st.(interface{ Unwrap() IndexStore })
+		if !ok {
+			break
+		}
+		st = u.Unwrap()
+	}
+	r, err := s.GetIndexReader(probeIndexName)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, r)
+		r.Close()
+	}
+	if err == nil || isIndexNotFound(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "failed to reach index store %s", s)
+}
+
+func isIndexNotFound(err error) bool {
+	if errors.Is(err, ErrNotFound) || errors.Is(err, os.ErrNotExist) || errors.Is(err, storage.ErrObjectNotExist) {
+		return true
+	}
+	var resp minio.ErrorResponse
+	return errors.As(err, &resp) && resp.Code == "NoSuchKey"
+}
+
+// Returns an error if dir doesn't exist or isn't a directory.
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package desync
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthHandler(t *testing.T) {
+	var readyErr error
+	h := HealthHandler{
+		Ready:   func() error { return readyErr },
+		Timeout: 100 * time.Millisecond,
+	}
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, get("/healthz"))
+	require.Equal(t, http.StatusOK, get("/readyz"))
+
+	// Failing readiness check, the server is still live
+	readyErr = errors.New("store unavailable")
+	require.Equal(t, http.StatusOK, get("/healthz"))
+	require.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	// Check that takes too long
+	h.Ready = func() error {
+		time.Sleep(time.Second)
+		return nil
+	}
+	require.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+}
+
+func TestCheckStore(t *testing.T) {
+	// A missing chunk means the store can be reached
+	s := &TestStore{}
+	require.NoError(t, CheckStore(s))
+
+	s.GetChunkFunc = func(ChunkID) (*Chunk, error) {
+		return nil, errors.New("connection refused")
+	}
+	require.Error(t, CheckStore(s))
+}
+
+func TestCheckStoreReachable(t *testing.T) {
+	dir := t.TempDir()
+	local, err := NewLocalStore(dir, StoreOptions{})
+	require.NoError(t, err)
+	ts := httptest.NewServer(NewHTTPHandler(local, false, false, []converter{Compressor{}}, ""))
+	u, _ := url.Parse(ts.URL)
+	remote, err := NewRemoteHTTPStore(u, StoreOptions{})
+	require.NoError(t, err)
+
+	// Both stores can be reached while the chunk is missing
+	require.NoError(t, CheckStore(local))
+	require.NoError(t, CheckStore(NewSwapStore(local)))
+	require.NoError(t, CheckStore(remote))
+
+	// Without the directory, the local store fails
+	require.NoError(t, os.RemoveAll(dir))
+	require.Error(t, CheckStore(local))
+	require.Error(t, CheckStore(NewSwapStore(local)))
+
+	// Server that's gone
+	ts.Close()
+	require.Error(t, CheckStore(remote))
+}
+
+func TestCheckIndexStoreReachable(t *testing.T) {
+	dir := t.TempDir()
+	local, err := NewLocalIndexStore(dir)
+	require.NoError(t, err)
+	ts := httptest.NewServer(NewHTTPIndexHandler(local, false, ""))
+	u, _ := url.Parse(ts.URL + "/")
+	remote, err := NewRemoteHTTPIndexStore(u, StoreOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, CheckIndexStore(local))
+	require.NoError(t, CheckIndexStore(NewSwapIndexStore(local)))
+	require.NoError(t, CheckIndexStore(remote))
+
+	require.NoError(t, os.RemoveAll(dir))
+	require.Error(t, CheckIndexStore(local))
+	require.Error(t, CheckIndexStore(NewSwapIndexStore(local)))
+
+	ts.Close()
+	require.Error(t, CheckIndexStore(remote))
+}
@@ -1,9 +1,11 @@
 package desync
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"path"
 	"strings"
@@ -20,29 +22,162 @@ type HTTPHandler struct {
 	// Storage-side of the converters in this case is towards the client
 	converters Converters
 
+	// Additional formats clients can request, and whether any of them uses a
+	// different file extension than the default
+	altConverters []Converters
+	anyExt        bool
+
 	// Use the file extension for compressed chunks
 	compressed bool
+
+	limits ChunkWriteLimits
+
+	// Answer writes of existing chunks without storing them again
+	skipExisting bool
+
+	// Path prefix the handler is mounted on, and optional authorization hook
+	prefix    string
+	authorize func(*http.Request) bool
+
+	warmer *ChunkWarmer
+	notify func(Event)
+	digest HashAlgorithm
+}
+
+// HTTPHandlerOptions configure a HTTP chunk server handler.
+type HTTPHandlerOptions struct {
+	// Allow clients to store chunks. The store needs to implement WriteStore.
+	Writable bool
+
+	// Don't verify the ID of chunks written by clients.
+	SkipVerifyWrite bool
+
+	// Converters used for chunks sent to and received from clients. Use
+	// Converters{Compressor{}} to serve compressed chunks.
+	Converters Converters
+
+	// Additional chunk formats clients can choose with the Accept header when
+	// reading, or Content-Type when writing chunks. Clients that don't ask for
+	// a format are served with Converters. Used to serve clients expecting
+	// different formats from the same endpoint.
+	AltConverters []Converters
+
+	// Expected value of the Authorization header. No check if empty.
+	Authorization string
+
+	// Optional hook to authorize requests. If set, it's used instead of
+	// comparing the Authorization header. Returning false rejects the
+	// request with 401.
+	Authorize func(*http.Request) bool
+
+	// Restrictions for chunks written by clients.
+	Limits ChunkWriteLimits
+
+	// Make writes idempotent. Chunks that are already in the store are
+	// answered with 204 No Content without reading or verifying the data,
+	// which saves a lot of work when many clients write the same chunks.
+	// Chunks that are verified and don't match their ID are rejected with
+	// 409 Conflict.
+	SkipExisting bool
+
+	// Path prefix the handler is mounted on, like "/chunks". It's removed from
+	// request paths before they're parsed with ChunkIDFromPath. Required when the
+	// handler is registered on a router without stripping the prefix.
+	Prefix string
+
+	// Optional, enables the <prefix>/warm endpoint. Clients can POST an index,
+	// or a list of chunk IDs as text/plain, to have the chunks read from the
+	// store ahead of requesting them.
+	Warmer *ChunkWarmer
+
+	// Optional, called after a chunk written by a client was stored.
+	Notify func(Event)
+
+	// Hash algorithm of the chunk IDs, used to verify chunks written by
+	// clients. The global Digest is used if nil.
+	Digest HashAlgorithm
+}
+
+// ChunkWriteLimits restrict what clients can write to an HTTP chunk store.
+type ChunkWriteLimits struct {
+	// Maximum size of the (uncompressed) chunk data. Unlimited if 0.
+	MaxSize uint64
+
+	// Reject chunks that can't be decoded in the storage format of the handler,
+	// like chunks that are not valid zstd data for a compressed store.
+	CheckFormat bool
+
+	// Verify that the chunk ID matches the digest of the data, regardless of
+	// SkipVerifyWrite.
+	VerifyDigest bool
 }
 
 // NewHTTPHandler initializes and returns a new HTTP handler for a chunks server.
 func NewHTTPHandler(s Store, writable, skipVerifyWrite bool, converters Converters, auth string) http.Handler {
-	compressed := converters.hasCompression()
-	return HTTPHandler{HTTPHandlerBase{"chunk", writable, auth}, s, skipVerifyWrite, converters, compressed}
+	return NewHTTPHandlerWithOptions(s, HTTPHandlerOptions{
+		Writable:        writable,
+		SkipVerifyWrite: skipVerifyWrite,
+		Converters:      converters,
+		Authorization:   auth,
+	})
+}
+
+// NewHTTPHandlerWithOptions initializes a HTTP handler for a chunk server. It
+// can be registered on any router, chunks are served under
+// <prefix>/<first 4 chars of ID>/<ID><ext> as built by ChunkPath.
+func NewHTTPHandlerWithOptions(s Store, opt HTTPHandlerOptions) http.Handler {
+	var anyExt bool
+	for _, c := range opt.AltConverters {
+		if c.hasCompression() != opt.Converters.hasCompression() {
+			anyExt = true
+		}
+	}
+	return HTTPHandler{
+		HTTPHandlerBase: HTTPHandlerBase{"chunk", opt.Writable, opt.Authorization},
+		altConverters:   opt.AltConverters,
+		anyExt:          anyExt,
+		s:               s,
+		SkipVerifyWrite: opt.SkipVerifyWrite,
+		converters:      opt.Converters,
+		compressed:      opt.Converters.hasCompression(),
+		limits:          opt.Limits,
+		skipExisting:    opt.SkipExisting,
+		prefix:          strings.TrimSuffix(opt.Prefix, "/"),
+		authorize:       opt.Authorize,
+		warmer:          opt.Warmer,
+		notify:          opt.Notify,
+		digest:          opt.Digest,
+	}
 }
 
 func (h HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if h.authorization != "" && r.Header.Get("Authorization") != h.authorization {
+	if !h.authorized(r) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	id, err := h.idFromPath(r.URL.Path)
+	p := r.URL.Path
+	if h.prefix != "" {
+		if !strings.HasPrefix(p, h.prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		p = strings.TrimPrefix(p, h.prefix)
+	}
+	if p == "/"+warmPath && h.warmer != nil {
+		h.warm(w, r)
+		return
+	}
+	id, err := ChunkIDFromPath(p, h.compressed)
+	if err != nil && h.anyExt {
+		id, err = ChunkIDFromPath(p, !h.compressed)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	switch r.Method {
 	case "GET":
-		h.get(id, w)
+		h.get(id, w, r)
 	case "HEAD":
 		h.head(id, w)
 	case "PUT":
@@ -53,7 +188,12 @@ func (h HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h HTTPHandler) get(id ChunkID, w http.ResponseWriter) {
+func (h HTTPHandler) get(id ChunkID, w http.ResponseWriter, r *http.Request) {
+	converters, ok := h.negotiate(r.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "requested chunk format not supported", http.StatusNotAcceptable)
+		return
+	}
 	var b []byte
 	chunk, err := h.s.GetChunk(id)
 	if err == nil {
@@ -61,18 +201,58 @@ func (h HTTPHandler) get(id ChunkID, w http.ResponseWriter) {
 		// of the chunk server. In that case it's not necessary
 		// to convert back and forth. Just use the raw data as loaded
 		// from the store.
-		if len(chunk.storage) > 0 && h.converters.equal(chunk.converters) {
+		if len(chunk.storage) > 0 && converters.equal(chunk.converters) {
 			b = chunk.storage
 		} else {
 			b, err = chunk.Data()
 			if err == nil {
-				b, err = h.converters.toStorage(b)
+				b, err = converters.toStorage(b)
 			}
 		}
 	}
+	if err == nil {
+		w.Header().Set("Content-Type", converters.mediaType())
+	}
 	h.HTTPHandlerBase.get(id.String(), b, err, w)
 }
 
+// Picks the format of a chunk sent to the client based on the Accept header.
+// Returns false if the client only accepts chunk formats that aren't served.
+func (h HTTPHandler) negotiate(accept string) (Converters, bool) {
+	var unsupported, other bool
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType != ChunkMediaType {
+			other = true
+			continue
+		}
+		if c, ok := h.convertersFor(params["format"]); ok {
+			return c, true
+		}
+		unsupported = true
+	}
+	if unsupported && !other {
+		return nil, false
+	}
+	return h.converters, true
+}
+
+// Returns the converters of the handler for a chunk format.
+func (h HTTPHandler) convertersFor(format string) (Converters, bool) {
+	if format == h.converters.format() {
+		return h.converters, true
+	}
+	for _, c := range h.altConverters {
+		if format == c.format() {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
 func (h HTTPHandler) head(id ChunkID, w http.ResponseWriter) {
 	hasChunk, err := h.s.HasChunk(id)
 	if err != nil {
@@ -100,32 +280,174 @@ func (h HTTPHandler) put(id ChunkID, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read the raw chunk data into memory
+	// Nothing to do if the chunk is already there. The content of a chunk is
+	// given by its ID, so it doesn't matter what the client sent.
+	if h.skipExisting {
+		hasChunk, err := h.s.HasChunk(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hasChunk {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	// Use the format the client sent the chunk in, if it's one we support
+	converters := h.converters
+	if mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mediaType == ChunkMediaType {
+		var ok bool
+		if converters, ok = h.convertersFor(params["format"]); !ok {
+			http.Error(w, "chunk format not supported", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	// Read the raw chunk data into memory. If there's a size limit, allow for
+	// the worst case size of incompressible data after compression.
+	body := r.Body
+	if h.limits.MaxSize > 0 {
+		body = http.MaxBytesReader(w, body, int64(h.limits.MaxSize+h.limits.MaxSize/128+1024))
+	}
 	b := new(bytes.Buffer)
-	if _, err := io.Copy(b, r.Body); err != nil {
+	if _, err := io.Copy(b, body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "chunk too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(w, err)
 		return
 	}
 
 	// Turn it into a chunk, and validate the ID unless verification is disabled
-	chunk, err := NewChunkFromStorage(id, b.Bytes(), h.converters, h.SkipVerifyWrite)
+	skipVerify := h.SkipVerifyWrite && !h.limits.VerifyDigest
+	chunk, err := newChunkFromStorage(id, b.Bytes(), converters, skipVerify, h.digest)
 	if err != nil {
+		var invalid ChunkInvalid
+		if h.skipExisting && errors.As(err, &invalid) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	// Check the content of the chunk if required
+	if h.limits.MaxSize > 0 || h.limits.CheckFormat {
+		data, err := chunk.Data()
+		if err != nil {
+			http.Error(w, "invalid chunk data: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.limits.MaxSize > 0 && uint64(len(data)) > h.limits.MaxSize {
+			http.Error(w, "chunk too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
 	// Store it upstream
 	if err := s.StoreChunk(chunk); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
+	if h.notify != nil {
+		h.notify(Event{
+			Type:   EventChunkStored,
+			Store:  h.s.String(),
+			Chunk:  id.String(),
+			Size:   int64(b.Len()),
+			Client: clientIdentity(r),
+		})
+	}
+}
+
+func (h HTTPHandler) warm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = w.Write([]byte("only POST is supported"))
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxWarmRequestSize)
+	var (
+		ids []ChunkID
+		err error
+	)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+		ids, err = readChunkIDList(body)
+	} else {
+		var idx Index
+		idx, err = IndexFromReader(body)
+		for _, c := range idx.Chunks {
+			ids = append(ids, c.ID)
+		}
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := h.warmer.Warm(ids)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "%d chunks queued\n", n)
+}
+
+func (h HTTPHandler) authorized(r *http.Request) bool {
+	if h.authorize != nil {
+		return h.authorize(r)
+	}
+	return h.authorization == "" || authorizationEqual(h.authorization, r.Header.Get("Authorization"))
+}
+
+// Path of the endpoint used to warm the store, relative to the root of the
+// store, and the maximum size of requests sent to it.
+const (
+	warmPath           = "warm"
+	maxWarmRequestSize = 64 << 20
+)
+
+// Reads chunk IDs from r, one per line. Blank lines are ignored.
+func readChunkIDList(r io.Reader) ([]ChunkID, error) {
+	var ids []ChunkID
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		id, err := ChunkIDFromString(line)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, scanner.Err()
+}
+
+// ChunkPath returns the path of a chunk in a HTTP chunk store, relative to the
+// root of the store. The layout is /<first 4 chars of ID>/<ID><ext>, with the
+// extension depending on whether the store holds compressed chunks.
+func ChunkPath(id ChunkID, compressed bool) string {
+	sID := id.String()
+	ext := UncompressedChunkExt
+	if compressed {
+		ext = CompressedChunkExt
+	}
+	return path.Join("/", sID[0:4], sID+ext)
 }
 
-func (h HTTPHandler) idFromPath(p string) (ChunkID, error) {
+// ChunkIDFromPath parses a path in the layout produced by ChunkPath and returns
+// the chunk ID. The path needs to be relative to the root of the store.
+func ChunkIDFromPath(p string, compressed bool) (ChunkID, error) {
 	ext := CompressedChunkExt
-	if !h.compressed {
+	if !compressed {
 		if strings.HasSuffix(p, CompressedChunkExt) {
 			return ChunkID{}, errors.New("compressed chunk requested from http chunk store serving uncompressed chunks")
 		}
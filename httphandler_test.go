@@ -1,8 +1,11 @@
 package desync
 
 import (
+	"bytes"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -103,3 +106,231 @@ func TestHTTPHandlerCompression(t *testing.T) {
 	_, err = unStore.GetChunk(id)
 	require.NoError(t, err)
 }
+
+func TestHTTPHandlerWriteLimits(t *testing.T) {
+	upstream, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+
+	limits := ChunkWriteLimits{MaxSize: 16, CheckFormat: true, VerifyDigest: true}
+	ts := httptest.NewServer(NewHTTPHandlerWithOptions(upstream, HTTPHandlerOptions{
+		Writable:        true,
+		SkipVerifyWrite: true,
+		Converters:      Converters{Compressor{}},
+		Limits:          limits,
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	s, err := NewRemoteHTTPStore(u, StoreOptions{ErrorRetry: 1})
+	require.NoError(t, err)
+
+	// Small chunks are accepted, large ones aren't
+	require.NoError(t, s.StoreChunk(NewChunk([]byte("small chunk"))))
+	require.Error(t, s.StoreChunk(NewChunk(bytes.Repeat([]byte{1}, 17))))
+
+	put := func(id ChunkID, b []byte) int {
+		req, err := http.NewRequest("PUT", ts.URL+"/"+s.nameFromID(id), bytes.NewReader(b))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Data that isn't compressed is rejected
+	data := []byte("not compressed")
+	id := NewChunk(data).ID()
+	require.Equal(t, http.StatusBadRequest, put(id, data))
+
+	// So is compressed data that doesn't match the ID
+	b, err := Compress(data)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, put(ChunkID{1}, b))
+	require.Equal(t, http.StatusOK, put(id, b))
+}
+
+func TestHTTPHandlerSkipExisting(t *testing.T) {
+	upstream, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(NewHTTPHandlerWithOptions(upstream, HTTPHandlerOptions{
+		Writable:     true,
+		Converters:   Converters{Compressor{}},
+		SkipExisting: true,
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	s, err := NewRemoteHTTPStore(u, StoreOptions{ErrorRetry: 1})
+	require.NoError(t, err)
+
+	put := func(id ChunkID, b []byte) int {
+		req, err := http.NewRequest("PUT", ts.URL+"/"+s.nameFromID(id), bytes.NewReader(b))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	data := []byte("some data")
+	id := NewChunk(data).ID()
+	b, err := Compress(data)
+	require.NoError(t, err)
+
+	// Chunks that don't match their ID are a conflict
+	require.Equal(t, http.StatusConflict, put(id, []byte("garbage")))
+
+	// The first write stores the chunk, later ones are skipped, even with
+	// invalid data
+	require.Equal(t, http.StatusOK, put(id, b))
+	require.Equal(t, http.StatusNoContent, put(id, b))
+	require.Equal(t, http.StatusNoContent, put(id, []byte("garbage")))
+
+	// The client treats writes of existing chunks as success
+	require.NoError(t, s.StoreChunk(NewChunk(data)))
+	out, err := upstream.GetChunk(id)
+	require.NoError(t, err)
+	got, err := out.Data()
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestHTTPHandlerWithOptions(t *testing.T) {
+	upstream, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+
+	// Mount the handler under a prefix on a mux, with a custom authorization hook
+	mux := http.NewServeMux()
+	mux.Handle("/chunks/", NewHTTPHandlerWithOptions(upstream, HTTPHandlerOptions{
+		Writable:   true,
+		Converters: Converters{Compressor{}},
+		Authorize:  func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer secret" },
+		Prefix:     "/chunks",
+	}))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL + "/chunks/")
+	s, err := NewRemoteHTTPStore(u, StoreOptions{HTTPAuth: "Bearer secret"})
+	require.NoError(t, err)
+
+	chunk := NewChunk([]byte("some data"))
+	require.NoError(t, s.StoreChunk(chunk))
+	hasChunk, err := s.HasChunk(chunk.ID())
+	require.NoError(t, err)
+	require.True(t, hasChunk)
+	out, err := s.GetChunk(chunk.ID())
+	require.NoError(t, err)
+	b, err := out.Data()
+	require.NoError(t, err)
+	require.Equal(t, []byte("some data"), b)
+
+	// The chunk path follows the exported layout
+	p := ChunkPath(chunk.ID(), true)
+	id, err := ChunkIDFromPath(p, true)
+	require.NoError(t, err)
+	require.Equal(t, chunk.ID(), id)
+	resp, err := http.Head(ts.URL + "/chunks" + p)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Clients with the wrong authorization are rejected
+	s, err = NewRemoteHTTPStore(u, StoreOptions{HTTPAuth: "Bearer wrong", ErrorRetry: 1})
+	require.NoError(t, err)
+	_, err = s.HasChunk(chunk.ID())
+	require.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestHTTPHandlerWarm(t *testing.T) {
+	upstream, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+	cache, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	index := readCaibxFile(t, "testdata/blob1.caibx")
+
+	warmer := NewChunkWarmer(NewCache(upstream, cache), 4)
+	ts := httptest.NewServer(NewHTTPHandlerWithOptions(upstream, HTTPHandlerOptions{
+		Converters: Converters{Compressor{}},
+		Warmer:     warmer,
+	}))
+	defer ts.Close()
+
+	// Send the index to the server and wait for the warmer to finish
+	u, _ := url.Parse(ts.URL)
+	s, err := NewRemoteHTTPStore(u, StoreOptions{})
+	require.NoError(t, err)
+	require.NoError(t, s.Warm(index))
+
+	// A list of chunk IDs works as well, invalid IDs are rejected
+	resp, err := http.Post(ts.URL+"/warm", "text/plain", strings.NewReader(index.Chunks[0].ID.String()+"\n"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp, err = http.Post(ts.URL+"/warm", "text/plain", strings.NewReader("invalid\n"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	require.NoError(t, warmer.Close())
+	for _, c := range index.Chunks {
+		hasChunk, err := cache.HasChunk(c.ID)
+		require.NoError(t, err)
+		require.True(t, hasChunk)
+	}
+}
+
+func TestHTTPHandlerFormatNegotiation(t *testing.T) {
+	upstream, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+
+	// Serve compressed chunks by default, and uncompressed or encrypted ones to
+	// clients asking for them
+	encrypted, err := ParseChunkFormat("aes-256-gcm", "secret")
+	require.NoError(t, err)
+	ts := httptest.NewServer(NewHTTPHandlerWithOptions(upstream, HTTPHandlerOptions{
+		Writable:      true,
+		Converters:    Converters{Compressor{}},
+		AltConverters: []Converters{nil, encrypted},
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	data := []byte("some data")
+	for _, opt := range []StoreOptions{
+		{},
+		{Uncompressed: true},
+		{Uncompressed: true, EncryptionPassword: "secret"},
+	} {
+		s, err := NewRemoteHTTPStore(u, opt)
+		require.NoError(t, err)
+		chunk := NewChunk(append(data, []byte(opt.EncryptionPassword)...))
+		require.NoError(t, s.StoreChunk(chunk))
+
+		// Read it back with all the clients
+		for _, opt := range []StoreOptions{
+			{},
+			{Uncompressed: true},
+			{Uncompressed: true, EncryptionPassword: "secret"},
+		} {
+			s, err := NewRemoteHTTPStore(u, opt)
+			require.NoError(t, err)
+			out, err := s.GetChunk(chunk.ID())
+			require.NoError(t, err)
+			b, err := out.Data()
+			require.NoError(t, err)
+			require.Equal(t, chunk.ID(), ChunkID(Digest.Sum(b)))
+		}
+	}
+
+	// Formats that aren't served are rejected
+	s, err := NewRemoteHTTPStore(u, StoreOptions{EncryptionPassword: "secret", ErrorRetry: 1})
+	require.NoError(t, err)
+	_, err = s.GetChunk(NewChunk(data).ID())
+	require.Error(t, err)
+	req, _ := http.NewRequest("PUT", ts.URL+ChunkPath(NewChunk(data).ID(), true), strings.NewReader("x"))
+	req.Header.Set("Content-Type", ChunkMediaType+"; format=unknown")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
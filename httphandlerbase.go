@@ -16,15 +16,23 @@ type HTTPHandlerBase struct {
 }
 
 func (h HTTPHandlerBase) get(id string, b []byte, err error, w http.ResponseWriter) {
-	switch err.(type) {
-	case nil:
+	switch {
+	case err == nil:
 		w.WriteHeader(http.StatusOK)
 		w.Write(b)
-	case ChunkMissing, NoSuchObject:
+	case errors.Is(err, ErrNotFound):
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "%s %s not found", h.handlerType, id)
 	default:
-		w.WriteHeader(http.StatusInternalServerError)
+		// Let clients know they can retry when the upstream store is throttling
+		// or temporarily unavailable
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrThrottled) {
+			status = http.StatusTooManyRequests
+		} else if errors.Is(err, ErrTemporaryNetwork) {
+			status = http.StatusServiceUnavailable
+		}
+		w.WriteHeader(status)
 		msg := fmt.Sprintf("failed to retrieve %s %s:%s", h.handlerType, id, err)
 		fmt.Fprintln(w, msg)
 		fmt.Fprintln(os.Stderr, msg)
@@ -2,24 +2,119 @@ package desync
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
 // HTTPIndexHandler is the HTTP handler for index stores.
 type HTTPIndexHandler struct {
 	HTTPHandlerBase
-	s IndexStore
+	s      IndexStore
+	limits IndexUploadLimits
+	quota  *uploadQuota
+
+	// Path prefix the handler is mounted on, and optional authorization hook
+	prefix    string
+	authorize func(*http.Request) bool
+
+	notify func(Event)
+
+	chunks           Store
+	chunkConcurrency int
+}
+
+// HTTPIndexHandlerOptions configure a HTTP index server handler.
+type HTTPIndexHandlerOptions struct {
+	// Allow clients to upload indexes. The store needs to implement
+	// IndexWriteStore.
+	Writable bool
+
+	// Expected value of the Authorization header. No check if empty.
+	Authorization string
+
+	// Optional hook to authorize requests. If set, it's used instead of
+	// comparing the Authorization header. Returning false rejects the
+	// request with 401.
+	Authorize func(*http.Request) bool
+
+	// Restrictions for uploaded indexes.
+	Limits IndexUploadLimits
+
+	// Path prefix the handler is mounted on, like "/indexes". Requests outside
+	// of it are answered with 404.
+	Prefix string
+
+	// Optional, called after an index uploaded by a client was stored.
+	Notify func(Event)
+
+	// If set, uploaded indexes are rejected unless all chunks they reference
+	// are present in this store. The chunks are checked with
+	// ChunkCheckConcurrency goroutines.
+	ChunkStore            Store
+	ChunkCheckConcurrency int
+}
+
+// IndexUploadLimits restrict what clients can write to an HTTP index store.
+type IndexUploadLimits struct {
+	// Maximum size of an uploaded index in bytes. Unlimited if 0.
+	MaxSize int64
+
+	// Maximum number of bytes each client can upload per day (UTC). Unlimited
+	// if 0. Clients are identified by the common name in their TLS certificate,
+	// the Authorization header, or their IP address, in that order.
+	DailyQuota int64
+
+	// Reject indexes that fail Index.Validate.
+	Validate bool
+
+	// If set, uploaded indexes have to use these chunk size parameters. Implies
+	// Validate.
+	ChunkSizeMin, ChunkSizeAvg, ChunkSizeMax uint64
 }
 
 // NewHTTPIndexHandler initializes an HTTP index store handler
 func NewHTTPIndexHandler(s IndexStore, writable bool, auth string) http.Handler {
-	return HTTPIndexHandler{HTTPHandlerBase{"index", writable, auth}, s}
+	return NewHTTPIndexHandlerWithOptions(s, HTTPIndexHandlerOptions{
+		Writable:      writable,
+		Authorization: auth,
+	})
+}
+
+// NewHTTPIndexHandlerWithOptions initializes an HTTP index store handler. It
+// can be embedded in other services and registered on any router, indexes are
+// served under <prefix>/<name>.
+func NewHTTPIndexHandlerWithOptions(s IndexStore, opt HTTPIndexHandlerOptions) http.Handler {
+	return HTTPIndexHandler{
+		HTTPHandlerBase:  HTTPHandlerBase{"index", opt.Writable, opt.Authorization},
+		s:                s,
+		limits:           opt.Limits,
+		quota:            newUploadQuota(opt.Limits.DailyQuota),
+		prefix:           strings.TrimSuffix(opt.Prefix, "/"),
+		authorize:        opt.Authorize,
+		notify:           opt.Notify,
+		chunks:           opt.ChunkStore,
+		chunkConcurrency: opt.ChunkCheckConcurrency,
+	}
 }
 
 func (h HTTPIndexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.prefix != "" && !strings.HasPrefix(r.URL.Path, h.prefix+"/") {
+		http.NotFound(w, r)
+		return
+	}
 	indexName := path.Base(r.URL.Path)
 
 	switch r.Method {
@@ -56,12 +151,20 @@ func (h HTTPIndexHandler) get(indexName string, w http.ResponseWriter) {
 }
 
 func (h HTTPIndexHandler) head(indexName string, w http.ResponseWriter) {
-	_, err := h.s.GetIndexReader(indexName)
+	r, err := h.s.GetIndexReader(indexName)
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	w.WriteHeader(http.StatusNotFound)
+	r.Close()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h HTTPIndexHandler) authorized(r *http.Request) bool {
+	if h.authorize != nil {
+		return h.authorize(r)
+	}
+	return h.authorization == "" || authorizationEqual(h.authorization, r.Header.Get("Authorization"))
 }
 
 func (h HTTPIndexHandler) put(indexName string, w http.ResponseWriter, r *http.Request) {
@@ -78,18 +181,188 @@ func (h HTTPIndexHandler) put(indexName string, w http.ResponseWriter, r *http.R
 		return
 	}
 
-	// Read the chunk into memory
-	idx, err := IndexFromReader(r.Body)
+	// Reject uploads that are too large or exceed the quota before reading them
+	client := clientIdentity(r)
+	if h.limits.MaxSize > 0 && r.ContentLength > h.limits.MaxSize {
+		http.Error(w, "index too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !h.quota.available(client, r.ContentLength) {
+		http.Error(w, "daily upload quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+	body := r.Body
+	if h.limits.MaxSize > 0 {
+		body = http.MaxBytesReader(w, body, h.limits.MaxSize)
+	}
+	cr := &countingReader{r: body}
+
+	// Read the index into memory
+	idx, err := IndexFromReaderWithDigest(cr, indexStoreDigest(h.s))
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "index too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "invalid index: "+err.Error(), http.StatusUnsupportedMediaType)
 		return
 	}
+	if err := h.validate(idx); err != nil {
+		http.Error(w, "invalid index: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Don't publish indexes that can't be extracted
+	if h.chunks != nil {
+		if err := CheckIndexChunks(r.Context(), idx, h.chunks, h.chunkConcurrency); err != nil {
+			var missing IndexChunksMissing
+			if errors.As(err, &missing) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Charge the upload to the client's quota, and refund it if it can't be stored
+	if !h.quota.reserve(client, cr.n) {
+		http.Error(w, "daily upload quota exceeded", http.StatusTooManyRequests)
+		return
+	}
 
 	// Store it upstream
 	if err := s.StoreIndex(indexName, idx); err != nil {
+		h.quota.release(client, cr.n)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
+	if h.notify != nil {
+		h.notify(Event{
+			Type:   EventIndexStored,
+			Store:  h.s.String(),
+			Index:  indexName,
+			Size:   cr.n,
+			Client: client,
+		})
+	}
+}
+
+// Checks an uploaded index against the configured limits.
+func (h HTTPIndexHandler) validate(idx Index) error {
+	l := h.limits
+	checkSizes := l.ChunkSizeMin > 0 || l.ChunkSizeAvg > 0 || l.ChunkSizeMax > 0
+	if !l.Validate && !checkSizes {
+		return nil
+	}
+	if err := idx.Validate(); err != nil {
+		return err
+	}
+	if checkSizes && (idx.Index.ChunkSizeMin != l.ChunkSizeMin || idx.Index.ChunkSizeAvg != l.ChunkSizeAvg || idx.Index.ChunkSizeMax != l.ChunkSizeMax) {
+		return fmt.Errorf("chunk size parameters %d:%d:%d don't match the expected %d:%d:%d",
+			idx.Index.ChunkSizeMin, idx.Index.ChunkSizeAvg, idx.Index.ChunkSizeMax,
+			l.ChunkSizeMin, l.ChunkSizeAvg, l.ChunkSizeMax)
+	}
+	return nil
+}
+
+// Returns a string identifying the client that sent a request. That's the
+// common name of its TLS certificate, a hash of the Authorization header, or
+// its IP address, whichever is available first.
+func clientIdentity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "cn:" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return fmt.Sprintf("auth:%x", sha256.Sum256([]byte(auth)))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// uploadQuota keeps track of the number of bytes each client uploaded on the
+// current day. A nil quota is unlimited.
+type uploadQuota struct {
+	limit int64
+	mu    sync.Mutex
+	day   string
+	used  map[string]int64
+}
+
+func newUploadQuota(limit int64) *uploadQuota {
+	if limit <= 0 {
+		return nil
+	}
+	return &uploadQuota{limit: limit}
+}
+
+// Resets the counters when the day changes. Must be called with the lock held.
+func (q *uploadQuota) rollover() {
+	day := time.Now().UTC().Format("2006-01-02")
+	if day != q.day {
+		q.day = day
+		q.used = make(map[string]int64)
+	}
+}
+
+// available returns true if the client has n bytes left in its quota. A
+// negative n (unknown size) only checks that some of the quota is left.
+func (q *uploadQuota) available(client string, n int64) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	if n < 0 {
+		n = 1
+	}
+	return q.used[client]+n <= q.limit
+}
+
+// reserve charges n bytes to the client's quota if it has enough left.
+func (q *uploadQuota) reserve(client string, n int64) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	if q.used[client]+n > q.limit {
+		return false
+	}
+	q.used[client] += n
+	return true
+}
+
+// release refunds n bytes previously reserved by a client.
+func (q *uploadQuota) release(client string, n int64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	q.used[client] -= n
+	if q.used[client] < 0 {
+		q.used[client] = 0
+	}
+}
+
+// countingReader counts the number of bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
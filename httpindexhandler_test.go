@@ -0,0 +1,150 @@
+package desync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPIndexHandlerLimits(t *testing.T) {
+	index, err := ioutil.ReadFile("testdata/blob1.caibx")
+	require.NoError(t, err)
+	idx, err := IndexFromReader(bytes.NewReader(index))
+	require.NoError(t, err)
+
+	put := func(t *testing.T, limits IndexUploadLimits, b []byte, n int) int {
+		upstream, err := NewLocalIndexStore(t.TempDir())
+		require.NoError(t, err)
+		ts := httptest.NewServer(NewHTTPIndexHandlerWithOptions(upstream, HTTPIndexHandlerOptions{Writable: true, Limits: limits}))
+		defer ts.Close()
+
+		// Upload the index n times and return the status of the last request
+		var status int
+		for i := 0; i < n; i++ {
+			req, err := http.NewRequest("PUT", ts.URL+"/test.caibx", bytes.NewReader(b))
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			status = resp.StatusCode
+		}
+		return status
+	}
+
+	tests := map[string]struct {
+		limits IndexUploadLimits
+		data   []byte
+		n      int
+		status int
+	}{
+		"no limits":           {IndexUploadLimits{}, index, 3, http.StatusOK},
+		"within size limit":   {IndexUploadLimits{MaxSize: int64(len(index))}, index, 1, http.StatusOK},
+		"too large":           {IndexUploadLimits{MaxSize: int64(len(index)) - 1}, index, 1, http.StatusRequestEntityTooLarge},
+		"within quota":        {IndexUploadLimits{DailyQuota: 2 * int64(len(index))}, index, 2, http.StatusOK},
+		"quota exceeded":      {IndexUploadLimits{DailyQuota: 2 * int64(len(index))}, index, 3, http.StatusTooManyRequests},
+		"invalid index":       {IndexUploadLimits{Validate: true}, []byte("garbage"), 1, http.StatusUnsupportedMediaType},
+		"matching sizes":      {IndexUploadLimits{ChunkSizeMin: idx.Index.ChunkSizeMin, ChunkSizeAvg: idx.Index.ChunkSizeAvg, ChunkSizeMax: idx.Index.ChunkSizeMax}, index, 1, http.StatusOK},
+		"chunk size mismatch": {IndexUploadLimits{ChunkSizeMin: 1024, ChunkSizeAvg: 2048, ChunkSizeMax: 4096}, index, 1, http.StatusUnprocessableEntity},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.status, put(t, test.limits, test.data, test.n))
+		})
+	}
+}
+
+func TestHTTPIndexHandlerWithOptions(t *testing.T) {
+	index, err := ioutil.ReadFile("testdata/blob1.caibx")
+	require.NoError(t, err)
+
+	upstream, err := NewLocalIndexStore(t.TempDir())
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.Handle("/indexes/", NewHTTPIndexHandlerWithOptions(upstream, HTTPIndexHandlerOptions{
+		Writable:  true,
+		Authorize: func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer secret" },
+		Prefix:    "/indexes",
+	}))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	do := func(method, auth string, body []byte) int {
+		req, err := http.NewRequest(method, ts.URL+"/indexes/test.caibx", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Requests without the right authorization are rejected
+	require.Equal(t, http.StatusUnauthorized, do("PUT", "Bearer wrong", index))
+
+	// HEAD reports whether the index exists
+	require.Equal(t, http.StatusNotFound, do("HEAD", "Bearer secret", nil))
+	require.Equal(t, http.StatusOK, do("PUT", "Bearer secret", index))
+	require.Equal(t, http.StatusOK, do("HEAD", "Bearer secret", nil))
+	require.Equal(t, http.StatusOK, do("GET", "Bearer secret", nil))
+}
+
+func TestHTTPIndexHandlerChunkStore(t *testing.T) {
+	index, err := ioutil.ReadFile("testdata/blob1.caibx")
+	require.NoError(t, err)
+
+	put := func(chunks string) int {
+		upstream, err := NewLocalIndexStore(t.TempDir())
+		require.NoError(t, err)
+		cs, err := NewLocalStore(chunks, StoreOptions{})
+		require.NoError(t, err)
+		ts := httptest.NewServer(NewHTTPIndexHandlerWithOptions(upstream, HTTPIndexHandlerOptions{
+			Writable:              true,
+			ChunkStore:            cs,
+			ChunkCheckConcurrency: 4,
+		}))
+		defer ts.Close()
+		req, err := http.NewRequest("PUT", ts.URL+"/test.caibx", bytes.NewReader(index))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Indexes are only accepted if all their chunks are in the store
+	require.Equal(t, http.StatusOK, put("testdata/blob1.store"))
+	require.Equal(t, http.StatusUnprocessableEntity, put("testdata/blob2.store"))
+}
+
+func TestHTTPIndexHandlerNotify(t *testing.T) {
+	index, err := ioutil.ReadFile("testdata/blob1.caibx")
+	require.NoError(t, err)
+	upstream, err := NewLocalIndexStore(t.TempDir())
+	require.NoError(t, err)
+
+	var events []Event
+	ts := httptest.NewServer(NewHTTPIndexHandlerWithOptions(upstream, HTTPIndexHandlerOptions{
+		Writable: true,
+		Notify:   func(e Event) { events = append(events, e) },
+	}))
+	defer ts.Close()
+
+	put := func(b []byte) {
+		req, err := http.NewRequest("PUT", ts.URL+"/test.caibx", bytes.NewReader(b))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	put(index)
+	put([]byte("garbage")) // rejected, no event
+
+	require.Len(t, events, 1)
+	require.Equal(t, EventIndexStored, events[0].Type)
+	require.Equal(t, "test.caibx", events[0].Index)
+	require.Equal(t, int64(len(index)), events[0].Size)
+}
@@ -0,0 +1,80 @@
+package desync
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+var _ io.ReaderAt = &HTTPRangeReader{}
+
+// HTTPRangeReader reads a remote file, like a blob on a web server or mirror,
+// with HTTP range requests. The server needs to support them.
+type HTTPRangeReader struct {
+	*RemoteHTTPBase
+	u *url.URL
+}
+
+// NewHTTPRangeReader initializes a reader for the file at the given URL.
+func NewHTTPRangeReader(location *url.URL, opt StoreOptions) (*HTTPRangeReader, error) {
+	// The base expects the location of a store, use the directory of the file
+	dir, err := location.Parse(".")
+	if err != nil {
+		return nil, err
+	}
+	b, err := newRemoteHTTPStoreBase(dir, opt, "")
+	if err != nil {
+		return nil, err
+	}
+	u := *location
+	return &HTTPRangeReader{RemoteHTTPBase: b, u: &u}, nil
+}
+
+// NewHTTPRangeSeed initializes a seed for a blob on a remote server. Chunks are
+// read from the blob with range requests and verified after they're written
+// into the target, so an outdated or corrupted remote blob is detected.
+func NewHTTPRangeSeed(location *url.URL, index Index, opt StoreOptions) (*ReaderAtSeed, error) {
+	r, err := NewHTTPRangeReader(location, opt)
+	if err != nil {
+		return nil, err
+	}
+	return NewReaderAtSeed(r, index), nil
+}
+
+// ReadAt reads len(p) bytes starting at off with a single range request.
+func (r *HTTPRangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)}}
+	statusCode, _, b, err := r.issueRetryableHttpRequest("GET", r.u, header, func() io.Reader { return nil })
+	if err != nil {
+		return 0, err
+	}
+	switch statusCode {
+	case http.StatusPartialContent: // expected
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	case http.StatusOK:
+		// The server ignored the range and sent the whole file
+		return 0, fmt.Errorf("%s doesn't support range requests", r)
+	case http.StatusNotFound:
+		return 0, NoSuchObject{r.u.String()}
+	default:
+		err := fmt.Errorf("unexpected status code %d from %s", statusCode, r)
+		if sErr := errorFromHTTPStatus(r.String(), statusCode, err); sErr != nil {
+			return 0, sErr
+		}
+		return 0, err
+	}
+	n := copy(p, b)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *HTTPRangeReader) String() string {
+	return r.u.String()
+}
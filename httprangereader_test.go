@@ -0,0 +1,147 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPRangeSeed(t *testing.T) {
+	dir := t.TempDir()
+
+	// Serve the blob of the seed with support for range requests
+	data := make([]byte, 4*ChunkSizeMaxDefault)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL + "/images/blob")
+
+	blob := filepath.Join(dir, "blob")
+	require.NoError(t, os.WriteFile(blob, data, 0644))
+	idx, _, err := IndexFromFile(context.Background(), blob, 1,
+		ChunkSizeMinDefault, ChunkSizeAvgDefault, ChunkSizeMaxDefault, NewProgressBar(""))
+	require.NoError(t, err)
+
+	// Read a range, and past the end of the blob
+	r, err := NewHTTPRangeReader(u, StoreOptions{})
+	require.NoError(t, err)
+	b := make([]byte, 10)
+	n, err := r.ReadAt(b, 100)
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	require.Equal(t, data[100:110], b)
+	n, err = r.ReadAt(b, int64(len(data))-5)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 5, n)
+
+	// Extract the blob with only the remote seed, the store is empty
+	s, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	seed, err := NewHTTPRangeSeed(u, idx, StoreOptions{})
+	require.NoError(t, err)
+	atomic.StoreInt64(&requests, 0)
+	target := filepath.Join(dir, "target")
+	stats, err := AssembleFile(context.Background(), target, idx, s, []Seed{seed}, AssembleOptions{N: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(idx.Chunks)), stats.ChunksFromSeeds)
+	require.Less(t, atomic.LoadInt64(&requests), int64(len(idx.Chunks)))
+	out, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+}
+
+func TestHTTPRangeSeedOutdated(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 4*ChunkSizeMaxDefault)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	blob := filepath.Join(dir, "blob")
+	require.NoError(t, os.WriteFile(blob, data, 0644))
+	idx, _, err := IndexFromFile(context.Background(), blob, 1,
+		ChunkSizeMinDefault, ChunkSizeAvgDefault, ChunkSizeMaxDefault, NewProgressBar(""))
+	require.NoError(t, err)
+
+	// All chunks are in the store
+	s, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	for _, c := range idx.Chunks {
+		b := data[c.Start : c.Start+c.Size]
+		require.NoError(t, s.StoreChunk(NewChunk(b)))
+	}
+
+	// The mirror has a different blob than the seed index says
+	mirror := make([]byte, len(data))
+	_, err = rand.Read(mirror)
+	require.NoError(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(mirror))
+	}))
+	u, _ := url.Parse(ts.URL + "/images/blob")
+
+	// The chunks are taken from the store instead
+	seed, err := NewHTTPRangeSeed(u, idx, StoreOptions{})
+	require.NoError(t, err)
+	target := filepath.Join(dir, "target")
+	_, err = AssembleFile(context.Background(), target, idx, s, []Seed{seed}, AssembleOptions{N: 1})
+	require.NoError(t, err)
+	out, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+
+	// Same if the mirror is gone
+	ts.Close()
+	require.NoError(t, os.Remove(target))
+	_, err = AssembleFile(context.Background(), target, idx, s, []Seed{seed}, AssembleOptions{N: 1})
+	require.NoError(t, err)
+	out, err = os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+}
+
+// Records the largest read.
+type maxReadReaderAt struct {
+	io.ReaderAt
+	max int
+}
+
+func (r *maxReadReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > r.max {
+		r.max = len(p)
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+func TestReaderAtSeedSegmentReadSize(t *testing.T) {
+	data := make([]byte, 3*readerAtSeedReadSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	r := &maxReadReaderAt{ReaderAt: bytes.NewReader(data)}
+	segment := &readerAtSeedSegment{r: r, chunks: []IndexChunk{{Start: 0, Size: uint64(len(data))}}}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "target"))
+	require.NoError(t, err)
+	defer f.Close()
+	copied, _, err := segment.WriteInto(f, 0, uint64(len(data)), 0, true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), copied)
+	require.Equal(t, readerAtSeedReadSize, r.max)
+	out, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+}
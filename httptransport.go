@@ -0,0 +1,202 @@
+package desync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Settings that determine how connections to an HTTP store are made. Stores
+// that agree on all of them share a transport, and with it the pool of
+// connections and the TLS session cache. That way, several stores on the same
+// host, like the members of a failover group with different paths, don't each
+// open their own connections and go through their own TLS handshakes.
+type httpTransportKey struct {
+	scheme, host, dialAddr        string
+	trustInsecure                 bool
+	clientCert, clientKey, caCert string
+	tlsSessionCacheSize, n        int
+	idleTimeout, connectTimeout   time.Duration
+	readTimeout                   time.Duration
+	http3                         bool
+}
+
+func newHTTPTransportKey(location *url.URL, opt StoreOptions, dialAddr string) httpTransportKey {
+	return httpTransportKey{
+		scheme:              location.Scheme,
+		host:                location.Host,
+		dialAddr:            dialAddr,
+		trustInsecure:       opt.TrustInsecure,
+		clientCert:          opt.ClientCert,
+		clientKey:           opt.ClientKey,
+		caCert:              opt.CACert,
+		tlsSessionCacheSize: opt.TLSSessionCacheSize,
+		n:                   opt.N,
+		idleTimeout:         opt.IdleTimeout,
+		connectTimeout:      opt.ConnectTimeout,
+		readTimeout:         opt.ReadTimeout,
+		http3:               opt.HTTP3,
+	}
+}
+
+// Transports in use by HTTP stores, with the number of stores using each.
+var (
+	httpTransportsMu sync.Mutex
+	httpTransports   = make(map[httpTransportKey]*sharedHTTPTransport)
+)
+
+// sharedHTTPTransport is a transport used by one or more HTTP stores. Its
+// connections are closed when the last of them releases it.
+type sharedHTTPTransport struct {
+	http.RoundTripper
+	key  httpTransportKey
+	refs int
+}
+
+// Returns the transport for the location and options, creating it if no other
+// store is using one with the same settings already.
+func acquireHTTPTransport(location *url.URL, opt StoreOptions, dialAddr string) (*sharedHTTPTransport, error) {
+	key := newHTTPTransportKey(location, opt, dialAddr)
+	httpTransportsMu.Lock()
+	defer httpTransportsMu.Unlock()
+	if t, ok := httpTransports[key]; ok {
+		t.refs++
+		return t, nil
+	}
+	rt, err := newHTTPTransport(location, opt, dialAddr)
+	if err != nil {
+		return nil, err
+	}
+	t := &sharedHTTPTransport{RoundTripper: rt, key: key, refs: 1}
+	httpTransports[key] = t
+	return t, nil
+}
+
+// Releases the transport. Once no store uses it anymore, its idle connections
+// are closed and the next store with the same settings gets a new one.
+func (t *sharedHTTPTransport) release() {
+	httpTransportsMu.Lock()
+	defer httpTransportsMu.Unlock()
+	t.refs--
+	if t.refs > 0 {
+		return
+	}
+	if httpTransports[t.key] == t {
+		delete(httpTransports, t.key)
+	}
+	switch rt := t.RoundTripper.(type) {
+	case *http3.Transport:
+		rt.Close()
+	case *http.Transport:
+		rt.CloseIdleConnections()
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the transport, which
+// affects all stores using it.
+func (t *sharedHTTPTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// Builds a transport for HTTP stores, with the TLS configuration and timeouts
+// from the options.
+func newHTTPTransport(location *url.URL, opt StoreOptions, dialAddr string) (http.RoundTripper, error) {
+	// Build a TLS client config
+	tlsConfig := &tls.Config{InsecureSkipVerify: opt.TrustInsecure}
+
+	// Cache sessions so that new connections can resume them rather than going
+	// through a full handshake
+	switch {
+	case opt.TLSSessionCacheSize == 0:
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(DefaultTLSSessionCacheSize)
+	case opt.TLSSessionCacheSize > 0:
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(opt.TLSSessionCacheSize)
+	}
+
+	// Add client key/cert if provided
+	if opt.ClientCert != "" && opt.ClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(opt.ClientCert, opt.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate from %s", opt.ClientCert)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	// Load custom CA set if provided
+	if opt.CACert != "" {
+		certPool := x509.NewCertPool()
+		b, err := ioutil.ReadFile(opt.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if ok := certPool.AppendCertsFromPEM(b); !ok {
+			return nil, errors.New("no CA certificates found in ca-cert file")
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	idleTimeout := opt.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 60 * time.Second
+	}
+	if opt.HTTP3 {
+		if location.Scheme != "https" {
+			return nil, fmt.Errorf("http3 requires https, not %s", location.Scheme)
+		}
+		if strings.HasPrefix(dialAddr, "unix:") {
+			return nil, errors.New("http3 isn't supported over Unix sockets")
+		}
+		tr3 := &http3.Transport{
+			TLSClientConfig:    tlsConfig,
+			DisableCompression: true,
+			QUICConfig: &quic.Config{
+				HandshakeIdleTimeout: opt.ConnectTimeout,
+				MaxIdleTimeout:       idleTimeout,
+			},
+		}
+		if dialAddr != "" {
+			tr3.Dial = func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+				return quic.DialAddrEarly(ctx, dialAddr, tlsCfg, cfg)
+			}
+		}
+		return tr3, nil
+	}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DisableCompression:    true,
+		MaxIdleConnsPerHost:   opt.N,
+		IdleConnTimeout:       idleTimeout,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		ResponseHeaderTimeout: opt.ReadTimeout,
+	}
+	if opt.ConnectTimeout > 0 {
+		tr.DialContext = (&net.Dialer{Timeout: opt.ConnectTimeout}).DialContext
+		tr.TLSHandshakeTimeout = opt.ConnectTimeout
+	}
+	if dialAddr != "" {
+		dial := (&net.Dialer{Timeout: opt.ConnectTimeout}).DialContext
+		tr.Proxy = nil
+		tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if path := strings.TrimPrefix(dialAddr, "unix:"); path != dialAddr {
+				return dial(ctx, "unix", path)
+			}
+			return dial(ctx, network, dialAddr)
+		}
+	}
+	return tr, nil
+}
@@ -2,11 +2,17 @@ package desync
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"crypto"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
 	"math"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 
@@ -19,6 +25,46 @@ import (
 type Index struct {
 	Index  FormatIndex
 	Chunks []IndexChunk
+
+	// Append a trailer with a checksum of the index when writing it, so that
+	// damaged index files are detected when they're read. Set by
+	// IndexFromReader if the index had a checksum trailer.
+	Checksum bool
+
+	// Optional key/value pairs describing the indexed blob, such as its name or
+	// version. They're written after the chunk table if present.
+	Metadata map[string]string
+
+	// Hash algorithm of the chunk IDs. Set by IndexFromReader and when chunking
+	// data into a new index. The global Digest is used if it's nil.
+	Digest HashAlgorithm
+}
+
+// Type of the optional checksum trailer that follows the chunk table. It's not
+// part of the casync format and holds a SHA256 digest of everything before it.
+const (
+	indexChecksumType = 0x2b4a4f3de1e1d8c5
+	indexChecksumSize = 16 + sha256.Size
+)
+
+// Type of the optional metadata element that follows the chunk table, before
+// the checksum trailer. Like the checksum, it's not part of the casync format.
+// It holds a list of NUL-terminated keys and values, sorted by key.
+const (
+	indexMetadataType    = 0x5e1a8d2c7f3b9046
+	maxIndexMetadataSize = 1 << 20
+)
+
+// Hashes everything read through it.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func (r hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
 }
 
 // IndexChunk is a table entry in an index file containing the chunk ID (SHA256)
@@ -31,58 +77,154 @@ type IndexChunk struct {
 }
 
 // IndexFromReader parses a caibx structure (from a reader) and returns a populated Caibx
-// object
+// object. The index has to use the global Digest algorithm.
 func IndexFromReader(r io.Reader) (c Index, err error) {
-	d := NewFormatDecoder(bufio.NewReader(r))
-	var ok bool
-	// Read the index
-	e, err := d.Next()
+	return IndexFromReaderWithDigest(r, Digest)
+}
+
+// IndexFromReaderWithDigest works like IndexFromReader but expects the index to
+// use the hash algorithm digest. If digest is nil, indexes with any algorithm are
+// accepted. The algorithm of the index is set in its Digest field.
+func IndexFromReaderWithDigest(r io.Reader, digest HashAlgorithm) (c Index, err error) {
+	ir, err := NewIndexReaderWithDigest(r, digest)
 	if err != nil {
-		return c, errors.Wrap(err, "reading index")
+		return c, err
 	}
+	c.Index = ir.Index
+	c.Digest = ir.Digest()
 
-	c.Index, ok = e.(FormatIndex)
-	if !ok {
-		return c, errors.New("input is not an index file")
+	// Convert the chunk table into a different format for easier use
+	c.Chunks = []IndexChunk{}
+	for {
+		chunk, err := ir.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return c, err
+		}
+		c.Chunks = append(c.Chunks, chunk)
 	}
+	c.Metadata, c.Checksum = ir.Metadata, ir.Checksum
+	return c, nil
+}
 
-	// Ensure the algorithm the library uses matches that of the index file
-	switch Digest.Algorithm() {
-	case crypto.SHA512_256:
-		if c.Index.FeatureFlags&CaFormatSHA512256 == 0 {
-			return c, errors.New("index file uses SHA256")
+// Reads the optional metadata element that follows the chunk table. Returns nil
+// if the next element isn't metadata.
+func readIndexMetadata(br *bufio.Reader, r io.Reader) (map[string]string, error) {
+	b, err := br.Peek(16)
+	if err != nil || binary.LittleEndian.Uint64(b[8:16]) != indexMetadataType {
+		return nil, nil
+	}
+	size := binary.LittleEndian.Uint64(b[0:8])
+	if size < 16 || size > maxIndexMetadataSize {
+		return nil, errors.New("invalid index metadata size")
+	}
+	b = make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.New("index metadata is truncated")
+	}
+	fields := bytes.Split(b[16:], []byte{0})
+	if len(fields)%2 != 1 || len(fields[len(fields)-1]) != 0 {
+		return nil, errors.New("invalid index metadata")
+	}
+	m := make(map[string]string)
+	for i := 0; i < len(fields)-1; i += 2 {
+		if len(fields[i]) == 0 {
+			return nil, errors.New("invalid index metadata, empty key")
 		}
-	case crypto.SHA256:
-		if c.Index.FeatureFlags&CaFormatSHA512256 != 0 {
-			return c, errors.New("index file uses SHA512-256")
+		m[string(fields[i])] = string(fields[i+1])
+	}
+	return m, nil
+}
+
+// Encodes the metadata element, with the keys in sorted order so the same
+// metadata always results in the same bytes.
+func encodeIndexMetadata(m map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k == "" || strings.IndexByte(k, 0) >= 0 || strings.IndexByte(m[k], 0) >= 0 {
+			return nil, fmt.Errorf("invalid index metadata key %q", k)
 		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := make([]byte, 16)
+	for _, k := range keys {
+		b = append(b, k...)
+		b = append(b, 0)
+		b = append(b, m[k]...)
+		b = append(b, 0)
 	}
+	if len(b) > maxIndexMetadataSize {
+		return nil, errors.New("index metadata is too large")
+	}
+	binary.LittleEndian.PutUint64(b[0:8], uint64(len(b)))
+	binary.LittleEndian.PutUint64(b[8:16], indexMetadataType)
+	return b, nil
+}
 
-	// Read the table
-	e, err = d.Next()
-	if err != nil {
-		return c, errors.Wrap(err, "reading chunk table")
+// Reads the optional checksum trailer after the chunk table and compares it
+// to the expected digest. Returns false if there is no trailer. Any other data
+// following the chunk table, or following the trailer, is ignored like it was
+// before checksums were introduced.
+func readIndexChecksum(r io.Reader, sum []byte) (bool, error) {
+	b := make([]byte, indexChecksumSize)
+	n, err := io.ReadFull(r, b)
+	switch {
+	case n < 16 || binary.LittleEndian.Uint64(b[8:16]) != indexChecksumType:
+		return false, nil
+	case err != nil:
+		return false, errors.New("index checksum is truncated")
+	case binary.LittleEndian.Uint64(b[0:8]) != indexChecksumSize:
+		return false, errors.New("invalid index checksum size")
+	case !bytes.Equal(b[16:], sum):
+		return false, errors.New("index checksum mismatch, the index is damaged")
 	}
-	table, ok := e.(FormatTable)
-	if !ok {
-		return c, errors.New("index table not found in input")
+	return true, nil
+}
+
+// Validate performs structural sanity checks on the index. It confirms the chunk
+// size parameters are consistent, that chunks are contiguous, that all chunks
+// except the last comply with the min and max chunk size, that the digest
+// algorithm in the feature flags matches the one of the index, and that the
+// total size doesn't overflow.
+func (i *Index) Validate() error {
+	min, avg, max := i.Index.ChunkSizeMin, i.Index.ChunkSizeAvg, i.Index.ChunkSizeMax
+	if min > avg || avg > max {
+		return fmt.Errorf("invalid chunk size parameters %d:%d:%d", min, avg, max)
 	}
 
-	// Convert the chunk table into a different format for easier use
-	c.Chunks = make([]IndexChunk, len(table.Items))
-	var lastOffset uint64
-	for i, r := range table.Items {
-		c.Chunks[i].ID = r.Chunk
-		c.Chunks[i].Start = lastOffset
-		c.Chunks[i].Size = r.Offset - lastOffset
-		lastOffset = r.Offset
-		// Check the max size of the chunk only. The min apperently doesn't apply
-		// to the last chunk.
-		if c.Chunks[i].Size > c.Index.ChunkSizeMax {
-			return c, fmt.Errorf("chunk size %d is larger than maximum %d", c.Chunks[i].Size, c.Index.ChunkSizeMax)
+	// Ensure the algorithm of the index matches its feature flags
+	if err := checkDigestFlags(i.digest(), i.Index.FeatureFlags); err != nil {
+		return err
+	}
+
+	var next uint64
+	for n, c := range i.Chunks {
+		if c.Start != next {
+			return fmt.Errorf("chunk %d starts at offset %d, expected %d", n, c.Start, next)
+		}
+		if c.Size == 0 {
+			return fmt.Errorf("chunk %d has zero size", n)
+		}
+		if c.Size > max {
+			return fmt.Errorf("chunk %d size %d is larger than maximum %d", n, c.Size, max)
+		}
+		if c.Size < min && n < len(i.Chunks)-1 {
+			return fmt.Errorf("chunk %d size %d is smaller than minimum %d", n, c.Size, min)
+		}
+		next = c.Start + c.Size
+		if next < c.Start || next > math.MaxInt64 {
+			return fmt.Errorf("total size overflows at chunk %d", n)
 		}
 	}
-	return
+	return nil
+}
+
+// Returns the hash algorithm of the chunk IDs in the index.
+func (i *Index) digest() HashAlgorithm {
+	return digestOrDefault(i.Digest)
 }
 
 // WriteTo writes the index and chunk table into a stream
@@ -96,7 +238,9 @@ func (i *Index) WriteTo(w io.Writer) (int64, error) {
 	}
 
 	bw := bufio.NewWriter(w)
-	d := NewFormatEncoder(bw)
+	h := sha256.New()
+	mw := io.MultiWriter(bw, h)
+	d := NewFormatEncoder(mw)
 	n, err := d.Encode(index)
 	if err != nil {
 		return n, err
@@ -115,11 +259,36 @@ func (i *Index) WriteTo(w io.Writer) (int64, error) {
 		Items:        fChunks,
 	}
 	n1, err := d.Encode(table)
-
-	if err := bw.Flush(); err != nil {
+	if err != nil {
 		return n + n1, err
 	}
-	return n + n1, err
+	n += n1
+
+	// Add the metadata, before the checksum so it's covered by it
+	if len(i.Metadata) > 0 {
+		b, err := encodeIndexMetadata(i.Metadata)
+		if err != nil {
+			return n, err
+		}
+		n2, err := mw.Write(b)
+		n += int64(n2)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	// Append the checksum of everything written so far
+	if i.Checksum {
+		b := make([]byte, 16, indexChecksumSize)
+		binary.LittleEndian.PutUint64(b[0:8], indexChecksumSize)
+		binary.LittleEndian.PutUint64(b[8:16], indexChecksumType)
+		n2, err := bw.Write(h.Sum(b))
+		n += int64(n2)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
 }
 
 // Length returns the total (uncompressed) size of the indexed stream
@@ -131,10 +300,48 @@ func (i *Index) Length() int64 {
 	return int64(lastChunk.Start + lastChunk.Size)
 }
 
+// RangeChunks returns the chunks covering the byte range of the given length
+// starting at start. The returned slice shares the underlying array with the
+// index. It's empty if the length is 0 or the range starts past the end.
+func (i *Index) RangeChunks(start, length uint64) []IndexChunk {
+	if length == 0 {
+		return nil
+	}
+	first := sort.Search(len(i.Chunks), func(n int) bool { return start < i.Chunks[n].Start+i.Chunks[n].Size })
+	end := start + length
+	if end < start { // overflow, the range extends to the end
+		end = math.MaxUint64
+	}
+	last := sort.Search(len(i.Chunks), func(n int) bool { return end <= i.Chunks[n].Start })
+	if first >= last {
+		return nil
+	}
+	return i.Chunks[first:last]
+}
+
 // ChunkStream splits up a blob into chunks using the provided chunker (single stream),
 // populates a store with the chunks and returns an index. Hashing and compression
 // is performed in n goroutines while the hashing algorithm is performed serially.
+// Chunks are hashed with the algorithm set in the context with WithDigest.
 func ChunkStream(ctx context.Context, c Chunker, ws WriteStore, n int) (Index, error) {
+	index, _, err := ChunkStreamWithStats(ctx, c, ws, n)
+	return index, err
+}
+
+// ChunkStreamStats contains the results of chunking a stream into a store.
+type ChunkStreamStats struct {
+	ChunksTotal  int    `json:"chunks-total"`
+	ChunksUnique int    `json:"chunks-unique"`
+	BytesTotal   uint64 `json:"bytes-total"`
+	ChunkStorageStats
+	Duration       time.Duration `json:"duration"`
+	BytesPerSecond float64       `json:"bytes-per-second"`
+}
+
+// ChunkStreamWithStats works like ChunkStream, and also returns statistics
+// about the chunks produced and how many of them had to be written to the store.
+func ChunkStreamWithStats(ctx context.Context, c Chunker, ws WriteStore, n int) (Index, ChunkStreamStats, error) {
+	start := time.Now()
 	type chunkJob struct {
 		num   int
 		start uint64
@@ -146,6 +353,7 @@ func ChunkStream(ctx context.Context, c Chunker, ws WriteStore, n int) (Index, e
 		results = make(map[int]IndexChunk)
 	)
 
+	digest := DigestFromContext(ctx)
 	g, ctx := errgroup.WithContext(ctx)
 	s := NewChunkStorage(ws)
 
@@ -164,7 +372,7 @@ func ChunkStream(ctx context.Context, c Chunker, ws WriteStore, n int) (Index, e
 		g.Go(func() error {
 			for c := range in {
 				// Create a chunk object, needed to calculate the checksum
-				chunk := NewChunk(c.b)
+				chunk := NewChunkWithDigest(c.b, digest)
 
 				// Record the index row
 				idxChunk := IndexChunk{Start: c.start, Size: uint64(len(c.b)), ID: chunk.ID()}
@@ -186,7 +394,7 @@ loop:
 	for {
 		start, b, err := c.Next()
 		if err != nil {
-			return Index{}, err
+			return Index{}, ChunkStreamStats{}, err
 		}
 		if len(b) == 0 {
 			break
@@ -203,7 +411,7 @@ loop:
 	close(in)
 
 	if err := g.Wait(); err != nil {
-		return Index{}, err
+		return Index{}, ChunkStreamStats{}, err
 	}
 
 	// All the chunks have been processed and are stored in a map. Now build a
@@ -216,12 +424,28 @@ loop:
 	// Build and return the index
 	index := Index{
 		Index: FormatIndex{
-			FeatureFlags: CaFormatExcludeNoDump | CaFormatSHA512256,
+			FeatureFlags: CaFormatExcludeNoDump | digestFlag(digest),
 			ChunkSizeMin: c.Min(),
 			ChunkSizeAvg: c.Avg(),
 			ChunkSizeMax: c.Max(),
 		},
 		Chunks: chunks,
+		Digest: digest,
+	}
+
+	storageStats := s.Stats()
+	stats := ChunkStreamStats{
+		ChunksTotal:       len(chunks),
+		ChunksUnique:      len(chunks) - int(storageStats.ChunksDuplicate),
+		ChunkStorageStats: storageStats,
+		Duration:          time.Since(start),
+	}
+	if len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		stats.BytesTotal = last.Start + last.Size
+	}
+	if secs := stats.Duration.Seconds(); secs > 0 {
+		stats.BytesPerSecond = float64(stats.BytesTotal) / secs
 	}
-	return index, nil
+	return index, stats, nil
 }
@@ -3,10 +3,15 @@ package desync
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"io/ioutil"
+	"math"
 	"os"
 	"reflect"
 	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIndexLoad(t *testing.T) {
@@ -67,6 +72,88 @@ func TestIndexWrite(t *testing.T) {
 	}
 }
 
+func TestIndexChecksum(t *testing.T) {
+	in, err := ioutil.ReadFile("testdata/index.caibx")
+	require.NoError(t, err)
+	idx, err := IndexFromReader(bytes.NewReader(in))
+	require.NoError(t, err)
+	require.False(t, idx.Checksum)
+
+	// Write it with a checksum trailer, it should be read back unchanged
+	idx.Checksum = true
+	out := new(bytes.Buffer)
+	n, err := idx.WriteTo(out)
+	require.NoError(t, err)
+	require.Equal(t, int64(out.Len()), n)
+	require.Equal(t, len(in)+indexChecksumSize, out.Len())
+	b := out.Bytes()
+
+	idx2, err := IndexFromReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Equal(t, idx, idx2)
+
+	// Flip a bit in the chunk table
+	damaged := append([]byte{}, b...)
+	damaged[len(in)-100] ^= 0x01
+	_, err = IndexFromReader(bytes.NewReader(damaged))
+	require.Error(t, err)
+
+	// Truncated checksum
+	_, err = IndexFromReader(bytes.NewReader(b[:len(b)-1]))
+	require.Error(t, err)
+
+	// Truncated chunk table
+	_, err = IndexFromReader(bytes.NewReader(b[:len(in)-10]))
+	require.Error(t, err)
+
+	// Data after the checksum is ignored
+	idx2, err = IndexFromReader(bytes.NewReader(append(append([]byte{}, b...), 0)))
+	require.NoError(t, err)
+	require.True(t, idx2.Checksum)
+
+	// Data after an index without checksum is ignored as well
+	idx2, err = IndexFromReader(bytes.NewReader(append(append([]byte{}, in...), []byte("trailing data")...)))
+	require.NoError(t, err)
+	require.False(t, idx2.Checksum)
+	require.Equal(t, len(idx.Chunks), len(idx2.Chunks))
+}
+
+func TestIndexMetadata(t *testing.T) {
+	in, err := ioutil.ReadFile("testdata/index.caibx")
+	require.NoError(t, err)
+	idx, err := IndexFromReader(bytes.NewReader(in))
+	require.NoError(t, err)
+	require.Nil(t, idx.Metadata)
+
+	// Write it with metadata and read it back, with and without a checksum
+	idx.Metadata = map[string]string{"name": "image", "version": "1.2", "channel": ""}
+	for _, checksum := range []bool{false, true} {
+		idx.Checksum = checksum
+		out := new(bytes.Buffer)
+		n, err := idx.WriteTo(out)
+		require.NoError(t, err)
+		require.Equal(t, int64(out.Len()), n)
+
+		idx2, err := IndexFromReader(bytes.NewReader(out.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, idx, idx2)
+	}
+
+	// The metadata is covered by the checksum
+	out := new(bytes.Buffer)
+	_, err = idx.WriteTo(out)
+	require.NoError(t, err)
+	damaged := out.Bytes()
+	damaged[len(in)+20] ^= 0x01
+	_, err = IndexFromReader(bytes.NewReader(damaged))
+	require.Error(t, err)
+
+	// Keys can't be empty
+	idx.Metadata = map[string]string{"": "value"}
+	_, err = idx.WriteTo(ioutil.Discard)
+	require.Error(t, err)
+}
+
 func TestIndexChunking(t *testing.T) {
 	// Open the blob
 	f, err := os.Open("testdata/chunker.input")
@@ -190,3 +277,88 @@ func splitBlob(b *testing.B) {
 		b.Fatal(err)
 	}
 }
+
+func TestIndexValidate(t *testing.T) {
+	var id ChunkID
+	valid := func() Index {
+		return Index{
+			Index: FormatIndex{
+				FeatureFlags: CaFormatSHA512256,
+				ChunkSizeMin: 10,
+				ChunkSizeAvg: 20,
+				ChunkSizeMax: 40,
+			},
+			Chunks: []IndexChunk{
+				{ID: id, Start: 0, Size: 20},
+				{ID: id, Start: 20, Size: 40},
+				{ID: id, Start: 60, Size: 5},
+			},
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		modify func(*Index)
+		valid  bool
+	}{
+		{"valid index", func(*Index) {}, true},
+		{"empty index", func(i *Index) { i.Chunks = nil }, true},
+		{"gap between chunks", func(i *Index) { i.Chunks[1].Start = 21 }, false},
+		{"overlapping chunks", func(i *Index) { i.Chunks[1].Start = 19 }, false},
+		{"zero size chunk", func(i *Index) { i.Chunks[2].Size = 0 }, false},
+		{"chunk below min", func(i *Index) { i.Chunks[0].Size = 5; i.Chunks[1].Start = 5; i.Chunks[2].Start = 45 }, false},
+		{"chunk above max", func(i *Index) { i.Chunks[2].Size = 41 }, false},
+		{"invalid size parameters", func(i *Index) { i.Index.ChunkSizeMin = 30 }, false},
+		{"wrong digest", func(i *Index) { i.Index.FeatureFlags = 0 }, false},
+		{"size overflow", func(i *Index) {
+			i.Index.ChunkSizeMax = math.MaxUint64
+			i.Chunks[2].Size = math.MaxUint64 - 10
+		}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			idx := valid()
+			test.modify(&idx)
+			err := idx.Validate()
+			if test.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+
+	// A wrong digest can be told apart from other problems
+	idx := valid()
+	idx.Index.FeatureFlags = 0
+	var mismatch DigestMismatch
+	require.ErrorAs(t, errors.Wrap(idx.Validate(), "index"), &mismatch)
+	require.Equal(t, DigestMismatch{Index: crypto.SHA256, Expected: crypto.SHA512_256}, mismatch)
+}
+
+func TestIndexRangeChunks(t *testing.T) {
+	idx := Index{
+		Chunks: []IndexChunk{
+			{ID: ChunkID{0}, Start: 0, Size: 20},
+			{ID: ChunkID{1}, Start: 20, Size: 40},
+			{ID: ChunkID{2}, Start: 60, Size: 5},
+		},
+	}
+	for _, test := range []struct {
+		name          string
+		start, length uint64
+		expected      []IndexChunk
+	}{
+		{"first byte", 0, 1, idx.Chunks[:1]},
+		{"within one chunk", 25, 10, idx.Chunks[1:2]},
+		{"across chunk boundary", 19, 2, idx.Chunks[:2]},
+		{"exactly one chunk", 20, 40, idx.Chunks[1:2]},
+		{"everything", 0, 65, idx.Chunks},
+		{"to the end", 30, math.MaxUint64, idx.Chunks[1:]},
+		{"zero length", 10, 0, nil},
+		{"past the end", 65, 10, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, idx.RangeChunks(test.start, test.length))
+		})
+	}
+}
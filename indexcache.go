@@ -0,0 +1,147 @@
+package desync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/folbricht/tempfile"
+	"github.com/pkg/errors"
+)
+
+// IndexETagger is implemented by index stores that can provide an ETag, or
+// some other version identifier, for an index without reading all of it.
+type IndexETagger interface {
+	IndexETag(name string) (string, error)
+}
+
+var _ IndexStore = &IndexCache{}
+
+// IndexCache is used to connect a (typically remote) index store with a local
+// directory in which fetched indexes are cached. Cached indexes are keyed by
+// store, name and ETag so that an index that changed in the store is fetched
+// again. Stores that don't provide ETags are passed through without caching.
+type IndexCache struct {
+	s   IndexStore
+	dir string
+}
+
+// NewIndexCache returns an index store that caches indexes from s in dir.
+func NewIndexCache(s IndexStore, dir string) (*IndexCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &IndexCache{s: s, dir: dir}, nil
+}
+
+// GetIndexReader returns a reader for the index from the cache if it's there
+// and current, otherwise it's read from the store and added to the cache.
+func (c *IndexCache) GetIndexReader(name string) (io.ReadCloser, error) {
+	et, ok := c.s.(IndexETagger)
+	if !ok {
+		return c.s.GetIndexReader(name)
+	}
+	etag, err := et.IndexETag(name)
+	if err != nil {
+		return nil, err
+	}
+	if etag == "" {
+		return c.s.GetIndexReader(name)
+	}
+	key := c.key(name)
+	cached := filepath.Join(c.dir, key+"-"+hashString(etag)[:16]+".caibx")
+	f, err := os.Open(cached)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Not in the cache, or outdated. Fetch it from the store
+	r, err := c.s.GetIndexReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.store(key, cached, b); err != nil {
+		return nil, errors.Wrap(err, "failed to store in index cache")
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// GetIndex returns an Index structure from the cache or the store.
+func (c *IndexCache) GetIndex(name string) (i Index, e error) {
+	r, err := c.GetIndexReader(name)
+	if err != nil {
+		return i, err
+	}
+	defer r.Close()
+	return IndexFromReaderWithDigest(r, c.indexDigest())
+}
+
+// Cached indexes use the hash algorithm of the wrapped store.
+func (c *IndexCache) indexDigest() HashAlgorithm {
+	return indexStoreDigest(c.s)
+}
+
+// Unwrap returns the index store that is being cached.
+func (c *IndexCache) Unwrap() IndexStore {
+	return c.s
+}
+
+// Close the underlying store.
+func (c *IndexCache) Close() error {
+	return c.s.Close()
+}
+
+func (c *IndexCache) String() string {
+	return c.s.String()
+}
+
+// Writes an index into the cache and removes older versions of it.
+func (c *IndexCache) store(key, name string, b []byte) error {
+	old, err := filepath.Glob(filepath.Join(c.dir, key+"-*.caibx"))
+	if err != nil {
+		return err
+	}
+	f, err := tempfile.NewMode(c.dir, "."+filepath.Base(name), 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	f.Close()
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	for _, o := range old {
+		if o != name {
+			os.Remove(o)
+		}
+	}
+	return nil
+}
+
+// Returns the part of the cache file name that identifies the index, regardless
+// of its version.
+func (c *IndexCache) key(name string) string {
+	return hashString(c.s.String() + "/" + name)
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,58 @@
+package desync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexCache(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/blob1.caibx")
+	require.NoError(t, err)
+	expected, err := IndexFromReader(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	// HTTP server that counts the number of times the index is downloaded
+	var gets int
+	etag := `"v1"`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		w.Write(b)
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL + "/")
+	s, err := NewRemoteHTTPIndexStore(u, NewStoreOptionsWithDefaults())
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	c, err := NewIndexCache(s, dir)
+	require.NoError(t, err)
+
+	// The first read goes to the server, the second is served from the cache
+	for i := 0; i < 2; i++ {
+		idx, err := c.GetIndex("blob1.caibx")
+		require.NoError(t, err)
+		require.Equal(t, expected, idx)
+	}
+	require.Equal(t, 1, gets)
+
+	// The index changed in the store, it should be fetched again and replace
+	// the old version in the cache
+	etag = `"v2"`
+	_, err = c.GetIndex("blob1.caibx")
+	require.NoError(t, err)
+	require.Equal(t, 2, gets)
+	files, err := filepath.Glob(filepath.Join(dir, "*.caibx"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
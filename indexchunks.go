@@ -0,0 +1,133 @@
+package desync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// IndexChunksMissing is returned when an index references chunks that are not
+// in a store.
+type IndexChunksMissing struct {
+	Store   string
+	Missing []ChunkID
+}
+
+func (e IndexChunksMissing) Error() string {
+	return fmt.Sprintf("%d chunks referenced by the index are missing from %s, like %s", len(e.Missing), e.Store, e.Missing[0])
+}
+
+// Is makes IndexChunksMissing match ErrNotFound
+func (e IndexChunksMissing) Is(target error) bool { return target == ErrNotFound }
+
+// CheckIndexChunks confirms that all chunks referenced by the index are present
+// in the store, using n goroutines. It returns IndexChunksMissing listing the
+// chunks that aren't. Errors other than the chunk not being in the store abort
+// the check.
+func CheckIndexChunks(ctx context.Context, idx Index, s Store, n int) error {
+	if n < 1 {
+		n = 1
+	}
+	var (
+		mu      sync.Mutex
+		missing []ChunkID
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(n)
+	seen := make(map[ChunkID]struct{})
+	for _, c := range idx.Chunks {
+		if _, ok := seen[c.ID]; ok {
+			continue
+		}
+		seen[c.ID] = struct{}{}
+		if gctx.Err() != nil {
+			break
+		}
+		id := c.ID
+		g.Go(func() error {
+			hasChunk, err := s.HasChunk(id)
+			if err != nil {
+				return err
+			}
+			if !hasChunk {
+				mu.Lock()
+				missing = append(missing, id)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return IndexChunksMissing{Store: s.String(), Missing: missing}
+	}
+	return nil
+}
+
+// ChunkCheckIndexStore wraps an index store and only writes indexes to it if
+// all chunks they reference are in a chunk store. This prevents publishing
+// indexes that can't be extracted.
+type ChunkCheckIndexStore struct {
+	s      IndexWriteStore
+	chunks Store
+	n      int
+}
+
+var _ IndexWriteStore = &ChunkCheckIndexStore{}
+
+// NewChunkCheckIndexStore initializes an index store that checks the chunks of
+// indexes written to it in the chunk store, using n goroutines.
+func NewChunkCheckIndexStore(s IndexWriteStore, chunks Store, n int) *ChunkCheckIndexStore {
+	return &ChunkCheckIndexStore{s: s, chunks: chunks, n: n}
+}
+
+// GetIndexReader returns a reader for an index from the store
+func (s *ChunkCheckIndexStore) GetIndexReader(name string) (io.ReadCloser, error) {
+	return s.s.GetIndexReader(name)
+}
+
+// GetIndex reads an index from the store
+func (s *ChunkCheckIndexStore) GetIndex(name string) (Index, error) {
+	return s.s.GetIndex(name)
+}
+
+// StoreIndex writes the index to the store if all its chunks are present in
+// the chunk store.
+func (s *ChunkCheckIndexStore) StoreIndex(name string, idx Index) error {
+	return s.StoreIndexContext(context.Background(), name, idx)
+}
+
+// StoreIndexContext is like StoreIndex, but stops checking the chunks when
+// ctx is canceled.
+func (s *ChunkCheckIndexStore) StoreIndexContext(ctx context.Context, name string, idx Index) error {
+	if err := CheckIndexChunks(ctx, idx, s.chunks, s.n); err != nil {
+		return err
+	}
+	return s.s.StoreIndex(name, idx)
+}
+
+func (s *ChunkCheckIndexStore) indexDigest() HashAlgorithm {
+	return indexStoreDigest(s.s)
+}
+
+// Unwrap returns the wrapped index store.
+func (s *ChunkCheckIndexStore) Unwrap() IndexStore {
+	return s.s
+}
+
+func (s *ChunkCheckIndexStore) String() string {
+	return s.s.String()
+}
+
+// Close the wrapped index store. The chunk store is not closed.
+func (s *ChunkCheckIndexStore) Close() error {
+	return s.s.Close()
+}
@@ -0,0 +1,48 @@
+package desync
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckIndexChunks(t *testing.T) {
+	idx := readCaibxFile(t, "testdata/blob1.caibx")
+
+	// All chunks are in the store
+	s, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+	require.NoError(t, CheckIndexChunks(context.Background(), idx, s, 4))
+
+	// Some are missing from the store of another blob
+	s, err = NewLocalStore("testdata/blob2.store", StoreOptions{})
+	require.NoError(t, err)
+	err = CheckIndexChunks(context.Background(), idx, s, 4)
+	var missing IndexChunksMissing
+	require.True(t, errors.As(err, &missing))
+	require.Len(t, missing.Missing, 7)
+	require.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestChunkCheckIndexStore(t *testing.T) {
+	idx := readCaibxFile(t, "testdata/blob1.caibx")
+	dir := t.TempDir()
+	is, err := NewLocalIndexStore(dir)
+	require.NoError(t, err)
+
+	// The index isn't written if chunks are missing
+	chunks, err := NewLocalStore("testdata/blob2.store", StoreOptions{})
+	require.NoError(t, err)
+	s := NewChunkCheckIndexStore(is, chunks, 4)
+	require.Error(t, s.StoreIndex("blob1.caibx", idx))
+	require.NoFileExists(t, filepath.Join(dir, "blob1.caibx"))
+
+	chunks, err = NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+	s = NewChunkCheckIndexStore(is, chunks, 4)
+	require.NoError(t, s.StoreIndex("blob1.caibx", idx))
+	require.FileExists(t, filepath.Join(dir, "blob1.caibx"))
+}
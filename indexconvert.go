@@ -0,0 +1,120 @@
+package desync
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Feature flags describing what's stored in a catar archive. An index with any
+// of these set is an archive index (caidx), otherwise a blob index (caibx).
+const archiveContentFlags uint64 = CaFormatWith16BitUIDs |
+	CaFormatWith32BitUIDs |
+	CaFormatWithUserNames |
+	CaFormatWithSecTime |
+	CaFormatWithUSecTime |
+	CaFormatWithNSecTime |
+	CaFormatWith2SecTime |
+	CaFormatWithReadOnly |
+	CaFormatWithPermissions |
+	CaFormatWithSymlinks |
+	CaFormatWithDeviceNodes |
+	CaFormatWithFIFOs |
+	CaFormatWithSockets |
+	CaFormatWithFlagHidden |
+	CaFormatWithFlagSystem |
+	CaFormatWithFlagArchive |
+	CaFormatWithFlagAppend |
+	CaFormatWithFlagNoAtime |
+	CaFormatWithFlagCompr |
+	CaFormatWithFlagNoCow |
+	CaFormatWithFlagNoDump |
+	CaFormatWithFlagDirSync |
+	CaFormatWithFlagImmutable |
+	CaFormatWithFlagSync |
+	CaFormatWithFlagNoComp |
+	CaFormatWithFlagProjectInherit |
+	CaFormatWithSubvolume |
+	CaFormatWithSubvolumeRO |
+	CaFormatWithXattrs |
+	CaFormatWithACL |
+	CaFormatWithSELinux |
+	CaFormatWithFcaps
+
+// All feature flags known to casync.
+const knownFeatureFlags = archiveContentFlags |
+	CaFormatExcludeFile |
+	CaFormatSHA512256 |
+	CaFormatExcludeSubmounts |
+	CaFormatExcludeNoDump
+
+// IsArchiveIndex returns true if the feature flags of the index describe the
+// content of a catar archive, as in a caidx file.
+func IsArchiveIndex(idx Index) bool {
+	return idx.Index.FeatureFlags&archiveContentFlags != 0
+}
+
+// ValidateArchiveFeatureFlags checks that the feature flags of a catar archive
+// or archive index are consistent, with no unknown flags, one UID size and one
+// time granularity at most.
+func ValidateArchiveFeatureFlags(flags uint64) error {
+	if unknown := flags &^ knownFeatureFlags; unknown != 0 {
+		return fmt.Errorf("unknown feature flags 0x%x", unknown)
+	}
+	if flags&archiveContentFlags == 0 {
+		return errors.New("no archive feature flags set")
+	}
+	if flags&CaFormatWith16BitUIDs != 0 && flags&CaFormatWith32BitUIDs != 0 {
+		return errors.New("both 16bit and 32bit UIDs set in feature flags")
+	}
+	var times int
+	for _, f := range []uint64{CaFormatWithSecTime, CaFormatWithUSecTime, CaFormatWithNSecTime, CaFormatWith2SecTime} {
+		if flags&f != 0 {
+			times++
+		}
+	}
+	if times > 1 {
+		return errors.New("more than one time granularity set in feature flags")
+	}
+	return nil
+}
+
+// IndexToArchive returns a copy of a blob index (caibx) of a catar archive as
+// archive index (caidx). The feature flags are taken from the header of the
+// archive, which is read from the first chunk in the store, and validated. The
+// digest flag of the index is kept.
+func IndexToArchive(idx Index, s Store) (Index, error) {
+	if len(idx.Chunks) == 0 {
+		return idx, errors.New("index is empty")
+	}
+	chunk, err := s.GetChunk(idx.Chunks[0].ID)
+	if err != nil {
+		return idx, err
+	}
+	b, err := chunk.Data()
+	if err != nil {
+		return idx, err
+	}
+	d := NewFormatDecoder(bytes.NewReader(b))
+	piece, err := d.Next()
+	if err != nil {
+		return idx, errors.Wrap(err, "index does not describe a catar archive")
+	}
+	entry, ok := piece.(FormatEntry)
+	if !ok {
+		return idx, errors.New("index does not describe a catar archive")
+	}
+	if err := ValidateArchiveFeatureFlags(entry.FeatureFlags); err != nil {
+		return idx, errors.Wrap(err, "invalid catar archive")
+	}
+	idx.Index.FeatureFlags = entry.FeatureFlags&^CaFormatSHA512256 | idx.Index.FeatureFlags&CaFormatSHA512256
+	return idx, nil
+}
+
+// IndexToBlob returns a copy of an archive index (caidx) as blob index (caibx),
+// with the feature flags make would use for it.
+func IndexToBlob(idx Index) Index {
+	idx.Index.FeatureFlags = CaFormatExcludeNoDump | idx.Index.FeatureFlags&CaFormatSHA512256
+	return idx
+}
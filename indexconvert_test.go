@@ -0,0 +1,22 @@
+package desync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateArchiveFeatureFlags(t *testing.T) {
+	require.NoError(t, ValidateArchiveFeatureFlags(TarFeatureFlags|CaFormatSHA512256))
+
+	for name, flags := range map[string]uint64{
+		"blob":          CaFormatExcludeNoDump | CaFormatSHA512256,
+		"unknown flag":  TarFeatureFlags | 1<<50,
+		"both uid":      TarFeatureFlags | CaFormatWith16BitUIDs | CaFormatWith32BitUIDs,
+		"multiple time": TarFeatureFlags | CaFormatWithSecTime | CaFormatWithNSecTime,
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Error(t, ValidateArchiveFeatureFlags(flags))
+		})
+	}
+}
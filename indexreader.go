@@ -0,0 +1,161 @@
+package desync
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// IndexReader reads the chunk table of an index one chunk at a time. Unlike
+// IndexFromReader, it doesn't hold the whole table in memory, which can take
+// hundreds of MB for very large blobs.
+type IndexReader struct {
+	Index FormatIndex
+
+	// Set from the data following the chunk table once Next returned io.EOF.
+	Checksum bool
+	Metadata map[string]string
+
+	br    *bufio.Reader
+	h     hash.Hash
+	r     reader
+	start uint64 // start of the next chunk
+	err   error
+}
+
+// NewIndexReader reads the index header and the start of the chunk table. The
+// chunks are then returned by Next. The index has to use the global Digest
+// algorithm.
+func NewIndexReader(r io.Reader) (*IndexReader, error) {
+	return NewIndexReaderWithDigest(r, Digest)
+}
+
+// NewIndexReaderWithDigest works like NewIndexReader but expects the index to use
+// the hash algorithm digest. If digest is nil, indexes with any algorithm are accepted. The
+// algorithm of the index is returned by Digest.
+func NewIndexReaderWithDigest(r io.Reader, digest HashAlgorithm) (*IndexReader, error) {
+	br := bufio.NewReader(r)
+	h := sha256.New()
+	hr := hashingReader{br, h}
+	d := NewFormatDecoder(hr)
+
+	// Read the index
+	e, err := d.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading index")
+	}
+	index, ok := e.(FormatIndex)
+	if !ok {
+		return nil, errors.New("input is not an index file")
+	}
+
+	// Ensure the algorithm matches that of the index file if one is expected
+	if digest != nil {
+		if err := checkDigestFlags(digest, index.FeatureFlags); err != nil {
+			return nil, err
+		}
+	}
+
+	// Read the header of the table, the items follow
+	rd := reader{hr}
+	hdr, err := rd.ReadHeader()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading chunk table")
+	}
+	if hdr.Type != CaFormatTable {
+		return nil, errors.New("index table not found in input")
+	}
+	if hdr.Size != math.MaxUint64 {
+		return nil, InvalidFormat{"expected size MAX_UINT64 in format table"}
+	}
+	return &IndexReader{Index: index, br: br, h: h, r: rd}, nil
+}
+
+// Digest returns the hash algorithm of the chunk IDs in the index.
+func (r *IndexReader) Digest() HashAlgorithm {
+	return digestFromFlags(r.Index.FeatureFlags)
+}
+
+// Next returns the next chunk from the table. It returns io.EOF after the last
+// chunk, once the rest of the index was read and its checksum verified.
+func (r *IndexReader) Next() (IndexChunk, error) {
+	if r.err != nil {
+		return IndexChunk{}, r.err
+	}
+	c, err := r.readChunk()
+	if err != nil {
+		r.err = err
+	}
+	return c, err
+}
+
+func (r *IndexReader) readChunk() (IndexChunk, error) {
+	offset, err := r.r.ReadUint64()
+	if err != nil {
+		return IndexChunk{}, errors.Wrap(unexpectedEOF(err), "reading chunk table")
+	}
+	if offset == 0 {
+		if err := r.readTrailer(); err != nil {
+			return IndexChunk{}, err
+		}
+		return IndexChunk{}, io.EOF
+	}
+	id, err := r.r.ReadID()
+	if err != nil {
+		return IndexChunk{}, errors.Wrap(unexpectedEOF(err), "reading chunk table")
+	}
+	c := IndexChunk{ID: id, Start: r.start, Size: offset - r.start}
+	r.start = offset
+	// Check the max size of the chunk only. The min apperently doesn't apply
+	// to the last chunk.
+	if c.Size > r.Index.ChunkSizeMax {
+		return c, fmt.Errorf("chunk size %d is larger than maximum %d", c.Size, r.Index.ChunkSizeMax)
+	}
+	return c, nil
+}
+
+// Reads the tail of the table and the optional metadata and checksum after it.
+func (r *IndexReader) readTrailer() error {
+	x, err := r.r.ReadUint64() // zero fill 2
+	if err != nil {
+		return errors.Wrap(unexpectedEOF(err), "reading chunk table")
+	}
+	if x != 0 {
+		return InvalidFormat{"tail marker not found"}
+	}
+	if _, err = r.r.ReadUint64(); err != nil { // index offset
+		return errors.Wrap(unexpectedEOF(err), "reading chunk table")
+	}
+	if _, err = r.r.ReadUint64(); err != nil { // size
+		return errors.Wrap(unexpectedEOF(err), "reading chunk table")
+	}
+	if x, err = r.r.ReadUint64(); err != nil { // marker
+		return errors.Wrap(unexpectedEOF(err), "reading chunk table")
+	}
+	if x != CaFormatTableTailMarker {
+		return InvalidFormat{"tail marker not found"}
+	}
+
+	// Read the metadata if present, it's covered by the checksum
+	r.Metadata, err = readIndexMetadata(r.br, hashingReader{r.br, r.h})
+	if err != nil {
+		return err
+	}
+
+	// Verify the checksum trailer if there is one
+	r.Checksum, err = readIndexChecksum(r.br, r.h.Sum(nil))
+	return err
+}
+
+// The table is cut short if it ends before the tail marker.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
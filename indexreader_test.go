@@ -0,0 +1,65 @@
+package desync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexReader(t *testing.T) {
+	in, err := ioutil.ReadFile("testdata/blob1.caibx")
+	require.NoError(t, err)
+	idx, err := IndexFromReader(bytes.NewReader(in))
+	require.NoError(t, err)
+
+	// Write the index with metadata and checksum, and read it back one chunk at
+	// a time
+	idx.Metadata = map[string]string{"name": "blob1"}
+	idx.Checksum = true
+	out := new(bytes.Buffer)
+	_, err = idx.WriteTo(out)
+	require.NoError(t, err)
+	b := out.Bytes()
+
+	ir, err := NewIndexReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Equal(t, idx.Index.ChunkSizeMax, ir.Index.ChunkSizeMax)
+	var chunks []IndexChunk
+	for {
+		c, err := ir.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, c)
+	}
+	require.Equal(t, idx.Chunks, chunks)
+	require.Equal(t, idx.Metadata, ir.Metadata)
+	require.True(t, ir.Checksum)
+
+	// Further calls keep returning EOF
+	_, err = ir.Next()
+	require.Equal(t, io.EOF, err)
+
+	// A truncated table fails, even if it ends between chunks
+	ir, err = NewIndexReader(bytes.NewReader(b[:48+16+40]))
+	require.NoError(t, err)
+	_, err = ir.Next()
+	require.NoError(t, err)
+	_, err = ir.Next()
+	require.Error(t, err)
+	require.NotEqual(t, io.EOF, err)
+
+	// A damaged index is only detected at the end of the table
+	damaged := append([]byte{}, b...)
+	damaged[48+16+10] ^= 0x01
+	ir, err = NewIndexReader(bytes.NewReader(damaged))
+	require.NoError(t, err)
+	for err == nil {
+		_, err = ir.Next()
+	}
+	require.NotEqual(t, io.EOF, err)
+}
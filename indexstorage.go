@@ -0,0 +1,59 @@
+package desync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Returns the converters applied to indexes in index stores. Indexes are only
+// converted if EncryptIndexes is set. They are then compressed (unless
+// Uncompressed is set) and encrypted, just like chunks.
+func (o *StoreOptions) indexConverters() (Converters, error) {
+	if !o.EncryptIndexes {
+		return nil, nil
+	}
+	if o.EncryptionPassword == "" {
+		return nil, errors.New("encrypting indexes requires an encryption password")
+	}
+	return o.converters(), nil
+}
+
+// Returns a reader of the plain index from a reader of an index in storage
+// format. The index is read into memory to decrypt it. Closes r if the index is
+// converted.
+func indexReaderFromStorage(r io.ReadCloser, c Converters) (io.ReadCloser, error) {
+	if len(c) == 0 {
+		return r, nil
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err = c.fromStorage(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt index: %w", err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Writes an index to w in storage format.
+func writeIndexToStorage(w io.Writer, idx Index, c Converters) error {
+	if len(c) == 0 {
+		_, err := idx.WriteTo(w)
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if _, err := idx.WriteTo(buf); err != nil {
+		return err
+	}
+	b, err := c.toStorage(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,135 @@
+package desync
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultChunkLayout is the template for chunk names used by casync and desync
+// unless a different one is configured, like 0123/0123abcd...cacnk.
+const DefaultChunkLayout = "{prefix}/{id}{ext}"
+
+// ChunkLayout defines how chunk IDs map to object names (or file paths) in a
+// store. It's built from a template which can contain these placeholders:
+//
+//	{id}        the chunk ID in hex
+//	{prefix}    the first 4 characters of the ID
+//	{prefix:N}  the first N characters of the ID
+//	{ext}       the chunk file extension of the store, .cacnk or none if uncompressed
+//
+// Directories are separated by "/". The template needs to contain {id} so chunk
+// names can be converted back into IDs when listing a store. Examples are
+// "{id}{ext}" for a flat layout or "{prefix:2}/{id}.chunk" for a different
+// prefix length and a custom extension. The zero value is the default layout
+// for compressed chunks.
+type ChunkLayout struct {
+	template string
+	ext      string
+	re       *regexp.Regexp
+}
+
+var chunkLayoutPlaceholder = regexp.MustCompile(`\{(id|ext|prefix(?::(\d+))?)\}`)
+
+// NewChunkLayout parses a layout template. The default layout is used if the
+// template is empty.
+func NewChunkLayout(template string, compressed bool) (ChunkLayout, error) {
+	if template == "" {
+		template = DefaultChunkLayout
+	}
+	ext := UncompressedChunkExt
+	if compressed {
+		ext = CompressedChunkExt
+	}
+
+	// Build a regular expression to parse names in this layout
+	var (
+		expr  strings.Builder
+		hasID bool
+		last  int
+	)
+	expr.WriteString("^")
+	for _, m := range chunkLayoutPlaceholder.FindAllStringSubmatchIndex(template, -1) {
+		expr.WriteString(regexp.QuoteMeta(template[last:m[0]]))
+		last = m[1]
+		switch name := template[m[2]:m[3]]; {
+		case name == "id":
+			if hasID {
+				return ChunkLayout{}, fmt.Errorf("chunk layout '%s' contains {id} more than once", template)
+			}
+			hasID = true
+			expr.WriteString("([0-9a-f]{64})")
+		case name == "ext":
+			expr.WriteString(regexp.QuoteMeta(ext))
+		default: // prefix
+			n := 4
+			if m[4] >= 0 {
+				n, _ = strconv.Atoi(template[m[4]:m[5]])
+				if n < 1 || n > 64 {
+					return ChunkLayout{}, fmt.Errorf("invalid prefix length %d in chunk layout '%s'", n, template)
+				}
+			}
+			fmt.Fprintf(&expr, "[0-9a-f]{%d}", n)
+		}
+	}
+	expr.WriteString(regexp.QuoteMeta(template[last:]))
+	expr.WriteString("$")
+	if !hasID {
+		return ChunkLayout{}, fmt.Errorf("chunk layout '%s' does not contain {id}", template)
+	}
+	if strings.HasPrefix(template, "/") {
+		return ChunkLayout{}, fmt.Errorf("chunk layout '%s' can not start with /", template)
+	}
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return ChunkLayout{}, err
+	}
+	return ChunkLayout{template: template, ext: ext, re: re}, nil
+}
+
+// Name returns the name of a chunk, relative to the root of the store.
+func (l ChunkLayout) Name(id ChunkID) string {
+	if l.re == nil { // zero value, use the default layout
+		l, _ = NewChunkLayout("", true)
+	}
+	sID := id.String()
+	return chunkLayoutPlaceholder.ReplaceAllStringFunc(l.template, func(p string) string {
+		switch p {
+		case "{id}":
+			return sID
+		case "{ext}":
+			return l.ext
+		case "{prefix}":
+			return sID[:4]
+		default: // {prefix:N}, already validated
+			n, _ := strconv.Atoi(p[len("{prefix:") : len(p)-1])
+			return sID[:n]
+		}
+	})
+}
+
+// ID parses the name of a chunk relative to the root of the store and returns
+// its ID. Fails if the name doesn't match the layout.
+func (l ChunkLayout) ID(name string) (ChunkID, error) {
+	if l.re == nil {
+		l, _ = NewChunkLayout("", true)
+	}
+	m := l.re.FindStringSubmatch(name)
+	if m == nil {
+		return ChunkID{}, fmt.Errorf("%s is not a chunk", name)
+	}
+	id, err := ChunkIDFromString(m[1])
+	if err != nil {
+		return ChunkID{}, err
+	}
+	// Make sure the prefixes match the ID too
+	if l.Name(id) != name {
+		return ChunkID{}, fmt.Errorf("%s is not a chunk", name)
+	}
+	return id, nil
+}
+
+func (l ChunkLayout) String() string {
+	return l.template
+}
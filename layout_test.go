@@ -0,0 +1,76 @@
+package desync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkLayout(t *testing.T) {
+	id, err := ChunkIDFromString("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		template   string
+		compressed bool
+		name       string
+	}{
+		{"", true, "0123/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.cacnk"},
+		{"", false, "0123/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+		{"{id}{ext}", true, "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.cacnk"},
+		{"{prefix:2}/{prefix:4}/{id}.chunk", true, "01/0123/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.chunk"},
+		{"chunks/{id}.nar.zst", false, "chunks/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.nar.zst"},
+	} {
+		t.Run(test.template, func(t *testing.T) {
+			l, err := NewChunkLayout(test.template, test.compressed)
+			require.NoError(t, err)
+			require.Equal(t, test.name, l.Name(id))
+			parsed, err := l.ID(test.name)
+			require.NoError(t, err)
+			require.Equal(t, id, parsed)
+		})
+	}
+
+	// Names that don't match the layout are rejected, including wrong prefixes
+	l, err := NewChunkLayout("", true)
+	require.NoError(t, err)
+	for _, name := range []string{
+		"0123/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"4567/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.cacnk",
+		"0123/.tmp-cacnk123",
+	} {
+		_, err := l.ID(name)
+		require.Error(t, err, name)
+	}
+
+	// Invalid templates
+	for _, template := range []string{"{prefix}/chunk", "{id}/{id}", "{prefix:0}/{id}", "/{id}"} {
+		_, err := NewChunkLayout(template, true)
+		require.Error(t, err, template)
+	}
+}
+
+func TestLocalStoreChunkLayout(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocalStore(dir, StoreOptions{ChunkLayout: "{id}.chunk"})
+	require.NoError(t, err)
+
+	chunk := NewChunk([]byte("some data"))
+	require.NoError(t, s.StoreChunk(chunk))
+	id := chunk.ID()
+	_, err = os.Stat(filepath.Join(dir, id.String()+".chunk"))
+	require.NoError(t, err)
+
+	_, err = s.GetChunk(chunk.ID())
+	require.NoError(t, err)
+
+	var ids []ChunkID
+	require.NoError(t, s.ListChunks(context.Background(), func(id ChunkID) error {
+		ids = append(ids, id)
+		return nil
+	}))
+	require.Equal(t, []ChunkID{chunk.ID()}, ids)
+}
@@ -9,11 +9,15 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/folbricht/tempfile"
 )
 
 var _ WriteStore = LocalStore{}
+var _ PruneProgressStore = LocalStore{}
+var _ PruneDryRunStore = LocalStore{}
+var _ ChunkLister = LocalStore{}
 
 const (
 	tmpChunkPrefix = ".tmp-cacnk"
@@ -30,6 +34,7 @@ type LocalStore struct {
 	Opt StoreOptions
 
 	converters Converters
+	layout     ChunkLayout
 }
 
 // NewLocalStore creates an instance of a local castore, it only checks presence
@@ -42,7 +47,20 @@ func NewLocalStore(dir string, opt StoreOptions) (LocalStore, error) {
 	if !info.IsDir() {
 		return LocalStore{}, fmt.Errorf("%s is not a directory", dir)
 	}
-	return LocalStore{Base: dir, Opt: opt, converters: opt.converters()}, nil
+	layout, err := opt.chunkLayout()
+	if err != nil {
+		return LocalStore{}, err
+	}
+	if _, err := DigestByName(opt.Digest); err != nil {
+		return LocalStore{}, err
+	}
+	return LocalStore{Base: dir, Opt: opt, converters: opt.converters(), layout: layout}, nil
+}
+
+// Confirms the store directory is still present, a missing chunk doesn't tell
+// the difference.
+func (s LocalStore) checkReachable() error {
+	return checkDir(s.Base)
 }
 
 // GetChunk reads and returns one (compressed!) chunk from the store
@@ -52,7 +70,12 @@ func (s LocalStore) GetChunk(id ChunkID) (*Chunk, error) {
 	if os.IsNotExist(err) {
 		return nil, ChunkMissing{id}
 	}
-	return NewChunkFromStorage(id, b, s.converters, s.Opt.SkipVerify)
+	if err == nil && s.UpdateTimes {
+		// Mark the chunk as recently used, failures don't matter much
+		now := time.Now()
+		_ = os.Chtimes(p, now, now)
+	}
+	return newChunkFromStorage(id, b, s.converters, s.Opt.SkipVerify, s.Opt.digest())
 }
 
 // RemoveChunk deletes a chunk, typically an invalid one, from the filesystem.
@@ -65,6 +88,29 @@ func (s LocalStore) RemoveChunk(id ChunkID) error {
 	return os.Remove(p)
 }
 
+// QuarantineChunk moves a chunk, typically an invalid one, out of the store and
+// into the quarantine directory configured in the store options. The file is
+// given a timestamped name to preserve multiple copies of the same chunk. Returns
+// the new location of the chunk file.
+func (s LocalStore) QuarantineChunk(id ChunkID) (string, error) {
+	if s.Opt.Quarantine == "" {
+		return "", fmt.Errorf("no quarantine directory configured for store %s", s)
+	}
+	_, p := s.nameFromID(id)
+	if _, err := os.Stat(p); err != nil {
+		return "", ChunkMissing{id}
+	}
+	if err := os.MkdirAll(s.Opt.Quarantine, 0755); err != nil {
+		return "", err
+	}
+	timestamp := time.Now().UTC().Format("20060102T150405.000000000Z")
+	target := filepath.Join(s.Opt.Quarantine, id.String()+"-"+timestamp+filepath.Ext(p))
+	if err := os.Rename(p, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
 // StoreChunk adds a new chunk to the store
 func (s LocalStore) StoreChunk(chunk *Chunk) error {
 	d, p := s.nameFromID(chunk.ID())
@@ -88,11 +134,25 @@ func (s LocalStore) StoreChunk(chunk *Chunk) error {
 		os.Remove(tmp.Name()) // clean up
 		return err
 	}
+	if s.Opt.Fsync {
+		if err = tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
 	tmp.Close() // Windows can't rename open files, close explicitly
-	return os.Rename(tmp.Name(), p)
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	if s.Opt.FsyncDir {
+		return SyncDir(d)
+	}
+	return nil
 }
 
-// Verify all chunks in the store. If repair is set true, bad chunks are deleted.
+// Verify all chunks in the store. If repair is set true, bad chunks are deleted,
+// or moved into the quarantine directory if one is set in the store options.
 // n determines the number of concurrent operations. w is used to write any messages
 // intended for the user, typically os.Stderr.
 func (s LocalStore) Verify(ctx context.Context, n int, repair bool, w io.Writer) error {
@@ -106,10 +166,16 @@ func (s LocalStore) Verify(ctx context.Context, n int, repair bool, w io.Writer)
 			for id := range ids {
 				_, err := s.GetChunk(id)
 				switch err.(type) {
-				case ChunkInvalid: // bad chunk, report and delete (if repair=true)
+				case ChunkInvalid: // bad chunk, report and delete or quarantine (if repair=true)
 					msg := err.Error()
 					if repair {
-						if err = s.RemoveChunk(id); err != nil {
+						if s.Opt.Quarantine != "" {
+							if target, err := s.QuarantineChunk(id); err != nil {
+								msg = msg + ":" + err.Error()
+							} else {
+								msg = msg + ": moved to " + target
+							}
+						} else if err = s.RemoveChunk(id); err != nil {
 							msg = msg + ":" + err.Error()
 						} else {
 							msg = msg + ": removed"
@@ -125,9 +191,20 @@ func (s LocalStore) Verify(ctx context.Context, n int, repair bool, w io.Writer)
 		}()
 	}
 
-	// Go trough all chunks underneath Base, filtering out other files, then feed
-	// the IDs to the workers
-	err := filepath.Walk(s.Base, func(path string, info os.FileInfo, err error) error {
+	// Go trough all chunks in the store and feed the IDs to the workers
+	err := s.ListChunks(ctx, func(id ChunkID) error {
+		ids <- id
+		return nil
+	})
+	close(ids)
+	wg.Wait()
+	return err
+}
+
+// ListChunks walks all chunks underneath Base, filtering out other files, and
+// calls fn with the ID of each one.
+func (s LocalStore) ListChunks(ctx context.Context, fn func(ChunkID) error) error {
+	return filepath.Walk(s.Base, func(path string, info os.FileInfo, err error) error {
 		// See if we're meant to stop
 		select {
 		case <-ctx.Done():
@@ -140,37 +217,45 @@ func (s LocalStore) Verify(ctx context.Context, n int, repair bool, w io.Writer)
 		if info.IsDir() { // Skip dirs
 			return nil
 		}
-		// Skip compressed chunks if this is running in uncompressed mode and vice-versa
-		var sID string
-		if s.Opt.Uncompressed {
-			if !strings.HasSuffix(path, UncompressedChunkExt) {
-				return nil
-			}
-			sID = strings.TrimSuffix(filepath.Base(path), UncompressedChunkExt)
-		} else {
-			if !strings.HasSuffix(path, CompressedChunkExt) {
-				return nil
-			}
-			sID = strings.TrimSuffix(filepath.Base(path), CompressedChunkExt)
-		}
 		// Convert the name into a checksum, if that fails we're probably not looking
-		// at a chunk file and should skip it.
-		id, err := ChunkIDFromString(sID)
+		// at a chunk file and should skip it. This also skips compressed chunks if
+		// this is running in uncompressed mode and vice-versa.
+		id, err := s.idFromName(path)
 		if err != nil {
 			return nil
 		}
-		// Feed the workers
-		ids <- id
-		return nil
+		return fn(id)
 	})
-	close(ids)
-	wg.Wait()
-	return err
 }
 
 // Prune removes any chunks from the store that are not contained in a list
 // of chunks
 func (s LocalStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
+	return s.PruneWithProgress(ctx, ids, NullProgressBar{})
+}
+
+// PruneWithProgress works like Prune and reports the removed chunks to pb.
+func (s LocalStore) PruneWithProgress(ctx context.Context, ids map[ChunkID]struct{}, pb ProgressBar) error {
+	list := func(ctx context.Context, fn func(ChunkID, int64) error) error {
+		return s.prune(ctx, ids, false, fn)
+	}
+	return pruneConcurrently(ctx, s.Opt, pb, list, s.RemoveChunk)
+}
+
+// PruneDryRun returns the chunks that Prune would remove from the store, without
+// removing anything.
+func (s LocalStore) PruneDryRun(ctx context.Context, ids map[ChunkID]struct{}) ([]PruneCandidate, error) {
+	var candidates []PruneCandidate
+	err := s.prune(ctx, ids, true, func(id ChunkID, size int64) error {
+		candidates = append(candidates, PruneCandidate{ID: id, Size: size})
+		return nil
+	})
+	return candidates, err
+}
+
+// Calls fn for every chunk in the store that is not in ids. Partially written
+// chunk files are removed unless dryRun is set.
+func (s LocalStore) prune(ctx context.Context, ids map[ChunkID]struct{}, dryRun bool, fn func(ChunkID, int64) error) error {
 	// Go trough all chunks underneath Base, filtering out other directories and files
 	err := filepath.Walk(s.Base, func(path string, info os.FileInfo, err error) error {
 		// See if we're meant to stop
@@ -188,35 +273,23 @@ func (s LocalStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
 
 		// If the chunk is only partially downloaded remove it
 		if strings.HasPrefix(filepath.Base(path), tmpChunkPrefix) {
-			_ = os.Remove(path)
+			if !dryRun {
+				_ = os.Remove(path)
+			}
 			return nil
 		}
 
-		// Skip compressed chunks if this is running in uncompressed mode and vice-versa
-		var sID string
-		if s.Opt.Uncompressed {
-			if !strings.HasSuffix(path, UncompressedChunkExt) {
-				return nil
-			}
-			sID = strings.TrimSuffix(filepath.Base(path), UncompressedChunkExt)
-		} else {
-			if !strings.HasSuffix(path, CompressedChunkExt) {
-				return nil
-			}
-			sID = strings.TrimSuffix(filepath.Base(path), CompressedChunkExt)
-		}
 		// Convert the name into a checksum, if that fails we're probably not looking
-		// at a chunk file and should skip it.
-		id, err := ChunkIDFromString(sID)
+		// at a chunk file and should skip it. This also skips compressed chunks if
+		// this is running in uncompressed mode and vice-versa.
+		id, err := s.idFromName(path)
 		if err != nil {
 			return nil
 		}
 		// See if the chunk we're looking at is in the list we want to keep, if not
 		// remove it.
 		if _, ok := ids[id]; !ok {
-			if err = s.RemoveChunk(id); err != nil {
-				return err
-			}
+			return fn(id, info.Size())
 		}
 		return nil
 	})
@@ -254,13 +327,16 @@ func (s LocalStore) GetChunkSize(id ChunkID) (int64, error) {
 }
 
 func (s LocalStore) nameFromID(id ChunkID) (dir, name string) {
-	sID := id.String()
-	dir = filepath.Join(s.Base, sID[0:4])
-	name = filepath.Join(dir, sID)
-	if s.Opt.Uncompressed {
-		name += UncompressedChunkExt
-	} else {
-		name += CompressedChunkExt
+	name = filepath.Join(s.Base, filepath.FromSlash(s.layout.Name(id)))
+	return filepath.Dir(name), name
+}
+
+// Returns the ID of a chunk file found underneath Base, or an error if the file
+// isn't a chunk.
+func (s LocalStore) idFromName(path string) (ChunkID, error) {
+	rel, err := filepath.Rel(s.Base, path)
+	if err != nil {
+		return ChunkID{}, err
 	}
-	return
+	return s.layout.ID(filepath.ToSlash(rel))
 }
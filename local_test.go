@@ -4,6 +4,8 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -147,3 +149,63 @@ func TestLocalStoreErrorHandling(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLocalStoreQuarantine(t *testing.T) {
+	store := t.TempDir()
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+
+	s, err := NewLocalStore(store, StoreOptions{Quarantine: quarantine})
+	require.NoError(t, err)
+
+	// Put an invalid chunk into the store
+	idInvalid, err := ChunkIDFromString("1000000000000000000000000000000000000000000000000000000000000000")
+	require.NoError(t, err)
+
+	dirInvalid, nameInvalid := s.nameFromID(idInvalid)
+	_ = os.Mkdir(dirInvalid, 0755)
+	err = ioutil.WriteFile(nameInvalid, []byte("invalid data"), 0644)
+	require.NoError(t, err)
+
+	// Verify with repair enabled should move the chunk into quarantine
+	err = s.Verify(context.Background(), 1, true, ioutil.Discard)
+	require.NoError(t, err)
+
+	_, err = s.GetChunk(idInvalid)
+	if _, ok := err.(ChunkMissing); !ok {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(quarantine)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.True(t, strings.HasPrefix(files[0].Name(), idInvalid.String()))
+
+	b, err := ioutil.ReadFile(filepath.Join(quarantine, files[0].Name()))
+	require.NoError(t, err)
+	require.Equal(t, []byte("invalid data"), b)
+
+	// Reading the invalid chunk through a repairable cache should quarantine it as well
+	err = ioutil.WriteFile(nameInvalid, []byte("invalid data"), 0644)
+	require.NoError(t, err)
+	_, err = NewRepairableCache(s).GetChunk(idInvalid)
+	if _, ok := err.(ChunkMissing); !ok {
+		t.Fatal(err)
+	}
+	files, err = ioutil.ReadDir(quarantine)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+}
+
+func TestLocalStoreFsync(t *testing.T) {
+	s, err := NewLocalStore(t.TempDir(), StoreOptions{Fsync: true, FsyncDir: true})
+	require.NoError(t, err)
+
+	chunkIn := NewChunk([]byte("some data"))
+	require.NoError(t, s.StoreChunk(chunkIn))
+
+	chunkOut, err := s.GetChunk(chunkIn.ID())
+	require.NoError(t, err)
+	b, err := chunkOut.Data()
+	require.NoError(t, err)
+	require.Equal(t, []byte("some data"), b)
+}
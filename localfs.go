@@ -1,8 +1,10 @@
 package desync
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -37,6 +39,17 @@ type LocalFSOptions struct {
 
 	// Reads all timestamps as zero. Used in tar operations to avoid unneccessary changes.
 	NoTime bool
+
+	// When writing files, don't apply file capabilities from the archive.
+	NoFCaps bool
+
+	// When writing files, don't apply POSIX ACLs from the archive.
+	NoACLs bool
+
+	// When writing files, leave existing files in place if their content matches
+	// the archive, and replace them otherwise. Metadata is applied in either case.
+	// Useful to update a previously extracted tree without rewriting unchanged data.
+	Overlay bool
 }
 
 var _ FilesystemWriter = &LocalFS{}
@@ -70,6 +83,22 @@ func (fs *LocalFS) CreateDir(n NodeDirectory) error {
 func (fs *LocalFS) CreateFile(n NodeFile) error {
 	dst := filepath.Join(fs.Root, n.Name)
 
+	if fs.opts.Overlay {
+		ok, err := overlayFile(dst, n)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := fs.SetFilePermissions(n); err != nil {
+				return err
+			}
+			if n.MTime == time.Unix(0, 0) {
+				return nil
+			}
+			return os.Chtimes(dst, n.MTime, n.MTime)
+		}
+	}
+
 	if err := os.RemoveAll(dst); err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -79,6 +108,9 @@ func (fs *LocalFS) CreateFile(n NodeFile) error {
 	}
 	defer f.Close()
 	if _, err = io.Copy(f, n.Data); err != nil {
+		// Don't leave an incomplete file behind, for example if interrupted
+		f.Close()
+		os.Remove(dst)
 		return err
 	}
 
@@ -95,6 +127,13 @@ func (fs *LocalFS) CreateFile(n NodeFile) error {
 func (fs *LocalFS) CreateSymlink(n NodeSymlink) error {
 	dst := filepath.Join(fs.Root, n.Name)
 
+	// Keep the link if it already points to the right target
+	if fs.opts.Overlay {
+		if target, err := os.Readlink(dst); err == nil && target == n.Target {
+			return fs.SetSymlinkPermissions(n)
+		}
+	}
+
 	if err := syscall.Unlink(dst); err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -109,6 +148,81 @@ func (fs *LocalFS) CreateSymlink(n NodeSymlink) error {
 	return nil
 }
 
+// Updates an existing file at dst with the content of n. Files with the same
+// size and modification time are considered identical and skipped. If only
+// the size matches, the content is compared. Once it differs, the file is
+// written to a temporary file that replaces dst, since writing to it in place
+// would change the content of any hardlinks to it as well. Returns false if
+// the file doesn't exist or can't be updated and needs to be written from
+// scratch, in which case n.Data hasn't been read from.
+func overlayFile(dst string, n NodeFile) (bool, error) {
+	info, err := os.Lstat(dst)
+	if err != nil || !info.Mode().IsRegular() || uint64(info.Size()) != n.Size {
+		return false, nil
+	}
+	if n.MTime != time.Unix(0, 0) && info.ModTime().Equal(n.MTime) {
+		_, err := io.Copy(ioutil.Discard, n.Data)
+		return true, err
+	}
+	f, err := os.Open(dst)
+	if err != nil {
+		return false, nil
+	}
+	defer f.Close()
+
+	var (
+		a   = make([]byte, 64*1024)
+		b   = make([]byte, 64*1024)
+		pos int64
+	)
+	for {
+		na, errA := io.ReadFull(n.Data, a)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return true, errA
+		}
+		if na == 0 {
+			return true, nil
+		}
+		nb, errB := io.ReadFull(f, b[:na])
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return true, errB
+		}
+		if nb != na || !bytes.Equal(a[:na], b[:na]) {
+			// Content differs from here on. Copy the matching part of the
+			// existing file and write the rest from the archive.
+			return true, replaceFile(dst, io.MultiReader(
+				io.NewSectionReader(f, 0, pos),
+				bytes.NewReader(a[:na]),
+				n.Data,
+			))
+		}
+		pos += int64(na)
+	}
+}
+
+// Writes the content of r into a temporary file in the same directory and
+// renames it to dst once complete.
+func replaceFile(dst string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
 type walkEntry struct {
 	path string
 	info os.FileInfo
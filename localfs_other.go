@@ -46,6 +46,11 @@ func (fs *LocalFS) SetDirPermissions(n NodeDirectory) error {
 			return err
 		}
 	}
+	if !fs.opts.NoACLs && n.ACL != nil {
+		if err := setACL(dst, n.Mode, n.ACL); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -71,6 +76,17 @@ func (fs *LocalFS) SetFilePermissions(n NodeFile) error {
 			return err
 		}
 	}
+	if !fs.opts.NoACLs && n.ACL != nil {
+		if err := setACL(dst, n.Mode, n.ACL); err != nil {
+			return err
+		}
+	}
+	// Capabilities need to be set last, changing the owner clears them
+	if !fs.opts.NoFCaps {
+		if err := setFCaps(dst, n.FCaps); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -126,6 +142,11 @@ func (fs *LocalFS) CreateDevice(n NodeDevice) error {
 			return errors.Wrapf(err, "chmod %s", dst)
 		}
 	}
+	if !fs.opts.NoACLs && n.ACL != nil {
+		if err := setACL(dst, n.Mode, n.ACL); err != nil {
+			return err
+		}
+	}
 	if n.MTime == time.Unix(0, 0) {
 		return nil
 	}
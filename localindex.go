@@ -12,6 +12,9 @@ import (
 // LocalIndexStore is used to read/write index files on local disk
 type LocalIndexStore struct {
 	Path string
+
+	converters Converters
+	digest     HashAlgorithm
 }
 
 // NewLocalIndexStore creates an instance of a local index store, it only checks presence
@@ -30,10 +33,33 @@ func NewLocalIndexStore(path string) (LocalIndexStore, error) {
 	return LocalIndexStore{Path: path}, nil
 }
 
+// NewLocalIndexStoreWithOptions creates a local index store that stores indexes
+// encrypted if set in the options.
+func NewLocalIndexStoreWithOptions(path string, opt StoreOptions) (LocalIndexStore, error) {
+	converters, err := opt.indexConverters()
+	if err != nil {
+		return LocalIndexStore{}, err
+	}
+	s, err := NewLocalIndexStore(path)
+	s.converters = converters
+	s.digest = opt.digest()
+	return s, err
+}
+
+// Confirms the store directory is still present, a missing index doesn't tell
+// the difference.
+func (s LocalIndexStore) checkReachable() error {
+	return checkDir(s.Path)
+}
+
 // GetIndexReader returns a reader of an index file in the store or an error if
 // the specified index file does not exist.
 func (s LocalIndexStore) GetIndexReader(name string) (rdr io.ReadCloser, e error) {
-	return os.Open(s.Path + name)
+	f, err := os.Open(s.Path + name)
+	if err != nil {
+		return nil, err
+	}
+	return indexReaderFromStorage(f, s.converters)
 }
 
 // GetIndex returns an Index structure from the store
@@ -43,13 +69,17 @@ func (s LocalIndexStore) GetIndex(name string) (i Index, e error) {
 		return i, err
 	}
 	defer f.Close()
-	idx, err := IndexFromReader(f)
+	idx, err := IndexFromReaderWithDigest(f, s.indexDigest())
 	if os.IsNotExist(err) {
 		err = errors.Errorf("Index file does not exist: %v", err)
 	}
 	return idx, err
 }
 
+func (s LocalIndexStore) indexDigest() HashAlgorithm {
+	return digestOrDefault(s.digest)
+}
+
 // StoreIndex stores an index in the index store with the given name.
 func (s LocalIndexStore) StoreIndex(name string, idx Index) error {
 	// Write the index to file
@@ -58,8 +88,7 @@ func (s LocalIndexStore) StoreIndex(name string, idx Index) error {
 		return err
 	}
 	defer i.Close()
-	_, err = idx.WriteTo(i)
-	return err
+	return writeIndexToStorage(i, idx, s.converters)
 }
 
 func (s LocalIndexStore) String() string {
@@ -0,0 +1,95 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalIndexStoreEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	in, err := os.Open(filepath.Join("testdata", "blob1.caibx"))
+	require.NoError(t, err)
+	defer in.Close()
+	idx, err := IndexFromReader(in)
+	require.NoError(t, err)
+
+	opt := StoreOptions{EncryptIndexes: true, EncryptionPassword: "secret"}
+	s, err := NewLocalIndexStoreWithOptions(dir, opt)
+	require.NoError(t, err)
+	require.NoError(t, s.StoreIndex("blob1.caibx", idx))
+
+	// The index can be read back, but isn't readable without the password
+	out, err := s.GetIndex("blob1.caibx")
+	require.NoError(t, err)
+	require.Equal(t, idx, out)
+	f, err := os.Open(filepath.Join(dir, "blob1.caibx"))
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = IndexFromReader(f)
+	require.Error(t, err)
+
+	plain, err := NewLocalIndexStore(dir)
+	require.NoError(t, err)
+	_, err = plain.GetIndex("blob1.caibx")
+	require.Error(t, err)
+
+	s, err = NewLocalIndexStoreWithOptions(dir, StoreOptions{EncryptIndexes: true, EncryptionPassword: "wrong"})
+	require.NoError(t, err)
+	_, err = s.GetIndex("blob1.caibx")
+	require.Error(t, err)
+
+	// A password is required
+	_, err = NewLocalIndexStoreWithOptions(dir, StoreOptions{EncryptIndexes: true})
+	require.Error(t, err)
+
+	// Each index file is encrypted with its own salt, so the same index doesn't
+	// produce the same file twice
+	s, err = NewLocalIndexStoreWithOptions(dir, opt)
+	require.NoError(t, err)
+	require.NoError(t, s.StoreIndex("copy.caibx", idx))
+	b1, err := ioutil.ReadFile(filepath.Join(dir, "blob1.caibx"))
+	require.NoError(t, err)
+	b2, err := ioutil.ReadFile(filepath.Join(dir, "copy.caibx"))
+	require.NoError(t, err)
+	require.NotEqual(t, b1[:aesGCMSaltSize], b2[:aesGCMSaltSize])
+}
+
+func TestLocalIndexStoreDigest(t *testing.T) {
+	data := make([]byte, 4*ChunkSizeMaxDefault)
+	rand.Read(data)
+	cs, err := NewLocalStore(t.TempDir(), StoreOptions{Digest: "sha256"})
+	require.NoError(t, err)
+	c, err := NewChunker(bytes.NewReader(data), ChunkSizeMinDefault, ChunkSizeAvgDefault, ChunkSizeMaxDefault)
+	require.NoError(t, err)
+	idx, err := ChunkStream(WithDigest(context.Background(), SHA256{}), c, cs, 4)
+	require.NoError(t, err)
+
+	// A store configured with the digest of the index can read it while the
+	// global Digest is different, a store without it can't
+	dir := t.TempDir()
+	s, err := NewLocalIndexStoreWithOptions(dir, StoreOptions{Digest: "sha256"})
+	require.NoError(t, err)
+	require.NoError(t, s.StoreIndex("sha256.caibx", idx))
+	out, err := s.GetIndex("sha256.caibx")
+	require.NoError(t, err)
+	require.Equal(t, SHA256{}, out.Digest)
+	require.NoError(t, out.Validate())
+
+	plain, err := NewLocalIndexStore(dir)
+	require.NoError(t, err)
+	_, err = plain.GetIndex("sha256.caibx")
+	require.Error(t, err)
+
+	// The digest is taken from the wrapped store when the index is cached
+	cache, err := NewIndexCache(s, t.TempDir())
+	require.NoError(t, err)
+	_, err = cache.GetIndex("sha256.caibx")
+	require.NoError(t, err)
+}
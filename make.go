@@ -2,12 +2,12 @@ package desync
 
 import (
 	"context"
-	"crypto"
 	"fmt"
 	"io"
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // IndexFromFile chunks a file in parallel and returns an index. It does not
@@ -19,6 +19,7 @@ import (
 // This algorithm wastes some CPU and I/O if the data doesn't contain chunk
 // boundaries, for example if the whole file contains nil bytes. If progress
 // is not nil, it'll be updated with the confirmed chunk position in the file.
+// Chunks are hashed with the algorithm set in the context with WithDigest.
 func IndexFromFile(ctx context.Context,
 	name string,
 	n int,
@@ -27,22 +28,20 @@ func IndexFromFile(ctx context.Context,
 ) (Index, ChunkingStats, error) {
 
 	stats := ChunkingStats{}
+	started := time.Now()
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	var digestFlag uint64
-	if Digest.Algorithm() == crypto.SHA512_256 {
-		digestFlag = CaFormatSHA512256
-	}
-
+	digest := DigestFromContext(ctx)
 	index := Index{
 		Index: FormatIndex{
-			FeatureFlags: CaFormatExcludeNoDump | digestFlag,
+			FeatureFlags: CaFormatExcludeNoDump | digestFlag(digest),
 			ChunkSizeMin: min,
 			ChunkSizeAvg: avg,
 			ChunkSizeMax: max,
 		},
+		Digest: digest,
 	}
 
 	// If our input file has a catar header, copy its feature flags into the index
@@ -73,17 +72,18 @@ func IndexFromFile(ctx context.Context,
 	span := size / uint64(n) // initial spacing between chunkers
 
 	// Setup and start the progressbar if any
-	pb.SetTotal(int(size))
+	pb.SetTotal(int64(size))
 	pb.Start()
 	defer pb.Finish()
 
 	// Null chunks is produced when a large section of null bytes is chunked. There are no
 	// split points in those sections so it's always of max chunk size. Used for optimizations
 	// when chunking files with large empty sections.
-	nullChunk := NewNullChunk(max)
+	nullChunk := newNullChunk(max, digest)
 
 	// Create/initialize the workers
 	worker := make([]*pChunker, n)
+	stats.Workers = make([]WorkerChunkingStats, n)
 	for i := 0; i < n; i++ {
 		f, err := os.Open(name) // open one file per worker
 		if err != nil {
@@ -109,8 +109,11 @@ func IndexFromFile(ctx context.Context,
 			done:      make(chan struct{}),
 			offset:    start,
 			stats:     &stats,
+			wstats:    &stats.Workers[i],
 			nullChunk: nullChunk,
+			digest:    digest,
 		}
+		p.wstats.Offset = start
 		worker[i] = p
 	}
 
@@ -133,8 +136,13 @@ func IndexFromFile(ctx context.Context,
 		for chunk := range w.results {
 			// Assemble the list of chunks in the index
 			index.Chunks = append(index.Chunks, chunk)
-			pb.Set(int(chunk.Start + chunk.Size))
-			stats.incAccepted()
+			pb.Set(int64(chunk.Start + chunk.Size))
+			stats.incAccepted(chunk.Size)
+			w.wstats.ChunksAccepted++
+			w.wstats.BytesAccepted += chunk.Size
+			if chunk.ID == nullChunk.ID {
+				stats.NullChunks++
+			}
 		}
 		// Done reading all chunks from this worker, check for any errors
 		if w.err != nil {
@@ -146,6 +154,14 @@ func IndexFromFile(ctx context.Context,
 			break
 		}
 	}
+
+	// Stop all workers and wait for them to finish before finalizing the stats
+	for _, w := range worker {
+		w.stop()
+		for range w.results {
+		}
+	}
+	stats.finalize(time.Since(started))
 	return index, stats, nil
 }
 
@@ -163,21 +179,27 @@ type pChunker struct {
 	// the absolute position of every boundry that is returned
 	offset uint64
 
-	once  sync.Once
-	done  chan struct{}
-	err   error
-	next  *pChunker
-	eof   bool
-	sync  IndexChunk
-	stats *ChunkingStats
+	once   sync.Once
+	done   chan struct{}
+	err    error
+	next   *pChunker
+	eof    bool
+	sync   IndexChunk
+	stats  *ChunkingStats
+	wstats *WorkerChunkingStats
 
 	// Null chunk for optimizing chunking sparse files
 	nullChunk *NullChunk
+
+	// Hash algorithm for the chunk IDs
+	digest HashAlgorithm
 }
 
 func (c *pChunker) start(ctx context.Context) {
 	defer close(c.results)
 	defer c.stop()
+	started := time.Now()
+	defer func() { c.wstats.Duration = time.Since(started) }()
 	for {
 		select {
 		case <-ctx.Done():
@@ -192,7 +214,9 @@ func (c *pChunker) start(ctx context.Context) {
 			c.err = err
 			return
 		}
-		c.stats.incProduced()
+		c.stats.incProduced(uint64(len(b)))
+		c.wstats.ChunksProduced++
+		c.wstats.BytesProduced += uint64(len(b))
 		start += c.offset
 		if len(b) == 0 {
 			// TODO: If this worker reached the end of the stream and it's not the
@@ -202,7 +226,7 @@ func (c *pChunker) start(ctx context.Context) {
 			return
 		}
 		// Calculate the chunk ID
-		id := Digest.Sum(b)
+		id := c.digest.Sum(b)
 
 		// Store it in our bucket
 		chunk := IndexChunk{Start: start, Size: uint64(len(b)), ID: id}
@@ -224,6 +248,9 @@ func (c *pChunker) start(ctx context.Context) {
 				nc := chunk
 				for i := 0; i < numNullChunks; i++ {
 					nc = IndexChunk{Start: nc.Start + nc.Size, Size: uint64(len(c.nullChunk.Data)), ID: c.nullChunk.ID}
+					c.stats.incProduced(nc.Size)
+					c.wstats.ChunksProduced++
+					c.wstats.BytesProduced += nc.Size
 					c.results <- nc
 					zeroes -= uint64(len(c.nullChunk.Data))
 				}
@@ -311,12 +338,62 @@ func (c *pChunker) syncWith(chunk IndexChunk) (bool, uint64) {
 type ChunkingStats struct {
 	ChunksAccepted uint64
 	ChunksProduced uint64
+
+	// Bytes in accepted chunks and bytes split by all chunkers. Produced
+	// includes work that was discarded because chunkers had not yet synced
+	// up with the chunk boundaries of the previous one. The difference is
+	// recorded in BytesWasted.
+	BytesAccepted uint64
+	BytesProduced uint64
+	BytesWasted   uint64
+
+	// Number of accepted chunks that contain only 0-bytes
+	NullChunks uint64
+
+	// Total time spent chunking
+	Duration time.Duration
+
+	// Statistics for each of the concurrent chunkers
+	Workers []WorkerChunkingStats
 }
 
-func (s *ChunkingStats) incAccepted() {
+// WorkerChunkingStats holds statistics for one of the concurrent chunkers in
+// a parallel chunking operation.
+type WorkerChunkingStats struct {
+	// Position in the input the worker started at. For streams, this is the
+	// position of the first window processed by the worker.
+	Offset uint64
+
+	ChunksAccepted uint64
+	ChunksProduced uint64
+	BytesAccepted  uint64
+	BytesProduced  uint64
+
+	// Time the worker was active and the throughput it achieved
+	Duration       time.Duration
+	BytesPerSecond float64
+}
+
+func (s *ChunkingStats) incAccepted(size uint64) {
 	atomic.AddUint64(&s.ChunksAccepted, 1)
+	atomic.AddUint64(&s.BytesAccepted, size)
 }
 
-func (s *ChunkingStats) incProduced() {
+func (s *ChunkingStats) incProduced(size uint64) {
 	atomic.AddUint64(&s.ChunksProduced, 1)
+	atomic.AddUint64(&s.BytesProduced, size)
+}
+
+// Calculate the derived values once chunking is complete.
+func (s *ChunkingStats) finalize(d time.Duration) {
+	s.Duration = d
+	if s.BytesProduced > s.BytesAccepted {
+		s.BytesWasted = s.BytesProduced - s.BytesAccepted
+	}
+	for i := range s.Workers {
+		w := &s.Workers[i]
+		if w.Duration > 0 {
+			w.BytesPerSecond = float64(w.BytesProduced) / w.Duration.Seconds()
+		}
+	}
 }
@@ -5,11 +5,13 @@ import (
 	"context"
 	"crypto/sha512"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"testing"
 
 	"github.com/folbricht/tempfile"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParallelChunking(t *testing.T) {
@@ -63,7 +65,7 @@ func TestParallelChunking(t *testing.T) {
 			// Chunk the file with the parallel chunking algorithm and different degrees of concurrency
 			for n := 1; n <= 10; n++ {
 				t.Run(fmt.Sprintf("%s, n=%d", name, n), func(t *testing.T) {
-					index, _, err := IndexFromFile(
+					index, stats, err := IndexFromFile(
 						context.Background(),
 						f.Name(),
 						n,
@@ -79,8 +81,89 @@ func TestParallelChunking(t *testing.T) {
 							t.Fatal("chunks from parallel splitter don't match single stream chunks")
 						}
 					}
+
+					// Confirm the stats add up
+					require.Equal(t, uint64(len(index.Chunks)), stats.ChunksAccepted)
+					require.Equal(t, uint64(len(b)), stats.BytesAccepted)
+					require.Equal(t, stats.BytesProduced-stats.BytesAccepted, stats.BytesWasted)
+					var workerAccepted uint64
+					for _, w := range stats.Workers {
+						workerAccepted += w.BytesAccepted
+					}
+					require.Equal(t, stats.BytesAccepted, workerAccepted)
 				})
 			}
 		})
 	}
 }
+
+func TestParallelStreamChunking(t *testing.T) {
+	null := make([]byte, 4*ChunkSizeMaxDefault)
+	rand1 := make([]byte, 4*ChunkSizeMaxDefault)
+	rand.Read(rand1)
+	rand2 := make([]byte, 4*ChunkSizeMaxDefault)
+	rand.Read(rand2)
+
+	tests := map[string][][]byte{
+		"empty input":     {},
+		"short input":     {rand1[:100]},
+		"random input":    {rand1, rand2, rand1, rand2, rand1},
+		"leading null":    {null, null, null, null, rand1, rand2},
+		"trailing null":   {rand1, rand2, null, null, null, null},
+		"middle null":     {rand1, null, null, null, null, rand2},
+		"spread out null": {rand1, null, null, null, rand1, null, null, null, rand2},
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := join(input...)
+
+			// Chunk the input single stream first to use the results as reference
+			c, err := NewChunker(bytes.NewReader(b), ChunkSizeMinDefault, ChunkSizeAvgDefault, ChunkSizeMaxDefault)
+			require.NoError(t, err)
+			var expected []IndexChunk
+			for {
+				start, buf, err := c.Next()
+				require.NoError(t, err)
+				if len(buf) == 0 {
+					break
+				}
+				id := ChunkID(sha512.Sum512_256(buf))
+				expected = append(expected, IndexChunk{Start: start, Size: uint64(len(buf)), ID: id})
+			}
+
+			// Chunk the stream with different window sizes and degrees of concurrency,
+			// storing the chunks as well
+			for _, window := range []uint64{ChunkSizeMaxDefault, 3 * ChunkSizeMaxDefault, streamWindowChunks * ChunkSizeMaxDefault} {
+				for _, n := range []int{1, 4} {
+					t.Run(fmt.Sprintf("window=%d, n=%d", window, n), func(t *testing.T) {
+						store, err := NewLocalStore(t.TempDir(), StoreOptions{})
+						require.NoError(t, err)
+
+						// Hide the Seek method of the reader
+						r := struct{ io.Reader }{bytes.NewReader(b)}
+						index, stats, err := indexFromStream(
+							context.Background(),
+							r,
+							store,
+							n,
+							ChunkSizeMinDefault, ChunkSizeAvgDefault, ChunkSizeMaxDefault,
+							window,
+							NullProgressBar{},
+						)
+						require.NoError(t, err)
+						require.Equal(t, expected, index.Chunks)
+						require.Equal(t, uint64(len(expected)), stats.ChunksAccepted)
+						require.Equal(t, uint64(len(b)), stats.BytesAccepted)
+
+						for _, c := range expected {
+							hasChunk, err := store.HasChunk(c.ID)
+							require.NoError(t, err)
+							require.True(t, hasChunk)
+						}
+					})
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Number of max-sized chunks that fit into one window when chunking a stream
+// in parallel.
+const streamWindowChunks = 32
+
+// IndexFromStream chunks a non-seekable stream in parallel and returns an index.
+// Unlike IndexFromFile, it doesn't need to seek in the input. The stream is read
+// sequentially into large windows which are split into chunks concurrently, each
+// window independently. Since the first chunks in a window are unlikely to line up
+// with the actual chunk boundaries, the end of the previous window and the
+// beginning of the next are chunked again, serially, until a boundary is found
+// that matches one produced by the window's worker. From there on, the chunks of
+// that window are accepted.
+// Chunks are hashed with the algorithm set in the context with WithDigest.
+// If ws is not nil, the chunks are stored in it while chunking. Hashing and
+// storing is performed in n goroutines. If progress is not nil, it'll be updated
+// with the confirmed position in the stream.
+func IndexFromStream(ctx context.Context,
+	r io.Reader,
+	ws WriteStore,
+	n int,
+	min, avg, max uint64,
+	pb ProgressBar,
+) (Index, ChunkingStats, error) {
+	return indexFromStream(ctx, r, ws, n, min, avg, max, streamWindowChunks*max, pb)
+}
+
+// Window of the input stream, chunked independently by one of the workers.
+type streamWindow struct {
+	worker  int // worker that split this window
+	offset  uint64
+	data    []byte
+	final   bool
+	results chan []streamChunk
+}
+
+// Chunk produced when splitting a stream, with the data it was produced from.
+type streamChunk struct {
+	IndexChunk
+	b []byte
+}
+
+func indexFromStream(ctx context.Context,
+	r io.Reader,
+	ws WriteStore,
+	n int,
+	min, avg, max uint64,
+	windowSize uint64,
+	pb ProgressBar,
+) (Index, ChunkingStats, error) {
+	stats := ChunkingStats{}
+	started := time.Now()
+
+	if _, err := NewChunker(nil, min, avg, max); err != nil {
+		return Index{}, stats, err
+	}
+	if n < 1 {
+		n = 1
+	}
+	stats.Workers = make([]WorkerChunkingStats, n)
+
+	digest := DigestFromContext(ctx)
+	index := Index{
+		Index: FormatIndex{
+			FeatureFlags: CaFormatExcludeNoDump | digestFlag(digest),
+			ChunkSizeMin: min,
+			ChunkSizeAvg: avg,
+			ChunkSizeMax: max,
+		},
+		Digest: digest,
+	}
+
+	// Total size is unknown, the progressbar only shows the position
+	pb.SetTotal(0)
+	pb.Start()
+	defer pb.Finish()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	g, ctx := errgroup.WithContext(ctx)
+
+	var (
+		jobs    = make(chan *streamWindow)
+		pending = make(chan *streamWindow, n)
+		store   = make(chan streamChunk)
+	)
+
+	// Read the stream into windows, and hand them to the workers as well as the
+	// merging routine (in order). Read one window ahead to be able to tell if a
+	// window is the last one.
+	g.Go(func() error {
+		defer close(jobs)
+		defer close(pending)
+		var offset uint64
+		next, err := readWindow(r, windowSize)
+		if err != nil {
+			return err
+		}
+		for {
+			current := next
+			if len(current) > 0 {
+				next, err = readWindow(r, windowSize)
+				if err != nil {
+					return err
+				}
+			}
+			w := &streamWindow{
+				offset:  offset,
+				data:    current,
+				final:   len(next) == 0 || len(current) == 0,
+				results: make(chan []streamChunk, 1),
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case pending <- w:
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case jobs <- w:
+			}
+			if w.final {
+				return nil
+			}
+			offset += uint64(len(current))
+		}
+	})
+
+	// Start the workers splitting each window independently
+	for i := 0; i < n; i++ {
+		wstats := &stats.Workers[i]
+		worker := i
+		g.Go(func() error {
+			for w := range jobs {
+				started := time.Now()
+				chunks, err := splitStream(w.data, w.offset, min, avg, max, digest)
+				if err != nil {
+					return err
+				}
+				if wstats.ChunksProduced == 0 {
+					wstats.Offset = w.offset
+				}
+				wstats.ChunksProduced += uint64(len(chunks))
+				wstats.BytesProduced += uint64(len(w.data))
+				wstats.Duration += time.Since(started)
+				w.worker = worker
+				w.results <- chunks
+			}
+			return nil
+		})
+	}
+
+	// Store the accepted chunks if a store was given
+	if ws != nil {
+		s := NewChunkStorage(ws)
+		for i := 0; i < n; i++ {
+			g.Go(func() error {
+				for c := range store {
+					if err := s.StoreChunk(NewChunkWithDigest(c.b, digest)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+	}
+
+	// Merge the results of the workers in order, re-chunking the data between
+	// windows until it lines up with the chunks from the workers.
+	merge := func() error {
+		defer close(store)
+		var (
+			pos   uint64 // start of the first unconfirmed chunk
+			carry []byte // data from pos to the end of the previous window
+		)
+		nullChunk := newNullChunk(max, digest)
+		accept := func(c streamChunk) error {
+			index.Chunks = append(index.Chunks, c.IndexChunk)
+			stats.incAccepted(c.Size)
+			if c.ID == nullChunk.ID {
+				stats.NullChunks++
+			}
+			pb.Set(int64(c.Start + c.Size))
+			if ws == nil {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return Interrupted{}
+			case store <- c:
+			}
+			return nil
+		}
+		for w := range pending {
+			var candidates []streamChunk
+			select {
+			case <-ctx.Done():
+				return Interrupted{}
+			case candidates = <-w.results:
+			}
+			for _, c := range candidates {
+				stats.incProduced(c.Size)
+			}
+			wstats := &stats.Workers[w.worker]
+
+			// If the input has a catar header, copy its feature flags into the index
+			if w.offset == 0 {
+				fDecoder := NewFormatDecoder(bytes.NewReader(w.data))
+				if piece, err := fDecoder.Next(); err == nil {
+					if e, ok := piece.(FormatEntry); ok {
+						index.Index.FeatureFlags |= e.FeatureFlags
+					}
+				}
+			}
+
+			starts := make(map[uint64]int, len(candidates))
+			for i, c := range candidates {
+				starts[c.Start] = i
+			}
+
+			synced, ok := starts[pos]
+			if !ok {
+				// Re-chunk from the last confirmed position until a boundary
+				// matches one from the worker
+				combined := make([]byte, 0, len(carry)+len(w.data))
+				combined = append(append(combined, carry...), w.data...)
+				carry = nil
+				c, err := NewChunker(bytes.NewReader(combined), min, avg, max)
+				if err != nil {
+					return err
+				}
+				for {
+					start, b, err := c.Next()
+					if err != nil {
+						return err
+					}
+					if len(b) == 0 {
+						break
+					}
+					stats.incProduced(uint64(len(b)))
+					start += pos
+					end := start + uint64(len(b))
+					if !w.final && end == w.offset+uint64(len(w.data)) {
+						// Truncated at the end of the window, can't be confirmed yet
+						carry = b
+						pos = start
+						break
+					}
+					chunk := streamChunk{IndexChunk: IndexChunk{Start: start, Size: uint64(len(b)), ID: digest.Sum(b)}, b: b}
+					if err := accept(chunk); err != nil {
+						return err
+					}
+					if synced, ok = starts[end]; ok {
+						break
+					}
+				}
+				if !ok {
+					continue
+				}
+			}
+
+			// In sync with the worker's chunks, take all but the last one (unless
+			// this is the end of the stream)
+			last := len(candidates)
+			if !w.final {
+				last--
+			}
+			for _, c := range candidates[synced:last] {
+				if err := accept(c); err != nil {
+					return err
+				}
+				wstats.ChunksAccepted++
+				wstats.BytesAccepted += c.Size
+			}
+			if !w.final {
+				c := candidates[len(candidates)-1]
+				carry = c.b
+				pos = c.Start
+			}
+		}
+		// The reader may have stopped early if interrupted
+		if ctx.Err() != nil {
+			return Interrupted{}
+		}
+		return nil
+	}
+	err := merge()
+	if err != nil {
+		cancel()
+	}
+	if gErr := g.Wait(); gErr != nil {
+		err = gErr
+	}
+	stats.finalize(time.Since(started))
+	return index, stats, err
+}
+
+// Read up to size bytes from r. Returns an empty slice at the end of the stream.
+func readWindow(r io.Reader, size uint64) ([]byte, error) {
+	b := make([]byte, size)
+	n, err := io.ReadFull(r, b)
+	switch err {
+	case nil, io.EOF, io.ErrUnexpectedEOF:
+		return b[:n], nil
+	default:
+		return nil, err
+	}
+}
+
+// Split a buffer starting at offset in the stream into chunks and calculate
+// their IDs. The last chunk is cut off at the end of the buffer.
+func splitStream(b []byte, offset uint64, min, avg, max uint64, digest HashAlgorithm) ([]streamChunk, error) {
+	c, err := NewChunker(bytes.NewReader(b), min, avg, max)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []streamChunk
+	for {
+		start, data, err := c.Next()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			break
+		}
+		chunks = append(chunks, streamChunk{
+			IndexChunk: IndexChunk{Start: offset + start, Size: uint64(len(data)), ID: digest.Sum(data)},
+			b:          data,
+		})
+	}
+	return chunks, nil
+}
@@ -0,0 +1,137 @@
+package desync
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// MirrorOptions control which chunks are copied by Mirror and how.
+type MirrorOptions struct {
+	// Number of concurrent goroutines copying chunks
+	N int
+
+	// Only copy chunks whose ID (in hex notation) starts with one of these
+	// prefixes. All chunks are included if empty.
+	Include []string
+
+	// Skip chunks whose ID (in hex notation) starts with one of these prefixes.
+	// Takes precedence over Include.
+	Exclude []string
+
+	// Skip chunks that are already present in the destination store.
+	Incremental bool
+}
+
+// MirrorStats contains the results of a Mirror operation.
+type MirrorStats struct {
+	ChunksListed   uint64 `json:"chunks-listed"`
+	ChunksExcluded uint64 `json:"chunks-excluded"`
+	ChunksSkipped  uint64 `json:"chunks-skipped"`
+	ChunksCopied   uint64 `json:"chunks-copied"`
+	BytesCopied    uint64 `json:"bytes-copied"`
+}
+
+// included returns true if the chunk ID is selected by the include and exclude
+// prefix lists.
+func (o MirrorOptions) included(id ChunkID) bool {
+	sID := id.String()
+	for _, p := range o.Exclude {
+		if strings.HasPrefix(sID, p) {
+			return false
+		}
+	}
+	if len(o.Include) == 0 {
+		return true
+	}
+	for _, p := range o.Include {
+		if strings.HasPrefix(sID, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mirror copies all chunks from the src store into dst. Unlike Copy, it's not
+// driven by an index but by the list of chunks present in the source store. The
+// data of every chunk is hashed and compared to its ID before it is written to
+// the destination, regardless of any verification settings in the source store.
+// Chunks are copied while the source is being listed, the total of the progress
+// bar grows as more chunks are found.
+func Mirror(ctx context.Context, src ChunkLister, dst WriteStore, opt MirrorOptions, pb ProgressBar) (MirrorStats, error) {
+	var stats MirrorStats
+	if opt.N < 1 {
+		opt.N = 1
+	}
+
+	in := make(chan ChunkID)
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Setup and start the progressbar if any
+	pb.Start()
+	defer pb.Finish()
+
+	// Start the workers
+	for i := 0; i < opt.N; i++ {
+		g.Go(func() error {
+			for id := range in {
+				pb.Increment()
+				if opt.Incremental {
+					hasChunk, err := dst.HasChunk(id)
+					if err != nil {
+						return err
+					}
+					if hasChunk {
+						atomic.AddUint64(&stats.ChunksSkipped, 1)
+						continue
+					}
+				}
+				chunk, err := src.GetChunk(id)
+				if err != nil {
+					return err
+				}
+				// Validate the data in transit, the source store may be configured
+				// to skip verification. The algorithm is the one of the source store.
+				b, err := chunk.Data()
+				if err != nil {
+					return err
+				}
+				if sum := chunk.hash().Sum(b); sum != id {
+					return ChunkInvalid{ID: id, Sum: sum}
+				}
+				if err := dst.StoreChunk(chunk); err != nil {
+					return err
+				}
+				atomic.AddUint64(&stats.ChunksCopied, 1)
+				atomic.AddUint64(&stats.BytesCopied, uint64(len(b)))
+			}
+			return nil
+		})
+	}
+
+	// Feed the workers while listing the source, the context is cancelled if any
+	// goroutine encounters an error
+	g.Go(func() error {
+		defer close(in)
+		var total int64
+		return src.ListChunks(ctx, func(id ChunkID) error {
+			atomic.AddUint64(&stats.ChunksListed, 1)
+			if !opt.included(id) {
+				atomic.AddUint64(&stats.ChunksExcluded, 1)
+				return nil
+			}
+			total++
+			pb.SetTotal(total)
+			select {
+			case <-ctx.Done():
+				return Interrupted{}
+			case in <- id:
+			}
+			return nil
+		})
+	})
+
+	return stats, g.Wait()
+}
@@ -0,0 +1,40 @@
+package desync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorInterrupted(t *testing.T) {
+	src, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+	dst, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Mirror(ctx, src, dst, MirrorOptions{N: 2}, NullProgressBar{})
+	require.IsType(t, Interrupted{}, err)
+}
+
+func TestMirror(t *testing.T) {
+	src, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+	dst, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+
+	stats, err := Mirror(context.Background(), src, dst, MirrorOptions{N: 4, Exclude: []string{"0"}}, NullProgressBar{})
+	require.NoError(t, err)
+	require.NotZero(t, stats.ChunksCopied)
+	require.Equal(t, stats.ChunksListed, stats.ChunksCopied+stats.ChunksExcluded)
+
+	// Every chunk copied is in the destination
+	var n uint64
+	require.NoError(t, dst.ListChunks(context.Background(), func(id ChunkID) error {
+		n++
+		return nil
+	}))
+	require.Equal(t, stats.ChunksCopied, n)
+}
@@ -48,6 +48,11 @@ func (r *SparseMountFS) OnAdd(ctx context.Context) {
 	r.AddChild(r.FName, ch, false)
 }
 
+// Stats returns statistics about the reads from the sparse file.
+func (r *SparseMountFS) Stats() SparseFileStats {
+	return r.sf.Stats()
+}
+
 // Save the state of the sparse file.
 func (r *SparseMountFS) WriteState() error {
 	return r.sf.WriteState()
@@ -0,0 +1,189 @@
+package desync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MtreeVerifyFS compares the content of an archive with a directory tree
+// instead of writing it. Every difference, like missing files, different
+// permissions, ownership, xattrs or file content, is written to a writer in a
+// line per difference. Timestamps are not compared. Call Finish after the
+// archive has been read to report files that exist only in the directory.
+type MtreeVerifyFS struct {
+	root  string
+	w     io.Writer
+	files map[string]*File
+	diffs int
+}
+
+var _ FilesystemWriter = &MtreeVerifyFS{}
+
+// NewMtreeVerifyFS reads the directory tree under root and returns a
+// filesystem writer that compares archive content against it, writing any
+// differences to w.
+func NewMtreeVerifyFS(root string, w io.Writer) (*MtreeVerifyFS, error) {
+	files := make(map[string]*File)
+	local := NewLocalFS(root, LocalFSOptions{})
+	for {
+		f, err := local.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.Close() // Content is read later if needed
+		rel, err := filepath.Rel(root, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.ToSlash(rel)] = f
+	}
+	return &MtreeVerifyFS{root: root, w: w, files: files}, nil
+}
+
+func (fs *MtreeVerifyFS) CreateDir(n NodeDirectory) error {
+	f := fs.lookup(n.Name, os.ModeDir)
+	if f == nil {
+		return nil
+	}
+	fs.compareAttrs(n.Name, n.Mode, n.UID, n.GID, n.Xattrs, f)
+	return nil
+}
+
+func (fs *MtreeVerifyFS) CreateFile(n NodeFile) error {
+	f := fs.lookup(n.Name, 0)
+	if f == nil {
+		_, err := io.Copy(ioutil.Discard, n.Data)
+		return err
+	}
+	fs.compareAttrs(n.Name, n.Mode, n.UID, n.GID, n.Xattrs, f)
+	if n.Size != f.Size {
+		fs.report("%s: size differs (archive %d, disk %d)", n.Name, n.Size, f.Size)
+		_, err := io.Copy(ioutil.Discard, n.Data)
+		return err
+	}
+
+	// Same size, compare the content digests
+	archiveSum, err := digestOf(n.Data)
+	if err != nil {
+		return err
+	}
+	data, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	diskSum, err := digestOf(data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(archiveSum, diskSum) {
+		fs.report("%s: content differs (archive %x, disk %x)", n.Name, archiveSum, diskSum)
+	}
+	return nil
+}
+
+func (fs *MtreeVerifyFS) CreateSymlink(n NodeSymlink) error {
+	f := fs.lookup(n.Name, os.ModeSymlink)
+	if f == nil {
+		return nil
+	}
+	fs.compareAttrs(n.Name, 0, n.UID, n.GID, n.Xattrs, f)
+	if n.Target != f.LinkTarget {
+		fs.report("%s: link target differs (archive %s, disk %s)", n.Name, n.Target, f.LinkTarget)
+	}
+	return nil
+}
+
+func (fs *MtreeVerifyFS) CreateDevice(n NodeDevice) error {
+	// Device modes in archives are system modes, not os.FileMode
+	typ := os.ModeDevice
+	if n.Mode&modeChar != 0 {
+		typ |= os.ModeCharDevice
+	}
+	f := fs.lookup(n.Name, typ)
+	if f == nil {
+		return nil
+	}
+	fs.compareAttrs(n.Name, n.Mode, n.UID, n.GID, n.Xattrs, f)
+	if n.Major != f.DevMajor || n.Minor != f.DevMinor {
+		fs.report("%s: device differs (archive %d:%d, disk %d:%d)", n.Name, n.Major, n.Minor, f.DevMajor, f.DevMinor)
+	}
+	return nil
+}
+
+// Finish reports all files that are in the directory but weren't in the archive
+// and returns the number of differences found.
+func (fs *MtreeVerifyFS) Finish() int {
+	var extra []string
+	for name := range fs.files {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		fs.report("%s: not in archive", name)
+	}
+	fs.files = nil
+	return fs.diffs
+}
+
+// Returns the file on disk for an archive entry and reports it if it's missing
+// or of a different type.
+func (fs *MtreeVerifyFS) lookup(name string, typ os.FileMode) *File {
+	f, ok := fs.files[name]
+	if !ok {
+		fs.report("%s: missing", name)
+		return nil
+	}
+	delete(fs.files, name)
+	if f.Mode.Type() != typ {
+		fs.report("%s: type differs (archive %s, disk %s)", name, typ, f.Mode.Type())
+		return nil
+	}
+	return f
+}
+
+func (fs *MtreeVerifyFS) compareAttrs(name string, mode os.FileMode, uid, gid int, xattrs Xattrs, f *File) {
+	if mode != 0 && mode.Perm() != f.Mode.Perm() {
+		fs.report("%s: mode differs (archive %04o, disk %04o)", name, mode.Perm(), f.Mode.Perm())
+	}
+	if uid != f.Uid {
+		fs.report("%s: uid differs (archive %d, disk %d)", name, uid, f.Uid)
+	}
+	if gid != f.Gid {
+		fs.report("%s: gid differs (archive %d, disk %d)", name, gid, f.Gid)
+	}
+	for key, value := range xattrs {
+		diskValue, ok := f.Xattrs[key]
+		if !ok {
+			fs.report("%s: xattr %s missing on disk", name, key)
+		} else if diskValue != value {
+			fs.report("%s: xattr %s differs", name, key)
+		}
+	}
+	for key := range f.Xattrs {
+		if _, ok := xattrs[key]; !ok {
+			fs.report("%s: xattr %s not in archive", name, key)
+		}
+	}
+}
+
+func (fs *MtreeVerifyFS) report(format string, args ...interface{}) {
+	fs.diffs++
+	fmt.Fprintf(fs.w, format+"\n", args...)
+}
+
+func digestOf(r io.Reader) ([]byte, error) {
+	h := Digest.Algorithm().New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package desync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMtreeVerifyFS(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("aaaa"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "b"), []byte("bbbb"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "c"), []byte("cccc"), 0644))
+	require.NoError(t, os.Symlink("a", filepath.Join(dir, "link")))
+
+	// Build an archive of the directory
+	archive := new(bytes.Buffer)
+	require.NoError(t, Tar(context.Background(), archive, NewLocalFS(dir, LocalFSOptions{})))
+
+	verify := func() (int, string) {
+		out := new(bytes.Buffer)
+		fs, err := NewMtreeVerifyFS(dir, out)
+		require.NoError(t, err)
+		require.NoError(t, UnTar(context.Background(), bytes.NewReader(archive.Bytes()), fs))
+		return fs.Finish(), out.String()
+	}
+
+	// No differences right after creating the archive
+	n, out := verify()
+	require.Zero(t, n, out)
+
+	// Modify the tree
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("AAAA"), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "sub", "b"), 0600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "sub", "c")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "extra"), nil, 0644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "link")))
+	require.NoError(t, os.Symlink("sub", filepath.Join(dir, "link")))
+
+	n, out = verify()
+	require.Equal(t, 5, n, out)
+	for _, expected := range []string{
+		"a: content differs",
+		"sub/b: mode differs (archive 0644, disk 0600)",
+		"sub/c: missing",
+		"extra: not in archive",
+		"link: link target differs (archive a, disk sub)",
+	} {
+		require.True(t, strings.Contains(out, expected), "expected %q in:\n%s", expected, out)
+	}
+}
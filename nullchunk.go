@@ -15,9 +15,14 @@ type NullChunk struct {
 // NewNullChunk returns an initialized chunk consisting of 0-bytes of 'size'
 // which must mach the max size used in the index to be effective
 func NewNullChunk(size uint64) *NullChunk {
+	return newNullChunk(size, Digest)
+}
+
+// Returns a null chunk with its ID calculated using the hash algorithm h.
+func newNullChunk(size uint64, h HashAlgorithm) *NullChunk {
 	b := make([]byte, int(size))
 	return &NullChunk{
 		Data: b,
-		ID:   Digest.Sum(b),
+		ID:   h.Sum(b),
 	}
 }
@@ -0,0 +1,88 @@
+package desync
+
+import (
+	"fmt"
+)
+
+var _ BatchWriteStore = &NullChunkStore{}
+
+// NullChunkStore wraps a store and handles the null chunks of the given sizes
+// locally. They consist of only 0-bytes and are very common in images with
+// large empty areas. Requests for them are served from memory, and writing them
+// is skipped, so they're never transferred from or to the wrapped store. Stores
+// written through this wrapper don't hold the null chunks, which is fine for
+// desync as it never requests them, but other tools may need them.
+type NullChunkStore struct {
+	store Store
+	null  map[ChunkID]*NullChunk
+}
+
+// NewNullChunkStore returns a store that handles the null chunks of the given
+// sizes, which should match the max chunk size of the indexes used with it.
+func NewNullChunkStore(s Store, sizes ...uint64) *NullChunkStore {
+	return NewNullChunkStoreWithDigest(s, Digest, sizes...)
+}
+
+// NewNullChunkStoreWithDigest works like NewNullChunkStore for stores with chunk
+// IDs calculated using the hash algorithm h. The global Digest is used if it's nil.
+func NewNullChunkStoreWithDigest(s Store, h HashAlgorithm, sizes ...uint64) *NullChunkStore {
+	null := make(map[ChunkID]*NullChunk)
+	for _, size := range sizes {
+		n := newNullChunk(size, digestOrDefault(h))
+		null[n.ID] = n
+	}
+	return &NullChunkStore{store: s, null: null}
+}
+
+// GetChunk returns null chunks from memory, and reads all others from the
+// wrapped store.
+func (s *NullChunkStore) GetChunk(id ChunkID) (*Chunk, error) {
+	if n, ok := s.null[id]; ok {
+		return NewChunkWithID(id, n.Data, true)
+	}
+	return s.store.GetChunk(id)
+}
+
+// HasChunk returns true for null chunks, without asking the wrapped store.
+func (s *NullChunkStore) HasChunk(id ChunkID) (bool, error) {
+	if _, ok := s.null[id]; ok {
+		return true, nil
+	}
+	return s.store.HasChunk(id)
+}
+
+// StoreChunk writes the chunk to the wrapped store, unless it's a null chunk.
+func (s *NullChunkStore) StoreChunk(chunk *Chunk) error {
+	if _, ok := s.null[chunk.ID()]; ok {
+		return nil
+	}
+	ws, ok := s.store.(WriteStore)
+	if !ok {
+		return fmt.Errorf("store %s does not support writing", s.store)
+	}
+	return ws.StoreChunk(chunk)
+}
+
+// StoreChunks writes all chunks except null chunks to the wrapped store, in a
+// single batch if it supports that.
+func (s *NullChunkStore) StoreChunks(chunks []*Chunk) error {
+	ws, ok := s.store.(WriteStore)
+	if !ok {
+		return fmt.Errorf("store %s does not support writing", s.store)
+	}
+	todo := make([]*Chunk, 0, len(chunks))
+	for _, c := range chunks {
+		if _, ok := s.null[c.ID()]; !ok {
+			todo = append(todo, c)
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+	return StoreChunks(ws, todo)
+}
+
+func (s *NullChunkStore) String() string { return s.store.String() }
+
+// Close the wrapped store.
+func (s *NullChunkStore) Close() error { return s.store.Close() }
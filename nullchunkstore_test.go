@@ -0,0 +1,44 @@
+package desync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNullChunkStore(t *testing.T) {
+	other := NewChunk([]byte("data"))
+	ts := &TestStore{Chunks: map[ChunkID][]byte{other.ID(): []byte("data")}}
+	s := NewNullChunkStore(ts, 64, 128)
+	null := NewNullChunk(128)
+
+	// The null chunk is served without asking the store
+	ok, err := s.HasChunk(null.ID)
+	require.NoError(t, err)
+	require.True(t, ok)
+	chunk, err := s.GetChunk(null.ID)
+	require.NoError(t, err)
+	b, err := chunk.Data()
+	require.NoError(t, err)
+	require.Equal(t, null.Data, b)
+
+	// Null chunks of other sizes come from the store
+	_, err = s.GetChunk(NewNullChunk(256).ID)
+	require.Error(t, err)
+
+	// Writing the null chunk is skipped, other chunks are written
+	require.NoError(t, s.StoreChunk(NewChunk(make([]byte, 64))))
+	require.Len(t, ts.Chunks, 1)
+	require.NoError(t, s.StoreChunk(NewChunk([]byte("other"))))
+	require.Len(t, ts.Chunks, 2)
+	chunk, err = s.GetChunk(other.ID())
+	require.NoError(t, err)
+	require.Equal(t, other.ID(), chunk.ID())
+
+	// Batches are forwarded without the null chunks
+	bs := &batchTestStore{TestStore: TestStore{Chunks: make(map[ChunkID][]byte)}}
+	s = NewNullChunkStore(bs, 64)
+	require.NoError(t, s.StoreChunks([]*Chunk{NewChunk(make([]byte, 64)), NewChunk([]byte("a")), NewChunk([]byte("b"))}))
+	require.Equal(t, []int{2}, bs.batches)
+	require.Len(t, bs.Chunks, 2)
+}
@@ -8,15 +8,15 @@ func (p NullProgressBar) Finish() {
 	/// Nothing to do
 }
 
-func (p NullProgressBar) Increment() int {
+func (p NullProgressBar) Increment() int64 {
 	return 0
 }
 
-func (p NullProgressBar) Add(add int) int {
+func (p NullProgressBar) Add(add int64) int64 {
 	return 0
 }
 
-func (p NullProgressBar) SetTotal(total int) {
+func (p NullProgressBar) SetTotal(total int64) {
 	// Nothing to do
 }
 
@@ -24,7 +24,7 @@ func (p NullProgressBar) Start() {
 	// Nothing to do
 }
 
-func (p NullProgressBar) Set(current int) {
+func (p NullProgressBar) Set(current int64) {
 	// Nothing to do
 }
 
@@ -7,6 +7,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+
+	"github.com/pkg/errors"
 )
 
 type nullChunkSeed struct {
@@ -15,7 +17,7 @@ type nullChunkSeed struct {
 	canReflink bool
 }
 
-func newNullChunkSeed(dstFile string, blocksize uint64, max uint64) (*nullChunkSeed, error) {
+func newNullChunkSeed(dstFile string, blocksize uint64, max uint64, digest HashAlgorithm) (*nullChunkSeed, error) {
 	blockfile, err := ioutil.TempFile(filepath.Dir(dstFile), ".tmp-block")
 	if err != nil {
 		return nil, err
@@ -29,7 +31,7 @@ func newNullChunkSeed(dstFile string, blocksize uint64, max uint64) (*nullChunkS
 		}
 	}
 	return &nullChunkSeed{
-		id:         NewNullChunk(max).ID,
+		id:         newNullChunk(max, digest).ID,
 		canReflink: canReflink,
 		blockfile:  blockfile,
 	}, nil
@@ -105,8 +107,15 @@ func (s *nullChunkSection) FileName() string {
 func (s *nullChunkSection) Size() uint64 { return s.to - s.from }
 
 func (s *nullChunkSection) WriteInto(dst *os.File, offset, length, blocksize uint64, isBlank bool) (uint64, uint64, error) {
+	copied, cloned, _, err := s.WriteIntoWithFallback(dst, offset, length, blocksize, isBlank)
+	return copied, cloned, err
+}
+
+// WriteIntoWithFallback works like WriteInto and also reports the bytes that
+// were copied because cloning them failed.
+func (s *nullChunkSection) WriteIntoWithFallback(dst *os.File, offset, length, blocksize uint64, isBlank bool) (uint64, uint64, uint64, error) {
 	if length != s.Size() {
-		return 0, 0, fmt.Errorf("unable to copy %d bytes to %s : wrong size", length, dst.Name())
+		return 0, 0, 0, fmt.Errorf("unable to copy %d bytes to %s : wrong size", length, dst.Name())
 	}
 
 	// When cloning isn'a available we'd normally have to copy the 0 bytes into
@@ -114,48 +123,59 @@ func (s *nullChunkSection) WriteInto(dst *os.File, offset, length, blocksize uin
 	// file) there's no need to copy 0 bytes.
 	if !s.canReflink {
 		if isBlank {
-			return 0, 0, nil
+			return 0, 0, 0, nil
 		}
-		return s.copy(dst, offset, s.Size())
+		copied, err := s.copy(dst, offset, s.Size())
+		return copied, 0, 0, err
 	}
 	return s.clone(dst, offset, length, blocksize)
 }
 
-func (s *nullChunkSection) copy(dst *os.File, offset, length uint64) (uint64, uint64, error) {
+func (s *nullChunkSection) copy(dst *os.File, offset, length uint64) (uint64, error) {
 	if _, err := dst.Seek(int64(offset), os.SEEK_SET); err != nil {
-		return 0, 0, err
+		return 0, err
 	}
 	// Copy using a fixed buffer. Using io.Copy() with a LimitReader will make it
 	// create a buffer matching N of the LimitReader which can be too large
 	copied, err := io.CopyBuffer(dst, io.LimitReader(nullReader{}, int64(length)), make([]byte, 64*1024))
-	return uint64(copied), 0, err
+	return uint64(copied), err
 }
 
-func (s *nullChunkSection) clone(dst *os.File, offset, length, blocksize uint64) (uint64, uint64, error) {
+// Clones the null block into all aligned blocks of the range and copies 0 bytes
+// into the bits before and after. If a block can't be cloned, the rest of the
+// aligned blocks are copied instead.
+func (s *nullChunkSection) clone(dst *os.File, offset, length, blocksize uint64) (uint64, uint64, uint64, error) {
 	dstAlignStart := (offset/blocksize + 1) * blocksize
 	dstAlignEnd := (offset + length) / blocksize * blocksize
 
 	// fill the area before the first aligned block
 	var copied, cloned uint64
-	c1, _, err := s.copy(dst, offset, dstAlignStart-offset)
+	c1, err := s.copy(dst, offset, dstAlignStart-offset)
 	if err != nil {
-		return c1, 0, err
+		return c1, 0, 0, err
 	}
 	copied += c1
 	// fill the area after the last aligned block
-	c2, _, err := s.copy(dst, dstAlignEnd, offset+length-dstAlignEnd)
+	c2, err := s.copy(dst, dstAlignEnd, offset+length-dstAlignEnd)
 	if err != nil {
-		return copied + c2, 0, err
+		return copied + c2, 0, 0, err
 	}
 	copied += c2
 
 	for blkOffset := dstAlignStart; blkOffset < dstAlignEnd; blkOffset += blocksize {
-		if err := CloneRange(dst, s.blockfile, 0, blocksize, blkOffset); err != nil {
-			return copied, cloned, err
+		cloneErr := CloneRange(dst, s.blockfile, 0, blocksize, blkOffset)
+		if cloneErr == nil {
+			cloned += blocksize
+			continue
+		}
+		Log.WithError(cloneErr).Debug("cloning null chunk failed, copying blocks instead")
+		c3, err := s.copy(dst, blkOffset, dstAlignEnd-blkOffset)
+		if err != nil {
+			return copied + c3, cloned, c3, errors.Wrapf(err, "copying blocks after %s", cloneErr)
 		}
-		cloned += blocksize
+		return copied + c3, cloned, c3, nil
 	}
-	return copied, cloned, nil
+	return copied, cloned, 0, nil
 }
 
 type nullReader struct{}
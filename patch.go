@@ -0,0 +1,303 @@
+package desync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// PatchOptions configure PatchFile.
+type PatchOptions struct {
+	// Number of goroutines reading, fetching and writing chunks in each step.
+	N int
+
+	// Flush the data to disk before returning.
+	Fsync bool
+}
+
+// PatchStats contains the results of a PatchFile operation.
+type PatchStats struct {
+	ChunksTotal     int    `json:"chunks-total"`
+	ChunksInPlace   uint64 `json:"chunks-in-place"`
+	ChunksMoved     uint64 `json:"chunks-moved"`
+	ChunksFromStore uint64 `json:"chunks-from-store"`
+	ChunksBuffered  uint64 `json:"chunks-buffered"`
+	BytesMoved      uint64 `json:"bytes-moved"`
+	BytesFromStore  uint64 `json:"bytes-from-store"`
+	BytesTotal      int64  `json:"bytes-total"`
+	Steps           int    `json:"steps"`
+}
+
+// A chunk of the new index, and where its data comes from.
+type patchJob struct {
+	c      IndexChunk
+	src    int    // chunk in the old index with the same data, -1 if there is none
+	data   []byte // data of the source, if it was read ahead
+	read   bool   // the source was read, it can be overwritten now
+	next   []int  // jobs that overwrite the source of this one
+	blocks int    // number of jobs that need to read before this one can write
+}
+
+// Returns true if the data of the chunk is already where it needs to be.
+func (j *patchJob) inPlace(oldIdx Index) bool {
+	return j.src >= 0 && oldIdx.Chunks[j.src].Start == j.c.Start
+}
+
+// PatchFile rewrites the file name, holding the data described by oldIdx, in
+// place to match newIdx. Chunks that are already in the file are copied from
+// there, at their old position, and only the rest is read from the store. No second copy of the data is needed, which allows updating
+// a partition or image that can't be duplicated, like on devices without A/B
+// partitions.
+// Data is only ever overwritten after every chunk that needs it was read. The
+// chunks are written in steps, with all chunks whose sources have been read by
+// the previous steps written concurrently. If chunks depend on each other in a
+// cycle, for example when two chunks swap places, one of them is read into
+// memory to break it. Every chunk read from the file is verified, chunks that
+// don't match their ID are read from the store instead. The store can be nil if
+// all chunks are expected to be in the file.
+// The file is not consistent while the operation is running. If interrupted,
+// it can be completed with AssembleFile which reads what's missing from the
+// store.
+func PatchFile(ctx context.Context, name string, oldIdx, newIdx Index, s Store, opt PatchOptions, pb ProgressBar) (*PatchStats, error) {
+	n := opt.N
+	if n < 1 {
+		n = 1
+	}
+	stats := &PatchStats{
+		ChunksTotal: len(newIdx.Chunks),
+		BytesTotal:  newIdx.Length(),
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return stats, err
+	}
+	isBlkDevice := isDevice(info.Mode())
+	if isBlkDevice {
+		size, err := GetFileSize(name)
+		if err != nil {
+			return stats, err
+		}
+		if size < uint64(newIdx.Length()) {
+			return stats, fmt.Errorf("%s is too small, need %d bytes but it has %d", name, newIdx.Length(), size)
+		}
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	// Grow the file first if needed, that doesn't touch the existing data
+	if !isBlkDevice && info.Size() < newIdx.Length() {
+		if err := CheckFreeSpace(filepath.Dir(name), spaceRequired(newIdx, info.Size(), false)); err != nil {
+			return stats, err
+		}
+		if err := f.Truncate(newIdx.Length()); err != nil {
+			return stats, err
+		}
+	}
+
+	jobs := planPatch(oldIdx, newIdx)
+
+	pb.SetTotal(int64(len(jobs)))
+	pb.Start()
+	defer pb.Finish()
+
+	digest := newIdx.digest()
+	var ready []int
+	for i, j := range jobs {
+		if j.blocks == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	// Reads the source of a job, returns nil if it doesn't match the chunk ID
+	readSource := func(j *patchJob) ([]byte, error) {
+		src := oldIdx.Chunks[j.src]
+		b := make([]byte, src.Size)
+		if _, err := f.ReadAt(b, int64(src.Start)); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF { // the file is shorter than the old index
+				return nil, nil
+			}
+			return nil, err
+		}
+		if digest.Sum(b) != j.c.ID {
+			Log.WithField("offset", src.Start).Debug("data in the file doesn't match the old index")
+			return nil, nil
+		}
+		return b, nil
+	}
+
+	// The source of a job was read, the jobs overwriting it may be unblocked now
+	release := func(j *patchJob) {
+		j.read = true
+		for _, k := range j.next {
+			jobs[k].blocks--
+			if jobs[k].blocks == 0 {
+				ready = append(ready, k)
+			}
+		}
+	}
+
+	var remaining = len(jobs)
+	var cursor int // jobs before this one have been read already
+	for remaining > 0 {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		// If no job can be written, they're blocked by a cycle. Break it by
+		// reading the source of a job into memory.
+		if len(ready) == 0 {
+			for cursor < len(jobs) && (jobs[cursor].read || jobs[cursor].src < 0) {
+				cursor++
+			}
+			if cursor == len(jobs) {
+				return stats, fmt.Errorf("unable to find an order to write the chunks in")
+			}
+			j := jobs[cursor]
+			b, err := readSource(j)
+			if err != nil {
+				return stats, err
+			}
+			if b == nil {
+				j.src = -1
+			}
+			j.data = b
+			stats.ChunksBuffered++
+			release(j)
+			continue
+		}
+
+		// Write all jobs that aren't blocked anymore
+		step := ready
+		ready = nil
+		stats.Steps++
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(n)
+		for _, i := range step {
+			j := jobs[i]
+			g.Go(func() error {
+				if gctx.Err() != nil {
+					return gctx.Err()
+				}
+				b := j.data
+				if j.src >= 0 && b == nil {
+					var err error
+					if b, err = readSource(j); err != nil {
+						return err
+					}
+				}
+				switch {
+				case b != nil && j.inPlace(oldIdx):
+					atomic.AddUint64(&stats.ChunksInPlace, 1)
+					pb.Increment()
+					return nil
+				case b != nil:
+					atomic.AddUint64(&stats.ChunksMoved, 1)
+					atomic.AddUint64(&stats.BytesMoved, j.c.Size)
+				default:
+					if s == nil {
+						return fmt.Errorf("chunk %s is not in %s and no store was given", j.c.ID.String(), name)
+					}
+					chunk, err := s.GetChunk(j.c.ID)
+					if err != nil {
+						return err
+					}
+					if b, err = chunk.Data(); err != nil {
+						return err
+					}
+					if uint64(len(b)) != j.c.Size {
+						return fmt.Errorf("unexpected size for chunk %s", j.c.ID.String())
+					}
+					atomic.AddUint64(&stats.ChunksFromStore, 1)
+					atomic.AddUint64(&stats.BytesFromStore, j.c.Size)
+				}
+				if _, err := f.WriteAt(b, int64(j.c.Start)); err != nil {
+					return err
+				}
+				pb.Increment()
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return stats, err
+		}
+		for _, i := range step {
+			j := jobs[i]
+			j.data = nil
+			remaining--
+			if !j.read {
+				release(j)
+			}
+		}
+	}
+
+	// Cut off what's left of the old data once nothing needs it anymore
+	if !isBlkDevice && info.Size() > newIdx.Length() {
+		if err := f.Truncate(newIdx.Length()); err != nil {
+			return stats, err
+		}
+	}
+	if opt.Fsync {
+		if err := f.Sync(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, f.Close()
+}
+
+// Builds the list of jobs for the chunks of the new index, and which of them
+// need to wait for others to read their source before they can be written.
+func planPatch(oldIdx, newIdx Index) []*patchJob {
+	// Find the chunks of the new index in the old one, preferring the same
+	// position
+	pos := make(map[ChunkID][]int)
+	for i, c := range oldIdx.Chunks {
+		pos[c.ID] = append(pos[c.ID], i)
+	}
+	jobs := make([]*patchJob, len(newIdx.Chunks))
+	readers := make(map[int][]int) // old chunk -> jobs reading it
+	for i, c := range newIdx.Chunks {
+		j := &patchJob{c: c, src: -1}
+		for _, p := range pos[c.ID] {
+			if j.src < 0 || oldIdx.Chunks[p].Start == c.Start {
+				j.src = p
+			}
+		}
+		if j.src >= 0 {
+			readers[j.src] = append(readers[j.src], i)
+		}
+		jobs[i] = j
+	}
+
+	// Every job overwriting old chunks has to wait for the jobs reading them.
+	// Chunks that are in place aren't written, unless they fail verification,
+	// in which case no job can use the old data anyway.
+	for i, j := range jobs {
+		if j.inPlace(oldIdx) {
+			continue
+		}
+		start, end := j.c.Start, j.c.Start+j.c.Size
+		first := sort.Search(len(oldIdx.Chunks), func(k int) bool {
+			return oldIdx.Chunks[k].Start+oldIdx.Chunks[k].Size > start
+		})
+		for k := first; k < len(oldIdx.Chunks) && oldIdx.Chunks[k].Start < end; k++ {
+			for _, r := range readers[k] {
+				if r == i {
+					continue
+				}
+				jobs[r].next = append(jobs[r].next, i)
+				j.blocks++
+			}
+		}
+	}
+	return jobs
+}
@@ -0,0 +1,118 @@
+package desync
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchFile(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	old, err := ioutil.ReadFile("testdata/blob2")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(out, old, 0644))
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	s, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+
+	oldIdx := readCaibxFile(t, "testdata/blob2.caibx")
+	newIdx := readCaibxFile(t, "testdata/blob1.caibx")
+	stats, err := PatchFile(context.Background(), out, oldIdx, newIdx, s, PatchOptions{N: 4}, NullProgressBar{})
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, b)
+	require.Equal(t, uint64(len(newIdx.Chunks)), stats.ChunksInPlace+stats.ChunksMoved+stats.ChunksFromStore)
+	require.NotZero(t, stats.ChunksInPlace+stats.ChunksMoved)
+
+	// Patching it again doesn't change anything
+	stats, err = PatchFile(context.Background(), out, newIdx, newIdx, nil, PatchOptions{N: 4}, NullProgressBar{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(newIdx.Chunks)), stats.ChunksInPlace)
+}
+
+// Builds an index for data split into chunks of the given sizes.
+func patchTestIndex(data []byte, sizes ...uint64) Index {
+	idx := Index{Index: FormatIndex{
+		FeatureFlags: CaFormatSHA512256,
+		ChunkSizeMin: 1,
+		ChunkSizeAvg: 1024,
+		ChunkSizeMax: 1 << 20,
+	}}
+	var start uint64
+	for _, size := range sizes {
+		b := data[start : start+size]
+		idx.Chunks = append(idx.Chunks, IndexChunk{ID: Digest.Sum(b), Start: start, Size: size})
+		start += size
+	}
+	return idx
+}
+
+func TestPatchFileReorder(t *testing.T) {
+	a, b, c := make([]byte, 1000), make([]byte, 3000), make([]byte, 500)
+	rand.Read(a)
+	rand.Read(b)
+	rand.Read(c)
+
+	tests := map[string]struct {
+		old, new []byte
+		oldSizes []uint64
+		newSizes []uint64
+	}{
+		"swap":   {join(a, b), join(b, a), []uint64{1000, 3000}, []uint64{3000, 1000}},
+		"rotate": {join(a, b, c), join(c, a, b), []uint64{1000, 3000, 500}, []uint64{500, 1000, 3000}},
+		"grow":   {join(a, b), join(b, a, b, a), []uint64{1000, 3000}, []uint64{3000, 1000, 3000, 1000}},
+		"shrink": {join(a, b, c), join(c, a), []uint64{1000, 3000, 500}, []uint64{500, 1000}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+			require.NoError(t, ioutil.WriteFile(out, test.old, 0644))
+			oldIdx := patchTestIndex(test.old, test.oldSizes...)
+			newIdx := patchTestIndex(test.new, test.newSizes...)
+
+			// All the data is in the file already, no store is needed
+			stats, err := PatchFile(context.Background(), out, oldIdx, newIdx, nil, PatchOptions{N: 2}, NullProgressBar{})
+			require.NoError(t, err)
+			require.Zero(t, stats.ChunksFromStore)
+			b, err := ioutil.ReadFile(out)
+			require.NoError(t, err)
+			require.Equal(t, test.new, b)
+		})
+	}
+}
+
+func TestPatchFileInvalidData(t *testing.T) {
+	a, b := make([]byte, 1000), make([]byte, 3000)
+	rand.Read(a)
+	rand.Read(b)
+	old, new := join(a, b), join(b, a)
+	oldIdx := patchTestIndex(old, 1000, 3000)
+	newIdx := patchTestIndex(new, 3000, 1000)
+
+	// The file doesn't match the old index
+	out := filepath.Join(t.TempDir(), "out")
+	damaged := join(a, make([]byte, 3000))
+	require.NoError(t, ioutil.WriteFile(out, damaged, 0644))
+
+	// Without a store, the chunk that's missing can't be written
+	_, err := PatchFile(context.Background(), out, oldIdx, newIdx, nil, PatchOptions{}, NullProgressBar{})
+	require.Error(t, err)
+
+	// It's read from the store instead
+	require.NoError(t, ioutil.WriteFile(out, damaged, 0644))
+	s, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	require.NoError(t, s.StoreChunk(NewChunk(b)))
+	stats, err := PatchFile(context.Background(), out, oldIdx, newIdx, s, PatchOptions{}, NullProgressBar{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), stats.ChunksFromStore)
+	data, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, new, data)
+}
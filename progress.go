@@ -1,10 +1,27 @@
 package desync
 
-import "io"
+import (
+	"io"
+	"math"
+)
 
 // ProgressBar allows clients to provide their own implementations of graphical
-// progress visualizations. Optional, can be nil to disable this feature.
+// progress visualizations. Optional, can be nil to disable this feature. Values
+// are int64 so that byte-based totals larger than 2GiB work on all platforms.
 type ProgressBar interface {
+	SetTotal(total int64)
+	Start()
+	Finish()
+	Increment() int64
+	Add(add int64) int64
+	Set(current int64)
+	io.Writer
+}
+
+// IntProgressBar is the interface progress bars implemented before values were
+// changed to int64. Existing implementations can be used as ProgressBar by
+// wrapping them with NewIntProgressBarShim.
+type IntProgressBar interface {
 	SetTotal(total int)
 	Start()
 	Finish()
@@ -13,3 +30,46 @@ type ProgressBar interface {
 	Set(current int)
 	io.Writer
 }
+
+// IntProgressBarShim makes an IntProgressBar usable as ProgressBar. Values that
+// don't fit into an int are capped.
+type IntProgressBarShim struct {
+	IntProgressBar
+}
+
+var _ ProgressBar = IntProgressBarShim{}
+
+// NewIntProgressBarShim wraps an IntProgressBar to implement ProgressBar.
+func NewIntProgressBarShim(p IntProgressBar) IntProgressBarShim {
+	return IntProgressBarShim{p}
+}
+
+// SetTotal sets the upper bounds for the progress bar
+func (p IntProgressBarShim) SetTotal(total int64) {
+	p.IntProgressBar.SetTotal(capInt(total))
+}
+
+// Increment the current value by one
+func (p IntProgressBarShim) Increment() int64 {
+	return int64(p.IntProgressBar.Increment())
+}
+
+// Add to the current value
+func (p IntProgressBarShim) Add(add int64) int64 {
+	return int64(p.IntProgressBar.Add(capInt(add)))
+}
+
+// Set the current value
+func (p IntProgressBarShim) Set(current int64) {
+	p.IntProgressBar.Set(capInt(current))
+}
+
+func capInt(v int64) int {
+	switch {
+	case v > math.MaxInt:
+		return math.MaxInt
+	case v < math.MinInt:
+		return math.MinInt
+	}
+	return int(v)
+}
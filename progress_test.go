@@ -0,0 +1,37 @@
+package desync
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Progress bar implementing the old int-based interface
+type intProgressBar struct {
+	total, current int
+}
+
+func (p *intProgressBar) SetTotal(total int)          { p.total = total }
+func (p *intProgressBar) Start()                      {}
+func (p *intProgressBar) Finish()                     {}
+func (p *intProgressBar) Increment() int              { return p.Add(1) }
+func (p *intProgressBar) Add(add int) int             { p.current += add; return p.current }
+func (p *intProgressBar) Set(current int)             { p.current = current }
+func (p *intProgressBar) Write(b []byte) (int, error) { p.Add(len(b)); return len(b), nil }
+
+func TestIntProgressBarShim(t *testing.T) {
+	old := &intProgressBar{}
+	var pb ProgressBar = NewIntProgressBarShim(old)
+
+	pb.SetTotal(10)
+	require.Equal(t, 10, old.total)
+	require.Equal(t, int64(1), pb.Increment())
+	require.Equal(t, int64(5), pb.Add(4))
+	pb.Set(7)
+	require.Equal(t, 7, old.current)
+
+	// Values beyond the range of int are capped
+	pb.SetTotal(math.MaxInt64)
+	require.Equal(t, math.MaxInt, old.total)
+}
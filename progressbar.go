@@ -12,6 +12,17 @@ import (
 // NewProgressBar initializes a wrapper for a https://github.com/cheggaaa/pb
 // progressbar that implements desync.ProgressBar
 func NewProgressBar(prefix string) ProgressBar {
+	return newProgressBar(prefix, false)
+}
+
+// NewBytesProgressBar returns a progressbar for operations measured in bytes,
+// such as chunking a file. It shows the values in KB/MB/GB along with the
+// current rate and the estimated time remaining.
+func NewBytesProgressBar(prefix string) ProgressBar {
+	return newProgressBar(prefix, true)
+}
+
+func newProgressBar(prefix string, bytes bool) ProgressBar {
 	if !terminal.IsTerminal(int(os.Stderr.Fd())) &&
 		os.Getenv("DESYNC_PROGRESSBAR_ENABLED") == "" &&
 		os.Getenv("DESYNC_ENABLE_PARSABLE_PROGRESS") == "" {
@@ -20,6 +31,12 @@ func NewProgressBar(prefix string) ProgressBar {
 	bar := pb.New(0).Prefix(prefix)
 	bar.ShowCounters = false
 	bar.Output = os.Stderr
+	if bytes {
+		bar.SetUnits(pb.U_BYTES)
+		bar.ShowCounters = true
+		bar.ShowSpeed = true
+		bar.ShowTimeLeft = true
+	}
 	if os.Getenv("DESYNC_ENABLE_PARSABLE_PROGRESS") != "" {
 		// This is likely going to a journal or redirected to a file, lower the
 		// refresh rate from the default 200ms to a more manageable 500ms.
@@ -39,8 +56,8 @@ type DefaultProgressBar struct {
 }
 
 // SetTotal sets the upper bounds for the progress bar
-func (p DefaultProgressBar) SetTotal(total int) {
-	p.ProgressBar.SetTotal(total)
+func (p DefaultProgressBar) SetTotal(total int64) {
+	p.ProgressBar.SetTotal64(total)
 }
 
 // Start displaying the progress bar
@@ -48,9 +65,19 @@ func (p DefaultProgressBar) Start() {
 	p.ProgressBar.Start()
 }
 
+// Increment the current value by one
+func (p DefaultProgressBar) Increment() int64 {
+	return p.ProgressBar.Add64(1)
+}
+
+// Add to the current value
+func (p DefaultProgressBar) Add(add int64) int64 {
+	return p.ProgressBar.Add64(add)
+}
+
 // Set the current value
-func (p DefaultProgressBar) Set(current int) {
-	p.ProgressBar.Set(current)
+func (p DefaultProgressBar) Set(current int64) {
+	p.ProgressBar.Set64(current)
 }
 
 // Write the current state of the progressbar
@@ -14,6 +14,9 @@ type Protocol struct {
 	r           io.Reader
 	w           io.Writer
 	initialized bool
+
+	// Hash algorithm of the chunks, the global Digest if nil
+	digest HashAlgorithm
 }
 
 // Message represents a command sent to, or received from the communication partner.
@@ -131,6 +134,51 @@ func (p *Protocol) SendGoodbye() error {
 	return p.WriteMessage(m)
 }
 
+// Maximum size of the index data sent in a single message
+const protocolIndexFrameSize = 64 * 1024
+
+// SendIndex sends the content of an index file to the client, split over as
+// many messages as needed and followed by an EOF message.
+func (p *Protocol) SendIndex(b []byte) error {
+	if !p.initialized {
+		return errors.New("protocol not initialized")
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if n > protocolIndexFrameSize {
+			n = protocolIndexFrameSize
+		}
+		if err := p.WriteMessage(Message{Type: CaProtocolIndex, Body: b[:n]}); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return p.WriteMessage(Message{Type: CaProtocolIndexEOF})
+}
+
+// RecvIndex reads the content of one index file sent by the server, up to
+// the EOF message.
+func (p *Protocol) RecvIndex() ([]byte, error) {
+	if !p.initialized {
+		return nil, errors.New("protocol not initialized")
+	}
+	var b []byte
+	for {
+		m, err := p.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch m.Type {
+		case CaProtocolIndex:
+			b = append(b, m.Body...)
+		case CaProtocolIndexEOF:
+			return b, nil
+		default:
+			return nil, fmt.Errorf("unexpected protocol message type %x", m.Type)
+		}
+	}
+}
+
 // RequestChunk sends a request for a specific chunk to the server, waits for
 // the response and returns the bytes in the chunk. Returns an error if the
 // server reports the chunk as missing
@@ -154,7 +202,7 @@ func (p *Protocol) RequestChunk(id ChunkID) (*Chunk, error) {
 			return nil, errors.New("received chunk too small")
 		}
 		// The rest should be the (compressed) chunk data
-		return NewChunkFromStorage(id, m.Body[40:], []converter{Compressor{}}, false)
+		return newChunkFromStorage(id, m.Body[40:], []converter{Compressor{}}, false, p.digest)
 	default:
 		return nil, fmt.Errorf("unexpected protocol message type %x", m.Type)
 	}
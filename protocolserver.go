@@ -10,27 +10,53 @@ import (
 
 // ProtocolServer serves up chunks from a local store using the casync protocol
 type ProtocolServer struct {
-	p     *Protocol
-	store Store
+	p       *Protocol
+	store   Store
+	indexes [][]byte
 }
 
 // NewProtocolServer returns an initialized server that can serve chunks from
 // a chunk store via the casync protocol
 func NewProtocolServer(r io.Reader, w io.Writer, s Store) *ProtocolServer {
+	return NewProtocolServerWithIndexes(r, w, s, nil)
+}
+
+// NewProtocolServerWithIndexes returns a server that sends the content of one
+// or more index files to clients requesting them, before serving chunks from
+// the store in the same session. This saves clients needing several indexes
+// from the same host from having to establish a session for each one.
+func NewProtocolServerWithIndexes(r io.Reader, w io.Writer, s Store, indexes [][]byte) *ProtocolServer {
 	return &ProtocolServer{
-		p:     NewProtocol(r, w),
-		store: s,
+		p:       NewProtocol(r, w),
+		store:   s,
+		indexes: indexes,
 	}
 }
 
 // Serve starts the protocol server. Blocks unless an error is encountered
 func (s *ProtocolServer) Serve(ctx context.Context) error {
-	flags, err := s.p.Initialize(CaProtocolReadableStore)
+	offer := uint64(CaProtocolReadableStore)
+	if len(s.indexes) > 0 {
+		offer |= CaProtocolReadableIndex
+	}
+	flags, err := s.p.Initialize(offer)
 	if err != nil {
 		return errors.Wrap(err, "failed to perform protocol handshake")
 	}
-	if flags&CaProtocolPullChunks == 0 {
-		return fmt.Errorf("client is not requesting chunks, provided flags %x", flags)
+	if flags&(CaProtocolPullChunks|CaProtocolPullIndex) == 0 {
+		return fmt.Errorf("client is not requesting chunks or indexes, provided flags %x", flags)
+	}
+
+	// Send all indexes in order first if the client asked for them
+	if flags&CaProtocolPullIndex != 0 {
+		if len(s.indexes) == 0 {
+			return errors.New("client is requesting indexes, but none are available")
+		}
+		for _, b := range s.indexes {
+			if err := s.p.SendIndex(b); err != nil {
+				return errors.Wrap(err, "failed to send index")
+			}
+		}
 	}
 	for {
 		// See if we're meant to stop
@@ -54,7 +80,7 @@ func (s *ProtocolServer) Serve(ctx context.Context) error {
 			}
 			chunk, err := s.store.GetChunk(id)
 			if err != nil {
-				if _, ok := err.(ChunkMissing); ok {
+				if errors.Is(err, ErrNotFound) {
 					if err = s.p.SendMissing(id); err != nil {
 						return errors.Wrap(err, "failed to send to client")
 					}
@@ -5,6 +5,8 @@ import (
 	"context"
 	"io"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestProtocolServer(t *testing.T) {
@@ -49,3 +51,40 @@ func TestProtocolServer(t *testing.T) {
 		t.Fatal("expected ChunkMissing error, got:", err)
 	}
 }
+
+func TestProtocolServerIndexes(t *testing.T) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	client := NewProtocol(r1, w2)
+
+	chunkIn := NewChunk([]byte{1, 2, 3, 4})
+	store := &TestStore{}
+	store.StoreChunk(chunkIn)
+
+	// Two indexes, one of them larger than a single protocol message
+	indexes := [][]byte{
+		[]byte("first index"),
+		bytes.Repeat([]byte{1, 2, 3}, protocolIndexFrameSize),
+	}
+	ps := NewProtocolServerWithIndexes(r2, w1, store, indexes)
+	go ps.Serve(context.Background())
+
+	flags, err := client.Initialize(CaProtocolPullChunks | CaProtocolPullIndex)
+	require.NoError(t, err)
+	require.NotZero(t, flags&CaProtocolReadableIndex)
+
+	// The indexes come first, in order
+	for _, exp := range indexes {
+		b, err := client.RecvIndex()
+		require.NoError(t, err)
+		require.Equal(t, exp, b)
+	}
+
+	// Chunks can be requested in the same session afterwards
+	chunk, err := client.RequestChunk(chunkIn.ID())
+	require.NoError(t, err)
+	b, err := chunk.Data()
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3, 4}, b)
+}
@@ -0,0 +1,60 @@
+package desync
+
+import (
+	"context"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Removes chunks from a store concurrently while they're being listed. list
+// calls fn for every chunk that should be removed, and remove deletes it. The
+// number of goroutines and the rate of removals are taken from the store
+// options. The total of the progress bar grows as chunks are listed.
+func pruneConcurrently(ctx context.Context, opt StoreOptions, pb ProgressBar, list func(context.Context, func(ChunkID, int64) error) error, remove func(ChunkID) error) error {
+	n := opt.N
+	if n < 1 {
+		n = 1
+	}
+	var limiter *rateLimiter
+	if opt.RateLimit > 0 {
+		limiter = newRateLimiter(opt.RateLimit)
+	}
+
+	pb.Start()
+	defer pb.Finish()
+
+	in := make(chan ChunkID, n)
+	g, gctx := errgroup.WithContext(ctx)
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for id := range in {
+				if limiter != nil {
+					limiter.wait()
+				}
+				if err := remove(id); err != nil {
+					return err
+				}
+				pb.Increment()
+			}
+			return nil
+		})
+	}
+
+	// Feed the workers, stop listing if any of them failed
+	var total int64
+	err := list(gctx, func(id ChunkID, size int64) error {
+		total++
+		pb.SetTotal(total)
+		select {
+		case <-gctx.Done():
+			return Interrupted{}
+		case in <- id:
+		}
+		return nil
+	})
+	close(in)
+	if gErr := g.Wait(); gErr != nil {
+		return gErr
+	}
+	return err
+}
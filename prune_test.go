@@ -0,0 +1,60 @@
+package desync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalStorePrune(t *testing.T) {
+	opt := NewStoreOptionsWithDefaults()
+	opt.N = 4
+	s, err := NewLocalStore(t.TempDir(), opt)
+	require.NoError(t, err)
+
+	// Fill the store and keep every other chunk
+	keep := make(map[ChunkID]struct{})
+	var removed []ChunkID
+	for i := 0; i < 100; i++ {
+		chunk := NewChunk([]byte{byte(i)})
+		require.NoError(t, s.StoreChunk(chunk))
+		if i%2 == 0 {
+			keep[chunk.ID()] = struct{}{}
+		} else {
+			removed = append(removed, chunk.ID())
+		}
+	}
+	require.NoError(t, s.Prune(context.Background(), keep))
+
+	for id := range keep {
+		hasChunk, err := s.HasChunk(id)
+		require.NoError(t, err)
+		require.True(t, hasChunk)
+	}
+	for _, id := range removed {
+		hasChunk, err := s.HasChunk(id)
+		require.NoError(t, err)
+		require.False(t, hasChunk)
+	}
+}
+
+func TestPruneConcurrentlyError(t *testing.T) {
+	opt := NewStoreOptionsWithDefaults()
+	opt.N = 4
+	list := func(ctx context.Context, fn func(ChunkID, int64) error) error {
+		for i := 0; i < 1000; i++ {
+			if err := fn(Digest.Sum([]byte{byte(i)}), 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	failed := errors.New("failed")
+	remove := func(id ChunkID) error { return failed }
+
+	// The listing should stop and the error of the removal be returned
+	err := pruneConcurrently(context.Background(), opt, NullProgressBar{}, list, remove)
+	require.Equal(t, failed, err)
+}
@@ -0,0 +1,91 @@
+package desync
+
+import (
+	"sync"
+	"time"
+)
+
+var _ Store = &RateLimitedStore{}
+var _ WriteStore = &RateLimitedWriteStore{}
+
+// RateLimitedStore wraps a store and limits the number of requests per second
+// that are sent to it. Requests over the limit are delayed.
+type RateLimitedStore struct {
+	s Store
+	l *rateLimiter
+}
+
+// RateLimitedWriteStore does the same as RateLimitedStore but implements
+// WriteStore as well.
+type RateLimitedWriteStore struct {
+	RateLimitedStore
+}
+
+// NewRateLimitedStore returns a store that sends at most rps requests per
+// second to s.
+func NewRateLimitedStore(s Store, rps float64) *RateLimitedStore {
+	return &RateLimitedStore{s: s, l: newRateLimiter(rps)}
+}
+
+// NewRateLimitedWriteStore returns a writable store that sends at most rps
+// requests per second to s.
+func NewRateLimitedWriteStore(s WriteStore, rps float64) *RateLimitedWriteStore {
+	return &RateLimitedWriteStore{RateLimitedStore{s: s, l: newRateLimiter(rps)}}
+}
+
+// GetChunk reads and returns one chunk from the store
+func (s *RateLimitedStore) GetChunk(id ChunkID) (*Chunk, error) {
+	s.l.wait()
+	return s.s.GetChunk(id)
+}
+
+// HasChunk returns true if the chunk is in the store
+func (s *RateLimitedStore) HasChunk(id ChunkID) (bool, error) {
+	s.l.wait()
+	return s.s.HasChunk(id)
+}
+
+func (s *RateLimitedStore) String() string {
+	return s.s.String()
+}
+
+// Close the underlying store
+func (s *RateLimitedStore) Close() error {
+	return s.s.Close()
+}
+
+// Unwrap returns the store requests are sent to.
+func (s *RateLimitedStore) Unwrap() Store {
+	return s.s
+}
+
+// StoreChunk adds a new chunk to the store
+func (s *RateLimitedWriteStore) StoreChunk(chunk *Chunk) error {
+	s.l.wait()
+	return s.s.(WriteStore).StoreChunk(chunk)
+}
+
+// rateLimiter spaces out events evenly so that no more than a given number
+// happen per second.
+type rateLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+func newRateLimiter(rps float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+// wait blocks until the next event is allowed to happen.
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
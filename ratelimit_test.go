@@ -0,0 +1,21 @@
+package desync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitedStore(t *testing.T) {
+	s := NewRateLimitedWriteStore(&TestStore{}, 50)
+
+	// The first request goes through right away, the following ones are
+	// spaced out by 20ms
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := s.HasChunk(ChunkID{})
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
@@ -1,6 +1,7 @@
 package desync
 
 import (
+	"context"
 	"encoding/binary"
 	"io"
 )
@@ -48,3 +49,20 @@ func (r reader) ReadHeader() (h FormatHeader, err error) {
 	h.Type, err = r.ReadUint64()
 	return
 }
+
+// contextReader wraps a reader and fails all reads with Interrupted once the
+// context is cancelled. Used to abort long-running decoding of large streams,
+// even in the middle of a payload.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.ctx.Done():
+		return 0, Interrupted{}
+	default:
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,141 @@
+package desync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var _ Seed = &ReaderAtSeed{}
+
+// Maximum number of bytes a ReaderAtSeed reads at once when writing a segment.
+const readerAtSeedReadSize = 4 << 20
+
+// ReaderAtSeed is a seed that reads the data of a blob with an io.ReaderAt,
+// like a file in a read-only image or a remote blob read with range requests.
+// Unlike FileSeed, the data is always copied into the target, and segments are
+// verified after they're written rather than validated up front.
+type ReaderAtSeed struct {
+	r         io.ReaderAt
+	index     Index
+	pos       map[ChunkID][]int
+	isInvalid bool
+	mu        sync.RWMutex
+}
+
+// NewReaderAtSeed initializes a seed for a blob read from r, and the index of
+// the blob.
+func NewReaderAtSeed(r io.ReaderAt, index Index) *ReaderAtSeed {
+	s := &ReaderAtSeed{
+		r:     r,
+		index: index,
+		pos:   make(map[ChunkID][]int),
+	}
+	for i, c := range index.Chunks {
+		s.pos[c.ID] = append(s.pos[c.ID], i)
+	}
+	return s
+}
+
+// LongestMatchWith returns the longest sequence of chunks anywhere in the seed
+// that match `chunks` starting at chunks[0]. If there is no match, it returns a
+// length of zero and a nil SeedSegment.
+func (s *ReaderAtSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
+	if len(chunks) == 0 || s.IsInvalid() {
+		return 0, nil
+	}
+	pos, ok := s.pos[chunks[0].ID]
+	if !ok {
+		return 0, nil
+	}
+	// Limit the number of chunks in a sequence, same as for seeds that can't
+	// be cloned, to avoid unbalanced jobs
+	match := longestMatchFrom(s.index.Chunks, pos, chunks, 100)
+	return len(match), &readerAtSeedSegment{r: s.r, chunks: match, digest: s.index.digest()}
+}
+
+// RegenerateIndex is not supported, the seed has no file that could be
+// chunked again.
+func (s *ReaderAtSeed) RegenerateIndex(ctx context.Context, n int, attempt int, seedNumber int) error {
+	return errors.New("unable to regenerate the index of a ReaderAt seed")
+}
+
+func (s *ReaderAtSeed) SetInvalid(value bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isInvalid = value
+}
+
+func (s *ReaderAtSeed) IsInvalid() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.isInvalid
+}
+
+type readerAtSeedSegment struct {
+	r      io.ReaderAt
+	chunks []IndexChunk
+	digest HashAlgorithm
+}
+
+// FileName is empty, there is no local file to validate. The chunks are
+// verified after they're written into the target.
+func (s *readerAtSeedSegment) FileName() string {
+	return ""
+}
+
+func (s *readerAtSeedSegment) Size() uint64 {
+	if len(s.chunks) == 0 {
+		return 0
+	}
+	last := s.chunks[len(s.chunks)-1]
+	return last.Start + last.Size - s.chunks[0].Start
+}
+
+// Validate compares the chunks of the segment to the data in the seed. It's
+// not called by AssembleFile since FileName is empty.
+func (s *readerAtSeedSegment) Validate(file *os.File) error {
+	for _, c := range s.chunks {
+		b := make([]byte, c.Size)
+		if _, err := s.r.ReadAt(b, int64(c.Start)); err != nil {
+			return err
+		}
+		if s.digest.Sum(b) != c.ID {
+			return fmt.Errorf("seed index doesn't match its data at offset %d", c.Start)
+		}
+	}
+	return nil
+}
+
+func (s *readerAtSeedSegment) WriteInto(dst *os.File, offset, length, blocksize uint64, isBlank bool) (uint64, uint64, error) {
+	if length != s.Size() {
+		return 0, 0, fmt.Errorf("unable to copy %d bytes to %s : wrong size", length, dst.Name())
+	}
+	// Read in large pieces, readers like HTTPRangeReader make a request for
+	// every call, but don't hold the whole segment in memory
+	size := length
+	if size > readerAtSeedReadSize {
+		size = readerAtSeedReadSize
+	}
+	b := make([]byte, size)
+	var copied uint64
+	for copied < length {
+		p := b
+		if length-copied < uint64(len(p)) {
+			p = p[:length-copied]
+		}
+		// ReadAt may return io.EOF along with the data at the end of the blob
+		if n, err := s.r.ReadAt(p, int64(s.chunks[0].Start+copied)); err != nil && (err != io.EOF || n < len(p)) {
+			return copied, 0, err
+		}
+		n, err := dst.WriteAt(p, int64(offset+copied))
+		copied += uint64(n)
+		if err != nil {
+			return copied, 0, err
+		}
+	}
+	return copied, 0, nil
+}
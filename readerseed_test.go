@@ -0,0 +1,45 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderAtSeed(t *testing.T) {
+	dir := t.TempDir()
+
+	// Chunk some random data to get an index for it
+	data := make([]byte, 4*ChunkSizeMaxDefault)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	blob := filepath.Join(dir, "blob")
+	require.NoError(t, os.WriteFile(blob, data, 0644))
+	idx, _, err := IndexFromFile(context.Background(), blob, 1,
+		ChunkSizeMinDefault, ChunkSizeAvgDefault, ChunkSizeMaxDefault, NewProgressBar(""))
+	require.NoError(t, err)
+
+	// The store is empty, everything has to come from the seed
+	s, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	seed := NewReaderAtSeed(bytes.NewReader(data), idx)
+
+	target := filepath.Join(dir, "target")
+	stats, err := AssembleFile(context.Background(), target, idx, s, []Seed{seed}, AssembleOptions{N: 4})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(idx.Chunks)), stats.ChunksFromSeeds)
+	b, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+
+	// Data that doesn't match the index is detected after it's written
+	bad := make([]byte, len(data))
+	seed = NewReaderAtSeed(bytes.NewReader(bad), idx)
+	_, err = AssembleFile(context.Background(), filepath.Join(dir, "bad"), idx, s, []Seed{seed}, AssembleOptions{N: 4})
+	require.Error(t, err)
+}
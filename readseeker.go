@@ -30,7 +30,7 @@ func NewIndexReadSeeker(i Index, s Store) *IndexPos {
 		Index:      i,
 		Length:     i.Length(),
 		curChunkID: i.Chunks[0].ID,
-		nullChunk:  NewNullChunk(i.Index.ChunkSizeMax),
+		nullChunk:  newNullChunk(i.Index.ChunkSizeMax, i.digest()),
 	}
 }
 
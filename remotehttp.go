@@ -2,18 +2,19 @@ package desync
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
-	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"crypto/x509"
-
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -26,17 +27,81 @@ type RemoteHTTPBase struct {
 	client     *http.Client
 	opt        StoreOptions
 	converters Converters
+	stats      *httpConnStats
+
+	// Address all connections are made to instead of the host in the location
+	dialAddr string
+
+	// Transport shared with other stores, released when the store is closed
+	transport *sharedHTTPTransport
+	closed    sync.Once
+
+	limits bandwidthLimits
+}
+
+// Default number of TLS sessions cached for resumption in HTTP stores.
+const DefaultTLSSessionCacheSize = 64
+
+// HTTPConnStats count how connections to an HTTP store were established. A high
+// number of new connections or full TLS handshakes compared to the number of
+// requests indicates connections aren't kept alive, or sessions not resumed.
+type HTTPConnStats struct {
+	Requests         uint64        `json:"requests"`
+	NewConns         uint64        `json:"new-connections"`
+	ReusedConns      uint64        `json:"reused-connections"`
+	TLSHandshakes    uint64        `json:"tls-handshakes"`
+	TLSResumed       uint64        `json:"tls-resumed"`
+	TLSHandshakeTime time.Duration `json:"tls-handshake-time"`
+}
+
+// Counters behind HTTPConnStats, updated atomically.
+type httpConnStats struct {
+	requests, newConns, reusedConns, tlsHandshakes, tlsResumed, tlsHandshakeNs uint64
+}
+
+// Returns a request trace that records connection reuse and TLS handshakes.
+func (s *httpConnStats) trace() *httptrace.ClientTrace {
+	var handshakeStart time.Time
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&s.reusedConns, 1)
+			} else {
+				atomic.AddUint64(&s.newConns, 1)
+			}
+		},
+		TLSHandshakeStart: func() { handshakeStart = time.Now() },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			atomic.AddUint64(&s.tlsHandshakeNs, uint64(time.Since(handshakeStart)))
+			if err != nil {
+				return
+			}
+			atomic.AddUint64(&s.tlsHandshakes, 1)
+			if state.DidResume {
+				atomic.AddUint64(&s.tlsResumed, 1)
+			}
+		},
+	}
 }
 
 // RemoteHTTP is a remote casync store accessed via HTTP.
 type RemoteHTTP struct {
 	*RemoteHTTPBase
+	layout ChunkLayout
 }
 
 type GetReaderForRequestBody func() io.Reader
 
 // NewRemoteHTTPStoreBase initializes a base object for HTTP index or chunk stores.
 func NewRemoteHTTPStoreBase(location *url.URL, opt StoreOptions) (*RemoteHTTPBase, error) {
+	return newRemoteHTTPStoreBase(location, opt, "")
+}
+
+// Initializes a base object for HTTP stores. If dialAddr is given, connections
+// are made to that address instead of the host in the location. The host is
+// still used in requests and to verify the certificate of the server. A dialAddr
+// of the form "unix:<path>" connects to a Unix socket.
+func newRemoteHTTPStoreBase(location *url.URL, opt StoreOptions, dialAddr string) (*RemoteHTTPBase, error) {
 	if location.Scheme != "http" && location.Scheme != "https" {
 		return nil, fmt.Errorf("unsupported scheme %s, expected http or https", location.Scheme)
 	}
@@ -45,62 +110,119 @@ func NewRemoteHTTPStoreBase(location *url.URL, opt StoreOptions) (*RemoteHTTPBas
 		location.Path = location.Path + "/"
 	}
 
-	// Build a TLS client config
-	tlsConfig := &tls.Config{InsecureSkipVerify: opt.TrustInsecure}
-
-	// Add client key/cert if provided
-	if opt.ClientCert != "" && opt.ClientKey != "" {
-		certificate, err := tls.LoadX509KeyPair(opt.ClientCert, opt.ClientKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load client certificate from %s", opt.ClientCert)
-		}
-		tlsConfig.Certificates = []tls.Certificate{certificate}
-	}
-
-	// Load custom CA set if provided
-	if opt.CACert != "" {
-		certPool := x509.NewCertPool()
-		b, err := ioutil.ReadFile(opt.CACert)
-		if err != nil {
-			return nil, err
-		}
-		if ok := certPool.AppendCertsFromPEM(b); !ok {
-			return nil, errors.New("no CA certificates found in ca-cert file")
-		}
-		tlsConfig.RootCAs = certPool
-	}
-
-	tr := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		DisableCompression:  true,
-		MaxIdleConnsPerHost: opt.N,
-		IdleConnTimeout:     60 * time.Second,
-		TLSClientConfig:     tlsConfig,
-		ForceAttemptHTTP2:   true,
+	tr, err := acquireHTTPTransport(location, opt, dialAddr)
+	if err != nil {
+		return nil, err
 	}
 
-	// If no timeout was given in config (set to 0), then use 1 minute. If timeout is negative, use 0 to
-	// set an infinite timeout.
+	// If no timeout was given in config (set to 0), then use 1 minute, unless stalled
+	// transfers are detected which makes an overall timeout unnecessary. If timeout is
+	// negative, use 0 to set an infinite timeout.
 	timeout := opt.Timeout
-	if timeout == 0 {
+	if timeout == 0 && opt.StallTimeout == 0 {
 		timeout = time.Minute
 	} else if timeout < 0 {
 		timeout = 0
 	}
 	client := &http.Client{Transport: tr, Timeout: timeout}
 
-	return &RemoteHTTPBase{location: location, client: client, opt: opt, converters: opt.converters()}, nil
+	return &RemoteHTTPBase{location: location, client: client, opt: opt, converters: opt.converters(), stats: new(httpConnStats), dialAddr: dialAddr, transport: tr}, nil
 }
 
 func (r *RemoteHTTPBase) String() string {
+	if r.dialAddr != "" {
+		return fmt.Sprintf("%s (%s)", r.location, r.dialAddr)
+	}
 	return r.location.String()
 }
 
-// Close the HTTP store. NOP operation but needed to implement the interface.
-func (r *RemoteHTTPBase) Close() error { return nil }
+// Cancels a request when no data was read for a given time.
+type stallDetector struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+func newStallDetector(timeout time.Duration, cancel context.CancelFunc) *stallDetector {
+	d := &stallDetector{timeout: timeout}
+	d.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&d.stalled, 1)
+		cancel()
+	})
+	return d
+}
+
+// Returns a reader that resets the timer whenever data is read from r.
+func (d *stallDetector) reader(r io.Reader) io.Reader {
+	return stallReader{r: r, d: d}
+}
+
+func (d *stallDetector) stop() {
+	d.timer.Stop()
+}
+
+// Replaces an error caused by the cancelation with one that explains it.
+func (d *stallDetector) wrap(err error) error {
+	if d == nil || atomic.LoadInt32(&d.stalled) == 0 {
+		return err
+	}
+	return fmt.Errorf("transfer stalled for %s: %w", d.timeout, err)
+}
+
+type stallReader struct {
+	r io.Reader
+	d *stallDetector
+}
+
+func (r stallReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.d.timer.Reset(r.d.timeout)
+	}
+	return n, err
+}
+
+// ConnStats returns statistics about the connections made to the store so far.
+func (r *RemoteHTTPBase) ConnStats() HTTPConnStats {
+	return HTTPConnStats{
+		Requests:         atomic.LoadUint64(&r.stats.requests),
+		NewConns:         atomic.LoadUint64(&r.stats.newConns),
+		ReusedConns:      atomic.LoadUint64(&r.stats.reusedConns),
+		TLSHandshakes:    atomic.LoadUint64(&r.stats.tlsHandshakes),
+		TLSResumed:       atomic.LoadUint64(&r.stats.tlsResumed),
+		TLSHandshakeTime: time.Duration(atomic.LoadUint64(&r.stats.tlsHandshakeNs)),
+	}
+}
+
+// Close the HTTP store. Logs the connection statistics in verbose mode.
+func (r *RemoteHTTPBase) Close() error {
+	stats := r.ConnStats()
+	Log.WithFields(logrus.Fields{
+		"store":              r.String(),
+		"requests":           stats.Requests,
+		"new-connections":    stats.NewConns,
+		"reused-connections": stats.ReusedConns,
+		"tls-handshakes":     stats.TLSHandshakes,
+		"tls-resumed":        stats.TLSResumed,
+		"tls-handshake-time": stats.TLSHandshakeTime,
+	}).Debug("connection statistics")
+	r.closed.Do(r.transport.release)
+	return nil
+}
+
+func (r *RemoteHTTPBase) limitBandwidth(download, upload *BandwidthLimiter) {
+	r.limits.add(download, upload)
+}
 
 // Send a single HTTP request.
 func (r *RemoteHTTPBase) IssueHttpRequest(method string, u *url.URL, getReader GetReaderForRequestBody, attempt int) (int, []byte, error) {
+	statusCode, _, b, err := r.issueHttpRequest(method, u, nil, getReader, attempt)
+	return statusCode, b, err
+}
+
+// Sends a single HTTP request with additional headers and returns the response
+// headers along with the status code and body.
+func (r *RemoteHTTPBase) issueHttpRequest(method string, u *url.URL, header http.Header, getReader GetReaderForRequestBody, attempt int) (int, http.Header, []byte, error) {
 
 	var (
 		resp *http.Response
@@ -111,10 +233,32 @@ func (r *RemoteHTTPBase) IssueHttpRequest(method string, u *url.URL, getReader G
 		})
 	)
 
-	req, err := http.NewRequest(method, u.String(), getReader())
+	// Abort the request if no data moves in either direction for too long
+	ctx := httptrace.WithClientTrace(context.Background(), r.stats.trace())
+	var stall *stallDetector
+	if r.opt.StallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		stall = newStallDetector(r.opt.StallTimeout, cancel)
+		defer stall.stop()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), getReader())
 	if err != nil {
 		log.Debug("unable to create new request")
-		return 0, nil, err
+		return 0, nil, nil, err
+	}
+	// Wrap the body after the request was created so the content length is preserved
+	if req.Body != nil && len(r.limits.upload) > 0 {
+		req.Body = ioutil.NopCloser(r.limits.uploadReader(req.Body))
+	}
+	if stall != nil && req.Body != nil {
+		req.Body = ioutil.NopCloser(stall.reader(req.Body))
+	}
+	atomic.AddUint64(&r.stats.requests, 1)
+	for k, v := range header {
+		req.Header[k] = v
 	}
 	if r.opt.HTTPAuth != "" {
 		req.Header.Set("Authorization", r.opt.HTTPAuth)
@@ -127,23 +271,35 @@ func (r *RemoteHTTPBase) IssueHttpRequest(method string, u *url.URL, getReader G
 	resp, err = r.client.Do(req)
 	if err != nil {
 		log.WithError(err).Error("error while sending request")
-		return 0, nil, errors.Wrap(err, u.String())
+		return 0, nil, nil, StoreError{Kind: ErrTemporaryNetwork, Store: r.String(), Err: errors.Wrap(stall.wrap(err), u.String())}
 	}
 
 	defer resp.Body.Close()
 
-	b, err := ioutil.ReadAll(resp.Body)
+	respBody := r.limits.downloadReader(resp.Body)
+	if stall != nil {
+		respBody = stall.reader(respBody)
+	}
+	b, err := ioutil.ReadAll(respBody)
 	if err != nil {
+		err = stall.wrap(err)
 		log.WithError(err).Error("error while reading response")
-		return 0, nil, errors.Wrap(err, u.String())
+		return 0, nil, nil, StoreError{Kind: ErrTemporaryNetwork, Store: r.String(), Err: errors.Wrap(err, u.String())}
 	}
 
 	log.WithField("statusCode", resp.StatusCode).Debug("response received")
-	return resp.StatusCode, b, nil
+	return resp.StatusCode, resp.Header, b, nil
 }
 
-// Send a single HTTP request, retrying if a retryable error has occurred.
+// Send a single HTTP request, retrying if a retryable error has occurred. Server
+// errors (5xx) and throttling (429) are retried too. The status of the last
+// attempt is returned if all attempts fail.
 func (r *RemoteHTTPBase) IssueRetryableHttpRequest(method string, u *url.URL, getReader GetReaderForRequestBody) (int, []byte, error) {
+	statusCode, _, b, err := r.issueRetryableHttpRequest(method, u, nil, getReader)
+	return statusCode, b, err
+}
+
+func (r *RemoteHTTPBase) issueRetryableHttpRequest(method string, u *url.URL, header http.Header, getReader GetReaderForRequestBody) (int, http.Header, []byte, error) {
 
 	var (
 		attempt int
@@ -155,12 +311,12 @@ func (r *RemoteHTTPBase) IssueRetryableHttpRequest(method string, u *url.URL, ge
 
 retry:
 	attempt++
-	statusCode, responseBody, err := r.IssueHttpRequest(method, u, getReader, attempt)
+	statusCode, respHeader, responseBody, err := r.issueHttpRequest(method, u, header, getReader, attempt)
 
-	if (err != nil) || (statusCode >= 500 && statusCode < 600) {
+	if (err != nil) || (statusCode >= 500 && statusCode < 600) || statusCode == http.StatusTooManyRequests {
 		if attempt >= r.opt.ErrorRetry {
 			log.WithField("attempt", attempt).Debug("failed, giving up")
-			return 0, nil, err
+			return statusCode, respHeader, responseBody, err
 		} else {
 			log.WithField("attempt", attempt).WithField("delay", attempt).Debug("waiting, then retrying")
 			time.Sleep(time.Duration(attempt) * r.opt.ErrorRetryBaseInterval)
@@ -168,13 +324,17 @@ retry:
 		}
 	}
 
-	return statusCode, responseBody, nil
+	return statusCode, respHeader, responseBody, nil
 }
 
 // GetObject reads and returns an object in the form of []byte from the store
 func (r *RemoteHTTPBase) GetObject(name string) ([]byte, error) {
+	return r.getObject(name, nil)
+}
+
+func (r *RemoteHTTPBase) getObject(name string, header http.Header) ([]byte, error) {
 	u, _ := r.location.Parse(name)
-	statusCode, responseBody, err := r.IssueRetryableHttpRequest("GET", u, func() io.Reader { return nil })
+	statusCode, _, responseBody, err := r.issueRetryableHttpRequest("GET", u, header, func() io.Reader { return nil })
 	if err != nil {
 		return nil, err
 	}
@@ -184,19 +344,54 @@ func (r *RemoteHTTPBase) GetObject(name string) ([]byte, error) {
 	case 404:
 		return nil, NoSuchObject{name}
 	default:
-		return nil, fmt.Errorf("unexpected status code %d from %s", statusCode, name)
+		err := fmt.Errorf("unexpected status code %d from %s", statusCode, name)
+		if sErr := errorFromHTTPStatus(r.String(), statusCode, err); sErr != nil {
+			return nil, sErr
+		}
+		return nil, err
+	}
+}
+
+// ObjectETag returns the ETag of an object in the store, or an empty string if
+// the server doesn't provide one.
+func (r *RemoteHTTPBase) ObjectETag(name string) (string, error) {
+	u, _ := r.location.Parse(name)
+	statusCode, header, _, err := r.issueRetryableHttpRequest("HEAD", u, nil, func() io.Reader { return nil })
+	if err != nil {
+		return "", err
+	}
+	switch statusCode {
+	case 200: // expected
+		return header.Get("ETag"), nil
+	case 404:
+		return "", NoSuchObject{name}
+	default:
+		err := fmt.Errorf("unexpected status code %d from %s", statusCode, name)
+		if sErr := errorFromHTTPStatus(r.String(), statusCode, err); sErr != nil {
+			return "", sErr
+		}
+		return "", err
 	}
 }
 
 // StoreObject stores an object to the store.
 func (r *RemoteHTTPBase) StoreObject(name string, getReader GetReaderForRequestBody) error {
+	return r.storeObject(name, nil, getReader)
+}
+
+func (r *RemoteHTTPBase) storeObject(name string, header http.Header, getReader GetReaderForRequestBody) error {
 	u, _ := r.location.Parse(name)
-	statusCode, responseBody, err := r.IssueRetryableHttpRequest("PUT", u, getReader)
+	statusCode, _, responseBody, err := r.issueRetryableHttpRequest("PUT", u, header, getReader)
 	if err != nil {
 		return err
 	}
-	if statusCode != 200 {
-		return errors.New(string(responseBody))
+	// Servers may answer with 204 if they already have the object
+	if statusCode != http.StatusOK && statusCode != http.StatusNoContent {
+		err := errors.New(string(responseBody))
+		if sErr := errorFromHTTPStatus(r.String(), statusCode, err); sErr != nil {
+			return sErr
+		}
+		return err
 	}
 	return nil
 }
@@ -204,17 +399,28 @@ func (r *RemoteHTTPBase) StoreObject(name string, getReader GetReaderForRequestB
 // NewRemoteHTTPStore initializes a new store that pulls chunks via HTTP(S) from
 // a remote web server. n defines the size of idle connections allowed.
 func NewRemoteHTTPStore(location *url.URL, opt StoreOptions) (*RemoteHTTP, error) {
-	b, err := NewRemoteHTTPStoreBase(location, opt)
+	return newRemoteHTTPStore(location, opt, "")
+}
+
+func newRemoteHTTPStore(location *url.URL, opt StoreOptions, dialAddr string) (*RemoteHTTP, error) {
+	b, err := newRemoteHTTPStoreBase(location, opt, dialAddr)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := opt.chunkLayout()
 	if err != nil {
 		return nil, err
 	}
-	return &RemoteHTTP{b}, nil
+	if _, err := DigestByName(opt.Digest); err != nil {
+		return nil, err
+	}
+	return &RemoteHTTP{b, layout}, nil
 }
 
 // GetChunk reads and returns one chunk from the store
 func (r *RemoteHTTP) GetChunk(id ChunkID) (*Chunk, error) {
 	p := r.nameFromID(id)
-	b, err := r.GetObject(p)
+	b, err := r.getObject(p, http.Header{"Accept": {r.converters.mediaType()}})
 	if err != nil {
 		// The base returns NoSuchObject, but it has to be ChunkMissing for routers to work
 		if _, ok := err.(NoSuchObject); ok {
@@ -222,7 +428,7 @@ func (r *RemoteHTTP) GetChunk(id ChunkID) (*Chunk, error) {
 		}
 		return nil, err
 	}
-	return NewChunkFromStorage(id, b, r.converters, r.opt.SkipVerify)
+	return newChunkFromStorage(id, b, r.converters, r.opt.SkipVerify, r.opt.digest())
 }
 
 // HasChunk returns true if the chunk is in the store
@@ -240,7 +446,11 @@ func (r *RemoteHTTP) HasChunk(id ChunkID) (bool, error) {
 	case 404:
 		return false, nil
 	default:
-		return false, fmt.Errorf("unexpected status code: %d", statusCode)
+		err := fmt.Errorf("unexpected status code: %d", statusCode)
+		if sErr := errorFromHTTPStatus(r.String(), statusCode, err); sErr != nil {
+			return false, sErr
+		}
+		return false, err
 	}
 }
 
@@ -255,16 +465,37 @@ func (r *RemoteHTTP) StoreChunk(chunk *Chunk) error {
 	if err != nil {
 		return err
 	}
-	return r.StoreObject(p, func() io.Reader { return bytes.NewReader(b) })
+	header := http.Header{"Content-Type": {r.converters.mediaType()}}
+	return r.storeObject(p, header, func() io.Reader { return bytes.NewReader(b) })
+}
+
+// Warm sends an index to a chunk server to have it read the chunks from its
+// upstream stores ahead of them being requested. Requires the server to have
+// the warm endpoint enabled.
+func (r *RemoteHTTP) Warm(idx Index) error {
+	u, _ := r.location.Parse(warmPath)
+	getReader := func() io.Reader {
+		rdr, w := io.Pipe()
+		go func() {
+			_, err := idx.WriteTo(w)
+			w.CloseWithError(err)
+		}()
+		return rdr
+	}
+	statusCode, responseBody, err := r.IssueRetryableHttpRequest("POST", u, getReader)
+	if err != nil {
+		return err
+	}
+	if statusCode != http.StatusAccepted {
+		err := errors.New(string(responseBody))
+		if sErr := errorFromHTTPStatus(r.String(), statusCode, err); sErr != nil {
+			return sErr
+		}
+		return err
+	}
+	return nil
 }
 
 func (r *RemoteHTTP) nameFromID(id ChunkID) string {
-	sID := id.String()
-	name := path.Join(sID[0:4], sID)
-	if r.opt.Uncompressed {
-		name += UncompressedChunkExt
-	} else {
-		name += CompressedChunkExt
-	}
-	return name
+	return r.layout.Name(id)
 }
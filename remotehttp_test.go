@@ -1,13 +1,18 @@
 package desync
 
 import (
+	"crypto/tls"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHTTPStoreURL(t *testing.T) {
@@ -299,3 +304,208 @@ func TestPutChunk(t *testing.T) {
 		})
 	}
 }
+
+func TestRemoteHTTPErrorClasses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/0000/0000000100000000000000000000000000000000000000000000000000000000.cacnk":
+			w.WriteHeader(http.StatusForbidden)
+		case "/0000/0000000200000000000000000000000000000000000000000000000000000000.cacnk":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/0000/0000000300000000000000000000000000000000000000000000000000000000.cacnk":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	s, err := NewRemoteHTTPStore(u, StoreOptions{ErrorRetry: 2, ErrorRetryBaseInterval: time.Microsecond})
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		id   ChunkID
+		kind error
+	}{
+		"unauthorized": {ChunkID{0, 0, 0, 1}, ErrUnauthorized},
+		"throttled":    {ChunkID{0, 0, 0, 2}, ErrThrottled},
+		"unavailable":  {ChunkID{0, 0, 0, 3}, ErrTemporaryNetwork},
+		"not found":    {ChunkID{0, 0, 0, 4}, ErrNotFound},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.GetChunk(test.id)
+			require.ErrorIs(t, err, test.kind)
+
+			// The class is preserved when going through a router
+			_, err = NewStoreRouter(&TestStore{}, s).GetChunk(test.id)
+			require.ErrorIs(t, err, test.kind)
+		})
+	}
+}
+
+func TestRemoteHTTPConnStats(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	s, err := NewRemoteHTTPStore(u, StoreOptions{TrustInsecure: true})
+	require.NoError(t, err)
+
+	// Sequential requests should all use the same connection
+	for i := 0; i < 5; i++ {
+		_, err := s.HasChunk(ChunkID{})
+		require.NoError(t, err)
+	}
+	stats := s.ConnStats()
+	require.Equal(t, uint64(5), stats.Requests)
+	require.Equal(t, uint64(1), stats.NewConns)
+	require.Equal(t, uint64(4), stats.ReusedConns)
+	require.Equal(t, uint64(1), stats.TLSHandshakes)
+
+	// A new connection resumes the cached TLS session
+	s.client.CloseIdleConnections()
+	_, err = s.HasChunk(ChunkID{})
+	require.NoError(t, err)
+	stats = s.ConnStats()
+	require.Equal(t, uint64(2), stats.NewConns)
+	require.Equal(t, uint64(2), stats.TLSHandshakes)
+	require.Equal(t, uint64(1), stats.TLSResumed)
+
+	// Without session cache, there's a full handshake every time
+	s, err = NewRemoteHTTPStore(u, StoreOptions{TrustInsecure: true, TLSSessionCacheSize: -1})
+	require.NoError(t, err)
+	_, err = s.HasChunk(ChunkID{})
+	require.NoError(t, err)
+	s.client.CloseIdleConnections()
+	_, err = s.HasChunk(ChunkID{})
+	require.NoError(t, err)
+	require.Zero(t, s.ConnStats().TLSResumed)
+}
+
+func TestRemoteHTTPStallTimeout(t *testing.T) {
+	chunk := NewChunk([]byte("some chunk data"))
+	b, err := Converters{Compressor{}}.toStorage([]byte("some chunk data"))
+	require.NoError(t, err)
+
+	// Sends the chunk slowly, one byte at a time, but keeps making progress
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for i := range b {
+			w.Write(b[i : i+1])
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer slow.Close()
+
+	// Sends the headers and then hangs
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer hung.Close()
+
+	opt := StoreOptions{StallTimeout: 200 * time.Millisecond, ErrorRetry: 1}
+
+	u, _ := url.Parse(slow.URL)
+	s, err := NewRemoteHTTPStore(u, opt)
+	require.NoError(t, err)
+	_, err = s.GetChunk(chunk.ID())
+	require.NoError(t, err)
+
+	u, _ = url.Parse(hung.URL)
+	s, err = NewRemoteHTTPStore(u, opt)
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = s.GetChunk(chunk.ID())
+	require.ErrorIs(t, err, ErrTemporaryNetwork)
+	require.Contains(t, err.Error(), "stalled")
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestRemoteHTTP3(t *testing.T) {
+	upstream, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	handler := NewHTTPHandler(upstream, true, false, []converter{Compressor{}}, "")
+
+	// Borrow the self-signed certificate of a TLS test server for the HTTP/3 server
+	ts := httptest.NewTLSServer(handler)
+	defer ts.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: ts.TLS.Certificates}),
+	}
+	go server.Serve(conn)
+	defer server.Close()
+
+	u, _ := url.Parse("https://" + conn.LocalAddr().String())
+	s, err := NewRemoteHTTPStore(u, StoreOptions{TrustInsecure: true, HTTP3: true})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Write a chunk and read it back
+	chunk := NewChunk([]byte("some data"))
+	require.NoError(t, s.StoreChunk(chunk))
+	out, err := s.GetChunk(chunk.ID())
+	require.NoError(t, err)
+	b, err := out.Data()
+	require.NoError(t, err)
+	require.Equal(t, []byte("some data"), b)
+
+	// HTTP/3 requires TLS
+	u, _ = url.Parse("http://" + conn.LocalAddr().String())
+	_, err = NewRemoteHTTPStore(u, StoreOptions{HTTP3: true})
+	require.Error(t, err)
+}
+
+func TestRemoteHTTPSharedTransport(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	u1, _ := url.Parse(ts.URL + "/store1")
+	u2, _ := url.Parse(ts.URL + "/store2")
+
+	// Stores on the same host with the same options share connections
+	s1, err := NewRemoteHTTPStore(u1, StoreOptions{TrustInsecure: true})
+	require.NoError(t, err)
+	s2, err := NewRemoteHTTPStore(u2, StoreOptions{TrustInsecure: true})
+	require.NoError(t, err)
+	require.Same(t, s1.transport, s2.transport)
+
+	_, err = s1.HasChunk(ChunkID{})
+	require.NoError(t, err)
+	_, err = s2.HasChunk(ChunkID{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), s1.ConnStats().NewConns)
+	require.Equal(t, uint64(0), s2.ConnStats().NewConns)
+	require.Equal(t, uint64(1), s2.ConnStats().ReusedConns)
+
+	// Different TLS settings need their own transport
+	s3, err := NewRemoteHTTPStore(u1, StoreOptions{TrustInsecure: true, TLSSessionCacheSize: -1})
+	require.NoError(t, err)
+	require.NotSame(t, s1.transport, s3.transport)
+	s3.Close()
+
+	// The transport remains in use until the last store is closed
+	s1.Close()
+	s1.Close()
+	_, err = s2.HasChunk(ChunkID{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), s2.ConnStats().ReusedConns)
+	s2.Close()
+	s4, err := NewRemoteHTTPStore(u1, StoreOptions{TrustInsecure: true})
+	require.NoError(t, err)
+	defer s4.Close()
+	require.NotSame(t, s1.transport, s4.transport)
+}
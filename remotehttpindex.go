@@ -10,16 +10,22 @@ import (
 // RemoteHTTPIndex is a remote index store accessed via HTTP.
 type RemoteHTTPIndex struct {
 	*RemoteHTTPBase
+
+	indexConverters Converters
 }
 
 // NewRemoteHTTPIndexStore initializes a new store that pulls the specified index file via HTTP(S) from
 // a remote web server.
 func NewRemoteHTTPIndexStore(location *url.URL, opt StoreOptions) (*RemoteHTTPIndex, error) {
+	converters, err := opt.indexConverters()
+	if err != nil {
+		return nil, err
+	}
 	b, err := NewRemoteHTTPStoreBase(location, opt)
 	if err != nil {
 		return nil, err
 	}
-	return &RemoteHTTPIndex{b}, nil
+	return &RemoteHTTPIndex{b, converters}, nil
 }
 
 // GetIndexReader returns an index reader from an HTTP store. Fails if the specified index
@@ -30,7 +36,7 @@ func (r RemoteHTTPIndex) GetIndexReader(name string) (rdr io.ReadCloser, e error
 		return rdr, err
 	}
 	rc := ioutil.NopCloser(bytes.NewReader(b))
-	return rc, nil
+	return indexReaderFromStorage(rc, r.indexConverters)
 }
 
 // GetIndex returns an Index structure from the store
@@ -39,7 +45,17 @@ func (r *RemoteHTTPIndex) GetIndex(name string) (i Index, e error) {
 	if err != nil {
 		return i, err
 	}
-	return IndexFromReader(ir)
+	return IndexFromReaderWithDigest(ir, r.indexDigest())
+}
+
+func (r *RemoteHTTPIndex) indexDigest() HashAlgorithm {
+	return r.opt.indexDigest()
+}
+
+// IndexETag returns the ETag the server provides for an index, or an empty
+// string if there is none.
+func (r *RemoteHTTPIndex) IndexETag(name string) (string, error) {
+	return r.ObjectETag(name)
 }
 
 // StoreIndex adds a new chunk to the store
@@ -49,8 +65,7 @@ func (r *RemoteHTTPIndex) StoreIndex(name string, idx Index) error {
 
 		rdr, w := io.Pipe()
 		go func() {
-			defer w.Close()
-			idx.WriteTo(w)
+			w.CloseWithError(writeIndexToStorage(w, idx, r.indexConverters))
 		}()
 		return rdr
 	}
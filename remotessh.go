@@ -28,6 +28,7 @@ func NewRemoteSSHStore(location *url.URL, opt StoreOptions) (*RemoteSSH, error)
 		if err != nil {
 			return &remote, errors.Wrap(err, "failed to start chunk server command")
 		}
+		s.digest = opt.digest()
 		remote.pool <- s
 	}
 	return &remote, nil
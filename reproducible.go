@@ -0,0 +1,54 @@
+package desync
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// ReproducibleReader wraps a FilesystemReader and normalizes the entries it
+// returns so that the same tree always results in identical catar archives
+// and chunks, regardless of when or where it was created. Timestamps are set
+// to zero, or if ClampTime is set, anything newer is clamped to that time. It
+// also ensures that entries in a directory are returned in sorted order, which
+// isn't guaranteed for inputs like tar streams.
+type ReproducibleReader struct {
+	fs        FilesystemReader
+	clampTime time.Time
+	last      map[string]string // last name seen in each directory
+}
+
+var _ FilesystemReader = &ReproducibleReader{}
+
+// NewReproducibleReader returns a reader that normalizes the entries of fs. If
+// clampTime is the zero value, all timestamps are set to zero.
+func NewReproducibleReader(fs FilesystemReader, clampTime time.Time) *ReproducibleReader {
+	return &ReproducibleReader{
+		fs:        fs,
+		clampTime: clampTime,
+		last:      make(map[string]string),
+	}
+}
+
+// Next returns the next normalized entry from the underlying reader. Fails if
+// an entry is out of order.
+func (r *ReproducibleReader) Next() (*File, error) {
+	f, err := r.fs.Next()
+	if err != nil {
+		return nil, err
+	}
+	dir, name := path.Split(path.Clean(f.Path))
+	if last, ok := r.last[dir]; ok && name <= last {
+		f.Close()
+		return nil, fmt.Errorf("'%s' is out of order, can't produce a reproducible archive", f.Path)
+	}
+	r.last[dir] = name
+
+	switch {
+	case r.clampTime.IsZero():
+		f.ModTime = time.Unix(0, 0)
+	case f.ModTime.After(r.clampTime):
+		f.ModTime = r.clampTime
+	}
+	return f, nil
+}
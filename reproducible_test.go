@@ -0,0 +1,76 @@
+package desync
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a list of files, used as input for tar operations
+type sliceFS []*File
+
+func (s *sliceFS) Next() (*File, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	f := (*s)[0]
+	*s = (*s)[1:]
+	return f, nil
+}
+
+func TestReproducibleReader(t *testing.T) {
+	clamp := time.Unix(1700000000, 0)
+	older := clamp.Add(-time.Hour)
+	newer := clamp.Add(time.Hour)
+	input := func() *sliceFS {
+		return &sliceFS{
+			{Name: ".", Path: ".", Mode: os.ModeDir | 0755, ModTime: newer},
+			{Name: "a", Path: "a", Mode: 0644, ModTime: older},
+			{Name: "b", Path: "b", Mode: os.ModeDir | 0755, ModTime: newer},
+			{Name: "a", Path: "b/a", Mode: 0644, ModTime: newer},
+			{Name: "c", Path: "c", Mode: 0644, ModTime: older},
+		}
+	}
+
+	// Without clamp time, everything is set to zero
+	r := NewReproducibleReader(input(), time.Time{})
+	for {
+		f, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, time.Unix(0, 0), f.ModTime, f.Path)
+	}
+
+	// With clamp time, only newer timestamps are changed
+	r = NewReproducibleReader(input(), clamp)
+	for {
+		f, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.False(t, f.ModTime.After(clamp), f.Path)
+		if f.Name != "c" {
+			continue
+		}
+		require.Equal(t, older, f.ModTime)
+	}
+
+	// Entries out of order in a directory should fail
+	r = NewReproducibleReader(&sliceFS{
+		{Name: ".", Path: ".", Mode: os.ModeDir | 0755},
+		{Name: "b", Path: "b", Mode: 0644},
+		{Name: "a", Path: "a", Mode: 0644},
+	}, time.Time{})
+	_, err := r.Next()
+	require.NoError(t, err)
+	_, err = r.Next()
+	require.NoError(t, err)
+	_, err = r.Next()
+	require.Error(t, err)
+}
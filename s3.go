@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"strings"
 
@@ -14,6 +15,10 @@ import (
 )
 
 var _ WriteStore = S3Store{}
+var _ PruneProgressStore = S3Store{}
+var _ PruneDryRunStore = S3Store{}
+var _ ChunkLister = S3Store{}
+var _ BatchWriteStore = S3Store{}
 
 // S3StoreBase is the base object for all chunk and index stores with S3 backing
 type S3StoreBase struct {
@@ -23,17 +28,28 @@ type S3StoreBase struct {
 	prefix     string
 	opt        StoreOptions
 	converters Converters
+	layout     ChunkLayout
+	limits     *bandwidthLimits
 }
 
 // S3Store is a read-write store with S3 backing
 type S3Store struct {
 	S3StoreBase
+
+	// Limits the number of concurrent uploads of StoreChunks
+	batch chan struct{}
 }
 
 // NewS3StoreBase initializes a base object used for chunk or index stores backed by S3.
 func NewS3StoreBase(u *url.URL, s3Creds *credentials.Credentials, region string, opt StoreOptions, lookupType minio.BucketLookupType) (S3StoreBase, error) {
 	var err error
-	s := S3StoreBase{Location: u.String(), opt: opt, converters: opt.converters()}
+	s := S3StoreBase{Location: u.String(), opt: opt, converters: opt.converters(), limits: &bandwidthLimits{}}
+	if s.layout, err = opt.chunkLayout(); err != nil {
+		return s, err
+	}
+	if _, err = DigestByName(opt.Digest); err != nil {
+		return s, err
+	}
 	if !strings.HasPrefix(u.Scheme, "s3+http") {
 		return s, fmt.Errorf("invalid scheme '%s', expected 's3+http' or 's3+https'", u.Scheme)
 	}
@@ -83,7 +99,7 @@ func NewS3Store(location *url.URL, s3Creds *credentials.Credentials, region stri
 	if err != nil {
 		return s, err
 	}
-	return S3Store{b}, nil
+	return S3Store{S3StoreBase: b, batch: newBatchLimit(opt.N)}, nil
 }
 
 // GetChunk reads and returns one chunk from the store
@@ -97,11 +113,11 @@ retry:
 		if attempt <= s.opt.ErrorRetry {
 			goto retry
 		}
-		return nil, errors.Wrap(err, s.String())
+		return nil, s.classifyError(err)
 	}
 	defer obj.Close()
 
-	b, err := ioutil.ReadAll(obj)
+	b, err := ioutil.ReadAll(s.limits.downloadReader(obj))
 	if err != nil {
 		if attempt <= s.opt.ErrorRetry {
 			goto retry
@@ -113,12 +129,13 @@ retry:
 			case "NoSuchKey":
 				err = ChunkMissing{ID: id}
 			default: // Without ListBucket perms in AWS, we get Permission Denied for a missing chunk, not 404
-				err = errors.Wrap(err, fmt.Sprintf("chunk %s could not be retrieved from s3 store", id))
+				err = s.classifyError(errors.Wrap(err, fmt.Sprintf("chunk %s could not be retrieved from s3 store", id.String())))
 			}
+			return nil, err
 		}
-		return nil, err
+		return nil, s.classifyError(err)
 	}
-	return NewChunkFromStorage(id, b, s.converters, s.opt.SkipVerify)
+	return newChunkFromStorage(id, b, s.converters, s.opt.SkipVerify, s.opt.digest())
 }
 
 // StoreChunk adds a new chunk to the store
@@ -136,13 +153,25 @@ func (s S3Store) StoreChunk(chunk *Chunk) error {
 	var attempt int
 retry:
 	attempt++
-	_, err = s.client.PutObject(s.bucket, name, bytes.NewReader(b), int64(len(b)), minio.PutObjectOptions{ContentType: contentType})
+	r := s.limits.uploadReader(bytes.NewReader(b))
+	_, err = s.client.PutObject(s.bucket, name, r, int64(len(b)), minio.PutObjectOptions{ContentType: contentType})
 	if err != nil {
 		if attempt < s.opt.ErrorRetry {
 			goto retry
 		}
+		return s.classifyError(err)
 	}
-	return errors.Wrap(err, s.String())
+	return nil
+}
+
+// StoreChunks adds multiple chunks to the store, uploading up to N of them
+// concurrently across all calls.
+func (s S3Store) StoreChunks(chunks []*Chunk) error {
+	return storeChunksConcurrently(chunks, s.batch, s.StoreChunk)
+}
+
+func (s S3Store) limitBandwidth(download, upload *BandwidthLimiter) {
+	s.limits.add(download, upload)
 }
 
 // HasChunk returns true if the chunk is in the store
@@ -153,14 +182,48 @@ func (s S3Store) HasChunk(id ChunkID) (bool, error) {
 }
 
 // RemoveChunk deletes a chunk, typically an invalid one, from the filesystem.
-// Used when verifying and repairing caches.
+// Used when verifying and repairing caches. If a trash prefix is set in the
+// options, the chunk is copied there before it's deleted.
 func (s S3Store) RemoveChunk(id ChunkID) error {
 	name := s.nameFromID(id)
+	if s.opt.TrashPrefix != "" {
+		dst, err := minio.NewDestinationInfo(s.bucket, s.opt.trashName(name), nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := s.client.CopyObject(dst, minio.NewSourceInfo(s.bucket, name, nil)); err != nil {
+			return errors.Wrapf(err, "moving %s to trash", name)
+		}
+	}
 	return s.client.RemoveObject(s.bucket, name)
 }
 
 // Prune removes any chunks from the store that are not contained in a list (map)
 func (s S3Store) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
+	return s.PruneWithProgress(ctx, ids, NullProgressBar{})
+}
+
+// PruneWithProgress works like Prune and reports the removed chunks to pb.
+func (s S3Store) PruneWithProgress(ctx context.Context, ids map[ChunkID]struct{}, pb ProgressBar) error {
+	list := func(ctx context.Context, fn func(ChunkID, int64) error) error {
+		return s.prune(ctx, ids, fn)
+	}
+	return pruneConcurrently(ctx, s.opt, pb, list, s.RemoveChunk)
+}
+
+// PruneDryRun returns the chunks that Prune would remove from the store, without
+// removing anything.
+func (s S3Store) PruneDryRun(ctx context.Context, ids map[ChunkID]struct{}) ([]PruneCandidate, error) {
+	var candidates []PruneCandidate
+	err := s.prune(ctx, ids, func(id ChunkID, size int64) error {
+		candidates = append(candidates, PruneCandidate{ID: id, Size: size})
+		return nil
+	})
+	return candidates, err
+}
+
+// Calls fn for every chunk in the store that is not in ids.
+func (s S3Store) prune(ctx context.Context, ids map[ChunkID]struct{}, fn func(ChunkID, int64) error) error {
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 	objectCh := s.client.ListObjectsV2(s.bucket, s.prefix, true, doneCh)
@@ -182,7 +245,7 @@ func (s S3Store) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
 
 		// Drop the chunk if it's not on the list
 		if _, ok := ids[id]; !ok {
-			if err = s.RemoveChunk(id); err != nil {
+			if err = fn(id, object.Size); err != nil {
 				return err
 			}
 		}
@@ -190,38 +253,63 @@ func (s S3Store) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
 	return nil
 }
 
-func (s S3Store) nameFromID(id ChunkID) string {
-	sID := id.String()
-	name := s.prefix + sID[0:4] + "/" + sID
-	if s.opt.Uncompressed {
-		name += UncompressedChunkExt
-	} else {
-		name += CompressedChunkExt
+// ListChunks calls fn for every chunk in the store. Objects that are not chunks
+// are skipped.
+func (s S3Store) ListChunks(ctx context.Context, fn func(ChunkID) error) error {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	objectCh := s.client.ListObjectsV2(s.bucket, s.prefix, true, doneCh)
+	for object := range objectCh {
+		if object.Err != nil {
+			return object.Err
+		}
+		// See if we're meant to stop
+		select {
+		case <-ctx.Done():
+			return Interrupted{}
+		default:
+		}
+		id, err := s.idFromName(object.Key)
+		if err != nil {
+			continue
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
 	}
-	return name
+	return nil
+}
+
+func (s S3Store) nameFromID(id ChunkID) string {
+	return s.prefix + s.layout.Name(id)
 }
 
 func (s S3Store) idFromName(name string) (ChunkID, error) {
-	var n string
-	if s.opt.Uncompressed {
-		if !strings.HasSuffix(name, UncompressedChunkExt) {
-			return ChunkID{}, fmt.Errorf("object %s is not a chunk", name)
+	if !strings.HasPrefix(name, s.prefix) {
+		return ChunkID{}, fmt.Errorf("object %s is not a chunk", name)
+	}
+	return s.layout.ID(strings.TrimPrefix(name, s.prefix))
+}
+
+// Attaches an error class to errors returned by the S3 client, based on the
+// error code or HTTP status of the response.
+func (s S3StoreBase) classifyError(err error) error {
+	var resp minio.ErrorResponse
+	if errors.As(err, &resp) {
+		switch resp.Code {
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken":
+			return StoreError{Kind: ErrUnauthorized, Store: s.String(), Err: err}
+		case "SlowDown", "Throttling", "RequestLimitExceeded":
+			return StoreError{Kind: ErrThrottled, Store: s.String(), Err: err}
 		}
-		n = strings.TrimSuffix(strings.TrimPrefix(name, s.prefix), UncompressedChunkExt)
-	} else {
-		if !strings.HasSuffix(name, CompressedChunkExt) {
-			return ChunkID{}, fmt.Errorf("object %s is not a chunk", name)
+		if sErr := errorFromHTTPStatus(s.String(), resp.StatusCode, err); sErr != nil {
+			return sErr
 		}
-		n = strings.TrimSuffix(strings.TrimPrefix(name, s.prefix), CompressedChunkExt)
-	}
-	fragments := strings.Split(n, "/")
-	if len(fragments) != 2 {
-		return ChunkID{}, fmt.Errorf("incorrect chunk name for object %s", name)
+		return errors.Wrap(err, s.String())
 	}
-	idx := fragments[0]
-	sid := fragments[1]
-	if !strings.HasPrefix(sid, idx) {
-		return ChunkID{}, fmt.Errorf("incorrect chunk name for object %s", name)
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return StoreError{Kind: ErrTemporaryNetwork, Store: s.String(), Err: err}
 	}
-	return ChunkIDFromString(sid)
+	return errors.Wrap(err, s.String())
 }
@@ -7,15 +7,18 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	minio "github.com/minio/minio-go/v6"
 	"github.com/minio/minio-go/v6/pkg/credentials"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -256,3 +259,41 @@ func TestS3StoreGetChunk(t *testing.T) {
 		}
 	})
 }
+
+func TestS3StoreRemoveChunkToTrash(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Amz-Copy-Source")))
+		mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			w.Write([]byte(`<CopyObjectResult><LastModified>2020-01-01T00:00:00.000Z</LastModified><ETag>"abc"</ETag></CopyObjectResult>`))
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	endpoint := url.URL{Scheme: "s3+http", Host: u.Host, Path: "/bucket/store/"}
+	provider := MockCredProvider{}
+	store, err := NewS3Store(&endpoint, credentials.New(&provider), "us-east-1", StoreOptions{TrashPrefix: "trash/"}, minio.BucketLookupPath)
+	require.NoError(t, err)
+
+	id, err := ChunkIDFromString("dda036db05bc2b99b6b9303d28496000c34b246457ae4bbf00fe625b5cabd7cd")
+	require.NoError(t, err)
+	require.NoError(t, store.RemoveChunk(id))
+
+	// The chunk is copied into the trash before it's deleted
+	name := "store/dda0/dda036db05bc2b99b6b9303d28496000c34b246457ae4bbf00fe625b5cabd7cd.cacnk"
+	require.Equal(t, []string{
+		"PUT /bucket/trash/" + name + " bucket/" + name,
+		"DELETE /bucket/" + name,
+	}, requests)
+}
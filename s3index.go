@@ -15,6 +15,8 @@ import (
 // S3IndexStore is a read-write index store with S3 backing
 type S3IndexStore struct {
 	S3StoreBase
+
+	indexConverters Converters
 }
 
 // NewS3IndexStore creates an index store with S3 backing. The URL
@@ -22,11 +24,15 @@ type S3IndexStore struct {
 // Credentials are passed in via the environment variables S3_ACCESS_KEY
 // and S3S3_SECRET_KEY, or via the desync config file.
 func NewS3IndexStore(location *url.URL, s3Creds *credentials.Credentials, region string, opt StoreOptions, lookupType minio.BucketLookupType) (s S3IndexStore, e error) {
+	converters, err := opt.indexConverters()
+	if err != nil {
+		return s, err
+	}
 	b, err := NewS3StoreBase(location, s3Creds, region, opt, lookupType)
 	if err != nil {
 		return s, err
 	}
-	return S3IndexStore{b}, nil
+	return S3IndexStore{b, converters}, nil
 }
 
 // GetIndexReader returns a reader for an index from an S3 store. Fails if the specified index
@@ -36,7 +42,7 @@ func (s S3IndexStore) GetIndexReader(name string) (r io.ReadCloser, e error) {
 	if err != nil {
 		return r, errors.Wrap(err, s.String())
 	}
-	return obj, nil
+	return indexReaderFromStorage(obj, s.indexConverters)
 }
 
 // GetIndex returns an Index structure from the store
@@ -46,7 +52,20 @@ func (s S3IndexStore) GetIndex(name string) (i Index, e error) {
 		return i, err
 	}
 	defer obj.Close()
-	return IndexFromReader(obj)
+	return IndexFromReaderWithDigest(obj, s.indexDigest())
+}
+
+func (s S3IndexStore) indexDigest() HashAlgorithm {
+	return s.opt.indexDigest()
+}
+
+// IndexETag returns the ETag of an index in the S3 store.
+func (s S3IndexStore) IndexETag(name string) (string, error) {
+	info, err := s.client.StatObject(s.bucket, s.prefix+name, minio.StatObjectOptions{})
+	if err != nil {
+		return "", errors.Wrap(err, s.String())
+	}
+	return info.ETag, nil
 }
 
 // StoreIndex writes the index file to the S3 store
@@ -55,8 +74,7 @@ func (s S3IndexStore) StoreIndex(name string, idx Index) error {
 	r, w := io.Pipe()
 
 	go func() {
-		defer w.Close()
-		idx.WriteTo(w)
+		w.CloseWithError(writeIndexToStorage(w, idx, s.indexConverters))
 	}()
 
 	_, err := s.client.PutObject(s.bucket, s.prefix+name, r, -1, minio.PutObjectOptions{ContentType: contentType})
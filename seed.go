@@ -8,12 +8,36 @@ import (
 // DefaultBlockSize is used when the actual filesystem block size cannot be determined automatically
 const DefaultBlockSize = 4096
 
+// IsValidBlockSize returns true if bs can be used as block size, a power of 2
+// and at least 512.
+func IsValidBlockSize(bs uint64) bool {
+	return bs >= 512 && bs&(bs-1) == 0
+}
+
 // Seed represent a source of chunks other than the store. Typically a seed is
 // another index+blob that present on disk already and is used to copy or clone
 // existing chunks or blocks into the target from.
+//
+// Applications can implement their own seeds, for example one reading from a
+// read-only squashfs image or from a remote blob with HTTP range requests, and
+// pass them to AssembleFile. NewReaderAtSeed covers the common case of a blob
+// that can be read with an io.ReaderAt. Seeds are used by several goroutines
+// concurrently.
 type Seed interface {
+	// LongestMatchWith returns the number of chunks at the start of chunks that
+	// can be taken from the seed, and the segment of the seed holding them. It
+	// returns 0 and a nil segment if there's no match, or if the seed is
+	// invalid.
 	LongestMatchWith(chunks []IndexChunk) (int, SeedSegment)
+
+	// RegenerateIndex is called for invalid seeds when the InvalidSeedAction
+	// is InvalidSeedActionRegenerate. It should re-chunk the seed data so that
+	// its index matches the data again, and mark the seed as valid. Seeds that
+	// can't do that return an error.
 	RegenerateIndex(ctx context.Context, n int, attempt int, seedNumber int) error
+
+	// SetInvalid marks the seed as invalid, after a segment failed validation.
+	// Invalid seeds don't return any matches.
 	SetInvalid(value bool)
 	IsInvalid() bool
 }
@@ -22,12 +46,45 @@ type Seed interface {
 // assembled from an Index. It's used to copy or reflink data from seeds into
 // a target file during an extract operation.
 type SeedSegment interface {
+	// FileName is the name of the local file holding the seed data. Segments
+	// of a file are validated with Validate before the file is assembled.
+	// Segments that aren't backed by a local file return an empty name and are
+	// not validated up front. Every chunk written from a seed is verified
+	// after writing, regardless of the name. Chunks of segments without a
+	// name that fail to write or verify are taken from the store instead.
 	FileName() string
+
+	// Size of the segment in bytes.
 	Size() uint64
+
+	// Validate checks that the data of the segment in file, which is opened
+	// from FileName, matches the chunks of the segment.
 	Validate(file *os.File) error
+
+	// WriteInto writes the segment to dst, starting at offset. The length is
+	// expected to match Size. If isBlank is true, the target was empty before
+	// the file was assembled.
 	WriteInto(dst *os.File, offset, end, blocksize uint64, isBlank bool) (copied uint64, cloned uint64, err error)
 }
 
+// SeedSegmentWithFallback is implemented by seed segments that copy blocks
+// when cloning them fails. The bytes copied that way are reported in fallback
+// as well as in copied.
+type SeedSegmentWithFallback interface {
+	SeedSegment
+	WriteIntoWithFallback(dst *os.File, offset, end, blocksize uint64, isBlank bool) (copied, cloned, fallback uint64, err error)
+}
+
+// Writes a seed segment into dst, reporting the bytes that were copied after
+// cloning failed if the segment supports it.
+func writeSeedSegment(s SeedSegment, dst *os.File, offset, length, blocksize uint64, isBlank bool) (copied, cloned, fallback uint64, err error) {
+	if f, ok := s.(SeedSegmentWithFallback); ok {
+		return f.WriteIntoWithFallback(dst, offset, length, blocksize, isBlank)
+	}
+	copied, cloned, err = s.WriteInto(dst, offset, length, blocksize, isBlank)
+	return copied, cloned, 0, err
+}
+
 // IndexSegment represents a contiguous section of an index which is used when
 // assembling a file from seeds. first/last are positions in the index.
 type IndexSegment struct {
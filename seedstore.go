@@ -0,0 +1,95 @@
+package desync
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+var _ Store = &SeedStore{}
+
+// SeedStore serves chunks from local seed files before falling back to an
+// upstream store. The index of each seed is used to locate chunks in it. Unlike
+// the seeds used when assembling a file, this supports random access, as needed
+// by cat or mount-index. Data read from a seed is verified against the chunk ID
+// and taken from the upstream store if it doesn't match, for example when a seed
+// file was modified.
+type SeedStore struct {
+	s     Store
+	files []*os.File
+	pos   map[ChunkID]seedChunk
+
+	fromSeeds uint64
+}
+
+// Location of a chunk in one of the seed files.
+type seedChunk struct {
+	f           *os.File
+	start, size uint64
+	digest      HashAlgorithm
+}
+
+// NewSeedStore returns a store that reads chunks from seed files before asking
+// the upstream store s for them. Seeds are added with AddSeed.
+func NewSeedStore(s Store) *SeedStore {
+	return &SeedStore{s: s, pos: make(map[ChunkID]seedChunk)}
+}
+
+// AddSeed adds a seed file and its index. If a chunk is present in several
+// seeds, the first one it was found in is used.
+func (s *SeedStore) AddSeed(name string, idx Index) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, f)
+	for _, c := range idx.Chunks {
+		if _, ok := s.pos[c.ID]; ok {
+			continue
+		}
+		s.pos[c.ID] = seedChunk{f: f, start: c.Start, size: c.Size, digest: idx.digest()}
+	}
+	return nil
+}
+
+// GetChunk reads a chunk from a seed if possible, or from the upstream store
+// otherwise.
+func (s *SeedStore) GetChunk(id ChunkID) (*Chunk, error) {
+	if p, ok := s.pos[id]; ok {
+		b := make([]byte, p.size)
+		_, err := p.f.ReadAt(b, int64(p.start))
+		if err == nil {
+			var chunk *Chunk
+			if chunk, err = newChunkWithID(id, b, false, p.digest); err == nil {
+				atomic.AddUint64(&s.fromSeeds, 1)
+				return chunk, nil
+			}
+		}
+		Log.WithError(err).WithField("seed", p.f.Name()).Debug("unable to read chunk from seed")
+	}
+	return s.s.GetChunk(id)
+}
+
+// HasChunk returns true if the chunk is in a seed or the upstream store.
+func (s *SeedStore) HasChunk(id ChunkID) (bool, error) {
+	if _, ok := s.pos[id]; ok {
+		return true, nil
+	}
+	return s.s.HasChunk(id)
+}
+
+// ChunksFromSeeds returns the number of chunks that were read from seeds.
+func (s *SeedStore) ChunksFromSeeds() uint64 {
+	return atomic.LoadUint64(&s.fromSeeds)
+}
+
+func (s *SeedStore) String() string {
+	return s.s.String()
+}
+
+// Close the seed files and the upstream store.
+func (s *SeedStore) Close() error {
+	for _, f := range s.files {
+		f.Close()
+	}
+	return s.s.Close()
+}
@@ -0,0 +1,40 @@
+package desync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeedStore(t *testing.T) {
+	f, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := IndexFromReader(f)
+	require.NoError(t, err)
+
+	// Use a copy of the blob as seed, with a damaged first chunk
+	b, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	seed := filepath.Join(t.TempDir(), "seed")
+	require.NoError(t, ioutil.WriteFile(seed, b, 0644))
+
+	upstream, err := NewLocalStore("testdata/blob1.store", NewStoreOptionsWithDefaults())
+	require.NoError(t, err)
+	s := NewSeedStore(upstream)
+	require.NoError(t, s.AddSeed(seed, idx))
+	defer s.Close()
+
+	// All chunks should be valid, the damaged one is read from the store
+	for _, c := range idx.Chunks {
+		chunk, err := s.GetChunk(c.ID)
+		require.NoError(t, err)
+		require.Equal(t, c.ID, chunk.ID())
+	}
+	require.NotZero(t, s.ChunksFromSeeds())
+	require.Less(t, s.ChunksFromSeeds(), uint64(len(idx.Chunks)))
+}
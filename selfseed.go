@@ -17,6 +17,7 @@ type selfSeed struct {
 	written    int
 	mu         sync.RWMutex
 	cache      map[int]int
+	skipped    map[int]struct{}
 }
 
 // newSelfSeed initializes a new seed based on the file being extracted
@@ -27,6 +28,7 @@ func newSelfSeed(file string, index Index) (*selfSeed, error) {
 		index:      index,
 		canReflink: CanClone(file, file),
 		cache:      make(map[int]int),
+		skipped:    make(map[int]struct{}),
 	}
 	return &s, nil
 }
@@ -38,7 +40,20 @@ func newSelfSeed(file string, index Index) (*selfSeed, error) {
 func (s *selfSeed) add(segment IndexSegment) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.record(segment)
+}
+
+// skip records a segment that couldn't be written to the file, like when a
+// chunk failed. Its chunks can't be used as seed, but later segments can once
+// all earlier ones have been added or skipped.
+func (s *selfSeed) skip(segment IndexSegment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped[segment.first] = struct{}{}
+	s.record(segment)
+}
 
+func (s *selfSeed) record(segment IndexSegment) {
 	// Make a record of this segment in the cache since those could come in
 	// out-of-order
 	s.cache[segment.first] = segment.last + 1
@@ -56,10 +71,15 @@ func (s *selfSeed) add(segment IndexSegment) {
 		if !ok {
 			break
 		}
-		// Record all chunks in this segment as written by adding them to the position map
-		for i := s.written; i < next; i++ {
-			chunk := s.index.Chunks[i]
-			s.pos[chunk.ID] = append(s.pos[chunk.ID], i)
+		// Record all chunks in this segment as written by adding them to the
+		// position map, unless the segment was skipped
+		if _, ok := s.skipped[s.written]; ok {
+			delete(s.skipped, s.written)
+		} else {
+			for i := s.written; i < next; i++ {
+				chunk := s.index.Chunks[i]
+				s.pos[chunk.ID] = append(s.pos[chunk.ID], i)
+			}
 		}
 		delete(s.cache, s.written)
 		s.written = next
@@ -76,7 +96,7 @@ func (s *selfSeed) getChunk(id ChunkID) SeedSegment {
 		return nil
 	}
 	first := pos[0]
-	return newFileSeedSegment(s.file, s.index.Chunks[first:first+1], s.canReflink)
+	return newFileSeedSegment(s.file, s.index.Chunks[first:first+1], s.canReflink, s.index.digest())
 }
 
 func (s *selfSeed) RegenerateIndex(ctx context.Context, n int, attempt int, seedNumber int) error {
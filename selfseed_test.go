@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -111,7 +112,7 @@ func TestSelfSeed(t *testing.T) {
 
 			// Extract the file
 			stats, err := AssembleFile(context.Background(), dst.Name(), idx, s, nil,
-				AssembleOptions{1, InvalidSeedActionBailOut},
+				AssembleOptions{N: 1, InvalidSeedAction: InvalidSeedActionBailOut},
 			)
 			if err != nil {
 				t.Fatal(err)
@@ -139,3 +140,59 @@ func TestSelfSeed(t *testing.T) {
 	}
 
 }
+
+func TestSelfSeedAfterFailedChunk(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks 0 and 2 are in the store, chunk 1 is missing
+	size := 1024
+	var ids []ChunkID
+	for i := 0; i < 3; i++ {
+		b := make([]byte, size)
+		rand.Read(b)
+		chunk := NewChunk(b)
+		if i != 1 {
+			if err := store.StoreChunk(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, chunk.ID())
+	}
+	var idx Index
+	for i, p := range []int{0, 1, 2, 2, 2} {
+		idx.Chunks = append(idx.Chunks, IndexChunk{ID: ids[p], Start: uint64(i * size), Size: uint64(size)})
+	}
+
+	// The self-seed moves past skipped segments without offering their chunks
+	ss, err := newSelfSeed("", idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.add(IndexSegment{index: idx, first: 2, last: 2})
+	ss.skip(IndexSegment{index: idx, first: 1, last: 1})
+	ss.add(IndexSegment{index: idx, first: 0, last: 0})
+	if ss.written != 3 || len(ss.cache) != 0 || len(ss.skipped) != 0 {
+		t.Fatalf("self-seed didn't advance past the skipped segment, written %d, cached %d", ss.written, len(ss.cache))
+	}
+	if ss.getChunk(ids[1]) != nil {
+		t.Fatal("skipped chunk offered by the self-seed")
+	}
+	if ss.getChunk(ids[2]) == nil {
+		t.Fatal("chunk after the skipped segment not offered by the self-seed")
+	}
+
+	// Chunks after the failed one are still taken from the self-seed
+	dst := filepath.Join(t.TempDir(), "dst")
+	stats, err := AssembleFile(context.Background(), dst, idx, store, nil,
+		AssembleOptions{N: 1, ContinueOnChunkError: true},
+	)
+	if _, ok := err.(ChunksFailed); !ok {
+		t.Fatalf("expected failed chunks, got %v", err)
+	}
+	if fromSeed := stats.BytesCopied + stats.BytesCloned; fromSeed == 0 {
+		t.Fatal("expected chunks after the failed one to be copied/cloned from self-seed")
+	}
+}
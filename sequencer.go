@@ -121,7 +121,7 @@ func (p Plan) Validate(ctx context.Context, n int, pb ProgressBar) (err error) {
 		}
 		length += s.indexSegment.lengthChunks()
 	}
-	pb.SetTotal(length)
+	pb.SetTotal(int64(length))
 	pb.Start()
 	defer pb.Finish()
 	// Share a single file descriptor per seed for all the goroutines
@@ -152,7 +152,7 @@ func (p Plan) Validate(ctx context.Context, n int, pb ProgressBar) (err error) {
 					job.candidate.seed.SetInvalid(true)
 					return err
 				}
-				pb.Add(job.candidate.indexSegment.lengthChunks())
+				pb.Add(int64(job.candidate.indexSegment.lengthChunks()))
 			}
 			return nil
 		})
@@ -9,7 +9,6 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -20,6 +19,10 @@ import (
 )
 
 var _ WriteStore = &SFTPStore{}
+var _ PruneProgressStore = &SFTPStore{}
+var _ PruneDryRunStore = &SFTPStore{}
+var _ ChunkLister = &SFTPStore{}
+var _ BatchWriteStore = &SFTPStore{}
 
 // SFTPStoreBase is the base object for SFTP chunk and index stores.
 type SFTPStoreBase struct {
@@ -28,6 +31,7 @@ type SFTPStoreBase struct {
 	client   *sftp.Client
 	cancel   context.CancelFunc
 	opt      StoreOptions
+	layout   ChunkLayout
 }
 
 // SFTPStore is a chunk store that uses SFTP over SSH.
@@ -36,10 +40,22 @@ type SFTPStore struct {
 	location   *url.URL
 	n          int
 	converters Converters
+	opt        StoreOptions
+	limits     bandwidthLimits
+
+	// Limits the number of concurrent uploads of StoreChunks
+	batch chan struct{}
 }
 
 // Creates a base sftp client
 func newSFTPStoreBase(location *url.URL, opt StoreOptions) (*SFTPStoreBase, error) {
+	layout, err := opt.chunkLayout()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := DigestByName(opt.Digest); err != nil {
+		return nil, err
+	}
 	sshCmd := os.Getenv("CASYNC_SSH_PATH")
 	if sshCmd == "" {
 		sshCmd = "ssh"
@@ -82,7 +98,7 @@ func newSFTPStoreBase(location *url.URL, opt StoreOptions) (*SFTPStoreBase, erro
 		cancel()
 		return nil, errors.Wrapf(err, "failed to stat '%s'", path)
 	}
-	return &SFTPStoreBase{location, path, client, cancel, opt}, nil
+	return &SFTPStoreBase{location, path, client, cancel, opt, layout}, nil
 }
 
 // StoreObject adds a new object to a writable index or chunk store.
@@ -131,19 +147,12 @@ func (s *SFTPStoreBase) String() string {
 
 // Returns the path for a chunk
 func (s *SFTPStoreBase) nameFromID(id ChunkID) string {
-	sID := id.String()
-	name := s.path + sID[0:4] + "/" + sID
-	if s.opt.Uncompressed {
-		name += UncompressedChunkExt
-	} else {
-		name += CompressedChunkExt
-	}
-	return name
+	return s.path + s.layout.Name(id)
 }
 
 // NewSFTPStore initializes a chunk store using SFTP over SSH.
 func NewSFTPStore(location *url.URL, opt StoreOptions) (*SFTPStore, error) {
-	s := &SFTPStore{make(chan *SFTPStoreBase, opt.N), location, opt.N, opt.converters()}
+	s := &SFTPStore{pool: make(chan *SFTPStoreBase, opt.N), location: location, n: opt.N, converters: opt.converters(), opt: opt, batch: newBatchLimit(opt.N)}
 	for i := 0; i < opt.N; i++ {
 		c, err := newSFTPStoreBase(location, opt)
 		if err != nil {
@@ -167,11 +176,11 @@ func (s *SFTPStore) GetChunk(id ChunkID) (*Chunk, error) {
 		return nil, err
 	}
 	defer f.Close()
-	b, err := ioutil.ReadAll(f)
+	b, err := ioutil.ReadAll(s.limits.downloadReader(f))
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to read from %s", name)
 	}
-	return NewChunkFromStorage(id, b, s.converters, c.opt.SkipVerify)
+	return newChunkFromStorage(id, b, s.converters, c.opt.SkipVerify, c.opt.digest())
 }
 
 // RemoveChunk deletes a chunk, typically an invalid one, from the filesystem.
@@ -200,7 +209,17 @@ func (s *SFTPStore) StoreChunk(chunk *Chunk) error {
 		return err
 	}
 
-	return c.StoreObject(name, bytes.NewReader(b))
+	return c.StoreObject(name, s.limits.uploadReader(bytes.NewReader(b)))
+}
+
+func (s *SFTPStore) limitBandwidth(download, upload *BandwidthLimiter) {
+	s.limits.add(download, upload)
+}
+
+// StoreChunks adds multiple chunks to the store, using up to as many
+// goroutines as there are connections in the pool across all calls.
+func (s *SFTPStore) StoreChunks(chunks []*Chunk) error {
+	return storeChunksConcurrently(chunks, s.batch, s.StoreChunk)
 }
 
 // HasChunk returns true if the chunk is in the store
@@ -215,6 +234,31 @@ func (s *SFTPStore) HasChunk(id ChunkID) (bool, error) {
 // Prune removes any chunks from the store that are not contained in a list
 // of chunks
 func (s *SFTPStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
+	return s.PruneWithProgress(ctx, ids, NullProgressBar{})
+}
+
+// PruneWithProgress works like Prune and reports the removed chunks to pb.
+func (s *SFTPStore) PruneWithProgress(ctx context.Context, ids map[ChunkID]struct{}, pb ProgressBar) error {
+	// Collect the chunks first, removing them needs the clients from the pool
+	candidates, err := s.PruneDryRun(ctx, ids)
+	if err != nil {
+		return err
+	}
+	list := func(ctx context.Context, fn func(ChunkID, int64) error) error {
+		for _, c := range candidates {
+			if err := fn(c.ID, c.Size); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return pruneConcurrently(ctx, s.opt, pb, list, s.RemoveChunk)
+}
+
+// PruneDryRun returns the chunks that Prune would remove from the store, without
+// removing anything.
+func (s *SFTPStore) PruneDryRun(ctx context.Context, ids map[ChunkID]struct{}) ([]PruneCandidate, error) {
+	var candidates []PruneCandidate
 	c := <-s.pool
 	defer func() { s.pool <- c }()
 	walker := c.client.Walk(c.path)
@@ -223,45 +267,60 @@ func (s *SFTPStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
 		// See if we're meant to stop
 		select {
 		case <-ctx.Done():
-			return Interrupted{}
+			return nil, Interrupted{}
 		default:
 		}
 		if err := walker.Err(); err != nil {
-			return err
+			return nil, err
 		}
 		info := walker.Stat()
 		if info.IsDir() { // Skip dirs
 			continue
 		}
-		path := walker.Path()
-		if !strings.HasSuffix(path, CompressedChunkExt) { // Skip files without chunk extension
+		// Convert the name into a checksum, if that fails we're probably not looking
+		// at a chunk file and should skip it. This also skips compressed chunks if
+		// this is running in uncompressed mode and vice-versa.
+		id, err := c.layout.ID(strings.TrimPrefix(walker.Path(), c.path))
+		if err != nil {
 			continue
 		}
-		// Skip compressed chunks if this is running in uncompressed mode and vice-versa
-		var sID string
-		if c.opt.Uncompressed {
-			if !strings.HasSuffix(path, UncompressedChunkExt) {
-				return nil
-			}
-			sID = strings.TrimSuffix(filepath.Base(path), UncompressedChunkExt)
-		} else {
-			if !strings.HasSuffix(path, CompressedChunkExt) {
-				return nil
-			}
-			sID = strings.TrimSuffix(filepath.Base(path), CompressedChunkExt)
+		// See if the chunk we're looking at is in the list we want to keep
+		if _, ok := ids[id]; !ok {
+			candidates = append(candidates, PruneCandidate{ID: id, Size: info.Size()})
+		}
+	}
+	return candidates, nil
+}
+
+// ListChunks walks the store and calls fn for every chunk found.
+func (s *SFTPStore) ListChunks(ctx context.Context, fn func(ChunkID) error) error {
+	c := <-s.pool
+	defer func() { s.pool <- c }()
+	walker := c.client.Walk(c.path)
+
+	for walker.Step() {
+		// See if we're meant to stop
+		select {
+		case <-ctx.Done():
+			return Interrupted{}
+		default:
+		}
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		info := walker.Stat()
+		if info.IsDir() { // Skip dirs
+			continue
 		}
 		// Convert the name into a checksum, if that fails we're probably not looking
-		// at a chunk file and should skip it.
-		id, err := ChunkIDFromString(sID)
+		// at a chunk file and should skip it. This also skips compressed chunks if
+		// this is running in uncompressed mode and vice-versa.
+		id, err := c.layout.ID(strings.TrimPrefix(walker.Path(), c.path))
 		if err != nil {
 			continue
 		}
-		// See if the chunk we're looking at is in the list we want to keep, if not
-		// remove it.
-		if _, ok := ids[id]; !ok {
-			if err = s.RemoveChunk(id); err != nil {
-				return err
-			}
+		if err := fn(id); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -1,6 +1,7 @@
 package desync
 
 import (
+	"fmt"
 	"net/url"
 	"os"
 	"path"
@@ -10,18 +11,26 @@ import (
 	"github.com/pkg/errors"
 )
 
+var _ IndexETagger = &SFTPIndexStore{}
+
 // SFTPIndexStore is an index store backed by SFTP over SSH
 type SFTPIndexStore struct {
 	*SFTPStoreBase
+
+	indexConverters Converters
 }
 
 // NewSFTPIndexStore initializes and index store backed by SFTP over SSH.
 func NewSFTPIndexStore(location *url.URL, opt StoreOptions) (*SFTPIndexStore, error) {
+	converters, err := opt.indexConverters()
+	if err != nil {
+		return nil, err
+	}
 	b, err := newSFTPStoreBase(location, opt)
 	if err != nil {
 		return nil, err
 	}
-	return &SFTPIndexStore{b}, nil
+	return &SFTPIndexStore{b, converters}, nil
 }
 
 // GetIndexReader returns a reader of an index from an SFTP store. Fails if the specified
@@ -30,11 +39,11 @@ func (s *SFTPIndexStore) GetIndexReader(name string) (r io.ReadCloser, e error)
 	f, err := s.client.Open(s.pathFromName(name))
 	if err != nil {
 		if os.IsNotExist(err) {
-			err = errors.Errorf("Index file does not exist: %v", err)
+			err = errors.Wrap(err, "Index file does not exist")
 		}
 		return r, err
 	}
-	return f, nil
+	return indexReaderFromStorage(f, s.indexConverters)
 }
 
 // GetIndex reads an index from an SFTP store, returns an error if the specified index file does not exist.
@@ -44,7 +53,11 @@ func (s *SFTPIndexStore) GetIndex(name string) (i Index, e error) {
 		return i, err
 	}
 	defer f.Close()
-	return IndexFromReader(f)
+	return IndexFromReaderWithDigest(f, s.indexDigest())
+}
+
+func (s *SFTPIndexStore) indexDigest() HashAlgorithm {
+	return s.opt.indexDigest()
 }
 
 // StoreIndex adds a new index to the store
@@ -52,12 +65,27 @@ func (s *SFTPIndexStore) StoreIndex(name string, idx Index) error {
 	r, w := io.Pipe()
 
 	go func() {
-		defer w.Close()
-		idx.WriteTo(w)
+		w.CloseWithError(writeIndexToStorage(w, idx, s.indexConverters))
 	}()
 	return s.StoreObject(s.pathFromName(name), r)
 }
 
+// IndexETag returns a version identifier of an index based on its size and
+// modification time, so clients caching indexes only download it again once
+// it changed. The resolution of the modification time is one second, an index
+// that is replaced within the same second by one of the same size isn't seen
+// as changed.
+func (s *SFTPIndexStore) IndexETag(name string) (string, error) {
+	info, err := s.client.Stat(s.pathFromName(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errors.Wrap(err, "Index file does not exist")
+		}
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano()), nil
+}
+
 func (s *SFTPIndexStore) pathFromName(name string) string {
 	return path.Join(s.path, name)
 }
@@ -0,0 +1,71 @@
+package desync
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns an SFTP index store in dir, talking to an SFTP server running in the
+// same process.
+func newTestSFTPIndexStore(t *testing.T, dir string) *SFTPIndexStore {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	require.NoError(t, err)
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		// Stop the server first, the client waits for its connection to end
+		sw.Close()
+		sr.Close()
+		client.Close()
+	})
+	return &SFTPIndexStore{SFTPStoreBase: &SFTPStoreBase{path: dir + "/", client: client}}
+}
+
+func TestSFTPIndexETag(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSFTPIndexStore(t, dir)
+	name := filepath.Join(dir, "test.caibx")
+
+	// Missing indexes fail
+	_, err := s.IndexETag("test.caibx")
+	require.Error(t, err)
+
+	// The ETag is stable as long as the index isn't changed
+	require.NoError(t, ioutil.WriteFile(name, []byte("index"), 0644))
+	etag1, err := s.IndexETag("test.caibx")
+	require.NoError(t, err)
+	require.NotEmpty(t, etag1)
+	etag2, err := s.IndexETag("test.caibx")
+	require.NoError(t, err)
+	require.Equal(t, etag1, etag2)
+
+	// Replacing the index with one of the same size changes the ETag if the
+	// modification time differs
+	require.NoError(t, ioutil.WriteFile(name, []byte("INDEX"), 0644))
+	mtime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(name, mtime, mtime))
+	etag3, err := s.IndexETag("test.caibx")
+	require.NoError(t, err)
+	require.NotEqual(t, etag1, etag3)
+
+	// So does a change in size
+	require.NoError(t, ioutil.WriteFile(name, []byte("larger index"), 0644))
+	require.NoError(t, os.Chtimes(name, mtime, mtime))
+	etag4, err := s.IndexETag("test.caibx")
+	require.NoError(t, err)
+	require.NotEqual(t, etag3, etag4)
+}
@@ -0,0 +1,182 @@
+package desync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var _ WriteStore = &ShardedStore{}
+var _ PruneProgressStore = &ShardedStore{}
+var _ PruneDryRunStore = &ShardedStore{}
+
+// StoreShard is a store holding the chunks with IDs that start with a hex
+// prefix in the range From to To, inclusive.
+type StoreShard struct {
+	From, To string
+	Store    Store
+}
+
+type shard struct {
+	from, to uint64
+	store    Store
+}
+
+// ShardedStore distributes chunks across several stores based on the prefix of
+// their IDs, so a very large store can be split over several servers. Every
+// chunk is read from and written to exactly one shard. Implements WriteStore if
+// the shards support writing.
+type ShardedStore struct {
+	shards []shard
+	digits int
+}
+
+// NewShardedStore returns a store combining the given shards. All ranges need
+// to use prefixes of the same length, and together cover all possible prefixes
+// without overlapping, like 00-7f and 80-ff.
+func NewShardedStore(shards ...StoreShard) (*ShardedStore, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards defined")
+	}
+	s := &ShardedStore{digits: len(shards[0].From)}
+	if s.digits == 0 || s.digits > 8 {
+		return nil, fmt.Errorf("invalid shard prefix length %d", s.digits)
+	}
+	for _, sh := range shards {
+		if len(sh.From) != s.digits || len(sh.To) != s.digits {
+			return nil, fmt.Errorf("shard %s-%s: all prefixes need to have the same length", sh.From, sh.To)
+		}
+		from, err := strconv.ParseUint(sh.From, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("shard %s-%s: invalid prefix %q", sh.From, sh.To, sh.From)
+		}
+		to, err := strconv.ParseUint(sh.To, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("shard %s-%s: invalid prefix %q", sh.From, sh.To, sh.To)
+		}
+		if from > to {
+			return nil, fmt.Errorf("shard %s-%s: invalid range", sh.From, sh.To)
+		}
+		s.shards = append(s.shards, shard{from: from, to: to, store: sh.Store})
+	}
+
+	// Make sure every possible ID ends up in exactly one shard
+	sort.Slice(s.shards, func(i, j int) bool { return s.shards[i].from < s.shards[j].from })
+	var next uint64
+	for _, sh := range s.shards {
+		if sh.from != next {
+			return nil, fmt.Errorf("shards don't cover prefix %0*x or overlap there", s.digits, next)
+		}
+		next = sh.to + 1
+	}
+	if next != 1<<(4*uint(s.digits)) {
+		return nil, fmt.Errorf("shards don't cover prefix %0*x", s.digits, next)
+	}
+	return s, nil
+}
+
+// Returns the store holding a chunk.
+func (s *ShardedStore) shardFor(id ChunkID) Store {
+	p, _ := strconv.ParseUint(id.String()[:s.digits], 16, 64)
+	i := sort.Search(len(s.shards), func(i int) bool { return s.shards[i].to >= p })
+	return s.shards[i].store
+}
+
+// GetChunk reads a chunk from the shard holding it.
+func (s *ShardedStore) GetChunk(id ChunkID) (*Chunk, error) {
+	return s.shardFor(id).GetChunk(id)
+}
+
+// HasChunk returns true if the shard for the ID holds the chunk.
+func (s *ShardedStore) HasChunk(id ChunkID) (bool, error) {
+	return s.shardFor(id).HasChunk(id)
+}
+
+// StoreChunk writes a chunk into the shard it belongs to.
+func (s *ShardedStore) StoreChunk(c *Chunk) error {
+	store := s.shardFor(c.ID())
+	ws, ok := store.(WriteStore)
+	if !ok {
+		return fmt.Errorf("shard %s does not support writing", store)
+	}
+	return ws.StoreChunk(c)
+}
+
+// ListChunks lists the chunks of all shards, one after the other. Fails if a
+// shard doesn't support listing.
+func (s *ShardedStore) ListChunks(ctx context.Context, fn func(ChunkID) error) error {
+	for _, sh := range s.shards {
+		l, ok := sh.store.(ChunkLister)
+		if !ok {
+			return fmt.Errorf("shard %s does not support listing chunks", sh.store)
+		}
+		if err := l.ListChunks(ctx, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune removes all chunks not in ids from every shard. Fails if a shard
+// doesn't support pruning.
+func (s *ShardedStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
+	return s.PruneWithProgress(ctx, ids, NullProgressBar{})
+}
+
+// PruneWithProgress works like Prune and reports the chunks removed from
+// shards that support it to pb.
+func (s *ShardedStore) PruneWithProgress(ctx context.Context, ids map[ChunkID]struct{}, pb ProgressBar) error {
+	for _, sh := range s.shards {
+		var err error
+		switch ps := sh.store.(type) {
+		case PruneProgressStore:
+			err = ps.PruneWithProgress(ctx, ids, pb)
+		case PruneStore:
+			err = ps.Prune(ctx, ids)
+		default:
+			return fmt.Errorf("shard %s does not support pruning", sh.store)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneDryRun returns the chunks Prune would remove from all shards.
+func (s *ShardedStore) PruneDryRun(ctx context.Context, ids map[ChunkID]struct{}) ([]PruneCandidate, error) {
+	var candidates []PruneCandidate
+	for _, sh := range s.shards {
+		ps, ok := sh.store.(PruneDryRunStore)
+		if !ok {
+			return nil, fmt.Errorf("shard %s does not support listing chunks to prune", sh.store)
+		}
+		c, err := ps.PruneDryRun(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c...)
+	}
+	return candidates, nil
+}
+
+func (s *ShardedStore) String() string {
+	var a []string
+	for _, sh := range s.shards {
+		a = append(a, fmt.Sprintf("%0*x-%0*x=%s", s.digits, sh.from, s.digits, sh.to, sh.store))
+	}
+	return strings.Join(a, ";")
+}
+
+// Close closes all shards. Returns only the first error encountered.
+func (s *ShardedStore) Close() error {
+	var sErr error
+	for _, sh := range s.shards {
+		if err := sh.store.Close(); err != nil && sErr == nil {
+			sErr = err
+		}
+	}
+	return sErr
+}
@@ -0,0 +1,104 @@
+package desync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedStore(t *testing.T) {
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	s1, err := NewLocalStore(dir1, StoreOptions{})
+	require.NoError(t, err)
+	s2, err := NewLocalStore(dir2, StoreOptions{})
+	require.NoError(t, err)
+	s, err := NewShardedStore(StoreShard{"80", "ff", s2}, StoreShard{"00", "7f", s1})
+	require.NoError(t, err)
+
+	// Write chunks and make sure they end up in the right shard
+	var ids []ChunkID
+	for i := 0; i < 20; i++ {
+		c := NewChunk([]byte(fmt.Sprintf("chunk %d", i)))
+		require.NoError(t, s.StoreChunk(c))
+		ids = append(ids, c.ID())
+	}
+	for _, id := range ids {
+		shard, other := s1, s2
+		if id[0] >= 0x80 {
+			shard, other = s2, s1
+		}
+		hasChunk, err := shard.HasChunk(id)
+		require.NoError(t, err)
+		require.True(t, hasChunk)
+		hasChunk, err = other.HasChunk(id)
+		require.NoError(t, err)
+		require.False(t, hasChunk)
+
+		_, err = s.GetChunk(id)
+		require.NoError(t, err)
+	}
+
+	// Listing covers all shards
+	var listed int
+	require.NoError(t, s.ListChunks(context.Background(), func(ChunkID) error {
+		listed++
+		return nil
+	}))
+	require.Equal(t, len(ids), listed)
+
+	// Pruning applies to all shards
+	keep := map[ChunkID]struct{}{ids[0]: {}}
+	require.NoError(t, s.PruneWithProgress(context.Background(), keep, NewProgressBar("")))
+	listed = 0
+	require.NoError(t, s.ListChunks(context.Background(), func(ChunkID) error {
+		listed++
+		return nil
+	}))
+	require.Equal(t, 1, listed)
+}
+
+func TestShardedStoreInvalidRanges(t *testing.T) {
+	var s Store = &TestStore{}
+	for _, shards := range [][]StoreShard{
+		nil,
+		{{"00", "7f", s}},                  // gap at the end
+		{{"00", "7f", s}, {"70", "ff", s}}, // overlap
+		{{"00", "7f", s}, {"81", "ff", s}}, // gap in the middle
+		{{"0", "7", s}, {"80", "ff", s}},   // different prefix lengths
+		{{"00", "zz", s}},                  // not hex
+		{{"7f", "00", s}, {"80", "ff", s}}, // reversed range
+	} {
+		_, err := NewShardedStore(shards...)
+		require.Error(t, err, "%v", shards)
+	}
+
+	_, err := NewShardedStore(StoreShard{"0", "f", s})
+	require.NoError(t, err)
+}
+
+// Implements only PruneStore, without progress or dry-run.
+type pruneOnlyStore struct {
+	WriteStore
+	pruned bool
+}
+
+func (s *pruneOnlyStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
+	s.pruned = true
+	return nil
+}
+
+func TestShardedStorePruneStore(t *testing.T) {
+	s1, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	s2 := &pruneOnlyStore{WriteStore: s1}
+	s, err := NewShardedStore(StoreShard{"00", "7f", s1}, StoreShard{"80", "ff", s2})
+	require.NoError(t, err)
+
+	// Shards that implement just PruneStore are pruned, but can't list candidates
+	require.NoError(t, s.PruneWithProgress(context.Background(), nil, NullProgressBar{}))
+	require.True(t, s2.pruned)
+	_, err = s.PruneDryRun(context.Background(), nil)
+	require.Error(t, err)
+}
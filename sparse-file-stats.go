@@ -0,0 +1,103 @@
+package desync
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the buckets used to record the latency of read operations
+// on a sparse file. Reads taking longer go into the last bucket.
+var sparseReadLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// SparseFileStats contains counters about read operations on a sparse file. They
+// can be used to judge how effective the file is as cache. Chunks that were
+// already present in the file when a read needed them count as coming from the
+// cache, chunks fetched to satisfy a read or to pre-load the file from a state
+// file count as coming from the store. Null chunks aren't counted.
+type SparseFileStats struct {
+	Reads           uint64          `json:"reads"`
+	BytesRead       uint64          `json:"bytes-read"`
+	ChunksFromCache uint64          `json:"chunks-from-cache"`
+	ChunksFromStore uint64          `json:"chunks-from-store"`
+	BytesFromCache  uint64          `json:"bytes-from-cache"`
+	BytesFromStore  uint64          `json:"bytes-from-store"`
+	FetchErrors     uint64          `json:"fetch-errors"`
+	ChunksEvicted   uint64          `json:"chunks-evicted"`
+	ReadLatency     []LatencyBucket `json:"read-latency"`
+}
+
+// LatencyBucket holds the number of operations that took at most Le, but longer
+// than the previous bucket. The last bucket has no upper bound and Le is "+Inf".
+type LatencyBucket struct {
+	Le    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// Counters behind SparseFileStats, updated atomically.
+type sparseFileStats struct {
+	reads, bytesRead, chunksFromCache, chunksFromStore uint64
+	bytesFromCache, bytesFromStore, fetchErrors        uint64
+	chunksEvicted                                      uint64
+	latency                                            []uint64
+}
+
+func newSparseFileStats() *sparseFileStats {
+	return &sparseFileStats{latency: make([]uint64, len(sparseReadLatencyBuckets)+1)}
+}
+
+// Records a read operation of n bytes that took d.
+func (s *sparseFileStats) addRead(n int, d time.Duration) {
+	atomic.AddUint64(&s.reads, 1)
+	atomic.AddUint64(&s.bytesRead, uint64(n))
+	i := 0
+	for i < len(sparseReadLatencyBuckets) && d > sparseReadLatencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&s.latency[i], 1)
+}
+
+func (s *sparseFileStats) addFromCache(size uint64) {
+	atomic.AddUint64(&s.chunksFromCache, 1)
+	atomic.AddUint64(&s.bytesFromCache, size)
+}
+
+func (s *sparseFileStats) addFromStore(size uint64) {
+	atomic.AddUint64(&s.chunksFromStore, 1)
+	atomic.AddUint64(&s.bytesFromStore, size)
+}
+
+func (s *sparseFileStats) incFetchErrors() {
+	atomic.AddUint64(&s.fetchErrors, 1)
+}
+
+func (s *sparseFileStats) incChunksEvicted() {
+	atomic.AddUint64(&s.chunksEvicted, 1)
+}
+
+func (s *sparseFileStats) get() SparseFileStats {
+	latency := make([]LatencyBucket, 0, len(s.latency))
+	for i := range s.latency {
+		le := "+Inf"
+		if i < len(sparseReadLatencyBuckets) {
+			le = sparseReadLatencyBuckets[i].String()
+		}
+		latency = append(latency, LatencyBucket{Le: le, Count: atomic.LoadUint64(&s.latency[i])})
+	}
+	return SparseFileStats{
+		Reads:           atomic.LoadUint64(&s.reads),
+		BytesRead:       atomic.LoadUint64(&s.bytesRead),
+		ChunksFromCache: atomic.LoadUint64(&s.chunksFromCache),
+		ChunksFromStore: atomic.LoadUint64(&s.chunksFromStore),
+		BytesFromCache:  atomic.LoadUint64(&s.bytesFromCache),
+		BytesFromStore:  atomic.LoadUint64(&s.bytesFromStore),
+		FetchErrors:     atomic.LoadUint64(&s.fetchErrors),
+		ChunksEvicted:   atomic.LoadUint64(&s.chunksEvicted),
+		ReadLatency:     latency,
+	}
+}
@@ -1,12 +1,14 @@
 package desync
 
 import (
+	"container/list"
 	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/boljen/go-bitmap"
 )
@@ -35,6 +37,12 @@ type SparseFileOptions struct {
 
 	// Optional, number of goroutines to preload chunks from StateInitFile.
 	StateInitConcurrency int
+
+	// Optional, maximum number of bytes of chunk data kept in the sparse file. When
+	// it's exceeded, the least recently read chunks are removed from the file by
+	// punching holes into it, and loaded from the store again when needed. Only
+	// supported on Linux. Unlimited if 0.
+	MaxSize int64
 }
 
 // SparseFileHandle is used to access a sparse file. All read operations performed
@@ -46,12 +54,15 @@ type SparseFileHandle struct {
 }
 
 func NewSparseFile(name string, idx Index, s Store, opt SparseFileOptions) (*SparseFile, error) {
+	if opt.MaxSize > 0 && !canPunchHoles {
+		return nil, errors.New("limiting the size of sparse files is not supported on this platform")
+	}
 	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0755)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	loader := newSparseFileLoader(name, idx, s)
+	loader := newSparseFileLoader(name, idx, s, opt.MaxSize)
 	sf := &SparseFile{
 		name:   name,
 		idx:    idx,
@@ -121,6 +132,11 @@ func (sf *SparseFile) Length() int64 {
 	return sf.idx.Length()
 }
 
+// Stats returns statistics about the read operations on the file so far.
+func (sf *SparseFile) Stats() SparseFileStats {
+	return sf.loader.stats.get()
+}
+
 // WriteState saves the state of file, basically which chunks were loaded
 // and which ones weren't.
 func (sf *SparseFile) WriteState() error {
@@ -138,6 +154,23 @@ func (sf *SparseFile) WriteState() error {
 // ReadAt reads from the sparse file. All accessed ranges are first written
 // to the file and then returned.
 func (h *SparseFileHandle) ReadAt(b []byte, offset int64) (int, error) {
+	l := h.sf.loader
+	start := time.Now()
+
+	// Prevent chunks from being evicted while they're read
+	l.evictMu.RLock()
+	n, err := h.readAt(b, offset)
+	l.evictMu.RUnlock()
+
+	// Drop the least recently read chunks if the file is too large now
+	if err := l.evict(); err != nil {
+		Log.WithError(err).WithField("file", h.sf.name).Warning("failed to evict chunks from sparse file")
+	}
+	l.stats.addRead(n, time.Since(start))
+	return n, err
+}
+
+func (h *SparseFileHandle) readAt(b []byte, offset int64) (int, error) {
 	if err := h.sf.loader.loadRange(offset, int64(len(b))); err != nil {
 		return 0, err
 	}
@@ -162,9 +195,20 @@ type sparseFileLoader struct {
 
 	nullChunk *NullChunk
 	chunks    []*sparseIndexChunk
+
+	// Maximum number of bytes of loaded chunks, unlimited if 0. Loaded
+	// chunks are kept in a list with the most recently read in front.
+	maxSize  int64
+	evictMu  sync.RWMutex // Held for reading while data is read from the file
+	lruMu    sync.Mutex
+	lru      *list.List
+	lruElems map[int]*list.Element
+	size     int64
+
+	stats *sparseFileStats
 }
 
-func newSparseFileLoader(name string, idx Index, s Store) *sparseFileLoader {
+func newSparseFileLoader(name string, idx Index, s Store, maxSize int64) *sparseFileLoader {
 	chunks := make([]*sparseIndexChunk, 0, len(idx.Chunks))
 	for _, c := range idx.Chunks {
 		chunks = append(chunks, &sparseIndexChunk{IndexChunk: c})
@@ -175,7 +219,11 @@ func newSparseFileLoader(name string, idx Index, s Store) *sparseFileLoader {
 		done:      bitmap.New(len(idx.Chunks)),
 		chunks:    chunks,
 		s:         s,
-		nullChunk: NewNullChunk(idx.Index.ChunkSizeMax),
+		nullChunk: newNullChunk(idx.Index.ChunkSizeMax, idx.digest()),
+		maxSize:   maxSize,
+		lru:       list.New(),
+		lruElems:  make(map[int]*list.Element),
+		stats:     newSparseFileStats(),
 	}
 }
 
@@ -204,12 +252,14 @@ func (l *sparseFileLoader) indexRange(start, length int64) (int, int) {
 
 // Loads all the chunks needed to populate the given byte range (if not already loaded)
 func (l *sparseFileLoader) loadRange(start, length int64) error {
-	first, last := l.indexRange(start, length)
-	var chunksNeeded []int
+	var chunksNeeded, chunksLoaded []int
 	l.mu.RLock()
+	first, last := l.indexRange(start, length)
 	for i := first; i <= last; i++ {
 		b := l.done.Get(i)
 		if b {
+			chunksLoaded = append(chunksLoaded, i)
+			l.stats.addFromCache(l.chunks[i].Size)
 			continue
 		}
 		// The file is truncated and blank, so no need to load null chunks
@@ -220,6 +270,10 @@ func (l *sparseFileLoader) loadRange(start, length int64) error {
 	}
 	l.mu.RUnlock()
 
+	for _, chunk := range chunksLoaded {
+		l.touch(chunk)
+	}
+
 	// TODO: Load the chunks concurrently
 	for _, chunk := range chunksNeeded {
 		if err := l.loadChunk(chunk); err != nil {
@@ -231,9 +285,13 @@ func (l *sparseFileLoader) loadRange(start, length int64) error {
 
 func (l *sparseFileLoader) loadChunk(i int) error {
 	var loadErr error
-	l.chunks[i].once.Do(func() {
-		c, err := l.s.GetChunk(l.chunks[i].ID)
+	l.mu.RLock()
+	chunk := l.chunks[i]
+	l.mu.RUnlock()
+	chunk.once.Do(func() {
+		c, err := l.s.GetChunk(chunk.ID)
 		if err != nil {
+			l.stats.incFetchErrors()
 			loadErr = err
 			return
 		}
@@ -250,7 +308,7 @@ func (l *sparseFileLoader) loadChunk(i int) error {
 		}
 		defer f.Close()
 
-		if _, err := f.WriteAt(b, int64(l.chunks[i].Start)); err != nil {
+		if _, err := f.WriteAt(b, int64(chunk.Start)); err != nil {
 			loadErr = err
 			return
 		}
@@ -258,10 +316,77 @@ func (l *sparseFileLoader) loadChunk(i int) error {
 		l.mu.Lock()
 		l.done.Set(i, true)
 		l.mu.Unlock()
+		l.touch(i)
+		l.stats.addFromStore(chunk.Size)
 	})
 	return loadErr
 }
 
+// Marks a loaded chunk as the most recently read one. NOP if the size of the
+// file isn't limited.
+func (l *sparseFileLoader) touch(i int) {
+	if l.maxSize == 0 {
+		return
+	}
+	l.lruMu.Lock()
+	defer l.lruMu.Unlock()
+	if e, ok := l.lruElems[i]; ok {
+		l.lru.MoveToFront(e)
+		return
+	}
+	l.lruElems[i] = l.lru.PushFront(i)
+	l.size += int64(l.chunks[i].Size)
+}
+
+// Removes the least recently read chunks from the file until the loaded data
+// fits into the maximum size again. Their ranges are deallocated and they're
+// marked as not loaded so they're read from the store on the next access.
+func (l *sparseFileLoader) evict() error {
+	if l.maxSize == 0 {
+		return nil
+	}
+	l.lruMu.Lock()
+	over := l.size > l.maxSize
+	l.lruMu.Unlock()
+	if !over {
+		return nil
+	}
+
+	// Wait for all reads to finish, nothing can be read while chunks are removed
+	l.evictMu.Lock()
+	defer l.evictMu.Unlock()
+
+	f, err := os.OpenFile(l.name, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	l.lruMu.Lock()
+	defer l.lruMu.Unlock()
+	for l.size > l.maxSize && l.lru.Len() > 0 {
+		e := l.lru.Back()
+		i := e.Value.(int)
+		l.mu.Lock()
+		chunk := l.chunks[i]
+		l.mu.Unlock()
+		if err := punchHole(f, int64(chunk.Start), int64(chunk.Size)); err != nil {
+			return err
+		}
+		l.lru.Remove(e)
+		delete(l.lruElems, i)
+		l.size -= int64(chunk.Size)
+
+		// Replace the chunk so it can be loaded again
+		l.mu.Lock()
+		l.done.Set(i, false)
+		l.chunks[i] = &sparseIndexChunk{IndexChunk: chunk.IndexChunk}
+		l.mu.Unlock()
+		l.stats.incChunksEvicted()
+	}
+	return nil
+}
+
 // writeState saves the current internal state about which chunks have
 // been loaded. It's a bitmap of the
 // same length as the index, with 0 = chunk has not been loaded and
@@ -283,9 +408,16 @@ func (l *sparseFileLoader) loadState(r io.Reader) error {
 		return err
 	}
 	l.mu.Lock()
-	defer l.mu.Unlock()
-
 	l.done = done
+	l.mu.Unlock()
+
+	// Track the loaded chunks if the size is limited, they'll be evicted
+	// on the next read if there are too many
+	for i := range l.chunks {
+		if done.Get(i) {
+			l.touch(i)
+		}
+	}
 	return nil
 }
 
@@ -3,9 +3,11 @@ package desync
 import (
 	"bytes"
 	"crypto/sha256"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -20,7 +22,7 @@ func TestLoaderChunkRange(t *testing.T) {
 		},
 	}
 
-	loader := newSparseFileLoader("", idx, nil)
+	loader := newSparseFileLoader("", idx, nil, 0)
 
 	tests := []struct {
 		// Input ranges
@@ -106,3 +108,97 @@ func TestSparseFileRead(t *testing.T) {
 	sparseHash := sha256.Sum256(whole)
 	require.Equal(t, blobHash, sparseHash)
 }
+
+func TestSparseFileMaxSize(t *testing.T) {
+	if !canPunchHoles {
+		t.Skip("not supported on this platform")
+	}
+	s, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	indexFile, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer indexFile.Close()
+	index, err := IndexFromReader(indexFile)
+	require.NoError(t, err)
+
+	b, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+
+	// Limit the sparse file to a fraction of the blob
+	maxSize := int64(len(b) / 4)
+	name := filepath.Join(t.TempDir(), "sparse")
+	sparse, err := NewSparseFile(name, index, s, SparseFileOptions{MaxSize: maxSize})
+	require.NoError(t, err)
+	h, err := sparse.Open()
+	require.NoError(t, err)
+	defer h.Close()
+
+	// Read the whole file a couple of times, with evictions happening along
+	// the way. The data should always be correct.
+	for i := 0; i < 3; i++ {
+		buf := make([]byte, 4096)
+		for offset := 0; offset < len(b); offset += len(buf) {
+			n, err := h.ReadAt(buf, int64(offset))
+			if err != nil {
+				require.Equal(t, io.EOF, err)
+			}
+			require.Equal(t, b[offset:offset+n], buf[:n])
+			require.LessOrEqual(t, sparse.loader.size, maxSize)
+		}
+	}
+
+	// Only chunks still in the file are marked as loaded in the state
+	var loaded int64
+	for i, c := range sparse.loader.chunks {
+		if sparse.loader.done.Get(i) {
+			loaded += int64(c.Size)
+		}
+	}
+	require.Equal(t, sparse.loader.size, loaded)
+}
+
+func TestSparseFileStats(t *testing.T) {
+	s, err := NewLocalStore("testdata/blob1.store", StoreOptions{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	indexFile, err := os.Open("testdata/blob1.caibx")
+	require.NoError(t, err)
+	defer indexFile.Close()
+	index, err := IndexFromReader(indexFile)
+	require.NoError(t, err)
+
+	name := filepath.Join(t.TempDir(), "sparse")
+	sparse, err := NewSparseFile(name, index, s, SparseFileOptions{})
+	require.NoError(t, err)
+	h, err := sparse.Open()
+	require.NoError(t, err)
+	defer h.Close()
+
+	// The first read fetches the chunk from the store, the second is served
+	// from the file
+	first := index.Chunks[0]
+	buf := make([]byte, first.Size)
+	for i := 0; i < 2; i++ {
+		_, err = h.ReadAt(buf, 0)
+		require.NoError(t, err)
+	}
+
+	stats := sparse.Stats()
+	require.Equal(t, uint64(2), stats.Reads)
+	require.Equal(t, 2*first.Size, stats.BytesRead)
+	require.Equal(t, uint64(1), stats.ChunksFromStore)
+	require.Equal(t, uint64(1), stats.ChunksFromCache)
+	require.Equal(t, first.Size, stats.BytesFromStore)
+	require.Equal(t, first.Size, stats.BytesFromCache)
+	require.Equal(t, uint64(0), stats.FetchErrors)
+
+	var reads uint64
+	for _, b := range stats.ReadLatency {
+		reads += b.Count
+	}
+	require.Equal(t, stats.Reads, reads)
+	require.Equal(t, "+Inf", stats.ReadLatency[len(stats.ReadLatency)-1].Le)
+}
@@ -0,0 +1,15 @@
+package desync
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Deallocates a range of a file without changing its size. Reading the range
+// afterwards returns zeros.
+func punchHole(f *os.File, offset, length int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+}
+
+const canPunchHoles = true
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package desync
+
+import (
+	"errors"
+	"os"
+)
+
+func punchHole(f *os.File, offset, length int64) error {
+	return errors.New("Not available on this platform")
+}
+
+const canPunchHoles = false
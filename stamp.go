@@ -0,0 +1,58 @@
+package desync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// StampAttr is the extended attribute used to record the digest of the index
+// a file was extracted from, or chunked into.
+const StampAttr = "user.desync.index"
+
+// IndexDigest returns a digest of an index that's recorded in the stamp of a
+// file. The metadata of the index doesn't describe the content of the file and
+// isn't included.
+func IndexDigest(idx Index) (string, error) {
+	idx.Metadata = nil
+	h := sha256.New()
+	if _, err := idx.WriteTo(h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// StampFile records the digest of an index in an extended attribute of a file,
+// together with the size and modification time of the file. It's used to skip
+// work on the file if it's processed again with the same index later. Only
+// regular files can be stamped.
+func StampFile(name, digest string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("can't stamp %s, not a regular file", name)
+	}
+	return setStamp(name, stampValue(info, digest))
+}
+
+// FileStampMatches returns true if a file was stamped with the digest and was
+// not modified since. Files without stamp, or on filesystems that don't
+// support extended attributes, never match.
+func FileStampMatches(name, digest string) bool {
+	info, err := os.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	value, err := getStamp(name)
+	if err != nil {
+		return false
+	}
+	return value == stampValue(info, digest)
+}
+
+func stampValue(info os.FileInfo, digest string) string {
+	return fmt.Sprintf("%s %d %d", digest, info.Size(), info.ModTime().UnixNano())
+}
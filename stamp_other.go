@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package desync
+
+import "github.com/pkg/xattr"
+
+func setStamp(name, value string) error {
+	return xattr.Set(name, StampAttr, []byte(value))
+}
+
+func getStamp(name string) (string, error) {
+	b, err := xattr.Get(name, StampAttr)
+	return string(b), err
+}
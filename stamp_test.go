@@ -0,0 +1,30 @@
+package desync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStampFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, ioutil.WriteFile(name, []byte("data"), 0644))
+	digest, err := IndexDigest(readCaibxFile(t, "testdata/blob1.caibx"))
+	require.NoError(t, err)
+
+	require.False(t, FileStampMatches(name, digest))
+	if err := StampFile(name, digest); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+	require.True(t, FileStampMatches(name, digest))
+	require.False(t, FileStampMatches(name, "other"))
+
+	// Modifying the file invalidates the stamp
+	mtime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(name, mtime, mtime))
+	require.False(t, FileStampMatches(name, digest))
+}
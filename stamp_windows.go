@@ -0,0 +1,11 @@
+package desync
+
+import "errors"
+
+func setStamp(name, value string) error {
+	return errors.New("stamping files is not supported on this platform")
+}
+
+func getStamp(name string) (string, error) {
+	return "", errors.New("stamping files is not supported on this platform")
+}
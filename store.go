@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
 	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 const DefaultErrorRetry = 3
@@ -27,12 +30,99 @@ type WriteStore interface {
 	StoreChunk(c *Chunk) error
 }
 
+// BatchWriteStore is implemented by stores that can write many chunks in one
+// call with less overhead than writing them one by one, for example by writing
+// them concurrently. StoreChunks only returns once all chunks are stored or an
+// error occurred. Chunks that were written before the error remain in the
+// store, and since chunks are content-addressed, it's safe to retry the whole
+// batch.
+type BatchWriteStore interface {
+	WriteStore
+	StoreChunks(chunks []*Chunk) error
+}
+
+// StoreChunks writes chunks into a store, in a single batch if the store
+// supports it, or one at a time otherwise.
+func StoreChunks(s WriteStore, chunks []*Chunk) error {
+	if bs, ok := s.(BatchWriteStore); ok {
+		return bs.StoreChunks(chunks)
+	}
+	for _, c := range chunks {
+		if err := s.StoreChunk(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns a semaphore limiting the number of chunks a store writes
+// concurrently in batches to n.
+func newBatchLimit(n int) chan struct{} {
+	if n < 1 {
+		n = 1
+	}
+	return make(chan struct{}, n)
+}
+
+// Calls fn for all chunks concurrently, with at most as many goroutines as
+// there are slots in sem. The semaphore is shared by all batches written to a
+// store, so concurrent batches don't multiply the number of requests. Stops on
+// the first error and returns it.
+func storeChunksConcurrently(chunks []*Chunk, sem chan struct{}, fn func(*Chunk) error) error {
+	g, ctx := errgroup.WithContext(context.Background())
+loop:
+	for _, c := range chunks {
+		select {
+		case <-ctx.Done():
+			break loop
+		case sem <- struct{}{}:
+		}
+		c := c
+		g.Go(func() error {
+			defer func() { <-sem }()
+			return fn(c)
+		})
+	}
+	return g.Wait()
+}
+
 // PruneStore is a store that supports read, write and pruning of chunks
 type PruneStore interface {
 	WriteStore
 	Prune(ctx context.Context, ids map[ChunkID]struct{}) error
 }
 
+// PruneProgressStore is a PruneStore that can report the chunks it removes to a
+// progress bar. Chunks are removed with the concurrency and rate limit set in
+// the store options.
+type PruneProgressStore interface {
+	PruneStore
+	PruneWithProgress(ctx context.Context, ids map[ChunkID]struct{}, pb ProgressBar) error
+}
+
+// PruneDryRunStore is a PruneStore that can list the chunks Prune would remove
+// without removing them.
+type PruneDryRunStore interface {
+	PruneStore
+	PruneDryRun(ctx context.Context, ids map[ChunkID]struct{}) ([]PruneCandidate, error)
+}
+
+// PruneCandidate is a chunk that would be removed from a store by Prune.
+type PruneCandidate struct {
+	ID ChunkID `json:"id"`
+
+	// Size of the chunk in the store, after compression and/or encryption
+	Size int64 `json:"size"`
+}
+
+// ChunkLister is implemented by stores that are able to enumerate all chunks
+// they hold. fn is called for every chunk ID found. Listing stops when fn
+// returns an error, which is then passed back to the caller.
+type ChunkLister interface {
+	Store
+	ListChunks(ctx context.Context, fn func(ChunkID) error) error
+}
+
 // IndexStore is implemented by stores that hold indexes.
 type IndexStore interface {
 	GetIndexReader(name string) (io.ReadCloser, error)
@@ -41,6 +131,20 @@ type IndexStore interface {
 	fmt.Stringer
 }
 
+// Implemented by index stores that can be configured to expect indexes using
+// a hash algorithm other than the global Digest.
+type indexDigester interface {
+	indexDigest() HashAlgorithm
+}
+
+// Returns the hash algorithm of the indexes in store s.
+func indexStoreDigest(s IndexStore) HashAlgorithm {
+	if d, ok := s.(indexDigester); ok {
+		return d.indexDigest()
+	}
+	return Digest
+}
+
 // IndexWriteStore is used by stores that support reading and writing of indexes.
 type IndexWriteStore interface {
 	IndexStore
@@ -71,9 +175,26 @@ type StoreOptions struct {
 	// Cookie header value for HTTP stores
 	HTTPCookie string `json:"http-cookie,omitempty"`
 
-	// Timeout for waiting for objects to be retrieved. Infinite if negative. Default: 1 minute
+	// Timeout for waiting for objects to be retrieved. Infinite if negative. Default: 1 minute,
+	// or infinite if StallTimeout is set.
 	Timeout time.Duration `json:"timeout,omitempty"`
 
+	// Time limit for establishing a connection to an HTTP store, including the TLS
+	// handshake. No limit other than Timeout if 0.
+	ConnectTimeout time.Duration `json:"connect-timeout,omitempty"`
+
+	// Time limit for receiving the response headers after a request to an HTTP store
+	// was sent. No limit other than Timeout if 0.
+	ReadTimeout time.Duration `json:"read-timeout,omitempty"`
+
+	// Time after which idle connections to an HTTP store are closed. Default: 1 minute
+	IdleTimeout time.Duration `json:"idle-timeout,omitempty"`
+
+	// Abort requests to an HTTP store when no data was sent or received for this
+	// long. Unlike Timeout, this doesn't fail slow transfers that are still making
+	// progress. Disabled if 0.
+	StallTimeout time.Duration `json:"stall-timeout,omitempty"`
+
 	// Number of times object retrieval should be attempted on error. Useful when dealing
 	// with unreliable connections.
 	ErrorRetry int `json:"error-retry,omitempty"`
@@ -92,6 +213,72 @@ type StoreOptions struct {
 
 	// Store and read chunks uncompressed, without chunk file extension
 	Uncompressed bool `json:"uncompressed"`
+
+	// zstd compression level for chunks written to the store, from 1 (fastest)
+	// to 22 (best). The default level is used if 0.
+	CompressionLevel int `json:"compression-level,omitempty"`
+
+	// Directory that invalid chunks are moved into when repairing a store or cache,
+	// instead of deleting them. Each quarantined chunk is given a timestamped name
+	// so that repeated corruption of the same chunk can be analyzed later. Only
+	// supported by local stores.
+	Quarantine string `json:"quarantine,omitempty"`
+
+	// Encrypt chunks with AES-256-GCM using a key derived from this password. Data is
+	// compressed (unless Uncompressed is set) before it's encrypted.
+	EncryptionPassword string `json:"encryption-password,omitempty"`
+
+	// Maximum number of requests per second sent to the store. Unlimited if 0.
+	RateLimit float64 `json:"rate-limit,omitempty"`
+
+	// Maximum number of bytes per second read from the store. Unlimited if 0.
+	DownloadLimit int64 `json:"download-limit,omitempty"`
+
+	// Maximum number of bytes per second written to the store. Unlimited if 0.
+	UploadLimit int64 `json:"upload-limit,omitempty"`
+
+	// Template for the names of chunks in the store, see ChunkLayout. Default:
+	// "{prefix}/{id}{ext}"
+	ChunkLayout string `json:"chunk-layout,omitempty"`
+
+	// Number of TLS sessions cached for resumption in HTTP stores. Disabled if
+	// negative. Default: 64
+	TLSSessionCacheSize int `json:"tls-session-cache-size,omitempty"`
+
+	// Flush chunk files to disk before they're moved into place. Only supported
+	// by local stores.
+	Fsync bool `json:"fsync,omitempty"`
+
+	// Flush the directory to disk after a chunk file was moved into it. Only
+	// supported by local stores.
+	FsyncDir bool `json:"fsync-dir,omitempty"`
+
+	// Resolve the host of an HTTP store to all of its addresses and send the
+	// requests for a chunk always to the same server, chosen by consistent
+	// hashing of the chunk ID. Used with pools of chunk servers behind one DNS
+	// name so each server only caches its share of the chunks.
+	ConsistentHash bool `json:"consistent-hash,omitempty"`
+
+	// Talk to HTTPS stores over HTTP/3 (QUIC) instead of TCP. Requires a server
+	// with an HTTP/3 listener, like chunk-server with --http3. ReadTimeout
+	// doesn't apply to HTTP/3.
+	HTTP3 bool `json:"http3,omitempty"`
+
+	// Move chunks removed from S3 or GCS stores, like by prune, to this prefix
+	// in the same bucket instead of deleting them. The name of a chunk in the
+	// trash is the prefix followed by its original name. Objects under the
+	// prefix are expected to be expired by a lifecycle rule on the bucket.
+	TrashPrefix string `json:"trash-prefix,omitempty"`
+
+	// Encrypt indexes in index stores with the EncryptionPassword. Indexes are
+	// compressed first, unless Uncompressed is set. Reading indexes that aren't
+	// encrypted fails once this is enabled.
+	EncryptIndexes bool `json:"encrypt-indexes,omitempty"`
+
+	// Digest algorithm of the chunk IDs in the store, "sha512-256" or "sha256".
+	// Chunks read from the store are verified with it. The global Digest is
+	// used if empty.
+	Digest string `json:"digest,omitempty"`
 }
 
 // NewStoreOptionsWithDefaults creates a new StoreOptions struct with the default values set
@@ -109,6 +296,29 @@ func (o *StoreOptions) UnmarshalJSON(data []byte) error {
 	return json.Unmarshal(data, (*Alias)(o))
 }
 
+// Returns the name of an object after it was moved into the trash.
+func (o *StoreOptions) trashName(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(o.TrashPrefix, "/"), "/") + "/" + name
+}
+
+// Returns the hash algorithm of the chunks in the store, nil for the global
+// Digest. The name is validated when the store is created.
+func (o *StoreOptions) digest() HashAlgorithm {
+	h, _ := DigestByName(o.Digest)
+	return h
+}
+
+// Returns the hash algorithm indexes in the store are expected to use, the
+// global Digest unless the store is configured with a different one.
+func (o *StoreOptions) indexDigest() HashAlgorithm {
+	return digestOrDefault(o.digest())
+}
+
+// Returns the layout of chunk names in the store.
+func (o *StoreOptions) chunkLayout() (ChunkLayout, error) {
+	return NewChunkLayout(o.ChunkLayout, !o.Uncompressed)
+}
+
 // Returns data converters that convert between plain and storage-format. Each layer
 // represents a modification such as compression or encryption and is applied in order
 // depending the direction of data. If data is written to storage, the layer's toStorage
@@ -117,7 +327,10 @@ func (o *StoreOptions) UnmarshalJSON(data []byte) error {
 func (o *StoreOptions) converters() []converter {
 	var m []converter
 	if !o.Uncompressed {
-		m = append(m, Compressor{})
+		m = append(m, Compressor{Level: o.CompressionLevel})
+	}
+	if o.EncryptionPassword != "" {
+		m = append(m, NewAESGCMEncryptor(o.EncryptionPassword))
 	}
 	return m
 }
@@ -23,14 +23,15 @@ func NewStoreRouter(stores ...Store) StoreRouter {
 }
 
 // GetChunk queries the available stores in order and moves to the next if
-// it gets a ChunkMissing. Fails if any store returns a different error.
+// it gets an ErrNotFound error, like ChunkMissing. Fails if any store returns
+// a different error.
 func (r StoreRouter) GetChunk(id ChunkID) (*Chunk, error) {
 	for _, s := range r.Stores {
 		chunk, err := s.GetChunk(id)
-		switch err.(type) {
-		case nil:
+		switch {
+		case err == nil:
 			return chunk, nil
-		case ChunkMissing:
+		case errors.Is(err, ErrNotFound):
 			continue
 		default:
 			return nil, errors.Wrap(err, s.String())
@@ -1,6 +1,8 @@
 package desync
 
 import (
+	"fmt"
+	"io"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -56,6 +58,13 @@ func (s *SwapStore) String() string {
 	return s.s.String()
 }
 
+// Unwrap returns the store requests are currently sent to.
+func (s *SwapStore) Unwrap() Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.s
+}
+
 // Close the store. NOP opertation, needed to implement Store interface.
 func (s *SwapStore) Close() error {
 	s.mu.RLock()
@@ -63,7 +72,8 @@ func (s *SwapStore) Close() error {
 	return s.s.Close()
 }
 
-// Close the store. NOP opertation, needed to implement Store interface.
+// Swap replaces the wrapped store with a new one and closes the old one. Use
+// ProbeStore beforehand to make sure the new store is usable.
 func (s *SwapStore) Swap(new Store) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -83,3 +93,126 @@ func (s *SwapWriteStore) StoreChunk(chunk *Chunk) error {
 	defer s.mu.RUnlock()
 	return s.s.(WriteStore).StoreChunk(chunk)
 }
+
+// SwapIndexStore wraps an index store and allows it to be replaced at runtime,
+// like SwapStore does for chunk stores. It implements IndexWriteStore, writing
+// fails if the wrapped store doesn't support it.
+type SwapIndexStore struct {
+	s IndexStore
+
+	mu sync.RWMutex
+}
+
+var _ IndexWriteStore = &SwapIndexStore{}
+
+// NewSwapIndexStore initializes a swap store for indexes.
+func NewSwapIndexStore(s IndexStore) *SwapIndexStore {
+	return &SwapIndexStore{s: s}
+}
+
+// Unwrap returns the index store requests are currently sent to.
+func (s *SwapIndexStore) Unwrap() IndexStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.s
+}
+
+// GetIndexReader returns a reader for an index from the store
+func (s *SwapIndexStore) GetIndexReader(name string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.s.GetIndexReader(name)
+}
+
+// GetIndex reads an index from the store
+func (s *SwapIndexStore) GetIndex(name string) (Index, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.s.GetIndex(name)
+}
+
+// StoreIndex writes an index to the store if it's writable
+func (s *SwapIndexStore) StoreIndex(name string, idx Index) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ws, ok := s.s.(IndexWriteStore)
+	if !ok {
+		return fmt.Errorf("index store %s does not support writing", s.s)
+	}
+	return ws.StoreIndex(name, idx)
+}
+
+func (s *SwapIndexStore) indexDigest() HashAlgorithm {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return indexStoreDigest(s.s)
+}
+
+func (s *SwapIndexStore) String() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.s.String()
+}
+
+// Close the wrapped store
+func (s *SwapIndexStore) Close() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.s.Close()
+}
+
+// Swap replaces the wrapped index store with a new one and closes the old one.
+func (s *SwapIndexStore) Swap(new IndexStore) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, oldWritable := s.s.(IndexWriteStore)
+	_, newWritable := new.(IndexWriteStore)
+	if oldWritable && !newWritable {
+		return errors.New("a writable index store can only be updated with another writable one")
+	}
+	s.s.Close()
+	s.s = new
+	return nil
+}
+
+// Content of the chunk used by ProbeStore to check that a store is writable.
+var probeChunkData = []byte("desync store probe")
+
+// ProbeStore checks that a store can be reached by asking it for a chunk. If
+// writable is true, the store also has to accept a small chunk, which is
+// removed again afterwards if the store supports removing chunks. Typically
+// used to validate a new store configuration before swapping it in.
+func ProbeStore(s Store, writable bool) error {
+	probe := NewChunk(probeChunkData)
+	present, err := s.HasChunk(probe.ID())
+	if err != nil {
+		return errors.Wrapf(err, "failed to probe store %s", s)
+	}
+	if !writable {
+		return nil
+	}
+	ws, ok := s.(WriteStore)
+	if !ok {
+		return fmt.Errorf("store %s is not writable", s)
+	}
+	if err := ws.StoreChunk(probe); err != nil {
+		return errors.Wrapf(err, "failed to write to store %s", s)
+	}
+	// Don't leave the probe behind, unless it was there before
+	if present {
+		return nil
+	}
+	for {
+		switch st := s.(type) {
+		case interface{ RemoveChunk(ChunkID) error }:
+			if err := st.RemoveChunk(probe.ID()); err != nil {
+				return errors.Wrapf(err, "failed to remove probe chunk from store %s", s)
+			}
+			return nil
+		case interface{ Unwrap() Store }:
+			s = st.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
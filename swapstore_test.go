@@ -0,0 +1,45 @@
+package desync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeStore(t *testing.T) {
+	// A working store passes, and gets the probe chunk when writable
+	s := &TestStore{}
+	require.NoError(t, ProbeStore(s, false))
+	require.Empty(t, s.Chunks)
+	require.NoError(t, ProbeStore(s, true))
+	require.Len(t, s.Chunks, 1)
+
+	// Stores that support removing chunks don't keep the probe, also when
+	// wrapped, unless it was there before
+	dir := t.TempDir()
+	local, err := NewLocalStore(dir, StoreOptions{})
+	require.NoError(t, err)
+	require.NoError(t, ProbeStore(NewSwapWriteStore(NewWriteDedupQueue(local)), true))
+	probe := NewChunk(probeChunkData)
+	hasChunk, err := local.HasChunk(probe.ID())
+	require.NoError(t, err)
+	require.False(t, hasChunk)
+	require.NoError(t, local.StoreChunk(probe))
+	require.NoError(t, ProbeStore(local, true))
+	hasChunk, err = local.HasChunk(probe.ID())
+	require.NoError(t, err)
+	require.True(t, hasChunk)
+
+	// Read-only stores fail when writing is required
+	require.Error(t, ProbeStore(NewStoreRouter(s), true))
+
+	// Errors from the store are passed up
+	broken := &TestStore{
+		HasChunkFunc: func(ChunkID) (bool, error) {
+			return false, StoreError{Kind: ErrTemporaryNetwork, Store: "broken", Err: errors.New("unreachable")}
+		},
+	}
+	err = ProbeStore(broken, false)
+	require.ErrorIs(t, err, ErrTemporaryNetwork)
+}
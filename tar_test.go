@@ -1,3 +1,4 @@
+//go:build !windows
 // +build !windows
 
 package desync
@@ -7,10 +8,16 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestTar(t *testing.T) {
@@ -99,3 +106,163 @@ func TestTar(t *testing.T) {
 		}
 	}
 }
+
+func TestUnTarOverlay(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Unix(1600000000, 0)
+	for name, content := range map[string]string{
+		"same":    "unchanged content",
+		"changed": "original content",
+		"resized": "short",
+	} {
+		p := filepath.Join(src, name)
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+		require.NoError(t, os.Chtimes(p, mtime, mtime))
+	}
+	require.NoError(t, os.Symlink("same", filepath.Join(src, "link")))
+
+	archive := new(bytes.Buffer)
+	require.NoError(t, Tar(context.Background(), archive, NewLocalFS(src, LocalFSOptions{})))
+
+	// Extract it once, then change some of the files
+	dst := t.TempDir()
+	opts := LocalFSOptions{NoSameOwner: true, Overlay: true}
+	require.NoError(t, UnTar(context.Background(), bytes.NewReader(archive.Bytes()), NewLocalFS(dst, opts)))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "changed"), []byte("modified content"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "resized"), []byte("much longer"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "extra"), []byte("extra"), 0644))
+	require.NoError(t, os.Link(filepath.Join(dst, "changed"), filepath.Join(dst, "hardlink")))
+
+	inode := func(name string) uint64 {
+		info, err := os.Lstat(filepath.Join(dst, name))
+		require.NoError(t, err)
+		return uint64(info.Sys().(*syscall.Stat_t).Ino)
+	}
+	sameIno, changedIno, linkIno := inode("same"), inode("changed"), inode("link")
+
+	// Extract again on top of it
+	require.NoError(t, UnTar(context.Background(), bytes.NewReader(archive.Bytes()), NewLocalFS(dst, opts)))
+
+	for name, content := range map[string]string{
+		"same":     "unchanged content",
+		"changed":  "original content",
+		"resized":  "short",
+		"extra":    "extra",
+		"hardlink": "modified content",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dst, name))
+		require.NoError(t, err)
+		require.Equal(t, content, string(b), name)
+	}
+
+	// Unchanged files were left in place, changed ones replaced without
+	// modifying other links to them
+	require.Equal(t, sameIno, inode("same"))
+	require.NotEqual(t, changedIno, inode("changed"))
+	require.Equal(t, changedIno, inode("hardlink"))
+	require.Equal(t, linkIno, inode("link"))
+	info, err := os.Stat(filepath.Join(dst, "changed"))
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Equal(mtime))
+}
+
+func TestUnTarParallel(t *testing.T) {
+	// A tree with nested directories, many small files and some larger ones
+	// that are written without buffering
+	src := t.TempDir()
+	mtime := time.Unix(1600000000, 0)
+	expected := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		dir := filepath.Join(fmt.Sprintf("dir%d", i), "sub")
+		require.NoError(t, os.MkdirAll(filepath.Join(src, dir), 0755))
+		for j := 0; j < 20; j++ {
+			name := filepath.Join(dir, fmt.Sprintf("file%d", j))
+			content := fmt.Sprintf("content of %s", name)
+			if j%10 == 0 {
+				content = string(bytes.Repeat([]byte(content), 100))
+			}
+			expected[name] = content
+			p := filepath.Join(src, name)
+			require.NoError(t, ioutil.WriteFile(p, []byte(content), 0640))
+			require.NoError(t, os.Chtimes(p, mtime, mtime))
+		}
+	}
+	archive := new(bytes.Buffer)
+	require.NoError(t, Tar(context.Background(), archive, NewLocalFS(src, LocalFSOptions{})))
+
+	dst := t.TempDir()
+	opt := UnTarOptions{Writers: 4, MaxBufferedFile: 64, VerifyGoodbye: true}
+	require.NoError(t, UnTarWithOptions(context.Background(), bytes.NewReader(archive.Bytes()), NewLocalFS(dst, LocalFSOptions{NoSameOwner: true}), opt))
+
+	for name, content := range expected {
+		p := filepath.Join(dst, name)
+		b, err := ioutil.ReadFile(p)
+		require.NoError(t, err)
+		require.Equal(t, content, string(b), name)
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0640), info.Mode().Perm(), name)
+		require.True(t, info.ModTime().Equal(mtime), name)
+	}
+
+	// Errors from the writers are returned
+	fs := failingFileFS{FilesystemWriter: NewLocalFS(t.TempDir(), LocalFSOptions{NoSameOwner: true}), name: "dir3/sub/file5"}
+	err := UnTarWithOptions(context.Background(), bytes.NewReader(archive.Bytes()), fs, opt)
+	require.EqualError(t, err, "failed to write dir3/sub/file5")
+}
+
+// Fails to write one of the files
+type failingFileFS struct {
+	FilesystemWriter
+	name string
+}
+
+func (fs failingFileFS) CreateFile(n NodeFile) error {
+	if n.Name == fs.name {
+		return fmt.Errorf("failed to write %s", n.Name)
+	}
+	return fs.FilesystemWriter.CreateFile(n)
+}
+
+func TestUnTarIndexFetchAhead(t *testing.T) {
+	// Identical files lead to repeated chunks in the index
+	src := t.TempDir()
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("file%d", i)), data, 0644))
+	}
+	archive := new(bytes.Buffer)
+	require.NoError(t, Tar(context.Background(), archive, NewLocalFS(src, LocalFSOptions{})))
+	c, err := NewChunker(archive, 16*1024, 32*1024, 64*1024)
+	require.NoError(t, err)
+	store := &TestStore{}
+	index, err := ChunkStream(context.Background(), c, store, 1)
+	require.NoError(t, err)
+	require.Less(t, len(store.Chunks), len(index.Chunks))
+
+	var (
+		mu      sync.Mutex
+		fetched = make(map[ChunkID]int)
+	)
+	store.GetChunkFunc = func(id ChunkID) (*Chunk, error) {
+		mu.Lock()
+		fetched[id]++
+		mu.Unlock()
+		return NewChunk(store.Chunks[id]), nil
+	}
+
+	// With all chunks in the window, each is only fetched once
+	dst := t.TempDir()
+	opt := UnTarOptions{FetchAhead: len(index.Chunks)}
+	require.NoError(t, UnTarIndexWithOptions(context.Background(), NewLocalFS(dst, LocalFSOptions{NoSameOwner: true}), index, store, 4, NullProgressBar{}, opt))
+	require.Len(t, fetched, len(store.Chunks))
+	for id, n := range fetched {
+		require.Equal(t, 1, n, id.String())
+	}
+	for i := 0; i < 4; i++ {
+		b, err := ioutil.ReadFile(filepath.Join(dst, fmt.Sprintf("file%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, data, b)
+	}
+}
@@ -0,0 +1,539 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// TreeIndexVersion is the version of the tree index format written by
+// MakeTreeIndex.
+const TreeIndexVersion = 1
+
+// TreeIndex describes a directory tree with the content of each regular file
+// chunked on its own, rather than as part of one catar stream. A change to one
+// file then only affects the chunks of that file, and not the chunk boundaries
+// of everything that follows it in the archive. This works better for trees of
+// many small files. It's stored as JSON.
+type TreeIndex struct {
+	Version      int         `json:"version"`
+	Digest       string      `json:"digest"`
+	ChunkSizeMin uint64      `json:"chunk-size-min"`
+	ChunkSizeAvg uint64      `json:"chunk-size-avg"`
+	ChunkSizeMax uint64      `json:"chunk-size-max"`
+	Entries      []TreeEntry `json:"entries"`
+}
+
+// Types of entries in a tree index
+const (
+	TreeEntryDir         = "dir"
+	TreeEntryFile        = "file"
+	TreeEntrySymlink     = "symlink"
+	TreeEntryCharDevice  = "char-device"
+	TreeEntryBlockDevice = "block-device"
+)
+
+// TreeEntry is a directory, file, symlink or device in a tree index. Entries
+// are listed in the order they need to be created, directories before their
+// content. The path is relative to the root of the tree, which is ".".
+type TreeEntry struct {
+	Path     string            `json:"path"`
+	Type     string            `json:"type"`
+	Mode     uint32            `json:"mode"`
+	UID      int               `json:"uid"`
+	GID      int               `json:"gid"`
+	MTime    time.Time         `json:"mtime"`
+	Size     uint64            `json:"size,omitempty"`
+	Target   string            `json:"target,omitempty"`
+	DevMajor uint64            `json:"dev-major,omitempty"`
+	DevMinor uint64            `json:"dev-minor,omitempty"`
+	Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+	Chunks   []TreeChunk       `json:"chunks,omitempty"`
+}
+
+// TreeChunk is a chunk of the content of a file in a tree index.
+type TreeChunk struct {
+	ID   ChunkID `json:"id"`
+	Size uint64  `json:"size"`
+}
+
+// TreeIndexOptions hold the parameters for making a tree index.
+type TreeIndexOptions struct {
+	ChunkSizeMin uint64
+	ChunkSizeAvg uint64
+	ChunkSizeMax uint64
+
+	// Number of goroutines chunking files
+	N int
+}
+
+// ReadTreeIndex decodes a tree index.
+func ReadTreeIndex(r io.Reader) (TreeIndex, error) {
+	var idx TreeIndex
+	if err := json.NewDecoder(r).Decode(&idx); err != nil {
+		return idx, fmt.Errorf("failed to read tree index: %w", err)
+	}
+	if idx.Version < 1 || idx.Version > TreeIndexVersion {
+		return idx, fmt.Errorf("unsupported tree index version %d", idx.Version)
+	}
+	if _, err := DigestByName(idx.Digest); err != nil {
+		return idx, err
+	}
+	return idx, validateTreeEntries(idx.Entries)
+}
+
+// Confirms the entries of a tree index stay within the target directory. Paths
+// need to be relative and clean, and every entry needs to be in a directory
+// defined by an earlier entry. Otherwise an entry could write through a
+// symlink created by one before it.
+func validateTreeEntries(entries []TreeEntry) error {
+	types := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if e.Path == "" || path.IsAbs(e.Path) || e.Path != path.Clean(e.Path) || e.Path == ".." || strings.HasPrefix(e.Path, "../") {
+			return fmt.Errorf("invalid path '%s' in tree index", e.Path)
+		}
+		if _, ok := types[e.Path]; ok {
+			return fmt.Errorf("duplicate path '%s' in tree index", e.Path)
+		}
+		if e.Path == "." {
+			if e.Type != TreeEntryDir {
+				return errors.New("root of tree index is not a directory")
+			}
+		} else if parent := path.Dir(e.Path); parent != "." && types[parent] != TreeEntryDir {
+			return fmt.Errorf("parent of '%s' is not a directory defined earlier in the tree index", e.Path)
+		}
+		types[e.Path] = e.Type
+	}
+	return nil
+}
+
+// WriteTo encodes the tree index as JSON.
+func (t TreeIndex) WriteTo(w io.Writer) (int64, error) {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+// MakeTreeIndex reads a tree from fs, chunks every regular file and stores the
+// chunks in ws. Files are chunked by opt.N goroutines. The hash algorithm for
+// the chunk IDs is taken from the context.
+func MakeTreeIndex(ctx context.Context, fs FilesystemReader, ws WriteStore, opt TreeIndexOptions) (TreeIndex, error) {
+	digest := DigestFromContext(ctx)
+	idx := TreeIndex{
+		Version:      TreeIndexVersion,
+		Digest:       digestName(digest),
+		ChunkSizeMin: opt.ChunkSizeMin,
+		ChunkSizeAvg: opt.ChunkSizeAvg,
+		ChunkSizeMax: opt.ChunkSizeMax,
+	}
+	n := opt.N
+	if n < 1 {
+		n = 1
+	}
+	type fileJob struct {
+		entry *TreeEntry
+		data  io.ReadCloser
+	}
+	var (
+		entries []*TreeEntry
+		files   = make(chan fileJob)
+		s       = NewChunkStorage(ws)
+	)
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Workers - chunk files and store the chunks
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for job := range files {
+				chunks, size, err := chunkTreeFile(ctx, job.data, opt, s, digest)
+				job.data.Close()
+				if err != nil {
+					return fmt.Errorf("failed to chunk %s: %w", job.entry.Path, err)
+				}
+				job.entry.Chunks = chunks
+				job.entry.Size = size
+			}
+			return nil
+		})
+	}
+
+	// Read the tree in order, the first entry is the root
+	g.Go(func() error {
+		defer close(files)
+		var root string
+		for {
+			if ctx.Err() != nil {
+				return Interrupted{}
+			}
+			f, err := fs.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if root == "" {
+				root = f.Path
+			}
+			e := &TreeEntry{
+				Path:   treePath(root, f.Path),
+				Mode:   treeMode(f.Mode),
+				UID:    f.Uid,
+				GID:    f.Gid,
+				MTime:  f.ModTime,
+				Xattrs: make(map[string][]byte),
+			}
+			for k, v := range f.Xattrs {
+				e.Xattrs[k] = []byte(v)
+			}
+			switch {
+			case f.IsDir():
+				e.Type = TreeEntryDir
+			case f.IsSymlink():
+				e.Type = TreeEntrySymlink
+				e.Target = f.LinkTarget
+			case f.IsDevice():
+				e.Type = TreeEntryBlockDevice
+				if f.Mode&os.ModeCharDevice != 0 {
+					e.Type = TreeEntryCharDevice
+				}
+				e.DevMajor, e.DevMinor = f.DevMajor, f.DevMinor
+			case f.IsRegular():
+				e.Type = TreeEntryFile
+			default:
+				fmt.Fprintf(os.Stderr, "skipping '%s' : unsupported node type\n", f.Name)
+				if f.Data != nil {
+					f.Data.Close()
+				}
+				continue
+			}
+			entries = append(entries, e)
+			if e.Type != TreeEntryFile {
+				continue
+			}
+			select {
+			case files <- fileJob{entry: e, data: f.Data}:
+			case <-ctx.Done():
+				f.Data.Close()
+				return Interrupted{}
+			}
+		}
+	})
+	if err := g.Wait(); err != nil {
+		return idx, err
+	}
+	for _, e := range entries {
+		idx.Entries = append(idx.Entries, *e)
+	}
+	return idx, nil
+}
+
+// Splits the content of a file into chunks and stores them.
+func chunkTreeFile(ctx context.Context, r io.Reader, opt TreeIndexOptions, s *ChunkStorage, digest HashAlgorithm) ([]TreeChunk, uint64, error) {
+	c, err := NewChunker(r, opt.ChunkSizeMin, opt.ChunkSizeAvg, opt.ChunkSizeMax)
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		chunks []TreeChunk
+		size   uint64
+	)
+	for {
+		if ctx.Err() != nil {
+			return nil, 0, Interrupted{}
+		}
+		_, b, err := c.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(b) == 0 {
+			return chunks, size, nil
+		}
+		chunk := NewChunkWithDigest(b, digest)
+		if err := s.StoreChunk(chunk); err != nil {
+			return nil, 0, err
+		}
+		chunks = append(chunks, TreeChunk{ID: chunk.ID(), Size: uint64(len(b))})
+		size += uint64(len(b))
+	}
+}
+
+// ExtractTreeIndex writes the tree described by the index to fs, reading the
+// file content from s. Directories, symlinks and devices are created in order,
+// while files are written by n goroutines, which requires fs to be safe for
+// concurrent use if n is larger than 1.
+func ExtractTreeIndex(ctx context.Context, idx TreeIndex, s Store, fs FilesystemWriter, n int) error {
+	if err := validateTreeEntries(idx.Entries); err != nil {
+		return err
+	}
+	if n < 1 {
+		n = 1
+	}
+	files := make(chan TreeEntry)
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Writers
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for e := range files {
+				if ctx.Err() != nil {
+					return Interrupted{}
+				}
+				err := fs.CreateFile(NodeFile{
+					Name:   e.Path,
+					UID:    e.UID,
+					GID:    e.GID,
+					Mode:   fileMode(e.Mode),
+					MTime:  e.MTime,
+					Xattrs: treeXattrs(e.Xattrs),
+					Size:   e.Size,
+					Data:   &treeFileReader{ctx: ctx, s: s, chunks: e.Chunks},
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	// Create everything but files in order and hand those to the writers
+	g.Go(func() error {
+		defer close(files)
+		for _, e := range idx.Entries {
+			if ctx.Err() != nil {
+				return Interrupted{}
+			}
+			var err error
+			switch e.Type {
+			case TreeEntryDir:
+				err = fs.CreateDir(NodeDirectory{
+					Name:   e.Path,
+					UID:    e.UID,
+					GID:    e.GID,
+					Mode:   os.ModeDir | fileMode(e.Mode),
+					MTime:  e.MTime,
+					Xattrs: treeXattrs(e.Xattrs),
+				})
+			case TreeEntrySymlink:
+				err = fs.CreateSymlink(NodeSymlink{
+					Name:   e.Path,
+					UID:    e.UID,
+					GID:    e.GID,
+					Mode:   os.ModeSymlink | fileMode(e.Mode),
+					MTime:  e.MTime,
+					Xattrs: treeXattrs(e.Xattrs),
+					Target: e.Target,
+				})
+			case TreeEntryCharDevice, TreeEntryBlockDevice:
+				mode := os.ModeDevice | fileMode(e.Mode)
+				if e.Type == TreeEntryCharDevice {
+					mode |= os.ModeCharDevice
+				}
+				err = fs.CreateDevice(NodeDevice{
+					Name:   e.Path,
+					UID:    e.UID,
+					GID:    e.GID,
+					Mode:   mode,
+					Major:  e.DevMajor,
+					Minor:  e.DevMinor,
+					MTime:  e.MTime,
+					Xattrs: treeXattrs(e.Xattrs),
+				})
+			case TreeEntryFile:
+				select {
+				case files <- e:
+				case <-ctx.Done():
+					return Interrupted{}
+				}
+			default:
+				err = fmt.Errorf("unsupported type '%s' of %s in tree index", e.Type, e.Path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return g.Wait()
+}
+
+// Reads the content of a file in a tree index from the store, one chunk at a
+// time.
+type treeFileReader struct {
+	ctx    context.Context
+	s      Store
+	chunks []TreeChunk
+	buf    *bytes.Reader
+}
+
+func (r *treeFileReader) Read(p []byte) (int, error) {
+	for r.buf == nil || r.buf.Len() == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		if r.ctx.Err() != nil {
+			return 0, Interrupted{}
+		}
+		c := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		chunk, err := r.s.GetChunk(c.ID)
+		if err != nil {
+			return 0, err
+		}
+		b, err := chunk.Data()
+		if err != nil {
+			return 0, err
+		}
+		if uint64(len(b)) != c.Size {
+			return 0, fmt.Errorf("unexpected size for chunk %s", c.ID.String())
+		}
+		r.buf = bytes.NewReader(b)
+	}
+	return r.buf.Read(p)
+}
+
+// TreeDiff lists the differences between two tree indexes.
+type TreeDiff struct {
+	// Paths that are only in the new index
+	Added []string `json:"added"`
+	// Paths that are only in the old index
+	Removed []string `json:"removed"`
+	// Paths with different content or metadata
+	Modified []string `json:"modified"`
+	// Chunks referenced by the new index that aren't in the old one
+	ChunksAdded int    `json:"chunks-added"`
+	BytesAdded  uint64 `json:"bytes-added"`
+}
+
+// DiffTreeIndex compares two tree indexes. Entries are considered modified if
+// their type, content or any of their metadata differs.
+func DiffTreeIndex(oldIdx, newIdx TreeIndex) TreeDiff {
+	diff := TreeDiff{Added: []string{}, Removed: []string{}, Modified: []string{}}
+	oldEntries := make(map[string]TreeEntry)
+	oldChunks := make(map[ChunkID]struct{})
+	for _, e := range oldIdx.Entries {
+		oldEntries[e.Path] = e
+		for _, c := range e.Chunks {
+			oldChunks[c.ID] = struct{}{}
+		}
+	}
+	newPaths := make(map[string]struct{})
+	for _, e := range newIdx.Entries {
+		newPaths[e.Path] = struct{}{}
+		old, ok := oldEntries[e.Path]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, e.Path)
+		case !treeEntryEqual(old, e):
+			diff.Modified = append(diff.Modified, e.Path)
+		}
+		for _, c := range e.Chunks {
+			if _, ok := oldChunks[c.ID]; ok {
+				continue
+			}
+			oldChunks[c.ID] = struct{}{} // only count each new chunk once
+			diff.ChunksAdded++
+			diff.BytesAdded += c.Size
+		}
+	}
+	for _, e := range oldIdx.Entries {
+		if _, ok := newPaths[e.Path]; !ok {
+			diff.Removed = append(diff.Removed, e.Path)
+		}
+	}
+	return diff
+}
+
+func treeEntryEqual(a, b TreeEntry) bool {
+	if a.Type != b.Type || a.Mode != b.Mode || a.UID != b.UID || a.GID != b.GID ||
+		!a.MTime.Equal(b.MTime) || a.Size != b.Size || a.Target != b.Target ||
+		a.DevMajor != b.DevMajor || a.DevMinor != b.DevMinor ||
+		len(a.Xattrs) != len(b.Xattrs) || len(a.Chunks) != len(b.Chunks) {
+		return false
+	}
+	for k, v := range a.Xattrs {
+		if w, ok := b.Xattrs[k]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	for i := range a.Chunks {
+		if a.Chunks[i] != b.Chunks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the path of an entry relative to the root of the tree, with "/" as
+// separator.
+func treePath(root, p string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
+
+// Converts the permissions of a file to the Unix representation, including
+// the setuid, setgid and sticky bits.
+func treeMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// Converts Unix permissions to an os.FileMode.
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func treeXattrs(xa map[string][]byte) Xattrs {
+	if len(xa) == 0 {
+		return nil
+	}
+	m := make(Xattrs)
+	for k, v := range xa {
+		m[k] = string(v)
+	}
+	return m
+}
+
+// Returns the name of a hash algorithm as used by DigestByName.
+func digestName(h HashAlgorithm) string {
+	if digestOrDefault(h).Algorithm() == crypto.SHA256 {
+		return "sha256"
+	}
+	return "sha512-256"
+}
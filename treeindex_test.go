@@ -0,0 +1,139 @@
+//go:build !windows
+// +build !windows
+
+package desync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeIndex(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Unix(1600000000, 0)
+	large := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(large)
+	files := map[string][]byte{
+		"a":         []byte("file a"),
+		"dir/b":     []byte("file b"),
+		"dir/large": large,
+		"empty":     nil,
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0750))
+	for name, content := range files {
+		p := filepath.Join(src, name)
+		require.NoError(t, ioutil.WriteFile(p, content, 0640))
+		require.NoError(t, os.Chtimes(p, mtime, mtime))
+	}
+	require.NoError(t, os.Symlink("dir/b", filepath.Join(src, "link")))
+
+	store, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	opt := TreeIndexOptions{ChunkSizeMin: 16 * 1024, ChunkSizeAvg: 64 * 1024, ChunkSizeMax: 256 * 1024, N: 4}
+	idx1, err := MakeTreeIndex(context.Background(), NewLocalFS(src, LocalFSOptions{}), store, opt)
+	require.NoError(t, err)
+
+	var paths []string
+	for _, e := range idx1.Entries {
+		paths = append(paths, e.Path)
+	}
+	require.Equal(t, []string{".", "a", "dir", "dir/b", "dir/large", "empty", "link"}, paths)
+
+	// Round trip through JSON
+	b := new(bytes.Buffer)
+	_, err = idx1.WriteTo(b)
+	require.NoError(t, err)
+	decoded, err := ReadTreeIndex(b)
+	require.NoError(t, err)
+	require.Empty(t, DiffTreeIndex(idx1, decoded).Modified)
+
+	// Change one file, only its chunks differ
+	large[0]++
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "dir", "large"), large, 0640))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "dir", "large"), mtime, mtime))
+	require.NoError(t, os.Remove(filepath.Join(src, "a")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "c"), []byte("file c"), 0640))
+	idx2, err := MakeTreeIndex(context.Background(), NewLocalFS(src, LocalFSOptions{}), store, opt)
+	require.NoError(t, err)
+
+	diff := DiffTreeIndex(idx1, idx2)
+	require.Equal(t, []string{"c"}, diff.Added)
+	require.Equal(t, []string{"a"}, diff.Removed)
+	require.Contains(t, diff.Modified, "dir/large")
+	require.NotContains(t, diff.Modified, "dir/b")
+	require.Equal(t, 2, diff.ChunksAdded) // first chunk of "large" and "c"
+
+	// Extract the new tree
+	dst := t.TempDir()
+	require.NoError(t, ExtractTreeIndex(context.Background(), idx2, store, NewLocalFS(dst, LocalFSOptions{NoSameOwner: true}), 4))
+	files["dir/large"] = large
+	files["c"] = []byte("file c")
+	delete(files, "a")
+	for name, content := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dst, name))
+		require.NoError(t, err)
+		require.Equal(t, len(content), len(b), name)
+		require.True(t, bytes.Equal(content, b), name)
+	}
+	info, err := os.Stat(filepath.Join(dst, "dir", "b"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	require.True(t, info.ModTime().Equal(mtime))
+	target, err := os.Readlink(filepath.Join(dst, "link"))
+	require.NoError(t, err)
+	require.Equal(t, "dir/b", target)
+
+	// Missing chunks fail the extraction
+	empty, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	err = ExtractTreeIndex(context.Background(), idx2, empty, NewLocalFS(t.TempDir(), LocalFSOptions{NoSameOwner: true}), 4)
+	require.Error(t, err)
+}
+
+func TestReadTreeIndexInvalidPath(t *testing.T) {
+	_, err := ReadTreeIndex(bytes.NewReader([]byte(`{"version": 1, "entries": [{"path": "../etc", "type": "dir"}]}`)))
+	require.Error(t, err)
+}
+
+func TestTreeIndexSymlinkTraversal(t *testing.T) {
+	outside := t.TempDir()
+	idx := TreeIndex{
+		Version: TreeIndexVersion,
+		Entries: []TreeEntry{
+			{Path: ".", Type: TreeEntryDir, Mode: 0755},
+			{Path: "x", Type: TreeEntrySymlink, Target: outside},
+			{Path: "x/evil", Type: TreeEntryFile, Mode: 0644},
+		},
+	}
+	b := new(bytes.Buffer)
+	_, err := idx.WriteTo(b)
+	require.NoError(t, err)
+	_, err = ReadTreeIndex(b)
+	require.Error(t, err)
+
+	// Indexes that weren't read from a file are checked before extracting
+	store, err := NewLocalStore(t.TempDir(), StoreOptions{})
+	require.NoError(t, err)
+	target := t.TempDir()
+	err = ExtractTreeIndex(context.Background(), idx, store, NewLocalFS(target, LocalFSOptions{NoSameOwner: true}), 1)
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(outside, "evil"))
+	require.True(t, os.IsNotExist(err))
+
+	// A directory replaced by a later entry is rejected as well
+	idx.Entries = []TreeEntry{
+		{Path: ".", Type: TreeEntryDir, Mode: 0755},
+		{Path: "x", Type: TreeEntryDir, Mode: 0755},
+		{Path: "x", Type: TreeEntrySymlink, Target: outside},
+		{Path: "x/evil", Type: TreeEntryFile, Mode: 0644},
+	}
+	require.Error(t, ExtractTreeIndex(context.Background(), idx, store, NewLocalFS(target, LocalFSOptions{NoSameOwner: true}), 1))
+}
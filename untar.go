@@ -10,10 +10,103 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// DefaultUnTarMaxBufferedFile is the size up to which files are read into
+// memory to be written by the writer goroutines of UnTarWithOptions.
+const DefaultUnTarMaxBufferedFile = 1024 * 1024
+
+// UnTarOptions influence how a catar archive is written to a filesystem.
+type UnTarOptions struct {
+	// Number of goroutines writing files. With more than one, files are not
+	// necessarily written in the order they appear in the archive and the
+	// FilesystemWriter needs to be safe for concurrent use. Directories are
+	// always created before their content.
+	Writers int
+
+	// Files up to this size are read into memory and passed to one of the
+	// writers. Larger files are written while reading them from the archive.
+	// Up to Writers+1 files are held in memory at a time, one by each writer
+	// and one being read by the decoder, so memory use is bounded by
+	// (Writers+1)*MaxBufferedFile. Defaults to DefaultUnTarMaxBufferedFile.
+	MaxBufferedFile uint64
+
+	// Maximum number of chunks fetched ahead of the decoder when extracting
+	// from an index, which limits the memory used when writing is slower than
+	// fetching. Defaults to the number of fetch goroutines.
+	FetchAhead int
+
+	// Validate the goodbye element of every directory in the archive and fail
+	// on malformed ones, like casync does.
+	VerifyGoodbye bool
+}
+
 // UnTar implements the untar command, decoding a catar file and writing the
-// contained tree to a target directory.
+// contained tree to a target directory. Returns Interrupted if the context is
+// cancelled, also while in the middle of reading a large file.
 func UnTar(ctx context.Context, r io.Reader, fs FilesystemWriter) error {
-	dec := NewArchiveDecoder(r)
+	return UnTarWithOptions(ctx, r, fs, UnTarOptions{})
+}
+
+// UnTarWithOptions works like UnTar, but can write several files in parallel.
+// Small files are read into memory and written by opt.Writers goroutines,
+// together with their metadata, while the archive is decoded. This is much
+// faster than writing one file after the other when the archive holds many
+// small files. Large files, directories, symlinks and devices are still created
+// one after the other by the decoder.
+func UnTarWithOptions(ctx context.Context, r io.Reader, fs FilesystemWriter, opt UnTarOptions) error {
+	if opt.Writers < 2 {
+		return untarNodes(ctx, r, fs, opt, fs.CreateFile)
+	}
+	maxBuffered := opt.MaxBufferedFile
+	if maxBuffered == 0 {
+		maxBuffered = DefaultUnTarMaxBufferedFile
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	// Unbuffered, so files are only read into memory once a writer is free
+	files := make(chan NodeFile)
+
+	// Writers
+	for i := 0; i < opt.Writers; i++ {
+		g.Go(func() error {
+			for n := range files {
+				if ctx.Err() != nil {
+					return Interrupted{}
+				}
+				if err := fs.CreateFile(n); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	// Decoder - creates directories and other entries in order and hands small
+	// files to the writers
+	g.Go(func() error {
+		defer close(files)
+		return untarNodes(ctx, r, fs, opt, func(n NodeFile) error {
+			if n.Size > maxBuffered {
+				return fs.CreateFile(n)
+			}
+			b := make([]byte, n.Size)
+			if _, err := io.ReadFull(n.Data, b); err != nil {
+				return err
+			}
+			n.Data = bytes.NewReader(b)
+			select {
+			case files <- n:
+				return nil
+			case <-ctx.Done():
+				return Interrupted{}
+			}
+		})
+	})
+	return g.Wait()
+}
+
+// Decodes the archive and creates all entries in fs, except for files which
+// are passed to createFile.
+func untarNodes(ctx context.Context, r io.Reader, fs FilesystemWriter, opt UnTarOptions, createFile func(NodeFile) error) error {
+	dec := NewArchiveDecoderWithOptions(ctx, r, ArchiveDecoderOptions{VerifyGoodbye: opt.VerifyGoodbye})
 loop:
 	for {
 		// See if we're meant to stop
@@ -30,7 +123,7 @@ loop:
 		case NodeDirectory:
 			err = fs.CreateDir(n)
 		case NodeFile:
-			err = fs.CreateFile(n)
+			err = createFile(n)
 		case NodeDevice:
 			err = fs.CreateDevice(n)
 		case NodeSymlink:
@@ -51,18 +144,33 @@ loop:
 // and decodes it on-the-fly into the target directory 'dst'. Uses n gorountines
 // to retrieve and decompress the chunks.
 func UnTarIndex(ctx context.Context, fs FilesystemWriter, index Index, s Store, n int, pb ProgressBar) error {
-	type requestJob struct {
+	return UnTarIndexWithOptions(ctx, fs, index, s, n, pb, UnTarOptions{})
+}
+
+// UnTarIndexWithOptions works like UnTarIndex, with options for writing the
+// files like UnTarWithOptions. Chunks are fetched up to opt.FetchAhead chunks
+// ahead of the decoder, in index order. A chunk that occurs more than once
+// within that window, like one holding the end of a file and the start of the
+// next that's repeated in the archive, is only fetched once.
+func UnTarIndexWithOptions(ctx context.Context, fs FilesystemWriter, index Index, s Store, n int, pb ProgressBar, opt UnTarOptions) error {
+	// A chunk being fetched, shared by all its occurrences in the window
+	type fetchJob struct {
 		chunk IndexChunk    // requested chunk
-		data  chan ([]byte) // channel for the (decompressed) chunk
+		done  chan struct{} // closed once data is set, or fetching failed
+		data  []byte        // (decompressed) chunk data
+	}
+	fetchAhead := opt.FetchAhead
+	if fetchAhead <= 0 {
+		fetchAhead = n
 	}
 	var (
-		req      = make(chan requestJob)
-		assemble = make(chan chan []byte, n)
+		req      = make(chan *fetchJob)
+		assemble = make(chan *fetchJob, fetchAhead)
 	)
 	g, ctx := errgroup.WithContext(ctx)
 
 	// Initialize and start progress bar if one was provided
-	pb.SetTotal(len(index.Chunks))
+	pb.SetTotal(int64(len(index.Chunks)))
 	pb.Start()
 	defer pb.Finish()
 
@@ -77,61 +185,81 @@ func UnTarIndex(ctx context.Context, fs FilesystemWriter, index Index, s Store,
 				// Pull the chunk from the store
 				chunk, err := s.GetChunk(r.chunk.ID)
 				if err != nil {
-					close(r.data)
+					close(r.done)
 					return err
 				}
 				b, err := chunk.Data()
 				if err != nil {
-					close(r.data)
+					close(r.done)
 					return err
 				}
 				// Might as well verify the chunk size while we're at it
 				if r.chunk.Size != uint64(len(b)) {
-					close(r.data)
-					return fmt.Errorf("unexpected size for chunk %s", r.chunk.ID)
+					close(r.done)
+					return fmt.Errorf("unexpected size for chunk %s", r.chunk.ID.String())
 				}
-				r.data <- b
-				close(r.data)
+				r.data = b
+				close(r.done)
 			}
 			return nil
 		})
 	}
 
-	// Feeder - requesting chunks from the workers and handing a result data channel
-	// to the assembler
+	// Feeder - requesting chunks from the workers and handing them to the
+	// assembler. Chunks requested within the last fetchAhead chunks are reused.
 	g.Go(func() error {
+		var (
+			recent = make(map[ChunkID]*fetchJob)
+			order  []ChunkID
+		)
 	loop:
 		for _, c := range index.Chunks {
-			data := make(chan []byte, 1)
-			select {
-			case <-ctx.Done():
-				break loop
-			case req <- requestJob{chunk: c, data: data}: // request the chunk
+			job, ok := recent[c.ID]
+			if !ok {
+				job = &fetchJob{chunk: c, done: make(chan struct{})}
 				select {
 				case <-ctx.Done():
 					break loop
-				case assemble <- data: // and hand over the data channel to the assembler
+				case req <- job: // request the chunk
+				}
+				recent[c.ID] = job
+				order = append(order, c.ID)
+				if len(order) > fetchAhead {
+					delete(recent, order[0])
+					order = order[1:]
 				}
 			}
+			select {
+			case <-ctx.Done():
+				break loop
+			case assemble <- job: // and hand it over to the assembler
+			}
 		}
 		close(req)      // tell the workers this is it
 		close(assemble) // tell the assembler we're done
 		return nil
 	})
 
-	// Assember - Read from data channels push the chunks into the pipe that untar reads from
+	// Assember - Wait for the chunks and push them into the pipe that untar reads from
 	g.Go(func() error {
 		defer w.Close() // No more chunks to come, stop the untar
 	loop:
 		for {
 			select {
-			case data := <-assemble:
-				if data == nil {
+			case job := <-assemble:
+				if job == nil {
 					break loop
 				}
 				pb.Increment()
-				b := <-data
-				if _, err := io.Copy(w, bytes.NewReader(b)); err != nil {
+				select {
+				case <-job.done:
+				case <-ctx.Done():
+					break loop
+				}
+				if job.data == nil && job.chunk.Size > 0 { // fetching failed
+					break loop
+				}
+				if _, err := io.Copy(w, bytes.NewReader(job.data)); err != nil {
 					return err
 				}
 			case <-ctx.Done():
@@ -143,7 +271,7 @@ func UnTarIndex(ctx context.Context, fs FilesystemWriter, index Index, s Store,
 
 	// UnTar - Read from the pipe that Assembler pushes into
 	g.Go(func() error {
-		err := UnTar(ctx, r, fs)
+		err := UnTarWithOptions(ctx, r, fs, opt)
 		if err != nil {
 			// If an error has occurred during the UnTar, we need to stop the Assembler.
 			// If we don't, then it would stall on writing to the pipe.
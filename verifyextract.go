@@ -0,0 +1,99 @@
+package desync
+
+import (
+	"context"
+	"os"
+)
+
+// VerifyExtractStats describe how much of an existing output already matches an
+// index, and where the remaining data would come from when extracting it.
+type VerifyExtractStats struct {
+	BytesTotal      int64   `json:"bytes-total"`
+	ChunksTotal     int     `json:"chunks-total"`
+	BytesCorrect    int64   `json:"bytes-correct"`
+	ChunksCorrect   int     `json:"chunks-correct"`
+	PercentCorrect  float64 `json:"percent-correct"`
+	BytesFromSeeds  int64   `json:"bytes-from-seeds"`
+	ChunksFromSeeds int     `json:"chunks-from-seeds"`
+	BytesFromStore  int64   `json:"bytes-from-store"`
+	ChunksFromStore int     `json:"chunks-from-store"`
+	Seeds           int     `json:"seeds"`
+}
+
+// VerifyExtract compares an existing output to an index without writing to it.
+// It returns how much of the output is already correct, and how much of the
+// rest would be taken from seeds or need to be fetched from the store by
+// AssembleFile. Seeds are validated, invalid ones are handled according to
+// options.InvalidSeedAction. Chunks needed more than once are counted once
+// towards the data from the store. A missing output counts as all incorrect.
+func VerifyExtract(ctx context.Context, name string, idx Index, seeds []Seed, options AssembleOptions) (*VerifyExtractStats, error) {
+	stats := &VerifyExtractStats{
+		BytesTotal:  idx.Length(),
+		ChunksTotal: len(idx.Chunks),
+		Seeds:       len(seeds),
+	}
+
+	// Find the chunks in the output that don't match the index
+	damaged := make(map[uint64]bool)
+	_, err := os.Stat(name)
+	switch {
+	case os.IsNotExist(err):
+		for _, c := range idx.Chunks {
+			damaged[c.Start] = true
+		}
+	case err != nil:
+		return stats, err
+	default:
+		chunks, err := FindDamagedChunks(ctx, name, idx, options.N, NewProgressBar("Verifying "))
+		if err != nil {
+			return stats, err
+		}
+		for _, c := range chunks {
+			damaged[c.Start] = true
+		}
+	}
+	for _, c := range idx.Chunks {
+		if !damaged[c.Start] {
+			stats.ChunksCorrect++
+			stats.BytesCorrect += int64(c.Size)
+		}
+	}
+	if stats.BytesTotal > 0 {
+		stats.PercentCorrect = 100 * float64(stats.BytesCorrect) / float64(stats.BytesTotal)
+	} else {
+		stats.PercentCorrect = 100
+	}
+
+	// Plan the extraction like AssembleFile would, including null chunks which
+	// don't need to come from a store. The null seed isn't needed to write
+	// anything here, so it doesn't need a block file.
+	if len(idx.Chunks) == 0 {
+		return stats, nil
+	}
+	ns := &nullChunkSeed{id: newNullChunk(idx.Index.ChunkSizeMax, idx.digest()).ID}
+	seq := NewSeedSequencer(idx, append([]Seed{ns}, seeds...)...)
+	plan, _, err := validPlan(ctx, seq, options)
+	if err != nil {
+		return stats, err
+	}
+	fromStore := make(map[ChunkID]struct{})
+	for _, candidate := range plan {
+		for _, c := range candidate.indexSegment.chunks() {
+			if !damaged[c.Start] {
+				continue
+			}
+			if candidate.source != nil {
+				stats.ChunksFromSeeds++
+				stats.BytesFromSeeds += int64(c.Size)
+				continue
+			}
+			if _, ok := fromStore[c.ID]; ok {
+				continue
+			}
+			fromStore[c.ID] = struct{}{}
+			stats.ChunksFromStore++
+			stats.BytesFromStore += int64(c.Size)
+		}
+	}
+	return stats, nil
+}
@@ -3,7 +3,10 @@ package desync
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"sync"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -15,7 +18,7 @@ func VerifyIndex(ctx context.Context, name string, idx Index, n int, pb Progress
 	g, ctx := errgroup.WithContext(ctx)
 
 	// Setup and start the progressbar if any
-	pb.SetTotal(len(idx.Chunks))
+	pb.SetTotal(int64(len(idx.Chunks)))
 	pb.Start()
 	defer pb.Finish()
 
@@ -37,13 +40,13 @@ func VerifyIndex(ctx context.Context, name string, idx Index, n int, pb Progress
 		g.Go(func() error {
 			for c := range in {
 				// Reuse the fileSeedSegment structure, this is really just a seed segment after all
-				segment := newFileSeedSegment(name, c, false)
+				segment := newFileSeedSegment(name, c, false, idx.digest())
 				if err := segment.Validate(f); err != nil {
 					return err
 				}
 
 				// Update progress bar, if any
-				pb.Add(len(c))
+				pb.Add(int64(len(c)))
 			}
 			return nil
 		})
@@ -77,3 +80,130 @@ loop:
 
 	return g.Wait()
 }
+
+// FindDamagedChunks compares every chunk of a blob to a given index and returns
+// the chunks whose data doesn't match. Unlike VerifyIndex, it doesn't stop at
+// the first mismatch. Chunks beyond the end of the blob are reported as damaged.
+func FindDamagedChunks(ctx context.Context, name string, idx Index, n int, pb ProgressBar) ([]IndexChunk, error) {
+	var (
+		mu      sync.Mutex
+		damaged []IndexChunk
+	)
+	in := make(chan int)
+	g, ctx := errgroup.WithContext(ctx)
+
+	pb.SetTotal(int64(len(idx.Chunks)))
+	pb.Start()
+	defer pb.Finish()
+
+	// Start the workers, each having its own filehandle to read concurrently
+	for i := 0; i < n; i++ {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open file %s, %s", name, err)
+		}
+		defer f.Close()
+		g.Go(func() error {
+			var b []byte
+			for i := range in {
+				c := idx.Chunks[i]
+				if uint64(cap(b)) < c.Size {
+					b = make([]byte, c.Size)
+				}
+				b = b[:c.Size]
+				_, err := f.ReadAt(b, int64(c.Start))
+				switch {
+				case err == io.EOF || err == io.ErrUnexpectedEOF: // blob is too short
+				case err != nil:
+					return err
+				case ChunkID(idx.digest().Sum(b)) == c.ID:
+					pb.Increment()
+					continue
+				}
+				mu.Lock()
+				damaged = append(damaged, c)
+				mu.Unlock()
+				pb.Increment()
+			}
+			return nil
+		})
+	}
+
+	// Feed the workers, stop if there are any errors
+loop:
+	for i := range idx.Chunks {
+		select {
+		case <-ctx.Done():
+			break loop
+		case in <- i:
+		}
+	}
+	close(in)
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Slice(damaged, func(i, j int) bool { return damaged[i].Start < damaged[j].Start })
+	return damaged, nil
+}
+
+// RepairChunks writes the data of the given chunks, typically found with
+// FindDamagedChunks, from the store into the blob at their offsets. Regular
+// files are resized to the length of the index.
+func RepairChunks(ctx context.Context, name string, idx Index, chunks []IndexChunk, s Store, n int, pb ProgressBar) error {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !isDevice(stat.Mode()) && stat.Size() != idx.Length() {
+		if err := os.Truncate(name, idx.Length()); err != nil {
+			return err
+		}
+	}
+
+	in := make(chan IndexChunk)
+	g, ctx := errgroup.WithContext(ctx)
+
+	pb.SetTotal(int64(len(chunks)))
+	pb.Start()
+	defer pb.Finish()
+
+	for i := 0; i < n; i++ {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("unable to open file %s, %s", name, err)
+		}
+		defer f.Close()
+		g.Go(func() error {
+			for c := range in {
+				chunk, err := s.GetChunk(c.ID)
+				if err != nil {
+					return err
+				}
+				b, err := chunk.Data()
+				if err != nil {
+					return err
+				}
+				if uint64(len(b)) != c.Size {
+					return fmt.Errorf("unexpected size for chunk %s", c.ID.String())
+				}
+				if _, err := f.WriteAt(b, int64(c.Start)); err != nil {
+					return err
+				}
+				pb.Increment()
+			}
+			return nil
+		})
+	}
+
+loop:
+	for _, c := range chunks {
+		select {
+		case <-ctx.Done():
+			break loop
+		case in <- c:
+		}
+	}
+	close(in)
+	return g.Wait()
+}
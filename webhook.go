@@ -0,0 +1,184 @@
+package desync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Types of events that can be sent to webhooks.
+const (
+	EventChunkStored   = "chunk-stored"
+	EventIndexStored   = "index-stored"
+	EventPruneFinished = "prune-finished"
+)
+
+// Event describes a change to a store, like an index uploaded to an index
+// server. Fields that don't apply to the type of event are left empty.
+type Event struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Store  string    `json:"store"`
+	Chunk  string    `json:"chunk,omitempty"`
+	Index  string    `json:"index,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	Client string    `json:"client,omitempty"`
+
+	// Number of chunks removed by prune, and the error if it failed
+	Removed int64  `json:"removed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Header holding the signature of a webhook request if a secret is configured.
+// The value is "sha256=" followed by the hex-encoded HMAC-SHA256 of the body.
+const WebhookSignatureHeader = "X-Desync-Signature"
+
+// WebhookOptions configure how events are sent to webhooks.
+type WebhookOptions struct {
+	// Optional secret used to sign the body of requests.
+	Secret string
+
+	// Only send events of these types. All events are sent if empty.
+	Types []string
+
+	// Time a single request can take. Default: 10s
+	Timeout time.Duration
+
+	// Number of times a failed request is retried. Default: 0
+	Retries int
+
+	// Number of events that can be queued before new ones are dropped.
+	// Default: 1000
+	QueueSize int
+}
+
+// WebhookNotifier sends events as JSON in POST requests to one or more URLs.
+// Events are queued and sent in the background in the order they happened, so
+// a slow or unavailable receiver doesn't hold up the server. Events are dropped
+// if the queue is full.
+type WebhookNotifier struct {
+	urls   []string
+	opt    WebhookOptions
+	types  map[string]bool
+	client *http.Client
+	queue  chan Event
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewWebhookNotifier returns a notifier for the given URLs and starts sending
+// the events passed to Notify.
+func NewWebhookNotifier(urls []string, opt WebhookOptions) *WebhookNotifier {
+	if opt.Timeout == 0 {
+		opt.Timeout = 10 * time.Second
+	}
+	if opt.QueueSize == 0 {
+		opt.QueueSize = 1000
+	}
+	n := &WebhookNotifier{
+		urls:   urls,
+		opt:    opt,
+		client: &http.Client{Timeout: opt.Timeout},
+		queue:  make(chan Event, opt.QueueSize),
+		done:   make(chan struct{}),
+	}
+	if len(opt.Types) > 0 {
+		n.types = make(map[string]bool)
+		for _, t := range opt.Types {
+			n.types[t] = true
+		}
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues an event to be sent. It doesn't block.
+func (n *WebhookNotifier) Notify(e Event) {
+	if n.types != nil && !n.types[e.Type] {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- e:
+	default:
+		Log.WithField("type", e.Type).Warning("webhook queue is full, dropping event")
+	}
+}
+
+// Close stops accepting events and waits until the queued ones have been sent.
+func (n *WebhookNotifier) Close() error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	<-n.done
+	return nil
+}
+
+func (n *WebhookNotifier) run() {
+	defer close(n.done)
+	for e := range n.queue {
+		b, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		for _, u := range n.urls {
+			if err := n.send(u, b); err != nil {
+				Log.WithError(err).WithField("url", u).WithField("type", e.Type).Warning("failed to send event to webhook")
+			}
+		}
+	}
+}
+
+// Sends the body to a URL, retrying if it fails.
+func (n *WebhookNotifier) send(u string, body []byte) error {
+	var err error
+	for attempt := 0; attempt <= n.opt.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = n.post(u, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (n *WebhookNotifier) post(u string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.opt.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.opt.Secret))
+		mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package desync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []Event
+		failures = 1
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		// Check the signature
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(WebhookSignatureHeader))
+
+		mu.Lock()
+		defer mu.Unlock()
+		// Fail the first request, it should be retried
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		require.NoError(t, json.Unmarshal(body, &e))
+		received = append(received, e)
+	}))
+	defer srv.Close()
+
+	n := NewWebhookNotifier([]string{srv.URL}, WebhookOptions{
+		Secret:  "secret",
+		Types:   []string{EventIndexStored},
+		Retries: 1,
+	})
+	n.Notify(Event{Type: EventIndexStored, Index: "a.caibx"})
+	n.Notify(Event{Type: EventChunkStored}) // filtered out
+	n.Notify(Event{Type: EventIndexStored, Index: "b.caibx"})
+	require.NoError(t, n.Close())
+
+	// Events after closing are ignored
+	n.Notify(Event{Type: EventIndexStored, Index: "c.caibx"})
+
+	require.Len(t, received, 2)
+	require.Equal(t, "a.caibx", received[0].Index)
+	require.Equal(t, "b.caibx", received[1].Index)
+	require.False(t, received[0].Time.IsZero())
+}
@@ -0,0 +1,158 @@
+package desync
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// WhiteoutFormat defines how deletions and opaque directories in a container
+// diff layer are represented.
+type WhiteoutFormat int
+
+const (
+	// WhiteoutOCI uses empty ".wh.<name>" files to mark deleted entries and a
+	// ".wh..wh..opq" file to mark opaque directories, as defined by the OCI
+	// image spec for layer tarballs.
+	WhiteoutOCI WhiteoutFormat = iota
+
+	// WhiteoutOverlayFS uses 0:0 character devices to mark deleted entries and
+	// the "trusted.overlay.opaque" xattr for opaque directories, which can be
+	// used as an OverlayFS upper or lower dir directly.
+	WhiteoutOverlayFS
+)
+
+const (
+	ociWhiteoutPrefix = ".wh."
+	ociWhiteoutOpaque = ".wh..wh..opq"
+	overlayOpaqueAttr = "trusted.overlay.opaque"
+	// Used instead of the trusted namespace when mounted with "userxattr"
+	overlayUserOpaqueAttr = "user.overlay.opaque"
+)
+
+var _ FilesystemWriter = &WhiteoutFS{}
+
+// WhiteoutFS wraps a FilesystemWriter and converts whiteouts in an archive of
+// a container diff layer into the given format while extracting it. Whiteouts
+// in either format are recognized in the archive. All other entries are
+// passed through unchanged. It's safe for concurrent use if the wrapped
+// writer is.
+type WhiteoutFS struct {
+	fs     FilesystemWriter
+	format WhiteoutFormat
+
+	// Directories seen so far, needed to mark them as opaque after the fact
+	dirs map[string]NodeDirectory
+	mu   sync.Mutex
+}
+
+// NewWhiteoutFS returns a filesystem writer that writes whiteouts to fs in
+// the given format.
+func NewWhiteoutFS(fs FilesystemWriter, format WhiteoutFormat) *WhiteoutFS {
+	return &WhiteoutFS{
+		fs:     fs,
+		format: format,
+		dirs:   make(map[string]NodeDirectory),
+	}
+}
+
+// CreateDir writes a directory, converting the opaque marker if needed.
+func (w *WhiteoutFS) CreateDir(n NodeDirectory) error {
+	if w.format == WhiteoutOverlayFS {
+		w.mu.Lock()
+		w.dirs[n.Name] = n
+		w.mu.Unlock()
+		return w.fs.CreateDir(n)
+	}
+	if !isOverlayOpaque(n.Xattrs) {
+		return w.fs.CreateDir(n)
+	}
+	xa := make(Xattrs)
+	for k, v := range n.Xattrs {
+		if k != overlayOpaqueAttr && k != overlayUserOpaqueAttr {
+			xa[k] = v
+		}
+	}
+	n.Xattrs = xa
+	if err := w.fs.CreateDir(n); err != nil {
+		return err
+	}
+	return w.fs.CreateFile(NodeFile{
+		Name:  path.Join(n.Name, ociWhiteoutOpaque),
+		UID:   n.UID,
+		GID:   n.GID,
+		Mode:  0,
+		MTime: n.MTime,
+		Data:  strings.NewReader(""),
+	})
+}
+
+// CreateFile writes a file, or converts it if it's an OCI whiteout.
+func (w *WhiteoutFS) CreateFile(n NodeFile) error {
+	dir, base := path.Split(n.Name)
+	if w.format != WhiteoutOverlayFS || !strings.HasPrefix(base, ociWhiteoutPrefix) {
+		return w.fs.CreateFile(n)
+	}
+	// Whiteout files are empty, but make sure the data is consumed
+	if _, err := io.Copy(ioutil.Discard, n.Data); err != nil {
+		return err
+	}
+
+	// Mark the parent directory as opaque by writing it again with the xattr
+	if base == ociWhiteoutOpaque {
+		parent := path.Clean(dir)
+		w.mu.Lock()
+		d, ok := w.dirs[parent]
+		if !ok {
+			d = NodeDirectory{Name: parent, UID: n.UID, GID: n.GID, Mode: os.ModeDir | 0755, MTime: n.MTime}
+		}
+		xa := Xattrs{overlayOpaqueAttr: "y"}
+		for k, v := range d.Xattrs {
+			xa[k] = v
+		}
+		d.Xattrs = xa
+		w.dirs[parent] = d
+		w.mu.Unlock()
+		return w.fs.CreateDir(d)
+	}
+
+	return w.fs.CreateDevice(NodeDevice{
+		Name:  path.Join(dir, strings.TrimPrefix(base, ociWhiteoutPrefix)),
+		UID:   n.UID,
+		GID:   n.GID,
+		Mode:  os.ModeDevice | os.ModeCharDevice,
+		MTime: n.MTime,
+	})
+}
+
+// CreateSymlink passes symlinks through unchanged.
+func (w *WhiteoutFS) CreateSymlink(n NodeSymlink) error {
+	return w.fs.CreateSymlink(n)
+}
+
+// CreateDevice writes a device, or converts it if it's an OverlayFS whiteout.
+func (w *WhiteoutFS) CreateDevice(n NodeDevice) error {
+	if w.format != WhiteoutOCI || !isOverlayWhiteout(n) {
+		return w.fs.CreateDevice(n)
+	}
+	dir, base := path.Split(n.Name)
+	return w.fs.CreateFile(NodeFile{
+		Name:  path.Join(dir, ociWhiteoutPrefix+base),
+		UID:   n.UID,
+		GID:   n.GID,
+		Mode:  0,
+		MTime: n.MTime,
+		Data:  strings.NewReader(""),
+	})
+}
+
+func isOverlayWhiteout(n NodeDevice) bool {
+	return n.Mode&os.ModeCharDevice != 0 && n.Major == 0 && n.Minor == 0
+}
+
+func isOverlayOpaque(xa Xattrs) bool {
+	return xa[overlayOpaqueAttr] == "y" || xa[overlayUserOpaqueAttr] == "y"
+}
@@ -0,0 +1,68 @@
+package desync
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Records the nodes written to it
+type recordingFS struct {
+	nodes []interface{}
+}
+
+func (fs *recordingFS) CreateDir(n NodeDirectory) error {
+	fs.nodes = append(fs.nodes, n)
+	return nil
+}
+
+func (fs *recordingFS) CreateFile(n NodeFile) error {
+	n.Data = nil
+	fs.nodes = append(fs.nodes, n)
+	return nil
+}
+
+func (fs *recordingFS) CreateSymlink(n NodeSymlink) error {
+	fs.nodes = append(fs.nodes, n)
+	return nil
+}
+
+func (fs *recordingFS) CreateDevice(n NodeDevice) error {
+	fs.nodes = append(fs.nodes, n)
+	return nil
+}
+
+func TestWhiteoutFSToOCI(t *testing.T) {
+	rec := new(recordingFS)
+	fs := NewWhiteoutFS(rec, WhiteoutOCI)
+
+	require.NoError(t, fs.CreateDir(NodeDirectory{Name: "dir", Mode: os.ModeDir | 0755, Xattrs: Xattrs{"trusted.overlay.opaque": "y", "user.other": "x"}}))
+	require.NoError(t, fs.CreateDevice(NodeDevice{Name: "dir/deleted", Mode: os.ModeDevice | os.ModeCharDevice}))
+	require.NoError(t, fs.CreateDevice(NodeDevice{Name: "dir/null", Mode: os.ModeDevice | os.ModeCharDevice | 0666, Major: 1, Minor: 3}))
+
+	require.Equal(t, []interface{}{
+		NodeDirectory{Name: "dir", Mode: os.ModeDir | 0755, Xattrs: Xattrs{"user.other": "x"}},
+		NodeFile{Name: "dir/.wh..wh..opq"},
+		NodeFile{Name: "dir/.wh.deleted"},
+		NodeDevice{Name: "dir/null", Mode: os.ModeDevice | os.ModeCharDevice | 0666, Major: 1, Minor: 3},
+	}, rec.nodes)
+}
+
+func TestWhiteoutFSToOverlayFS(t *testing.T) {
+	rec := new(recordingFS)
+	fs := NewWhiteoutFS(rec, WhiteoutOverlayFS)
+
+	require.NoError(t, fs.CreateDir(NodeDirectory{Name: "dir", Mode: os.ModeDir | 0755}))
+	require.NoError(t, fs.CreateFile(NodeFile{Name: "dir/.wh..wh..opq", Data: strings.NewReader("")}))
+	require.NoError(t, fs.CreateFile(NodeFile{Name: "dir/.wh.deleted", Data: strings.NewReader("")}))
+	require.NoError(t, fs.CreateFile(NodeFile{Name: "dir/file", Size: 4, Data: strings.NewReader("data")}))
+
+	require.Equal(t, []interface{}{
+		NodeDirectory{Name: "dir", Mode: os.ModeDir | 0755},
+		NodeDirectory{Name: "dir", Mode: os.ModeDir | 0755, Xattrs: Xattrs{"trusted.overlay.opaque": "y"}},
+		NodeDevice{Name: "dir/deleted", Mode: os.ModeDevice | os.ModeCharDevice},
+		NodeFile{Name: "dir/file", Size: 4},
+	}, rec.nodes)
+}